@@ -0,0 +1,17 @@
+#!/bin/sh -e
+# Applies the censor rules inside the tests container, then runs the tests.
+
+# the RST injector, every connection to the reset origin is torn down
+iptables -A OUTPUT -d ${RESET_IP} -p tcp --dport 443 -j REJECT --reject-with tcp-reset
+
+# the throttler, a flow from the throttle origin loses most of its packets
+# once it has carried 256KB, like a QoS box collapsing a bulk transfer
+iptables -A INPUT -s ${THROTTLE_IP} -p tcp --sport 443 \
+	-m connbytes --connbytes 262144: --connbytes-dir reply --connbytes-mode bytes \
+	-m statistic --mode random --probability 0.8 -j DROP
+
+# the origins serve a certificate of the test CA
+cp /certs/ca.pem /usr/local/share/ca-certificates/goproxy-test.crt
+update-ca-certificates
+
+exec go test -v -tags integration ./httpproxy/integration
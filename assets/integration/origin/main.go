@@ -0,0 +1,43 @@
+// origin is the TLS server behind the simulated censor, /big streams a body
+// large enough for the throttler to kick in.
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+func main() {
+	addr := flag.String("addr", ":443", "listen address")
+	cert := flag.String("cert", "server.pem", "certificate file")
+	key := flag.String("key", "server.key", "private key file")
+	flag.Parse()
+
+	http.HandleFunc("/", func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "ok\n")
+	})
+
+	http.HandleFunc("/big", func(rw http.ResponseWriter, req *http.Request) {
+		size := 16 * 1024 * 1024
+		if n, err := strconv.Atoi(req.URL.Query().Get("size")); err == nil && n > 0 {
+			size = n
+		}
+		rw.Header().Set("Content-Length", strconv.Itoa(size))
+		buf := make([]byte, 32*1024)
+		for size > 0 {
+			n := len(buf)
+			if n > size {
+				n = size
+			}
+			if _, err := rw.Write(buf[:n]); err != nil {
+				return
+			}
+			size -= n
+		}
+	})
+
+	log.Fatal(http.ListenAndServeTLS(*addr, *cert, *key, nil))
+}
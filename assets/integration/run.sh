@@ -0,0 +1,18 @@
+#!/bin/bash -e
+# Runs the integration tests against the simulated hostile network.
+
+cd "$(dirname "$0")"
+
+if [ ! -f certs/ca.pem ]; then
+	mkdir -p certs
+	openssl req -x509 -newkey rsa:2048 -nodes -days 3650 -subj "/CN=GoProxy Test CA" \
+		-keyout certs/ca.key -out certs/ca.pem
+	openssl req -newkey rsa:2048 -nodes -subj "/CN=good.test" \
+		-keyout certs/server.key -out certs/server.csr
+	printf "subjectAltName=DNS:*.test,DNS:good.test,DNS:reset.test,DNS:throttle.test\n" >certs/san.ext
+	openssl x509 -req -days 3650 -in certs/server.csr -CA certs/ca.pem -CAkey certs/ca.key \
+		-CAcreateserial -extfile certs/san.ext -out certs/server.pem
+fi
+
+trap "docker compose down -v" EXIT
+docker compose up --build --abort-on-container-exit --exit-code-from tests
@@ -128,6 +128,13 @@ function build_repo() {
 		make clean
 	done
 
+	for OSARCH in linux/amd64 linux/arm64
+	do
+		make server GOOS=${OSARCH%/*} GOARCH=${OSARCH#*/}
+		cp -r build/dist/* ${WORKING_DIR}/r${RELEASE}
+		make clean
+	done
+
 	(cd ${WORKING_DIR}/r${RELEASE}/ && ls -lht)
 
 	popd
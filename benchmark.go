@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"./httpproxy/dialer"
+	"./httpproxy/filters"
+)
+
+// benchmarkResult is the -json output of benchmark.
+type benchmarkResult struct {
+	Command string                 `json:"command"`
+	Filter  string                 `json:"filter"`
+	Alias   string                 `json:"alias"`
+	Source  string                 `json:"source"`
+	Good    int                    `json:"good"`
+	Addrs   []dialer.AddrBenchmark `json:"addrs"`
+}
+
+// benchmarkCommand is "goproxy benchmark", it dials every ip of -alias,
+// measures the connect, the TLS handshake and a small GET over it, and
+// prints them ranked. With -admin it runs in a running goproxy, whose
+// duration caches are seeded with the results, otherwise in this process,
+// which can save them to the ConnCache file of the filter with -conncache.
+func benchmarkCommand(args []string) int {
+	fs := flag.NewFlagSet("benchmark", flag.ExitOnError)
+	filterName := fs.String("filter", "gae", "the filter whose dialer is benchmarked")
+	alias := fs.String("alias", "", "the alias whose ips are benchmarked, e.g. google_hk")
+	host := fs.String("host", "", "the SNI and Host of the GET, the first hostname of the alias if empty")
+	path := fs.String("path", "/", "the path of the GET")
+	concurrency := fs.Int("c", 8, "the number of concurrent dials")
+	timeout := fs.Duration("timeout", 10*time.Second, "the timeout of each ip")
+	admin := fs.String("admin", "", "the admin api of a running goproxy, e.g. http://127.0.0.1:8087/admin/api/")
+	token := fs.String("token", "1", "the Token of the admin filter, sent in the X-Goproxy-Admin header")
+	connCache := fs.String("conncache", "", "save the dialer caches to this ConnCache file, e.g. the ConnCache.Filename of gae.json")
+	asJSON := fs.Bool("json", false, "write the results as json instead of a table")
+	fs.Parse(args)
+
+	if *alias == "" {
+		fmt.Fprintf(os.Stderr, "usage: goproxy benchmark -alias google_hk [options]\n")
+		fs.PrintDefaults()
+		return 2
+	}
+
+	result := benchmarkResult{
+		Command: "benchmark",
+		Filter:  *filterName,
+		Alias:   *alias,
+	}
+
+	if *admin != "" {
+		u := strings.TrimSuffix(*admin, "/") + "/" + *filterName + "/benchmark?" + url.Values{
+			"alias":   {*alias},
+			"host":    {*host},
+			"path":    {*path},
+			"c":       {fmt.Sprintf("%d", *concurrency)},
+			"timeout": {fmt.Sprintf("%d", int(timeout.Seconds()))},
+		}.Encode()
+		addrs, err := postBenchmark(u, *token, *timeout)
+		if err != nil {
+			return failCommand("benchmark", *asJSON, err)
+		}
+		result.Source = u
+		result.Addrs = addrs
+	} else {
+		f, err := filters.GetFilter(*filterName)
+		if err != nil {
+			return failCommand("benchmark", *asJSON, err)
+		}
+		f1, ok := f.(interface {
+			MultiDialer() *dialer.MultiDialer
+		})
+		if !ok || f1.MultiDialer() == nil {
+			return failCommand("benchmark", *asJSON, fmt.Errorf("filter %#v has no MultiDialer", *filterName))
+		}
+		d := f1.MultiDialer()
+
+		b := &dialer.AliasBenchmark{
+			MultiDialer: d,
+			Alias:       *alias,
+			Host:        *host,
+			Path:        *path,
+			Concurrency: *concurrency,
+			Timeout:     *timeout,
+		}
+		if result.Addrs, err = b.Run(); err != nil {
+			return failCommand("benchmark", *asJSON, err)
+		}
+		result.Source = "local"
+
+		if *connCache != "" {
+			if err = d.SaveConnCache(*connCache); err != nil {
+				return failCommand("benchmark", *asJSON, err)
+			}
+		}
+	}
+
+	for _, a := range result.Addrs {
+		if a.Error == "" {
+			result.Good++
+		}
+	}
+
+	if *asJSON {
+		writeJSON(result)
+		return 0
+	}
+
+	if err := dialer.WriteAddrBenchmarks(os.Stdout, result.Addrs); err != nil {
+		return failCommand("benchmark", false, err)
+	}
+	fmt.Fprintf(os.Stderr, "benchmark: %d of %d ips of alias %#v answered\n", result.Good, len(result.Addrs), *alias)
+	if *connCache != "" && *admin == "" {
+		fmt.Fprintf(os.Stderr, "benchmark: saved the dialer caches to %s\n", *connCache)
+	}
+
+	return 0
+}
+
+func postBenchmark(u, token string, timeout time.Duration) ([]dialer.AddrBenchmark, error) {
+	// the ips are dialed in rounds of -c, so leave room for a few of them
+	client := &http.Client{Timeout: 10*timeout + 10*time.Second}
+	req, err := http.NewRequest(http.MethodPost, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Goproxy-Admin", token)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return nil, fmt.Errorf("POST %s: %s %s", u, resp.Status, e.Error)
+	}
+
+	addrs := make([]dialer.AddrBenchmark, 0)
+	if err := json.NewDecoder(resp.Body).Decode(&addrs); err != nil {
+		return nil, fmt.Errorf("POST %s: %v", u, err)
+	}
+	return addrs, nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"./httpproxy/filters"
+)
+
+const (
+	// the user.js lines written by "goproxy cert install" end with it, so
+	// that uninstall only removes ours
+	userJSMarker string = "// goproxy cert install"
+)
+
+type certStoreResult struct {
+	Store string `json:"store"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// certResult is the -json output of cert install.
+type certResult struct {
+	Command     string            `json:"command"`
+	Action      string            `json:"action"`
+	Name        string            `json:"name"`
+	Cert        string            `json:"cert"`
+	Fingerprint string            `json:"sha1"`
+	Stores      []certStoreResult `json:"stores"`
+	Failed      int               `json:"failed"`
+}
+
+// certCommand is "goproxy cert install", it installs the root CA of stripssl
+// into the OS store, which Chrome and Edge use, and into the NSS databases of
+// Firefox and of Chrome on linux. -uninstall removes it from all of them.
+func certCommand(args []string) int {
+	if len(args) == 0 || args[0] != "install" {
+		fmt.Fprintf(os.Stderr, "usage: goproxy cert install [-uninstall] [options]\n")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("cert install", flag.ExitOnError)
+	name := fs.String("name", "GoProxy", "the name of the root CA, RootCA.Name of stripssl.json")
+	certFile := fs.String("cert", "", "the root CA certificate, <name>.crt if empty")
+	uninstall := fs.Bool("uninstall", false, "remove the root CA instead")
+	asJSON := fs.Bool("json", false, "write the result as json")
+	fs.Parse(args[1:])
+
+	if *certFile == "" {
+		*certFile = *name + ".crt"
+	}
+
+	if _, err := os.Stat(*certFile); os.IsNotExist(err) && !*uninstall {
+		// stripssl generates the root CA when it is created
+		if _, err := filters.GetFilter("stripssl"); err != nil {
+			return failCommand("cert", *asJSON, fmt.Errorf("generate root CA error: %s", err))
+		}
+	}
+
+	data, err := ioutil.ReadFile(*certFile)
+	if err != nil {
+		return failCommand("cert", *asJSON, err)
+	}
+	b, _ := pem.Decode(data)
+	if b == nil || b.Type != "CERTIFICATE" {
+		return failCommand("cert", *asJSON, fmt.Errorf("no certificate found in %#v", *certFile))
+	}
+	fingerprint := sha1.Sum(b.Bytes)
+
+	result := certResult{
+		Command:     "cert",
+		Action:      "install",
+		Name:        *name,
+		Cert:        *certFile,
+		Fingerprint: hex.EncodeToString(fingerprint[:]),
+		Stores:      make([]certStoreResult, 0),
+	}
+	if *uninstall {
+		result.Action = "uninstall"
+	}
+
+	report := func(store string, err error) {
+		r := certStoreResult{Store: store, OK: err == nil}
+		if err != nil {
+			result.Failed++
+			r.Error = err.Error()
+		}
+		result.Stores = append(result.Stores, r)
+		switch {
+		case *asJSON:
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "%s %s: %s\n", result.Action, store, err)
+		default:
+			fmt.Printf("%s %s: OK\n", result.Action, store)
+		}
+	}
+
+	report("system store", systemCA(*name, *certFile, result.Fingerprint, *uninstall))
+
+	certutil, err := nssCertutil()
+	for _, db := range nssDatabases() {
+		if err != nil {
+			// Firefox reads the OS store if it is told to
+			// strip "sql:" or "dbm:"
+			if profile := db[4:]; isFirefoxProfile(profile) {
+				report(profile, setEnterpriseRoots(profile, !*uninstall))
+			} else {
+				report(db, err)
+			}
+			continue
+		}
+		report(db, nssCA(certutil, db, *name, *certFile, *uninstall))
+	}
+
+	if *asJSON {
+		writeJSON(result)
+	}
+	if result.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func runCommand(name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %v %s", strings.Join(cmd.Args, " "), err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+// systemCA installs certFile into the OS store, it needs to run as root or
+// administrator.
+func systemCA(name, certFile, fingerprint string, uninstall bool) error {
+	switch runtime.GOOS {
+	case "windows":
+		// the same certmgr.exe stripssl imports the generated root CA with
+		runCommand("certmgr.exe", "-del", "-c", "-n", name, "-s", "-r", "localMachine", "root")
+		if uninstall {
+			return nil
+		}
+		return runCommand("certmgr.exe", "-add", "-c", certFile, "-s", "-r", "localMachine", "root")
+	case "darwin":
+		const keychain = "/Library/Keychains/System.keychain"
+		if uninstall {
+			runCommand("security", "remove-trusted-cert", "-d", certFile)
+			return runCommand("security", "delete-certificate", "-Z", strings.ToUpper(fingerprint), keychain)
+		}
+		return runCommand("security", "add-trusted-cert", "-d", "-r", "trustRoot", "-k", keychain, certFile)
+	case "linux":
+		anchors := []struct {
+			dir    string
+			update []string
+		}{
+			{"/usr/local/share/ca-certificates", []string{"update-ca-certificates", "--fresh"}},
+			{"/etc/pki/ca-trust/source/anchors", []string{"update-ca-trust", "extract"}},
+			{"/etc/ca-certificates/trust-source/anchors", []string{"trust", "extract-compat"}},
+		}
+		for _, a := range anchors {
+			if fi, err := os.Stat(a.dir); err != nil || !fi.IsDir() {
+				continue
+			}
+			filename := filepath.Join(a.dir, strings.ToLower(name)+".crt")
+			if uninstall {
+				if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			} else {
+				data, err := ioutil.ReadFile(certFile)
+				if err != nil {
+					return err
+				}
+				if err = ioutil.WriteFile(filename, data, 0644); err != nil {
+					return err
+				}
+			}
+			return runCommand(a.update[0], a.update[1:]...)
+		}
+		return fmt.Errorf("no known ca-certificates directory")
+	default:
+		return fmt.Errorf("unsupported os %#v", runtime.GOOS)
+	}
+}
+
+// nssCertutil returns the certutil of NSS, the one of windows is another
+// tool of the same name.
+func nssCertutil() (string, error) {
+	if runtime.GOOS == "windows" {
+		return "", fmt.Errorf("no NSS certutil on windows")
+	}
+	path, err := exec.LookPath("certutil")
+	if err != nil {
+		return "", fmt.Errorf("NSS certutil not found, install libnss3-tools or nss-tools")
+	}
+	return path, nil
+}
+
+// nssDatabases returns the NSS databases of the Firefox profiles and of
+// Chrome on linux, as "sql:dir" or "dbm:dir".
+func nssDatabases() []string {
+	home, _ := os.UserHomeDir()
+
+	patterns := make([]string, 0)
+	switch runtime.GOOS {
+	case "windows":
+		patterns = append(patterns, filepath.Join(os.Getenv("APPDATA"), "Mozilla", "Firefox", "Profiles", "*"))
+	case "darwin":
+		patterns = append(patterns, filepath.Join(home, "Library", "Application Support", "Firefox", "Profiles", "*"))
+	default:
+		patterns = append(patterns,
+			filepath.Join(home, ".pki", "nssdb"),
+			filepath.Join(home, ".mozilla", "firefox", "*"),
+			filepath.Join(home, "snap", "firefox", "common", ".mozilla", "firefox", "*"),
+			filepath.Join(home, ".var", "app", "org.mozilla.firefox", ".mozilla", "firefox", "*"))
+	}
+
+	dbs := make([]string, 0)
+	for _, pattern := range patterns {
+		dirs, _ := filepath.Glob(pattern)
+		for _, dir := range dirs {
+			switch {
+			case isFile(filepath.Join(dir, "cert9.db")):
+				dbs = append(dbs, "sql:"+dir)
+			case isFile(filepath.Join(dir, "cert8.db")):
+				dbs = append(dbs, "dbm:"+dir)
+			}
+		}
+	}
+	return dbs
+}
+
+func nssCA(certutil, db, name, certFile string, uninstall bool) error {
+	// -D fails if it is not there, which is fine for both
+	runCommand(certutil, "-D", "-d", db, "-n", name)
+	if uninstall {
+		return nil
+	}
+	return runCommand(certutil, "-A", "-d", db, "-t", "C,,", "-n", name, "-i", certFile)
+}
+
+func isFile(filename string) bool {
+	fi, err := os.Stat(filename)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+func isFirefoxProfile(dir string) bool {
+	return isFile(filepath.Join(dir, "prefs.js"))
+}
+
+// setEnterpriseRoots makes Firefox trust the OS store through user.js of
+// profile, for the systems without NSS certutil.
+func setEnterpriseRoots(profile string, enable bool) error {
+	filename := filepath.Join(profile, "user.js")
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	lines := make([]string, 0)
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		if len(data) > 0 && !strings.HasSuffix(line, userJSMarker) {
+			lines = append(lines, line)
+		}
+	}
+	if enable {
+		lines = append(lines, `user_pref("security.enterprise_roots.enabled", true); `+userJSMarker)
+	}
+
+	if len(lines) == 0 {
+		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// The -json output of the subcommands is a single object on stdout. Fields
+// are only ever added to it, so that scripts keep working across versions.
+// A failed command prints {"error": "..."} and exits non zero.
+
+type commandError struct {
+	Command string `json:"command"`
+	Error   string `json:"error"`
+}
+
+func writeJSON(v interface{}) error {
+	e := json.NewEncoder(os.Stdout)
+	e.SetIndent("", "  ")
+	return e.Encode(v)
+}
+
+// failCommand reports err of command on stderr, or on stdout as json if
+// asJSON, and returns the exit code.
+func failCommand(command string, asJSON bool, err error) int {
+	if asJSON {
+		writeJSON(commandError{command, err.Error()})
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", command, err)
+	}
+	return 1
+}
@@ -0,0 +1,86 @@
+// goproxy-embed is an example of a program which embeds the whole proxy by
+// httpproxy.New instead of running goproxy, it serves the Default profile of
+// httpproxy.json with a filter of its own in front, e.g.
+//
+//	CONFIG_STORE_URI=file:///etc/goproxy goproxy-embed -addr 127.0.0.1:8087
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../../httpproxy"
+)
+
+// blockFilter answers the requests to the blocked hosts itself, and passes
+// the others on to the filters of the profile.
+type blockFilter struct {
+	hosts map[string]bool
+}
+
+func (f *blockFilter) FilterName() string {
+	return "block"
+}
+
+func (f *blockFilter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	if !f.hosts[req.Host] {
+		return ctx, nil, nil
+	}
+
+	glog.Infof("%s \"BLOCK %s %s %s\"", req.RemoteAddr, req.Method, req.URL.String(), req.Proto)
+	return ctx, &http.Response{
+		StatusCode: http.StatusForbidden,
+		Header:     http.Header{},
+		Request:    req,
+		Close:      true,
+	}, nil
+}
+
+func main() {
+	addr := flag.String("addr", "127.0.0.1:8087", "listen address")
+	profile := flag.String("profile", "Default", "profile of httpproxy.json")
+	block := flag.String("block", "", "a host answered with 403, e.g. ads.example.com")
+	flag.Parse()
+
+	config, ok := httpproxy.Config[*profile]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "profile %#v not exists\n", *profile)
+		os.Exit(1)
+	}
+
+	f := &blockFilter{hosts: map[string]bool{*block: true}}
+	p, err := httpproxy.New(config, httpproxy.WithName(*profile), httpproxy.WithFilter(f))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+		<-c
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		p.Shutdown(ctx)
+	}()
+
+	if err := p.Serve(ln); err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// The encodings must match httpproxy/filters/gae, which is the client of this
+// server, the obfuscation is the one of helpers.NewObfuscator.
+
+const (
+	EncodingFlate  string = "deflate"
+	EncodingBrotli string = "br"
+	EncodingZstd   string = "zstd"
+)
+
+// acceptEncodings is the Accept-Encoding of the 415 to a fetch in another
+// encoding, which makes the client fall back to flate.
+const acceptEncodings string = EncodingFlate + ", " + EncodingBrotli + ", " + EncodingZstd
+
+func supportedEncoding(encoding string) bool {
+	switch encoding {
+	case "", EncodingFlate, EncodingBrotli, EncodingZstd:
+		return true
+	}
+	return false
+}
+
+func newEncoder(w io.Writer, encoding string) (io.WriteCloser, error) {
+	switch encoding {
+	case "", EncodingFlate:
+		return flate.NewWriter(w, flate.DefaultCompression)
+	case EncodingBrotli:
+		return brotli.NewWriterLevel(w, brotli.DefaultCompression), nil
+	case EncodingZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	default:
+		return nil, fmt.Errorf("unsupported urlfetch encoding %#v", encoding)
+	}
+}
+
+func newDecoder(r io.Reader, encoding string) (io.ReadCloser, error) {
+	switch encoding {
+	case "", EncodingFlate:
+		return flate.NewReader(r), nil
+	case EncodingBrotli:
+		return ioutil.NopCloser(brotli.NewReader(r)), nil
+	case EncodingZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zstdReadCloser{d}, nil
+	default:
+		return nil, fmt.Errorf("unsupported urlfetch encoding %#v", encoding)
+	}
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (r zstdReadCloser) Close() error {
+	r.Decoder.Close()
+	return nil
+}
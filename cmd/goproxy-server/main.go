@@ -0,0 +1,224 @@
+// goproxy-server is the fetch server of the gae filter for a VPS, it speaks
+// the same urlfetch protocol as the server-side scripts, so gae.json only
+// needs its url in FetchServers and its -password in Password, e.g.
+//
+//	"FetchServers": ["https://vps.example.org/_gh/"]
+//
+// With a -password the fetches must be signed by it, "SignRequest" of gae.json.
+// More clients, each with its own KeyID and Password, are listed in -keyfile,
+// one "id:secret" per line, e.g.
+//
+//	laptop:0123456789abcdef
+//	phone:fedcba9876543210
+//
+// Without any of -password, -keyfile and -clientca it refuses to start unless
+// -insecure is set. Loopback, link-local and private addresses are never
+// fetched unless -allowprivate is set.
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../../httpproxy/helpers"
+)
+
+var (
+	version = "r9999"
+)
+
+func main() {
+
+	logToStderr := true
+	for i := 1; i < len(os.Args); i++ {
+		if strings.HasPrefix(os.Args[i], "-logtostderr=") {
+			logToStderr = false
+			break
+		}
+	}
+	if logToStderr {
+		flag.Set("logtostderr", "true")
+	}
+
+	addr := flag.String("addr", ":443", "listen address")
+	cert := flag.String("cert", "", "certificate file, serve plain http if empty")
+	key := flag.String("key", "", "private key file")
+	clientCA := flag.String("clientca", "", "CA certificates file, only the clients with a certificate signed by them are served")
+	path := flag.String("path", "/_gh/", "path of the fetch url")
+	password := flag.String("password", "", "password of the fetch requests, empty accepts all if -keyfile is empty too")
+	keyID := flag.String("keyid", "", "key id of -password, the KeyID of the clients")
+	keyFile := flag.String("keyfile", "", "file of more accepted keys, one \"id:secret\" per line")
+	obfuscateKey := flag.String("obfuscatekey", "", "secret of obfuscated fetches, defaults to password")
+	deadline := flag.Duration("deadline", 30*time.Second, "deadline of the response header of a fetch if the client sets none")
+	quota := flag.Int64("quota", 0, "MB of responses served per day, 0 is unlimited")
+	ipQuota := flag.Int64("ipquota", 0, "MB of responses served per day to each client ip, 0 is unlimited")
+	tunnel := flag.Bool("tunnel", false, "serve CONNECT tunnels at <path>tunnel, for the TunnelURL of the php filter")
+	insecure := flag.Bool("insecure", false, "serve without -password, -keyfile and -clientca, anyone can fetch through it")
+	allowPrivate := flag.Bool("allowprivate", false, "fetch and tunnel to loopback, link-local and private addresses too")
+	decoyRoot := flag.String("decoyroot", "", "directory of the site served to the requests which are not fetches, a nginx welcome page if empty")
+	pidfile := flag.String("pidfile", "", "pid file")
+	showVersion := flag.Bool("version", false, "print the version and exit")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(version)
+		return
+	}
+
+	if *pidfile != "" {
+		if err := ioutil.WriteFile(*pidfile, []byte(strconv.Itoa(os.Getpid())), 0644); err != nil {
+			glog.Fatalf("goproxy-server: write pidfile %#v error: %+v", *pidfile, err)
+		}
+		defer os.Remove(*pidfile)
+	}
+
+	var keys []helpers.SignatureKey
+	if *password != "" {
+		keys = append(keys, helpers.SignatureKey{ID: *keyID, Secret: *password})
+	}
+	if *keyFile != "" {
+		keys1, err := readKeyFile(*keyFile)
+		if err != nil {
+			glog.Fatalf("goproxy-server: read -keyfile %#v error: %+v", *keyFile, err)
+		}
+		keys = append(keys, keys1...)
+	}
+
+	if len(keys) == 0 && *clientCA == "" {
+		if !*insecure {
+			glog.Fatalf("goproxy-server: no -password, -keyfile or -clientca is set, pass -insecure to let anyone fetch through %s", *addr)
+		}
+		glog.Warningf("goproxy-server: no password is set, anyone can fetch through %s", *addr)
+	}
+
+	var verifier *helpers.SignatureVerifier
+	if len(keys) > 0 {
+		verifier = helpers.NewSignatureVerifier(nil, 0)
+		for _, key := range keys {
+			verifier.AddKey("", key)
+		}
+	}
+
+	s := &Server{
+		Password:     *password,
+		Verifier:     verifier,
+		ObfuscateKey: *obfuscateKey,
+		Deadline:     *deadline,
+		Quota:        NewQuota(*quota*1024*1024, *ipQuota*1024*1024),
+		AllowPrivate: *allowPrivate,
+		Transport: &http.Transport{
+			Proxy:               nil,
+			DialContext:         newDialer(30*time.Second, *allowPrivate).DialContext,
+			DisableCompression:  true,
+			MaxIdleConnsPerHost: 8,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 10 * time.Second,
+		},
+	}
+
+	// probes and unsigned requests only ever see an ordinary web server
+	decoy := helpers.NewDecoyHandler(*decoyRoot)
+
+	mux := http.NewServeMux()
+	mux.Handle(*path, helpers.NewCamouflageHandler(s.Authorized, s, decoy))
+	if *tunnel {
+		tunnelPath := strings.TrimSuffix(*path, "/") + "/tunnel"
+		t := NewTunnel(verifier, s.Quota, 10*time.Second)
+		t.AllowPrivate = *allowPrivate
+		mux.Handle(tunnelPath, helpers.NewCamouflageHandler(t.Authorized, t, decoy))
+		glog.Infof("goproxy-server: serve CONNECT tunnels at %#v", tunnelPath)
+	}
+	mux.Handle("/", decoy)
+
+	var tlsConfig *tls.Config
+	if *cert != "" {
+		certificate, err := tls.LoadX509KeyPair(*cert, *key)
+		if err != nil {
+			glog.Fatalf("goproxy-server: load -cert %#v error: %+v", *cert, err)
+		}
+		tlsConfig = &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			NextProtos:   []string{"h2", "http/1.1"},
+		}
+	} else {
+		glog.Warningf("goproxy-server: no -cert is set, serve plain http")
+	}
+
+	if *clientCA != "" {
+		if tlsConfig == nil {
+			glog.Fatalf("goproxy-server: -clientca needs -cert")
+		}
+		data, err := ioutil.ReadFile(*clientCA)
+		if err != nil {
+			glog.Fatalf("goproxy-server: read -clientca %#v error: %+v", *clientCA, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			glog.Fatalf("goproxy-server: no certificates in -clientca %#v", *clientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		glog.Infof("goproxy-server: require client certificates signed by %#v", *clientCA)
+	}
+
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		glog.Fatalf("goproxy-server: listen on %s error: %+v", *addr, err)
+	}
+
+	// malformed requests, and plain http to https, get the 400 of nginx too
+	dl := helpers.NewDecoyListener(ln, tlsConfig, decoy)
+
+	server := &http.Server{
+		Handler:           dl.Handler(mux),
+		ConnContext:       dl.ConnContext,
+		ReadHeaderTimeout: 30 * time.Second,
+		IdleTimeout:       5 * time.Minute,
+	}
+
+	glog.Infof("goproxy-server %s listen on %s, fetch path %#v", version, *addr, *path)
+
+	err = server.Serve(dl)
+	glog.Fatalf("goproxy-server: %+v", err)
+}
+
+// readKeyFile reads the "id:secret" lines of filename, blank lines and the
+// lines starting with "#" are skipped. A line without ":" is a secret without
+// an id.
+func readKeyFile(filename string) ([]helpers.SignatureKey, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]helpers.SignatureKey, 0)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var key helpers.SignatureKey
+		if n := strings.IndexByte(line, ':'); n >= 0 {
+			key.ID, key.Secret = line[:n], line[n+1:]
+		} else {
+			key.Secret = line
+		}
+		if key.Secret == "" {
+			return nil, fmt.Errorf("line %d: empty secret", i+1)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
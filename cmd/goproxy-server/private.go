@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// the shared address space of carrier-grade NAT, some clouds serve their
+// metadata there, e.g. 100.100.100.200
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0).To4(), Mask: net.CIDRMask(10, 32)}
+
+// privateIP reports whether ip is of the networks around the server rather
+// than of the internet, i.e. loopback, link-local (169.254.169.254 of cloud
+// metadata), private, shared or unspecified.
+func privateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsPrivate() || ip.IsUnspecified() ||
+		sharedAddressSpace.Contains(ip)
+}
+
+// privateHost reports whether host is a private ip or a name of localhost,
+// the names which resolve to private ips are refused by refusePrivate.
+func privateHost(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && privateIP(ip)
+}
+
+// refusePrivate is the Control of the dialers of the fetches and the
+// tunnels, it sees the resolved address, so neither a name nor a redirect
+// leads to a private one.
+func refusePrivate(network, address string, c syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(host); ip == nil || privateIP(ip) {
+		return fmt.Errorf("dial %s: refused private address", address)
+	}
+	return nil
+}
+
+// newDialer returns the dialer of the fetches and the tunnels, which refuses
+// the private addresses unless allowPrivate.
+func newDialer(timeout time.Duration, allowPrivate bool) *net.Dialer {
+	d := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+	}
+	if !allowPrivate {
+		d.Control = refusePrivate
+	}
+	return d
+}
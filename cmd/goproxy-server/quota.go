@@ -0,0 +1,54 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Quota counts the response bytes served in the current UTC day, in total
+// and by client ip. A fetch over quota gets 503, which the gae filter takes
+// as an appid over quota and switches to its next fetch server.
+type Quota struct {
+	Limit   int64
+	IPLimit int64
+
+	mu   sync.Mutex
+	day  string
+	used int64
+	ips  map[string]int64
+}
+
+func NewQuota(limit, ipLimit int64) *Quota {
+	return &Quota{
+		Limit:   limit,
+		IPLimit: ipLimit,
+		ips:     make(map[string]int64),
+	}
+}
+
+func (q *Quota) reset() {
+	if day := time.Now().UTC().Format("2006-01-02"); day != q.day {
+		q.day, q.used = day, 0
+		q.ips = make(map[string]int64)
+	}
+}
+
+// Exceeded reports whether ip, or the server, is over quota today.
+func (q *Quota) Exceeded(ip string) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.reset()
+	return (q.Limit > 0 && q.used >= q.Limit) || (q.IPLimit > 0 && q.ips[ip] >= q.IPLimit)
+}
+
+func (q *Quota) Add(ip string, n int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.reset()
+	q.used += n
+	if q.IPLimit > 0 {
+		q.ips[ip] += n
+	}
+}
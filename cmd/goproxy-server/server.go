@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../../httpproxy/helpers"
+)
+
+const (
+	// the client only encodes bodies up to 8MB
+	maxEncodedBodySize int64 = 8 * 1024 * 1024
+	maxHeaderSize      int64 = 1024 * 1024
+	maxRedirects       int   = 10
+)
+
+var hopHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// Server serves the fetches of the gae filter:
+//
+//   - the POST body is a 2 bytes big endian length, the header block of the
+//     fetch compressed by X-Urlfetch-Encoding, and the body of the fetch,
+//     compressed by X-Urlfetch-Body-Encoding if it is set, another encoding
+//     is answered 415 with the supported ones in Accept-Encoding
+//   - the header block is a request line and the headers of the fetch,
+//     followed by the X-Urlfetch-Password or -Signature, -Deadline,
+//     -Redirect, -MaxSize and -Padding headers
+//   - a padding chunk of X-Urlfetch-Padding-Body bytes may come between the
+//     header block and the body, in both directions, the response is padded
+//     if the fetch asks for it by X-Urlfetch-Padding-Percent and -Max
+//   - the response is 200 with the same framing of the response of the
+//     fetch, errors of the fetch are inner 502 responses
+//   - all of it is xored with the keystreams of X-Urlfetch-Options if it is
+//     an obfuscated fetch
+//   - the POST carries the "HMAC" Proxy-Authorization of Verifier, it is
+//     checked by Authorized before the body is read
+//
+// The keys of Verifier are the accepted passwords, Password is only the
+// default of ObfuscateKey.
+type Server struct {
+	Password     string
+	Verifier     *helpers.SignatureVerifier
+	ObfuscateKey string
+	Deadline     time.Duration
+	Quota        *Quota
+	// dials with newDialer, which refuses the private addresses
+	Transport *http.Transport
+	// the fetches of private hosts are refused unless it is set
+	AllowPrivate bool
+}
+
+// fetch is one fetch, it answers in the encoding and obfuscation of the
+// request.
+type fetch struct {
+	rw           http.ResponseWriter
+	encoding     string
+	bodyEncoding string
+	obfuscate    string
+	stream       cipher.Stream
+
+	password  string
+	signature string
+	rawurl    string
+	deadline  time.Duration
+	redirect  bool
+	maxSize   int64
+
+	paddingPercent int
+	paddingMax     int
+}
+
+func (s *Server) obfuscateKey() string {
+	if s.ObfuscateKey != "" {
+		return s.ObfuscateKey
+	}
+	return s.Password
+}
+
+// Authorized tells the fetches from the probes, it is the authorized func of
+// helpers.NewCamouflageHandler, which serves the others a decoy site.
+func (s *Server) Authorized(req *http.Request) bool {
+	return authorized(s.Verifier, req)
+}
+
+func authorized(verifier *helpers.SignatureVerifier, req *http.Request) bool {
+	if req.Method != http.MethodPost {
+		return false
+	}
+	if verifier != nil && !verifier.VerifyRequest(req) {
+		glog.V(2).Infof("goproxy-server: %s %s %#v without a valid signature", req.RemoteAddr, req.Method, req.URL.Path)
+		return false
+	}
+	return true
+}
+
+func (s *Server) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.NotFound(rw, req)
+		return
+	}
+
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+
+	if s.Quota.Exceeded(ip) {
+		glog.Warningf("goproxy-server: %s is over quota", ip)
+		http.Error(rw, "over quota", http.StatusServiceUnavailable)
+		return
+	}
+
+	f := &fetch{
+		rw:       rw,
+		encoding: req.Header.Get("X-Urlfetch-Encoding"),
+		deadline: s.Deadline,
+	}
+
+	for _, encoding := range []string{f.encoding, req.Header.Get("X-Urlfetch-Body-Encoding")} {
+		if !supportedEncoding(encoding) {
+			rw.Header().Set("Accept-Encoding", acceptEncodings)
+			http.Error(rw, fmt.Sprintf("unsupported urlfetch encoding %#v", encoding), http.StatusUnsupportedMediaType)
+			return
+		}
+	}
+
+	var body io.Reader = req.Body
+	if options := helpers.ParseUrlfetchOptions(req.Header.Get("X-Urlfetch-Options")); options["obfs"] != "" {
+		nonce, err := hex.DecodeString(options["nonce"])
+		if err != nil || len(nonce) == 0 {
+			http.Error(rw, "obfuscated fetch without nonce", http.StatusBadRequest)
+			return
+		}
+		stream, err := helpers.NewObfuscator(options["obfs"], s.obfuscateKey(), nonce, "request")
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.obfuscate = options["obfs"]
+		f.stream, _ = helpers.NewObfuscator(f.obfuscate, s.obfuscateKey(), nonce, "response")
+		body = cipher.StreamReader{S: stream, R: req.Body}
+	}
+
+	req1, err := f.decodeRequest(body, req.ContentLength, req.Header.Get("X-Urlfetch-Body-Encoding"))
+	if err != nil {
+		glog.Warningf("goproxy-server: %s decode fetch error: %+v", ip, err)
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var n int64
+	var status int
+	switch {
+	case !s.allowed(f, req1):
+		status = http.StatusForbidden
+		n, err = f.writeError(status, "wrong password")
+	default:
+		status, n, err = s.fetch(f, req1)
+	}
+	s.Quota.Add(ip, n)
+
+	if err != nil {
+		glog.V(2).Infof("goproxy-server: %s write response of %#v error: %+v", ip, req1.URL.String(), err)
+	}
+	glog.V(1).Infof("%s \"FETCH %s %s %s\" %d %d", ip, req1.Method, req1.URL.String(), req.Proto, status, n)
+}
+
+// allowed checks the X-Urlfetch-Signature of the php filter, or else the
+// X-Urlfetch-Password of the gae filter, against the keys of Verifier.
+func (s *Server) allowed(f *fetch, req *http.Request) bool {
+	if s.Verifier == nil {
+		return true
+	}
+	if f.signature != "" {
+		_, err := s.Verifier.Verify(f.signature, req.Method, f.rawurl)
+		if err != nil {
+			glog.V(2).Infof("goproxy-server: X-Urlfetch-Signature of %#v error: %v", f.rawurl, err)
+		}
+		return err == nil
+	}
+	return s.Verifier.HasSecret("", f.password)
+}
+
+func (s *Server) fetch(f *fetch, req *http.Request) (int, int64, error) {
+	if !s.AllowPrivate && privateHost(req.URL.Hostname()) {
+		n, err := f.writeError(http.StatusForbidden, "PRIVATE_ADDRESS: "+req.URL.Hostname())
+		return http.StatusForbidden, n, err
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+
+	// the deadline is of the response header, the body is streamed as long
+	// as it takes
+	timer := time.AfterFunc(f.deadline, cancel)
+
+	var resp *http.Response
+	var err error
+	if f.redirect {
+		client := &http.Client{
+			Transport: s.Transport,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if len(via) >= maxRedirects {
+					return fmt.Errorf("stopped after %d redirects", maxRedirects)
+				}
+				return nil
+			},
+		}
+		resp, err = client.Do(req.WithContext(ctx))
+	} else {
+		resp, err = s.Transport.RoundTrip(req.WithContext(ctx))
+	}
+
+	if !timer.Stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		n, err := f.writeError(http.StatusBadGateway, "DEADLINE_EXCEEDED")
+		return http.StatusBadGateway, n, err
+	}
+	if err != nil {
+		n, err := f.writeError(http.StatusBadGateway, err.Error())
+		return http.StatusBadGateway, n, err
+	}
+	defer resp.Body.Close()
+
+	if f.maxSize > 0 && resp.ContentLength > f.maxSize {
+		n, err := f.writeError(http.StatusBadGateway, fmt.Sprintf("RESPONSE_TOO_LARGE: %d > %d", resp.ContentLength, f.maxSize))
+		return http.StatusBadGateway, n, err
+	}
+
+	encodeBody := f.bodyEncoding != "" &&
+		req.Method != http.MethodHead &&
+		resp.Header.Get("Content-Encoding") == "" &&
+		isTextContent(resp.Header.Get("Content-Type"))
+
+	n, err := f.writeResponse(resp, encodeBody)
+	return resp.StatusCode, n, err
+}
+
+// decodeRequest returns the request of the fetch in body, whose length is
+// contentLength.
+func (f *fetch) decodeRequest(body io.Reader, contentLength int64, bodyEncoding string) (*http.Request, error) {
+	var hdrLen uint16
+	if err := binary.Read(body, binary.BigEndian, &hdrLen); err != nil {
+		return nil, err
+	}
+
+	hdrBuf := make([]byte, hdrLen)
+	if _, err := io.ReadFull(body, hdrBuf); err != nil {
+		return nil, err
+	}
+
+	hdr, err := newDecoder(bytes.NewReader(hdrBuf), f.encoding)
+	if err != nil {
+		return nil, err
+	}
+	defer hdr.Close()
+
+	// the header block ends without a blank line
+	tp := textproto.NewReader(bufio.NewReader(io.MultiReader(io.LimitReader(hdr, maxHeaderSize), strings.NewReader("\r\n\r\n"))))
+
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed request line %#v", line)
+	}
+
+	u, err := url.Parse(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("unsupported fetch url %#v", parts[1])
+	}
+
+	mimeHeader, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	header := http.Header(mimeHeader)
+
+	f.password = header.Get("X-Urlfetch-Password")
+	f.signature = header.Get("X-Urlfetch-Signature")
+	f.rawurl = parts[1]
+	if s := header.Get("X-Urlfetch-Deadline"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			f.deadline = time.Duration(n) * time.Second
+		}
+	}
+	f.redirect = header.Get("X-Urlfetch-Redirect") == "1"
+	if s := header.Get("X-Urlfetch-MaxSize"); s != "" {
+		f.maxSize, _ = strconv.ParseInt(s, 10, 64)
+	}
+	f.bodyEncoding = bodyEncoding
+
+	f.paddingPercent, f.paddingMax = helpers.ParsePaddingOptions(header)
+	padded, err := helpers.DiscardPadding(body, header)
+	if err != nil {
+		return nil, err
+	}
+
+	for key := range header {
+		if strings.HasPrefix(key, "X-Urlfetch-") || hopHeaders[key] {
+			header.Del(key)
+		}
+	}
+
+	bodyLength := int64(-1)
+	if contentLength >= 0 {
+		bodyLength = contentLength - 2 - int64(hdrLen) - padded
+	}
+
+	if bodyEncoding != "" && bodyLength != 0 {
+		r, err := newDecoder(body, bodyEncoding)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+
+		data, err := ioutil.ReadAll(io.LimitReader(r, maxEncodedBodySize+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(data)) > maxEncodedBodySize {
+			return nil, fmt.Errorf("encoded body larger than %d bytes", maxEncodedBodySize)
+		}
+		body, bodyLength = bytes.NewReader(data), int64(len(data))
+	}
+
+	if bodyLength == 0 {
+		body = nil
+	}
+
+	req, err := http.NewRequest(parts[0], u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	if bodyLength > 0 {
+		req.ContentLength = bodyLength
+	}
+
+	return req, nil
+}
+
+// writeResponse writes resp in the framing of the fetch and returns the
+// bytes written.
+func (f *fetch) writeResponse(resp *http.Response, encodeBody bool) (int64, error) {
+	var b bytes.Buffer
+	w, err := newEncoder(&b, f.encoding)
+	if err != nil {
+		return 0, err
+	}
+
+	status := resp.Status
+	if status == "" {
+		status = fmt.Sprintf("%d %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+	}
+	fmt.Fprintf(w, "HTTP/1.1 %s\r\n", status)
+	// the padding headers of the block are the ones of the server only
+	for key := range resp.Header {
+		if strings.HasPrefix(key, helpers.PaddingHeader) {
+			delete(resp.Header, key)
+		}
+	}
+	resp.Header.WriteSubset(w, hopHeaders)
+	if resp.ContentLength >= 0 && !encodeBody && resp.Header.Get("Content-Length") == "" {
+		fmt.Fprintf(w, "Content-Length: %d\r\n", resp.ContentLength)
+	}
+	var bodyPadding string
+	if f.paddingPercent > 0 {
+		size := resp.ContentLength
+		if size < 0 {
+			size = 0
+		}
+		var padding string
+		padding, bodyPadding = helpers.RandomPaddings(size+1024, f.paddingPercent, f.paddingMax)
+		if padding != "" {
+			fmt.Fprintf(w, "%s: %s\r\n", helpers.PaddingHeader, padding)
+		}
+		if bodyPadding != "" {
+			fmt.Fprintf(w, "%s: %d\r\n", helpers.PaddingBodyHeader, len(bodyPadding))
+		}
+	}
+	io.WriteString(w, "\r\n")
+	if err = w.Close(); err != nil {
+		return 0, err
+	}
+	if b.Len() > 0xffff {
+		return 0, fmt.Errorf("response header block of %d bytes is too large", b.Len())
+	}
+
+	h := f.rw.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	if f.encoding != "" && f.encoding != EncodingFlate {
+		h.Set("X-Urlfetch-Encoding", f.encoding)
+	}
+	if f.obfuscate != "" {
+		h.Set("X-Urlfetch-Options", "obfs="+f.obfuscate)
+	}
+	if encodeBody {
+		h.Set("X-Urlfetch-Body-Encoding", f.bodyEncoding)
+	}
+	f.rw.WriteHeader(http.StatusOK)
+
+	cw := &countWriter{w: f.rw}
+	var out io.Writer = cw
+	if f.stream != nil {
+		out = cipher.StreamWriter{S: f.stream, W: cw}
+	}
+
+	b0 := make([]byte, 2)
+	binary.BigEndian.PutUint16(b0, uint16(b.Len()))
+	if _, err = out.Write(append(append(b0, b.Bytes()...), bodyPadding...)); err != nil {
+		return cw.n, err
+	}
+
+	if resp.Body == nil {
+		return cw.n, nil
+	}
+
+	if encodeBody {
+		w1, err := newEncoder(out, f.bodyEncoding)
+		if err != nil {
+			return cw.n, err
+		}
+		if _, err = io.Copy(w1, resp.Body); err != nil {
+			return cw.n, err
+		}
+		err = w1.Close()
+		return cw.n, err
+	}
+
+	_, err = io.Copy(out, resp.Body)
+	return cw.n, err
+}
+
+// writeError answers the fetch with an inner response of status, the gae
+// filter retries the 502 ones which say DEADLINE_EXCEEDED.
+func (f *fetch) writeError(status int, msg string) (int64, error) {
+	resp := &http.Response{
+		StatusCode:    status,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		ContentLength: int64(len(msg)),
+		Body:          ioutil.NopCloser(strings.NewReader(msg)),
+	}
+	return f.writeResponse(resp, false)
+}
+
+func isTextContent(contentType string) bool {
+	if strings.HasPrefix(contentType, "text/") {
+		return true
+	}
+	for _, s := range []string{"json", "javascript", "xml"} {
+		if strings.Contains(contentType, s) {
+			return true
+		}
+	}
+	return false
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
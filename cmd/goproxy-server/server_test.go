@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"../../httpproxy/dialer"
+	"../../httpproxy/helpers"
+)
+
+func newTestVerifier(password string) *helpers.SignatureVerifier {
+	v := helpers.NewSignatureVerifier(nil, 0)
+	v.AddKey("", helpers.SignatureKey{Secret: password})
+	return v
+}
+
+// newTestFetch is a fetch of rawurl as the gae filter encodes it.
+func newTestFetch(t *testing.T, server, rawurl, password string) *http.Request {
+	var b bytes.Buffer
+	w, err := newEncoder(&b, EncodingFlate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(w, "GET %s HTTP/1.1\r\nX-Urlfetch-Password: %s\r\n", rawurl, password)
+	w.Close()
+
+	body := make([]byte, 2, 2+b.Len())
+	binary.BigEndian.PutUint16(body, uint16(b.Len()))
+	body = append(body, b.Bytes()...)
+
+	req, err := http.NewRequest(http.MethodPost, server, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestServerSignedFetch(t *testing.T) {
+	var fetched int32
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&fetched, 1)
+		io.WriteString(rw, "hello")
+	}))
+	defer target.Close()
+
+	s := &Server{
+		Password: "123456",
+		Verifier: newTestVerifier("123456"),
+		Deadline: 5 * time.Second,
+		Quota:    NewQuota(0, 0),
+		// the targets are httptest servers on 127.0.0.1
+		AllowPrivate: true,
+		Transport:    &http.Transport{},
+	}
+	ts := httptest.NewServer(helpers.NewCamouflageHandler(s.Authorized, s, helpers.NewDecoyHandler("")))
+	defer ts.Close()
+
+	cases := []struct {
+		name   string
+		secret string
+		status int
+	}{
+		{"signed", "123456", http.StatusOK},
+		{"wrong secret", "654321", http.StatusMethodNotAllowed},
+		{"unsigned", "", http.StatusMethodNotAllowed},
+	}
+
+	for _, c := range cases {
+		req := newTestFetch(t, ts.URL+"/_gh/", target.URL+"/", "123456")
+		if c.secret != "" {
+			helpers.SignRequest(req, c.secret, "", "")
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: fetch error: %v", c.name, err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != c.status {
+			t.Errorf("%s: status %d, want %d", c.name, resp.StatusCode, c.status)
+		}
+	}
+
+	if n := atomic.LoadInt32(&fetched); n != 1 {
+		t.Errorf("target is fetched %d times, want 1", n)
+	}
+
+	// a replayed signature is refused even though it is valid
+	req := newTestFetch(t, ts.URL+"/_gh/", target.URL+"/", "123456")
+	helpers.SignRequest(req, "123456", "", "")
+	auth := req.Header.Get("Proxy-Authorization")
+	for i, status := range []int{http.StatusOK, http.StatusMethodNotAllowed} {
+		req := newTestFetch(t, ts.URL+"/_gh/", target.URL+"/", "123456")
+		req.Header.Set("Proxy-Authorization", auth)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("replay #%d: status %d, want %d", i, resp.StatusCode, status)
+		}
+	}
+
+	// an unknown encoding is the 415 which makes the client fall back to flate
+	req = newTestFetch(t, ts.URL+"/_gh/", target.URL+"/", "123456")
+	req.Header.Set("X-Urlfetch-Encoding", "lzma")
+	helpers.SignRequest(req, "123456", "", "")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType || resp.Header.Get("Accept-Encoding") != acceptEncodings {
+		t.Errorf("lzma fetch: status %d, Accept-Encoding %#v", resp.StatusCode, resp.Header.Get("Accept-Encoding"))
+	}
+
+	// a probe sees the decoy, not the decode error of a fetch
+	for _, method := range []string{http.MethodGet, http.MethodPost} {
+		req, _ := http.NewRequest(method, ts.URL+"/_gh/", bytes.NewReader([]byte("garbage")))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.Header.Get("Server") != helpers.DefaultDecoyServer || !bytes.Contains(body, []byte("nginx")) {
+			t.Errorf("probe %s: %d %#v is not the decoy", method, resp.StatusCode, string(body))
+		}
+	}
+}
+
+func TestServerKeys(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.WriteString(rw, "hello")
+	}))
+	defer target.Close()
+
+	v := helpers.NewSignatureVerifier(nil, 0)
+	v.AddKey("", helpers.SignatureKey{ID: "laptop", Secret: "123456"})
+	v.AddKey("", helpers.SignatureKey{ID: "phone", Secret: "abcdef"})
+	s := &Server{
+		Verifier: v,
+		Deadline: 5 * time.Second,
+		Quota:    NewQuota(0, 0),
+		// the targets are httptest servers on 127.0.0.1
+		AllowPrivate: true,
+		Transport:    &http.Transport{},
+	}
+	ts := httptest.NewServer(helpers.NewCamouflageHandler(s.Authorized, s, helpers.NewDecoyHandler("")))
+	defer ts.Close()
+
+	rawurl := target.URL + "/"
+	cases := []struct {
+		name   string
+		keyID  string
+		secret string
+		header string
+		status int
+	}{
+		{"gae laptop", "laptop", "123456", "X-Urlfetch-Password: 123456", http.StatusOK},
+		{"gae phone", "phone", "abcdef", "X-Urlfetch-Password: abcdef", http.StatusOK},
+		{"gae wrong password", "phone", "abcdef", "X-Urlfetch-Password: 654321", http.StatusForbidden},
+		{"php", "phone", "abcdef", "X-Urlfetch-Signature: " + helpers.NewSignature("abcdef", "phone", "", http.MethodGet, rawurl).String(), http.StatusOK},
+		{"php wrong key", "phone", "abcdef", "X-Urlfetch-Signature: " + helpers.NewSignature("abcdef", "laptop", "", http.MethodGet, rawurl).String(), http.StatusForbidden},
+		{"php other url", "phone", "abcdef", "X-Urlfetch-Signature: " + helpers.NewSignature("abcdef", "phone", "", http.MethodGet, rawurl+"x").String(), http.StatusForbidden},
+	}
+
+	for _, c := range cases {
+		var b bytes.Buffer
+		w, err := newEncoder(&b, EncodingFlate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(w, "GET %s HTTP/1.1\r\n%s\r\n", rawurl, c.header)
+		w.Close()
+
+		body := make([]byte, 2, 2+b.Len())
+		binary.BigEndian.PutUint16(body, uint16(b.Len()))
+		body = append(body, b.Bytes()...)
+
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/_gh/", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		helpers.SignRequest(req, c.secret, c.keyID, "")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s: fetch error: %v", c.name, err)
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK || len(data) < 2 {
+			t.Fatalf("%s: response %d %#v, error %v", c.name, resp.StatusCode, string(data), err)
+		}
+
+		// a refused fetch is an inner 403
+		hdr, err := newDecoder(bytes.NewReader(data[2:2+binary.BigEndian.Uint16(data)]), EncodingFlate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		line, _ := bufio.NewReader(hdr).ReadString('\n')
+		hdr.Close()
+		if want := fmt.Sprintf("HTTP/1.1 %d ", c.status); !strings.HasPrefix(line, want) {
+			t.Errorf("%s: status line %#v, want %#v", c.name, line, want)
+		}
+	}
+}
+
+func TestServerPadding(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		io.Copy(rw, req.Body)
+	}))
+	defer target.Close()
+
+	s := &Server{
+		Deadline: 5 * time.Second,
+		Quota:    NewQuota(0, 0),
+		// the targets are httptest servers on 127.0.0.1
+		AllowPrivate: true,
+		Transport:    &http.Transport{},
+	}
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	const percent, max = 10, 64
+	for i := 0; i < 20; i++ {
+		var b bytes.Buffer
+		w, err := newEncoder(&b, EncodingFlate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(w, "POST %s HTTP/1.1\r\nContent-Length: 5\r\n%s: 3\r\n", target.URL+"/", helpers.PaddingBodyHeader)
+		helpers.WritePaddingOptions(w, percent, max)
+		w.Close()
+
+		body := make([]byte, 2, 2+b.Len())
+		binary.BigEndian.PutUint16(body, uint16(b.Len()))
+		body = append(body, b.Bytes()...)
+		body = append(body, "xxxhello"...)
+
+		resp, err := http.Post(ts.URL+"/_gh/", "application/octet-stream", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || len(data) < 2 {
+			t.Fatalf("response %#v, error %v", string(data), err)
+		}
+
+		hdrLen := int(binary.BigEndian.Uint16(data))
+		hdr, err := newDecoder(bytes.NewReader(data[2:2+hdrLen]), EncodingFlate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp1, err := http.ReadResponse(bufio.NewReader(hdr), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the padding chunk follows the header block, as the body does
+		r := bytes.NewReader(data[2+hdrLen:])
+		padding := resp1.Header.Get(helpers.PaddingHeader)
+		n, err := helpers.DiscardPadding(r, resp1.Header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rest, _ := ioutil.ReadAll(r)
+		if string(rest) != "hello" {
+			t.Fatalf("body after the padding chunk of %d bytes is %#v, want \"hello\"", n, string(rest))
+		}
+		if overhead := len(padding) + int(n); overhead > max {
+			t.Errorf("padding of the response is %d bytes, want at most %d", overhead, max)
+		}
+	}
+}
+
+func TestDecoyListenerMalformed(t *testing.T) {
+	// only for its certificate
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	decoy := helpers.NewDecoyHandler("")
+	for _, config := range []*tls.Config{nil, {Certificates: ts.TLS.Certificates}} {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dl := helpers.NewDecoyListener(ln, config, decoy)
+		server := &http.Server{
+			Handler: dl.Handler(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				fmt.Fprintf(rw, "tls=%v", req.TLS != nil)
+			})),
+			ConnContext: dl.ConnContext,
+		}
+		go server.Serve(dl)
+
+		dial := func() net.Conn {
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if config == nil {
+				return conn
+			}
+			return tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+		}
+
+		cases := []struct {
+			name    string
+			request string
+			body    string
+		}{
+			{"malformed header", "GET / HTTP/1.1\r\nHost: a\r\nbad header\r\n\r\n", "<center><h1>400 Bad Request</h1></center>"},
+			{"no host", "GET / HTTP/1.1\r\n\r\n", "<center><h1>400 Bad Request</h1></center>"},
+			{"header too large", "GET / HTTP/1.1\r\nHost: a\r\nX: " + strings.Repeat("a", 2<<20) + "\r\n\r\n", "Request Header Or Cookie Too Large"},
+			{"valid", "GET / HTTP/1.1\r\nHost: a\r\n\r\n", fmt.Sprintf("tls=%v", config != nil)},
+		}
+		if config != nil {
+			cases = append(cases, struct {
+				name    string
+				request string
+				body    string
+			}{"plain http", "GET / HTTP/1.1\r\nHost: a\r\n\r\n", "The plain HTTP request was sent to HTTPS port"})
+		}
+
+		for _, c := range cases {
+			conn := dial()
+			if c.name == "plain http" {
+				conn = conn.(*tls.Conn).NetConn()
+			}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			go io.WriteString(conn, c.request)
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatalf("tls=%v %s: read response error: %v", config != nil, c.name, err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			conn.Close()
+
+			if c.name != "valid" && (resp.StatusCode != http.StatusBadRequest || resp.Header.Get("Server") != helpers.DefaultDecoyServer) {
+				t.Errorf("tls=%v %s: %s with Server %#v, want 400 of nginx", config != nil, c.name, resp.Status, resp.Header.Get("Server"))
+			}
+			if !bytes.Contains(body, []byte(c.body)) {
+				t.Errorf("tls=%v %s: body %#v does not contain %#v", config != nil, c.name, string(body), c.body)
+			}
+		}
+
+		server.Close()
+	}
+}
+
+func TestTunnelMeekDialer(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	tunnel := NewTunnel(newTestVerifier("123456"), NewQuota(0, 0), time.Second)
+	tunnel.AllowPrivate = true
+	ts := httptest.NewServer(helpers.NewCamouflageHandler(tunnel.Authorized, tunnel, helpers.NewDecoyHandler("")))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL + "/_gh/tunnel")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, password := range []string{"123456", "654321"} {
+		d := &dialer.MeekDialer{
+			URL:          u,
+			Transport:    &http.Transport{},
+			PollInterval: 50 * time.Millisecond,
+			Password:     password,
+		}
+
+		conn, err := d.Dial("tcp", ln.Addr().String())
+		if password != "123456" {
+			if err == nil {
+				conn.Close()
+				t.Errorf("Dial() with password %#v is not refused", password)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Dial() error: %v", err)
+		}
+
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatalf("Write() error: %v", err)
+		}
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(conn, b); err != nil || string(b) != "ping" {
+			t.Errorf("echo read %#v, error %v, want \"ping\"", string(b), err)
+		}
+		conn.Close()
+	}
+}
+
+func TestRefusePrivate(t *testing.T) {
+	cases := []struct {
+		host    string
+		private bool
+	}{
+		{"127.0.0.1", true},
+		{"localhost", true},
+		{"api.localhost.", true},
+		{"10.1.2.3", true},
+		{"192.168.1.1", true},
+		{"169.254.169.254", true},
+		{"100.100.100.200", true},
+		{"::1", true},
+		{"fe80::1", true},
+		{"0.0.0.0", true},
+		{"8.8.8.8", false},
+		{"2001:4860:4860::8888", false},
+		{"www.example.org", false},
+	}
+
+	for _, c := range cases {
+		if privateHost(c.host) != c.private {
+			t.Errorf("privateHost(%#v) is %v, want %v", c.host, !c.private, c.private)
+		}
+		if ip := net.ParseIP(c.host); ip != nil {
+			err := refusePrivate("tcp", net.JoinHostPort(c.host, "80"), nil)
+			if (err != nil) != c.private {
+				t.Errorf("refusePrivate(%#v) error: %v", c.host, err)
+			}
+		}
+	}
+
+	// a fetch of a private host is answered 403 without dialing it
+	s := &Server{Deadline: time.Second, Quota: NewQuota(0, 0), Transport: &http.Transport{}}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, newTestFetch(t, "http://vps.example.org/_gh/", "http://127.0.0.1:1/", ""))
+	if !bytes.Contains(rec.Body.Bytes(), []byte("PRIVATE_ADDRESS")) {
+		t.Errorf("fetch of 127.0.0.1 is not refused: %q", rec.Body.String())
+	}
+}
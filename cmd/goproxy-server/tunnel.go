@@ -0,0 +1,289 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../../httpproxy/helpers"
+)
+
+const (
+	// the default of MeekDialer.MaxBody, a larger downstream is truncated
+	defaultTunnelMaxBody int = 64 * 1024
+	// an exchange without upstream data waits this long for downstream data
+	tunnelPollWait time.Duration = 200 * time.Millisecond
+	// a session without exchanges for this long is closed, the client is
+	// gone without saying it
+	tunnelIdleTimeout time.Duration = 2 * time.Minute
+	// the target is not read while this many bytes are waiting for the client
+	maxTunnelBuffer int = 1024 * 1024
+)
+
+// Tunnel serves CONNECT tunnels in the meek protocol of MeekDialer, the
+// server keeps the tcp connection to the target and each POST exchanges the
+// pending bytes of both directions:
+//
+//   - X-Session-Id names the session, the first exchange of it carries
+//     X-Target, the address to connect to
+//   - the "HMAC" Proxy-Authorization is checked by Verifier in Authorized
+//   - the request body is written to the target and the response body is
+//     what the target has sent since, up to X-Max-Body bytes
+//   - X-Session-Close ends the session, and 410 tells the client the target
+//     has closed it
+type Tunnel struct {
+	Verifier    *helpers.SignatureVerifier
+	Quota       *Quota
+	DialTimeout time.Duration
+	// the tunnels to private addresses are refused unless it is set
+	AllowPrivate bool
+
+	mu       sync.Mutex
+	sessions map[string]*tunnelSession
+}
+
+type tunnelSession struct {
+	conn   net.Conn
+	notify chan struct{}
+	done   chan struct{}
+
+	mu       sync.Mutex
+	buf      []byte
+	err      error
+	lastSeen time.Time
+}
+
+func NewTunnel(verifier *helpers.SignatureVerifier, quota *Quota, dialTimeout time.Duration) *Tunnel {
+	t := &Tunnel{
+		Verifier:    verifier,
+		Quota:       quota,
+		DialTimeout: dialTimeout,
+		sessions:    make(map[string]*tunnelSession),
+	}
+	go t.expire()
+	return t
+}
+
+// Authorized is the authorized func of helpers.NewCamouflageHandler, as
+// Server.Authorized.
+func (t *Tunnel) Authorized(req *http.Request) bool {
+	return authorized(t.Verifier, req)
+}
+
+func (t *Tunnel) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.NotFound(rw, req)
+		return
+	}
+
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+
+	id := req.Header.Get("X-Session-Id")
+	if id == "" {
+		http.Error(rw, "no X-Session-Id", http.StatusBadRequest)
+		return
+	}
+
+	if req.Header.Get("X-Session-Close") != "" {
+		t.close(id)
+		rw.WriteHeader(http.StatusOK)
+		return
+	}
+
+	s, ok := t.session(id)
+	if !ok {
+		target := req.Header.Get("X-Target")
+		if target == "" {
+			http.Error(rw, "session not exists", http.StatusNotFound)
+			return
+		}
+		if t.Quota.Exceeded(ip) {
+			glog.Warningf("goproxy-server: %s is over quota", ip)
+			http.Error(rw, "over quota", http.StatusServiceUnavailable)
+			return
+		}
+		conn, err := newDialer(t.DialTimeout, t.AllowPrivate).Dial("tcp", target)
+		if err != nil {
+			glog.V(1).Infof("%s \"TUNNEL %s\" %d error: %v", ip, target, http.StatusBadGateway, err)
+			http.Error(rw, err.Error(), http.StatusBadGateway)
+			return
+		}
+		glog.V(1).Infof("%s \"TUNNEL %s\" %d session %s", ip, target, http.StatusOK, id)
+		s = t.open(id, conn)
+	}
+
+	up, err := io.Copy(s.conn, req.Body)
+	if err != nil {
+		t.close(id)
+		http.Error(rw, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	maxBody := defaultTunnelMaxBody
+	if n, err := strconv.Atoi(req.Header.Get("X-Max-Body")); err == nil && n > 0 && n < maxBody {
+		maxBody = n
+	}
+
+	wait := tunnelPollWait
+	if up > 0 {
+		// the answer to what was just sent is usually on its way
+		wait = tunnelPollWait / 4
+	}
+
+	data, err := s.read(maxBody, wait)
+	if len(data) == 0 && err != nil {
+		t.close(id)
+		http.Error(rw, "session closed", http.StatusGone)
+		return
+	}
+	t.Quota.Add(ip, up+int64(len(data)))
+
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	rw.WriteHeader(http.StatusOK)
+	rw.Write(data)
+}
+
+func (t *Tunnel) session(id string) (*tunnelSession, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.sessions[id]
+	if ok {
+		s.mu.Lock()
+		s.lastSeen = time.Now()
+		s.mu.Unlock()
+	}
+	return s, ok
+}
+
+func (t *Tunnel) open(id string, conn net.Conn) *tunnelSession {
+	s := &tunnelSession{
+		conn:     conn,
+		notify:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		lastSeen: time.Now(),
+	}
+	go s.pump()
+
+	t.mu.Lock()
+	if s0, ok := t.sessions[id]; ok {
+		s0.close()
+	}
+	t.sessions[id] = s
+	t.mu.Unlock()
+
+	return s
+}
+
+func (t *Tunnel) close(id string) {
+	t.mu.Lock()
+	s, ok := t.sessions[id]
+	delete(t.sessions, id)
+	t.mu.Unlock()
+
+	if ok {
+		s.close()
+	}
+}
+
+func (t *Tunnel) expire() {
+	for range time.Tick(tunnelIdleTimeout / 4) {
+		ids := make([]string, 0)
+		t.mu.Lock()
+		for id, s := range t.sessions {
+			s.mu.Lock()
+			if time.Since(s.lastSeen) > tunnelIdleTimeout {
+				ids = append(ids, id)
+			}
+			s.mu.Unlock()
+		}
+		t.mu.Unlock()
+
+		for _, id := range ids {
+			glog.V(2).Infof("goproxy-server: tunnel session %s is idle, close it", id)
+			t.close(id)
+		}
+	}
+}
+
+// pump buffers what the target sends until the next exchange takes it.
+func (s *tunnelSession) pump() {
+	b := make([]byte, 32*1024)
+	for {
+		for s.buffered() >= maxTunnelBuffer {
+			select {
+			case <-s.done:
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+
+		n, err := s.conn.Read(b)
+
+		s.mu.Lock()
+		s.buf = append(s.buf, b[:n]...)
+		if err != nil {
+			s.err = err
+		}
+		s.mu.Unlock()
+
+		select {
+		case s.notify <- struct{}{}:
+		default:
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (s *tunnelSession) close() {
+	close(s.done)
+	s.conn.Close()
+}
+
+func (s *tunnelSession) buffered() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.buf)
+}
+
+// read takes up to max buffered bytes, waiting up to wait for some if there
+// are none. The error is the one of the target once its bytes are taken.
+func (s *tunnelSession) read(max int, wait time.Duration) ([]byte, error) {
+	s.mu.Lock()
+	empty := len(s.buf) == 0 && s.err == nil
+	s.mu.Unlock()
+
+	if empty {
+		select {
+		case <-s.notify:
+		case <-time.After(wait):
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(s.buf)
+	if n > max {
+		n = max
+	}
+	data := append([]byte(nil), s.buf[:n]...)
+	s.buf = s.buf[n:]
+
+	if len(s.buf) == 0 && s.err != nil {
+		return data, s.err
+	}
+	return data, nil
+}
@@ -0,0 +1,112 @@
+package dialer
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// NormalizeIP returns the form of ip which IPBlackList and the other caches
+// are keyed by, so that equivalent spellings share one entry: the zone is
+// stripped, an IPv4-mapped address becomes IPv4 and IPv6 is compressed in
+// lower case. A string which is not an ip is returned as is.
+func NormalizeIP(ip string) string {
+	s := ip
+	if i := strings.IndexByte(s, '%'); i >= 0 {
+		s = s[:i]
+	}
+
+	ip1 := net.ParseIP(strings.Trim(s, "[]"))
+	if ip1 == nil {
+		return ip
+	}
+	if ip4 := ip1.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	return ip1.String()
+}
+
+// NormalizeAddr is NormalizeIP for the host of a "host:port" addr.
+func NormalizeAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return NormalizeIP(addr)
+	}
+	return net.JoinHostPort(NormalizeIP(host), port)
+}
+
+// ParseCIDR parses a CIDR, or a single ip as a /32 or /128.
+func ParseCIDR(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		ip, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		// ::ffff:10.0.0.0/104 is 10.0.0.0/8
+		if ip4 := ip.To4(); ip4 != nil && len(ipnet.IP) == net.IPv6len {
+			ones, _ := ipnet.Mask.Size()
+			if ones < 96 {
+				return nil, fmt.Errorf("invalid cidr %#v", s)
+			}
+			return &net.IPNet{IP: ip4.Mask(net.CIDRMask(ones-96, 32)), Mask: net.CIDRMask(ones-96, 32)}, nil
+		}
+		return ipnet, nil
+	}
+
+	ip := net.ParseIP(NormalizeIP(s))
+	if ip == nil {
+		return nil, fmt.Errorf("invalid cidr %#v", s)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// AddrInNet reports whether the ip of addr, an ip or "ip:port", is in ipnet.
+func AddrInNet(addr string, ipnet *net.IPNet) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(NormalizeIP(host))
+	return ip != nil && ipnet.Contains(ip)
+}
+
+// BlackListedIn returns the ips of IPBlackList in ipnet which have not
+// expired yet, the sources of BlackList are not listed.
+func (d *MultiDialer) BlackListedIn(ipnet *net.IPNet) []string {
+	ips := make([]string, 0)
+	now := time.Now()
+	for _, ip := range cacheKeys(d.IPBlackList) {
+		if !AddrInNet(ip, ipnet) {
+			continue
+		}
+		if v, ok := d.IPBlackList.GetQuiet(ip); ok {
+			if expire, _ := v.(time.Time); expire.IsZero() || now.Before(expire) {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips
+}
+
+// UnBlackListIP removes ip from IPBlackList.
+func (d *MultiDialer) UnBlackListIP(ip string) {
+	d.IPBlackList.Del(NormalizeIP(ip))
+}
+
+// UnBlackListIn removes the ips in ipnet from IPBlackList and returns how
+// many there were.
+func (d *MultiDialer) UnBlackListIn(ipnet *net.IPNet) int {
+	n := 0
+	for _, ip := range cacheKeys(d.IPBlackList) {
+		if AddrInNet(ip, ipnet) {
+			if _, ok := d.IPBlackList.Del(ip); ok {
+				n++
+			}
+		}
+	}
+	return n
+}
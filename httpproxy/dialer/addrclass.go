@@ -0,0 +1,188 @@
+package dialer
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/phuslu/glog"
+)
+
+// Address classes of ClassifyIP, the keys of MultiDialer.AddrPolicy.
+const (
+	AddrGlobal    string = "global"
+	AddrLoopback  string = "loopback"
+	AddrLinkLocal string = "link_local"
+	// RFC 1918 and the shared address space of RFC 6598
+	AddrPrivate string = "private"
+	// unique local ipv6, fc00::/7
+	AddrULA    string = "ula"
+	AddrTeredo string = "teredo"
+	AddrSixTo4 string = "6to4"
+	// unspecified, multicast, documentation, benchmarking and reserved
+	AddrBogon string = "bogon"
+)
+
+// the classes a public name must not resolve to, an answer in them is a
+// common sign of DNS poisoning. A local name, e.g. of .lan, may.
+var localAddrClasses = map[string]bool{
+	AddrLoopback:  true,
+	AddrLinkLocal: true,
+	AddrPrivate:   true,
+	AddrULA:       true,
+}
+
+// the default of MultiDialer.AddrPolicy, true allows the class.
+var defaultAddrPolicy = map[string]bool{
+	AddrGlobal:    true,
+	AddrLoopback:  false,
+	AddrLinkLocal: false,
+	AddrPrivate:   false,
+	AddrULA:       false,
+	AddrTeredo:    false,
+	AddrSixTo4:    false,
+	AddrBogon:     false,
+}
+
+// the suffixes of the names which are not resolved by public DNS
+var localNameSuffixes = []string{
+	".local",
+	".localhost",
+	".lan",
+	".home",
+	".internal",
+	".intranet",
+	".corp",
+	".home.arpa",
+	// reserved by RFC 2606
+	".test",
+	".example",
+	".invalid",
+	".in-addr.arpa",
+	".ip6.arpa",
+}
+
+var addrClassNets = func() []struct {
+	class string
+	ipnet *net.IPNet
+} {
+	nets := []struct {
+		class string
+		cidr  string
+	}{
+		{AddrBogon, "0.0.0.0/8"},
+		{AddrPrivate, "10.0.0.0/8"},
+		{AddrPrivate, "100.64.0.0/10"},
+		{AddrLoopback, "127.0.0.0/8"},
+		{AddrLinkLocal, "169.254.0.0/16"},
+		{AddrPrivate, "172.16.0.0/12"},
+		{AddrBogon, "192.0.0.0/24"},
+		{AddrBogon, "192.0.2.0/24"},
+		{AddrPrivate, "192.168.0.0/16"},
+		{AddrBogon, "198.18.0.0/15"},
+		{AddrBogon, "198.51.100.0/24"},
+		{AddrBogon, "203.0.113.0/24"},
+		{AddrBogon, "224.0.0.0/3"},
+		{AddrLoopback, "::1/128"},
+		{AddrBogon, "::/128"},
+		{AddrBogon, "100::/64"},
+		{AddrTeredo, "2001::/32"},
+		{AddrBogon, "2001:db8::/32"},
+		{AddrSixTo4, "2002::/16"},
+		{AddrULA, "fc00::/7"},
+		{AddrLinkLocal, "fe80::/10"},
+		{AddrBogon, "ff00::/8"},
+	}
+
+	result := make([]struct {
+		class string
+		ipnet *net.IPNet
+	}, len(nets))
+	for i, n := range nets {
+		_, ipnet, err := net.ParseCIDR(n.cidr)
+		if err != nil {
+			panic(err)
+		}
+		result[i].class = n.class
+		result[i].ipnet = ipnet
+	}
+	return result
+}()
+
+// ClassifyIP returns the address class of ip, AddrGlobal if it is in none of
+// the others.
+func ClassifyIP(ip net.IP) string {
+	// an ipv4 in its ipv6 form is classified as ipv4
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, n := range addrClassNets {
+		if len(n.ipnet.IP) == len(ip) && n.ipnet.Contains(ip) {
+			return n.class
+		}
+	}
+	return AddrGlobal
+}
+
+// ParseAddrPolicy checks a AddrPolicy config, which maps classes to "allow"
+// or "deny", and returns it over the default one.
+func ParseAddrPolicy(config map[string]string) (map[string]bool, error) {
+	policy := make(map[string]bool, len(defaultAddrPolicy))
+	for class, allow := range defaultAddrPolicy {
+		policy[class] = allow
+	}
+
+	for class, s := range config {
+		if _, ok := defaultAddrPolicy[class]; !ok {
+			return nil, fmt.Errorf("unknown address class %#v", class)
+		}
+		switch s {
+		case "allow":
+			policy[class] = true
+		case "deny":
+			policy[class] = false
+		default:
+			return nil, fmt.Errorf("address class %#v policy %#v is neither \"allow\" nor \"deny\"", class, s)
+		}
+	}
+
+	return policy, nil
+}
+
+func isLocalName(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if !strings.Contains(name, ".") {
+		return true
+	}
+	for _, suffix := range localNameSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// usableAnswer reports whether ip is a sane answer of name under AddrPolicy.
+// A local class is denied only to public names.
+func (d *MultiDialer) usableAnswer(name, ip string) bool {
+	ip1 := net.ParseIP(ip)
+	if ip1 == nil {
+		return false
+	}
+
+	class := ClassifyIP(ip1)
+	if class == AddrGlobal {
+		return true
+	}
+
+	policy := d.AddrPolicy
+	if policy == nil {
+		policy = defaultAddrPolicy
+	}
+	if policy[class] || (localAddrClasses[class] && isLocalName(name)) {
+		return true
+	}
+
+	glog.V(2).Infof("MULTIDIALER: drop the %s answer %s of %#v", class, ip, name)
+	return false
+}
@@ -0,0 +1,69 @@
+package dialer
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ResolveHostMap returns hostMap with the names which are aliases of it
+// replaced by the hosts of those aliases, so that a pool is kept once and
+// composed into others, e.g. "google_cn": ["google_hk", "203.0.113.1"].
+// A cycle of references is an error which names the whole cycle.
+func ResolveHostMap(hostMap map[string][]string) (map[string][]string, error) {
+	resolved := make(map[string][]string, len(hostMap))
+
+	var resolve func(alias string, path []string) ([]string, error)
+	resolve = func(alias string, path []string) ([]string, error) {
+		if names, ok := resolved[alias]; ok {
+			return names, nil
+		}
+		for i, a := range path {
+			if a == alias {
+				return nil, fmt.Errorf("HostMap alias cycle %s", strings.Join(append(path[i:], alias), " -> "))
+			}
+		}
+		path = append(path[:len(path):len(path)], alias)
+
+		names := make([]string, 0, len(hostMap[alias]))
+		seen := make(map[string]struct{})
+		add := func(name string) {
+			if _, ok := seen[name]; !ok {
+				seen[name] = struct{}{}
+				names = append(names, name)
+			}
+		}
+
+		for _, name := range hostMap[alias] {
+			if _, ok := hostMap[name]; !ok {
+				add(name)
+				continue
+			}
+			names1, err := resolve(name, path)
+			if err != nil {
+				return nil, err
+			}
+			for _, name1 := range names1 {
+				add(name1)
+			}
+		}
+
+		resolved[alias] = names
+		return names, nil
+	}
+
+	aliases := make([]string, 0, len(hostMap))
+	for alias := range hostMap {
+		aliases = append(aliases, alias)
+	}
+	// the same config reports the same cycle
+	sort.Strings(aliases)
+
+	for _, alias := range aliases {
+		if _, err := resolve(alias, nil); err != nil {
+			return nil, err
+		}
+	}
+
+	return resolved, nil
+}
@@ -0,0 +1,53 @@
+package dialer
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// SetAliasPorts swaps the port overrides by alias, e.g. "google_hk": {"*":
+// "443"} dials the hosts of google_hk on 443 whatever port is asked, and
+// "cdn": {"8443": "443"} only moves 8443. "*" applies to the other aliases and
+// ports. The conn caches and the scores are kept by the addr dialed, so a
+// host is scored apart on each of its ports.
+func (d *MultiDialer) SetAliasPorts(ports map[string]map[string]string) error {
+	for alias, m := range ports {
+		for from, to := range m {
+			if from != "*" && !validPort(from) {
+				return fmt.Errorf("AliasPorts[%#v]: invalid port %#v", alias, from)
+			}
+			if !validPort(to) {
+				return fmt.Errorf("AliasPorts[%#v][%#v]: invalid port %#v", alias, from, to)
+			}
+		}
+	}
+
+	d.muConfig.Lock()
+	defer d.muConfig.Unlock()
+	d.AliasPorts = ports
+
+	return nil
+}
+
+// aliasPort returns the port which the hosts of alias are dialed on for port.
+func (d *MultiDialer) aliasPort(alias, port string) string {
+	d.muConfig.RLock()
+	defer d.muConfig.RUnlock()
+
+	m, ok := d.AliasPorts[alias]
+	if !ok {
+		m = d.AliasPorts["*"]
+	}
+	if to, ok := m[port]; ok {
+		return to
+	}
+	if to, ok := m["*"]; ok {
+		return to
+	}
+	return port
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n < 65536
+}
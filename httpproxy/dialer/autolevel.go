@@ -0,0 +1,188 @@
+package dialer
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+)
+
+const (
+	// the races of an alias the level is tuned by
+	autoLevelWindow int = 16
+	// the races of an alias before its level is tuned
+	autoLevelMinRaces int = 4
+	// a top addr winning the races below this latency is dialed alone
+	autoLevelFastLatency time.Duration = 50 * time.Millisecond
+)
+
+// DialLevel is how AutoLevel has tuned the dials of an alias.
+type DialLevel struct {
+	Level         int
+	Races         int
+	Failures      int
+	TopWins       int
+	MedianLatency time.Duration
+}
+
+type raceResult struct {
+	failed bool
+	// the winner is the first of the picked addrs, the best known one
+	top     bool
+	latency time.Duration
+}
+
+type aliasLevel struct {
+	results []raceResult
+	next    int
+	level   int
+}
+
+// autoLevels keeps the recent races of each alias. With AutoLevel, an alias
+// whose top addr keeps winning fast is dialed one addr at a time to spare
+// the bandwidth and the handshakes of the losers, and one whose races fail or
+// vary much is raced over Level addrs again.
+type autoLevels struct {
+	mu      sync.Mutex
+	aliases map[string]*aliasLevel
+}
+
+// dialLevel returns the number of addrs to race for alias.
+func (d *MultiDialer) dialLevel(alias string) int {
+	if !d.AutoLevel || d.Level <= 1 {
+		return d.Level
+	}
+
+	d.levels.mu.Lock()
+	defer d.levels.mu.Unlock()
+
+	if a, ok := d.levels.aliases[alias]; ok && a.level > 0 {
+		return a.level
+	}
+	return d.Level
+}
+
+// observeRace records a race of alias, whose winner has connected after
+// latency, or err if all its attempts failed.
+func (d *MultiDialer) observeRace(alias string, top bool, latency time.Duration, err error) {
+	if !d.AutoLevel || d.Level <= 1 {
+		return
+	}
+
+	d.levels.mu.Lock()
+	defer d.levels.mu.Unlock()
+
+	if d.levels.aliases == nil {
+		d.levels.aliases = make(map[string]*aliasLevel)
+	}
+	a, ok := d.levels.aliases[alias]
+	if !ok {
+		a = &aliasLevel{results: make([]raceResult, 0, autoLevelWindow)}
+		d.levels.aliases[alias] = a
+	}
+
+	r := raceResult{failed: err != nil, top: top, latency: latency}
+	if len(a.results) < autoLevelWindow {
+		a.results = append(a.results, r)
+	} else {
+		a.results[a.next] = r
+		a.next = (a.next + 1) % autoLevelWindow
+	}
+
+	level := tuneLevel(a.results, d.Level)
+	if level != a.level {
+		if a.level > 0 {
+			glog.Infof("MULTIDIALER: alias %#v dial level %d -> %d", alias, a.level, level)
+		}
+		a.level = level
+	}
+}
+
+// tuneLevel returns the level of results out of max.
+func tuneLevel(results []raceResult, max int) int {
+	if len(results) < autoLevelMinRaces {
+		return max
+	}
+
+	s := summarizeRaces(results)
+	mean, stddev := latencyStats(results)
+
+	switch {
+	case s.Failures*4 >= s.Races:
+		// a failure spike
+		return max
+	case s.Failures == 0 && s.TopWins == s.Races && slowestLatency(results) < autoLevelFastLatency:
+		return 1
+	case mean > 0 && stddev > mean/2:
+		// the winners vary too much to trust one addr
+		return max
+	}
+
+	level := (max + 1) / 2
+	if level < 2 {
+		level = 2
+	}
+	return level
+}
+
+func summarizeRaces(results []raceResult) DialLevel {
+	var s DialLevel
+	latencies := make([]time.Duration, 0, len(results))
+	for _, r := range results {
+		s.Races++
+		if r.failed {
+			s.Failures++
+			continue
+		}
+		if r.top {
+			s.TopWins++
+		}
+		latencies = append(latencies, r.latency)
+	}
+	s.MedianLatency = medianDuration(latencies)
+	return s
+}
+
+func latencyStats(results []raceResult) (mean, stddev time.Duration) {
+	var sum, sum2 float64
+	n := 0
+	for _, r := range results {
+		if r.failed {
+			continue
+		}
+		x := float64(r.latency)
+		sum += x
+		sum2 += x * x
+		n++
+	}
+	if n == 0 {
+		return 0, 0
+	}
+	m := sum / float64(n)
+	return time.Duration(m), time.Duration(math.Sqrt(math.Max(sum2/float64(n)-m*m, 0)))
+}
+
+func slowestLatency(results []raceResult) time.Duration {
+	var slowest time.Duration
+	for _, r := range results {
+		if !r.failed && r.latency > slowest {
+			slowest = r.latency
+		}
+	}
+	return slowest
+}
+
+// DialLevels returns the tuned level of each alias dialed since AutoLevel.
+func (d *MultiDialer) DialLevels() map[string]DialLevel {
+	d.levels.mu.Lock()
+	defer d.levels.mu.Unlock()
+
+	levels := make(map[string]DialLevel, len(d.levels.aliases))
+	for alias, a := range d.levels.aliases {
+		s := summarizeRaces(a.results)
+		s.Level = a.level
+		levels[alias] = s
+	}
+	return levels
+}
@@ -0,0 +1,184 @@
+package dialer
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// AddrBenchmark is how one addr of an alias did in AliasBenchmark.Run.
+type AddrBenchmark struct {
+	Addr      string
+	Connect   time.Duration
+	Handshake time.Duration
+	// until the response header of the GET
+	Request time.Duration
+	Status  int
+	Error   string `json:",omitempty"`
+}
+
+// Total is the time from dialing to the response header.
+func (b AddrBenchmark) Total() time.Duration {
+	return b.Connect + b.Handshake + b.Request
+}
+
+// AliasBenchmark dials every ip of Alias, handshakes it as MultiDialer would,
+// and GETs Path of Host over it. The results are put into TCPConnDuration and
+// TLSConnDuration, or their error caches, so the next dials pick the fastest.
+type AliasBenchmark struct {
+	MultiDialer *MultiDialer
+	Alias       string
+	// the SNI and Host, the first hostname of the alias if empty
+	Host        string
+	Path        string
+	Concurrency int
+	Timeout     time.Duration
+}
+
+// Run returns the addrs fastest first, the failed ones are at the end.
+func (b *AliasBenchmark) Run() ([]AddrBenchmark, error) {
+	d := b.MultiDialer
+
+	ips, err := d.LookupAlias(b.Alias)
+	if err != nil {
+		return nil, err
+	}
+
+	host := b.Host
+	if host == "" {
+		names, _ := d.hostNames(b.Alias)
+		for _, name := range names {
+			if net.ParseIP(name) == nil {
+				host = name
+				break
+			}
+		}
+	}
+	path := b.Path
+	if path == "" {
+		path = "/"
+	}
+	concurrency := b.Concurrency
+	if concurrency <= 0 {
+		concurrency = 8
+	}
+	timeout := b.Timeout
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	port := d.aliasPort(b.Alias, "443")
+	results := make([]AddrBenchmark, len(ips))
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, ip := range ips {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, addr string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			results[i] = b.probe(addr, host, path, timeout)
+		}(i, net.JoinHostPort(ip, port))
+	}
+	wg.Wait()
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if (results[i].Error == "") != (results[j].Error == "") {
+			return results[i].Error == ""
+		}
+		return results[i].Total() < results[j].Total()
+	})
+
+	return results, nil
+}
+
+func (b *AliasBenchmark) probe(addr, host, path string, timeout time.Duration) AddrBenchmark {
+	d := b.MultiDialer
+	result := AddrBenchmark{Addr: addr}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := d.dialContext(ctx, b.Alias, "tcp", addr)
+	if err != nil {
+		d.TCPConnDuration.Del(addr)
+		d.TCPConnError.Set(addr, err, time.Now().Add(d.ConnExpiry))
+		d.scores.observe(b.Alias, "tcp", addr, 0, err)
+		result.Error = err.Error()
+		return result
+	}
+	defer conn.Close()
+
+	end := time.Now()
+	result.Connect = end.Sub(start)
+	d.TCPConnDuration.Set(addr, result.Connect, end.Add(d.ConnExpiry))
+	d.scores.observe(b.Alias, "tcp", addr, result.Connect, nil)
+
+	conn.SetDeadline(start.Add(timeout))
+
+	config := d.tlsConfigForAlias(b.Alias, host, nil)
+	config.NextProtos = []string{"http/1.1"}
+	if err = d.setECH(b.Alias, config); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	start = time.Now()
+	tlsConn := d.tlsClient(conn, config, b.Alias)
+	err = tlsConn.Handshake()
+	end = time.Now()
+	if err != nil {
+		d.TLSConnDuration.Del(addr)
+		d.TLSConnError.Set(addr, err, end.Add(d.ConnExpiry))
+		d.scores.observe(b.Alias, "tls", addr, 0, err)
+		result.Error = err.Error()
+		return result
+	}
+	result.Handshake = end.Sub(start)
+	d.TLSConnDuration.Set(addr, result.Handshake, end.Add(d.ConnExpiry))
+	d.scores.observe(b.Alias, "tls", addr, result.Handshake, nil)
+
+	start = time.Now()
+	if _, err = fmt.Fprintf(tlsConn, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", path, d.HostHeader(host)); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(tlsConn), nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	resp.Body.Close()
+	result.Request = time.Since(start)
+	result.Status = resp.StatusCode
+
+	return result
+}
+
+// WriteAddrBenchmarks writes results as a table, the durations in ms.
+func WriteAddrBenchmarks(w io.Writer, results []AddrBenchmark) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADDR\tCONNECT_MS\tHANDSHAKE_MS\tREQUEST_MS\tTOTAL_MS\tSTATUS\tERROR")
+	for _, r := range results {
+		status := "-"
+		if r.Status > 0 {
+			status = fmt.Sprintf("%d", r.Status)
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%s\t%s\n",
+			r.Addr, r.Connect/time.Millisecond, r.Handshake/time.Millisecond, r.Request/time.Millisecond, r.Total()/time.Millisecond,
+			status, strings.Replace(r.Error, "\t", " ", -1))
+	}
+	return tw.Flush()
+}
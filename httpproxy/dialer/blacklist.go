@@ -0,0 +1,217 @@
+package dialer
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../helpers"
+)
+
+// BlackListSource provides ips or CIDRs which should never be dialed.
+type BlackListSource interface {
+	Name() string
+	Load() ([]string, error)
+}
+
+type StaticBlackListSource struct {
+	Label   string
+	Entries []string
+}
+
+func (s *StaticBlackListSource) Name() string {
+	return s.Label
+}
+
+func (s *StaticBlackListSource) Load() ([]string, error) {
+	return s.Entries, nil
+}
+
+// FileBlackListSource reads one ip or CIDR per line, "#" starts a comment.
+type FileBlackListSource struct {
+	Filename string
+}
+
+func (s *FileBlackListSource) Name() string {
+	return "file:" + s.Filename
+}
+
+func (s *FileBlackListSource) Load() ([]string, error) {
+	f, err := os.Open(s.Filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return readBlackList(f)
+}
+
+// URLBlackListSource downloads a list in the format of FileBlackListSource,
+// see helpers.Downloader for ChecksumURL and RangeDelta.
+type URLBlackListSource struct {
+	URL         string
+	Transport   http.RoundTripper
+	ChecksumURL string
+	RangeDelta  bool
+
+	// Load is called by the refresh job and by admin reloads at once
+	mu         sync.Mutex
+	downloader *helpers.Downloader
+	entries    []string
+}
+
+func (s *URLBlackListSource) Name() string {
+	return s.URL
+}
+
+func (s *URLBlackListSource) Load() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.downloader == nil {
+		s.downloader = &helpers.Downloader{
+			URL:         s.URL,
+			Transport:   s.Transport,
+			ChecksumURL: s.ChecksumURL,
+			RangeDelta:  s.RangeDelta,
+		}
+	}
+
+	data, modified, err := s.downloader.Download()
+	if err != nil {
+		return nil, err
+	}
+
+	if !modified && s.entries != nil {
+		glog.V(2).Infof("BLACKLIST %#v not modified", s.URL)
+		return s.entries, nil
+	}
+
+	entries, err := readBlackList(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	s.entries = entries
+
+	return entries, nil
+}
+
+func readBlackList(r io.Reader) ([]string, error) {
+	entries := make([]string, 0)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		s := scanner.Text()
+		if i := strings.Index(s, "#"); i >= 0 {
+			s = s[:i]
+		}
+		if s = strings.TrimSpace(s); s != "" {
+			entries = append(entries, s)
+		}
+	}
+
+	return entries, scanner.Err()
+}
+
+type blackListNet struct {
+	ipnet  *net.IPNet
+	source string
+}
+
+// BlackList merges BlackListSources and reloads them every Interval.
+type BlackList struct {
+	Sources  []BlackListSource
+	Interval time.Duration
+
+	mu   sync.RWMutex
+	ips  map[string]string
+	nets []blackListNet
+}
+
+func NewBlackList(sources []BlackListSource, interval time.Duration) *BlackList {
+	b := &BlackList{
+		Sources:  sources,
+		Interval: interval,
+		ips:      make(map[string]string),
+	}
+	b.Reload()
+	return b
+}
+
+// Reload loads all sources, a failed source keeps its previous entries.
+func (b *BlackList) Reload() {
+	b.mu.RLock()
+	old := make(map[string][]string)
+	for ip, source := range b.ips {
+		old[source] = append(old[source], ip)
+	}
+	for _, n := range b.nets {
+		old[n.source] = append(old[n.source], n.ipnet.String())
+	}
+	b.mu.RUnlock()
+
+	ips := make(map[string]string)
+	nets := make([]blackListNet, 0)
+
+	for _, source := range b.Sources {
+		name := source.Name()
+		entries, err := source.Load()
+		if err != nil {
+			glog.Warningf("BLACKLIST: %T(%#v).Load() error: %v", source, name, err)
+			entries = old[name]
+		}
+
+		for _, s := range entries {
+			if strings.Contains(s, "/") {
+				if _, ipnet, err := net.ParseCIDR(s); err == nil {
+					nets = append(nets, blackListNet{ipnet, name})
+				} else {
+					glog.Warningf("BLACKLIST: %#v has invalid cidr %#v", name, s)
+				}
+			} else if ip := net.ParseIP(NormalizeIP(s)); ip != nil {
+				ips[ip.String()] = name
+			} else {
+				glog.Warningf("BLACKLIST: %#v has invalid ip %#v", name, s)
+			}
+		}
+	}
+
+	b.mu.Lock()
+	b.ips = ips
+	b.nets = nets
+	b.mu.Unlock()
+
+	glog.V(2).Infof("BLACKLIST: loaded %d ips and %d cidrs from %d sources", len(ips), len(nets), len(b.Sources))
+}
+
+// Lookup returns the source which rejects ip.
+func (b *BlackList) Lookup(ip string) (string, bool) {
+	ip1 := net.ParseIP(NormalizeIP(ip))
+	if ip1 == nil {
+		return "", false
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if source, ok := b.ips[ip1.String()]; ok {
+		return source, true
+	}
+
+	for _, n := range b.nets {
+		if n.ipnet.Contains(ip1) {
+			return n.source + " " + n.ipnet.String(), true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,197 @@
+package dialer
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+	"github.com/phuslu/glog"
+
+	"../helpers"
+)
+
+const (
+	DefaultCertLearnTTL time.Duration = 7 * 24 * time.Hour
+
+	// the learned ips kept for export, the oldest are dropped first
+	maxLearnedIPs int = 4096
+)
+
+// LearnedIP is an ip blacklisted for presenting an injected certificate.
+type LearnedIP struct {
+	IP          string
+	Alias       string
+	ServerName  string
+	Subject     string
+	Issuer      string
+	Fingerprint string
+	Reason      string
+	Learned     time.Time
+	Expires     time.Time
+}
+
+// CertLearner blacklists the ips whose certificate in a raced TLS handshake
+// is clearly forged: its chain does not lead to a trusted root, which is the
+// case of the self-signed certificates of an injector, or it is valid for
+// none of the VerifyAliases names of the alias. An expired certificate is not
+// taken as forged, the local clock may be wrong.
+type CertLearner struct {
+	TTL time.Duration
+	// nil is the system roots
+	Roots *x509.CertPool
+
+	// fingerprints and names of the leafs which passed already
+	good lrucache.Cache
+
+	mu      sync.Mutex
+	learned map[string]LearnedIP
+}
+
+func NewCertLearner(ttl time.Duration) *CertLearner {
+	if ttl <= 0 {
+		ttl = DefaultCertLearnTTL
+	}
+	return &CertLearner{
+		TTL:     ttl,
+		good:    lrucache.NewLRUCache(1024),
+		learned: make(map[string]LearnedIP),
+	}
+}
+
+// check returns why certs are forged, names are the ones the leaf must be
+// valid for if not empty.
+func (l *CertLearner) check(certs []*x509.Certificate, names []string) (string, bool) {
+	if len(certs) == 0 {
+		return "", false
+	}
+
+	sum := sha256.Sum256(certs[0].Raw)
+	key := hex.EncodeToString(sum[:]) + "|" + strings.Join(names, ",")
+	if _, ok := l.good.GetQuiet(key); ok {
+		return "", false
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         l.Roots,
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   helpers.Now(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	if _, err := certs[0].Verify(opts); err != nil {
+		switch e := err.(type) {
+		case x509.UnknownAuthorityError:
+			return e.Error(), true
+		case x509.CertificateInvalidError:
+			if e.Reason != x509.Expired {
+				return e.Error(), true
+			}
+		}
+		// the others say nothing about the ip
+		return "", false
+	}
+
+	if len(names) > 0 {
+		var err error
+		for _, name := range names {
+			if err = certs[0].VerifyHostname(name); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return err.Error(), true
+		}
+	}
+
+	l.good.Set(key, struct{}{}, time.Now().Add(verdictExpiry))
+	return "", false
+}
+
+func (l *CertLearner) learn(ip LearnedIP) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.learned) >= maxLearnedIPs {
+		var oldest string
+		for k, v := range l.learned {
+			if oldest == "" || v.Learned.Before(l.learned[oldest].Learned) {
+				oldest = k
+			}
+		}
+		delete(l.learned, oldest)
+	}
+	l.learned[ip.IP] = ip
+}
+
+// Learned returns the ips learned which have not expired, the latest first.
+func (l *CertLearner) Learned() []LearnedIP {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	ips := make([]LearnedIP, 0, len(l.learned))
+	for k, v := range l.learned {
+		if now.After(v.Expires) {
+			delete(l.learned, k)
+			continue
+		}
+		ips = append(ips, v)
+	}
+
+	sort.Slice(ips, func(i, j int) bool {
+		return ips[i].Learned.After(ips[j].Learned)
+	})
+
+	return ips
+}
+
+// learnCert blacklists the ip of addr if the certificate presented through
+// conn is forged, the error fails the handshake then.
+func (d *MultiDialer) learnCert(conn net.Conn, alias, addr, serverName string) error {
+	if d.CertLearner == nil {
+		return nil
+	}
+
+	certs := peerCertificates(conn)
+	reason, forged := d.CertLearner.check(certs, d.VerifyAliases[alias])
+	if !forged {
+		return nil
+	}
+
+	ip, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		ip = addr
+	}
+	ip = NormalizeIP(ip)
+
+	sum := sha256.Sum256(certs[0].Raw)
+	now := time.Now()
+	learned := LearnedIP{
+		IP:          ip,
+		Alias:       alias,
+		ServerName:  serverName,
+		Subject:     certs[0].Subject.String(),
+		Issuer:      certs[0].Issuer.String(),
+		Fingerprint: hex.EncodeToString(sum[:]),
+		Reason:      reason,
+		Learned:     now,
+		Expires:     now.Add(d.CertLearner.TTL),
+	}
+
+	d.BlackListIP(ip, d.CertLearner.TTL)
+	d.CertLearner.learn(learned)
+
+	glog.Warningf("MULTIDIALER: blacklist %s of alias %#v for %s, certificate subject=%#v issuer=%#v sha256=%s: %s",
+		ip, alias, d.CertLearner.TTL, learned.Subject, learned.Issuer, learned.Fingerprint, reason)
+
+	return fmt.Errorf("%s presents a forged certificate: %s", addr, reason)
+}
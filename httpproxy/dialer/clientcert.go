@@ -0,0 +1,23 @@
+package dialer
+
+import (
+	"crypto/tls"
+)
+
+// withClientCertificate returns config with the client certificate of host
+// in ClientCertificates, or config as is if host has none. The certificate is
+// never presented to the other hosts, e.g. the sites dialed directly.
+func (d *MultiDialer) withClientCertificate(config *tls.Config, host string) *tls.Config {
+	cert, ok := d.ClientCertificates[host]
+	if !ok {
+		return config
+	}
+
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	config.Certificates = []tls.Certificate{cert}
+	return config
+}
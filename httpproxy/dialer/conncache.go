@@ -0,0 +1,111 @@
+package dialer
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+	"github.com/phuslu/glog"
+
+	"../storage"
+)
+
+type connCacheFile struct {
+	SavedAt         time.Time
+	TCPConnDuration map[string]time.Duration
+	TCPConnError    map[string]string
+	TLSConnDuration map[string]time.Duration
+	TLSConnError    map[string]string
+}
+
+func cacheKeys(c lrucache.Cache) []string {
+	if kc, ok := c.(interface {
+		Keys() []string
+	}); ok {
+		return kc.Keys()
+	}
+	return nil
+}
+
+func dumpDurations(c lrucache.Cache) map[string]time.Duration {
+	m := make(map[string]time.Duration)
+	for _, key := range cacheKeys(c) {
+		if v, ok := c.GetQuiet(key); ok {
+			if d, ok := v.(time.Duration); ok {
+				m[key] = d
+			}
+		}
+	}
+	return m
+}
+
+func dumpErrors(c lrucache.Cache) map[string]string {
+	m := make(map[string]string)
+	for _, key := range cacheKeys(c) {
+		if v, ok := c.GetQuiet(key); ok {
+			if err, ok := v.(error); ok {
+				m[key] = err.Error()
+			}
+		}
+	}
+	return m
+}
+
+// SaveConnCache writes the tcp/tls connection durations and errors to
+// filename, the caches must be able to list their keys (see helpers.KeyedCache).
+func (d *MultiDialer) SaveConnCache(filename string) error {
+	data, err := json.Marshal(&connCacheFile{
+		SavedAt:         time.Now(),
+		TCPConnDuration: dumpDurations(d.TCPConnDuration),
+		TCPConnError:    dumpErrors(d.TCPConnError),
+		TLSConnDuration: dumpDurations(d.TLSConnDuration),
+		TLSConnError:    dumpErrors(d.TLSConnError),
+	})
+	if err != nil {
+		return err
+	}
+
+	return storage.WriteFileAtomic(filename, data, 0644)
+}
+
+// LoadConnCache restores the caches saved by SaveConnCache, entries older
+// than maxAge are ignored and loaded entries expire after ConnExpiry.
+func (d *MultiDialer) LoadConnCache(filename string, maxAge time.Duration) error {
+	data, recovered, err := storage.ReadFileVerified(filename, nil)
+	if err != nil {
+		return err
+	}
+	if recovered {
+		glog.Warningf("MULTIDIALER %#v is corrupted, load the last good one", filename)
+	}
+
+	var cf connCacheFile
+	if err = json.Unmarshal(data, &cf); err != nil {
+		return err
+	}
+
+	if maxAge > 0 && time.Since(cf.SavedAt) > maxAge {
+		glog.V(2).Infof("MULTIDIALER skip %#v saved at %s", filename, cf.SavedAt)
+		return nil
+	}
+
+	expire := time.Now().Add(d.ConnExpiry)
+	// the files of older versions may spell an addr in several ways
+	for addr, duration := range cf.TCPConnDuration {
+		d.TCPConnDuration.Set(NormalizeAddr(addr), duration, expire)
+	}
+	for addr, s := range cf.TCPConnError {
+		d.TCPConnError.Set(NormalizeAddr(addr), errors.New(s), expire)
+	}
+	for addr, duration := range cf.TLSConnDuration {
+		d.TLSConnDuration.Set(NormalizeAddr(addr), duration, expire)
+	}
+	for addr, s := range cf.TLSConnError {
+		d.TLSConnError.Set(NormalizeAddr(addr), errors.New(s), expire)
+	}
+
+	glog.Infof("MULTIDIALER loaded %d good_addrs, %d bad_addrs from %#v", len(cf.TCPConnDuration)+len(cf.TLSConnDuration), len(cf.TCPConnError)+len(cf.TLSConnError), filename)
+
+	return nil
+}
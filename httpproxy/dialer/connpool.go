@@ -0,0 +1,113 @@
+package dialer
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultIdleConnTimeout time.Duration = 60 * time.Second
+
+	// how long a pooled conn may take to show it is still open
+	idleConnProbeTimeout = time.Millisecond
+)
+
+type idleConn struct {
+	conn  net.Conn
+	since time.Time
+}
+
+// connPool keeps the TLS connections which finished their handshake after
+// the race of dialMultiTLS was won, so that the next dial of the alias hands
+// one back instead of handshaking again.
+type connPool struct {
+	mu    sync.Mutex
+	conns map[string][]idleConn
+}
+
+func connPoolKey(alias, port string, config *tls.Config) string {
+	if config == nil {
+		return alias + ":" + port
+	}
+	// a conn handshaked with the SNI of one site must not serve another one
+	return alias + ":" + port + "|" + config.ServerName + "|" + strings.Join(config.NextProtos, ",")
+}
+
+// addrsPort returns the port of the addrs raced for an alias, they share it.
+func addrsPort(addrs []string) string {
+	if len(addrs) == 0 {
+		return ""
+	}
+	_, port, _ := net.SplitHostPort(addrs[0])
+	return port
+}
+
+// put keeps conn unless there are max conns of key already.
+func (p *connPool) put(key string, conn net.Conn, max int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.conns == nil {
+		p.conns = make(map[string][]idleConn)
+	}
+
+	if len(p.conns[key]) >= max {
+		conn.Close()
+		return
+	}
+
+	p.conns[key] = append(p.conns[key], idleConn{conn, time.Now()})
+}
+
+// get returns the newest conn of key which is younger than timeout and
+// still open, the stale ones are closed.
+func (p *connPool) get(key string, timeout time.Duration) net.Conn {
+	for {
+		p.mu.Lock()
+		conns := p.conns[key]
+		if len(conns) == 0 {
+			p.mu.Unlock()
+			return nil
+		}
+		ic := conns[len(conns)-1]
+		p.conns[key] = conns[:len(conns)-1]
+		p.mu.Unlock()
+
+		if time.Since(ic.since) < timeout && isConnAlive(ic.conn) {
+			return ic.conn
+		}
+		ic.conn.Close()
+	}
+}
+
+// closeAll closes the pooled conns, e.g. when the dialer caches are cleared.
+func (p *connPool) closeAll() {
+	p.mu.Lock()
+	conns := p.conns
+	p.conns = nil
+	p.mu.Unlock()
+
+	for _, ics := range conns {
+		for _, ic := range ics {
+			ic.conn.Close()
+		}
+	}
+}
+
+// isConnAlive reads conn with a tiny deadline, an idle conn times out while
+// a closed one returns EOF. Any data is unexpected and spoils conn.
+func isConnAlive(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(idleConnProbeTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	var b [1]byte
+	n, err := conn.Read(b[:])
+	if n > 0 {
+		return false
+	}
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
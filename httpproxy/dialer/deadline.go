@@ -0,0 +1,31 @@
+package dialer
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"../helpers"
+)
+
+// withConnectTimeout returns dialer, or a copy of it with the ConnectTimeout
+// of the deadline policy of ctx.
+func withConnectTimeout(ctx context.Context, dialer *net.Dialer) *net.Dialer {
+	p, ok := helpers.DeadlinePolicyFromContext(ctx)
+	if !ok || p.ConnectTimeout <= 0 {
+		return dialer
+	}
+
+	d := *dialer
+	d.Timeout = time.Duration(p.ConnectTimeout) * time.Second
+	return &d
+}
+
+// handshakeTimeout returns the TLSHandshakeTimeout of the deadline policy of
+// ctx, or timeout if it has none.
+func handshakeTimeout(ctx context.Context, timeout time.Duration) time.Duration {
+	if p, ok := helpers.DeadlinePolicyFromContext(ctx); ok && p.TLSHandshakeTimeout > 0 {
+		return time.Duration(p.TLSHandshakeTimeout) * time.Second
+	}
+	return timeout
+}
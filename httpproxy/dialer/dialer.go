@@ -1,12 +1,16 @@
 package dialer
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/cloudflare/golibs/lrucache"
 	"github.com/phuslu/glog"
+
+	"../helpers"
 )
 
 const (
@@ -25,20 +29,91 @@ type Dialer struct {
 	DNSCacheExpiry time.Duration
 	LoopbackAddrs  map[string]struct{}
 	Level          int
+	// Hosts pins the ips of hostnames, e.g. fetch servers whose dns is
+	// poisoned, the pinned ips are raced against each other.
+	Hosts map[string][]string
+	// BadIPs holds the ips which served a hijacked response, they are
+	// skipped when a hostname is resolved.
+	BadIPs lrucache.Cache
+	// Retry takes over RetryTimes and RetryDelay if not nil.
+	Retry *helpers.RetryPolicy
+
+	muHosts sync.RWMutex
+}
+
+// SetHosts replaces Hosts, the connections dialed before are kept.
+func (d *Dialer) SetHosts(hosts map[string][]string) {
+	d.muHosts.Lock()
+	defer d.muHosts.Unlock()
+	d.Hosts = hosts
 }
 
-func (d *Dialer) Dial(network, address string) (conn net.Conn, err error) {
+func (d *Dialer) pinnedIPs(host string) ([]string, bool) {
+	d.muHosts.RLock()
+	defer d.muHosts.RUnlock()
+	ips, ok := d.Hosts[host]
+	return ips, ok && len(ips) > 0
+}
+
+// RegisterCaches hands DNSCache and BadIPs to helpers.DefaultCacheManager as
+// "<name>.<field>" if they are KeyedCaches, as MultiDialer.RegisterCaches.
+func (d *Dialer) RegisterCaches(name string) {
+	for field, c := range map[string]lrucache.Cache{
+		"DNSCache": d.DNSCache,
+		"BadIPs":   d.BadIPs,
+	} {
+		if kc, ok := c.(*helpers.KeyedCache); ok {
+			helpers.DefaultCacheManager.Register(name+"."+field, kc)
+		}
+	}
+}
+
+func (d *Dialer) retryPolicy() *helpers.RetryPolicy {
+	if d.Retry != nil {
+		return d.Retry
+	}
+
+	p := &helpers.RetryPolicy{
+		MaxAttempts: d.RetryTimes,
+		Backoff:     d.RetryDelay.Seconds(),
+		MaxBackoff:  d.RetryDelay.Seconds(),
+	}
+	if p.MaxAttempts == 0 {
+		p.MaxAttempts = DefaultRetryTimes
+	}
+	if p.Backoff == 0 {
+		p.Backoff, p.MaxBackoff = DefaultRetryDelay.Seconds(), DefaultRetryDelay.Seconds()
+	}
+	return p
+}
+
+func (d *Dialer) Dial(network, address string) (net.Conn, error) {
+	return d.dial(&d.Dialer, network, address)
+}
+
+func (d *Dialer) dial(nd *net.Dialer, network, address string) (conn net.Conn, err error) {
 	glog.V(3).Infof("Dail(%#v, %#v)", network, address)
 
 	switch network {
 	case "tcp", "tcp4", "tcp6":
+		if host, port, err := net.SplitHostPort(address); err == nil {
+			if ips, ok := d.pinnedIPs(host); ok {
+				return d.dialPinned(nd, network, ips, port)
+			}
+		}
 		if d.DNSCache != nil {
-			if addr, ok := d.DNSCache.Get(address); ok {
+			if addr, ok := d.DNSCache.Get(address); ok && !d.isBadAddr(addr.(string)) {
 				address = addr.(string)
 			} else {
 				if host, port, err := net.SplitHostPort(address); err == nil {
 					if ips, err := net.LookupIP(host); err == nil && len(ips) > 0 {
 						ip := ips[0].String()
+						for _, ip1 := range ips {
+							if !d.IsBadIP(ip1.String()) {
+								ip = ip1.String()
+								break
+							}
+						}
 						if d.LoopbackAddrs != nil {
 							if _, ok := d.LoopbackAddrs[ip]; ok {
 								return nil, net.InvalidAddrError(fmt.Sprintf("Invaid DNS Record: %s(%s)", host, ip))
@@ -61,21 +136,15 @@ func (d *Dialer) Dial(network, address string) (conn net.Conn, err error) {
 	}
 
 	if d.Level <= 1 {
-		retry := d.RetryTimes
-		if retry == 0 {
-			retry = DefaultRetryTimes
-		}
-
-		for i := 0; i < retry; i++ {
-			conn, err = d.Dialer.Dial(network, address)
-			if err == nil || i == retry-1 {
-				break
+		retry := d.retryPolicy()
+		for i := 0; i < retry.Attempts(); i++ {
+			if i > 0 {
+				time.Sleep(retry.Delay(i))
 			}
-			retryDelay := d.RetryDelay
-			if retryDelay == 0 {
-				retryDelay = DefaultRetryDelay
+			conn, err = nd.Dial(network, address)
+			if err == nil || !retry.RetryError(err) {
+				break
 			}
-			time.Sleep(retryDelay)
 		}
 		return conn, err
 	} else {
@@ -85,11 +154,11 @@ func (d *Dialer) Dial(network, address string) (conn net.Conn, err error) {
 		}
 
 		lane := make(chan racer, d.Level)
-		retry := (d.RetryTimes + d.Level - 1) / d.Level
+		retry := (d.retryPolicy().Attempts() + d.Level - 1) / d.Level
 		for i := 0; i < retry; i++ {
 			for j := 0; j < d.Level; j++ {
 				go func(addr string, c chan<- racer) {
-					conn, err := d.Dialer.Dial(network, addr)
+					conn, err := nd.Dial(network, addr)
 					lane <- racer{conn, err}
 				}(address, lane)
 			}
@@ -119,3 +188,67 @@ func (d *Dialer) Dial(network, address string) (conn net.Conn, err error) {
 
 	return nil, net.UnknownNetworkError("Unkown transport/direct error")
 }
+
+// DialContext is Dial with the ConnectTimeout of the deadline policy of ctx,
+// if there is one.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if p, ok := helpers.DeadlinePolicyFromContext(ctx); ok && p.ConnectTimeout > 0 {
+		nd := d.Dialer
+		nd.Timeout = time.Duration(p.ConnectTimeout) * time.Second
+		return d.dial(&nd, network, address)
+	}
+	return d.Dial(network, address)
+}
+
+// MarkBadIP skips ip for expiry when hostnames are resolved.
+func (d *Dialer) MarkBadIP(ip string, expiry time.Duration) {
+	if d.BadIPs != nil {
+		d.BadIPs.Set(ip, struct{}{}, time.Now().Add(expiry))
+	}
+}
+
+func (d *Dialer) IsBadIP(ip string) bool {
+	if d.BadIPs == nil {
+		return false
+	}
+	_, ok := d.BadIPs.GetNotStale(ip)
+	return ok
+}
+
+func (d *Dialer) isBadAddr(addr string) bool {
+	ip, _, err := net.SplitHostPort(addr)
+	return err == nil && d.IsBadIP(ip)
+}
+
+// dialPinned races the pinned ips and returns the first connection.
+func (d *Dialer) dialPinned(nd *net.Dialer, network string, ips []string, port string) (net.Conn, error) {
+	type racer struct {
+		c net.Conn
+		e error
+	}
+
+	lane := make(chan racer, len(ips))
+	for _, ip := range ips {
+		go func(addr string) {
+			conn, err := nd.Dial(network, addr)
+			lane <- racer{conn, err}
+		}(net.JoinHostPort(ip, port))
+	}
+
+	var r racer
+	for i := 0; i < len(ips); i++ {
+		r = <-lane
+		if r.e == nil {
+			go func(count int) {
+				for ; count > 0; count-- {
+					if r1 := <-lane; r1.c != nil {
+						r1.c.Close()
+					}
+				}
+			}(len(ips) - 1 - i)
+			return r.c, nil
+		}
+	}
+
+	return nil, r.e
+}
@@ -0,0 +1,87 @@
+package dialer
+
+import (
+	"fmt"
+	"net"
+)
+
+// ipv4only.arpa resolves to these well-known addresses only, a DNS64 resolver
+// answers its AAAA query with them embedded in the NAT64 prefix (RFC 7050).
+var wellKnownIPv4Only = []net.IP{
+	net.IPv4(192, 0, 0, 170),
+	net.IPv4(192, 0, 0, 171),
+}
+
+// DetectDNS64 returns the /96 NAT64 prefixes of the system resolver.
+func DetectDNS64() ([]net.IP, error) {
+	ips, err := net.LookupIP("ipv4only.arpa")
+	if err != nil {
+		return nil, err
+	}
+
+	prefixes := make([]net.IP, 0)
+	seen := make(map[string]struct{})
+	for _, ip := range ips {
+		if ip.To4() != nil || len(ip) != net.IPv6len {
+			continue
+		}
+		for _, ip4 := range wellKnownIPv4Only {
+			if !ip[12:].Equal(ip4.To4()) {
+				continue
+			}
+			prefix := make(net.IP, net.IPv6len)
+			copy(prefix, ip[:12])
+			if _, ok := seen[prefix.String()]; !ok {
+				seen[prefix.String()] = struct{}{}
+				prefixes = append(prefixes, prefix)
+			}
+		}
+	}
+
+	if len(prefixes) == 0 {
+		return nil, fmt.Errorf("no DNS64 prefix found in %v", ips)
+	}
+
+	return prefixes, nil
+}
+
+// ParseDNS64Prefixes parses prefixes like "64:ff9b::/96", only /96 prefixes
+// are supported.
+func ParseDNS64Prefixes(ss []string) ([]net.IP, error) {
+	prefixes := make([]net.IP, 0, len(ss))
+	for _, s := range ss {
+		ip, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		if ones, bits := ipnet.Mask.Size(); ones != 96 || bits != 128 {
+			return nil, fmt.Errorf("DNS64 prefix %#v is not a /96 ipv6 prefix", s)
+		}
+		prefixes = append(prefixes, ip.Mask(ipnet.Mask))
+	}
+	return prefixes, nil
+}
+
+// synthesizeDNS64 maps the ipv4 addrs into DNS64Prefixes, ipv6 addrs are
+// kept as is.
+func (d *MultiDialer) synthesizeDNS64(addrs []string) []string {
+	addrs1 := make([]string, 0, len(addrs)*len(d.DNS64Prefixes))
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			continue
+		}
+		ip4 := ip.To4()
+		if ip4 == nil {
+			addrs1 = append(addrs1, addr)
+			continue
+		}
+		for _, prefix := range d.DNS64Prefixes {
+			ip6 := make(net.IP, net.IPv6len)
+			copy(ip6, prefix[:12])
+			copy(ip6[12:], ip4)
+			addrs1 = append(addrs1, ip6.String())
+		}
+	}
+	return addrs1
+}
@@ -0,0 +1,248 @@
+package dialer
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../helpers"
+)
+
+const (
+	DefaultDNSNegativeExpiry time.Duration = 30 * time.Second
+)
+
+// dnsCall is an in-flight lookup, concurrent lookups of the same key wait
+// for it instead of querying the resolver again.
+type dnsCall struct {
+	wg    sync.WaitGroup
+	addrs []string
+	err   error
+}
+
+// singleLookup runs lookup once for all concurrent callers of key, so that a
+// burst of requests for a cold name sends one query instead of N. Each caller
+// gets its own copy of the addrs.
+func (d *MultiDialer) singleLookup(key string, lookup func() ([]string, error)) ([]string, error) {
+	d.muLookups.Lock()
+	if c, ok := d.lookups[key]; ok {
+		d.muLookups.Unlock()
+		c.wg.Wait()
+		return copyAddrs(c.addrs), c.err
+	}
+	if d.lookups == nil {
+		d.lookups = make(map[string]*dnsCall)
+	}
+	c := &dnsCall{}
+	c.wg.Add(1)
+	d.lookups[key] = c
+	d.muLookups.Unlock()
+
+	defer func() {
+		d.muLookups.Lock()
+		delete(d.lookups, key)
+		d.muLookups.Unlock()
+		c.wg.Done()
+	}()
+
+	c.addrs, c.err = lookup()
+	return copyAddrs(c.addrs), c.err
+}
+
+func copyAddrs(addrs []string) []string {
+	if addrs == nil {
+		return nil
+	}
+	return append(make([]string, 0, len(addrs)), addrs...)
+}
+
+// lookupName returns the StaticHosts ips of name if there are any, or its
+// cached addrs. A fresh entry is returned as is, a stale one is returned
+// while it is refreshed in background, and only a missing entry blocks on the
+// resolver. A non empty servers overrides the default resolvers.
+func (d *MultiDialer) lookupName(name string, servers []string) ([]string, error) {
+	if addrs, ok := d.lookupStatic(name); ok {
+		return addrs, nil
+	}
+	return d.lookupNameDNS(name, servers)
+}
+
+func (d *MultiDialer) lookupNameDNS(name string, servers []string) ([]string, error) {
+	if addrs, ok := d.DNSCache.GetNotStale(name); ok {
+		return addrs.([]string), nil
+	}
+
+	if addrs, ok := d.DNSCache.Get(name); ok && len(addrs.([]string)) > 0 {
+		go d.resolveName(name, servers)
+		return addrs.([]string), nil
+	}
+
+	return d.resolveName(name, servers)
+}
+
+// resolveName queries name once for all concurrent callers and caches the
+// result. A failed lookup keeps the previous addrs if there are any,
+// otherwise an empty entry is cached for DNSNegativeExpiry.
+func (d *MultiDialer) resolveName(name string, servers []string) ([]string, error) {
+	return d.singleLookup("name "+name, func() ([]string, error) {
+		return d.resolveName1(name, servers)
+	})
+}
+
+func (d *MultiDialer) resolveName1(name string, servers []string) ([]string, error) {
+	var addrs []string
+	var err error
+	if len(servers) > 0 {
+		addrs, err = d.lookupHostFirst(name, servers)
+	} else if dnsservers := d.dnsServers(); d.ipv6Only() && len(dnsservers) > 0 {
+		addrs, err = d.lookupHostFirst(name, dnsServerAddrs(dnsservers))
+	} else {
+		addrs, err = d.LookupHost(name)
+		if err != nil {
+			helpers.DefaultLogger.Warning("LookupHost error", helpers.F("name", name), helpers.F("error", err))
+		}
+	}
+
+	if err == nil && len(addrs) > 0 {
+		glog.V(2).Infof("LookupHost(%#v) return %v", name, addrs)
+		d.DNSCache.Set(name, addrs, time.Now().Add(d.DNSCacheExpiry))
+		return addrs, nil
+	}
+
+	negativeExpiry := d.DNSNegativeExpiry
+	if negativeExpiry <= 0 {
+		negativeExpiry = DefaultDNSNegativeExpiry
+	}
+
+	if addrs0, ok := d.DNSCache.Get(name); ok && len(addrs0.([]string)) > 0 {
+		glog.Warningf("LookupHost(%#v) failed, serve stale addrs %v", name, addrs0)
+		d.DNSCache.Set(name, addrs0, time.Now().Add(negativeExpiry))
+		return addrs0.([]string), nil
+	}
+
+	d.DNSCache.Set(name, []string{}, time.Now().Add(negativeExpiry))
+	return []string{}, err
+}
+
+func dnsServerAddrs(ips []net.IP) []string {
+	servers := make([]string, len(ips))
+	for i, ip := range ips {
+		servers[i] = net.JoinHostPort(ip.String(), "53")
+	}
+	return servers
+}
+
+type dnsAnswer struct {
+	server string
+	addrs  []string
+	err    error
+}
+
+// lookupHostFanout queries name through all servers at once, each one with
+// its own DNSQueryOptions and timeout.
+func (d *MultiDialer) lookupHostFanout(name string, servers []string) <-chan dnsAnswer {
+	answers := make(chan dnsAnswer, len(servers))
+	for _, server := range servers {
+		go func(server string) {
+			addrs, err := d.lookupHostVia(name, server)
+			if err != nil {
+				helpers.DefaultLogger.Warning("LookupHost error", helpers.F("name", name), helpers.F("server", server), helpers.F("error", err))
+			}
+			answers <- dnsAnswer{server, addrs, err}
+		}(server)
+	}
+	return answers
+}
+
+// lookupHostFirst returns the first non empty answer of servers, a slow or
+// dead resolver does not delay the others.
+func (d *MultiDialer) lookupHostFirst(name string, servers []string) ([]string, error) {
+	if d.DNSOrdering {
+		return d.lookupHostOrdered(name, servers)
+	}
+
+	answers := d.lookupHostFanout(name, servers)
+
+	var err error
+	for range servers {
+		a := <-answers
+		if a.err == nil && len(a.addrs) > 0 {
+			return a.addrs, nil
+		}
+		if a.err != nil {
+			err = a.err
+		}
+	}
+
+	return nil, err
+}
+
+// lookupHostOrdered queries the fastest healthy one of servers first, and the
+// next one whenever the last one fails or is slower than it has been, see
+// dnsStats.order.
+func (d *MultiDialer) lookupHostOrdered(name string, servers []string) ([]string, error) {
+	servers, step := d.dnsStats.order(servers)
+	answers := make(chan dnsAnswer, len(servers))
+	query := func(server string) {
+		addrs, err := d.lookupHostVia(name, server)
+		if err != nil {
+			helpers.DefaultLogger.Warning("LookupHost error", helpers.F("name", name), helpers.F("server", server), helpers.F("error", err))
+		}
+		answers <- dnsAnswer{server, addrs, err}
+	}
+
+	var err error
+	next, pending := 0, 0
+	for next < len(servers) || pending > 0 {
+		if next < len(servers) && (pending == 0 || step == 0) {
+			go query(servers[next])
+			next++
+			pending++
+			continue
+		}
+
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if next < len(servers) {
+			timer = time.NewTimer(step)
+			timeout = timer.C
+		}
+
+		select {
+		case a := <-answers:
+			if timer != nil {
+				timer.Stop()
+			}
+			pending--
+			if a.err == nil && len(a.addrs) > 0 {
+				return a.addrs, nil
+			}
+			if a.err != nil {
+				err = a.err
+			}
+		case <-timeout:
+			go query(servers[next])
+			next++
+			pending++
+		}
+	}
+
+	return nil, err
+}
+
+// lookupHostAll merges the answers of all servers.
+func (d *MultiDialer) lookupHostAll(name string, servers []string) []string {
+	answers := d.lookupHostFanout(name, servers)
+
+	addrs := make([]string, 0)
+	for range servers {
+		if a := <-answers; a.err == nil {
+			glog.V(2).Infof("ExpandList(%#v) %#v return %v", name, a.server, a.addrs)
+			addrs = append(addrs, a.addrs...)
+		}
+	}
+
+	return addrs
+}
@@ -0,0 +1,106 @@
+package dialer
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../storage"
+)
+
+type dnsCacheFile struct {
+	SavedAt time.Time
+	Hosts   map[string][]string
+}
+
+// SaveDNSCache writes the resolved addrs of DNSCache to filename, the failed
+// lookups are left out.
+func (d *MultiDialer) SaveDNSCache(filename string) error {
+	hosts := make(map[string][]string)
+	for _, name := range cacheKeys(d.DNSCache) {
+		if v, ok := d.DNSCache.GetQuiet(name); ok {
+			if addrs, ok := v.([]string); ok && len(addrs) > 0 {
+				hosts[name] = addrs
+			}
+		}
+	}
+
+	data, err := json.Marshal(&dnsCacheFile{
+		SavedAt: time.Now(),
+		Hosts:   hosts,
+	})
+	if err != nil {
+		return err
+	}
+
+	return storage.WriteFileAtomic(filename, data, 0644)
+}
+
+// LoadDNSCache restores the addrs saved by SaveDNSCache, unless they are older
+// than maxAge. The loaded addrs are stale, a lookup returns them at once and
+// refreshes them in background.
+func (d *MultiDialer) LoadDNSCache(filename string, maxAge time.Duration) error {
+	data, recovered, err := storage.ReadFileVerified(filename, nil)
+	if err != nil {
+		return err
+	}
+	if recovered {
+		glog.Warningf("MULTIDIALER %#v is corrupted, load the last good one", filename)
+	}
+
+	var cf dnsCacheFile
+	if err = json.Unmarshal(data, &cf); err != nil {
+		return err
+	}
+
+	if maxAge > 0 && time.Since(cf.SavedAt) > maxAge {
+		glog.V(2).Infof("MULTIDIALER skip %#v saved at %s", filename, cf.SavedAt)
+		return nil
+	}
+
+	now := time.Now()
+	n := 0
+	for name, addrs := range cf.Hosts {
+		if len(addrs) == 0 {
+			continue
+		}
+		// a fresher entry resolved since the start wins
+		if _, ok := d.DNSCache.GetQuiet(name); ok {
+			continue
+		}
+		d.DNSCache.Set(name, addrs, now)
+		n++
+	}
+
+	glog.Infof("MULTIDIALER loaded %d hosts from %#v", n, filename)
+
+	return nil
+}
+
+// PrefetchDNS resolves names into DNSCache, an alias is expanded with all of
+// its resolvers by ExpandAlias and a host is resolved as it is dialed.
+func (d *MultiDialer) PrefetchDNS(names []string) {
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			var err error
+			if d.HasAlias(name) {
+				err = d.ExpandAlias(name)
+			} else {
+				_, err = d.lookupName(name, nil)
+			}
+			if err != nil {
+				glog.Warningf("MULTIDIALER: prefetch %#v error: %v", name, err)
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	glog.Infof("MULTIDIALER: prefetched %d names in %s", len(names), time.Since(start))
+}
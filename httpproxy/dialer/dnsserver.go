@@ -0,0 +1,226 @@
+package dialer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	DefaultDNSTimeout time.Duration = 2 * time.Second
+	DefaultDoHTimeout time.Duration = 5 * time.Second
+
+	// the EDNS0 buffer size of the DNS flag day 2020, which avoids fragments
+	defaultEDNS0UDPSize uint16 = 1232
+)
+
+var dohClient = &http.Client{}
+
+// DNSQueryOptions is how the queries are sent to a resolver of DNSServers or
+// AliasDNSServers.
+type DNSQueryOptions struct {
+	// the EDNS0 client subnet, e.g. "203.0.113.0/24", so that CDNs answer
+	// with the nodes near it instead of near the resolver
+	ClientSubnet string
+	// sets the DO bit and drops the answers which the resolver did not
+	// validate, the resolver must be a validating one
+	DNSSEC bool
+	// the EDNS0 UDP payload size, 1232 if EDNS0 is used
+	UDPSize uint16
+	// in seconds, 2 for plain resolvers and 5 for DoH by default
+	Timeout int
+}
+
+func (o DNSQueryOptions) Validate() error {
+	if o.ClientSubnet != "" {
+		if _, _, err := net.ParseCIDR(o.ClientSubnet); err != nil {
+			return fmt.Errorf("invalid ClientSubnet %#v: %v", o.ClientSubnet, err)
+		}
+	}
+	if o.Timeout < 0 {
+		return fmt.Errorf("invalid Timeout %d", o.Timeout)
+	}
+	return nil
+}
+
+// apply returns a copy of m with the EDNS0 options of o.
+func (o DNSQueryOptions) apply(m *dns.Msg) *dns.Msg {
+	if o.ClientSubnet == "" && !o.DNSSEC && o.UDPSize == 0 {
+		return m
+	}
+
+	m = m.Copy()
+
+	udpSize := o.UDPSize
+	if udpSize == 0 {
+		udpSize = defaultEDNS0UDPSize
+	}
+	m.SetEdns0(udpSize, o.DNSSEC)
+	if o.DNSSEC {
+		// ask for the AD bit even if the resolver ignores the DO bit
+		m.AuthenticatedData = true
+	}
+
+	if o.ClientSubnet != "" {
+		_, ipnet, _ := net.ParseCIDR(o.ClientSubnet)
+		ones, _ := ipnet.Mask.Size()
+		subnet := &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        1,
+			SourceNetmask: uint8(ones),
+			Address:       ipnet.IP,
+		}
+		if ip4 := ipnet.IP.To4(); ip4 != nil {
+			subnet.Address = ip4
+		} else {
+			subnet.Family = 2
+		}
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, subnet)
+	}
+
+	return m
+}
+
+func (o DNSQueryOptions) timeout(server string) time.Duration {
+	switch {
+	case o.Timeout > 0:
+		return time.Duration(o.Timeout) * time.Second
+	case isDoHServer(server):
+		return DefaultDoHTimeout
+	default:
+		return DefaultDNSTimeout
+	}
+}
+
+// SetDNSQueryOptions swaps the query options by resolver, see
+// ParseDNSServer, "*" applies to the resolvers which are not listed.
+func (d *MultiDialer) SetDNSQueryOptions(options map[string]DNSQueryOptions) error {
+	options1 := make(map[string]DNSQueryOptions, len(options))
+	for server, o := range options {
+		if err := o.Validate(); err != nil {
+			return fmt.Errorf("DNSQueryOptions[%#v]: %v", server, err)
+		}
+		if server != "*" {
+			s, err := ParseDNSServer(server)
+			if err != nil {
+				return fmt.Errorf("DNSQueryOptions[%#v]: %v", server, err)
+			}
+			server = s
+		}
+		options1[server] = o
+	}
+
+	d.muConfig.Lock()
+	defer d.muConfig.Unlock()
+	d.DNSQueryOptions = options1
+
+	return nil
+}
+
+func (d *MultiDialer) dnsQueryOptions(server string) DNSQueryOptions {
+	d.muConfig.RLock()
+	defer d.muConfig.RUnlock()
+
+	if o, ok := d.DNSQueryOptions[server]; ok {
+		return o
+	}
+	return d.DNSQueryOptions["*"]
+}
+
+// exchange sends m to server with the DNSQueryOptions of server.
+func (d *MultiDialer) exchange(m *dns.Msg, server string) (*dns.Msg, error) {
+	o := d.dnsQueryOptions(server)
+
+	start := time.Now()
+	r, err := exchange(o.apply(m), server, o.timeout(server))
+	d.dnsStats.observe(server, time.Since(start), err)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.DNSSEC && !r.AuthenticatedData && r.Rcode == dns.RcodeSuccess {
+		return nil, fmt.Errorf("the answer of %s from %s is not DNSSEC validated", m.Question[0].Name, server)
+	}
+
+	return r, nil
+}
+
+// ParseDNSServer normalizes a resolver of AliasDNSServers, which is an ip, an
+// "ip:port" or the url of a DNS over HTTPS (RFC 8484) endpoint.
+func ParseDNSServer(s string) (string, error) {
+	if isDoHServer(s) {
+		return s, nil
+	}
+	if ip := net.ParseIP(strings.Trim(s, "[]")); ip != nil {
+		return net.JoinHostPort(ip.String(), "53"), nil
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil && net.ParseIP(host) != nil {
+		return s, nil
+	}
+	return "", fmt.Errorf("invalid dns server %#v", s)
+}
+
+func isDoHServer(server string) bool {
+	return strings.HasPrefix(server, "https://")
+}
+
+// exchange sends m to server, a plain "ip:port" resolver or a DoH url. A
+// truncated UDP answer is asked again over TCP.
+func exchange(m *dns.Msg, server string, timeout time.Duration) (*dns.Msg, error) {
+	if !isDoHServer(server) {
+		c := &dns.Client{Timeout: timeout}
+		r, _, err := c.Exchange(m, server)
+		if err == nil && r.Truncated {
+			c.Net = "tcp"
+			r, _, err = c.Exchange(m, server)
+		}
+		return r, err
+	}
+
+	data, err := m.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, server, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	resp, err := dohClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DoH %s returns %s", server, resp.Status)
+	}
+
+	data, err = ioutil.ReadAll(io.LimitReader(resp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	r := new(dns.Msg)
+	if err = r.Unpack(data); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
@@ -0,0 +1,139 @@
+package dialer
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// a resolver is unhealthy after this many failures in a row, until it
+	// answers again
+	dnsUnhealthyStreak int = 3
+	// the weight of a new latency in DNSServerStats.Latency
+	dnsLatencyWeight float64 = 0.2
+	// the bounds of the wait for a resolver before the next one is queried
+	dnsStaggerMin time.Duration = 25 * time.Millisecond
+	dnsStaggerMax time.Duration = 500 * time.Millisecond
+)
+
+// DNSServerStats is how the queries to a resolver have gone.
+type DNSServerStats struct {
+	Server   string
+	Queries  int64
+	Failures int64
+	// failures in a row
+	Streak int
+	// the moving average of the answers
+	Latency   time.Duration
+	LastError string `json:",omitempty"`
+	LastSeen  time.Time
+	Healthy   bool
+}
+
+type dnsStats struct {
+	mu      sync.Mutex
+	servers map[string]*DNSServerStats
+}
+
+func (s *dnsStats) observe(server string, latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.servers == nil {
+		s.servers = make(map[string]*DNSServerStats)
+	}
+	st, ok := s.servers[server]
+	if !ok {
+		st = &DNSServerStats{Server: server}
+		s.servers[server] = st
+	}
+
+	st.Queries++
+	st.LastSeen = time.Now()
+	if err != nil {
+		st.Failures++
+		st.Streak++
+		st.LastError = err.Error()
+		return
+	}
+
+	st.Streak = 0
+	if st.Latency == 0 {
+		st.Latency = latency
+	} else {
+		st.Latency += time.Duration(dnsLatencyWeight * float64(latency-st.Latency))
+	}
+}
+
+// dnsServerRank orders the healthy resolvers by latency, then the ones not
+// queried yet, then the unhealthy ones by their failures in a row.
+func dnsServerRank(st *DNSServerStats) (int, time.Duration) {
+	switch {
+	case st == nil || st.Queries == st.Failures && st.Streak < dnsUnhealthyStreak:
+		return 1, 0
+	case st.Streak < dnsUnhealthyStreak:
+		return 0, st.Latency
+	default:
+		return 2, time.Duration(st.Streak)
+	}
+}
+
+// order returns servers the fastest healthy one first, and how long to wait
+// for a resolver before the next one is queried, 0 to query all at once when
+// none has answered yet.
+func (s *dnsStats) order(servers []string) ([]string, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ordered := append([]string(nil), servers...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		ri, li := dnsServerRank(s.servers[ordered[i]])
+		rj, lj := dnsServerRank(s.servers[ordered[j]])
+		if ri != rj {
+			return ri < rj
+		}
+		return li < lj
+	})
+
+	if len(ordered) == 0 {
+		return ordered, 0
+	}
+	rank, latency := dnsServerRank(s.servers[ordered[0]])
+	if rank != 0 {
+		return ordered, 0
+	}
+
+	step := 2 * latency
+	if step < dnsStaggerMin {
+		step = dnsStaggerMin
+	}
+	if step > dnsStaggerMax {
+		step = dnsStaggerMax
+	}
+	return ordered, step
+}
+
+// DNSServerStats returns the stats of the resolvers queried so far, in the
+// order they are tried with DNSOrdering.
+func (d *MultiDialer) DNSServerStats() []DNSServerStats {
+	d.dnsStats.mu.Lock()
+	servers := make([]string, 0, len(d.dnsStats.servers))
+	for server := range d.dnsStats.servers {
+		servers = append(servers, server)
+	}
+	d.dnsStats.mu.Unlock()
+
+	servers, _ = d.dnsStats.order(servers)
+
+	d.dnsStats.mu.Lock()
+	defer d.dnsStats.mu.Unlock()
+
+	stats := make([]DNSServerStats, 0, len(servers))
+	for _, server := range servers {
+		st := *d.dnsStats.servers[server]
+		st.Healthy = st.Streak < dnsUnhealthyStreak
+		stats = append(stats, st)
+	}
+	return stats
+}
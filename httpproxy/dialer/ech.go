@@ -0,0 +1,258 @@
+package dialer
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/phuslu/glog"
+)
+
+const (
+	DefaultECHDNSServer string = "https://1.1.1.1/dns-query"
+
+	// the HTTPS resource record type and the ech SvcParamKey of RFC 9460,
+	// written out for the versions of miekg/dns which do not know them
+	dnsTypeHTTPS uint16 = 65
+	svcParamECH  uint16 = 5
+)
+
+// SetECHDNSServer swaps the DoH url which the ECH configs are fetched from,
+// "" is DefaultECHDNSServer.
+func (d *MultiDialer) SetECHDNSServer(server string) error {
+	if server != "" && !isDoHServer(server) {
+		return fmt.Errorf("ECHDNSServer %#v is not a DoH url", server)
+	}
+
+	d.muConfig.Lock()
+	defer d.muConfig.Unlock()
+	d.ECHDNSServer = server
+
+	return nil
+}
+
+// echServers returns the DoH servers of alias followed by ECHDNSServer, the
+// HTTPS record must not be looked up in plain text either.
+func (d *MultiDialer) echServers(alias string) []string {
+	servers := make([]string, 0)
+	for _, server := range d.aliasDNSServers(alias) {
+		if isDoHServer(server) {
+			servers = append(servers, server)
+		}
+	}
+
+	d.muConfig.RLock()
+	server := d.ECHDNSServer
+	d.muConfig.RUnlock()
+	if server == "" {
+		server = DefaultECHDNSServer
+	}
+
+	return append(servers, server)
+}
+
+// setECH puts the ECH config of config.ServerName into config if the policy
+// of alias asks for ECH. It fails instead of falling back to a plain
+// ClientHello, which would send the real SNI on the wire.
+func (d *MultiDialer) setECH(alias string, config *tls.Config) error {
+	if !d.sniPolicy(alias).ECH {
+		return nil
+	}
+
+	list, err := d.lookupECHConfig(alias, config.ServerName)
+	if err != nil {
+		return fmt.Errorf("ECH config of %#v: %v", config.ServerName, err)
+	}
+	if len(list) == 0 {
+		return fmt.Errorf("%#v publishes no ECH config", config.ServerName)
+	}
+
+	config.EncryptedClientHelloConfigList = list
+	config.MinVersion = tls.VersionTLS13
+	if config.MaxVersion != 0 && config.MaxVersion < tls.VersionTLS13 {
+		config.MaxVersion = tls.VersionTLS13
+	}
+
+	return nil
+}
+
+func echCacheKey(name string) string {
+	return name + " HTTPS"
+}
+
+// lookupECHConfig returns the ECHConfigList of the HTTPS record of name. It
+// is kept in DNSCache next to the addrs of name, an empty one means name
+// publishes none and is cached for DNSNegativeExpiry.
+func (d *MultiDialer) lookupECHConfig(alias, name string) ([]byte, error) {
+	key := echCacheKey(name)
+	if v, ok := d.DNSCache.Get(key); ok {
+		return v.([]byte), nil
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), dnsTypeHTTPS)
+	m.RecursionDesired = true
+
+	var list []byte
+	var ttl uint32
+	var err error
+	for _, server := range d.echServers(alias) {
+		var r *dns.Msg
+		if r, err = d.exchange(m, server); err != nil {
+			glog.V(2).Infof("ECH: lookup HTTPS %#v via %#v error: %v", name, server, err)
+			continue
+		}
+		if r.Rcode != dns.RcodeSuccess && r.Rcode != dns.RcodeNameError {
+			err = fmt.Errorf("lookup HTTPS %#v via %#v return %s", name, server, dns.RcodeToString[r.Rcode])
+			continue
+		}
+		list, ttl, err = parseECHConfigList(r.Answer)
+		break
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	expiry := time.Duration(ttl) * time.Second
+	switch {
+	case len(list) == 0:
+		expiry = d.DNSNegativeExpiry
+		if expiry <= 0 {
+			expiry = DefaultDNSNegativeExpiry
+		}
+		list = []byte{}
+	case expiry <= 0 || (d.DNSCacheExpiry > 0 && expiry > d.DNSCacheExpiry):
+		expiry = d.DNSCacheExpiry
+	}
+
+	glog.V(2).Infof("ECH: lookup HTTPS %#v return %d bytes of ECH config", name, len(list))
+	d.DNSCache.Set(key, list, time.Now().Add(expiry))
+
+	return list, nil
+}
+
+// echRejected handles the ECHRejectionError of a handshake to name, the
+// retry configs sent by the server replace the cached ones. A server which
+// sends none has turned ECH off, and the record is looked up again.
+func (d *MultiDialer) echRejected(name string, err error) {
+	var e *tls.ECHRejectionError
+	if !errors.As(err, &e) {
+		return
+	}
+
+	if len(e.RetryConfigList) == 0 {
+		glog.Warningf("ECH: %#v rejects ECH without retry configs", name)
+		d.DNSCache.Del(echCacheKey(name))
+		return
+	}
+
+	glog.V(2).Infof("ECH: %#v rejects the ECH config, use its retry configs", name)
+	d.DNSCache.Set(echCacheKey(name), e.RetryConfigList, time.Now().Add(d.DNSCacheExpiry))
+}
+
+// parseECHConfigList returns the ech SvcParam of the service mode HTTPS
+// record of the lowest priority in answer, and its ttl.
+func parseECHConfigList(answer []dns.RR) ([]byte, uint32, error) {
+	var list []byte
+	var ttl uint32
+	var priority uint16 = 0xffff
+
+	for _, rr := range answer {
+		if rr.Header().Rrtype != dnsTypeHTTPS {
+			continue
+		}
+
+		rdata, err := packRdata(rr)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		prio, ech, err := parseSVCB(rdata)
+		if err != nil {
+			return nil, 0, err
+		}
+		// priority 0 is the alias mode, which carries no SvcParams
+		if prio == 0 || ech == nil || (list != nil && prio >= priority) {
+			continue
+		}
+
+		list, ttl, priority = ech, rr.Header().Ttl, prio
+	}
+
+	return list, ttl, nil
+}
+
+// packRdata returns the wire format rdata of rr, whether miekg/dns parsed it
+// as an HTTPS record or kept it as an unknown RFC3597 one.
+func packRdata(rr dns.RR) ([]byte, error) {
+	buf := make([]byte, dns.MaxMsgSize)
+	n, err := dns.PackRR(rr, buf, 0, nil, false)
+	if err != nil {
+		return nil, err
+	}
+	buf = buf[:n]
+
+	// skip the uncompressed owner name, type, class and ttl
+	off := 0
+	for off < len(buf) && buf[off] != 0 {
+		off += int(buf[off]) + 1
+	}
+	off += 1 + 8
+	if off+2 > len(buf) {
+		return nil, fmt.Errorf("truncated %s record", dns.TypeToString[rr.Header().Rrtype])
+	}
+
+	rdlength := int(binary.BigEndian.Uint16(buf[off:]))
+	off += 2
+	if off+rdlength > len(buf) {
+		return nil, fmt.Errorf("truncated %s record", dns.TypeToString[rr.Header().Rrtype])
+	}
+
+	return buf[off : off+rdlength], nil
+}
+
+// parseSVCB returns the SvcPriority and the ech SvcParam of a SVCB or HTTPS
+// rdata, the latter is nil if there is none.
+func parseSVCB(rdata []byte) (uint16, []byte, error) {
+	errTruncated := fmt.Errorf("truncated HTTPS record")
+
+	if len(rdata) < 2 {
+		return 0, nil, errTruncated
+	}
+	priority := binary.BigEndian.Uint16(rdata)
+	off := 2
+
+	// TargetName is never compressed
+	for {
+		if off >= len(rdata) {
+			return 0, nil, errTruncated
+		}
+		n := int(rdata[off])
+		off++
+		if n == 0 {
+			break
+		}
+		off += n
+	}
+
+	for off < len(rdata) {
+		if off+4 > len(rdata) {
+			return 0, nil, errTruncated
+		}
+		key := binary.BigEndian.Uint16(rdata[off:])
+		length := int(binary.BigEndian.Uint16(rdata[off+2:]))
+		off += 4
+		if off+length > len(rdata) {
+			return 0, nil, errTruncated
+		}
+		if key == svcParamECH {
+			return priority, append([]byte(nil), rdata[off:off+length]...), nil
+		}
+		off += length
+	}
+
+	return priority, nil, nil
+}
@@ -0,0 +1,94 @@
+package dialer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+var clientHelloIDs = map[string]utls.ClientHelloID{
+	"chrome":     utls.HelloChrome_Auto,
+	"firefox":    utls.HelloFirefox_Auto,
+	"edge":       utls.HelloEdge_Auto,
+	"ios":        utls.HelloIOS_Auto,
+	"randomized": utls.HelloRandomized,
+}
+
+// ParseFingerprint checks a TLSFingerprints value, "" and "go" keep the
+// ClientHello of crypto/tls.
+func ParseFingerprint(name string) (utls.ClientHelloID, bool, error) {
+	switch name {
+	case "", "go":
+		return utls.ClientHelloID{}, false, nil
+	}
+
+	id, ok := clientHelloIDs[name]
+	if !ok {
+		return utls.ClientHelloID{}, false, fmt.Errorf("unknown tls fingerprint %#v", name)
+	}
+
+	return id, true, nil
+}
+
+type handshakeConn interface {
+	net.Conn
+	Handshake() error
+}
+
+// tlsClient returns a crypto/tls client, or a utls one which mimics the
+// ClientHello of a browser if a fingerprint is set for alias. Session
+// tickets are not shared between the two, so utls connections always do a
+// full handshake. ECH is only done by crypto/tls, so it wins over the
+// fingerprint.
+func (d *MultiDialer) tlsClient(conn net.Conn, config *tls.Config, alias string) handshakeConn {
+	conn = d.splitHello(conn, alias)
+
+	if id, ok, _ := ParseFingerprint(d.TLSFingerprints[alias]); ok && config.EncryptedClientHelloConfigList == nil {
+		return utls.UClient(conn, &utls.Config{
+			ServerName:         config.ServerName,
+			InsecureSkipVerify: config.InsecureSkipVerify,
+			NextProtos:         config.NextProtos,
+			RootCAs:            config.RootCAs,
+			MinVersion:         config.MinVersion,
+			MaxVersion:         config.MaxVersion,
+			Time:               config.Time,
+			KeyLogWriter:       config.KeyLogWriter,
+			ClientSessionCache: d.uSessionCache(alias),
+			Certificates:       uCertificates(config.Certificates),
+		}, id)
+	}
+
+	return tls.Client(conn, config)
+}
+
+func uCertificates(certs []tls.Certificate) []utls.Certificate {
+	if len(certs) == 0 {
+		return nil
+	}
+
+	ucerts := make([]utls.Certificate, len(certs))
+	for i, cert := range certs {
+		ucerts[i] = utls.Certificate{
+			Certificate:                 cert.Certificate,
+			PrivateKey:                  cert.PrivateKey,
+			OCSPStaple:                  cert.OCSPStaple,
+			SignedCertificateTimestamps: cert.SignedCertificateTimestamps,
+			Leaf:                        cert.Leaf,
+		}
+	}
+	return ucerts
+}
+
+// peerCertificates returns the certificates of a crypto/tls or utls conn.
+func peerCertificates(conn net.Conn) []*x509.Certificate {
+	switch c := conn.(type) {
+	case *tls.Conn:
+		return c.ConnectionState().PeerCertificates
+	case *utls.UConn:
+		return c.ConnectionState().PeerCertificates
+	}
+	return nil
+}
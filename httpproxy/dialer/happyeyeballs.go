@@ -0,0 +1,127 @@
+package dialer
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+// happyEyeballs staggers a dual stack race as RFC 8305 does, attempts of the
+// leading family start at once and the other ones wait for delay, unless
+// every attempt of the leading family has failed already.
+type happyEyeballs struct {
+	delay   time.Duration
+	v6First bool
+	pending int32
+	failed  chan struct{}
+}
+
+// newHappyEyeballs returns nil if addrs are not of both families. ipv6 leads
+// if v6First is true, see MultiDialer.ipv6First.
+func newHappyEyeballs(addrs []string, delay time.Duration, v6First bool) *happyEyeballs {
+	if delay <= 0 {
+		return nil
+	}
+
+	v6, v4 := splitFamilies(addrs)
+	if len(v6) == 0 || len(v4) == 0 {
+		return nil
+	}
+
+	pending := len(v6)
+	if !v6First {
+		pending = len(v4)
+	}
+
+	return &happyEyeballs{
+		delay:   delay,
+		v6First: v6First,
+		pending: int32(pending),
+		failed:  make(chan struct{}),
+	}
+}
+
+func (h *happyEyeballs) leading(addr string) bool {
+	return isIPv6Addr(addr) == h.v6First
+}
+
+func (h *happyEyeballs) wait(ctx context.Context, addr string) error {
+	if h == nil || h.leading(addr) {
+		return nil
+	}
+
+	timer := time.NewTimer(h.delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-h.failed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return nil
+}
+
+func (h *happyEyeballs) done(addr string, err error) {
+	if h == nil || err == nil || !h.leading(addr) {
+		return
+	}
+
+	if atomic.AddInt32(&h.pending, -1) == 0 {
+		close(h.failed)
+	}
+}
+
+// pickupDualStack picks the addrs of each family separately, so that the
+// scores of one family never starve the other one out of the race. The
+// leading family gets the larger share.
+func pickupDualStack(addrs []string, n int, connDuration lrucache.Cache, connError lrucache.Cache, v6First bool) []string {
+	v6, v4 := splitFamilies(addrs)
+	if len(v6) == 0 || len(v4) == 0 {
+		return pickupAddrs(addrs, n, connDuration, connError)
+	}
+
+	first, second := v6, v4
+	if !v6First {
+		first, second = v4, v6
+	}
+
+	n1 := (n + 1) / 2
+	if n1 > len(first) {
+		n1 = len(first)
+	}
+
+	n2 := n - n1
+	if n2 > len(second) {
+		n2 = len(second)
+	}
+	if n2 < 1 {
+		n2 = 1
+	}
+
+	return append(pickupAddrs(first, n1, connDuration, connError), pickupAddrs(second, n2, connDuration, connError)...)
+}
+
+func splitFamilies(addrs []string) (v6, v4 []string) {
+	for _, addr := range addrs {
+		if isIPv6Addr(addr) {
+			v6 = append(v6, addr)
+		} else {
+			v4 = append(v4, addr)
+		}
+	}
+	return
+}
+
+func isIPv6Addr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() == nil
+}
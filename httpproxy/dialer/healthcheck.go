@@ -0,0 +1,138 @@
+package dialer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../helpers"
+)
+
+// HealthChecker re-probes the addrs in TLSConnError with a TLS handshake.
+// A recovered addr is moved back to TLSConnDuration, and the ip of an addr
+// which fails MaxFailures probes in a row is put into IPBlackList for good.
+type HealthChecker struct {
+	MultiDialer *MultiDialer
+	ServerName  string
+	MaxFailures int
+	Concurrency int
+	Timeout     time.Duration
+
+	mu       sync.Mutex
+	failures map[string]int
+}
+
+func NewHealthChecker(d *MultiDialer, serverName string) *HealthChecker {
+	return &HealthChecker{
+		MultiDialer: d,
+		ServerName:  serverName,
+		MaxFailures: 5,
+		Concurrency: 8,
+		Timeout:     3 * time.Second,
+		failures:    make(map[string]int),
+	}
+}
+
+// Check probes all quarantined addrs once, it is run by DefaultScheduler.
+func (h *HealthChecker) Check() error {
+	d := h.MultiDialer
+
+	kc, ok := d.TLSConnError.(*helpers.KeyedCache)
+	if !ok {
+		return fmt.Errorf("HealthChecker: TLSConnError %T cannot be enumerated", d.TLSConnError)
+	}
+
+	addrs := kc.Keys()
+
+	// recovered and dropped are guarded by h.mu
+	var recovered, dropped int
+	sem := make(chan struct{}, h.Concurrency)
+	var wg sync.WaitGroup
+	for _, addr := range addrs {
+		ip, _, err := net.SplitHostPort(addr)
+		if err != nil || d.IsBlackListed(ip) {
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(addr, ip string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			duration, err := h.probe(addr)
+
+			h.mu.Lock()
+			defer h.mu.Unlock()
+
+			if err == nil {
+				delete(h.failures, addr)
+				d.TLSConnError.Del(addr)
+				d.TLSConnDuration.Set(addr, duration, time.Now().Add(d.ConnExpiry))
+				recovered++
+				return
+			}
+
+			// keep it quarantined while it fails
+			d.TLSConnError.Set(addr, err, time.Now().Add(d.ConnExpiry))
+			h.failures[addr]++
+			glog.V(3).Infof("HealthChecker probe(%#v) failure %d: %v", addr, h.failures[addr], err)
+			if h.failures[addr] >= h.MaxFailures {
+				delete(h.failures, addr)
+				d.BlackListIP(ip, 0)
+				glog.Warningf("HealthChecker: %s failed %d probes in a row, add to blacklist", addr, h.MaxFailures)
+				dropped++
+			}
+		}(addr, ip)
+	}
+	wg.Wait()
+
+	// forget the failures of addrs which expired from TLSConnError meanwhile
+	h.mu.Lock()
+	seen := make(map[string]struct{}, len(addrs))
+	for _, addr := range addrs {
+		seen[addr] = struct{}{}
+	}
+	for addr := range h.failures {
+		if _, ok := seen[addr]; !ok {
+			delete(h.failures, addr)
+		}
+	}
+	h.mu.Unlock()
+
+	glog.V(2).Infof("HealthChecker probe %d addrs, %d recovered, %d dropped", len(addrs), recovered, dropped)
+
+	return nil
+}
+
+func (h *HealthChecker) probe(addr string) (time.Duration, error) {
+	d := h.MultiDialer
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := d.dialContext(ctx, "", "tcp", addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(h.Timeout))
+	tlsConn := tls.Client(conn, &tls.Config{
+		ServerName:         h.ServerName,
+		InsecureSkipVerify: true,
+	})
+	if err := tlsConn.Handshake(); err != nil {
+		return 0, err
+	}
+
+	return time.Since(start), nil
+}
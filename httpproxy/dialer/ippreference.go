@@ -0,0 +1,122 @@
+package dialer
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+// IPPreference values of MultiDialer, an empty one is IPOnlyIPv4.
+const (
+	IPPreferIPv6 string = "prefer_ipv6"
+	IPPreferIPv4 string = "prefer_ipv4"
+	IPOnlyIPv6   string = "only_ipv6"
+	IPOnlyIPv4   string = "only_ipv4"
+)
+
+// the other family leads a dual stack race only if its mean handshake
+// duration is below this ratio of the preferred one.
+const familyScoreRatio = 0.8
+
+func ParseIPPreference(s string) (string, error) {
+	switch s {
+	case "", IPOnlyIPv4:
+		return IPOnlyIPv4, nil
+	case IPPreferIPv6, IPPreferIPv4, IPOnlyIPv6:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown IPPreference %#v", s)
+}
+
+func (d *MultiDialer) ipv6Only() bool {
+	return d.IPPreference == IPOnlyIPv6
+}
+
+func (d *MultiDialer) wantIPv4() bool {
+	return d.IPPreference != IPOnlyIPv6
+}
+
+func (d *MultiDialer) wantIPv6() bool {
+	switch d.IPPreference {
+	case IPPreferIPv6, IPPreferIPv4, IPOnlyIPv6:
+		return true
+	}
+	return false
+}
+
+// dialNetwork pins the network of a race to the only allowed family.
+func (d *MultiDialer) dialNetwork(network string) string {
+	switch d.IPPreference {
+	case IPOnlyIPv6:
+		return "tcp6"
+	case IPOnlyIPv4:
+		return "tcp4"
+	}
+	return network
+}
+
+// lookupBoth queries A and AAAA of name through server at once and puts the
+// preferred family first. It fails only if both queries fail.
+func (d *MultiDialer) lookupBoth(name, server string) ([]string, error) {
+	var v6, v4 []string
+	var err6, err4 error
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		v6, err6 = d.lookupHost2(name, server, true)
+	}()
+	go func() {
+		defer wg.Done()
+		v4, err4 = d.lookupHost2(name, server, false)
+	}()
+	wg.Wait()
+
+	if err6 != nil && err4 != nil {
+		return nil, err4
+	}
+
+	if d.IPPreference == IPPreferIPv6 {
+		return append(v6, v4...), nil
+	}
+	return append(v4, v6...), nil
+}
+
+// ipv6First tells which family leads the dual stack race of addrs, the one
+// which performs better on record, or the preferred one while it is unknown
+// or close.
+func (d *MultiDialer) ipv6First(addrs []string, connDuration lrucache.Cache) bool {
+	preferIPv6 := d.IPPreference == IPPreferIPv6
+
+	v6, v4 := splitFamilies(addrs)
+	mean6, ok6 := meanDuration(v6, connDuration)
+	mean4, ok4 := meanDuration(v4, connDuration)
+	if !ok6 || !ok4 {
+		return preferIPv6
+	}
+
+	if preferIPv6 {
+		return !(float64(mean4) < float64(mean6)*familyScoreRatio)
+	}
+	return float64(mean6) < float64(mean4)*familyScoreRatio
+}
+
+func meanDuration(addrs []string, connDuration lrucache.Cache) (time.Duration, bool) {
+	var sum time.Duration
+	var n int
+	for _, addr := range addrs {
+		if v, ok := connDuration.GetQuiet(addr); ok {
+			if duration, ok := v.(time.Duration); ok {
+				sum += duration
+				n++
+			}
+		}
+	}
+	if n == 0 {
+		return 0, false
+	}
+	return sum / time.Duration(n), true
+}
@@ -0,0 +1,125 @@
+package dialer
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/phuslu/glog"
+)
+
+const (
+	DefaultIPv6FallbackFailures int           = 3
+	DefaultIPv6FallbackCooldown time.Duration = 10 * time.Minute
+)
+
+// ipv6Fallback demotes an alias to ipv4 for a cooldown once its ipv6 attempts
+// have lost IPv6FallbackFailures dual stack races in a row, which is the case
+// of a broken ipv6 path whose AAAA records resolve fine.
+type ipv6Fallback struct {
+	mu       sync.Mutex
+	failures map[string]int
+	demoted  map[string]time.Time
+}
+
+// ipv6Race is how the ipv6 attempts of one race went.
+type ipv6Race struct {
+	alias  string
+	failed int32
+	// ipv6 led the race, so a ipv4 winner means ipv6 did not connect in time
+	leading bool
+}
+
+func (d *MultiDialer) ipv6FallbackFailures() int {
+	if d.IPv6FallbackFailures == 0 {
+		return DefaultIPv6FallbackFailures
+	}
+	return d.IPv6FallbackFailures
+}
+
+// dropDemotedIPv6 returns the ipv4 addrs of a demoted alias, or addrs as is.
+func (d *MultiDialer) dropDemotedIPv6(alias string, addrs []string) []string {
+	if d.ipv6FallbackFailures() < 0 || d.IPPreference == IPOnlyIPv6 {
+		return addrs
+	}
+
+	f := &d.v6fallback
+	f.mu.Lock()
+	until, ok := f.demoted[alias]
+	if ok && time.Now().After(until) {
+		delete(f.demoted, alias)
+		glog.Infof("MULTIDIALER: alias %#v cooldown is over, race ipv6 addrs again", alias)
+		ok = false
+	}
+	f.mu.Unlock()
+
+	if !ok {
+		return addrs
+	}
+
+	v6, v4 := splitFamilies(addrs)
+	if len(v6) == 0 || len(v4) == 0 {
+		return addrs
+	}
+	return v4
+}
+
+// newIPv6Race returns nil if the race of addrs says nothing of the ipv6 path,
+// when they are not of both families or go through an upstream proxy.
+func (d *MultiDialer) newIPv6Race(alias string, addrs []string, v6First bool) *ipv6Race {
+	if d.ipv6FallbackFailures() < 0 || d.Upstream != nil {
+		return nil
+	}
+	v6, v4 := splitFamilies(addrs)
+	if len(v6) == 0 || len(v4) == 0 {
+		return nil
+	}
+	return &ipv6Race{alias: alias, leading: v6First}
+}
+
+// fail records that the attempt to addr has failed on its own, not by the
+// end of the race.
+func (r *ipv6Race) fail(addr string) {
+	if r != nil && isIPv6Addr(addr) {
+		atomic.StoreInt32(&r.failed, 1)
+	}
+}
+
+// settleIPv6 counts the race won by the dial of addr, "" if all attempts
+// failed.
+func (d *MultiDialer) settleIPv6(r *ipv6Race, addr string) {
+	if r == nil {
+		return
+	}
+
+	won := addr != "" && isIPv6Addr(addr)
+	if !won && !r.leading && atomic.LoadInt32(&r.failed) == 0 {
+		// ipv4 is ahead on its merits
+		return
+	}
+
+	f := &d.v6fallback
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.failures == nil {
+		f.failures = make(map[string]int)
+		f.demoted = make(map[string]time.Time)
+	}
+
+	if won {
+		delete(f.failures, r.alias)
+		return
+	}
+
+	f.failures[r.alias]++
+	if n := f.failures[r.alias]; n >= d.ipv6FallbackFailures() {
+		cooldown := d.IPv6FallbackCooldown
+		if cooldown <= 0 {
+			cooldown = DefaultIPv6FallbackCooldown
+		}
+		delete(f.failures, r.alias)
+		f.demoted[r.alias] = time.Now().Add(cooldown)
+		glog.Warningf("MULTIDIALER: ipv6 of alias %#v lost %d races in a row, fall back to ipv4 for %s", r.alias, n, cooldown)
+	}
+}
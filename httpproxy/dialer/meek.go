@@ -0,0 +1,422 @@
+package dialer
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../helpers"
+)
+
+const (
+	DefaultMeekPollInterval time.Duration = 5 * time.Second
+	DefaultMeekMaxBody      int           = 64 * 1024
+	// MaxBuffer defaults to this many MaxBody
+	DefaultMeekBufferBodies int = 4
+)
+
+// MeekDialer tunnels a tcp stream through sequential HTTP POST exchanges to
+// a relay, for networks where CONNECT and raw TLS egress are blocked.
+//
+// Each exchange carries "X-Session-Id", the first one also "X-Target" with the
+// address to connect to. The request body is the pending upstream payload and
+// the response body is the downstream payload, the relay answers a non 200
+// status when the session is gone, 410 if the target has closed it. The last
+// exchange carries "X-Session-Close". When Front is set the request is sent to
+// Front while the Host header keeps the relay host (domain fronting).
+type MeekDialer struct {
+	URL          *url.URL
+	Front        string
+	Transport    http.RoundTripper
+	PollInterval time.Duration
+	MaxBody      int
+	// a Write blocks while this many bytes are waiting to be sent
+	MaxBuffer int
+	// sent with each exchange, e.g. the password of the relay
+	Header http.Header
+	// signs each exchange with a HMAC of Password if set, as goproxy-server
+	// -tunnel requires
+	Password string
+	KeyID    string
+}
+
+func (d *MeekDialer) Dial(network, address string) (net.Conn, error) {
+	glog.V(3).Infof("MEEK Dial(%#v, %#v) via %#v", network, address, d.URL.String())
+
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		break
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	c := &meekConn{
+		dialer:  d,
+		id:      hex.EncodeToString(b),
+		address: address,
+		wake:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	c.cond = sync.NewCond(&c.mu)
+
+	// the first exchange opens the session, so dial errors show up here
+	data, err := c.exchange(nil, true)
+	if err != nil {
+		return nil, err
+	}
+
+	go c.loop(data)
+
+	return c, nil
+}
+
+func (d *MeekDialer) maxBody() int {
+	if d.MaxBody <= 0 {
+		return DefaultMeekMaxBody
+	}
+	return d.MaxBody
+}
+
+func (d *MeekDialer) maxBuffer() int {
+	if d.MaxBuffer <= 0 {
+		return DefaultMeekBufferBodies * d.maxBody()
+	}
+	return d.MaxBuffer
+}
+
+// meekConn keeps the upstream payload in wbuf until the loop sends it, and
+// the downstream payload of the last exchange in rbuf until it is read. A
+// Write blocks while wbuf is full, the loop waits for rbuf to be read before
+// the next exchange, so neither side grows without bound.
+type meekConn struct {
+	dialer  *MeekDialer
+	id      string
+	address string
+	wake    chan struct{}
+	done    chan struct{}
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	wbuf   []byte
+	rbuf   []byte
+	rerr   error
+	closed bool
+
+	readDeadline  meekDeadline
+	writeDeadline meekDeadline
+}
+
+// meekDeadline wakes up the waiters of cond when it is due.
+type meekDeadline struct {
+	t     time.Time
+	timer *time.Timer
+}
+
+func (d *meekDeadline) set(t time.Time, cond *sync.Cond) {
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	d.t = t
+	if !t.IsZero() {
+		d.timer = time.AfterFunc(time.Until(t), func() {
+			cond.L.Lock()
+			cond.Broadcast()
+			cond.L.Unlock()
+		})
+	}
+	cond.Broadcast()
+}
+
+func (d *meekDeadline) exceeded() bool {
+	return !d.t.IsZero() && !time.Now().Before(d.t)
+}
+
+func (c *meekConn) newRequest(data []byte) (*http.Request, error) {
+	req, err := http.NewRequest(http.MethodPost, c.dialer.URL.String(), bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	if c.dialer.Front != "" {
+		req.Host = c.dialer.URL.Host
+		req.URL.Host = c.dialer.Front
+	}
+
+	for key, values := range c.dialer.Header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Session-Id", c.id)
+
+	if c.dialer.Password != "" {
+		helpers.SignRequest(req, c.dialer.Password, c.dialer.KeyID, "")
+	}
+
+	return req, nil
+}
+
+func (c *meekConn) exchange(data []byte, first bool) ([]byte, error) {
+	req, err := c.newRequest(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if first {
+		req.Header.Set("X-Target", c.address)
+	}
+
+	maxBody := c.dialer.maxBody()
+	req.Header.Set("X-Max-Body", strconv.Itoa(maxBody))
+
+	resp, err := c.dialer.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		break
+	case http.StatusGone:
+		return nil, io.EOF
+	default:
+		return nil, fmt.Errorf("MEEK: relay %#v returns %s", c.dialer.URL.Host, resp.Status)
+	}
+
+	return ioutil.ReadAll(io.LimitReader(resp.Body, int64(maxBody)))
+}
+
+// loop sends the buffered payload and polls for downstream data, backing off
+// up to PollInterval while the tunnel is idle.
+func (c *meekConn) loop(data []byte) {
+	maxInterval := c.dialer.PollInterval
+	if maxInterval <= 0 {
+		maxInterval = DefaultMeekPollInterval
+	}
+
+	maxBody := c.dialer.maxBody()
+
+	const minInterval = 100 * time.Millisecond
+
+	var err error
+	interval := minInterval
+	for {
+		if len(data) > 0 {
+			if !c.deliver(data) {
+				break
+			}
+			interval = minInterval
+		} else if !c.pending() {
+			if interval *= 2; interval > maxInterval {
+				interval = maxInterval
+			}
+			select {
+			case <-c.wake:
+				interval = minInterval
+			case <-time.After(interval):
+			case <-c.done:
+			}
+		}
+
+		c.mu.Lock()
+		n := len(c.wbuf)
+		if n > maxBody {
+			n = maxBody
+		}
+		out := c.wbuf[:n:n]
+		c.wbuf = c.wbuf[n:]
+		if len(c.wbuf) == 0 {
+			c.wbuf = nil
+		}
+		closed := c.closed
+		c.cond.Broadcast()
+		c.mu.Unlock()
+
+		if closed {
+			break
+		}
+
+		data, err = c.exchange(out, false)
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil {
+			glog.Warningf("MEEK: session %s to %#v error: %v", c.id, c.address, err)
+			break
+		}
+	}
+
+	c.mu.Lock()
+	if err == nil {
+		err = io.EOF
+	}
+	c.rerr = err
+	c.cond.Broadcast()
+	c.mu.Unlock()
+
+	if err != io.EOF {
+		return
+	}
+
+	// tell the relay to close the target now instead of on its idle timeout
+	if req, err := c.newRequest(nil); err == nil {
+		req.Header.Set("X-Session-Close", "1")
+		if resp, err := c.dialer.Transport.RoundTrip(req); err == nil {
+			resp.Body.Close()
+		}
+	}
+}
+
+// deliver hands data to Read, it waits for the last one to be read first.
+func (c *meekConn) deliver(data []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.rbuf) > 0 && !c.closed {
+		c.cond.Wait()
+	}
+	if c.closed {
+		return false
+	}
+	c.rbuf = data
+	c.cond.Broadcast()
+	return true
+}
+
+func (c *meekConn) pending() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.wbuf) > 0
+}
+
+func (c *meekConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		switch {
+		case c.closed:
+			return 0, net.ErrClosed
+		case len(c.rbuf) > 0:
+			n := copy(b, c.rbuf)
+			c.rbuf = c.rbuf[n:]
+			if len(c.rbuf) == 0 {
+				c.rbuf = nil
+				c.cond.Broadcast()
+			}
+			return n, nil
+		case c.rerr != nil:
+			return 0, c.rerr
+		case c.readDeadline.exceeded():
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.cond.Wait()
+	}
+}
+
+// Write blocks while MaxBuffer bytes are waiting to be sent.
+func (c *meekConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	maxBuffer := c.dialer.maxBuffer()
+
+	n := 0
+	for n < len(b) {
+		switch {
+		case c.closed:
+			return n, net.ErrClosed
+		case c.rerr != nil:
+			// the session is gone, nothing is sent anymore
+			return n, io.ErrClosedPipe
+		case c.writeDeadline.exceeded():
+			return n, os.ErrDeadlineExceeded
+		}
+
+		if room := maxBuffer - len(c.wbuf); room > 0 {
+			m := len(b) - n
+			if m > room {
+				m = room
+			}
+			c.wbuf = append(c.wbuf, b[n:n+m]...)
+			n += m
+
+			select {
+			case c.wake <- struct{}{}:
+			default:
+			}
+			continue
+		}
+
+		c.cond.Wait()
+	}
+
+	return n, nil
+}
+
+func (c *meekConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	c.readDeadline.set(time.Time{}, c.cond)
+	c.writeDeadline.set(time.Time{}, c.cond)
+	return nil
+}
+
+func (c *meekConn) LocalAddr() net.Addr {
+	return meekAddr("meek:" + c.id)
+}
+
+func (c *meekConn) RemoteAddr() net.Addr {
+	return meekAddr(c.address)
+}
+
+func (c *meekConn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline.set(t, c.cond)
+	c.writeDeadline.set(t, c.cond)
+	return nil
+}
+
+func (c *meekConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline.set(t, c.cond)
+	return nil
+}
+
+func (c *meekConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline.set(t, c.cond)
+	return nil
+}
+
+type meekAddr string
+
+func (a meekAddr) Network() string { return "meek" }
+func (a meekAddr) String() string  { return string(a) }
@@ -0,0 +1,59 @@
+package dialer
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMeekConnDeadline(t *testing.T) {
+	release := make(chan struct{})
+	relay := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		// the exchanges after the first one stall, as a slow relay does
+		if req.Header.Get("X-Target") == "" && req.Header.Get("X-Session-Close") == "" {
+			<-release
+		}
+	}))
+	defer relay.Close()
+	defer close(release)
+
+	u, err := url.Parse(relay.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &MeekDialer{
+		URL:       u,
+		Transport: &http.Transport{},
+		MaxBody:   8,
+		MaxBuffer: 16,
+	}
+
+	conn, err := d.Dial("tcp", "example.org:443")
+	if err != nil {
+		t.Fatalf("Dial() error: %v", err)
+	}
+	defer conn.Close()
+
+	// the buffer is bounded, the stalled relay blocks the writer
+	conn.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := conn.Write(make([]byte, 64))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Write() to a stalled relay error: %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if n > d.MaxBuffer+d.MaxBody {
+		t.Errorf("Write() to a stalled relay buffers %d bytes, want at most %d", n, d.MaxBuffer+d.MaxBody)
+	}
+
+	start := time.Now()
+	conn.SetReadDeadline(start.Add(100 * time.Millisecond))
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Read() error: %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Read() returns after %s, want about 100ms", d)
+	}
+}
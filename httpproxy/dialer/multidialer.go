@@ -1,6 +1,7 @@
 package dialer
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -8,6 +9,8 @@ import (
 	"net"
 	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/cloudflare/golibs/lrucache"
@@ -19,21 +22,148 @@ import (
 
 type MultiDialer struct {
 	net.Dialer
-	IPv6Only        bool
-	TLSConfig       *tls.Config
-	Site2Alias      *helpers.HostMatcher
-	FakeServerNames []string
-	IPBlackList     lrucache.Cache
-	HostMap         map[string][]string
-	DNSServers      []net.IP
-	DNSCache        lrucache.Cache
-	DNSCacheExpiry  time.Duration
-	TCPConnDuration lrucache.Cache
-	TCPConnError    lrucache.Cache
-	TLSConnDuration lrucache.Cache
-	TLSConnError    lrucache.Cache
-	ConnExpiry      time.Duration
-	Level           int
+	IPPreference       string
+	DNS64Prefixes      []net.IP
+	TLSConfig          *tls.Config
+	TLSFingerprints    map[string]string
+	SessionCache       tls.ClientSessionCache
+	Site2Alias         *helpers.HostMatcher
+	FakeServerNames    []string
+	SNIPolicies        map[string]SNIPolicy
+	ServerNames        *helpers.HostMatcher
+	SocketOptions      map[string]SocketOptions
+	DialStrategies     map[string]string
+	ECHDNSServer       string
+	IPBlackList        lrucache.Cache
+	BlackList          *BlackList
+	CertLearner        *CertLearner
+	IPWhiteList        map[string][]*net.IPNet
+	AddrPolicy         map[string]bool
+	IPVerdicts         lrucache.Cache
+	VerifyAliases      map[string][]string
+	HostMap            map[string][]string
+	StaticHosts        *helpers.HostMatcher
+	DNSServers         []net.IP
+	DNSOrdering        bool
+	AliasDNSServers    map[string][]string
+	AliasTiers         map[string][]string
+	AliasPorts         map[string]map[string]string
+	DNSQueryOptions    map[string]DNSQueryOptions
+	DNSCache           lrucache.Cache
+	DNSCacheExpiry     time.Duration
+	DNSNegativeExpiry  time.Duration
+	TCPConnDuration    lrucache.Cache
+	TCPConnError       lrucache.Cache
+	TLSConnDuration    lrucache.Cache
+	TLSConnError       lrucache.Cache
+	QUICConnDuration   lrucache.Cache
+	QUICConnError      lrucache.Cache
+	ConnExpiry         time.Duration
+	IdleConnPool       int
+	IdleConnTimeout    time.Duration
+	Level              int
+	AutoLevel          bool
+	HappyEyeballsDelay time.Duration
+	ThrottledIPs       lrucache.Cache
+	ThrottleWindow     time.Duration
+	Upstream           *Upstream
+	Metrics            helpers.MetricsRecorder
+
+	// a dual stack alias is dialed over ipv4 only for IPv6FallbackCooldown
+	// after its ipv6 lost this many races in a row, negative disables it
+	IPv6FallbackFailures int
+	IPv6FallbackCooldown time.Duration
+
+	// the client certificates presented to these hosts only, e.g. the fetch
+	// servers which require mutual TLS
+	ClientCertificates map[string]tls.Certificate
+
+	muConfig       sync.RWMutex
+	extraHosts     map[string][]string
+	fakeServerName string
+
+	muLookups sync.Mutex
+	lookups   map[string]*dnsCall
+
+	idleConns connPool
+	usessions uSessions
+
+	v6fallback ipv6Fallback
+	scores     scoreBoard
+	levels     autoLevels
+	dnsStats   dnsStats
+}
+
+const (
+	DefaultDialLevel     int           = 2
+	DefaultDialCacheSize uint          = 8192
+	DefaultConnExpiry    time.Duration = 5 * time.Minute
+)
+
+// NewMultiDialer returns a MultiDialer with the caches allocated and the
+// defaults set, for the programs which embed it. Sites matching site2alias
+// are dialed through the hosts of their alias in hostMap, whose names are
+// resolved via dnsServers, see ResolveHostMap for aliases of aliases. The
+// other fields may be changed before it is used, or by their Set methods.
+// The caches are sized by helpers.DefaultCacheManager under name, e.g. the
+// filter which owns the dialer, an empty name leaves them alone.
+func NewMultiDialer(name string, site2alias map[string]string, hostMap map[string][]string, dnsServers []net.IP) (*MultiDialer, error) {
+	hostMap, err := ResolveHostMap(hostMap)
+	if err != nil {
+		return nil, err
+	}
+
+	newCache := func() lrucache.Cache {
+		return helpers.NewKeyedCache(lrucache.NewLRUCache(DefaultDialCacheSize))
+	}
+
+	d := &MultiDialer{
+		Dialer: net.Dialer{
+			Timeout:   10 * time.Second,
+			KeepAlive: 3 * time.Minute,
+		},
+		Site2Alias:       helpers.NewHostMatcherWithString(site2alias),
+		HostMap:          hostMap,
+		DNSServers:       dnsServers,
+		IPBlackList:      newCache(),
+		IPVerdicts:       newCache(),
+		DNSCache:         newCache(),
+		DNSCacheExpiry:   DefaultDNSCacheExpiry,
+		TCPConnDuration:  newCache(),
+		TCPConnError:     newCache(),
+		TLSConnDuration:  newCache(),
+		TLSConnError:     newCache(),
+		QUICConnDuration: newCache(),
+		QUICConnError:    newCache(),
+		ConnExpiry:       DefaultConnExpiry,
+		Level:            DefaultDialLevel,
+	}
+
+	if name != "" {
+		d.RegisterCaches(name)
+	}
+
+	return d, nil
+}
+
+// RegisterCaches hands the KeyedCaches of d to helpers.DefaultCacheManager as
+// "<name>.<field>", so that -cachemem shares its budget with them in
+// proportion to their sizes.
+func (d *MultiDialer) RegisterCaches(name string) {
+	for field, c := range map[string]lrucache.Cache{
+		"IPBlackList":      d.IPBlackList,
+		"DNSCache":         d.DNSCache,
+		"TCPConnDuration":  d.TCPConnDuration,
+		"TCPConnError":     d.TCPConnError,
+		"TLSConnDuration":  d.TLSConnDuration,
+		"TLSConnError":     d.TLSConnError,
+		"QUICConnDuration": d.QUICConnDuration,
+		"QUICConnError":    d.QUICConnError,
+	} {
+		if kc, ok := c.(*helpers.KeyedCache); ok {
+			helpers.DefaultCacheManager.Register(name+"."+field, kc)
+		}
+	}
 }
 
 func (d *MultiDialer) ClearCache() {
@@ -42,6 +172,144 @@ func (d *MultiDialer) ClearCache() {
 	d.TCPConnError.Clear()
 	d.TLSConnDuration.Clear()
 	d.TLSConnError.Clear()
+	if d.QUICConnDuration != nil {
+		d.QUICConnDuration.Clear()
+	}
+	if d.QUICConnError != nil {
+		d.QUICConnError.Clear()
+	}
+	d.idleConns.closeAll()
+}
+
+// Reload swaps the alias and dns settings, connections which are already
+// established are left alone. Hosts added by AddHost are carried over to the
+// aliases which still exist.
+func (d *MultiDialer) Reload(site2alias *helpers.HostMatcher, hostMap map[string][]string, dnsServers []net.IP) {
+	hostMap1 := make(map[string][]string, len(hostMap))
+	for alias, names := range hostMap {
+		hostMap1[alias] = append([]string(nil), names...)
+	}
+
+	d.muConfig.Lock()
+	defer d.muConfig.Unlock()
+
+	for alias, names := range d.extraHosts {
+		if _, ok := hostMap1[alias]; ok {
+			hostMap1[alias] = append(hostMap1[alias], names...)
+		}
+	}
+
+	d.Site2Alias = site2alias
+	d.HostMap = hostMap1
+	d.DNSServers = dnsServers
+}
+
+// AddHost appends name to the hosts of alias and keeps it across Reload.
+func (d *MultiDialer) AddHost(alias, name string) error {
+	d.muConfig.Lock()
+	defer d.muConfig.Unlock()
+
+	if _, ok := d.HostMap[alias]; !ok {
+		return fmt.Errorf("alias %#v not exists", alias)
+	}
+
+	if d.extraHosts == nil {
+		d.extraHosts = make(map[string][]string)
+	}
+	d.extraHosts[alias] = append(d.extraHosts[alias], name)
+	d.HostMap[alias] = append(d.HostMap[alias], name)
+
+	return nil
+}
+
+func (d *MultiDialer) HasAlias(alias string) bool {
+	_, ok := d.hostNames(alias)
+	return ok || len(d.aliasTiers(alias)) > 0
+}
+
+func (d *MultiDialer) lookupSite(host string) (string, bool) {
+	d.muConfig.RLock()
+	defer d.muConfig.RUnlock()
+	if alias, ok := d.Site2Alias.Lookup(host); ok {
+		return alias.(string), true
+	}
+	return "", false
+}
+
+// lookupSitePort is lookupSite which prefers the Site2Alias patterns of
+// host:port, e.g. "example.com:8443".
+func (d *MultiDialer) lookupSitePort(host, port string) (string, bool) {
+	d.muConfig.RLock()
+	defer d.muConfig.RUnlock()
+	if alias, ok := d.Site2Alias.LookupWithPort(host, port); ok {
+		return alias.(string), true
+	}
+	return "", false
+}
+
+func (d *MultiDialer) hostNames(alias string) ([]string, bool) {
+	d.muConfig.RLock()
+	defer d.muConfig.RUnlock()
+	names, ok := d.HostMap[alias]
+	return names, ok
+}
+
+func (d *MultiDialer) dnsServers() []net.IP {
+	d.muConfig.RLock()
+	defer d.muConfig.RUnlock()
+	return d.DNSServers
+}
+
+// SetAliasDNSServers swaps the resolvers of aliases, see ParseDNSServer. An
+// alias which is not in servers resolves through DNSServers as before.
+func (d *MultiDialer) SetAliasDNSServers(servers map[string][]string) {
+	d.muConfig.Lock()
+	defer d.muConfig.Unlock()
+	d.AliasDNSServers = servers
+}
+
+func (d *MultiDialer) aliasDNSServers(alias string) []string {
+	d.muConfig.RLock()
+	defer d.muConfig.RUnlock()
+	return d.AliasDNSServers[alias]
+}
+
+// BlackListIP puts ip into IPBlackList for ttl, a zero ttl never expires.
+func (d *MultiDialer) BlackListIP(ip string, ttl time.Duration) {
+	var expire time.Time
+	if ttl > 0 {
+		expire = time.Now().Add(ttl)
+	}
+	d.IPBlackList.Set(NormalizeIP(ip), expire, expire)
+}
+
+// IsBlackListed reports whether ip is in IPBlackList and not expired yet,
+// or rejected by one of BlackList sources.
+func (d *MultiDialer) IsBlackListed(ip string) bool {
+	_, ok := d.BlackListReason(ip)
+	return ok
+}
+
+// BlackListReason tells why ip is blacklisted.
+func (d *MultiDialer) BlackListReason(ip string) (string, bool) {
+	ip = NormalizeIP(ip)
+	if v, ok := d.IPBlackList.GetQuiet(ip); ok {
+		expire, _ := v.(time.Time)
+		switch {
+		case expire.IsZero():
+			return "IPBlackList", true
+		case time.Now().Before(expire):
+			return fmt.Sprintf("IPBlackList until %s", expire.Format(time.RFC3339)), true
+		default:
+			d.IPBlackList.Del(ip)
+		}
+	}
+
+	if d.BlackList != nil {
+		return d.BlackList.Lookup(ip)
+	}
+
+	return "", false
 }
 
 func (d *MultiDialer) LookupHost(name string) (addrs []string, err error) {
@@ -51,48 +319,86 @@ func (d *MultiDialer) LookupHost(name string) (addrs []string, err error) {
 	}
 
 	addrs = make([]string, 0)
+	ip4s := make([]string, 0)
 	for _, h := range hs {
-		if _, ok := d.IPBlackList.GetQuiet(h); ok {
+		if d.IsBlackListed(h) || !d.usableAnswer(name, h) {
 			continue
 		}
 
 		if strings.Contains(h, ":") {
-			if d.IPv6Only {
+			if d.wantIPv6() {
 				addrs = append(addrs, h)
 			}
 		} else {
-			addrs = append(addrs, h)
+			ip4s = append(ip4s, h)
 		}
 	}
 
+	switch {
+	case d.wantIPv4() && d.IPPreference == IPPreferIPv6:
+		addrs = append(addrs, ip4s...)
+	case d.wantIPv4():
+		addrs = append(ip4s, addrs...)
+	case len(addrs) == 0 && len(d.DNS64Prefixes) > 0:
+		// a host without AAAA records is reachable through NAT64 only
+		addrs = d.synthesizeDNS64(ip4s)
+	}
+
 	return addrs, nil
 }
 
 func (d *MultiDialer) LookupHost2(name string, dnsserver net.IP) (addrs []string, err error) {
+	return d.lookupHostVia(name, net.JoinHostPort(dnsserver.String(), "53"))
+}
+
+// lookupHostVia queries name through server, see ParseDNSServer. Concurrent
+// queries of the same name and server share one.
+func (d *MultiDialer) lookupHostVia(name, server string) ([]string, error) {
+	return d.singleLookup("via "+server+" "+name, func() ([]string, error) {
+		return d.lookupHostVia1(name, server)
+	})
+}
+
+func (d *MultiDialer) lookupHostVia1(name, server string) (addrs []string, err error) {
+	if d.wantIPv4() && d.wantIPv6() {
+		return d.lookupBoth(name, server)
+	}
+
+	addrs, err = d.lookupHost2(name, server, d.ipv6Only())
+	if d.ipv6Only() && len(addrs) == 0 && len(d.DNS64Prefixes) > 0 {
+		// a host without AAAA records is reachable through NAT64 only
+		if addrs1, err1 := d.lookupHost2(name, server, false); err1 == nil {
+			return d.synthesizeDNS64(addrs1), nil
+		}
+	}
+	return addrs, err
+}
+
+func (d *MultiDialer) lookupHost2(name string, server string, ipv6 bool) (addrs []string, err error) {
 	m := &dns.Msg{}
 
-	if d.IPv6Only {
+	if ipv6 {
 		m.SetQuestion(dns.Fqdn(name), dns.TypeAAAA)
 	} else {
-		m.SetQuestion(dns.Fqdn(name), dns.TypeANY)
+		m.SetQuestion(dns.Fqdn(name), dns.TypeA)
 	}
 
-	r, err := dns.Exchange(m, dnsserver.String()+":53")
+	r, err := d.exchange(m, server)
 	if err != nil {
-		return nil, err
+		return nil, helpers.NewError(helpers.ErrDNSFailure, fmt.Sprintf("LookupHost2(%#v)", name), err)
 	}
 
 	if len(r.Answer) < 1 {
-		return nil, errors.New("no Answer")
+		return nil, helpers.NewError(helpers.ErrDNSFailure, fmt.Sprintf("LookupHost2(%#v)", name), errors.New("no Answer"))
 	}
 
 	addrs = []string{}
 
 	for _, rr := range r.Answer {
-		if d.IPv6Only {
+		if ipv6 {
 			if aaaa, ok := rr.(*dns.AAAA); ok {
 				ip := aaaa.AAAA.String()
-				if _, ok := d.IPBlackList.GetQuiet(ip); ok {
+				if d.IsBlackListed(ip) || !d.usableAnswer(name, ip) {
 					continue
 				}
 				addrs = append(addrs, ip)
@@ -100,7 +406,7 @@ func (d *MultiDialer) LookupHost2(name string, dnsserver net.IP) (addrs []string
 		} else {
 			if a, ok := rr.(*dns.A); ok {
 				ip := a.A.String()
-				if _, ok := d.IPBlackList.GetQuiet(ip); ok {
+				if d.IsBlackListed(ip) || !d.usableAnswer(name, ip) {
 					continue
 				}
 				addrs = append(addrs, ip)
@@ -111,66 +417,80 @@ func (d *MultiDialer) LookupHost2(name string, dnsserver net.IP) (addrs []string
 	return addrs, nil
 }
 
-func (d *MultiDialer) LookupAlias(alias string) (addrs []string, err error) {
-	names, ok := d.HostMap[alias]
+// LookupAlias returns the good ips of the hosts of alias, concurrent lookups
+// of the same alias share one.
+func (d *MultiDialer) LookupAlias(alias string) ([]string, error) {
+	return d.singleLookup("alias "+alias, func() ([]string, error) {
+		return d.lookupAlias(alias)
+	})
+}
+
+func (d *MultiDialer) lookupAlias(alias string) (addrs []string, err error) {
+	names, ok := d.hostNames(alias)
 	if !ok {
 		return nil, fmt.Errorf("alias %#v not exists", alias)
 	}
 
+	servers := d.aliasDNSServers(alias)
+
 	seen := make(map[string]struct{}, 0)
-	expiry := time.Now().Add(d.DNSCacheExpiry)
 	for _, name := range names {
 		var addrs0 []string
-		if net.ParseIP(name) != nil {
-			addrs0 = []string{name}
-			expiry = time.Time{}
-		} else if addrs1, ok := d.DNSCache.Get(name); ok {
-			addrs0 = addrs1.([]string)
+		if ip := net.ParseIP(NormalizeIP(name)); ip != nil {
+			addrs0 = []string{NormalizeIP(name)}
+			if d.ipv6Only() && ip.To4() != nil && len(d.DNS64Prefixes) > 0 {
+				addrs0 = d.synthesizeDNS64(addrs0)
+			}
 		} else {
-			if d.IPv6Only {
-				addrs0, err = d.LookupHost2(name, d.DNSServers[0])
-				if err != nil {
-					glog.Warningf("LookupHost2(%#v, %#v) error: %s", name, d.DNSServers[0], err)
-					addrs0 = []string{}
-				}
-			} else {
-				addrs0, err = d.LookupHost(name)
-				if err != nil {
-					glog.Warningf("LookupHost(%#v) error: %s", name, err)
-					addrs0 = []string{}
-				}
+			var err1 error
+			if addrs0, err1 = d.lookupName(name, servers); err1 != nil {
+				err = err1
 			}
-
-			glog.V(2).Infof("LookupHost(%#v) return %v", name, addrs0)
-			d.DNSCache.Set(name, addrs0, expiry)
 		}
 		for _, addr := range addrs0 {
-			seen[addr] = struct{}{}
+			seen[NormalizeIP(addr)] = struct{}{}
 		}
 	}
 
 	if len(seen) == 0 {
-		return nil, err
+		return nil, helpers.NewError(helpers.ErrDNSFailure, fmt.Sprintf("MULTIDIALER LookupAlias(%#v)", alias), err).WithAddrs(alias, nil)
 	}
 
 	addrs = make([]string, 0)
 	for addr, _ := range seen {
-		if _, ok := d.IPBlackList.GetQuiet(addr); ok {
+		if d.IsBlackListed(addr) {
 			continue
 		}
 		addrs = append(addrs, addr)
 	}
 
+	if ipnets, ok := d.ipWhiteList(alias); ok {
+		addrs = filterIPNets(addrs, ipnets)
+	}
+
+	if names, ok := d.VerifyAliases[alias]; ok && d.IPVerdicts != nil {
+		addrs = d.verifyAddrs(alias, addrs, names)
+	}
+
 	if len(addrs) == 0 {
 		glog.Errorf("MULTIDIALER: LookupAlias(%#v) have no good ip addrs", alias)
-		return nil, fmt.Errorf("MULTIDIALER: LookupAlias(%#v) have no good ip addrs", alias)
+		return nil, helpers.NewError(helpers.ErrAllAddrsBad, fmt.Sprintf("MULTIDIALER LookupAlias(%#v)", alias), nil).WithAddrs(alias, nil)
 	}
 
 	return addrs, nil
 }
 
 func (d *MultiDialer) ExpandAlias(alias string) error {
-	names, ok := d.HostMap[alias]
+	if tiers := d.aliasTiers(alias); len(tiers) > 0 {
+		for _, tier := range tiers {
+			if err := d.ExpandAlias(tier); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	names, ok := d.hostNames(alias)
 	if !ok {
 		return fmt.Errorf("alias %#v not exists", alias)
 	}
@@ -178,18 +498,12 @@ func (d *MultiDialer) ExpandAlias(alias string) error {
 	expire := time.Now().Add(24 * time.Hour)
 	for _, name := range names {
 		seen := make(map[string]struct{}, 0)
-		for _, dnsserver := range d.DNSServers {
-			var addrs []string
-			var err error
-			if net.ParseIP(name) != nil {
-				addrs = []string{name}
-				expire = time.Time{}
-			} else if addrs, err = d.LookupHost2(name, dnsserver); err != nil {
-				glog.V(2).Infof("LookupHost2(%#v) error: %s", name, err)
-				continue
-			}
-			glog.V(2).Infof("ExpandList(%#v) %#v return %v", name, dnsserver, addrs)
-			for _, addr := range addrs {
+		if net.ParseIP(NormalizeIP(name)) != nil {
+			seen[NormalizeIP(name)] = struct{}{}
+			expire = time.Time{}
+		} else {
+			// every resolver may know other ips, so all of them are merged
+			for _, addr := range d.lookupHostAll(name, dnsServerAddrs(d.dnsServers())) {
 				seen[addr] = struct{}{}
 			}
 		}
@@ -217,130 +531,280 @@ func (d *MultiDialer) ExpandAlias(alias string) error {
 }
 
 func (d *MultiDialer) Dial(network, address string) (net.Conn, error) {
-	glog.Warningf("MULTIDIALER Dial(%#v, %#v) with good_addrs=%d, bad_addrs=%d", network, address, d.TCPConnDuration.Len(), d.TCPConnError.Len())
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext is Dial bound to ctx, cancelling it aborts all of the dials
+// which are racing.
+func (d *MultiDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	helpers.DefaultLogger.Warning("MULTIDIALER Dial", helpers.F("network", network), helpers.F("address", address), helpers.F("good_addrs", d.TCPConnDuration.Len()), helpers.F("bad_addrs", d.TCPConnError.Len()))
 	switch network {
 	case "tcp", "tcp4", "tcp6":
 		if host, port, err := net.SplitHostPort(address); err == nil {
-			if alias0, ok := d.Site2Alias.Lookup(host); ok {
-				alias := alias0.(string)
-				if hosts, err := d.LookupAlias(alias); err == nil {
-					addrs := make([]string, len(hosts))
-					for i, host := range hosts {
-						addrs[i] = net.JoinHostPort(host, port)
-					}
-					if d.IPv6Only {
-						network = "tcp6"
-					}
-					return d.dialMulti(network, addrs)
+			if alias, ok := d.lookupSitePort(host, port); ok {
+				if tiers := d.aliasTiers(alias); len(tiers) > 0 {
+					return d.dialTiers(alias, tiers, port, d.TCPConnError, func(tier string) (net.Conn, error) {
+						conn, _, err := d.dialAlias(ctx, network, port, tier)
+						return conn, err
+					})
+				}
+				if conn, ok, err := d.dialAlias(ctx, network, port, alias); ok {
+					return conn, err
 				}
 			}
 		}
+		if conn, ok, err := d.dialStatic(ctx, network, address, nil); ok {
+			return conn, err
+		}
 	default:
 		break
 	}
-	return d.Dialer.Dial(network, address)
+	return d.dialContext(ctx, "", network, address)
 }
 
 func (d *MultiDialer) DialTLS(network, address string) (net.Conn, error) {
-	glog.Warningf("MULTIDIALER DialTLS(%#v, %#v) with good_addrs=%d, bad_addrs=%d", network, address, d.TLSConnDuration.Len(), d.TLSConnError.Len())
+	return d.dialTLSSite(context.Background(), network, address, nil, false)
+}
+
+// DialTLSContext is DialTLS bound to ctx, cancelling it aborts all of the
+// dials and handshakes which are racing.
+func (d *MultiDialer) DialTLSContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.dialTLSSite(ctx, network, address, nil, false)
+}
+
+func (d *MultiDialer) DialTLS2(network, address string, cfg *tls.Config) (net.Conn, error) {
+	return d.dialTLSSite(context.Background(), network, address, cfg, false)
+}
+
+// DialTLSSmall is DialTLS for transports which only carry small requests,
+// it prefers the addrs throttled for bulk transfers.
+func (d *MultiDialer) DialTLSSmall(network, address string) (net.Conn, error) {
+	return d.dialTLSSite(context.Background(), network, address, nil, true)
+}
+
+func (d *MultiDialer) DialTLSSmallContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d.dialTLSSite(ctx, network, address, nil, true)
+}
+
+func (d *MultiDialer) DialTLS2Small(network, address string, cfg *tls.Config) (net.Conn, error) {
+	return d.dialTLSSite(context.Background(), network, address, cfg, true)
+}
+
+// dialTLSSite races the addrs of the alias of address, a nil cfg picks the
+// default config of the alias.
+func (d *MultiDialer) dialTLSSite(ctx context.Context, network, address string, cfg *tls.Config, small bool) (net.Conn, error) {
+	helpers.DefaultLogger.Warning("MULTIDIALER DialTLS", helpers.F("network", network), helpers.F("address", address), helpers.F("good_addrs", d.TLSConnDuration.Len()), helpers.F("bad_addrs", d.TLSConnError.Len()))
 	switch network {
 	case "tcp", "tcp4", "tcp6":
 		if host, port, err := net.SplitHostPort(address); err == nil {
-			if alias0, ok := d.Site2Alias.Lookup(host); ok {
-				alias := alias0.(string)
-				if hosts, err := d.LookupAlias(alias); err == nil {
-					var config *tls.Config
-
-					switch {
-					case strings.HasPrefix(alias, "google_"):
-						config = GetDefaultTLSConfigForGoogle(d.FakeServerNames)
-					default:
-						config = &tls.Config{
-							InsecureSkipVerify: true,
-							ServerName:         address,
-						}
-					}
-					glog.V(3).Infof("DialTLS(%#v, %#v) alais=%#v set tls.Config=%#v", network, address, alias, config)
-
-					addrs := make([]string, len(hosts))
-					for i, host := range hosts {
-						addrs[i] = net.JoinHostPort(host, port)
-					}
-					if d.IPv6Only {
-						network = "tcp6"
-					}
-					return d.dialMultiTLS(network, addrs, config)
+			if alias, ok := d.lookupSitePort(host, port); ok {
+				if tiers := d.aliasTiers(alias); len(tiers) > 0 {
+					return d.dialTiers(alias, tiers, port, d.TLSConnError, func(tier string) (net.Conn, error) {
+						conn, _, err := d.dialAliasTLS(ctx, network, host, port, tier, cfg, small)
+						return conn, err
+					})
+				}
+				if conn, ok, err := d.dialAliasTLS(ctx, network, host, port, alias, cfg, small); ok {
+					return conn, err
 				}
 			}
 		}
+		config := cfg
+		if config == nil {
+			config = d.TLSConfig
+		}
+		if config == nil {
+			config = &tls.Config{}
+		}
+		if conn, ok, err := d.dialStatic(ctx, network, address, config); ok {
+			return conn, err
+		}
 	default:
 		break
 	}
-	return tls.DialWithDialer(&d.Dialer, network, address, d.TLSConfig)
+	return d.dialTLS(ctx, network, address, d.TLSConfig)
 }
 
-func (d *MultiDialer) DialTLS2(network, address string, cfg *tls.Config) (net.Conn, error) {
-	glog.Warningf("MULTIDIALER DialTLS2(%#v, %#v) with good_addrs=%d, bad_addrs=%d", network, address, d.TLSConnDuration.Len(), d.TLSConnError.Len())
-	switch network {
-	case "tcp", "tcp4", "tcp6":
-		if host, port, err := net.SplitHostPort(address); err == nil {
-			if alias0, ok := d.Site2Alias.Lookup(host); ok {
-				alias := alias0.(string)
-				if hosts, err := d.LookupAlias(alias); err == nil {
-					var config *tls.Config
-
-					switch {
-					case strings.HasPrefix(alias, "google_"):
-						config = GetDefaultTLSConfigForGoogle(d.FakeServerNames)
-					default:
-						config = cfg
-					}
-					glog.V(3).Infof("DialTLS(%#v, %#v) alais=%#v set tls.Config=%#v", network, address, alias, config)
+// dialAlias races the addrs of alias, ok is false if it has none.
+func (d *MultiDialer) dialAlias(ctx context.Context, network, port, alias string) (net.Conn, bool, error) {
+	port = d.aliasPort(alias, port)
+	hosts, err := d.LookupAlias(alias)
+	if err != nil {
+		helpers.TraceFrom(ctx).Addf("dns", alias, "error: %v", err)
+		return nil, false, err
+	}
+	helpers.TraceFrom(ctx).Addf("dns", alias, "%v", hosts)
 
-					addrs := make([]string, len(hosts))
-					for i, host := range hosts {
-						addrs[i] = net.JoinHostPort(host, port)
-					}
-					if d.IPv6Only {
-						network = "tcp6"
-					}
-					return d.dialMultiTLS(network, addrs, config)
-				}
+	addrs := make([]string, len(hosts))
+	for i, host := range hosts {
+		addrs[i] = net.JoinHostPort(host, port)
+	}
+	network = d.dialNetwork(network)
+	conn, err := d.dialMulti(ctx, network, addrs, alias)
+	d.recordDial(alias, "tcp", err)
+	return conn, true, err
+}
+
+// dialAliasTLS races the addrs of alias for host, ok is false if it has none.
+func (d *MultiDialer) dialAliasTLS(ctx context.Context, network, host, port, alias string, cfg *tls.Config, small bool) (net.Conn, bool, error) {
+	port = d.aliasPort(alias, port)
+	hosts, err := d.LookupAlias(alias)
+	if err != nil {
+		helpers.TraceFrom(ctx).Addf("dns", alias, "error: %v", err)
+		return nil, false, err
+	}
+	helpers.TraceFrom(ctx).Addf("dns", alias, "%v", hosts)
+
+	config := d.tlsConfigForAlias(alias, host, cfg)
+	if err := d.setECH(alias, config); err != nil {
+		d.recordDial(alias, "tls", err)
+		return nil, true, err
+	}
+	glog.V(3).Infof("DialTLS(%#v, %#v) alais=%#v set tls.Config=%#v", network, net.JoinHostPort(host, port), alias, config)
+
+	addrs := make([]string, len(hosts))
+	for i, host := range hosts {
+		addrs[i] = net.JoinHostPort(host, port)
+	}
+	network = d.dialNetwork(network)
+	conn, err := d.dialMultiTLS(ctx, network, d.filterThrottled(addrs, small), config, alias)
+	d.recordDial(alias, "tls", err)
+	return conn, true, err
+}
+
+func (d *MultiDialer) recordDial(alias, kind string, err error) {
+	if d.Metrics == nil {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	d.Metrics.IncCounter("goproxy_dial_attempts_total", "alias", alias, "type", kind, "result", result)
+}
+
+func (d *MultiDialer) dialTLS(ctx context.Context, network, address string, config *tls.Config) (net.Conn, error) {
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		if name, ok := d.serverNameOf(host); ok {
+			if config == nil {
+				config = &tls.Config{}
+			} else {
+				config = config.Clone()
 			}
+			setServerName(config, name)
 		}
-	default:
-		break
+		config = d.withClientCertificate(config, host)
 	}
-	return tls.DialWithDialer(&d.Dialer, network, address, d.TLSConfig)
+
+	if d.Upstream == nil {
+		if config != nil && config.KeyLogWriter == nil {
+			config = config.Clone()
+			config.KeyLogWriter = helpers.KeyLog
+		}
+		dialer, _ := d.dialerFor("")
+		dialer = d.withWhiteList("", withConnectTimeout(ctx, dialer))
+		if timeout := handshakeTimeout(ctx, 0); timeout > 0 && dialer.Timeout > 0 {
+			// the Timeout of tls.Dialer covers the handshake too
+			d1 := *dialer
+			d1.Timeout += timeout
+			dialer = &d1
+		}
+		return (&tls.Dialer{NetDialer: dialer, Config: config}).DialContext(ctx, network, address)
+	}
+
+	conn, err := d.dialContext(ctx, "", network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.KeyLogWriter == nil {
+		config = config.Clone()
+		config.KeyLogWriter = helpers.KeyLog
+	}
+	if config.ServerName == "" {
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			config = config.Clone()
+			config.ServerName = host
+		}
+	}
+
+	if timeout := handshakeTimeout(ctx, d.Timeout); timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
 }
 
-func (d *MultiDialer) dialMulti(network string, addrs []string) (net.Conn, error) {
+func (d *MultiDialer) dialMulti(ctx context.Context, network string, addrs []string, alias string) (net.Conn, error) {
 	glog.V(3).Infof("dialMulti(%v, %v)", network, addrs)
 	type racer struct {
-		c net.Conn
-		e error
+		c    net.Conn
+		e    error
+		addr string
 	}
 
+	addrs = d.dropDemotedIPv6(alias, addrs)
+
 	length := len(addrs)
-	if d.Level < length {
-		length = d.Level
+	if level := d.dialLevel(alias); level < length {
+		length = level
 	}
 
-	addrs = pickupAddrs(addrs, length, d.TCPConnDuration, d.TCPConnError)
+	v6First := d.ipv6First(addrs, d.TCPConnDuration)
+	switch {
+	case d.dialStrategy(alias) == DialWeighted:
+		addrs = pickupWeighted(addrs, d.TCPConnDuration, d.TCPConnError)
+	case d.HappyEyeballsDelay > 0:
+		addrs = pickupDualStack(addrs, length, d.TCPConnDuration, d.TCPConnError, v6First)
+	default:
+		addrs = pickupAddrs(addrs, length, d.TCPConnDuration, d.TCPConnError)
+	}
+	length = len(addrs)
+	helpers.TraceFrom(ctx).Addf("dial", alias, "race %v", addrs)
+	he := newHappyEyeballs(addrs, d.HappyEyeballsDelay, v6First)
+	race := d.newIPv6Race(alias, addrs, v6First)
 	lane := make(chan racer, length)
 
+	// cancel aborts the losing attempts as soon as a winner is chosen, and
+	// all of them as soon as ctx is done
+	parent := ctx
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	raceStart := time.Now()
 	for _, addr := range addrs {
 		go func(addr string, c chan<- racer) {
+			if err := he.wait(ctx, addr); err != nil {
+				lane <- racer{nil, err, addr}
+				return
+			}
 			start := time.Now()
-			conn, err := d.Dialer.Dial(network, addr)
+			conn, err := d.dialContext(ctx, alias, network, addr)
 			end := time.Now()
-			if err == nil {
+			he.done(addr, err)
+			switch {
+			case err == nil:
 				d.TCPConnDuration.Set(addr, end.Sub(start), end.Add(d.ConnExpiry))
-			} else {
+				d.scores.observe(alias, "tcp", addr, end.Sub(start), nil)
+			case ctx.Err() != nil:
+				break
+			default:
 				d.TCPConnDuration.Del(addr)
-				d.TLSConnError.Set(addr, err, end.Add(d.ConnExpiry))
+				d.TCPConnError.Set(addr, err, end.Add(d.ConnExpiry))
+				d.scores.observe(alias, "tcp", addr, 0, err)
+				race.fail(addr)
 			}
-			lane <- racer{conn, err}
+			lane <- racer{conn, err, addr}
 		}(addr, lane)
 	}
 
@@ -357,57 +821,169 @@ func (d *MultiDialer) dialMulti(network string, addrs []string) (net.Conn, error
 					}
 				}
 			}(length - 1 - i)
+			// r.c.RemoteAddr() is the upstream proxy if there is one
+			d.settleIPv6(race, r.addr)
+			d.observeRace(alias, r.addr == addrs[0], time.Since(raceStart), nil)
+			helpers.TraceFrom(ctx).Addf("dial", alias, "%s won in %s", r.addr, time.Since(raceStart))
 			return r.c, nil
 		}
 	}
-	return nil, r.e
+	if err := parent.Err(); err != nil {
+		return nil, err
+	}
+	d.settleIPv6(race, "")
+	d.observeRace(alias, false, 0, r.e)
+	helpers.TraceFrom(ctx).Addf("dial", alias, "all failed: %v", r.e)
+	return nil, helpers.NewError(helpers.ErrDialFailure, "MULTIDIALER", r.e).WithAddrs(alias, addrs)
 }
 
-func (d *MultiDialer) dialMultiTLS(network string, addrs []string, config *tls.Config) (net.Conn, error) {
-	glog.V(3).Infof("dialMultiTLS(%v, %v, %#v)", network, addrs, config)
+func (d *MultiDialer) dialMultiTLS(ctx context.Context, network string, addrs []string, config *tls.Config, alias string) (net.Conn, error) {
+	glog.V(3).Infof("dialMultiTLS(%v, %v, %#v, %#v)", network, addrs, config, alias)
 	type racer struct {
-		c net.Conn
-		e error
+		c    net.Conn
+		e    error
+		addr string
 	}
 
+	addrs = d.dropDemotedIPv6(alias, addrs)
+
 	length := len(addrs)
-	if d.Level < length {
-		length = d.Level
+	if level := d.dialLevel(alias); level < length {
+		length = level
 	}
 
-	addrs = pickupAddrs(addrs, length, d.TLSConnDuration, d.TLSConnError)
+	v6First := d.ipv6First(addrs, d.TLSConnDuration)
+	switch {
+	case d.dialStrategy(alias) == DialWeighted:
+		addrs = pickupWeighted(addrs, d.TLSConnDuration, d.TLSConnError)
+	case d.HappyEyeballsDelay > 0:
+		addrs = pickupDualStack(addrs, length, d.TLSConnDuration, d.TLSConnError, v6First)
+	default:
+		addrs = pickupAddrs(addrs, length, d.TLSConnDuration, d.TLSConnError)
+	}
+	length = len(addrs)
+	helpers.TraceFrom(ctx).Addf("dial", alias, "race %v", addrs)
+	he := newHappyEyeballs(addrs, d.HappyEyeballsDelay, v6First)
+	race := d.newIPv6Race(alias, addrs, v6First)
 	lane := make(chan racer, length)
 
+	if config == nil {
+		config = &tls.Config{
+			InsecureSkipVerify: true,
+		}
+	}
+
+	poolKey := connPoolKey(alias, addrsPort(addrs), config)
+	if slot := prewarmSlotOf(ctx); slot != nil {
+		slot.key = poolKey
+	} else if d.IdleConnPool > 0 {
+		idleConnTimeout := d.IdleConnTimeout
+		if idleConnTimeout <= 0 {
+			idleConnTimeout = DefaultIdleConnTimeout
+		}
+		if conn := d.idleConns.get(poolKey, idleConnTimeout); conn != nil {
+			glog.V(3).Infof("dialMultiTLS(%#v) reuse idle conn to %s", alias, conn.RemoteAddr())
+			helpers.TraceFrom(ctx).Addf("dial", alias, "reuse idle conn to %s", conn.RemoteAddr())
+			return conn, nil
+		}
+	}
+
+	config = d.sessionConfig(config, alias)
+
+	// cancel aborts the losing attempts as soon as a winner is chosen, and
+	// all of them as soon as ctx is done
+	parent := ctx
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	raceStart := time.Now()
 	for _, addr := range addrs {
 		go func(addr string, c chan<- racer) {
-			// start := time.Now()
-			conn, err := d.Dialer.Dial(network, addr)
-			if err != nil {
-				d.TLSConnDuration.Del(addr)
-				d.TLSConnError.Set(addr, err, time.Now().Add(d.ConnExpiry))
-				lane <- racer{conn, err}
+			if err := he.wait(ctx, addr); err != nil {
+				lane <- racer{nil, err, addr}
 				return
 			}
-
-			if config == nil {
-				config = &tls.Config{
-					InsecureSkipVerify: true,
+			conn, err := d.dialContext(ctx, alias, network, addr)
+			if err != nil {
+				if ctx.Err() == nil {
+					d.TLSConnDuration.Del(addr)
+					d.TLSConnError.Set(addr, err, time.Now().Add(d.ConnExpiry))
+					d.scores.observe(alias, "tls", addr, 0, err)
+					race.fail(addr)
 				}
+				he.done(addr, err)
+				lane <- racer{conn, err, addr}
+				return
 			}
 
 			start := time.Now()
-			tlsConn := tls.Client(conn, config)
+			wconn := d.watchThrottle(conn, addr)
+			tlsConn := d.tlsClient(wconn, config, alias)
+
+			timeout := handshakeTimeout(ctx, 0)
+			if timeout > 0 {
+				conn.SetDeadline(start.Add(timeout))
+			}
+
+			// close the half-open socket if the race is over during handshake,
+			// a conn closed by the watcher is never handed out, even if its
+			// handshake has just finished
+			done := make(chan struct{})
+			watched := make(chan bool, 1)
+			go func() {
+				select {
+				case <-ctx.Done():
+					conn.Close()
+					watched <- true
+				case <-done:
+					watched <- false
+				}
+			}()
 			err = tlsConn.Handshake()
+			close(done)
+			if <-watched && err == nil {
+				err = ctx.Err()
+			}
+			if timeout > 0 && err == nil {
+				conn.SetDeadline(time.Time{})
+			}
+			if err == nil {
+				err = d.learnCert(tlsConn, alias, addr, config.ServerName)
+			}
 
 			end := time.Now()
-			if err == nil {
+			switch {
+			case err == nil:
 				d.TLSConnDuration.Set(addr, end.Sub(start), end.Add(d.ConnExpiry))
-			} else {
+				d.scores.observe(alias, "tls", addr, end.Sub(start), nil)
+				if tc, ok := wconn.(*throttleConn); ok {
+					tc.begin()
+				}
+				if d.Metrics != nil {
+					d.Metrics.Observe("goproxy_tls_handshake_duration_seconds", end.Sub(start).Seconds())
+					if didResume(tlsConn) {
+						d.Metrics.IncCounter("goproxy_tls_resumptions_total", "alias", alias)
+					}
+				}
+			case ctx.Err() != nil:
+				conn.Close()
+			default:
 				d.TLSConnDuration.Del(addr)
 				d.TLSConnError.Set(addr, err, end.Add(d.ConnExpiry))
+				d.scores.observe(alias, "tls", addr, 0, err)
+				race.fail(addr)
+				if config.EncryptedClientHelloConfigList != nil {
+					d.echRejected(config.ServerName, err)
+				}
+				conn.Close()
 			}
 
-			lane <- racer{tlsConn, err}
+			he.done(addr, err)
+			if err != nil {
+				lane <- racer{nil, err, addr}
+				return
+			}
+			lane <- racer{tlsConn, nil, addr}
 		}(addr, lane)
 	}
 
@@ -415,19 +991,35 @@ func (d *MultiDialer) dialMultiTLS(network string, addrs []string, config *tls.C
 	for i := 0; i < length; i++ {
 		r = <-lane
 		if r.e == nil {
+			// the losers which finish their handshake anyway are kept for later dials
 			go func(count int) {
 				var r1 racer
 				for ; count > 0; count-- {
 					r1 = <-lane
-					if r1.c != nil {
+					if r1.c == nil {
+						continue
+					}
+					if d.IdleConnPool > 0 {
+						d.idleConns.put(poolKey, r1.c, d.IdleConnPool)
+					} else {
 						r1.c.Close()
 					}
 				}
 			}(length - 1 - i)
+			// r.c.RemoteAddr() is the upstream proxy if there is one
+			d.settleIPv6(race, r.addr)
+			d.observeRace(alias, r.addr == addrs[0], time.Since(raceStart), nil)
+			helpers.TraceFrom(ctx).Addf("dial", alias, "%s won in %s", r.addr, time.Since(raceStart))
 			return r.c, nil
 		}
 	}
-	return nil, r.e
+	if err := parent.Err(); err != nil {
+		return nil, err
+	}
+	d.settleIPv6(race, "")
+	d.observeRace(alias, false, 0, r.e)
+	helpers.TraceFrom(ctx).Addf("dial", alias, "all failed: %v", r.e)
+	return nil, helpers.NewError(helpers.ErrDialFailure, "MULTIDIALER", r.e).WithAddrs(alias, addrs)
 }
 
 type racer struct {
@@ -449,6 +1041,71 @@ func (r racers) Less(i, j int) bool {
 	return r[i].duration < r[j].duration
 }
 
+// ipWhiteList returns the IPWhiteList of alias, the one of alias "*" applies
+// to the aliases without their own and to the dials of no alias.
+func (d *MultiDialer) ipWhiteList(alias string) ([]*net.IPNet, bool) {
+	if ipnets, ok := d.IPWhiteList[alias]; ok && alias != "" {
+		return ipnets, true
+	}
+	ipnets, ok := d.IPWhiteList["*"]
+	return ipnets, ok
+}
+
+// checkWhiteList fails if address is not an ip inside the IPWhiteList of
+// alias, a name cannot be vetted.
+func (d *MultiDialer) checkWhiteList(alias, address string) error {
+	ipnets, ok := d.ipWhiteList(alias)
+	if !ok {
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	if ip := net.ParseIP(host); ip != nil && helpers.ContainsIP(ipnets, ip) {
+		return nil
+	}
+
+	return fmt.Errorf("MULTIDIALER: %s is outside of the IPWhiteList of alias %#v", address, alias)
+}
+
+// withWhiteList returns dialer, or a copy of it which checks the ip it is
+// about to connect to against the IPWhiteList of alias, after any DNS lookup
+// of its own, so that no dial can leave the vetted ranges.
+func (d *MultiDialer) withWhiteList(alias string, dialer *net.Dialer) *net.Dialer {
+	if _, ok := d.ipWhiteList(alias); !ok {
+		return dialer
+	}
+
+	dialer1 := *dialer
+	control := dialer.Control
+	dialer1.Control = func(network, address string, c syscall.RawConn) error {
+		if err := d.checkWhiteList(alias, address); err != nil {
+			return err
+		}
+		if control != nil {
+			return control(network, address, c)
+		}
+		return nil
+	}
+	return &dialer1
+}
+
+// filterIPNets keeps the ips inside one of ipnets.
+func filterIPNets(ips []string, ipnets []*net.IPNet) []string {
+	ips1 := make([]string, 0, len(ips))
+	for _, s := range ips {
+		if ip := net.ParseIP(s); ip != nil && helpers.ContainsIP(ipnets, ip) {
+			ips1 = append(ips1, s)
+		}
+	}
+	if len(ips1) < len(ips) {
+		glog.V(2).Infof("MULTIDIALER: drop %d ips outside of whitelist", len(ips)-len(ips1))
+	}
+	return ips1
+}
+
 func pickupAddrs(addrs []string, n int, connDuration lrucache.Cache, connError lrucache.Cache) []string {
 	if len(addrs) <= n {
 		return addrs
@@ -478,8 +1135,14 @@ func pickupAddrs(addrs []string, n int, connDuration lrucache.Cache, connError l
 
 	sort.Sort(racers(goodAddrs))
 
-	if len(goodAddrs) > n/2 {
-		goodAddrs = goodAddrs[:n/2]
+	// half of a race goes to the best known addrs, and the rest to find
+	// better ones, a single dial goes to the best one
+	keep := n / 2
+	if keep == 0 {
+		keep = 1
+	}
+	if len(goodAddrs) > keep {
+		goodAddrs = goodAddrs[:keep]
 	}
 
 	goodAddrs1 := make([]string, len(goodAddrs), n)
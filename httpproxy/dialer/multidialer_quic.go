@@ -0,0 +1,138 @@
+package dialer
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/phuslu/glog"
+	"github.com/quic-go/quic-go"
+
+	"../helpers"
+)
+
+// DialQUIC is the UDP counterpart of DialTLS2, it races QUIC handshakes to
+// the addrs of the alias of address, so google traffic still works when
+// TCP/443 is throttled. Results are kept in QUICConnDuration/QUICConnError.
+// Its signature is the Dial of http3.Transport.
+func (d *MultiDialer) DialQUIC(ctx context.Context, address string, tlsConfig *tls.Config, cfg *quic.Config) (*quic.Conn, error) {
+	helpers.DefaultLogger.Warning("MULTIDIALER DialQUIC", helpers.F("address", address), helpers.F("good_addrs", d.QUICConnDuration.Len()), helpers.F("bad_addrs", d.QUICConnError.Len()))
+	if d.Upstream != nil {
+		return nil, fmt.Errorf("DialQUIC(%#v): QUIC cannot be dialed through Upstream", address)
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+
+	alias, ok := d.lookupSitePort(host, port)
+	if !ok {
+		if err := d.checkWhiteList("", address); err != nil {
+			return nil, err
+		}
+		config := tlsConfig.Clone()
+		config.KeyLogWriter = helpers.KeyLog
+		return quic.DialAddr(ctx, address, config, cfg)
+	}
+
+	if d.sniPolicy(alias).ECH {
+		// quic-go sends the SNI in the clear
+		return nil, fmt.Errorf("DialQUIC(%#v): alias %#v requires ECH, which is not supported over QUIC", address, alias)
+	}
+
+	port = d.aliasPort(alias, port)
+	hosts, err := d.LookupAlias(alias)
+	if err != nil {
+		helpers.TraceFrom(ctx).Addf("dns", alias, "error: %v", err)
+		return nil, err
+	}
+	helpers.TraceFrom(ctx).Addf("dns", alias, "%v", hosts)
+
+	// the ALPN is the one of the caller, e.g. "h3" of http3.Transport
+	config := d.tlsConfigForAlias(alias, host, tlsConfig)
+	config.NextProtos = tlsConfig.NextProtos
+	glog.V(3).Infof("DialQUIC(%#v) alais=%#v set tls.Config=%#v", address, alias, config)
+
+	addrs := make([]string, len(hosts))
+	for i, host := range hosts {
+		addrs[i] = net.JoinHostPort(host, port)
+	}
+	conn, err := d.dialMultiQUIC(ctx, addrs, config, cfg, alias)
+	d.recordDial(alias, "quic", err)
+	return conn, err
+}
+
+func (d *MultiDialer) dialMultiQUIC(ctx context.Context, addrs []string, config *tls.Config, cfg *quic.Config, alias string) (*quic.Conn, error) {
+	glog.V(3).Infof("dialMultiQUIC(%v, %#v, %#v)", addrs, config, alias)
+	type racer struct {
+		c    *quic.Conn
+		e    error
+		addr string
+	}
+
+	length := len(addrs)
+	if level := d.dialLevel(alias); level < length {
+		length = level
+	}
+
+	addrs = pickupAddrs(addrs, length, d.QUICConnDuration, d.QUICConnError)
+	length = len(addrs)
+	helpers.TraceFrom(ctx).Addf("dial", alias, "race quic %v", addrs)
+	lane := make(chan racer, length)
+
+	// cancel aborts the losing handshakes as soon as a winner is chosen, and
+	// all of them as soon as ctx is done
+	parent := ctx
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	for _, addr := range addrs {
+		go func(addr string) {
+			if err := d.checkWhiteList(alias, addr); err != nil {
+				lane <- racer{nil, err, addr}
+				return
+			}
+			start := time.Now()
+			conn, err := quic.DialAddr(ctx, addr, config, cfg)
+			end := time.Now()
+			switch {
+			case err == nil:
+				d.QUICConnDuration.Set(addr, end.Sub(start), end.Add(d.ConnExpiry))
+				d.scores.observe(alias, "quic", addr, end.Sub(start), nil)
+			case ctx.Err() != nil:
+				break
+			default:
+				d.QUICConnDuration.Del(addr)
+				d.QUICConnError.Set(addr, err, end.Add(d.ConnExpiry))
+				d.scores.observe(alias, "quic", addr, 0, err)
+			}
+			lane <- racer{conn, err, addr}
+		}(addr)
+	}
+
+	var r racer
+	for i := 0; i < length; i++ {
+		r = <-lane
+		if r.e == nil {
+			go func(count int) {
+				var r1 racer
+				for ; count > 0; count-- {
+					r1 = <-lane
+					if r1.c != nil {
+						r1.c.CloseWithError(0, "")
+					}
+				}
+			}(length - 1 - i)
+			helpers.TraceFrom(ctx).Addf("dial", alias, "quic %s won", r.addr)
+			return r.c, nil
+		}
+	}
+	if err := parent.Err(); err != nil {
+		return nil, err
+	}
+	helpers.TraceFrom(ctx).Addf("dial", alias, "quic all failed: %v", r.e)
+	return nil, helpers.NewError(helpers.ErrDialFailure, "MULTIDIALER", r.e).WithAddrs(alias, addrs)
+}
@@ -0,0 +1,66 @@
+package dialer
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+)
+
+// prewarmSlot marks the dials of Prewarm, dialMultiTLS does not hand them an
+// idle conn and tells them the key of the pool their conn goes back to.
+type prewarmSlot struct {
+	key string
+}
+
+type prewarmSlotKey struct{}
+
+func prewarmSlotOf(ctx context.Context) *prewarmSlot {
+	slot, _ := ctx.Value(prewarmSlotKey{}).(*prewarmSlot)
+	return slot
+}
+
+// Prewarm dials up to n TLS conns to address at once and keeps them in the
+// idle pool, so that the next n dials of it, e.g. the chunks of a ranged
+// download, skip the race and the handshake. It returns the number of conns
+// kept, none without IdleConnPool or for an address which is not a site of
+// an alias.
+func (d *MultiDialer) Prewarm(ctx context.Context, network, address string, n int) int {
+	if d.IdleConnPool <= 0 || n <= 0 {
+		return 0
+	}
+	if n > d.IdleConnPool {
+		n = d.IdleConnPool
+	}
+
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	kept := 0
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slot := &prewarmSlot{}
+			conn, err := d.dialTLSSite(context.WithValue(ctx, prewarmSlotKey{}, slot), network, address, nil, false)
+			if err != nil {
+				glog.V(2).Infof("MULTIDIALER: prewarm %#v error: %v", address, err)
+				return
+			}
+			if slot.key == "" {
+				conn.Close()
+				return
+			}
+			d.idleConns.put(slot.key, conn, d.IdleConnPool)
+			mu.Lock()
+			kept++
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	glog.V(2).Infof("MULTIDIALER: prewarmed %d/%d conns to %#v in %s", kept, n, address, time.Since(start))
+	return kept
+}
@@ -0,0 +1,133 @@
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// the most bytes read for the throughput sample of an ip
+	rankSampleSize int64 = 1024 * 1024
+)
+
+// IPRank is the result of handshaking one candidate ip of RankIPs.
+type IPRank struct {
+	IP      string
+	Latency time.Duration
+	// the CommonName of the leaf certificate
+	CommonName string
+	// bytes per second of the sample, 0 if it is not taken
+	Throughput float64
+	Err        error
+}
+
+// IPRanker handshakes candidate ips of Alias with the SNI policy, socket
+// options and fingerprint of the alias, as MultiDialer would dial them. If
+// SamplePath is set, it is requested from Host to sample the throughput.
+type IPRanker struct {
+	MultiDialer *MultiDialer
+	Alias       string
+	Host        string
+	Port        int
+	SamplePath  string
+	Concurrency int
+	Timeout     time.Duration
+}
+
+// Rank probes ips concurrently and returns them fastest first, the failed
+// ones are at the end.
+func (r *IPRanker) Rank(ips []string) []IPRank {
+	ranks := make([]IPRank, len(ips))
+
+	sem := make(chan struct{}, r.Concurrency)
+	var wg sync.WaitGroup
+	for i, ip := range ips {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, ip string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			ranks[i] = r.probe(ip)
+		}(i, ip)
+	}
+	wg.Wait()
+
+	sort.SliceStable(ranks, func(i, j int) bool {
+		if (ranks[i].Err == nil) != (ranks[j].Err == nil) {
+			return ranks[i].Err == nil
+		}
+		return ranks[i].Latency < ranks[j].Latency
+	})
+
+	return ranks
+}
+
+func (r *IPRanker) probe(ip string) IPRank {
+	rank := IPRank{IP: ip}
+	d := r.MultiDialer
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := d.dialContext(ctx, r.Alias, "tcp", net.JoinHostPort(ip, fmt.Sprintf("%d", r.Port)))
+	if err != nil {
+		rank.Err = err
+		return rank
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(start.Add(r.Timeout))
+
+	config := d.tlsConfigForAlias(r.Alias, r.Host, nil)
+	config.NextProtos = []string{"http/1.1"}
+	if err = d.setECH(r.Alias, config); err != nil {
+		rank.Err = err
+		return rank
+	}
+	tlsConn := d.tlsClient(conn, config, r.Alias)
+	if err = tlsConn.Handshake(); err != nil {
+		rank.Err = err
+		return rank
+	}
+	rank.Latency = time.Since(start)
+
+	if certs := peerCertificates(tlsConn); len(certs) > 0 {
+		rank.CommonName = certs[0].Subject.CommonName
+	}
+
+	if r.SamplePath != "" {
+		rank.Throughput, rank.Err = r.sample(tlsConn)
+	}
+
+	return rank
+}
+
+// sample reads up to rankSampleSize bytes of SamplePath, the response line
+// and headers are counted as well.
+func (r *IPRanker) sample(conn net.Conn) (float64, error) {
+	host := r.MultiDialer.HostHeader(r.Host)
+
+	start := time.Now()
+	if _, err := fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", r.SamplePath, host); err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(ioutil.Discard, io.LimitReader(conn, rankSampleSize))
+	if n == 0 {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+
+	return float64(n) / time.Since(start).Seconds(), nil
+}
@@ -0,0 +1,253 @@
+package dialer
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+const (
+	// the latencies kept per addr for the median
+	scoreSamples int = 16
+	// addrs tracked, the least recently seen are dropped first
+	maxScoredAddrs int = 8192
+)
+
+// AddrScore is how dialing an addr has gone, see MultiDialer.ScoreReport.
+type AddrScore struct {
+	Addr          string
+	Alias         string
+	Network       string
+	Samples       int
+	MedianLatency time.Duration
+	Errors        int
+	LastError     string `json:",omitempty"`
+	LastSeen      time.Time
+}
+
+type addrScore struct {
+	AddrScore
+	latencies []time.Duration
+}
+
+// scoreBoard keeps the recent latencies and the errors of the dialed addrs,
+// the conn caches only have the latest of them.
+type scoreBoard struct {
+	mu     sync.Mutex
+	scores map[string]*addrScore
+}
+
+func (b *scoreBoard) observe(alias, network, addr string, latency time.Duration, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.scores == nil {
+		b.scores = make(map[string]*addrScore)
+	}
+
+	key := network + " " + addr
+	s, ok := b.scores[key]
+	if !ok {
+		if len(b.scores) >= maxScoredAddrs {
+			b.evict()
+		}
+		s = &addrScore{AddrScore: AddrScore{Addr: addr, Network: network}}
+		b.scores[key] = s
+	}
+
+	s.Alias = alias
+	s.LastSeen = time.Now()
+	if err != nil {
+		s.Errors++
+		s.LastError = err.Error()
+		return
+	}
+
+	s.latencies = append(s.latencies, latency)
+	if len(s.latencies) > scoreSamples {
+		s.latencies = s.latencies[1:]
+	}
+	s.Samples++
+}
+
+// evict drops the least recently seen addr, b.mu must be held.
+func (b *scoreBoard) evict() {
+	var oldest string
+	for key, s := range b.scores {
+		if oldest == "" || s.LastSeen.Before(b.scores[oldest].LastSeen) {
+			oldest = key
+		}
+	}
+	delete(b.scores, oldest)
+}
+
+func medianDuration(durations []time.Duration) time.Duration {
+	if len(durations) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	if n := len(sorted); n%2 == 0 {
+		return (sorted[n/2-1] + sorted[n/2]) / 2
+	}
+	return sorted[len(sorted)/2]
+}
+
+// ScoreReport returns the score of each dialed addr, and of the addrs only
+// known from the conn caches, e.g. loaded by LoadConnCache, whose latency is
+// the cached one and LastSeen is zero.
+func (d *MultiDialer) ScoreReport() []AddrScore {
+	report := make([]AddrScore, 0)
+	seen := make(map[string]bool)
+
+	d.scores.mu.Lock()
+	for key, s := range d.scores.scores {
+		score := s.AddrScore
+		score.MedianLatency = medianDuration(s.latencies)
+		report = append(report, score)
+		seen[key] = true
+	}
+	d.scores.mu.Unlock()
+
+	aliases := d.hostMapAliases()
+
+	for _, c := range []struct {
+		network  string
+		duration lrucache.Cache
+		errors   lrucache.Cache
+	}{
+		{"tcp", d.TCPConnDuration, d.TCPConnError},
+		{"tls", d.TLSConnDuration, d.TLSConnError},
+	} {
+		durations := dumpDurations(c.duration)
+		errors := dumpErrors(c.errors)
+		for addr, duration := range durations {
+			if seen[c.network+" "+addr] {
+				continue
+			}
+			seen[c.network+" "+addr] = true
+			report = append(report, AddrScore{
+				Addr:          addr,
+				Alias:         aliases[addrIP(addr)],
+				Network:       c.network,
+				Samples:       1,
+				MedianLatency: duration,
+			})
+		}
+		for addr, err := range errors {
+			if seen[c.network+" "+addr] {
+				continue
+			}
+			seen[c.network+" "+addr] = true
+			report = append(report, AddrScore{
+				Addr:      addr,
+				Alias:     aliases[addrIP(addr)],
+				Network:   c.network,
+				Errors:    1,
+				LastError: err,
+			})
+		}
+	}
+
+	SortAddrScores(report, "")
+
+	return report
+}
+
+// hostMapAliases maps the ips of HostMap to their alias.
+func (d *MultiDialer) hostMapAliases() map[string]string {
+	m := make(map[string]string)
+	for alias, hosts := range d.HostMap {
+		for _, host := range hosts {
+			if net.ParseIP(host) != nil {
+				m[NormalizeIP(host)] = alias
+			}
+		}
+	}
+	return m
+}
+
+func addrIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return NormalizeIP(host)
+}
+
+// SortAddrScores sorts scores by key, which is one of "latency" (the
+// default), "errors", "lastseen", "addr" and "alias". The failing addrs go
+// after the working ones for "latency", the most failing first for "errors"
+// and the latest seen first for "lastseen".
+func SortAddrScores(scores []AddrScore, key string) error {
+	var less func(a, b *AddrScore) bool
+	switch key {
+	case "", "latency":
+		less = func(a, b *AddrScore) bool {
+			if (a.Samples == 0) != (b.Samples == 0) {
+				return a.Samples > 0
+			}
+			if a.MedianLatency != b.MedianLatency {
+				return a.MedianLatency < b.MedianLatency
+			}
+			return a.Errors < b.Errors
+		}
+	case "errors":
+		less = func(a, b *AddrScore) bool {
+			return a.Errors > b.Errors
+		}
+	case "lastseen":
+		less = func(a, b *AddrScore) bool {
+			return a.LastSeen.After(b.LastSeen)
+		}
+	case "addr":
+		less = func(a, b *AddrScore) bool {
+			return a.Addr < b.Addr
+		}
+	case "alias":
+		less = func(a, b *AddrScore) bool {
+			if a.Alias != b.Alias {
+				return a.Alias < b.Alias
+			}
+			return a.MedianLatency < b.MedianLatency
+		}
+	default:
+		return fmt.Errorf("unknown sort key %#v, want latency, errors, lastseen, addr or alias", key)
+	}
+
+	sort.SliceStable(scores, func(i, j int) bool {
+		return less(&scores[i], &scores[j])
+	})
+
+	return nil
+}
+
+// WriteAddrScores writes scores as a table aligned with spaces.
+func WriteAddrScores(w io.Writer, scores []AddrScore) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ADDR\tALIAS\tNET\tSAMPLES\tMEDIAN_MS\tERRORS\tLAST_SEEN\tLAST_ERROR")
+	for _, s := range scores {
+		lastSeen := "-"
+		if !s.LastSeen.IsZero() {
+			lastSeen = s.LastSeen.Format(time.RFC3339)
+		}
+		median := "-"
+		if s.Samples > 0 {
+			median = fmt.Sprintf("%d", s.MedianLatency/time.Millisecond)
+		}
+		alias := s.Alias
+		if alias == "" {
+			alias = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%d\t%s\t%s\n",
+			s.Addr, alias, s.Network, s.Samples, median, s.Errors, lastSeen, strings.Replace(s.LastError, "\t", " ", -1))
+	}
+	return tw.Flush()
+}
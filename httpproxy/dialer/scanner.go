@@ -0,0 +1,183 @@
+package dialer
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+)
+
+// IPScanner probes random ips of CIDRs with a TLS handshake, checks the
+// certificate against ServerName and feeds the working ips to Alias of
+// MultiDialer, so the alias does not depend on DNS answers only.
+type IPScanner struct {
+	MultiDialer *MultiDialer
+	Alias       string
+	CIDRs       []*net.IPNet
+	Port        int
+	ServerName  string
+	Concurrency int
+	BatchSize   int
+	MaxGood     int
+	Interval    time.Duration
+	Timeout     time.Duration
+
+	mu   sync.Mutex
+	good map[string]time.Duration
+}
+
+// NewIPScanner adds HostName to alias, so it must be called before d is used.
+func NewIPScanner(d *MultiDialer, alias string, cidrs []string, serverName string) (*IPScanner, error) {
+	if !d.HasAlias(alias) {
+		return nil, fmt.Errorf("alias %#v not exists", alias)
+	}
+
+	s := &IPScanner{
+		MultiDialer: d,
+		Alias:       alias,
+		Port:        443,
+		ServerName:  serverName,
+		Concurrency: 16,
+		BatchSize:   256,
+		MaxGood:     64,
+		Interval:    10 * time.Minute,
+		Timeout:     3 * time.Second,
+		good:        make(map[string]time.Duration),
+	}
+
+	for _, cidr := range cidrs {
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		if ipnet.IP.To4() == nil {
+			return nil, fmt.Errorf("IPScanner: only ipv4 cidr is supported, got %#v", cidr)
+		}
+		s.CIDRs = append(s.CIDRs, ipnet)
+	}
+
+	if len(s.CIDRs) == 0 {
+		return nil, fmt.Errorf("IPScanner: no cidrs for alias %#v", alias)
+	}
+
+	if err := d.AddHost(alias, s.HostName()); err != nil {
+		return nil, err
+	}
+	d.DNSCache.Set(s.HostName(), []string{}, time.Time{})
+
+	return s, nil
+}
+
+// HostName is the pseudo host added to the alias, its DNSCache entry holds
+// the ips found by the scanner.
+func (s *IPScanner) HostName() string {
+	return s.Alias + ".ipscanner"
+}
+
+// Scan rechecks the known good ips plus BatchSize random candidates and
+// returns the number of working ips.
+func (s *IPScanner) Scan() int {
+	s.mu.Lock()
+	ips := make([]string, 0, len(s.good)+s.BatchSize)
+	for ip := range s.good {
+		ips = append(ips, ip)
+	}
+	s.mu.Unlock()
+
+	for i := 0; i < s.BatchSize; i++ {
+		ips = append(ips, s.randomIP())
+	}
+
+	type result struct {
+		ip       string
+		duration time.Duration
+	}
+
+	results := make(chan result, len(ips))
+	sem := make(chan struct{}, s.Concurrency)
+	var wg sync.WaitGroup
+	for _, ip := range ips {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(ip string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			if duration, err := s.probe(ip); err == nil {
+				results <- result{ip, duration}
+			} else {
+				glog.V(3).Infof("IPScanner probe(%#v) error: %v", ip, err)
+			}
+		}(ip)
+	}
+	wg.Wait()
+	close(results)
+
+	rs := make([]result, 0)
+	for r := range results {
+		rs = append(rs, r)
+	}
+	sort.Slice(rs, func(i, j int) bool { return rs[i].duration < rs[j].duration })
+	if len(rs) > s.MaxGood {
+		rs = rs[:s.MaxGood]
+	}
+
+	d := s.MultiDialer
+	good := make(map[string]time.Duration, len(rs))
+	addrs := make([]string, 0, len(rs))
+	expire := time.Now().Add(d.ConnExpiry)
+	for _, r := range rs {
+		good[r.ip] = r.duration
+		addrs = append(addrs, r.ip)
+		d.TLSConnDuration.Set(net.JoinHostPort(r.ip, fmt.Sprintf("%d", s.Port)), r.duration, expire)
+	}
+
+	s.mu.Lock()
+	s.good = good
+	s.mu.Unlock()
+
+	d.DNSCache.Set(s.HostName(), addrs, time.Time{})
+
+	glog.Infof("IPScanner scan %d ips for alias %#v, found %d good ips", len(ips), s.Alias, len(addrs))
+
+	return len(addrs)
+}
+
+func (s *IPScanner) randomIP() string {
+	ipnet := s.CIDRs[rand.Intn(len(s.CIDRs))]
+	ones, bits := ipnet.Mask.Size()
+	base := binary.BigEndian.Uint32(ipnet.IP.To4())
+	n := uint32(0)
+	if bits > ones {
+		n = uint32(rand.Int63n(int64(1) << uint(bits-ones)))
+	}
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, base|n)
+	return ip.String()
+}
+
+func (s *IPScanner) probe(ip string) (time.Duration, error) {
+	d := s.MultiDialer
+	if d.IsBlackListed(ip) {
+		return 0, fmt.Errorf("ip %#v in blacklist", ip)
+	}
+
+	start := time.Now()
+	dialer := d.withWhiteList(s.Alias, &net.Dialer{Timeout: s.Timeout})
+	conn, err := tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(ip, fmt.Sprintf("%d", s.Port)), &tls.Config{
+		ServerName: s.ServerName,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	return time.Since(start), nil
+}
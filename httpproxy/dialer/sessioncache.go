@@ -0,0 +1,83 @@
+package dialer
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+
+	utls "github.com/refraction-networking/utls"
+)
+
+// aliasSessionCache is the part of MultiDialer.SessionCache of an alias. The
+// frontends behind an alias share their session ticket keys, so the session
+// of one raced addr resumes on the others, but those of another alias may not
+// and their sessions are kept apart.
+type aliasSessionCache struct {
+	alias string
+	cache tls.ClientSessionCache
+}
+
+func (c aliasSessionCache) Get(key string) (*tls.ClientSessionState, bool) {
+	return c.cache.Get(c.alias + "|" + key)
+}
+
+func (c aliasSessionCache) Put(key string, cs *tls.ClientSessionState) {
+	c.cache.Put(c.alias+"|"+key, cs)
+}
+
+// the same for the utls conns of TLSFingerprints, whose sessions are of
+// another type
+type aliasUSessionCache struct {
+	alias string
+	cache utls.ClientSessionCache
+}
+
+func (c aliasUSessionCache) Get(key string) (*utls.ClientSessionState, bool) {
+	return c.cache.Get(c.alias + "|" + key)
+}
+
+func (c aliasUSessionCache) Put(key string, cs *utls.ClientSessionState) {
+	c.cache.Put(c.alias+"|"+key, cs)
+}
+
+type uSessions struct {
+	once  sync.Once
+	cache utls.ClientSessionCache
+}
+
+// sessionConfig returns config resuming the sessions of alias in
+// SessionCache, or config as is if there is no SessionCache. crypto/tls sends
+// no early data, so a TLS 1.3 resumption saves the certificate exchange and
+// its verification but not the round trip.
+func (d *MultiDialer) sessionConfig(config *tls.Config, alias string) *tls.Config {
+	if d.SessionCache == nil {
+		return config
+	}
+	config = config.Clone()
+	config.ClientSessionCache = aliasSessionCache{alias, d.SessionCache}
+	return config
+}
+
+// uSessionCache returns the utls counterpart of sessionConfig, sized as the
+// default of crypto/tls.
+func (d *MultiDialer) uSessionCache(alias string) utls.ClientSessionCache {
+	if d.SessionCache == nil {
+		return nil
+	}
+	d.usessions.once.Do(func() {
+		d.usessions.cache = utls.NewLRUClientSessionCache(0)
+	})
+	return aliasUSessionCache{alias, d.usessions.cache}
+}
+
+// didResume reports whether the handshake of a crypto/tls or utls conn has
+// resumed a session.
+func didResume(conn net.Conn) bool {
+	switch c := conn.(type) {
+	case *tls.Conn:
+		return c.ConnectionState().DidResume
+	case *utls.UConn:
+		return c.ConnectionState().DidResume
+	}
+	return false
+}
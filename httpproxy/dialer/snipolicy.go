@@ -0,0 +1,345 @@
+package dialer
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../helpers"
+)
+
+const (
+	// the SNI is the host of the request, which CDNs check against the Host header
+	SNIMatch string = "match"
+	// the SNI is a front name and the Host header is the real site, domain fronting
+	SNICross string = "cross"
+	// no SNI at all, for the origins which serve their default certificate
+	SNIEmpty string = "empty"
+
+	sniCheckTimeout time.Duration = 10 * time.Second
+)
+
+// SNIPolicy is the combination of SNI and Host header sent to the hosts of an
+// alias. The aliases without one keep the old behavior, "google_" aliases are
+// SNICross over FakeServerNames and the others are SNIMatch.
+type SNIPolicy struct {
+	SNI string
+	// the front names of SNICross, FakeServerNames if it is empty
+	ServerNames []string
+	// replaces the Host header of the requests to the alias, "" keeps it
+	Host string
+	// a site of the alias which CheckSNIPolicy requests to see whether the
+	// origin accepts the combination
+	CheckHost string
+	// encrypts the SNI in an Encrypted Client Hello with the ECH config of
+	// the HTTPS record of the SNI, the outer ClientHello only carries the
+	// public name of the config
+	ECH bool
+}
+
+func (p SNIPolicy) Validate() error {
+	switch p.SNI {
+	case SNIMatch, SNIEmpty:
+		if len(p.ServerNames) > 0 {
+			return fmt.Errorf("SNI %#v does not take ServerNames", p.SNI)
+		}
+		if p.SNI == SNIEmpty && p.ECH {
+			return fmt.Errorf("SNI %#v has nothing to encrypt with ECH", p.SNI)
+		}
+	case SNICross:
+	default:
+		return fmt.Errorf("unknown SNI %#v, want %#v, %#v or %#v", p.SNI, SNIMatch, SNICross, SNIEmpty)
+	}
+	return nil
+}
+
+// SetSNIPolicies validates and swaps the policies by alias.
+func (d *MultiDialer) SetSNIPolicies(policies map[string]SNIPolicy) error {
+	for alias, p := range policies {
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("SNIPolicies[%#v]: %v", alias, err)
+		}
+	}
+
+	d.muConfig.Lock()
+	defer d.muConfig.Unlock()
+	d.SNIPolicies = policies
+
+	return nil
+}
+
+// SetServerNames swaps the SNI map, host patterns like "*.example.org" to
+// the server name sent to them, "" for no SNI at all. It wins over the
+// policy of the alias of a host.
+func (d *MultiDialer) SetServerNames(names map[string]string) {
+	var hm *helpers.HostMatcher
+	if len(names) > 0 {
+		hm = helpers.NewHostMatcherWithString(names)
+	}
+
+	d.muConfig.Lock()
+	defer d.muConfig.Unlock()
+	d.ServerNames = hm
+}
+
+// SetFakeServerNames swaps the front names of SNICross, the learned ip
+// scores are kept. If names differs, the name of "google_" aliases is picked
+// again, the next conns use it and the idle ones are left to expire.
+func (d *MultiDialer) SetFakeServerNames(names []string) {
+	d.muConfig.Lock()
+	defer d.muConfig.Unlock()
+
+	if len(names) == len(d.FakeServerNames) {
+		same := true
+		for i := range names {
+			if names[i] != d.FakeServerNames[i] {
+				same = false
+				break
+			}
+		}
+		if same {
+			return
+		}
+	}
+
+	d.FakeServerNames = names
+	d.fakeServerName = ""
+}
+
+// SetAliasFakeServerNames makes alias SNICross over names, the other fields
+// of its policy are kept. An empty names falls back to FakeServerNames.
+func (d *MultiDialer) SetAliasFakeServerNames(alias string, names []string) {
+	d.muConfig.Lock()
+	defer d.muConfig.Unlock()
+
+	policies := make(map[string]SNIPolicy, len(d.SNIPolicies)+1)
+	for k, v := range d.SNIPolicies {
+		policies[k] = v
+	}
+	p := policies[alias]
+	p.SNI, p.ServerNames = SNICross, names
+	policies[alias] = p
+
+	d.SNIPolicies = policies
+}
+
+// FakeServerNamesOf returns FakeServerNames and the front names of the
+// SNICross aliases which have their own.
+func (d *MultiDialer) FakeServerNamesOf() ([]string, map[string][]string) {
+	d.muConfig.RLock()
+	defer d.muConfig.RUnlock()
+
+	aliases := make(map[string][]string)
+	for alias, p := range d.SNIPolicies {
+		if p.SNI == SNICross && len(p.ServerNames) > 0 {
+			aliases[alias] = p.ServerNames
+		}
+	}
+	return d.FakeServerNames, aliases
+}
+
+// fakeServerNames returns FakeServerNames and the one picked for "google_"
+// aliases, which stays the same until they are swapped so that idle conns
+// are shared.
+func (d *MultiDialer) fakeServerNames() ([]string, string) {
+	d.muConfig.RLock()
+	names, name := d.FakeServerNames, d.fakeServerName
+	d.muConfig.RUnlock()
+
+	if name != "" || len(names) == 0 {
+		return names, name
+	}
+
+	d.muConfig.Lock()
+	defer d.muConfig.Unlock()
+	if d.fakeServerName == "" && len(d.FakeServerNames) > 0 {
+		d.fakeServerName = d.FakeServerNames[rand.Intn(len(d.FakeServerNames))]
+	}
+	return d.FakeServerNames, d.fakeServerName
+}
+
+func (d *MultiDialer) serverNameOf(host string) (string, bool) {
+	d.muConfig.RLock()
+	names := d.ServerNames
+	d.muConfig.RUnlock()
+
+	if names == nil {
+		return "", false
+	}
+	v, ok := names.Lookup(host)
+	if !ok {
+		return "", false
+	}
+	return v.(string), true
+}
+
+func setServerName(config *tls.Config, name string) {
+	config.ServerName = name
+	if name == "" {
+		// the certificate cannot be verified against a name it was not asked for
+		config.InsecureSkipVerify = true
+	}
+}
+
+func (d *MultiDialer) sniPolicy(alias string) SNIPolicy {
+	d.muConfig.RLock()
+	p, ok := d.SNIPolicies[alias]
+	d.muConfig.RUnlock()
+
+	switch {
+	case ok:
+		return p
+	case strings.HasPrefix(alias, "google_"):
+		return SNIPolicy{SNI: SNICross}
+	default:
+		return SNIPolicy{SNI: SNIMatch}
+	}
+}
+
+// Strategy describes how alias is dialed without naming it, e.g.
+// "sni=cross,fingerprint=chrome,ech=false".
+func (d *MultiDialer) Strategy(alias string) string {
+	p := d.sniPolicy(alias)
+
+	fingerprint := d.TLSFingerprints[alias]
+	if fingerprint == "" {
+		fingerprint = "go"
+	}
+
+	return fmt.Sprintf("sni=%s,fingerprint=%s,ech=%t", p.SNI, fingerprint, p.ECH)
+}
+
+// HostHeader returns the Host header to send for host, which is host itself
+// unless the policy of its alias replaces it.
+func (d *MultiDialer) HostHeader(host string) string {
+	name := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		name = h
+	}
+
+	if alias, ok := d.lookupSite(name); ok {
+		if p := d.sniPolicy(alias); p.Host != "" {
+			return p.Host
+		}
+	}
+
+	return host
+}
+
+// tlsConfigForAlias returns the tls.Config to dial host of alias with, the
+// SNI of the policy overrides the ServerName of cfg.
+func (d *MultiDialer) tlsConfigForAlias(alias, host string, cfg *tls.Config) *tls.Config {
+	names, picked := d.fakeServerNames()
+
+	var config *tls.Config
+	switch {
+	case strings.HasPrefix(alias, "google_"):
+		config = GetDefaultTLSConfigForGoogle(names).Clone()
+	case cfg != nil:
+		config = cfg.Clone()
+	default:
+		config = &tls.Config{
+			InsecureSkipVerify: true,
+		}
+	}
+
+	switch p := d.sniPolicy(alias); p.SNI {
+	case SNIMatch:
+		config.ServerName = host
+	case SNICross:
+		switch {
+		case len(p.ServerNames) > 0:
+			config.ServerName = p.ServerNames[rand.Intn(len(p.ServerNames))]
+		case picked != "" && strings.HasPrefix(alias, "google_"):
+			// the front name picked once for google, so that idle conns are shared
+			config.ServerName = picked
+		case config.ServerName != "" && config.ServerName != host:
+		case len(names) > 0:
+			config.ServerName = names[rand.Intn(len(names))]
+		}
+	case SNIEmpty:
+		setServerName(config, "")
+	}
+
+	if name, ok := d.serverNameOf(host); ok {
+		setServerName(config, name)
+	}
+
+	config = d.withClientCertificate(config, host)
+
+	config.KeyLogWriter = helpers.KeyLog
+
+	return config
+}
+
+// CheckSNIPolicy sends a HEAD request for CheckHost to alias with the SNI and
+// Host header of its policy. An error means the origin does not accept the
+// combination, e.g. it answers 421 Misdirected Request or the handshake fails.
+func (d *MultiDialer) CheckSNIPolicy(alias string) error {
+	p := d.sniPolicy(alias)
+	if p.CheckHost == "" {
+		return fmt.Errorf("SNIPolicies[%#v] has no CheckHost", alias)
+	}
+
+	hosts, err := d.LookupAlias(alias)
+	if err != nil {
+		return err
+	}
+
+	addrs := make([]string, len(hosts))
+	for i, host := range hosts {
+		addrs[i] = net.JoinHostPort(host, "443")
+	}
+
+	config := d.tlsConfigForAlias(alias, p.CheckHost, nil)
+	config.NextProtos = []string{"http/1.1"}
+	if err := d.setECH(alias, config); err != nil {
+		return err
+	}
+
+	conn, err := d.dialMultiTLS(context.Background(), d.dialNetwork("tcp"), addrs, config, alias)
+	if err != nil {
+		return fmt.Errorf("SNI %#v handshake error: %v", config.ServerName, err)
+	}
+	defer conn.Close()
+
+	if p.SNI == SNIMatch {
+		if certs := peerCertificates(conn); len(certs) > 0 {
+			if err := certs[0].VerifyHostname(p.CheckHost); err != nil {
+				return err
+			}
+		}
+	}
+
+	host := p.CheckHost
+	if p.Host != "" {
+		host = p.Host
+	}
+
+	conn.SetDeadline(time.Now().Add(sniCheckTimeout))
+	if _, err = fmt.Fprintf(conn, "HEAD / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", host); err != nil {
+		return err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusMisdirectedRequest, http.StatusBadRequest, http.StatusForbidden:
+		return fmt.Errorf("SNI %#v with Host %#v return %s", config.ServerName, host, resp.Status)
+	}
+
+	glog.V(2).Infof("MULTIDIALER: SNIPolicies[%#v] SNI %#v with Host %#v return %s", alias, config.ServerName, host, resp.Status)
+	return nil
+}
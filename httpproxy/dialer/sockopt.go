@@ -0,0 +1,129 @@
+package dialer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// SocketOptions are set on the sockets dialed to the hosts of an alias, the
+// ones of alias "*" apply to the aliases without their own.
+type SocketOptions struct {
+	// TCP_FASTOPEN_CONNECT, the handshake carries the ClientHello
+	FastOpen bool
+	// nil keeps TCP_NODELAY on as Go does
+	NoDelay *bool
+	// SO_MARK, for policy routing
+	Mark int
+	// IP_TTL or IPV6_UNICAST_HOPS, 0 keeps the system default
+	TTL int
+	// SO_BINDTODEVICE, e.g. to pin an alias to a WAN interface
+	Interface string
+	// TCP_MAXSEG, clamps the segments sent below the path MTU, 0 keeps it
+	MSS int
+	// bytes of the ClientHello sent in the first segment of a TLS connection,
+	// the rest follows SplitDelay milliseconds later, for the DPI boxes which
+	// only inspect the first packet. 0 sends it whole
+	SplitClientHello int
+	SplitDelay       int
+}
+
+func (o SocketOptions) Validate() error {
+	if o.Mark < 0 {
+		return fmt.Errorf("invalid Mark %d", o.Mark)
+	}
+	if o.TTL < 0 || o.TTL > 255 {
+		return fmt.Errorf("invalid TTL %d", o.TTL)
+	}
+	if o.MSS != 0 && (o.MSS < 88 || o.MSS > 65535) {
+		return fmt.Errorf("invalid MSS %d", o.MSS)
+	}
+	if o.SplitClientHello < 0 || o.SplitDelay < 0 {
+		return fmt.Errorf("invalid SplitClientHello %d or SplitDelay %d", o.SplitClientHello, o.SplitDelay)
+	}
+	if o.SplitClientHello > 0 && o.NoDelay != nil && !*o.NoDelay {
+		return fmt.Errorf("SplitClientHello needs NoDelay")
+	}
+	return validatePlatformSocketOptions(o)
+}
+
+// control sets the options on the socket before it connects.
+func (o SocketOptions) control(network, address string, c syscall.RawConn) error {
+	var err error
+	if err1 := c.Control(func(fd uintptr) {
+		err = setSocketOptions(int(fd), network, o)
+	}); err1 != nil {
+		return err1
+	}
+	return err
+}
+
+// SetSocketOptions validates and swaps the socket options by alias.
+func (d *MultiDialer) SetSocketOptions(options map[string]SocketOptions) error {
+	for alias, o := range options {
+		if err := o.Validate(); err != nil {
+			return fmt.Errorf("SocketOptions[%#v]: %v", alias, err)
+		}
+	}
+
+	d.muConfig.Lock()
+	defer d.muConfig.Unlock()
+	d.SocketOptions = options
+
+	return nil
+}
+
+func (d *MultiDialer) socketOptions(alias string) (SocketOptions, bool) {
+	d.muConfig.RLock()
+	defer d.muConfig.RUnlock()
+
+	if o, ok := d.SocketOptions[alias]; ok {
+		return o, true
+	}
+	o, ok := d.SocketOptions["*"]
+	return o, ok
+}
+
+// dialerFor returns d.Dialer, or a copy of it which sets the socket options
+// of alias.
+func (d *MultiDialer) dialerFor(alias string) (*net.Dialer, *SocketOptions) {
+	o, ok := d.socketOptions(alias)
+	if !ok {
+		return &d.Dialer, nil
+	}
+
+	dialer := d.Dialer
+	dialer.Control = o.control
+	return &dialer, &o
+}
+
+// dialContext dials address directly or through Upstream if it is set, with
+// the socket options of alias.
+func (d *MultiDialer) dialContext(ctx context.Context, alias, network, address string) (net.Conn, error) {
+	dialer, o := d.dialerFor(alias)
+	dialer = withConnectTimeout(ctx, dialer)
+
+	var conn net.Conn
+	var err error
+	if d.Upstream != nil {
+		// the dialer connects to the upstream, so address is checked here
+		if err := d.checkWhiteList(alias, address); err != nil {
+			return nil, err
+		}
+		conn, err = d.Upstream.DialContext(ctx, dialer, address)
+	} else {
+		conn, err = d.withWhiteList(alias, dialer).DialContext(ctx, network, address)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if o != nil && o.NoDelay != nil {
+		if tc, ok := conn.(*net.TCPConn); ok {
+			tc.SetNoDelay(*o.NoDelay)
+		}
+	}
+
+	return conn, nil
+}
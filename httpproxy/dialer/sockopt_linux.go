@@ -0,0 +1,58 @@
+// +build linux
+
+package dialer
+
+import (
+	"os"
+	"strings"
+	"syscall"
+)
+
+const (
+	// not in package syscall, since linux 4.11
+	tcpFastOpenConnect = 30
+)
+
+func validatePlatformSocketOptions(o SocketOptions) error {
+	return nil
+}
+
+func setSocketOptions(fd int, network string, o SocketOptions) error {
+	if o.FastOpen && strings.HasPrefix(network, "tcp") {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, tcpFastOpenConnect, 1); err != nil {
+			return os.NewSyscallError("setsockopt TCP_FASTOPEN_CONNECT", err)
+		}
+	}
+
+	if o.Mark > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_MARK, o.Mark); err != nil {
+			return os.NewSyscallError("setsockopt SO_MARK", err)
+		}
+	}
+
+	if o.TTL > 0 {
+		var err error
+		if strings.HasSuffix(network, "6") {
+			err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_UNICAST_HOPS, o.TTL)
+		} else {
+			err = syscall.SetsockoptInt(fd, syscall.IPPROTO_IP, syscall.IP_TTL, o.TTL)
+		}
+		if err != nil {
+			return os.NewSyscallError("setsockopt TTL", err)
+		}
+	}
+
+	if o.MSS > 0 && strings.HasPrefix(network, "tcp") {
+		if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_MAXSEG, o.MSS); err != nil {
+			return os.NewSyscallError("setsockopt TCP_MAXSEG", err)
+		}
+	}
+
+	if o.Interface != "" {
+		if err := syscall.BindToDevice(fd, o.Interface); err != nil {
+			return os.NewSyscallError("setsockopt SO_BINDTODEVICE", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,30 @@
+// +build !linux
+
+package dialer
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// only NoDelay, which is set on the connected socket, and SplitClientHello
+// work everywhere
+func validatePlatformSocketOptions(o SocketOptions) error {
+	switch {
+	case o.FastOpen:
+		return fmt.Errorf("FastOpen is not supported on %s", runtime.GOOS)
+	case o.Mark > 0:
+		return fmt.Errorf("Mark is not supported on %s", runtime.GOOS)
+	case o.TTL > 0:
+		return fmt.Errorf("TTL is not supported on %s", runtime.GOOS)
+	case o.Interface != "":
+		return fmt.Errorf("Interface is not supported on %s", runtime.GOOS)
+	case o.MSS > 0:
+		return fmt.Errorf("MSS is not supported on %s", runtime.GOOS)
+	}
+	return nil
+}
+
+func setSocketOptions(fd int, network string, o SocketOptions) error {
+	return nil
+}
@@ -0,0 +1,190 @@
+package dialer
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"github.com/phuslu/glog"
+)
+
+const (
+	socks5Version      byte = 0x05
+	socks5AuthNone     byte = 0x00
+	socks5AuthPassword byte = 0x02
+	socks5AuthNoAccept byte = 0xff
+	socks5CmdConnect   byte = 0x01
+	socks5AtypIPv4     byte = 0x01
+	socks5AtypDomain   byte = 0x03
+	socks5AtypIPv6     byte = 0x04
+)
+
+var socks5Errors = []string{
+	"",
+	"general SOCKS server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+type Socks5Dialer struct {
+	Dialer interface {
+		Dial(network, address string) (net.Conn, error)
+	}
+	Address  string
+	Username string
+	Password string
+}
+
+func (d *Socks5Dialer) Dial(network, address string) (net.Conn, error) {
+	glog.V(3).Infof("SOCKS5 Dial(%#v, %#v) via %#v", network, address, d.Address)
+
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		break
+	default:
+		return nil, net.UnknownNetworkError(network)
+	}
+
+	conn, err := d.Dialer.Dial("tcp", d.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = Socks5Connect(conn, address, d.Username, d.Password); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// Socks5Connect performs a SOCKS5 handshake on conn and asks the server to
+// connect to address, authenticating with username/password if given.
+func Socks5Connect(conn net.Conn, address, username, password string) error {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 0xffff {
+		return fmt.Errorf("SOCKS5: invalid port %#v", portStr)
+	}
+
+	b := make([]byte, 0, 6+len(host))
+
+	b = append(b, socks5Version)
+	if username == "" {
+		b = append(b, 1, socks5AuthNone)
+	} else {
+		b = append(b, 2, socks5AuthNone, socks5AuthPassword)
+	}
+
+	if _, err = conn.Write(b); err != nil {
+		return err
+	}
+
+	if _, err = io.ReadFull(conn, b[:2]); err != nil {
+		return err
+	}
+	if b[0] != socks5Version {
+		return fmt.Errorf("SOCKS5: unexpected protocol version %d", b[0])
+	}
+
+	switch b[1] {
+	case socks5AuthNone:
+		break
+	case socks5AuthPassword:
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("SOCKS5: username or password too long")
+		}
+		b = b[:0]
+		b = append(b, 1, byte(len(username)))
+		b = append(b, username...)
+		b = append(b, byte(len(password)))
+		b = append(b, password...)
+		if _, err = conn.Write(b); err != nil {
+			return err
+		}
+		if _, err = io.ReadFull(conn, b[:2]); err != nil {
+			return err
+		}
+		if b[1] != 0 {
+			return errors.New("SOCKS5: username/password authentication failed")
+		}
+	case socks5AuthNoAccept:
+		return errors.New("SOCKS5: no acceptable authentication methods")
+	default:
+		return fmt.Errorf("SOCKS5: unsupported authentication method %d", b[1])
+	}
+
+	b = b[:0]
+	b = append(b, socks5Version, socks5CmdConnect, 0)
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, socks5AtypIPv4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, socks5AtypIPv6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return fmt.Errorf("SOCKS5: host name %#v too long", host)
+		}
+		b = append(b, socks5AtypDomain, byte(len(host)))
+		b = append(b, host...)
+	}
+	b = append(b, byte(port>>8), byte(port))
+
+	if _, err = conn.Write(b); err != nil {
+		return err
+	}
+
+	if _, err = io.ReadFull(conn, b[:4]); err != nil {
+		return err
+	}
+	if b[0] != socks5Version {
+		return fmt.Errorf("SOCKS5: unexpected protocol version %d", b[0])
+	}
+	if rep := int(b[1]); rep != 0 {
+		if rep < len(socks5Errors) {
+			return fmt.Errorf("SOCKS5: connect %#v failed: %s", address, socks5Errors[rep])
+		}
+		return fmt.Errorf("SOCKS5: connect %#v failed: unknown error %d", address, rep)
+	}
+
+	var n int
+	switch b[3] {
+	case socks5AtypIPv4:
+		n = net.IPv4len
+	case socks5AtypIPv6:
+		n = net.IPv6len
+	case socks5AtypDomain:
+		if _, err = io.ReadFull(conn, b[:1]); err != nil {
+			return err
+		}
+		n = int(b[0])
+	default:
+		return fmt.Errorf("SOCKS5: unknown address type %d", b[3])
+	}
+
+	// discard BND.ADDR and BND.PORT
+	if cap(b) < n+2 {
+		b = make([]byte, n+2)
+	}
+	if _, err = io.ReadFull(conn, b[:n+2]); err != nil {
+		return err
+	}
+	glog.V(3).Infof("SOCKS5 %#v bound to port %d", address, binary.BigEndian.Uint16(b[n:n+2]))
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package dialer
+
+import (
+	"net"
+	"time"
+)
+
+// helloSplitConn sends its first write, which is the ClientHello of a TLS
+// client, in two writes, and so in two TCP segments as long as TCP_NODELAY
+// is on. The later writes pass through.
+type helloSplitConn struct {
+	net.Conn
+	first int
+	delay time.Duration
+	done  bool
+}
+
+// splitHello wraps conn if SocketOptions.SplitClientHello is set for alias.
+func (d *MultiDialer) splitHello(conn net.Conn, alias string) net.Conn {
+	o, ok := d.socketOptions(alias)
+	if !ok || o.SplitClientHello <= 0 {
+		return conn
+	}
+
+	return &helloSplitConn{
+		Conn:  conn,
+		first: o.SplitClientHello,
+		delay: time.Duration(o.SplitDelay) * time.Millisecond,
+	}
+}
+
+func (c *helloSplitConn) Write(b []byte) (int, error) {
+	if c.done || len(b) <= c.first {
+		c.done = true
+		return c.Conn.Write(b)
+	}
+	c.done = true
+
+	n, err := c.Conn.Write(b[:c.first])
+	if err != nil {
+		return n, err
+	}
+
+	if c.delay > 0 {
+		time.Sleep(c.delay)
+	}
+
+	m, err := c.Conn.Write(b[c.first:])
+	return n + m, err
+}
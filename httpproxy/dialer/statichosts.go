@@ -0,0 +1,172 @@
+package dialer
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"../helpers"
+)
+
+// SetStaticHosts swaps the resolutions which are used instead of DNS, e.g.
+// "*.googlevideo.com": ["google_hk"] or "www.example.com": ["192.0.2.1"]. A
+// value is an ip, or an alias whose ips are used.
+func (d *MultiDialer) SetStaticHosts(hosts map[string][]string) error {
+	values := make(map[string]interface{}, len(hosts))
+	for host, names := range hosts {
+		if len(names) == 0 {
+			return fmt.Errorf("StaticHosts[%#v] is empty", host)
+		}
+		values[host] = names
+	}
+
+	d.muConfig.Lock()
+	defer d.muConfig.Unlock()
+	d.StaticHosts = helpers.NewHostMatcherWithValue(values)
+
+	return nil
+}
+
+// lookupStatic returns the ips of the StaticHosts entry of name. The ips of
+// an alias are its literal ips and the DNS answers of its names, StaticHosts
+// is not consulted again for them.
+func (d *MultiDialer) lookupStatic(name string) ([]string, bool) {
+	d.muConfig.RLock()
+	hosts := d.StaticHosts
+	d.muConfig.RUnlock()
+
+	if hosts == nil {
+		return nil, false
+	}
+	v, ok := hosts.Lookup(name)
+	if !ok {
+		return nil, false
+	}
+
+	addrs := make([]string, 0)
+	for _, s := range v.([]string) {
+		if ip := NormalizeIP(s); net.ParseIP(ip) != nil {
+			addrs = append(addrs, ip)
+			continue
+		}
+
+		names, ok := d.hostNames(s)
+		if !ok {
+			helpers.DefaultLogger.Warning("StaticHosts alias not exists", helpers.F("name", name), helpers.F("alias", s))
+			continue
+		}
+		servers := d.aliasDNSServers(s)
+		addrs1 := make([]string, 0)
+		for _, name1 := range names {
+			if ip := NormalizeIP(name1); net.ParseIP(ip) != nil {
+				addrs1 = append(addrs1, ip)
+			} else if addrs2, err := d.lookupNameDNS(name1, servers); err == nil {
+				addrs1 = append(addrs1, addrs2...)
+			}
+		}
+		if ipnets, ok := d.ipWhiteList(s); ok {
+			addrs1 = filterIPNets(addrs1, ipnets)
+		}
+		addrs = append(addrs, addrs1...)
+	}
+
+	addrs1 := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		if !d.IsBlackListed(addr) {
+			addrs1 = append(addrs1, addr)
+		}
+	}
+
+	return addrs1, true
+}
+
+// dialStatic dials the StaticHosts ips of the host of address, config nil
+// dials plain TCP.
+func (d *MultiDialer) dialStatic(ctx context.Context, network, address string, config *tls.Config) (net.Conn, bool, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, false, nil
+	}
+
+	ips, ok := d.lookupStatic(host)
+	if !ok {
+		return nil, false, nil
+	}
+	if len(ips) == 0 {
+		return nil, true, helpers.NewError(helpers.ErrAllAddrsBad, fmt.Sprintf("MULTIDIALER StaticHosts(%#v)", host), nil)
+	}
+
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip, port)
+	}
+	network = d.dialNetwork(network)
+
+	if config == nil {
+		conn, err := d.dialMulti(ctx, network, addrs, "")
+		return conn, true, err
+	}
+
+	config = config.Clone()
+	if name, ok := d.serverNameOf(host); ok {
+		setServerName(config, name)
+	} else if config.ServerName == "" {
+		config.ServerName = host
+	}
+	config.KeyLogWriter = helpers.KeyLog
+	config = d.withClientCertificate(config, host)
+
+	conn, err := d.dialMultiTLS(ctx, network, addrs, config, "")
+	return conn, true, err
+}
+
+// ReadHostsFile reads a file in the format of /etc/hosts, an ip followed by
+// its names, which may be wildcards like "*.googlevideo.com".
+func ReadHostsFile(filename string) (map[string][]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hosts, err := ParseHosts(f)
+	if err != nil {
+		return nil, fmt.Errorf("%#v: %v", filename, err)
+	}
+	return hosts, nil
+}
+
+func ParseHosts(r io.Reader) (map[string][]string, error) {
+	hosts := make(map[string][]string)
+
+	scanner := bufio.NewScanner(r)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		s := scanner.Text()
+		if i := strings.Index(s, "#"); i >= 0 {
+			s = s[:i]
+		}
+
+		fields := strings.Fields(s)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: no name for %#v", lineno, fields[0])
+		}
+
+		ip := NormalizeIP(fields[0])
+		if net.ParseIP(ip) == nil {
+			return nil, fmt.Errorf("line %d: invalid ip %#v", lineno, fields[0])
+		}
+		for _, name := range fields[1:] {
+			hosts[strings.ToLower(name)] = append(hosts[strings.ToLower(name)], ip)
+		}
+	}
+
+	return hosts, scanner.Err()
+}
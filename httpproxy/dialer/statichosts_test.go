@@ -0,0 +1,84 @@
+package dialer
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"../helpers"
+)
+
+func TestStaticHostsIPWhiteList(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen error: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+
+	d, err := NewMultiDialer("", nil, map[string][]string{"google_hk": {"127.0.0.1"}}, nil)
+	if err != nil {
+		t.Fatalf("NewMultiDialer error: %v", err)
+	}
+	err = d.SetStaticHosts(map[string][]string{
+		"ip.example.com":    {"127.0.0.1"},
+		"alias.example.com": {"google_hk"},
+	})
+	if err != nil {
+		t.Fatalf("SetStaticHosts error: %v", err)
+	}
+
+	whitelist := func(cidrs map[string][]string) map[string][]*net.IPNet {
+		m := make(map[string][]*net.IPNet)
+		for alias, s := range cidrs {
+			ipnets, err := helpers.ParseIPNets(s)
+			if err != nil {
+				t.Fatalf("helpers.ParseIPNets(%#v) error: %v", s, err)
+			}
+			m[alias] = ipnets
+		}
+		return m
+	}
+
+	cases := []struct {
+		host      string
+		whitelist map[string][]string
+		ok        bool
+	}{
+		{"ip.example.com", nil, true},
+		{"ip.example.com", map[string][]string{"*": {"127.0.0.0/8"}}, true},
+		{"ip.example.com", map[string][]string{"*": {"192.0.2.0/24"}}, false},
+		{"alias.example.com", map[string][]string{"google_hk": {"127.0.0.1"}}, true},
+		{"alias.example.com", map[string][]string{"google_hk": {"192.0.2.0/24"}}, false},
+		{"alias.example.com", map[string][]string{"*": {"192.0.2.0/24"}}, false},
+	}
+
+	for _, c := range cases {
+		d.IPWhiteList = whitelist(c.whitelist)
+		conn, err := d.Dial("tcp", net.JoinHostPort(c.host, port))
+		if conn != nil {
+			conn.Close()
+		}
+		if c.ok && err != nil {
+			t.Errorf("Dial(%#v) with IPWhiteList %v error: %v", c.host, c.whitelist, err)
+		}
+		if !c.ok && err == nil {
+			t.Errorf("Dial(%#v) with IPWhiteList %v should fail", c.host, c.whitelist)
+		}
+	}
+
+	// the ips of the race are checked again right before they connect
+	d.IPWhiteList = whitelist(map[string][]string{"*": {"192.0.2.0/24"}})
+	if _, err := d.dialMulti(context.Background(), "tcp", []string{ln.Addr().String()}, ""); err == nil || !helpers.IsError(err, helpers.ErrDialFailure) {
+		t.Errorf("dialMulti(%s) outside of IPWhiteList should fail with ErrDialFailure, got %v", ln.Addr(), err)
+	}
+}
@@ -0,0 +1,183 @@
+package dialer
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+)
+
+const (
+	// a connection must carry this much in its first window to count as a
+	// bulk transfer, below it a slow second window means nothing.
+	throttleMinBytes int64 = 256 * 1024
+	// a throttled connection keeps trickling, an idle one does not.
+	throttleMinReads int = 16
+	// the second window rate must drop below 1/throttleRatio of the first.
+	throttleRatio int64 = 10
+)
+
+// throttleConn watches the read throughput of a connection which has
+// completed its handshake. Some networks let the handshake and the first
+// seconds through at full speed and then collapse the throughput of the flow,
+// so the rate of the first window is compared with the one of the second.
+// Only the time spent blocked in Read counts for the second window, an idle
+// connection is not throttled.
+type throttleConn struct {
+	net.Conn
+	dialer *MultiDialer
+	ip     string
+	window time.Duration
+
+	mu        sync.Mutex
+	start     time.Time
+	early     int64
+	late      int64
+	lateReads int
+	lateWait  time.Duration
+	checked   bool
+}
+
+// begin starts the first window, reads before it are not accounted.
+func (c *throttleConn) begin() {
+	c.mu.Lock()
+	c.start = time.Now()
+	c.mu.Unlock()
+}
+
+func (c *throttleConn) Read(b []byte) (int, error) {
+	begin := time.Now()
+	n, err := c.Conn.Read(b)
+	c.account(begin, time.Now(), n)
+	return n, err
+}
+
+func (c *throttleConn) Close() error {
+	c.mu.Lock()
+	c.check(time.Now())
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+func (c *throttleConn) account(begin, end time.Time, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.start.IsZero() || c.checked {
+		return
+	}
+
+	mid := c.start.Add(c.window)
+	switch {
+	case end.Before(mid):
+		c.early += int64(n)
+	case end.Before(mid.Add(c.window)):
+		if begin.Before(mid) {
+			begin = mid
+		}
+		c.late += int64(n)
+		c.lateReads++
+		c.lateWait += end.Sub(begin)
+	default:
+		c.check(end)
+	}
+}
+
+func (c *throttleConn) check(now time.Time) {
+	if c.start.IsZero() || c.checked {
+		return
+	}
+
+	elapsed := now.Sub(c.start) - c.window
+	if elapsed < c.window/2 {
+		return
+	}
+	if elapsed > c.window {
+		elapsed = c.window
+	}
+	c.checked = true
+
+	if c.early < throttleMinBytes || c.lateReads < throttleMinReads || c.lateWait < elapsed/2 {
+		return
+	}
+
+	earlyRate := c.early * int64(time.Second) / int64(c.window)
+	lateRate := c.late * int64(time.Second) / int64(elapsed)
+	if lateRate*throttleRatio >= earlyRate {
+		return
+	}
+
+	glog.Warningf("MULTIDIALER: %s looks throttled, throughput %d B/s drops to %d B/s after %s", c.ip, earlyRate, lateRate, c.window)
+	c.dialer.ThrottleIP(c.ip)
+}
+
+// ThrottleIP marks ip as throttled for ConnExpiry, it is kept for small
+// requests and avoided for bulk transfers.
+func (d *MultiDialer) ThrottleIP(ip string) {
+	if d.ThrottledIPs == nil {
+		return
+	}
+	d.ThrottledIPs.Set(NormalizeIP(ip), struct{}{}, time.Now().Add(d.ConnExpiry))
+	if d.Metrics != nil {
+		d.Metrics.IncCounter("goproxy_throttled_ips_total")
+	}
+}
+
+func (d *MultiDialer) IsThrottled(ip string) bool {
+	if d.ThrottledIPs == nil {
+		return false
+	}
+	_, ok := d.ThrottledIPs.GetQuiet(NormalizeIP(ip))
+	return ok
+}
+
+// filterThrottled keeps the throttled addrs for small requests and the other
+// ones for bulk transfers, addrs is returned as is if either side is empty.
+func (d *MultiDialer) filterThrottled(addrs []string, small bool) []string {
+	if d.ThrottledIPs == nil || d.ThrottledIPs.Len() == 0 {
+		return addrs
+	}
+
+	throttled := make([]string, 0)
+	healthy := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		if d.IsThrottled(host) {
+			throttled = append(throttled, addr)
+		} else {
+			healthy = append(healthy, addr)
+		}
+	}
+
+	switch {
+	case small && len(throttled) > 0:
+		return throttled
+	case !small && len(healthy) > 0:
+		return healthy
+	default:
+		return addrs
+	}
+}
+
+// watchThrottle wraps conn to addr if throttle detection is enabled.
+func (d *MultiDialer) watchThrottle(conn net.Conn, addr string) net.Conn {
+	if d.ThrottledIPs == nil || d.ThrottleWindow <= 0 {
+		return conn
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	return &throttleConn{
+		Conn:   conn,
+		dialer: d,
+		ip:     host,
+		window: d.ThrottleWindow,
+	}
+}
@@ -0,0 +1,84 @@
+package dialer
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/cloudflare/golibs/lrucache"
+	"github.com/phuslu/glog"
+
+	"../helpers"
+)
+
+// SetAliasTiers swaps the tiered aliases, e.g. "google_auto": ["google_hk",
+// "google_us", "google_cn"]. A site of a tiered alias is dialed through its
+// first tier which is not degraded, and through the next ones if that fails.
+// The tiers are aliases of HostMap.
+func (d *MultiDialer) SetAliasTiers(tiers map[string][]string) error {
+	for alias, names := range tiers {
+		if len(names) == 0 {
+			return fmt.Errorf("AliasTiers[%#v] is empty", alias)
+		}
+		for _, name := range names {
+			if _, ok := d.hostNames(name); !ok {
+				return fmt.Errorf("AliasTiers[%#v]: alias %#v not exists", alias, name)
+			}
+			if _, ok := tiers[name]; ok {
+				return fmt.Errorf("AliasTiers[%#v]: %#v is tiered too", alias, name)
+			}
+		}
+	}
+
+	d.muConfig.Lock()
+	defer d.muConfig.Unlock()
+	d.AliasTiers = tiers
+
+	return nil
+}
+
+func (d *MultiDialer) aliasTiers(alias string) []string {
+	d.muConfig.RLock()
+	defer d.muConfig.RUnlock()
+	return d.AliasTiers[alias]
+}
+
+// tierDegraded reports whether tier has no good ips left, or at least half
+// of its addrs on port, or on the one AliasPorts maps it to, have failed
+// within ConnExpiry.
+func (d *MultiDialer) tierDegraded(tier, port string, connError lrucache.Cache) bool {
+	port = d.aliasPort(tier, port)
+	hosts, err := d.LookupAlias(tier)
+	if err != nil {
+		return true
+	}
+
+	failed := 0
+	for _, host := range hosts {
+		if _, ok := connError.GetQuiet(net.JoinHostPort(host, port)); ok {
+			failed++
+		}
+	}
+	return failed*2 >= len(hosts)
+}
+
+// dialTiers dials the tiers of alias in order with dial. The degraded tiers
+// are skipped, except the last one which is the last resort.
+func (d *MultiDialer) dialTiers(alias string, tiers []string, port string, connError lrucache.Cache, dial func(tier string) (net.Conn, error)) (net.Conn, error) {
+	var err error
+	for i, tier := range tiers {
+		if i < len(tiers)-1 && d.tierDegraded(tier, port, connError) {
+			glog.V(2).Infof("MULTIDIALER: tier %#v of %#v is degraded, skip it", tier, alias)
+			continue
+		}
+
+		var conn net.Conn
+		if conn, err = dial(tier); err == nil {
+			return conn, nil
+		}
+		if i < len(tiers)-1 {
+			glog.Warningf("MULTIDIALER: tier %#v of %#v error: %v, fall back to the next tier", tier, alias, err)
+		}
+	}
+
+	return nil, helpers.NewError(helpers.ErrAllAddrsBad, fmt.Sprintf("MULTIDIALER AliasTiers(%#v)", alias), err).WithAddrs(alias, nil)
+}
@@ -0,0 +1,139 @@
+package dialer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../helpers"
+)
+
+const (
+	verdictExpiry      time.Duration = 24 * time.Hour
+	verdictErrorExpiry time.Duration = 5 * time.Minute
+	verifyTimeout      time.Duration = 5 * time.Second
+	// LookupAlias waits this long for the handshakes, the ones still going
+	// on count as unverified and cache their verdicts for the next lookup
+	verifyDeadline time.Duration = 8 * time.Second
+	// the handshakes of all the lookups in flight
+	verifyConcurrency int = 16
+)
+
+var verifySem = make(chan struct{}, verifyConcurrency)
+
+// verifyAddrs keeps the ips whose certificate is valid for one of names. The
+// verdicts are cached in IPVerdicts, so each ip is only handshaked once a day.
+func (d *MultiDialer) verifyAddrs(alias string, addrs []string, names []string) []string {
+	type verdict struct {
+		i  int
+		ok bool
+	}
+
+	verdicts := make([]bool, len(addrs))
+	results := make(chan verdict, len(addrs))
+	expired := make(chan struct{})
+	defer close(expired)
+
+	pending := 0
+	for i, addr := range addrs {
+		addr = NormalizeIP(addr)
+		if v, ok := d.IPVerdicts.GetNotStale(addr); ok {
+			verdicts[i] = v.(bool)
+			continue
+		}
+		pending++
+		go func(i int, addr string) {
+			select {
+			case verifySem <- struct{}{}:
+				defer func() { <-verifySem }()
+			case <-expired:
+				return
+			}
+			results <- verdict{i, d.verifyAddr(alias, addr, names)}
+		}(i, addr)
+	}
+
+	timer := time.NewTimer(verifyDeadline)
+	defer timer.Stop()
+
+wait:
+	for ; pending > 0; pending-- {
+		select {
+		case v := <-results:
+			verdicts[v.i] = v.ok
+		case <-timer.C:
+			glog.Warningf("MULTIDIALER: %d verifications for alias %#v not done in %s", pending, alias, verifyDeadline)
+			break wait
+		}
+	}
+
+	addrs1 := make([]string, 0, len(addrs))
+	for i, addr := range addrs {
+		if verdicts[i] {
+			addrs1 = append(addrs1, addr)
+		}
+	}
+
+	return addrs1
+}
+
+// verifyAddr handshakes addr and caches the verdict in IPVerdicts.
+func (d *MultiDialer) verifyAddr(alias, addr string, names []string) bool {
+	err := d.verifyIP(alias, addr, names)
+	if err == nil {
+		d.IPVerdicts.Set(addr, true, time.Now().Add(verdictExpiry))
+		return true
+	}
+
+	glog.Warningf("MULTIDIALER: verifyIP(%#v) for alias %#v error: %v", addr, alias, err)
+	if _, ok := err.(x509.HostnameError); ok {
+		d.IPVerdicts.Set(addr, false, time.Now().Add(verdictExpiry))
+	} else {
+		d.IPVerdicts.Set(addr, false, time.Now().Add(verdictErrorExpiry))
+	}
+	return false
+}
+
+func (d *MultiDialer) verifyIP(alias, ip string, names []string) error {
+	if len(names) == 0 {
+		return fmt.Errorf("no names to verify %#v", ip)
+	}
+
+	conn, err := tls.DialWithDialer(d.withWhiteList(alias, &net.Dialer{Timeout: verifyTimeout}), "tcp", net.JoinHostPort(ip, "443"), &tls.Config{
+		ServerName:         names[0],
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	certs := conn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return fmt.Errorf("%#v presents no certificate", ip)
+	}
+
+	opts := x509.VerifyOptions{
+		Intermediates: x509.NewCertPool(),
+		CurrentTime:   helpers.Now(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+
+	if _, err = certs[0].Verify(opts); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err = certs[0].VerifyHostname(name); err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,70 @@
+package dialer
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+)
+
+// WarmUp resolves every alias and races one handshake per alias, so the
+// DNSCache and TLSConnDuration are filled before the first request. It
+// blocks until all aliases are done.
+func (d *MultiDialer) WarmUp() {
+	d.muConfig.RLock()
+	aliases := make([]string, 0, len(d.HostMap))
+	for alias := range d.HostMap {
+		aliases = append(aliases, alias)
+	}
+	d.muConfig.RUnlock()
+
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for _, alias := range aliases {
+		wg.Add(1)
+		go func(alias string) {
+			defer wg.Done()
+			if err := d.warmUpAlias(alias); err != nil {
+				glog.Warningf("MULTIDIALER: warm up alias %#v error: %v", alias, err)
+			}
+		}(alias)
+	}
+	wg.Wait()
+
+	glog.Infof("MULTIDIALER: warmed up %d aliases in %s", len(aliases), time.Since(start))
+}
+
+func (d *MultiDialer) warmUpAlias(alias string) error {
+	hosts, err := d.LookupAlias(alias)
+	if err != nil {
+		return err
+	}
+
+	var host string
+	names, _ := d.hostNames(alias)
+	for _, name := range names {
+		if net.ParseIP(name) == nil {
+			host = name
+			break
+		}
+	}
+	config := d.tlsConfigForAlias(alias, host, nil)
+	if err := d.setECH(alias, config); err != nil {
+		return err
+	}
+
+	addrs := make([]string, len(hosts))
+	for i, host := range hosts {
+		addrs[i] = net.JoinHostPort(host, "443")
+	}
+
+	conn, err := d.dialMultiTLS(context.Background(), d.dialNetwork("tcp"), addrs, config, alias)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
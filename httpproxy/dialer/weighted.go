@@ -0,0 +1,108 @@
+package dialer
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+const (
+	// race Level addrs and keep the first one which connects
+	DialRace string = "race"
+	// dial a single addr, picked with a chance of the inverse of its
+	// duration, which saves the SYNs and handshakes of the losers
+	DialWeighted string = "weighted"
+
+	// the chance of dialing an addr without history instead, so that the
+	// durations of the others are learned too
+	weightedExplore float64 = 0.1
+	// durations below it are taken as it, so that one lucky dial does not
+	// take all of the weight
+	weightedMinDuration time.Duration = 5 * time.Millisecond
+)
+
+// SetDialStrategies swaps the dial strategies by alias, "*" applies to the
+// other aliases and DialRace is the default.
+func (d *MultiDialer) SetDialStrategies(strategies map[string]string) error {
+	for alias, s := range strategies {
+		switch s {
+		case DialRace, DialWeighted:
+		default:
+			return fmt.Errorf("DialStrategies[%#v]: unknown strategy %#v, want %#v or %#v", alias, s, DialRace, DialWeighted)
+		}
+	}
+
+	d.muConfig.Lock()
+	defer d.muConfig.Unlock()
+	d.DialStrategies = strategies
+
+	return nil
+}
+
+func (d *MultiDialer) dialStrategy(alias string) string {
+	d.muConfig.RLock()
+	defer d.muConfig.RUnlock()
+
+	if s, ok := d.DialStrategies[alias]; ok {
+		return s
+	}
+	if s, ok := d.DialStrategies["*"]; ok {
+		return s
+	}
+	return DialRace
+}
+
+// pickupWeighted returns one of addrs for DialWeighted. The failed addrs are
+// only picked when all of them have failed.
+func pickupWeighted(addrs []string, connDuration lrucache.Cache, connError lrucache.Cache) []string {
+	if len(addrs) <= 1 {
+		return addrs
+	}
+
+	goodAddrs := make([]racer, 0)
+	unknownAddrs := make([]string, 0)
+	badAddrs := make([]string, 0)
+
+	for _, addr := range addrs {
+		if v, ok := connDuration.GetQuiet(addr); ok {
+			if d, ok := v.(time.Duration); ok {
+				goodAddrs = append(goodAddrs, racer{addr, d})
+				continue
+			}
+		}
+		if _, ok := connError.GetQuiet(addr); ok {
+			badAddrs = append(badAddrs, addr)
+		} else {
+			unknownAddrs = append(unknownAddrs, addr)
+		}
+	}
+
+	switch {
+	case len(unknownAddrs) > 0 && (len(goodAddrs) == 0 || rand.Float64() < weightedExplore):
+		return []string{unknownAddrs[rand.Intn(len(unknownAddrs))]}
+	case len(goodAddrs) == 0:
+		return []string{badAddrs[rand.Intn(len(badAddrs))]}
+	}
+
+	weights := make([]float64, len(goodAddrs))
+	total := 0.0
+	for i, r := range goodAddrs {
+		d := r.duration
+		if d < weightedMinDuration {
+			d = weightedMinDuration
+		}
+		weights[i] = 1 / d.Seconds()
+		total += weights[i]
+	}
+
+	x := rand.Float64() * total
+	for i, w := range weights {
+		if x < w {
+			return []string{goodAddrs[i].addr}
+		}
+		x -= w
+	}
+	return []string{goodAddrs[len(goodAddrs)-1].addr}
+}
@@ -0,0 +1,115 @@
+package httpproxy
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+	"github.com/phuslu/glog"
+
+	"./filters"
+)
+
+const (
+	DefaultFallbackMaxFailures int           = 3
+	DefaultFallbackCooldown    time.Duration = 5 * time.Minute
+)
+
+// FallbackChain moves a host off a RoundTripFilter which keeps failing it,
+// e.g. gae answering 403/503 for a site, to the next filters of the chain.
+// After MaxFailures errors or Statuses within Cooldown, the requests to the
+// host skip the filter until Cooldown passes.
+type FallbackChain struct {
+	Filters     []filters.RoundTripFilter
+	Statuses    map[int]bool
+	MaxFailures int
+	Cooldown    time.Duration
+
+	mu       sync.Mutex
+	failures lrucache.Cache
+	cooling  lrucache.Cache
+}
+
+func NewFallbackChain(fs []filters.RoundTripFilter, statuses []int, maxFailures int, cooldown time.Duration) *FallbackChain {
+	if maxFailures <= 0 {
+		maxFailures = DefaultFallbackMaxFailures
+	}
+	if cooldown <= 0 {
+		cooldown = DefaultFallbackCooldown
+	}
+
+	c := &FallbackChain{
+		Filters:     fs,
+		Statuses:    make(map[int]bool),
+		MaxFailures: maxFailures,
+		Cooldown:    cooldown,
+		failures:    lrucache.NewLRUCache(4096),
+		cooling:     lrucache.NewLRUCache(4096),
+	}
+	for _, code := range statuses {
+		c.Statuses[code] = true
+	}
+
+	return c
+}
+
+// Pick returns the first filter of f and the chain which is not cooling down
+// for host, or f if all of them are.
+func (c *FallbackChain) Pick(f filters.RoundTripFilter, host string) filters.RoundTripFilter {
+	if _, ok := c.cooling.GetQuiet(f.FilterName() + " " + host); !ok {
+		return f
+	}
+	if f1 := c.Next(f, host); f1 != nil {
+		return f1
+	}
+	return f
+}
+
+// Next returns the filter after f in the chain which is not cooling down for
+// host, or nil.
+func (c *FallbackChain) Next(f filters.RoundTripFilter, host string) filters.RoundTripFilter {
+	i := -1
+	for j, f1 := range c.Filters {
+		if f1 == f {
+			i = j
+			break
+		}
+	}
+	for _, f1 := range c.Filters[i+1:] {
+		if _, ok := c.cooling.GetQuiet(f1.FilterName() + " " + host); !ok {
+			return f1
+		}
+	}
+	return nil
+}
+
+// Failed counts a failure of f for host and reports whether the host starts
+// to cool down on f with it. A nil err and a resp of other status is not a
+// failure.
+func (c *FallbackChain) Failed(f filters.RoundTripFilter, host string, resp *http.Response, err error) bool {
+	if err == nil && (resp == nil || !c.Statuses[resp.StatusCode]) {
+		return false
+	}
+
+	key := f.FilterName() + " " + host
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 1
+	if v, ok := c.failures.GetQuiet(key); ok {
+		n += v.(int)
+	}
+
+	if n < c.MaxFailures {
+		c.failures.Set(key, n, time.Now().Add(c.Cooldown))
+		return false
+	}
+
+	c.failures.Del(key)
+	c.cooling.Set(key, true, time.Now().Add(c.Cooldown))
+	glog.Warningf("FALLBACK: %s failed %#v %d times, skip it for %s", f.FilterName(), host, n, c.Cooldown)
+
+	return true
+}
@@ -0,0 +1,1109 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+	"github.com/phuslu/glog"
+
+	"../../dialer"
+	"../../filters"
+	"../../helpers"
+	"../../storage"
+)
+
+const (
+	filterName string = "admin"
+
+	// TokenHeader carries the Token, or anything if there is none, in every
+	// request which changes something.
+	TokenHeader string = "X-Goproxy-Admin"
+)
+
+type Config struct {
+	Path       string
+	Dashboard  string
+	WhiteList  []string
+	Hosts      []string
+	Token      string
+	KeyLogFile string
+}
+
+type Filter struct {
+	Config
+	Path      string
+	Dashboard []byte
+	WhiteList map[string]struct{}
+	Hosts     map[string]struct{}
+}
+
+type multiDialerFilter interface {
+	MultiDialer() *dialer.MultiDialer
+}
+
+type quotaFilter interface {
+	QuotaUsage() (interface{}, bool)
+	ResetQuota(host string) bool
+}
+
+type guestFilter interface {
+	IssueGuest(profile string, ttl time.Duration) (interface{}, error)
+	Guests() (interface{}, bool)
+	RevokeGuest(id string) bool
+}
+
+func init() {
+	filename := filterName + ".json"
+	config := new(Config)
+	err := storage.ReadJsonConfig(storage.LookupConfigStoreURI(filterName), filename, config)
+	if err != nil {
+		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	err = filters.Register(filterName, &filters.RegisteredFilter{
+		New: func() (filters.Filter, error) {
+			return NewFilter(config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	f := &Filter{
+		Config:    *config,
+		Path:      config.Path,
+		WhiteList: make(map[string]struct{}),
+		Hosts:     make(map[string]struct{}),
+	}
+
+	if !strings.HasSuffix(f.Path, "/") {
+		f.Path += "/"
+	}
+
+	for _, ip := range config.WhiteList {
+		f.WhiteList[ip] = struct{}{}
+	}
+
+	if config.KeyLogFile != "" {
+		helpers.KeyLog.SetFilename(config.KeyLogFile)
+	}
+
+	for _, host := range config.Hosts {
+		f.Hosts[strings.ToLower(strings.Trim(host, "[]"))] = struct{}{}
+	}
+
+	if config.Dashboard != "" {
+		f.Dashboard = renderDashboard(f.Path, config.Token)
+	}
+
+	return f, nil
+}
+
+func (f *Filter) FilterName() string {
+	return filterName
+}
+
+func (f *Filter) Route(req *http.Request) (string, bool) {
+	isDashboard := f.Config.Dashboard != "" && strings.SplitN(req.RequestURI, "?", 2)[0] == f.Config.Dashboard
+	return filterName, isDashboard || strings.HasPrefix(req.RequestURI, f.Path)
+}
+
+func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	isDashboard := f.Config.Dashboard != "" && strings.SplitN(req.RequestURI, "?", 2)[0] == f.Config.Dashboard
+	if !isDashboard && !strings.HasPrefix(req.RequestURI, f.Path) {
+		return ctx, nil, nil
+	}
+
+	// the peers of a unix socket have no ip, they are "unix" in WhiteList
+	peer := "unix"
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		peer = ip
+	}
+	if _, ok := f.WhiteList[peer]; !ok {
+		glog.Warningf("%s \"ADMIN %s %s %s\" forbidden", filters.RemoteAddr(req), req.Method, req.RequestURI, req.Proto)
+		return ctx, jsonResponse(req, http.StatusForbidden, map[string]string{"error": "forbidden"}), nil
+	}
+
+	if err := f.checkRequest(req); err != nil {
+		glog.Warningf("%s \"ADMIN %s %s %s\" forbidden: %v", filters.RemoteAddr(req), req.Method, req.RequestURI, req.Proto, err)
+		return ctx, jsonError(req, http.StatusForbidden, err), nil
+	}
+
+	if filters.ReadOnly() && req.Method != http.MethodGet && req.Method != http.MethodHead {
+		glog.Warningf("%s \"ADMIN %s %s %s\" forbidden in read-only mode", filters.RemoteAddr(req), req.Method, req.RequestURI, req.Proto)
+		return ctx, jsonError(req, http.StatusForbidden, fmt.Errorf("read-only mode")), nil
+	}
+
+	var resp *http.Response
+	if isDashboard {
+		resp = htmlResponse(req, http.StatusOK, f.Dashboard)
+	} else {
+		resp = f.serve(req)
+	}
+
+	glog.V(2).Infof("%s \"ADMIN %s %s %s\" %d %s", filters.RemoteAddr(req), req.Method, req.RequestURI, req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
+
+	return ctx, resp, nil
+}
+
+// checkRequest stops the web pages in the browser of a whitelisted user from
+// using the api. A page of another site may send simple requests to it, and
+// read the answers after rebinding its name to 127.0.0.1, so the Host must be
+// an admin address, the Origin the api itself, and the requests which change
+// anything must carry the Token in a header no page can set without a CORS
+// preflight, which is never granted.
+func (f *Filter) checkRequest(req *http.Request) error {
+	if !f.isAdminHost(req.Host) {
+		return fmt.Errorf("host %#v is not an admin address", req.Host)
+	}
+
+	if origin := req.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || !strings.EqualFold(u.Host, req.Host) {
+			return fmt.Errorf("cross-origin request from %#v", origin)
+		}
+	}
+
+	if req.Method == http.MethodGet || req.Method == http.MethodHead {
+		return nil
+	}
+
+	token := req.Header.Get(TokenHeader)
+	switch {
+	case token == "":
+		return fmt.Errorf("missing %s header", TokenHeader)
+	case f.Config.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(f.Config.Token)) != 1:
+		return fmt.Errorf("wrong %s header", TokenHeader)
+	}
+
+	return nil
+}
+
+// isAdminHost reports whether host, the Host of a request, names the proxy
+// itself, i.e. it is one of Hosts, a loopback ip or the ip of a listener.
+func (f *Filter) isAdminHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+
+	if _, ok := f.Hosts[host]; ok {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	if ip.IsLoopback() {
+		return true
+	}
+	for _, ln := range helpers.Listeners() {
+		if addr, ok := ln.Addr().(*net.TCPAddr); ok && addr.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Filter) serve(req *http.Request) *http.Response {
+	parts := strings.SplitN(strings.Trim(strings.TrimPrefix(req.URL.Path, f.Path), "/"), "/", 2)
+	if len(parts) != 2 {
+		return jsonError(req, http.StatusNotFound, fmt.Errorf("unknown api %#v", req.URL.Path))
+	}
+
+	switch parts[0] {
+	case "listener":
+		return serveListener(req, parts[1])
+	case "system":
+		return serveSystem(req, parts[1])
+	}
+
+	f1, ok := filters.LookupFilter(parts[0])
+	if !ok {
+		return jsonError(req, http.StatusNotFound, fmt.Errorf("filter %#v not exists", parts[0]))
+	}
+
+	if parts[1] == "quota" {
+		return serveQuota(req, f1, parts[0])
+	}
+
+	if parts[1] == "guests" {
+		return serveGuests(req, f1, parts[0])
+	}
+
+	f2, ok := f1.(multiDialerFilter)
+	if !ok || f2.MultiDialer() == nil {
+		return jsonError(req, http.StatusNotFound, fmt.Errorf("filter %#v has no MultiDialer", parts[0]))
+	}
+
+	d := f2.MultiDialer()
+	query := req.URL.Query()
+
+	switch parts[1] {
+	case "scores":
+		if req.Method != http.MethodGet {
+			break
+		}
+		scores := d.ScoreReport()
+		if alias := query.Get("alias"); alias != "" {
+			scores1 := scores[:0]
+			for _, s := range scores {
+				if s.Alias == alias {
+					scores1 = append(scores1, s)
+				}
+			}
+			scores = scores1
+		}
+		if err := dialer.SortAddrScores(scores, query.Get("sort")); err != nil {
+			return jsonError(req, http.StatusBadRequest, err)
+		}
+		if query.Get("format") == "text" {
+			var b bytes.Buffer
+			dialer.WriteAddrScores(&b, scores)
+			return textResponse(req, http.StatusOK, b.Bytes())
+		}
+		return jsonResponse(req, http.StatusOK, scores)
+	case "benchmark":
+		if req.Method != http.MethodPost {
+			break
+		}
+		b := &dialer.AliasBenchmark{
+			MultiDialer: d,
+			Alias:       query.Get("alias"),
+			Host:        query.Get("host"),
+			Path:        query.Get("path"),
+		}
+		if b.Alias == "" {
+			return jsonError(req, http.StatusBadRequest, fmt.Errorf("alias is required"))
+		}
+		if s := query.Get("c"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return jsonError(req, http.StatusBadRequest, err)
+			}
+			b.Concurrency = n
+		}
+		if s := query.Get("timeout"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return jsonError(req, http.StatusBadRequest, err)
+			}
+			b.Timeout = time.Duration(n) * time.Second
+		}
+		results, err := b.Run()
+		if err != nil {
+			return jsonError(req, http.StatusBadGateway, err)
+		}
+		glog.Infof("%s \"ADMIN benchmark %s\" %d addrs", filters.RemoteAddr(req), b.Alias, len(results))
+		if query.Get("format") == "text" {
+			var buf bytes.Buffer
+			dialer.WriteAddrBenchmarks(&buf, results)
+			return textResponse(req, http.StatusOK, buf.Bytes())
+		}
+		return jsonResponse(req, http.StatusOK, results)
+	case "dnscache":
+		if req.Method != http.MethodGet {
+			break
+		}
+		return jsonResponse(req, http.StatusOK, dumpCache(d.DNSCache, nil))
+	case "levels":
+		if req.Method != http.MethodGet {
+			break
+		}
+		return jsonResponse(req, http.StatusOK, d.DialLevels())
+	case "dnsservers":
+		if req.Method != http.MethodGet {
+			break
+		}
+		return jsonResponse(req, http.StatusOK, d.DNSServerStats())
+	case "dialstats":
+		if req.Method != http.MethodGet {
+			break
+		}
+		m, ok := d.Metrics.(*helpers.Metrics)
+		if !ok {
+			return jsonError(req, http.StatusNotFound, fmt.Errorf("filter %#v has no dial metrics", parts[0]))
+		}
+		return jsonResponse(req, http.StatusOK, dialStats(m))
+	case "conn":
+		if req.Method != http.MethodGet {
+			break
+		}
+		ipnet, err := parseCIDRQuery(query)
+		if err != nil {
+			return jsonError(req, http.StatusBadRequest, err)
+		}
+		format := func(c lrucache.Cache) map[string]interface{} {
+			m := dumpCache(c, formatValue)
+			for addr := range m {
+				if ipnet != nil && !dialer.AddrInNet(addr, ipnet) {
+					delete(m, addr)
+				}
+			}
+			return m
+		}
+		m := map[string]interface{}{
+			"TCPConnDuration": format(d.TCPConnDuration),
+			"TCPConnError":    format(d.TCPConnError),
+			"TLSConnDuration": format(d.TLSConnDuration),
+			"TLSConnError":    format(d.TLSConnError),
+		}
+		// only the dialers of gae race QUIC handshakes
+		if d.QUICConnDuration != nil && d.QUICConnError != nil {
+			m["QUICConnDuration"] = format(d.QUICConnDuration)
+			m["QUICConnError"] = format(d.QUICConnError)
+		}
+		return jsonResponse(req, http.StatusOK, m)
+	case "blacklist":
+		ipnet, err := parseCIDRQuery(query)
+		if err != nil {
+			return jsonError(req, http.StatusBadRequest, err)
+		}
+		switch req.Method {
+		case http.MethodGet:
+			return jsonResponse(req, http.StatusOK, dumpBlackList(d, ipnet))
+		case http.MethodDelete:
+			if ipnet != nil {
+				n := d.UnBlackListIn(ipnet)
+				glog.Infof("ADMIN %s %s IPBlackList %s, %d ips removed", req.Method, parts[0], ipnet, n)
+				return jsonResponse(req, http.StatusOK, map[string]interface{}{"cidr": ipnet.String(), "removed": n})
+			}
+			fallthrough
+		case http.MethodPost:
+			ip := dialer.NormalizeIP(query.Get("ip"))
+			if net.ParseIP(ip) == nil {
+				return jsonError(req, http.StatusBadRequest, fmt.Errorf("invalid ip %#v", query.Get("ip")))
+			}
+			if req.Method == http.MethodPost {
+				ttl, err := parseTTL(query.Get("ttl"))
+				if err != nil {
+					return jsonError(req, http.StatusBadRequest, err)
+				}
+				d.BlackListIP(ip, ttl)
+			} else {
+				d.UnBlackListIP(ip)
+			}
+			glog.Infof("ADMIN %s %s IPBlackList %s", req.Method, parts[0], ip)
+			return jsonResponse(req, http.StatusOK, map[string]string{"ip": ip})
+		}
+	case "blacklist/why":
+		if req.Method != http.MethodGet {
+			break
+		}
+		ip := dialer.NormalizeIP(query.Get("ip"))
+		if net.ParseIP(ip) == nil {
+			return jsonError(req, http.StatusBadRequest, fmt.Errorf("invalid ip %#v", query.Get("ip")))
+		}
+		reason, ok := d.BlackListReason(ip)
+		return jsonResponse(req, http.StatusOK, map[string]interface{}{
+			"ip":          ip,
+			"blacklisted": ok,
+			"reason":      reason,
+		})
+	case "blacklist/reload":
+		if req.Method != http.MethodPost {
+			break
+		}
+		if d.BlackList == nil {
+			return jsonError(req, http.StatusNotFound, fmt.Errorf("filter %#v has no blacklist sources", parts[0]))
+		}
+		go d.BlackList.Reload()
+		return jsonResponse(req, http.StatusAccepted, map[string]string{})
+	case "blacklist/learned":
+		if req.Method != http.MethodGet {
+			break
+		}
+		if d.CertLearner == nil {
+			return jsonError(req, http.StatusNotFound, fmt.Errorf("filter %#v has no cert learning", parts[0]))
+		}
+		learned := d.CertLearner.Learned()
+		if query.Get("format") == "text" {
+			var b bytes.Buffer
+			for _, ip := range learned {
+				fmt.Fprintf(&b, "%s # %s sha256=%s %s\n", ip.IP, ip.Alias, ip.Fingerprint, ip.Expires.Format(time.RFC3339))
+			}
+			return textResponse(req, http.StatusOK, b.Bytes())
+		}
+		return jsonResponse(req, http.StatusOK, learned)
+	case "blacklist/import":
+		if req.Method != http.MethodPost {
+			break
+		}
+		ttl, err := parseTTL(query.Get("ttl"))
+		if err != nil {
+			return jsonError(req, http.StatusBadRequest, err)
+		}
+		ips, err := readIPs(req.Body)
+		if err != nil {
+			return jsonError(req, http.StatusBadRequest, err)
+		}
+		for _, ip := range ips {
+			d.BlackListIP(ip, ttl)
+		}
+		glog.Infof("ADMIN %s %s IPBlackList import %d ips", req.Method, parts[0], len(ips))
+		return jsonResponse(req, http.StatusOK, map[string]int{"imported": len(ips)})
+	case "clearcache":
+		if req.Method != http.MethodPost {
+			break
+		}
+		d.ClearCache()
+		glog.Infof("ADMIN %s ClearCache()", parts[0])
+		return jsonResponse(req, http.StatusOK, map[string]string{})
+	case "fakeservernames":
+		switch req.Method {
+		case http.MethodGet:
+			names, aliases := d.FakeServerNamesOf()
+			return jsonResponse(req, http.StatusOK, map[string]interface{}{
+				"FakeServerNames": names,
+				"Aliases":         aliases,
+			})
+		case http.MethodPost:
+			names := make([]string, 0)
+			for _, name := range strings.Split(query.Get("names"), ",") {
+				if name = strings.TrimSpace(name); name != "" {
+					names = append(names, name)
+				}
+			}
+			alias := query.Get("alias")
+			switch {
+			case alias != "":
+				if !d.HasAlias(alias) {
+					return jsonError(req, http.StatusBadRequest, fmt.Errorf("alias %#v not exists", alias))
+				}
+				d.SetAliasFakeServerNames(alias, names)
+			case len(names) == 0:
+				return jsonError(req, http.StatusBadRequest, fmt.Errorf("empty names"))
+			default:
+				d.SetFakeServerNames(names)
+			}
+			glog.Infof("ADMIN %s SetFakeServerNames(%#v, %#v)", parts[0], alias, names)
+			return jsonResponse(req, http.StatusOK, map[string]interface{}{"alias": alias, "names": names})
+		}
+	case "expandalias":
+		if req.Method != http.MethodPost {
+			break
+		}
+		alias := query.Get("alias")
+		if !d.HasAlias(alias) {
+			return jsonError(req, http.StatusBadRequest, fmt.Errorf("alias %#v not exists", alias))
+		}
+		go func() {
+			if err := d.ExpandAlias(alias); err != nil {
+				glog.Warningf("ADMIN %s ExpandAlias(%#v) error: %v", parts[0], alias, err)
+			}
+		}()
+		return jsonResponse(req, http.StatusAccepted, map[string]string{"alias": alias})
+	default:
+		return jsonError(req, http.StatusNotFound, fmt.Errorf("unknown api %#v", req.URL.Path))
+	}
+
+	return jsonError(req, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed for %#v", req.Method, req.URL.Path))
+}
+
+// serveQuota serves the fetch server quotas of filter, GET lists them and
+// DELETE clears the one of ?host=, or all of them.
+func serveQuota(req *http.Request, f filters.Filter, name string) *http.Response {
+	q, ok := f.(quotaFilter)
+	if !ok {
+		return jsonError(req, http.StatusNotFound, fmt.Errorf("filter %#v has no quota", name))
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		usage, ok := q.QuotaUsage()
+		if !ok {
+			return jsonError(req, http.StatusNotFound, fmt.Errorf("filter %#v has no quota enabled", name))
+		}
+		return jsonResponse(req, http.StatusOK, usage)
+	case http.MethodDelete:
+		host := req.URL.Query().Get("host")
+		if !q.ResetQuota(host) {
+			return jsonError(req, http.StatusNotFound, fmt.Errorf("filter %#v has no quota enabled", name))
+		}
+		glog.Infof("ADMIN %s ResetQuota(%#v)", name, host)
+		return jsonResponse(req, http.StatusOK, map[string]string{"host": host})
+	}
+
+	return jsonError(req, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed for %#v", req.Method, req.URL.Path))
+}
+
+// serveGuests serves the guest credentials of filter, GET lists them, POST
+// issues one of ?profile= for ?ttl= seconds and DELETE revokes the one of ?id=.
+func serveGuests(req *http.Request, f filters.Filter, name string) *http.Response {
+	g, ok := f.(guestFilter)
+	if !ok {
+		return jsonError(req, http.StatusNotFound, fmt.Errorf("filter %#v has no guests", name))
+	}
+
+	query := req.URL.Query()
+
+	switch req.Method {
+	case http.MethodGet:
+		guests, ok := g.Guests()
+		if !ok {
+			return jsonError(req, http.StatusNotFound, fmt.Errorf("filter %#v has no guests enabled", name))
+		}
+		return jsonResponse(req, http.StatusOK, guests)
+	case http.MethodPost:
+		var ttl int
+		if s := query.Get("ttl"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 {
+				return jsonError(req, http.StatusBadRequest, fmt.Errorf("invalid ttl %#v", s))
+			}
+			ttl = n
+		}
+		guest, err := g.IssueGuest(query.Get("profile"), time.Duration(ttl)*time.Second)
+		if err != nil {
+			return jsonError(req, http.StatusBadRequest, err)
+		}
+		glog.Infof("ADMIN %s IssueGuest(%#v, %d)", name, query.Get("profile"), ttl)
+		return jsonResponse(req, http.StatusCreated, guest)
+	case http.MethodDelete:
+		id := query.Get("id")
+		if !g.RevokeGuest(id) {
+			return jsonError(req, http.StatusBadRequest, fmt.Errorf("%#v is not a guest id", id))
+		}
+		glog.Infof("ADMIN %s RevokeGuest(%#v)", name, id)
+		return jsonResponse(req, http.StatusOK, map[string]string{"id": id})
+	}
+
+	return jsonError(req, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed for %#v", req.Method, req.URL.Path))
+}
+
+func serveListener(req *http.Request, profile string) *http.Response {
+	ln, ok := helpers.LookupListener(profile)
+	if !ok {
+		return jsonError(req, http.StatusNotFound, fmt.Errorf("listener %#v not exists", profile))
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		addr := req.URL.Query().Get("addr")
+		if ln.Addr().Network() != "unix" {
+			if _, _, err := net.SplitHostPort(addr); err != nil {
+				return jsonError(req, http.StatusBadRequest, err)
+			}
+		}
+		if err := ln.Rebind("", addr); err != nil {
+			return jsonError(req, http.StatusInternalServerError, err)
+		}
+		glog.Infof("ADMIN: listener %#v rebound to %s", profile, ln.Addr())
+	default:
+		return jsonError(req, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+	}
+
+	return jsonResponse(req, http.StatusOK, map[string]interface{}{
+		"Address": ln.Addr().String(),
+		"Accept":  ln.AcceptStats(),
+	})
+}
+
+// cachesResponse is the budget of the caches and their stats.
+func cachesResponse() map[string]interface{} {
+	return map[string]interface{}{
+		"Budget": helpers.DefaultCacheManager.Budget(),
+		"Caches": helpers.DefaultCacheManager.Stats(),
+	}
+}
+
+func serveSystem(req *http.Request, resource string) *http.Response {
+	switch resource {
+	case "reload":
+		if req.Method != http.MethodPost {
+			break
+		}
+		if err := filters.ReloadFilters(); err != nil {
+			return jsonError(req, http.StatusInternalServerError, err)
+		}
+		glog.Infof("ADMIN ReloadFilters()")
+		return jsonResponse(req, http.StatusOK, map[string]string{})
+	case "conflicts":
+		if req.Method != http.MethodGet {
+			break
+		}
+		// our own listeners hold the configured ports, only probe the platform.
+		addrs := make([]string, 0)
+		for _, ln := range helpers.Listeners() {
+			addrs = append(addrs, ln.Addr().String())
+		}
+		return jsonResponse(req, http.StatusOK, helpers.DetectPlatformConflicts(addrs))
+	case "dialers":
+		if req.Method != http.MethodGet {
+			break
+		}
+		names := make([]string, 0)
+		for _, name := range filters.FilterNames() {
+			if f, ok := filters.LookupFilter(name); ok {
+				if f1, ok := f.(multiDialerFilter); ok && f1.MultiDialer() != nil {
+					names = append(names, name)
+				}
+			}
+		}
+		return jsonResponse(req, http.StatusOK, names)
+	case "tophosts":
+		if req.Method != http.MethodGet {
+			break
+		}
+		rows, err := topHosts(req.URL.Query())
+		if err != nil {
+			return jsonError(req, http.StatusBadRequest, err)
+		}
+		return jsonResponse(req, http.StatusOK, rows)
+	case "memory":
+		if req.Method != http.MethodGet {
+			break
+		}
+		return jsonResponse(req, http.StatusOK, helpers.MemoryUsages())
+	case "caches":
+		switch req.Method {
+		case http.MethodGet:
+			return jsonResponse(req, http.StatusOK, cachesResponse())
+		case http.MethodPost:
+			// ?budget=<MB> sizes all the caches, ?name=gae.DNSCache&capacity=<entries> pins one,
+			// capacity=0 gives it back to the budget
+			q := req.URL.Query()
+			if v := q.Get("budget"); v != "" {
+				mb, err := strconv.Atoi(v)
+				if err == nil {
+					err = helpers.DefaultCacheManager.SetBudget(int64(mb) << 20)
+				}
+				if err != nil {
+					return jsonError(req, http.StatusBadRequest, fmt.Errorf("budget %#v: %v", v, err))
+				}
+				glog.Infof("ADMIN: cache budget set to %d MB", mb)
+			}
+			if name := q.Get("name"); name != "" {
+				capacity, err := strconv.Atoi(q.Get("capacity"))
+				if err != nil {
+					return jsonError(req, http.StatusBadRequest, fmt.Errorf("capacity %#v: %v", q.Get("capacity"), err))
+				}
+				if err = helpers.DefaultCacheManager.Resize(name, capacity); err != nil {
+					return jsonError(req, http.StatusBadRequest, err)
+				}
+				glog.Infof("ADMIN: cache %#v resized to %d entries", name, capacity)
+			}
+			return jsonResponse(req, http.StatusOK, cachesResponse())
+		}
+	case "traffic":
+		if req.Method != http.MethodGet {
+			break
+		}
+		rows, err := queryTraffic(req.URL.Query())
+		if err != nil {
+			return jsonError(req, http.StatusBadRequest, err)
+		}
+		return jsonResponse(req, http.StatusOK, rows)
+	case "jobs":
+		switch req.Method {
+		case http.MethodGet:
+			return jsonResponse(req, http.StatusOK, helpers.DefaultScheduler.Jobs())
+		case http.MethodPost:
+			name := req.URL.Query().Get("name")
+			if err := helpers.DefaultScheduler.RunNow(name); err != nil {
+				return jsonError(req, http.StatusNotFound, err)
+			}
+			glog.Infof("ADMIN: job %#v triggered", name)
+			return jsonResponse(req, http.StatusOK, map[string]string{})
+		}
+	case "telemetry":
+		if req.Method != http.MethodGet {
+			break
+		}
+		return jsonResponse(req, http.StatusOK, helpers.LastTelemetryReports())
+	case "keylog":
+		// the secrets decrypt every capture of the proxy, never hand them out
+		// to a remote admin even if it is whitelisted
+		if ip, _, err := net.SplitHostPort(req.RemoteAddr); err != nil || !net.ParseIP(ip).IsLoopback() {
+			return jsonError(req, http.StatusForbidden, fmt.Errorf("%#v is only allowed from localhost", req.URL.Path))
+		}
+		// the file is configured, the api only turns it on and off
+		switch req.Method {
+		case http.MethodGet:
+		case http.MethodPost:
+			var err error
+			switch req.URL.Query().Get("enabled") {
+			case "true":
+				err = helpers.KeyLog.Enable()
+			case "false":
+				err = helpers.KeyLog.Disable()
+			default:
+				err = fmt.Errorf("enabled must be true or false")
+			}
+			if err != nil {
+				return jsonError(req, http.StatusBadRequest, err)
+			}
+		default:
+			return jsonError(req, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method))
+		}
+		return jsonResponse(req, http.StatusOK, map[string]interface{}{
+			"enabled":  helpers.KeyLog.Filename() != "",
+			"filename": helpers.KeyLog.ConfiguredFilename(),
+		})
+	case "panics":
+		switch req.Method {
+		case http.MethodGet:
+			panics := make(map[string][]helpers.PanicRecord)
+			for name, g := range helpers.PanicGuards() {
+				panics[name] = g.Records()
+			}
+			return jsonResponse(req, http.StatusOK, panics)
+		case http.MethodDelete:
+			// stop bypassing the filter, e.g. after its config is fixed and reloaded
+			filter := req.URL.Query().Get("filter")
+			for _, g := range helpers.PanicGuards() {
+				g.Reset(filter)
+			}
+			glog.Infof("ADMIN: panics of filter %#v reset", filter)
+			return jsonResponse(req, http.StatusOK, map[string]string{})
+		}
+	case "trace":
+		switch req.Method {
+		case http.MethodGet:
+			if id := req.URL.Query().Get("id"); id != "" {
+				trace, ok := helpers.Traces.Get(id)
+				if !ok {
+					return jsonError(req, http.StatusNotFound, fmt.Errorf("trace %#v not found", id))
+				}
+				return jsonResponse(req, http.StatusOK, trace)
+			}
+			return jsonResponse(req, http.StatusOK, traceStatus())
+		case http.MethodPost:
+			// trace the requests to the hosts without the header for a while
+			var hosts []string
+			if s := req.URL.Query().Get("host"); s != "" {
+				hosts = strings.Split(s, ",")
+			}
+			d := 300 * time.Second
+			if s := req.URL.Query().Get("duration"); s != "" {
+				n, err := strconv.Atoi(s)
+				if err != nil {
+					return jsonError(req, http.StatusBadRequest, fmt.Errorf("invalid duration %#v", s))
+				}
+				d = time.Duration(n) * time.Second
+			}
+			switch req.URL.Query().Get("enabled") {
+			case "true":
+				helpers.Traces.Enable(hosts, d)
+			case "false":
+				helpers.Traces.Enable(nil, 0)
+			default:
+				return jsonError(req, http.StatusBadRequest, fmt.Errorf("enabled must be true or false"))
+			}
+			glog.Infof("ADMIN: trace enabled=%s hosts=%v for %s", req.URL.Query().Get("enabled"), hosts, d)
+			return jsonResponse(req, http.StatusOK, traceStatus())
+		}
+	default:
+		return jsonError(req, http.StatusNotFound, fmt.Errorf("unknown api %#v", req.URL.Path))
+	}
+
+	return jsonError(req, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed for %#v", req.Method, req.URL.Path))
+}
+
+// traceStatus returns whether requests are traced without the header, and the
+// traces kept.
+func traceStatus() map[string]interface{} {
+	hosts, until := helpers.Traces.Enabled()
+	status := map[string]interface{}{
+		"enabled": hosts != nil,
+		"traces":  helpers.Traces.List(),
+	}
+	if hosts != nil {
+		status["until"] = until
+	}
+	return status
+}
+
+type aliasDialStats struct {
+	Alias       string  `json:"alias"`
+	Type        string  `json:"type"`
+	OK          int64   `json:"ok"`
+	Error       int64   `json:"error"`
+	SuccessRate float64 `json:"success_rate"`
+}
+
+// dialStats sums goproxy_dial_attempts_total of m by alias and dial type.
+func dialStats(m *helpers.Metrics) []aliasDialStats {
+	stats := make(map[string]*aliasDialStats)
+	m.Counters("goproxy_dial_attempts_total", func(labels map[string]string, value float64) {
+		key := labels["alias"] + "|" + labels["type"]
+		s, ok := stats[key]
+		if !ok {
+			s = &aliasDialStats{Alias: labels["alias"], Type: labels["type"]}
+			stats[key] = s
+		}
+		if labels["result"] == "ok" {
+			s.OK += int64(value)
+		} else {
+			s.Error += int64(value)
+		}
+	})
+
+	result := make([]aliasDialStats, 0, len(stats))
+	for _, s := range stats {
+		if n := s.OK + s.Error; n > 0 {
+			s.SuccessRate = float64(s.OK) / float64(n)
+		}
+		result = append(result, *s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Alias != result[j].Alias {
+			return result[i].Alias < result[j].Alias
+		}
+		return result[i].Type < result[j].Type
+	})
+	return result
+}
+
+// topHosts returns the hosts with the most traffic in the StatsDB, e.g.
+// "?hours=24&limit=10". hours defaults to 1 and limit to 20.
+func topHosts(query url.Values) ([]helpers.StatsRow, error) {
+	db := helpers.DefaultStatsDB()
+	if db == nil {
+		return nil, fmt.Errorf("stats is not enabled")
+	}
+
+	hours, limit := 1, 20
+	if s := query.Get("hours"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid hours %#v", s)
+		}
+		hours = n
+	}
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid limit %#v", s)
+		}
+		limit = n
+	}
+
+	to := time.Now()
+	rows, err := db.Query(to.Add(-time.Duration(hours)*time.Hour), to.Add(time.Second), []string{"host"})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].RequestBytes+rows[i].ResponseBytes > rows[j].RequestBytes+rows[j].ResponseBytes
+	})
+	if len(rows) > limit {
+		rows = rows[:limit]
+	}
+	return rows, nil
+}
+
+// queryTraffic returns the traffic per client or host of TrafficStats, e.g.
+// "?window=day&by=client&limit=10". window is "hour" (default) or "day", by
+// is "client" (default) or "host".
+func queryTraffic(query url.Values) ([]helpers.TrafficRow, error) {
+	t := helpers.DefaultTrafficStats()
+	if t == nil {
+		return nil, fmt.Errorf("traffic accounting is not enabled")
+	}
+
+	window := time.Hour
+	switch s := query.Get("window"); s {
+	case "", "hour":
+	case "day":
+		window = 24 * time.Hour
+	default:
+		return nil, fmt.Errorf("invalid window %#v", s)
+	}
+
+	by := query.Get("by")
+	if by == "" {
+		by = "client"
+	}
+
+	limit := 0
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid limit %#v", s)
+		}
+		limit = n
+	}
+
+	return t.Query(window, by, limit)
+}
+
+func cacheKeys(c lrucache.Cache) []string {
+	if kc, ok := c.(*helpers.KeyedCache); ok {
+		return kc.Keys()
+	}
+	return []string{}
+}
+
+func dumpCache(c lrucache.Cache, format func(interface{}) interface{}) map[string]interface{} {
+	m := make(map[string]interface{})
+	for _, key := range cacheKeys(c) {
+		if v, ok := c.GetQuiet(key); ok {
+			if format != nil {
+				v = format(v)
+			}
+			m[key] = v
+		}
+	}
+	return m
+}
+
+// dumpBlackList returns the remaining ttl of each blacklisted ip in ipnet,
+// "" means the ip never expires. A nil ipnet dumps all of them.
+func dumpBlackList(d *dialer.MultiDialer, ipnet *net.IPNet) map[string]string {
+	m := make(map[string]string)
+	now := time.Now()
+	ips := cacheKeys(d.IPBlackList)
+	if ipnet != nil {
+		ips = d.BlackListedIn(ipnet)
+	}
+	for _, ip := range ips {
+		if !d.IsBlackListed(ip) {
+			continue
+		}
+		m[ip] = ""
+		if v, ok := d.IPBlackList.GetQuiet(ip); ok {
+			if expire, ok := v.(time.Time); ok && !expire.IsZero() {
+				m[ip] = expire.Sub(now).Truncate(time.Second).String()
+			}
+		}
+	}
+	return m
+}
+
+// parseTTL accepts seconds or a time.Duration string, empty means forever.
+func parseTTL(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 0 {
+			return 0, fmt.Errorf("invalid ttl %#v", s)
+		}
+		return time.Duration(n) * time.Second, nil
+	}
+
+	ttl, err := time.ParseDuration(s)
+	if err != nil || ttl < 0 {
+		return 0, fmt.Errorf("invalid ttl %#v", s)
+	}
+
+	return ttl, nil
+}
+
+// parseCIDRQuery returns the "cidr" parameter, nil if there is none.
+func parseCIDRQuery(query url.Values) (*net.IPNet, error) {
+	s := query.Get("cidr")
+	if s == "" {
+		return nil, nil
+	}
+	return dialer.ParseCIDR(s)
+}
+
+// readIPs reads a JSON array or whitespace/comma separated ips from r.
+func readIPs(r io.Reader) ([]string, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, 4*1024*1024))
+	if err != nil {
+		return nil, err
+	}
+
+	var ips []string
+	if data = bytes.TrimSpace(data); bytes.HasPrefix(data, []byte("[")) {
+		if err = json.Unmarshal(data, &ips); err != nil {
+			return nil, err
+		}
+	} else {
+		ips = strings.FieldsFunc(string(data), func(c rune) bool {
+			return c == ',' || c == ' ' || c == '\t' || c == '\r' || c == '\n'
+		})
+	}
+
+	for _, ip := range ips {
+		if net.ParseIP(dialer.NormalizeIP(ip)) == nil {
+			return nil, fmt.Errorf("invalid ip %#v", ip)
+		}
+	}
+
+	return ips, nil
+}
+
+func formatValue(v interface{}) interface{} {
+	switch v1 := v.(type) {
+	case time.Duration:
+		return v1.String()
+	case error:
+		return v1.Error()
+	default:
+		return v
+	}
+}
+
+func jsonError(req *http.Request, code int, err error) *http.Response {
+	return jsonResponse(req, code, map[string]string{"error": err.Error()})
+}
+
+func htmlResponse(req *http.Request, code int, data []byte) *http.Response {
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode: code,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type":  []string{"text/html; charset=utf-8"},
+			"Cache-Control": []string{"no-cache"},
+		},
+		Request:       req,
+		Close:         false,
+		ContentLength: int64(len(data)),
+		Body:          ioutil.NopCloser(bytes.NewReader(data)),
+	}
+}
+
+func textResponse(req *http.Request, code int, data []byte) *http.Response {
+	resp := htmlResponse(req, code, data)
+	resp.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	return resp
+}
+
+func jsonResponse(req *http.Request, code int, v interface{}) *http.Response {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		code = http.StatusInternalServerError
+		data = []byte(fmt.Sprintf("{\"error\": %q}", err.Error()))
+	}
+
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode: code,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type": []string{"application/json; charset=utf-8"},
+		},
+		Request:       req,
+		Close:         false,
+		ContentLength: int64(len(data)),
+		Body:          ioutil.NopCloser(bytes.NewReader(data)),
+	}
+}
@@ -0,0 +1,160 @@
+package admin
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// dashboardHTML is compiled into the binary so that the dashboard needs no
+// asset files, it polls the admin api below the "{{API}}" path.
+const dashboardHTML string = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>GoProxy Dashboard</title>
+<style>
+    body { margin: 1em 2em; font-family: Tahoma, Verdana, Arial, sans-serif; font-size: 14px; }
+    h2 { margin-top: 1.5em; border-bottom: 1px solid #ccc; }
+    table { border-collapse: collapse; }
+    th, td { padding: 2px 10px; text-align: left; border-bottom: 1px solid #eee; }
+    td.num { text-align: right; }
+    .bad { color: #c00; }
+    #error { color: #c00; }
+</style>
+</head>
+<body>
+<h1>GoProxy Dashboard</h1>
+<div id="error"></div>
+<div id="panics" class="bad"></div>
+<p>
+    <select id="filter"></select>
+    <input id="ip" placeholder="ip">
+    <button onclick="blacklist(document.getElementById('ip').value)">Blacklist</button>
+</p>
+<h2>Dial Success Rates</h2>
+<table id="dialstats"></table>
+<h2>Top Hosts (last hour)</h2>
+<table id="tophosts"></table>
+<h2>DNS Cache</h2>
+<table id="dnscache"></table>
+<script>
+var API = {{API}};
+var TOKEN = {{TOKEN}};
+
+function $(id) { return document.getElementById(id); }
+
+function escape(s) {
+    return String(s).replace(/[&<>"']/g, function (c) {
+        return {"&": "&amp;", "<": "&lt;", ">": "&gt;", '"': "&quot;", "'": "&#39;"}[c];
+    });
+}
+
+function request(method, path, callback) {
+    var xhr = new XMLHttpRequest();
+    xhr.open(method, API + path);
+    if (method != "GET") xhr.setRequestHeader("X-Goproxy-Admin", TOKEN);
+    xhr.onload = function () {
+        var data = null;
+        try { data = JSON.parse(xhr.responseText); } catch (e) {}
+        if (xhr.status >= 300) {
+            $("error").textContent = method + " " + path + ": " + (data && data.error || xhr.status);
+            return;
+        }
+        if (callback) callback(data);
+    };
+    xhr.send();
+}
+
+function render(id, head, rows) {
+    var html = "<tr><th>" + head.join("</th><th>") + "</th></tr>";
+    for (var i = 0; i < rows.length; i++) {
+        html += "<tr>" + rows[i].join("") + "</tr>";
+    }
+    $(id).innerHTML = html;
+}
+
+function cell(s, cls) {
+    return "<td" + (cls ? " class=\"" + cls + "\"" : "") + ">" + escape(s) + "</td>";
+}
+
+function bytes(n) {
+    var units = ["B", "KB", "MB", "GB", "TB"], i = 0;
+    while (n >= 1024 && i < units.length - 1) { n /= 1024; i++; }
+    return n.toFixed(i ? 1 : 0) + " " + units[i];
+}
+
+function blacklist(ip) {
+    var name = $("filter").value;
+    if (!name || !ip || !confirm("Blacklist " + ip + " of " + name + "?")) return;
+    request("POST", name + "/blacklist?ip=" + encodeURIComponent(ip), refresh);
+}
+
+function refresh() {
+    var name = $("filter").value;
+    if (name) {
+        request("GET", name + "/dialstats", function (stats) {
+            render("dialstats", ["Alias", "Type", "OK", "Error", "Success"], stats.map(function (s) {
+                return [cell(s.alias), cell(s.type), cell(s.ok, "num"), cell(s.error, "num"),
+                    cell((s.success_rate * 100).toFixed(1) + "%", s.success_rate < 0.5 ? "num bad" : "num")];
+            }));
+        });
+        request("GET", name + "/dnscache", function (cache) {
+            var rows = [];
+            Object.keys(cache).sort().forEach(function (host) {
+                var ips = [].concat(cache[host] || []);
+                rows.push([cell(host), "<td>" + ips.map(function (ip) {
+                    return escape(ip) + " <a href=\"#\" data-ip=\"" + escape(ip) + "\">&#x2715;</a>";
+                }).join("<br>") + "</td>"]);
+            });
+            render("dnscache", ["Host", "IPs"], rows);
+        });
+    }
+    request("GET", "system/panics", function (panics) {
+        var html = "";
+        Object.keys(panics).sort().forEach(function (profile) {
+            panics[profile].forEach(function (p) {
+                if (!p.Bypassed) return;
+                html += "<p>&#x26A0; " + escape(p.Filter) + " is bypassed for " + escape(p.Pattern) +
+                    " after " + escape(p.Count) + " panics (" + escape(p.Value) + " at " + escape(p.Site) + ")</p>";
+            });
+        });
+        $("panics").innerHTML = html;
+    });
+    request("GET", "system/tophosts", function (rows) {
+        render("tophosts", ["Host", "Requests", "Sent", "Received", "Latency"], rows.map(function (r) {
+            return [cell(r.group.host), cell(r.requests, "num"), cell(bytes(r.request_bytes), "num"),
+                cell(bytes(r.response_bytes), "num"), cell(r.avg_latency_ms.toFixed(0) + " ms", "num")];
+        }));
+    });
+}
+
+$("dnscache").onclick = function (e) {
+    var ip = e.target.getAttribute("data-ip");
+    if (ip) {
+        e.preventDefault();
+        blacklist(ip);
+    }
+};
+
+$("filter").onchange = refresh;
+
+request("GET", "system/dialers", function (names) {
+    $("filter").innerHTML = names.map(function (name) {
+        return "<option>" + escape(name) + "</option>";
+    }).join("");
+    refresh();
+    setInterval(refresh, 5000);
+});
+</script>
+</body>
+</html>
+`
+
+func renderDashboard(api, token string) []byte {
+	if token == "" {
+		token = "1"
+	}
+	data, _ := json.Marshal(api)
+	data1, _ := json.Marshal(token)
+	return []byte(strings.NewReplacer("{{API}}", string(data), "{{TOKEN}}", string(data1)).Replace(dashboardHTML))
+}
@@ -2,16 +2,25 @@ package auth
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cloudflare/golibs/lrucache"
 	"github.com/phuslu/glog"
 
 	"../../filters"
+	"../../helpers"
 	"../../storage"
 )
 
@@ -21,20 +30,53 @@ const (
 	bypassHeader string = filterName + "/bypass"
 )
 
+const (
+	defaultRealm       string        = "GoProxy"
+	defaultNonceExpiry time.Duration = 5 * time.Minute
+)
+
 type Config struct {
 	CacheSize int
-	Basic     []struct {
+	Realm     string
+	Digest    bool
+	// seconds a Digest nonce stays valid
+	NonceExpiry  int
+	HtpasswdFile string
+	Basic        []struct {
 		Username string
 		Password string
 	}
+	// ips or cidrs which skip the authentication
 	WhiteList []string
+	// if not empty, the ips or cidrs which may use the proxy at all
+	AllowList []string
+	Guests    struct {
+		Enabled bool
+		// signs the guest credentials, a random one invalidates them on restart
+		Secret string
+		// the revoked guests, empty keeps them in memory only
+		RevokedFile string
+		// seconds
+		DefaultTTL int
+		MaxTTL     int
+		Profiles   map[string]GuestProfile
+	}
 }
 
 type Filter struct {
 	Config
 	ByPassHeaders lrucache.Cache
-	Basic         map[string]string
-	WhiteList     map[string]struct{}
+	Credentials   CredentialStore
+	WhiteList     []*net.IPNet
+	AllowList     []*net.IPNet
+	NonceExpiry   time.Duration
+	nonceKey      []byte
+	// the last nc of each nonce until it expires, a Digest response is not
+	// accepted twice
+	nonceCounts map[string]nonceCount
+	noncePrune  time.Time
+	muNonce     sync.Mutex
+	guests      *guestStore
 }
 
 func init() {
@@ -60,16 +102,55 @@ func NewFilter(config *Config) (filters.Filter, error) {
 	f := &Filter{
 		Config:        *config,
 		ByPassHeaders: lrucache.NewMultiLRUCache(4, uint(config.CacheSize)),
-		Basic:         make(map[string]string),
-		WhiteList:     make(map[string]struct{}),
+		NonceExpiry:   time.Duration(config.NonceExpiry) * time.Second,
+		nonceKey:      make([]byte, 32),
+		nonceCounts:   make(map[string]nonceCount),
+	}
+
+	if f.Realm == "" {
+		f.Realm = defaultRealm
 	}
 
-	for _, v := range config.Basic {
-		f.Basic[v.Username] = v.Password
+	if f.NonceExpiry <= 0 {
+		f.NonceExpiry = defaultNonceExpiry
 	}
 
-	for _, v := range config.WhiteList {
-		f.WhiteList[v] = struct{}{}
+	if _, err := rand.Read(f.nonceKey); err != nil {
+		return nil, err
+	}
+
+	if config.HtpasswdFile != "" {
+		store, err := newFileStore(config.HtpasswdFile)
+		if err != nil {
+			return nil, fmt.Errorf("AUTH: load %#v failed: %v", config.HtpasswdFile, err)
+		}
+		f.Credentials = store
+	} else {
+		store := make(inlineStore)
+		for _, v := range config.Basic {
+			store[v.Username] = v.Password
+		}
+		f.Credentials = store
+	}
+
+	if config.Guests.Enabled {
+		store, err := newGuestStore(config.Guests.Secret,
+			time.Duration(config.Guests.DefaultTTL)*time.Second,
+			time.Duration(config.Guests.MaxTTL)*time.Second,
+			config.Guests.Profiles,
+			config.Guests.RevokedFile)
+		if err != nil {
+			return nil, err
+		}
+		f.guests = store
+	}
+
+	var err error
+	if f.WhiteList, err = helpers.ParseIPNets(config.WhiteList); err != nil {
+		return nil, fmt.Errorf("AUTH: WhiteList: %v", err)
+	}
+	if f.AllowList, err = helpers.ParseIPNets(config.AllowList); err != nil {
+		return nil, fmt.Errorf("AUTH: AllowList: %v", err)
 	}
 
 	return f, nil
@@ -88,13 +169,21 @@ func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Contex
 }
 
 func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	var ip net.IP
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		ip = net.ParseIP(host)
+	}
 
-	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
-		if _, ok := f.WhiteList[ip]; ok {
-			return ctx, nil, nil
-		}
+	if len(f.AllowList) > 0 && !helpers.ContainsIP(f.AllowList, ip) {
+		glog.V(1).Infof("Forbidden URL %v from %#v", req.URL.String(), filters.RemoteAddr(req))
+		return ctx, f.newResponse(req, http.StatusForbidden), nil
+	}
+
+	if helpers.ContainsIP(f.WhiteList, ip) {
+		return ctx, nil, nil
 	}
 
+	stale := false
 	if auth := filters.String(ctx, authHeader); auth != "" {
 		if _, ok := f.ByPassHeaders.Get(auth); ok {
 			glog.V(3).Infof("auth filter hit bypass cache %#v", auth)
@@ -105,15 +194,32 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 			switch parts[0] {
 			case "Basic":
 				if userpass, err := base64.StdEncoding.DecodeString(parts[1]); err == nil {
-					parts := strings.Split(string(userpass), ":")
-					user := parts[0]
-					pass := parts[1]
-					pass1, ok := f.Basic[user]
-					if ok && pass == pass1 {
+					parts := strings.SplitN(string(userpass), ":", 2)
+					// guests are checked on every request for their expiry and limits
+					if len(parts) == 2 && f.guests != nil && strings.HasPrefix(parts[0], guestPrefix) {
+						code := f.guests.Authorize(parts[0], parts[1], req)
+						if code == 0 {
+							return ctx, nil, nil
+						}
+						if code == http.StatusForbidden {
+							glog.V(1).Infof("Forbidden URL %v for %#v from %#v", req.URL.String(), parts[0], filters.RemoteAddr(req))
+							return ctx, f.newResponse(req, http.StatusForbidden), nil
+						}
+						break
+					}
+					if len(parts) == 2 && f.Credentials.Verify(parts[0], parts[1]) {
 						f.ByPassHeaders.Set(auth, struct{}{}, time.Now().Add(time.Hour))
 						return ctx, nil, nil
 					}
 				}
+			case "Digest":
+				if !f.Digest {
+					break
+				}
+				var ok bool
+				if ok, stale = f.verifyDigest(req, parts[1]); ok {
+					return ctx, nil, nil
+				}
 			default:
 				glog.Errorf("Unrecognized auth type: %#v", parts[0])
 				break
@@ -121,11 +227,46 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 		}
 	}
 
-	glog.V(1).Infof("UnAuthenticated URL %v from %#v", req.URL.String(), req.RemoteAddr)
+	glog.V(1).Infof("UnAuthenticated URL %v from %#v", req.URL.String(), filters.RemoteAddr(req))
+
+	resp := f.newResponse(req, http.StatusProxyAuthRequired)
+	resp.Header.Add("Proxy-Authenticate", fmt.Sprintf("Basic realm=\"%s\"", f.Realm))
+	if f.Digest {
+		challenge := fmt.Sprintf("Digest realm=\"%s\", qop=\"auth\", algorithm=MD5, nonce=\"%s\"", f.Realm, f.newNonce())
+		if stale {
+			challenge += ", stale=true"
+		}
+		resp.Header.Add("Proxy-Authenticate", challenge)
+	}
+
+	return ctx, resp, nil
+}
+
+// IssueGuest returns a new guest credential of profile which expires after
+// ttl, 0 is Guests.DefaultTTL.
+func (f *Filter) IssueGuest(profile string, ttl time.Duration) (interface{}, error) {
+	if f.guests == nil {
+		return nil, fmt.Errorf("guests are not enabled")
+	}
+	return f.guests.Issue(profile, ttl)
+}
+
+// Guests returns the guests which have not expired.
+func (f *Filter) Guests() (interface{}, bool) {
+	if f.guests == nil {
+		return nil, false
+	}
+	return f.guests.List(), true
+}
 
-	noAuthResponse := &http.Response{
-		Status:        "407 Proxy Authentication Required",
-		StatusCode:    http.StatusProxyAuthRequired,
+func (f *Filter) RevokeGuest(id string) bool {
+	return f.guests != nil && f.guests.Revoke(id)
+}
+
+func (f *Filter) newResponse(req *http.Request, code int) *http.Response {
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
 		Proto:         "HTTP/1.1",
 		ProtoMajor:    1,
 		ProtoMinor:    1,
@@ -134,6 +275,162 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 		Close:         true,
 		ContentLength: -1,
 	}
+}
+
+// newNonce returns a timestamp signed with nonceKey, so that nonces need no
+// server side state and expire after NonceExpiry.
+func (f *Filter) newNonce() string {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(time.Now().Unix()))
+	return hex.EncodeToString(b) + f.signNonce(b)
+}
+
+func (f *Filter) signNonce(b []byte) string {
+	mac := hmac.New(sha256.New, f.nonceKey)
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// checkNonce returns the time nonce was issued, valid is false unless it is
+// issued by f.
+func (f *Filter) checkNonce(nonce string) (issued time.Time, valid bool) {
+	if len(nonce) != 48 {
+		return time.Time{}, false
+	}
+
+	b, err := hex.DecodeString(nonce[:16])
+	if err != nil || !hmac.Equal([]byte(nonce[16:]), []byte(f.signNonce(b))) {
+		return time.Time{}, false
+	}
 
-	return ctx, noAuthResponse, nil
+	return time.Unix(int64(binary.BigEndian.Uint64(b)), 0), true
+}
+
+// verifyDigest checks the Digest credentials of RFC 2617 with qop "auth", the
+// one of the challenge, stale is set if they are only wrong because of an old
+// nonce. The uri must be the one of req and the nc must grow with each request
+// of a nonce, so a captured header can not be replayed.
+func (f *Filter) verifyDigest(req *http.Request, s string) (ok bool, stale bool) {
+	params := parseDigestParams(s)
+
+	username := params["username"]
+	if username == "" || params["realm"] != f.Realm {
+		return false, false
+	}
+
+	if !digestURIMatch(params["uri"], req) {
+		return false, false
+	}
+
+	if algorithm := params["algorithm"]; algorithm != "" && !strings.EqualFold(algorithm, "MD5") {
+		return false, false
+	}
+
+	issued, valid := f.checkNonce(params["nonce"])
+	if !valid {
+		return false, false
+	}
+
+	ha1, found := f.Credentials.HA1(username, f.Realm)
+	if !found {
+		return false, false
+	}
+
+	// without qop there is no nc, such a response could be replayed
+	if params["qop"] != "auth" {
+		return false, false
+	}
+
+	ha2 := md5hex(req.Method + ":" + params["uri"])
+	response := md5hex(strings.Join([]string{ha1, params["nonce"], params["nc"], params["cnonce"], "auth", ha2}, ":"))
+	if !hmac.Equal([]byte(response), []byte(strings.ToLower(params["response"]))) {
+		return false, false
+	}
+
+	expiry := issued.Add(f.NonceExpiry)
+	if !time.Now().Before(expiry) {
+		return false, true
+	}
+
+	if !f.checkNonceCount(params["nonce"], params["nc"], expiry) {
+		return false, false
+	}
+
+	return true, false
+}
+
+// digestURIMatch reports whether uri is the request-target of req, either as
+// sent or as the path of an absolute one.
+func digestURIMatch(uri string, req *http.Request) bool {
+	if uri == "" {
+		return false
+	}
+	if uri == req.RequestURI {
+		return true
+	}
+	return req.Method != http.MethodConnect && req.URL != nil && uri == req.URL.RequestURI()
+}
+
+type nonceCount struct {
+	nc     uint64
+	expiry time.Time
+}
+
+// checkNonceCount records nc of nonce until expiry, it fails unless nc is
+// above the last one seen. The counts are only dropped once their nonces have
+// expired, so no number of other nonces can make one usable again.
+func (f *Filter) checkNonceCount(nonce, nc string, expiry time.Time) bool {
+	n, err := strconv.ParseUint(nc, 16, 32)
+	if err != nil || n == 0 {
+		return false
+	}
+
+	f.muNonce.Lock()
+	defer f.muNonce.Unlock()
+
+	now := time.Now()
+	if now.After(f.noncePrune) {
+		for nonce1, c := range f.nonceCounts {
+			if !now.Before(c.expiry) {
+				delete(f.nonceCounts, nonce1)
+			}
+		}
+		f.noncePrune = now.Add(f.NonceExpiry)
+	}
+
+	if c, ok := f.nonceCounts[nonce]; ok && n <= c.nc {
+		return false
+	}
+	f.nonceCounts[nonce] = nonceCount{n, expiry}
+	return true
+}
+
+func parseDigestParams(s string) map[string]string {
+	params := make(map[string]string)
+	for len(s) > 0 {
+		s = strings.TrimLeft(s, " ,")
+		i := strings.IndexByte(s, '=')
+		if i < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(s[:i]))
+		s = s[i+1:]
+
+		var value string
+		if strings.HasPrefix(s, "\"") {
+			j := strings.IndexByte(s[1:], '"')
+			if j < 0 {
+				break
+			}
+			value, s = s[1:j+1], s[j+2:]
+		} else {
+			j := strings.IndexByte(s, ',')
+			if j < 0 {
+				j = len(s)
+			}
+			value, s = strings.TrimSpace(s[:j]), s[j:]
+		}
+		params[key] = value
+	}
+	return params
 }
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyDigest(t *testing.T) {
+	filter, err := NewFilter(&Config{
+		Realm:  "GoProxy",
+		Digest: true,
+		Basic:  []struct{ Username, Password string }{{"admin", "123456"}},
+	})
+	if err != nil {
+		t.Fatalf("NewFilter error: %v", err)
+	}
+	f := filter.(*Filter)
+
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(time.Now().Add(-2*f.NonceExpiry).Unix()))
+	staleNonce := hex.EncodeToString(b) + f.signNonce(b)
+
+	nonce := f.newNonce()
+	header := func(nonce, uri, qop, nc string) string {
+		ha1 := md5hex("admin:GoProxy:123456")
+		ha2 := md5hex(http.MethodConnect + ":" + uri)
+		response := md5hex(strings.Join([]string{ha1, nonce, nc, "0a4f113b", qop, ha2}, ":"))
+		if qop == "" {
+			response = md5hex(ha1 + ":" + nonce + ":" + ha2)
+		}
+		return fmt.Sprintf(`username="admin", realm="GoProxy", nonce="%s", uri="%s", qop=%s, nc=%s, cnonce="0a4f113b", response="%s"`, nonce, uri, qop, nc, response)
+	}
+
+	req := &http.Request{Method: http.MethodConnect, RequestURI: "example.org:443"}
+
+	cases := []struct {
+		name   string
+		header string
+		ok     bool
+		stale  bool
+	}{
+		{"valid", header(nonce, "example.org:443", "auth", "00000001"), true, false},
+		{"replayed nc", header(nonce, "example.org:443", "auth", "00000001"), false, false},
+		{"next nc", header(nonce, "example.org:443", "auth", "00000002"), true, false},
+		{"wrong uri", header(nonce, "example.com:443", "auth", "00000003"), false, false},
+		{"no qop", header(nonce, "example.org:443", "", "00000004"), false, false},
+		{"stale nonce", header(staleNonce, "example.org:443", "auth", "00000001"), false, true},
+	}
+
+	for _, c := range cases {
+		ok, stale := f.verifyDigest(req, c.header)
+		if ok != c.ok || stale != c.stale {
+			t.Errorf("%s: verifyDigest returns (%v, %v), want (%v, %v)", c.name, ok, stale, c.ok, c.stale)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+
+	"github.com/phuslu/glog"
+
+	"../../storage"
+)
+
+// CredentialStore checks the proxy credentials, HA1 is only needed by Digest
+// authentication and is MD5(username:realm:password).
+type CredentialStore interface {
+	Verify(username, password string) bool
+	HA1(username, realm string) (string, bool)
+}
+
+// inlineStore holds the plain text passwords of auth.json.
+type inlineStore map[string]string
+
+func (s inlineStore) Verify(username, password string) bool {
+	password1, ok := s[username]
+	return ok && subtle.ConstantTimeCompare([]byte(password), []byte(password1)) == 1
+}
+
+func (s inlineStore) HA1(username, realm string) (string, bool) {
+	password, ok := s[username]
+	if !ok {
+		return "", false
+	}
+	return md5hex(username + ":" + realm + ":" + password), true
+}
+
+// fileStore reads htpasswd lines "user:password" where password is plain text
+// or "{SHA}" hashed, and htdigest lines "user:realm:ha1". Only plain text and
+// htdigest entries can be used with Digest authentication.
+type fileStore struct {
+	passwords map[string]string
+	ha1s      map[string]string
+}
+
+func newFileStore(filename string) (*fileStore, error) {
+	store, err := storage.OpenURI(storage.LookupConfigStoreURI(filterName))
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := store.GetObject(filename, -1, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := object.Body()
+	defer rc.Close()
+
+	s := &fileStore{
+		passwords: make(map[string]string),
+		ha1s:      make(map[string]string),
+	}
+
+	scanner := bufio.NewScanner(rc)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.Split(line, ":")
+		switch {
+		case len(parts) == 3:
+			s.ha1s[parts[0]+":"+parts[1]] = strings.ToLower(parts[2])
+		case len(parts) == 2 && strings.HasPrefix(parts[1], "$"):
+			glog.Warningf("AUTH: %s: unsupported password hash of %#v, skipped", filename, parts[0])
+		case len(parts) == 2:
+			s.passwords[parts[0]] = parts[1]
+		default:
+			glog.Warningf("AUTH: %s: malformed line %#v, skipped", filename, line)
+		}
+	}
+
+	return s, scanner.Err()
+}
+
+func (s *fileStore) Verify(username, password string) bool {
+	password1, ok := s.passwords[username]
+	if !ok {
+		return false
+	}
+
+	if strings.HasPrefix(password1, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		password = "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+	}
+
+	return subtle.ConstantTimeCompare([]byte(password), []byte(password1)) == 1
+}
+
+func (s *fileStore) HA1(username, realm string) (string, bool) {
+	if ha1, ok := s.ha1s[username+":"+realm]; ok {
+		return ha1, true
+	}
+
+	password, ok := s.passwords[username]
+	if !ok || strings.HasPrefix(password, "{SHA}") {
+		return "", false
+	}
+
+	return md5hex(username + ":" + realm + ":" + password), true
+}
+
+func md5hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,315 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../../helpers"
+	"../../storage"
+)
+
+const (
+	guestPrefix string = "guest-"
+
+	defaultGuestTTL time.Duration = 24 * time.Hour
+)
+
+// GuestProfile restricts what the guests issued with it may do.
+type GuestProfile struct {
+	// host patterns the guests may visit, empty for all
+	Sites []string
+	// requests of a guest, 0 is unlimited
+	MaxRequests int64
+}
+
+// Guest is a time-limited credential issued by the admin.
+type Guest struct {
+	ID       string
+	Username string
+	Password string `json:",omitempty"`
+	Profile  string
+	Expires  time.Time
+	Requests int64
+	Revoked  bool
+}
+
+// guestStore issues and verifies the guest credentials. The password is the
+// id, expiry and profile signed with key, so a guest stays valid across
+// restarts if key is kept; the usage is in memory, the revocations are
+// saved to revokedFile.
+type guestStore struct {
+	key        []byte
+	defaultTTL time.Duration
+	maxTTL     time.Duration
+	profiles   map[string]GuestProfile
+	sites      map[string]*helpers.HostMatcher
+	// the revocations are saved to it if set
+	revokedFile string
+
+	mu     sync.Mutex
+	guests map[string]*Guest
+	// the revoked ids and when their guests expire, zero if unknown
+	revoked map[string]time.Time
+}
+
+func newGuestStore(secret string, defaultTTL, maxTTL time.Duration, profiles map[string]GuestProfile, revokedFile string) (*guestStore, error) {
+	if len(profiles) == 0 {
+		return nil, fmt.Errorf("AUTH: Guests.Profiles is empty")
+	}
+
+	s := &guestStore{
+		key:         []byte(secret),
+		defaultTTL:  defaultTTL,
+		maxTTL:      maxTTL,
+		profiles:    profiles,
+		sites:       make(map[string]*helpers.HostMatcher),
+		revokedFile: revokedFile,
+		guests:      make(map[string]*Guest),
+		revoked:     make(map[string]time.Time),
+	}
+
+	if secret == "" {
+		s.key = make([]byte, 32)
+		if _, err := rand.Read(s.key); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.defaultTTL <= 0 {
+		s.defaultTTL = defaultGuestTTL
+	}
+	if s.maxTTL > 0 && s.defaultTTL > s.maxTTL {
+		s.defaultTTL = s.maxTTL
+	}
+
+	for name, p := range profiles {
+		if len(p.Sites) > 0 {
+			s.sites[name] = helpers.NewHostMatcher(p.Sites)
+		}
+	}
+
+	if revokedFile != "" {
+		data, recovered, err := storage.ReadFileVerified(revokedFile, func(b []byte) error {
+			return json.Unmarshal(b, &map[string]time.Time{})
+		})
+		switch {
+		case os.IsNotExist(err):
+			break
+		case err != nil:
+			return nil, err
+		default:
+			if recovered {
+				glog.Warningf("AUTH: %#v is corrupted, load the last good one", revokedFile)
+			}
+			if err = json.Unmarshal(data, &s.revoked); err != nil {
+				return nil, err
+			}
+			s.purge(time.Now())
+		}
+	}
+
+	return s, nil
+}
+
+func (s *guestStore) sign(payload string) string {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Issue returns a new guest of profile which expires after ttl, 0 is the
+// default one.
+func (s *guestStore) Issue(profile string, ttl time.Duration) (*Guest, error) {
+	if _, ok := s.profiles[profile]; !ok {
+		return nil, fmt.Errorf("guest profile %#v not exists", profile)
+	}
+	if ttl <= 0 {
+		ttl = s.defaultTTL
+	}
+	if s.maxTTL > 0 && ttl > s.maxTTL {
+		return nil, fmt.Errorf("ttl %s is longer than %s", ttl, s.maxTTL)
+	}
+
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(expires.Unix()))
+	payload := base64.RawURLEncoding.EncodeToString(append(append(id, b...), profile...))
+
+	g := &Guest{
+		ID:       hex.EncodeToString(id),
+		Profile:  profile,
+		Expires:  expires,
+		Password: payload + "." + s.sign(payload),
+	}
+	g.Username = guestPrefix + g.ID
+
+	s.mu.Lock()
+	s.purge(time.Now())
+	s.guests[g.ID] = g
+	s.mu.Unlock()
+
+	g1 := *g
+	return &g1, nil
+}
+
+// parse verifies the credential of a guest and returns its id, profile and
+// expiry.
+func (s *guestStore) parse(username, password string) (string, string, time.Time, bool) {
+	parts := strings.SplitN(password, ".", 2)
+	if len(parts) != 2 || subtle.ConstantTimeCompare([]byte(parts[1]), []byte(s.sign(parts[0]))) != 1 {
+		return "", "", time.Time{}, false
+	}
+
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || len(b) < 14 {
+		return "", "", time.Time{}, false
+	}
+
+	id := hex.EncodeToString(b[:6])
+	if username != guestPrefix+id {
+		return "", "", time.Time{}, false
+	}
+
+	return id, string(b[14:]), time.Unix(int64(binary.BigEndian.Uint64(b[6:14])), 0), true
+}
+
+// Authorize checks the guest credential for req and counts the request. It
+// returns 0 if the request may pass, or else the status to answer with.
+func (s *guestStore) Authorize(username, password string, req *http.Request) int {
+	id, profile, expires, ok := s.parse(username, password)
+	if !ok {
+		return http.StatusProxyAuthRequired
+	}
+
+	now := time.Now()
+	p, ok := s.profiles[profile]
+	if !ok || now.After(expires) {
+		return http.StatusProxyAuthRequired
+	}
+
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if m, ok := s.sites[profile]; ok && !m.Match(host) {
+		return http.StatusForbidden
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.revoked[id]; ok {
+		return http.StatusProxyAuthRequired
+	}
+
+	g, ok := s.guests[id]
+	if !ok {
+		// issued before a restart
+		g = &Guest{ID: id, Username: username, Profile: profile, Expires: expires}
+		s.guests[id] = g
+	}
+	if p.MaxRequests > 0 && g.Requests >= p.MaxRequests {
+		return http.StatusForbidden
+	}
+	g.Requests++
+
+	return 0
+}
+
+// Revoke invalidates the guest of id until it expires, also the ones which
+// have not been seen since a restart. It is false if id is not a guest id.
+func (s *guestStore) Revoke(id string) bool {
+	if b, err := hex.DecodeString(id); err != nil || len(b) != 6 {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// a guest issued before a restart expires within maxTTL at most
+	var expires time.Time
+	if s.maxTTL > 0 {
+		expires = time.Now().Add(s.maxTTL)
+	}
+	if g, ok := s.guests[id]; ok {
+		g.Revoked = true
+		expires = g.Expires
+	}
+	s.revoked[id] = expires
+
+	if err := s.saveRevoked(); err != nil {
+		glog.Warningf("AUTH: save revoked guests to %#v error: %v", s.revokedFile, err)
+	}
+
+	return true
+}
+
+// saveRevoked writes the revoked ids to revokedFile, s.mu must be held.
+func (s *guestStore) saveRevoked() error {
+	if s.revokedFile == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(s.revoked, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return storage.WriteFileAtomic(s.revokedFile, data, 0644)
+}
+
+// purge drops the expired guests and revocations, s.mu must be held.
+func (s *guestStore) purge(now time.Time) {
+	for id, g := range s.guests {
+		if now.After(g.Expires) {
+			delete(s.guests, id)
+		}
+	}
+	for id, expires := range s.revoked {
+		if !expires.IsZero() && now.After(expires) {
+			delete(s.revoked, id)
+		}
+	}
+}
+
+// List returns the guests which have not expired.
+func (s *guestStore) List() []Guest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.purge(time.Now())
+	guests := make([]Guest, 0, len(s.guests))
+	for _, g := range s.guests {
+		g1 := *g
+		g1.Password = ""
+		guests = append(guests, g1)
+	}
+
+	sort.Slice(guests, func(i, j int) bool {
+		return guests[i].Expires.Before(guests[j].Expires)
+	})
+
+	return guests
+}
@@ -1,9 +1,9 @@
 package autoproxy
 
 import (
-	"bufio"
 	"bytes"
 	"context"
+	"crypto/ed25519"
 	"encoding/base64"
 	"fmt"
 	"io"
@@ -14,11 +14,13 @@ import (
 	"os"
 	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	"github.com/phuslu/glog"
 
 	"../../filters"
+	"../../helpers"
 	"../../storage"
 )
 
@@ -28,13 +30,24 @@ const (
 )
 
 type Config struct {
-	MyProxyPAC string
-	GFWList    struct {
-		Enabled  bool
-		URL      string
-		File     string
-		Encoding string
-		Duration int
+	MyProxyPAC      string
+	PACTemplate     string
+	Sites           []string
+	RefreshInterval int
+	CacheFile       string
+	GFWList         struct {
+		Enabled      bool
+		URL          string
+		Mirrors      []string
+		File         string
+		Encoding     string
+		Duration     int
+		ChecksumURL  string
+		SignatureURL string
+		PublicKey    string
+		RangeDelta   bool
+		// download through this filter, e.g. "gae", instead of directly
+		Filter string
 	}
 }
 
@@ -55,9 +68,13 @@ type Filter struct {
 	MyProxyPAC     string
 	GFWListEnabled bool
 	GFWList        *GFWList
+	Downloaders    []*helpers.Downloader
 	AutoProxy2Pac  *AutoProxy2Pac
-	Transport      *http.Transport
+	GFWListSites   *helpers.HostMatcher
+	PACTemplate    *template.Template
+	Transport      http.RoundTripper
 	UpdateChan     chan struct{}
+	muAutoProxy    sync.RWMutex
 }
 
 func init() {
@@ -95,39 +112,31 @@ func NewFilter(config *Config) (_ filters.Filter, err error) {
 		return nil, err
 	}
 
-	if _, err := store.HeadObject(gfwlist.Filename); err != nil {
+	h, err := store.HeadObject(gfwlist.Filename)
+	if err != nil {
 		return nil, err
 	}
 
-	autoproxy2pac := &AutoProxy2Pac{
-		Sites: []string{"google.com"},
+	if config.Sites == nil {
+		config.Sites = []string{"google.com"}
 	}
 
-	object, err := store.GetObject(gfwlist.Filename, -1, -1)
-	if err != nil {
-		return nil, err
+	if config.RefreshInterval <= 0 {
+		config.RefreshInterval = 600
 	}
 
-	rc := object.Body()
-	defer rc.Close()
-
-	var r io.Reader
-	br := bufio.NewReader(rc)
-	if data, err := br.Peek(20); err == nil {
-		if bytes.HasPrefix(data, []byte("[AutoProxy ")) {
-			r = br
-		} else {
-			r = base64.NewDecoder(base64.StdEncoding, br)
-		}
+	var transport http.RoundTripper = &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
 	}
-
-	err = autoproxy2pac.Read(r)
-	if err != nil {
-		return nil, err
+	if config.GFWList.Filter != "" {
+		transport = &filters.Transport{Name: config.GFWList.Filter}
 	}
 
-	transport := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
+	var publicKey ed25519.PublicKey
+	if config.GFWList.SignatureURL != "" {
+		if publicKey, err = helpers.ParsePublicKey(config.GFWList.PublicKey); err != nil {
+			return nil, err
+		}
 	}
 
 	f := &Filter{
@@ -136,11 +145,53 @@ func NewFilter(config *Config) (_ filters.Filter, err error) {
 		MyProxyPAC:     config.MyProxyPAC,
 		GFWListEnabled: config.GFWList.Enabled,
 		GFWList:        &gfwlist,
-		AutoProxy2Pac:  autoproxy2pac,
 		Transport:      transport,
 		UpdateChan:     make(chan struct{}),
 	}
 
+	// the stored gfwlist is not downloaded again unless it is changed
+	lastModified := ""
+	if t, err := time.Parse(store.DateFormat(), h.Get("Last-Modified")); err == nil {
+		lastModified = t.UTC().Format(http.TimeFormat)
+	}
+
+	// mirrors are tried in order if URL fails, the checksum and the
+	// signature are always fetched from the same urls
+	for _, rawurl := range append([]string{gfwlist.URL.String()}, config.GFWList.Mirrors...) {
+		f.Downloaders = append(f.Downloaders, &helpers.Downloader{
+			URL:          rawurl,
+			Transport:    transport,
+			ChecksumURL:  config.GFWList.ChecksumURL,
+			SignatureURL: config.GFWList.SignatureURL,
+			PublicKey:    publicKey,
+			RangeDelta:   config.GFWList.RangeDelta,
+			LastModified: lastModified,
+		})
+	}
+
+	if config.PACTemplate != "" {
+		object, err := store.GetObject(config.PACTemplate, -1, -1)
+		if err != nil {
+			return nil, err
+		}
+
+		rc := object.Body()
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		f.PACTemplate, err = template.New(config.PACTemplate).Parse(string(data))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err = f.loadGFWList(); err != nil {
+		return nil, err
+	}
+
 	if f.GFWListEnabled {
 		go onceUpdater.Do(f.updater)
 	}
@@ -152,10 +203,98 @@ func (f *Filter) FilterName() string {
 	return filterName
 }
 
+// loadGFWList (re)builds AutoProxy2Pac from the stored gfwlist.
+func (f *Filter) loadGFWList() error {
+	object, err := f.Store.GetObject(f.GFWList.Filename, -1, -1)
+	if err != nil {
+		return err
+	}
+
+	rc := object.Body()
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+
+	autoproxy2pac := &AutoProxy2Pac{
+		Sites:    f.Config.Sites,
+		Template: f.PACTemplate,
+	}
+
+	checksum := autoproxy2pac.checksum(data)
+	if f.CacheFile != "" && autoproxy2pac.LoadCache(f.CacheFile, checksum) {
+		glog.V(2).Infof("AUTOPROXY load %d sites of %#v from %#v", len(autoproxy2pac.sites), f.GFWList.Filename, f.CacheFile)
+	} else {
+		var r io.Reader = bytes.NewReader(data)
+		if !bytes.HasPrefix(data, []byte("[AutoProxy ")) {
+			r = base64.NewDecoder(base64.StdEncoding, r)
+		}
+
+		if err = autoproxy2pac.Read(r); err != nil {
+			return err
+		}
+
+		if f.CacheFile != "" {
+			if err := autoproxy2pac.SaveCache(f.CacheFile, checksum); err != nil {
+				glog.Warningf("AUTOPROXY save %#v error: %v", f.CacheFile, err)
+			}
+		}
+	}
+
+	if autoproxy2pac.Template != nil {
+		if err = autoproxy2pac.Template.Execute(ioutil.Discard, PacTemplateData{autoproxy2pac.sites, "PROXY 127.0.0.1:8087"}); err != nil {
+			return err
+		}
+	}
+
+	f.muAutoProxy.Lock()
+	f.AutoProxy2Pac = autoproxy2pac
+	f.GFWListSites = helpers.NewHostMatcher(autoproxy2pac.sites)
+	f.muAutoProxy.Unlock()
+
+	return nil
+}
+
+// MatchGFWList reports whether host or one of its parent domains is listed
+// in the gfwlist.
+func (f *Filter) MatchGFWList(host string) bool {
+	f.muAutoProxy.RLock()
+	sites := f.GFWListSites
+	f.muAutoProxy.RUnlock()
+
+	if sites == nil {
+		return false
+	}
+
+	for {
+		if sites.Match(host) {
+			return true
+		}
+		i := strings.IndexByte(host, '.')
+		if i < 0 {
+			return false
+		}
+		host = host[i+1:]
+	}
+}
+
+// download tries URL and then the mirrors of gfwlist until one succeeds.
+func (f *Filter) download() (data []byte, modified bool, err error) {
+	for _, d := range f.Downloaders {
+		glog.Infof("Downloading %#v", d.URL)
+		if data, modified, err = d.Download(); err == nil {
+			return data, modified, nil
+		}
+		glog.Warningf("Download(%#v) error: %v", d.URL, err)
+	}
+	return nil, false, err
+}
+
 func (f *Filter) updater() {
 	glog.V(2).Infof("start updater for %#v", f.GFWList)
 
-	ticker := time.Tick(10 * time.Minute)
+	ticker := time.Tick(time.Duration(f.Config.RefreshInterval) * time.Second)
 
 	for {
 		needUpdate := false
@@ -191,21 +330,17 @@ func (f *Filter) updater() {
 		}
 
 		if needUpdate {
-			req, err := http.NewRequest("GET", f.GFWList.URL.String(), nil)
+			body, modified, err := f.download()
 			if err != nil {
-				glog.Warningf("NewRequest(%#v) error: %v", f.GFWList.URL.String(), err)
 				continue
 			}
 
-			glog.Infof("Downloading %#v", f.GFWList.URL.String())
-
-			resp, err := f.Transport.RoundTrip(req)
-			if err != nil {
-				glog.Warningf("%T.RoundTrip(%#v) error: %v", f.Transport, f.GFWList.URL.String(), err)
+			if !modified {
+				glog.V(2).Infof("gfwlist(%#v) is not modified", f.GFWList.URL.String())
 				continue
 			}
 
-			var r io.Reader = resp.Body
+			var r io.Reader = bytes.NewReader(body)
 			switch f.GFWList.Encoding {
 			case "base64":
 				r = base64.NewDecoder(base64.StdEncoding, r)
@@ -216,7 +351,6 @@ func (f *Filter) updater() {
 			data, err := ioutil.ReadAll(r)
 			if err != nil {
 				glog.Warningf("ReadAll(%#v) error: %v", r, err)
-				resp.Body.Close()
 				continue
 			}
 
@@ -232,12 +366,19 @@ func (f *Filter) updater() {
 				continue
 			}
 
-			glog.Infof("Update %#v from %#v OK", f.GFWList.Filename, f.GFWList.URL.String())
-			resp.Body.Close()
+			glog.Infof("Update %#v OK", f.GFWList.Filename)
+
+			if err = f.loadGFWList(); err != nil {
+				glog.Warningf("loadGFWList(%#v) error: %v", f.GFWList.Filename, err)
+			}
 		}
 	}
 }
 
+func (f *Filter) Route(req *http.Request) (string, bool) {
+	return filterName, strings.HasPrefix(req.RequestURI, placeholderPath)
+}
+
 func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
 
 	if !strings.HasPrefix(req.RequestURI, placeholderPath) {
@@ -285,7 +426,9 @@ function FindProxyForURL(url, host) {
 	}
 
 	if f.GFWListEnabled {
+		f.muAutoProxy.RLock()
 		data += f.AutoProxy2Pac.GeneratePac(req)
+		f.muAutoProxy.RUnlock()
 	} else {
 		data += `
 function FindProxyForURL(url, host) {
@@ -314,7 +457,7 @@ function FindProxyForURL(url, host) {
 		Body:          ioutil.NopCloser(bytes.NewReader([]byte(data))),
 	}
 
-	glog.V(2).Infof("%s \"AUTOPROXY %s %s %s\" %d %s", req.RemoteAddr, req.Method, req.RequestURI, req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
+	glog.V(2).Infof("%s \"AUTOPROXY %s %s %s\" %d %s", filters.RemoteAddr(req), req.Method, req.RequestURI, req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
 
 	return ctx, resp, nil
 }
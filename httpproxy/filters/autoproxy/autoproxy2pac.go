@@ -3,6 +3,9 @@ package autoproxy
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,13 +13,30 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"text/template"
+
+	"../../storage"
 )
 
+// bumped whenever Read makes something else of the same gfwlist
+const pacCacheVersion = 1
+
+var plainSiteRegexp = regexp.MustCompile(`^[a-zA-Z0-9\.\_\-]+$`)
+
 type AutoProxy2Pac struct {
 	Sites    []string
+	Template *template.Template
+	sites    []string
 	template string
 }
 
+// PacTemplateData is passed to a user-defined PAC template, Sites are the
+// domains which should go through Proxy.
+type PacTemplateData struct {
+	Sites []string
+	Proxy string
+}
+
 func (a *AutoProxy2Pac) Read(r io.Reader) error {
 	scanner := bufio.NewScanner(r)
 
@@ -63,7 +83,7 @@ func (a *AutoProxy2Pac) Read(r io.Reader) error {
 			sites[site] = struct{}{}
 		case !strings.ContainsAny(s, "*"):
 			site := strings.Split(s, "/")[0]
-			if regexp.MustCompile(`^[a-zA-Z0-9\.\_\-]+$`).MatchString(site) {
+			if plainSiteRegexp.MatchString(site) {
 				sites[site] = struct{}{}
 			}
 		}
@@ -77,19 +97,25 @@ func (a *AutoProxy2Pac) Read(r io.Reader) error {
 	for s, _ := range sites {
 		sites1 = append(sites1, s)
 	}
+	for _, s := range a.Sites {
+		if _, ok := sites[s]; !ok {
+			sites1 = append(sites1, s)
+		}
+	}
 	sort.Strings(sites1)
+	a.sites = sites1
+
+	if a.Template != nil {
+		return nil
+	}
 
 	var b bytes.Buffer
 	var w io.Writer = &b
 
 	io.WriteString(w, "var sites = {\n")
 
-	for _, s := range sites1 {
-		fmt.Fprintf(w, "'%s': 1,\n", s)
-	}
-
-	for i, s := range a.Sites {
-		if i == len(a.Sites)-1 {
+	for i, s := range sites1 {
+		if i == len(sites1)-1 {
 			fmt.Fprintf(w, "'%s': 1", s)
 		} else {
 			fmt.Fprintf(w, "'%s': 1,\n", s)
@@ -129,7 +155,62 @@ function FindProxyForURL(url, host) {
 	return nil
 }
 
+// pacCache is what Read makes of a gfwlist, kept on disk so that a restart
+// skips parsing the same gfwlist again.
+type pacCache struct {
+	Checksum string
+	Sites    []string
+	Template string
+}
+
+// checksum identifies the result of Read for gfwlist.
+func (a *AutoProxy2Pac) checksum(gfwlist []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%d\x00%s\x00%v\x00", pacCacheVersion, strings.Join(a.Sites, ","), a.Template != nil)
+	h.Write(gfwlist)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// LoadCache restores the result of Read from filename if it was saved for
+// checksum.
+func (a *AutoProxy2Pac) LoadCache(filename, checksum string) bool {
+	data, _, err := storage.ReadFileVerified(filename, nil)
+	if err != nil {
+		return false
+	}
+
+	var c pacCache
+	if err := json.Unmarshal(data, &c); err != nil || c.Checksum != checksum {
+		return false
+	}
+
+	a.sites, a.template = c.Sites, c.Template
+	return true
+}
+
+// SaveCache writes the result of Read to filename for checksum.
+func (a *AutoProxy2Pac) SaveCache(filename, checksum string) error {
+	data, err := json.Marshal(&pacCache{
+		Checksum: checksum,
+		Sites:    a.sites,
+		Template: a.template,
+	})
+	if err != nil {
+		return err
+	}
+
+	return storage.WriteFileAtomic(filename, data, 0644)
+}
+
 func (a *AutoProxy2Pac) GeneratePac(req *http.Request) string {
+	if a.Template != nil {
+		var b bytes.Buffer
+		if err := a.Template.Execute(&b, PacTemplateData{a.sites, "PROXY " + req.URL.Host}); err != nil {
+			panic(fmt.Errorf("%T.Execute(%#v) error: %v", a.Template, a.Template.Name(), err))
+		}
+		return b.String()
+	}
+
 	if a.template == "" {
 		panic(fmt.Errorf("%T(%#v) has a empty template", a, a))
 	}
@@ -3,6 +3,8 @@ package autorange
 import (
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
@@ -17,6 +19,9 @@ import (
 
 const (
 	filterName string = "autorange"
+
+	// Content-Range mismatches of a chunk in a row before the download fails
+	maxRangeMismatches int = 3
 )
 
 type Config struct {
@@ -163,22 +168,25 @@ func (f *Filter) Response(ctx context.Context, resp *http.Response) (context.Con
 	go func(w *autoPipeWriter, filter filters.RoundTripFilter, req0 *http.Request, start, length int64) {
 		glog.V(2).Infof("AUTORANGE begin rangefetch for %#v by using %#v", req0.URL.String(), filter.FilterName())
 
-		req, err := http.NewRequest(req0.Method, req0.URL.String(), nil)
-		if err != nil {
-			glog.Warningf("AUTORANGE http.NewRequest(%#v) error: %#v", req, err)
+		req := filters.ReplayRequest(req0)
+
+		if err := w.WaitForReading(); err != nil {
 			return
 		}
 
-		for key, values := range req0.Header {
-			for _, value := range values {
-				req.Header.Add(key, value)
+		// open the connections of the chunks at once instead of one by one
+		if p, ok := filter.(filters.Prewarmer); ok {
+			threads := f.Threads
+			if chunks := int((length - start + 1024<<10 - 1) / (1024 << 10)); chunks < threads {
+				threads = chunks
+			}
+			if n := p.Prewarm(req, threads); n > 0 {
+				glog.V(2).Infof("AUTORANGE prewarmed %d connections for %#v", n, req.URL.String())
 			}
 		}
 
-		if err := w.WaitForReading(); err != nil {
-			return
-		}
 		var index uint32
+		var mismatches int
 		for {
 			if w.FatalErr() {
 				break
@@ -207,28 +215,53 @@ func (f *Filter) Response(ctx context.Context, resp *http.Response) (context.Con
 				time.Sleep(1 * time.Second)
 				continue
 			}
-			if resp.StatusCode != http.StatusPartialContent {
+
+			switch resp.StatusCode {
+			case http.StatusPartialContent:
+				break
+			case http.StatusOK:
+				// the server ignores Range, the rest of the body is read from this response alone
+				glog.Warningf("AUTORANGE %#v ignores Range, switch to a single stream from %d", req.URL.String(), start)
+				piper := w.NewPiper(index)
+				w.Close()
+				if resp.ContentLength >= 0 && resp.ContentLength != length {
+					resp.Body.Close()
+					glog.Warningf("AUTORANGE %#v length changed from %d to %d", req.URL.String(), length, resp.ContentLength)
+					piper.EIndex()
+					piper.WClose()
+					return
+				}
+				w.ThreadHello()
+				go copyChunk(w, piper, resp, start, length-start)
+				return
+			default:
+				resp.Body.Close()
 				if resp.StatusCode >= http.StatusBadRequest {
 					time.Sleep(1 * time.Second)
 				}
 				continue
 			}
 
-			w.ThreadHello()
-			go func(index uint32, resp *http.Response) {
-				defer resp.Body.Close()
-				defer w.ThreadBye() // TODO: launch it as soon as iocopy over?
-
-				piper := w.NewPiper(index)
-				_, err := helpers.IoCopy(piper, resp.Body)
-				if err != nil {
-					glog.Warningf("AUTORANGE helpers.IoCopy(%#v) error: %#v", resp.Body, err)
+			end1, err := chunkRange(resp, start, end, length)
+			if err != nil {
+				resp.Body.Close()
+				glog.Warningf("AUTORANGE %#v bytes=%d-%d error: %v", req.URL.String(), start, end, err)
+				if mismatches++; mismatches >= maxRangeMismatches {
+					piper := w.NewPiper(index)
 					piper.EIndex()
+					piper.WClose()
+					break
 				}
-				piper.WClose()
-			}(index, resp)
+				time.Sleep(1 * time.Second)
+				continue
+			}
+			mismatches = 0
 
-			start = end + 1
+			w.ThreadHello()
+			go copyChunk(w, w.NewPiper(index), resp, 0, end1-start+1)
+
+			// a server capping the size of ranges may return less than asked
+			start = end1 + 1
 			index++
 		}
 	}(w, f1, resp.Request, end+1, length)
@@ -237,3 +270,57 @@ func (f *Filter) Response(ctx context.Context, resp *http.Response) (context.Con
 
 	return ctx, resp, nil
 }
+
+// chunkRange checks the Content-Range of the response to bytes=start-end of
+// a body of length bytes, and returns the end it covers, which may be short
+// of end.
+func chunkRange(resp *http.Response, start, end, length int64) (int64, error) {
+	s := resp.Header.Get("Content-Range")
+
+	var start1, end1, length1 int64
+	if _, err := fmt.Sscanf(s, "bytes %d-%d/%d", &start1, &end1, &length1); err != nil {
+		return 0, fmt.Errorf("malformed Content-Range %#v", s)
+	}
+
+	switch {
+	case length1 != length:
+		return 0, fmt.Errorf("Content-Range %#v, the length was %d", s, length)
+	case start1 != start || end1 < start1 || end1 > end:
+		return 0, fmt.Errorf("Content-Range %#v mismatch bytes=%d-%d", s, start, end)
+	case resp.ContentLength >= 0 && resp.ContentLength != end1-start1+1:
+		return 0, fmt.Errorf("Content-Range %#v mismatch Content-Length %d", s, resp.ContentLength)
+	}
+
+	return end1, nil
+}
+
+// copyChunk writes size bytes of resp.Body after skip ones to piper, a short
+// or a long body fails the pipe from piper on.
+func copyChunk(w *autoPipeWriter, piper *piper, resp *http.Response, skip, size int64) {
+	defer resp.Body.Close()
+	defer w.ThreadBye()
+	defer piper.WClose()
+
+	if skip > 0 {
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, skip); err != nil {
+			glog.Warningf("AUTORANGE skip %d bytes of %#v error: %v", skip, resp.Request.URL.String(), err)
+			piper.EIndex()
+			return
+		}
+	}
+
+	n, err := helpers.IoCopy(piper, io.LimitReader(resp.Body, size))
+	if err == nil && n != size {
+		err = fmt.Errorf("short chunk, got %d of %d bytes", n, size)
+	}
+	if err == nil {
+		var b [1]byte
+		if m, _ := resp.Body.Read(b[:]); m > 0 {
+			err = fmt.Errorf("long chunk, more than %d bytes", size)
+		}
+	}
+	if err != nil {
+		glog.Warningf("AUTORANGE helpers.IoCopy(%#v) error: %v", resp.Body, err)
+		piper.EIndex()
+	}
+}
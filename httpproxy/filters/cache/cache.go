@@ -0,0 +1,357 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../../filters"
+	"../../helpers"
+	"../../storage"
+)
+
+const (
+	filterName string = "cache"
+)
+
+type Config struct {
+	Sites         []string
+	MaxSize       int64
+	MaxObjectSize int64
+	Eviction      string
+	Dir           string
+	BypassHeader  string
+}
+
+type Filter struct {
+	Config
+	SiteMatcher *helpers.HostMatcher
+	Metrics     helpers.MetricsRecorder
+	store       *store
+}
+
+func init() {
+	filename := filterName + ".json"
+	config := new(Config)
+	err := storage.ReadJsonConfig(storage.LookupConfigStoreURI(filterName), filename, config)
+	if err != nil {
+		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	err = filters.Register(filterName, &filters.RegisteredFilter{
+		New: func() (filters.Filter, error) {
+			return NewFilter(config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	switch config.Eviction {
+	case "":
+		config.Eviction = EvictionLRU
+	case EvictionLRU, EvictionFIFO:
+		break
+	default:
+		return nil, fmt.Errorf("CACHE: unknown Eviction %#v", config.Eviction)
+	}
+
+	if config.MaxObjectSize <= 0 || config.MaxObjectSize > config.MaxSize {
+		config.MaxObjectSize = config.MaxSize
+	}
+
+	s, err := newStore(config.MaxSize, config.Eviction, config.Dir)
+	if err != nil {
+		return nil, err
+	}
+	helpers.RegisterMemoryUser(filterName, s)
+
+	return &Filter{
+		Config:      *config,
+		SiteMatcher: helpers.NewHostMatcher(config.Sites),
+		Metrics:     helpers.DefaultMetrics,
+		store:       s,
+	}, nil
+}
+
+func (f *Filter) FilterName() string {
+	return filterName
+}
+
+// RoundTrip serves fresh entries, a stale entry with validators turns the
+// request into a conditional one which is completed in Response.
+func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	if !f.cacheable(req) {
+		return ctx, nil, nil
+	}
+
+	key := cacheKey(req)
+	ctx = filters.WithString(ctx, "cache.key", key)
+
+	e, ok := f.store.get(key)
+	if !ok {
+		f.count("miss")
+		return filters.WithBool(ctx, "cache.miss", true), nil, nil
+	}
+
+	now := time.Now()
+	reqDirectives := parseCacheControl(req.Header.Get("Cache-Control"))
+	_, noCache := reqDirectives["no-cache"]
+	if !noCache && req.Header.Get("Pragma") != "no-cache" && e.fresh(now) {
+		resp, err := f.response(req, e, now)
+		if err != nil {
+			f.store.del(key)
+			f.count("miss")
+			return filters.WithBool(ctx, "cache.miss", true), nil, nil
+		}
+		f.count("hit")
+		glog.V(2).Infof("%s \"CACHE %s %s %s\" HIT %d %s", filters.RemoteAddr(req), req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
+		return ctx, resp, nil
+	}
+
+	if req.Header.Get("If-None-Match") == "" && req.Header.Get("If-Modified-Since") == "" {
+		etag, lastModified := e.header.Get("ETag"), e.header.Get("Last-Modified")
+		if etag != "" || lastModified != "" {
+			if etag != "" {
+				req.Header.Set("If-None-Match", etag)
+			}
+			if lastModified != "" {
+				req.Header.Set("If-Modified-Since", lastModified)
+			}
+			f.count("revalidate")
+			return filters.WithBool(ctx, "cache.revalidate", true), nil, nil
+		}
+	}
+
+	f.count("miss")
+	return filters.WithBool(ctx, "cache.miss", true), nil, nil
+}
+
+func (f *Filter) count(result string) {
+	if f.Metrics != nil {
+		f.Metrics.IncCounter("goproxy_cache_requests_total", "result", result)
+	}
+}
+
+func (f *Filter) Response(ctx context.Context, resp *http.Response) (context.Context, *http.Response, error) {
+	req := resp.Request
+	if req == nil {
+		return ctx, resp, nil
+	}
+
+	// the filters after RoundTrip may have changed the headers of req
+	key := filters.String(ctx, "cache.key")
+	if key == "" {
+		key = cacheKey(req)
+	}
+
+	if ok1, ok := filters.Bool(ctx, "cache.revalidate"); ok && ok1 {
+		req.Header.Del("If-None-Match")
+		req.Header.Del("If-Modified-Since")
+
+		e, ok := f.store.get(key)
+		if resp.StatusCode == http.StatusNotModified && ok {
+			now := time.Now()
+			if expires, ok := freshUntil(resp.Header, now); ok {
+				f.store.refresh(e, resp.Header, now, expires)
+			}
+			resp1, err := f.response(req, e, now)
+			if err == nil {
+				resp.Body.Close()
+				f.count("revalidated")
+				glog.V(2).Infof("%s \"CACHE %s %s %s\" REVALIDATED %d %s", filters.RemoteAddr(req), req.Method, req.URL.String(), req.Proto, resp1.StatusCode, resp1.Header.Get("Content-Length"))
+				return ctx, resp1, nil
+			}
+			f.store.del(key)
+		}
+	} else if ok1, ok := filters.Bool(ctx, "cache.miss"); !ok || !ok1 {
+		return ctx, resp, nil
+	}
+
+	if resp.StatusCode != http.StatusOK || resp.ContentLength <= 0 || resp.ContentLength > f.MaxObjectSize {
+		return ctx, resp, nil
+	}
+
+	// the key has the Accept-Encoding of the request, other Vary headers are
+	// not kept apart
+	if vary := resp.Header.Get("Vary"); vary != "" && !strings.EqualFold(vary, "Accept-Encoding") {
+		return ctx, resp, nil
+	}
+
+	now := time.Now()
+	directives := parseCacheControl(resp.Header.Get("Cache-Control"))
+	for _, name := range []string{"no-store", "private", "no-cache"} {
+		if _, ok := directives[name]; ok {
+			return ctx, resp, nil
+		}
+	}
+	if resp.Header.Get("Set-Cookie") != "" {
+		return ctx, resp, nil
+	}
+	// a response to a request with cookies may be personal, it is only
+	// shared with other clients if it is explicitly public.
+	if _, ok := directives["public"]; !ok && req.Header.Get("Cookie") != "" {
+		return ctx, resp, nil
+	}
+
+	expires, ok := freshUntil(resp.Header, now)
+	if !ok {
+		return ctx, resp, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, resp.ContentLength+1))
+	if err != nil {
+		resp.Body.Close()
+		return ctx, nil, err
+	}
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if int64(len(body)) != resp.ContentLength {
+		return ctx, resp, nil
+	}
+
+	header := make(http.Header, len(resp.Header))
+	for k, v := range resp.Header {
+		header[k] = append([]string(nil), v...)
+	}
+
+	err = f.store.put(&entry{
+		key:        key,
+		statusCode: resp.StatusCode,
+		header:     header,
+		body:       body,
+		size:       int64(len(body)),
+		date:       now,
+		expires:    expires,
+	})
+	if err != nil {
+		glog.Warningf("CACHE store %#v error: %v", key, err)
+	} else {
+		glog.V(2).Infof("%s \"CACHE %s %s %s\" STORE %d %d", filters.RemoteAddr(req), req.Method, req.URL.String(), req.Proto, resp.StatusCode, len(body))
+	}
+
+	return ctx, resp, nil
+}
+
+// cacheKey is the url of req and its Accept-Encoding, so that a response of
+// "Vary: Accept-Encoding" is only served to the clients which accept it.
+func cacheKey(req *http.Request) string {
+	key := req.URL.String()
+	if ae := req.Header.Get("Accept-Encoding"); ae != "" {
+		key += "\nAccept-Encoding: " + strings.ToLower(strings.Replace(ae, " ", "", -1))
+	}
+	return key
+}
+
+func (f *Filter) cacheable(req *http.Request) bool {
+	if req.Method != http.MethodGet || req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return false
+	}
+
+	if f.BypassHeader != "" && req.Header.Get(f.BypassHeader) != "" {
+		req.Header.Del(f.BypassHeader)
+		return false
+	}
+
+	if req.Header.Get("Range") != "" || req.Header.Get("Authorization") != "" {
+		return false
+	}
+
+	if _, ok := parseCacheControl(req.Header.Get("Cache-Control"))["no-store"]; ok {
+		return false
+	}
+
+	return f.SiteMatcher.Match(req.Host)
+}
+
+func (f *Filter) response(req *http.Request, e *entry, now time.Time) (*http.Response, error) {
+	body, err := e.open()
+	if err != nil {
+		return nil, err
+	}
+
+	header := make(http.Header, len(e.header)+2)
+	for k, v := range e.header {
+		header[k] = v
+	}
+	header.Set("Age", strconv.FormatInt(int64(now.Sub(e.date)/time.Second), 10))
+	header.Set("X-Cache", "HIT")
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.statusCode, http.StatusText(e.statusCode)),
+		StatusCode:    e.statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Request:       req,
+		ContentLength: e.size,
+		Body:          body,
+	}, nil
+}
+
+func parseCacheControl(s string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		name := strings.ToLower(strings.TrimSpace(kv[0]))
+		if len(kv) == 2 {
+			directives[name] = strings.Trim(strings.TrimSpace(kv[1]), "\"")
+		} else {
+			directives[name] = ""
+		}
+	}
+	return directives
+}
+
+// freshUntil computes the expiry of a response from s-maxage, max-age,
+// Expires or 10% of its age since Last-Modified, in this order.
+func freshUntil(header http.Header, now time.Time) (time.Time, bool) {
+	directives := parseCacheControl(header.Get("Cache-Control"))
+	for _, name := range []string{"s-maxage", "max-age"} {
+		if v, ok := directives[name]; ok {
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+				return now.Add(time.Duration(n) * time.Second), true
+			}
+			return time.Time{}, false
+		}
+	}
+
+	date := now
+	if t, err := http.ParseTime(header.Get("Date")); err == nil {
+		date = t
+	}
+
+	if v := header.Get("Expires"); v != "" {
+		if t, err := http.ParseTime(v); err == nil && t.After(date) {
+			return now.Add(t.Sub(date)), true
+		}
+		return time.Time{}, false
+	}
+
+	if t, err := http.ParseTime(header.Get("Last-Modified")); err == nil && t.Before(date) {
+		heuristic := date.Sub(t) / 10
+		if heuristic > 24*time.Hour {
+			heuristic = 24 * time.Hour
+		}
+		return now.Add(heuristic), true
+	}
+
+	return time.Time{}, false
+}
@@ -0,0 +1,176 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+)
+
+const (
+	EvictionLRU  string = "lru"
+	EvictionFIFO string = "fifo"
+)
+
+type entry struct {
+	key        string
+	statusCode int
+	header     http.Header
+	body       []byte
+	filename   string
+	size       int64
+	date       time.Time
+	expires    time.Time
+	elem       *list.Element
+}
+
+func (e *entry) fresh(now time.Time) bool {
+	return now.Before(e.expires)
+}
+
+func (e *entry) open() (io.ReadCloser, error) {
+	if e.filename == "" {
+		return ioutil.NopCloser(bytes.NewReader(e.body)), nil
+	}
+	return os.Open(e.filename)
+}
+
+// store keeps at most maxSize bytes of bodies in memory or under dir, the
+// oldest (fifo) or least recently used (lru) entries are evicted first.
+type store struct {
+	mu       sync.Mutex
+	items    map[string]*entry
+	ll       *list.List
+	size     int64
+	maxSize  int64
+	eviction string
+	dir      string
+}
+
+func newStore(maxSize int64, eviction, dir string) (*store, error) {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+
+	return &store{
+		items:    make(map[string]*entry),
+		ll:       list.New(),
+		maxSize:  maxSize,
+		eviction: eviction,
+		dir:      dir,
+	}, nil
+}
+
+func (s *store) get(key string) (*entry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.items[key]
+	if ok && s.eviction == EvictionLRU {
+		s.ll.MoveToFront(e.elem)
+	}
+	return e, ok
+}
+
+func (s *store) put(e *entry) error {
+	if e.size > s.maxSize {
+		return nil
+	}
+
+	if s.dir != "" {
+		sum := sha1.Sum([]byte(e.key))
+		e.filename = filepath.Join(s.dir, hex.EncodeToString(sum[:]))
+		if err := ioutil.WriteFile(e.filename+".tmp", e.body, 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(e.filename+".tmp", e.filename); err != nil {
+			return err
+		}
+		e.body = nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if old, ok := s.items[e.key]; ok {
+		s.remove(old, old.filename != e.filename)
+	}
+
+	e.elem = s.ll.PushFront(e)
+	s.items[e.key] = e
+	s.size += e.size
+
+	for s.size > s.maxSize {
+		s.remove(s.ll.Back().Value.(*entry), true)
+	}
+
+	return nil
+}
+
+// refresh updates the freshness of e after a 304 revalidation.
+func (s *store) refresh(e *entry, header http.Header, date, expires time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range []string{"Cache-Control", "Date", "ETag", "Expires", "Last-Modified"} {
+		if v := header.Get(key); v != "" {
+			e.header.Set(key, v)
+		}
+	}
+	e.date = date
+	e.expires = expires
+}
+
+func (s *store) del(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.items[key]; ok {
+		s.remove(e, true)
+	}
+}
+
+// remove must be called with s.mu held.
+func (s *store) remove(e *entry, removeFile bool) {
+	s.ll.Remove(e.elem)
+	delete(s.items, e.key)
+	s.size -= e.size
+	if removeFile && e.filename != "" {
+		if err := os.Remove(e.filename); err != nil && !os.IsNotExist(err) {
+			glog.Warningf("CACHE os.Remove(%#v) error: %v", e.filename, err)
+		}
+	}
+}
+
+// MemoryUsage is the size of the bodies kept in memory.
+func (s *store) MemoryUsage() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dir != "" {
+		return 0
+	}
+	return s.size
+}
+
+// Shrink evicts entries in eviction order until fraction of the size is freed.
+func (s *store) Shrink(fraction float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	want := s.size - int64(float64(s.size)*fraction)
+	for s.size > want && s.ll.Len() > 0 {
+		s.remove(s.ll.Back().Value.(*entry), true)
+	}
+}
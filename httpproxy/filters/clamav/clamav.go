@@ -0,0 +1,257 @@
+package clamav
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../../filters"
+	"../../helpers"
+	"../../storage"
+)
+
+const (
+	filterName string = "clamav"
+
+	PolicyBlock string = "block"
+	PolicyWarn  string = "warn"
+
+	// clamd's StreamMaxLength defaults to 25M, it fails larger streams
+	defaultMaxSize int64 = 25 * 1024 * 1024
+	// the INSTREAM chunk size
+	chunkSize int = 64 * 1024
+)
+
+type Config struct {
+	// "unix" or "tcp"
+	Network string
+	Address string
+	// seconds to connect to clamd and get the result
+	Timeout int
+	// bytes, larger bodies are passed unscanned
+	MaxSize int64
+	// "block" replaces an infected response with a 403 page, "warn" passes
+	// it with X-Virus-Found
+	Policy string
+	// pass the bodies unscanned if clamd fails, or else block them
+	FailOpen     bool
+	Extensions   []string
+	ContentTypes []string
+}
+
+// Filter sends the downloads which look like executables or archives to clamd
+// and blocks the infected ones. The body is buffered up to MaxSize as the
+// response cannot be taken back once it is sent to the client.
+type Filter struct {
+	Config
+	Extensions   map[string]struct{}
+	ContentTypes map[string]struct{}
+}
+
+func init() {
+	filename := filterName + ".json"
+	config := new(Config)
+	err := storage.ReadJsonConfig(storage.LookupConfigStoreURI(filterName), filename, config)
+	if err != nil {
+		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	err = filters.Register(filterName, &filters.RegisteredFilter{
+		New: func() (filters.Filter, error) {
+			return NewFilter(config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	switch config.Network {
+	case "unix", "tcp":
+		break
+	default:
+		return nil, fmt.Errorf("CLAMAV: unknown Network %#v, want \"unix\" or \"tcp\"", config.Network)
+	}
+
+	switch config.Policy {
+	case "":
+		config.Policy = PolicyBlock
+	case PolicyBlock, PolicyWarn:
+		break
+	default:
+		return nil, fmt.Errorf("CLAMAV: unknown Policy %#v, want %#v or %#v", config.Policy, PolicyBlock, PolicyWarn)
+	}
+
+	if config.MaxSize <= 0 {
+		config.MaxSize = defaultMaxSize
+	}
+
+	if config.Timeout <= 0 {
+		config.Timeout = 30
+	}
+
+	f := &Filter{
+		Config:       *config,
+		Extensions:   make(map[string]struct{}),
+		ContentTypes: make(map[string]struct{}),
+	}
+
+	for _, ext := range config.Extensions {
+		f.Extensions["."+strings.TrimPrefix(strings.ToLower(ext), ".")] = struct{}{}
+	}
+	for _, ct := range config.ContentTypes {
+		f.ContentTypes[strings.ToLower(ct)] = struct{}{}
+	}
+
+	return f, nil
+}
+
+func (f *Filter) FilterName() string {
+	return filterName
+}
+
+func (f *Filter) Response(ctx context.Context, resp *http.Response) (context.Context, *http.Response, error) {
+	req := resp.Request
+	if req == nil || req.Method == http.MethodHead || resp.StatusCode != http.StatusOK || resp.Body == nil || resp.Body == http.NoBody {
+		return ctx, resp, nil
+	}
+
+	if resp.ContentLength > f.MaxSize || !f.wantsScan(req, resp) {
+		return ctx, resp, nil
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, f.MaxSize+1))
+	if err != nil || int64(len(data)) > f.MaxSize {
+		// pass what is read and the rest as is
+		resp.Body = readCloser{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+		return ctx, resp, nil
+	}
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+	start := time.Now()
+	virus, err := f.scan(data)
+	if err != nil {
+		glog.Warningf("%s \"CLAMAV %s %s %s\" scan %d bytes error: %v", filters.RemoteAddr(req), req.Method, req.URL.String(), req.Proto, len(data), err)
+		if f.FailOpen {
+			return ctx, resp, nil
+		}
+		return ctx, f.newResponse(req, http.StatusBadGateway, fmt.Sprintf("The download of %s could not be scanned for viruses.", req.URL.String())), nil
+	}
+
+	if virus == "" {
+		glog.V(2).Infof("%s \"CLAMAV %s %s %s\" %d bytes OK in %s", filters.RemoteAddr(req), req.Method, req.URL.String(), req.Proto, len(data), time.Since(start))
+		return ctx, resp, nil
+	}
+
+	glog.Warningf("%s \"CLAMAV %s %s %s\" %s FOUND, policy %s", filters.RemoteAddr(req), req.Method, req.URL.String(), req.Proto, virus, f.Policy)
+
+	if f.Policy == PolicyWarn {
+		resp.Header.Set("X-Virus-Found", virus)
+		return ctx, resp, nil
+	}
+
+	return ctx, f.newResponse(req, http.StatusForbidden, fmt.Sprintf("The download of %s is blocked, it contains %s.", req.URL.String(), virus)), nil
+}
+
+// wantsScan reports whether the response is an executable or an archive, by
+// the extension of the url path or the Content-Disposition filename, or by
+// its Content-Type.
+func (f *Filter) wantsScan(req *http.Request, resp *http.Response) bool {
+	names := []string{req.URL.Path}
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		names = append(names, params["filename"])
+	}
+	for _, name := range names {
+		if _, ok := f.Extensions[strings.ToLower(path.Ext(name))]; ok {
+			return true
+		}
+	}
+
+	ct := strings.ToLower(strings.TrimSpace(strings.SplitN(resp.Header.Get("Content-Type"), ";", 2)[0]))
+	_, ok := f.ContentTypes[ct]
+	return ok
+}
+
+// scan sends data to clamd with INSTREAM and returns the name of the virus
+// found, or "" if it is clean.
+func (f *Filter) scan(data []byte) (string, error) {
+	timeout := time.Duration(f.Timeout) * time.Second
+
+	conn, err := net.DialTimeout(f.Network, f.Address, timeout)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	// the z prefix makes the commands and the reply end with \0
+	if _, err = conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", err
+	}
+
+	size := make([]byte, 4)
+	for len(data) > 0 {
+		n := len(data)
+		if n > chunkSize {
+			n = chunkSize
+		}
+		binary.BigEndian.PutUint32(size, uint32(n))
+		if _, err = conn.Write(size); err != nil {
+			return "", err
+		}
+		if _, err = conn.Write(data[:n]); err != nil {
+			return "", err
+		}
+		data = data[n:]
+	}
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err = conn.Write(size); err != nil {
+		return "", err
+	}
+
+	reply, err := ioutil.ReadAll(io.LimitReader(conn, 4096))
+	if err != nil {
+		return "", err
+	}
+
+	return parseReply(string(bytes.TrimRight(reply, "\x00\n")))
+}
+
+// parseReply parses "stream: OK", "stream: <name> FOUND" or
+// "<message> ERROR" of clamd.
+func parseReply(reply string) (string, error) {
+	switch {
+	case strings.HasSuffix(reply, " FOUND"):
+		return strings.TrimSpace(strings.TrimPrefix(strings.TrimSuffix(reply, " FOUND"), "stream:")), nil
+	case strings.HasSuffix(reply, ": OK"):
+		return "", nil
+	default:
+		return "", fmt.Errorf("clamd reply %#v", reply)
+	}
+}
+
+// newResponse tells the client why the download is withheld, in an error
+// page if they are enabled.
+func (f *Filter) newResponse(req *http.Request, code int, message string) *http.Response {
+	return helpers.BlockResponse(req, code, filterName, message)
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
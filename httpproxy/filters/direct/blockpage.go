@@ -0,0 +1,76 @@
+package direct
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"../../helpers"
+)
+
+const (
+	// only the beginning of a body is searched for fingerprints
+	blockPagePeekSize int64 = 8192
+)
+
+// BlockPageDetector recognizes the responses injected by a middlebox instead
+// of the ones of the origin server.
+type BlockPageDetector struct {
+	// Fingerprints are substrings of the injected html pages.
+	Fingerprints []string
+	// Redirects are the portal hosts an injected redirect points to.
+	Redirects *helpers.HostMatcher
+	// Issuers are substrings of the issuer of injected certificates.
+	Issuers []string
+}
+
+// Detect returns a non-nil error if resp looks injected. The body of resp is
+// peeked for fingerprints and restored, so resp can be used afterwards.
+func (b *BlockPageDetector) Detect(resp *http.Response) error {
+	if b.Redirects != nil {
+		switch resp.StatusCode {
+		case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect:
+			if u, err := url.Parse(resp.Header.Get("Location")); err == nil && u.Host != "" {
+				host := u.Host
+				if h, _, err := net.SplitHostPort(host); err == nil {
+					host = h
+				}
+				if b.Redirects.Match(host) {
+					return fmt.Errorf("redirect to portal %#v", u.String())
+				}
+			}
+		}
+	}
+
+	if resp.TLS != nil && len(resp.TLS.PeerCertificates) > 0 && len(b.Issuers) > 0 {
+		issuer := resp.TLS.PeerCertificates[0].Issuer.String()
+		for _, s := range b.Issuers {
+			if strings.Contains(issuer, s) {
+				return fmt.Errorf("certificate issued by %#v", issuer)
+			}
+		}
+	}
+
+	if len(b.Fingerprints) > 0 && resp.Body != nil && strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html") && resp.Header.Get("Content-Encoding") == "" {
+		data, err := ioutil.ReadAll(io.LimitReader(resp.Body, blockPagePeekSize))
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+		if err != nil {
+			return nil
+		}
+		for _, s := range b.Fingerprints {
+			if bytes.Contains(data, []byte(s)) {
+				return fmt.Errorf("body matches fingerprint %#v", s)
+			}
+		}
+	}
+
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/cloudflare/golibs/lrucache"
@@ -24,13 +25,15 @@ const (
 )
 
 type Config struct {
-	Transport struct {
+	FastConnect bool
+	Transport   struct {
 		Dialer struct {
 			Timeout        int
 			KeepAlive      int
 			DualStack      bool
 			RetryTimes     int
 			RetryDelay     float32
+			RetryPolicy    string
 			DNSCacheExpiry int
 			DNSCacheSize   uint
 		}
@@ -43,12 +46,64 @@ type Config struct {
 		TLSHandshakeTimeout int
 		MaxIdleConnsPerHost int
 	}
+	DeadlinePolicies map[string]helpers.DeadlinePolicy
+	Headers          helpers.HeaderNormalization
+	BlockPage        struct {
+		Enabled      bool
+		Fingerprints []string
+		Redirects    []string
+		Issuers      []string
+		BadIPExpiry  int
+	}
 }
 
 type Filter struct {
 	Config
 	filters.RoundTripFilter
 	transport *http.Transport
+	dialer    *dialer.Dialer
+	options   *options
+	muConfig  sync.RWMutex
+}
+
+// options are the settings of direct.json which Reload swaps in.
+type options struct {
+	fastConnect bool
+	deadlines   *helpers.DeadlinePolicies
+	headers     *helpers.HeaderNormalizer
+	blockPage   *BlockPageDetector
+	badIPExpiry time.Duration
+}
+
+func newOptions(config *Config) (*options, error) {
+	o := &options{
+		fastConnect: config.FastConnect,
+		headers:     helpers.NewHeaderNormalizer(config.Headers),
+	}
+
+	if len(config.DeadlinePolicies) > 0 {
+		deadlines, err := helpers.NewDeadlinePolicies(helpers.DeadlinePolicy{
+			ConnectTimeout: config.Transport.Dialer.Timeout,
+		}, config.DeadlinePolicies)
+		if err != nil {
+			return nil, fmt.Errorf("DIRECT: %v", err)
+		}
+		o.deadlines = deadlines
+	}
+
+	if config.BlockPage.Enabled {
+		o.blockPage = &BlockPageDetector{
+			Fingerprints: config.BlockPage.Fingerprints,
+			Redirects:    helpers.NewHostMatcher(config.BlockPage.Redirects),
+			Issuers:      config.BlockPage.Issuers,
+		}
+		o.badIPExpiry = time.Duration(config.BlockPage.BadIPExpiry) * time.Second
+		if o.badIPExpiry <= 0 {
+			o.badIPExpiry = time.Hour
+		}
+	}
+
+	return o, nil
 }
 
 func init() {
@@ -78,10 +133,20 @@ func NewFilter(config *Config) (filters.Filter, error) {
 			DualStack: config.Transport.Dialer.DualStack,
 		},
 		RetryTimes:     config.Transport.Dialer.RetryTimes,
-		RetryDelay:     time.Duration(config.Transport.Dialer.RetryDelay*1000) * time.Second,
-		DNSCache:       lrucache.NewLRUCache(config.Transport.Dialer.DNSCacheSize),
+		RetryDelay:     time.Duration(config.Transport.Dialer.RetryDelay*1000) * time.Millisecond,
+		DNSCache:       helpers.NewKeyedCache(lrucache.NewLRUCache(config.Transport.Dialer.DNSCacheSize)),
 		DNSCacheExpiry: time.Duration(config.Transport.Dialer.DNSCacheExpiry) * time.Second,
 		LoopbackAddrs:  make(map[string]struct{}),
+		// kept even without BlockPage, which Reload may enable
+		BadIPs: helpers.NewKeyedCache(lrucache.NewLRUCache(1024)),
+	}
+
+	if name := config.Transport.Dialer.RetryPolicy; name != "" {
+		p, err := helpers.LookupRetryPolicy(name)
+		if err != nil {
+			return nil, fmt.Errorf("DIRECT: %v", err)
+		}
+		d.Retry = p
 	}
 
 	d.LoopbackAddrs = make(map[string]struct{})
@@ -97,34 +162,134 @@ func NewFilter(config *Config) (filters.Filter, error) {
 	}
 
 	tr := &http.Transport{
-		Dial: d.Dial,
+		DialContext: d.DialContext,
 		TLSClientConfig: &tls.Config{
 			InsecureSkipVerify: config.Transport.TLSClientConfig.InsecureSkipVerify,
 			ClientSessionCache: tls.NewLRUClientSessionCache(config.Transport.TLSClientConfig.ClientSessionCacheSize),
+			KeyLogWriter:       helpers.KeyLog,
 		},
 		TLSHandshakeTimeout: time.Duration(config.Transport.TLSHandshakeTimeout) * time.Second,
 		MaxIdleConnsPerHost: config.Transport.MaxIdleConnsPerHost,
 		DisableCompression:  config.Transport.DisableCompression,
 	}
 
-	return &Filter{
+	opts, err := newOptions(config)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &Filter{
 		Config:    *config,
 		transport: tr,
-	}, nil
+		dialer:    d,
+		options:   opts,
+	}
+
+	d.RegisterCaches(filterName)
+
+	return f, nil
 }
 
 func (f *Filter) FilterName() string {
 	return filterName
 }
 
+// Reload re-reads direct.json and swaps in FastConnect, DeadlinePolicies,
+// Headers and BlockPage, the established connections are kept. The Transport
+// settings are applied on restart.
+func (f *Filter) Reload() error {
+	filename := filterName + ".json"
+	config := new(Config)
+	if err := storage.ReadJsonConfig(storage.LookupConfigStoreURI(filterName), filename, config); err != nil {
+		return err
+	}
+
+	opts, err := newOptions(config)
+	if err != nil {
+		return err
+	}
+
+	f.muConfig.Lock()
+	f.options = opts
+	f.muConfig.Unlock()
+
+	glog.Infof("DIRECT: %#v reloaded", filename)
+	return nil
+}
+
+func (f *Filter) currentOptions() *options {
+	f.muConfig.RLock()
+	defer f.muConfig.RUnlock()
+	return f.options
+}
+
+// roundTrip sends req under the deadline policy of its host, if any, with
+// the headers normalized if Headers is enabled.
+func (f *Filter) roundTrip(req *http.Request) (*http.Response, error) {
+	opts := f.currentOptions()
+	req = opts.headers.Normalize(req)
+	if opts.deadlines == nil {
+		return f.transport.RoundTrip(req)
+	}
+	p, _ := opts.deadlines.Lookup(req.Host)
+	return helpers.RoundTripWithDeadline(f.transport, req, p)
+}
+
+// dial connects to the CONNECT target addr in the ConnectTimeout of its
+// deadline policy, if any.
+func (f *Filter) dial(ctx context.Context, addr string) (net.Conn, error) {
+	if deadlines := f.currentOptions().deadlines; deadlines != nil {
+		p, _ := deadlines.Lookup(addr)
+		ctx = helpers.WithDeadlinePolicy(ctx, p)
+	}
+	return f.dialer.DialContext(ctx, "tcp", addr)
+}
+
+// checkBlockPage marks the ip which served an injected response as bad and
+// retries a request without body once on another ip. If it is still blocked
+// an ErrBlockPage error is returned, so the FallbackFilter can take over.
+func (f *Filter) checkBlockPage(ctx context.Context, req *http.Request, resp *http.Response, opts *options) (*http.Response, error) {
+	for i := 0; ; i++ {
+		// Detect may wrap the body, which hides the connection from reflection
+		addr, err := helpers.ReflectRemoteAddrFromResponse(resp)
+		if err == nil {
+			filters.SetUpstream(ctx, addr)
+		}
+
+		reason := opts.blockPage.Detect(resp)
+		if reason == nil {
+			return resp, nil
+		}
+
+		resp.Body.Close()
+		f.transport.CloseIdleConnections()
+
+		glog.Warningf("%s \"DIRECT %s %s %s\" from %s looks hijacked: %v", filters.RemoteAddr(req), req.Method, req.URL.String(), req.Proto, addr, reason)
+		if err == nil {
+			if ip, _, err := net.SplitHostPort(addr); err == nil {
+				f.dialer.MarkBadIP(ip, opts.badIPExpiry)
+			}
+		}
+
+		if i > 0 || req.ContentLength != 0 {
+			return nil, helpers.NewError(helpers.ErrBlockPage, "DIRECT "+req.Host, reason)
+		}
+
+		if resp, err = f.roundTrip(filters.ReplayRequest(req)); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Route takes every request.
+func (f *Filter) Route(req *http.Request) (string, bool) {
+	return filterName, true
+}
+
 func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
 	switch req.Method {
 	case "CONNECT":
-		glog.V(2).Infof("%s \"DIRECT %s %s %s\" - -", req.RemoteAddr, req.Method, req.Host, req.Proto)
-		rconn, err := f.transport.Dial("tcp", req.Host)
-		if err != nil {
-			return ctx, nil, err
-		}
+		glog.V(2).Infof("%s \"DIRECT %s %s %s\" - -", filters.RemoteAddr(req), req.Method, req.Host, req.Proto)
 
 		rw := filters.GetResponseWriter(ctx)
 
@@ -138,6 +303,16 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 			return ctx, nil, fmt.Errorf("http.ResponseWriter(%#v) does not implments http.Flusher", rw)
 		}
 
+		if f.currentOptions().fastConnect {
+			return ctx, nil, f.connectFast(ctx, req, hijacker, flusher)
+		}
+
+		rconn, err := f.dial(ctx, req.Host)
+		if err != nil {
+			return ctx, nil, err
+		}
+		filters.SetUpstream(ctx, rconn.RemoteAddr().String())
+
 		rw.WriteHeader(http.StatusOK)
 		flusher.Flush()
 
@@ -147,16 +322,21 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 		}
 		defer lconn.Close()
 
-		go helpers.IoCopy(rconn, lconn)
-		helpers.IoCopy(lconn, rconn)
+		relay(ctx, lconn, rconn, lconn)
 
 		filters.SetHijacked(ctx, true)
 		return ctx, nil, nil
 	default:
-		resp, err := f.transport.RoundTrip(req)
+		opts := f.currentOptions()
+		resp, err := f.roundTrip(req)
+		if err == nil && opts.blockPage != nil {
+			if resp, err = f.checkBlockPage(ctx, req, resp, opts); err != nil {
+				return ctx, nil, err
+			}
+		}
 
 		if err != nil {
-			glog.Errorf("%s \"DIRECT %s %s %s\" error: %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, err)
+			glog.Errorf("%s \"DIRECT %s %s %s\" error: %s", filters.RemoteAddr(req), req.Method, req.URL.String(), req.Proto, err)
 			data := err.Error()
 			resp = &http.Response{
 				Status:        "502 Bad Gateway",
@@ -172,8 +352,13 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 			}
 			err = nil
 		} else {
+			if opts.blockPage == nil {
+				if addr, err := helpers.ReflectRemoteAddrFromResponse(resp); err == nil {
+					filters.SetUpstream(ctx, addr)
+				}
+			}
 			if req.RemoteAddr != "" {
-				glog.V(2).Infof("%s \"DIRECT %s %s %s\" %d %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
+				glog.V(2).Infof("%s \"DIRECT %s %s %s\" %d %s", filters.RemoteAddr(req), req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
 			}
 		}
 		return ctx, resp, err
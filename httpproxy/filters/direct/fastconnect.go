@@ -0,0 +1,102 @@
+package direct
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../../filters"
+	"../../helpers"
+)
+
+const (
+	// how long to wait for the first client bytes to translate a dial error
+	fastConnectPeekTimeout = 3 * time.Second
+)
+
+// a fatal internal_error alert, browsers show it as a connection error
+var tlsAlertInternalError = []byte{0x15, 0x03, 0x01, 0x00, 0x02, 0x02, 0x50}
+
+// connectFast acks the CONNECT at once and dials in background, so browsers
+// which time out the CONNECT phase quickly never see a slow raced dial. A
+// dial error is translated for the protocol the client speaks, a TLS alert
+// after a ClientHello and a 502 response otherwise.
+func (f *Filter) connectFast(ctx context.Context, req *http.Request, hijacker http.Hijacker, flusher http.Flusher) error {
+	type dialResult struct {
+		conn net.Conn
+		err  error
+	}
+
+	lane := make(chan dialResult, 1)
+	go func() {
+		conn, err := f.dial(ctx, req.Host)
+		lane <- dialResult{conn, err}
+	}()
+
+	rw := filters.GetResponseWriter(ctx)
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	lconn, brw, err := hijacker.Hijack()
+	if err != nil {
+		go func() {
+			if r := <-lane; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return fmt.Errorf("%#v.Hijack() error: %v", hijacker, err)
+	}
+	defer lconn.Close()
+
+	filters.SetHijacked(ctx, true)
+
+	r := <-lane
+	if r.err != nil {
+		glog.Warningf("%s \"DIRECT %s %s %s\" dial error: %v", filters.RemoteAddr(req), req.Method, req.Host, req.Proto, r.err)
+
+		lconn.SetReadDeadline(time.Now().Add(fastConnectPeekTimeout))
+		if b, err := brw.Reader.Peek(1); err == nil {
+			lconn.SetWriteDeadline(time.Now().Add(fastConnectPeekTimeout))
+			if b[0] == 0x16 {
+				lconn.Write(tlsAlertInternalError)
+			} else {
+				data := r.err.Error()
+				fmt.Fprintf(lconn, "HTTP/1.1 502 Bad Gateway\r\nContent-Type: text/plain\r\nContent-Length: %d\r\nConnection: close\r\n\r\n", len(data))
+				io.WriteString(lconn, data)
+			}
+		}
+		return nil
+	}
+
+	rconn := r.conn
+	defer rconn.Close()
+
+	filters.SetUpstream(ctx, rconn.RemoteAddr().String())
+
+	// brw.Reader keeps the bytes which the client sent right after the ack
+	relay(ctx, lconn, rconn, brw.Reader)
+
+	return nil
+}
+
+// relay copies between the client lconn and rconn until rconn is done, the
+// client is read through r. The bytes of both ways are counted in ctx.
+func relay(ctx context.Context, lconn, rconn net.Conn, r io.Reader) {
+	upc := make(chan int64, 1)
+	go func() {
+		n, _ := helpers.IoCopy(rconn, r)
+		upc <- n
+	}()
+
+	down, _ := helpers.IoCopy(lconn, rconn)
+	// unblocks the copy of the other way
+	lconn.Close()
+	rconn.Close()
+
+	filters.AddTraffic(ctx, <-upc, down)
+}
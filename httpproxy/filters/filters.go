@@ -4,6 +4,9 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
 )
 
 type Filter interface {
@@ -25,6 +28,21 @@ type ResponseFilter interface {
 	Response(context.Context, *http.Response) (context.Context, *http.Response, error)
 }
 
+// Router is implemented by the RoundTripFilters which can tell from req alone,
+// without sending it, whether they take it and through which egress, which is
+// their FilterName or a part of it, e.g. "gae/direct". The filters whose
+// answer depends on more, e.g. the entries of cache, are not Routers.
+type Router interface {
+	Route(req *http.Request) (egress string, ok bool)
+}
+
+// Prewarmer is implemented by the RoundTripFilters which can open the
+// connections of n requests like req ahead of them, e.g. for the chunks of a
+// ranged download. Prewarm returns the number of connections opened.
+type Prewarmer interface {
+	Prewarm(req *http.Request, n int) int
+}
+
 type RegisteredFilter struct {
 	New func() (Filter, error)
 }
@@ -32,10 +50,14 @@ type RegisteredFilter struct {
 var (
 	registeredFilters map[string]*RegisteredFilter
 	filters           map[string]Filter
+	newFilterCalls    map[string]*filterCall
+	muFilters         sync.Mutex
 )
 
 func init() {
 	registeredFilters = make(map[string]*RegisteredFilter)
+	filters = make(map[string]Filter)
+	newFilterCalls = make(map[string]*filterCall)
 }
 
 // Register a Filter
@@ -57,11 +79,99 @@ func NewFilter(name string) (Filter, error) {
 	return filter.New()
 }
 
+// filterCall is a NewFilter in progress, concurrent GetFilter of the same
+// name wait for it instead of building another one.
+type filterCall struct {
+	wg     sync.WaitGroup
+	filter Filter
+	err    error
+}
+
 // GetFilter try get a existing Filter of type "name", otherwise create new one
 func GetFilter(name string) (Filter, error) {
-	filter, exists := filters[name]
-	if exists {
+	muFilters.Lock()
+	if filter, exists := filters[name]; exists {
+		muFilters.Unlock()
 		return filter, nil
 	}
-	return NewFilter(name)
+	if c, ok := newFilterCalls[name]; ok {
+		muFilters.Unlock()
+		c.wg.Wait()
+		return c.filter, c.err
+	}
+	c := &filterCall{}
+	c.wg.Add(1)
+	newFilterCalls[name] = c
+	muFilters.Unlock()
+
+	// NewFilter may take long, e.g. downloading a list, so muFilters is not
+	// held by it and the other filters can be got meanwhile. a filter is
+	// built once only, since it may register jobs and start goroutines.
+	c.filter, c.err = NewFilter(name)
+
+	muFilters.Lock()
+	if c.err == nil {
+		filters[name] = c.filter
+	}
+	delete(newFilterCalls, name)
+	muFilters.Unlock()
+	c.wg.Done()
+
+	return c.filter, c.err
+}
+
+// LookupFilter returns a existing Filter of type "name"
+func LookupFilter(name string) (Filter, bool) {
+	muFilters.Lock()
+	defer muFilters.Unlock()
+
+	filter, exists := filters[name]
+	return filter, exists
+}
+
+// FilterNames returns the names of the existing filters in order.
+func FilterNames() []string {
+	muFilters.Lock()
+	defer muFilters.Unlock()
+
+	names := make([]string, 0, len(filters))
+	for name := range filters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Reloader is implemented by filters which can apply a changed config file
+// without dropping established connections.
+type Reloader interface {
+	Reload() error
+}
+
+// ReloadFilters calls Reload of all existing filters which support it
+func ReloadFilters() error {
+	if ReadOnly() {
+		return fmt.Errorf("ReloadFilters error: read-only mode")
+	}
+
+	muFilters.Lock()
+	fs := make(map[string]Filter, len(filters))
+	for name, filter := range filters {
+		fs[name] = filter
+	}
+	muFilters.Unlock()
+
+	var errs []string
+	for name, filter := range fs {
+		if r, ok := filter.(Reloader); ok {
+			if err := r.Reload(); err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("ReloadFilters error: %s", strings.Join(errs, "; "))
+	}
+	return nil
 }
@@ -4,6 +4,8 @@ import (
 	"context"
 	"net"
 	"net/http"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -15,10 +17,15 @@ type racer struct {
 	rw  http.ResponseWriter
 	rtf RoundTripFilter
 	hj  bool
+	id  string
+	up  atomic.Value
+	tx  int64
+	rx  int64
+	fi  atomic.Value
 }
 
 func NewContext(ctx context.Context, ln net.Listener, rw http.ResponseWriter) context.Context {
-	return context.WithValue(ctx, contextKey, &racer{ln, rw, nil, false})
+	return context.WithValue(ctx, contextKey, &racer{ln: ln, rw: rw})
 }
 
 func GetListener(ctx context.Context) net.Listener {
@@ -37,6 +44,82 @@ func GetHijacked(ctx context.Context) bool {
 	return ctx.Value(contextKey).(*racer).hj
 }
 
+// GetRequestID returns the id assigned to the request at ingress, it is safe
+// to call with a context which is not created by NewContext.
+func GetRequestID(ctx context.Context) string {
+	if r, ok := ctx.Value(contextKey).(*racer); ok {
+		return r.id
+	}
+	return ""
+}
+
+func SetRequestID(ctx context.Context, id string) {
+	ctx.Value(contextKey).(*racer).id = id
+}
+
+// GetUpstream returns the remote address which served the request, it is
+// empty if the round trip filter does not report one.
+func GetUpstream(ctx context.Context) string {
+	if r, ok := ctx.Value(contextKey).(*racer); ok {
+		if addr, ok := r.up.Load().(string); ok {
+			return addr
+		}
+	}
+	return ""
+}
+
+// SetUpstream records addr as the upstream of the request, it may be called by
+// concurrent hedged requests and is a no-op without a NewContext context.
+func SetUpstream(ctx context.Context, addr string) {
+	if r, ok := ctx.Value(contextKey).(*racer); ok {
+		r.up.Store(addr)
+	}
+}
+
+// AddTraffic records the bytes a hijacking filter relayed from (up) and to
+// (down) the client, which the handler cannot see.
+func AddTraffic(ctx context.Context, up, down int64) {
+	if r, ok := ctx.Value(contextKey).(*racer); ok {
+		atomic.AddInt64(&r.tx, up)
+		atomic.AddInt64(&r.rx, down)
+	}
+}
+
+func GetTraffic(ctx context.Context) (up, down int64) {
+	if r, ok := ctx.Value(contextKey).(*racer); ok {
+		return atomic.LoadInt64(&r.tx), atomic.LoadInt64(&r.rx)
+	}
+	return 0, 0
+}
+
+// RemoteAddr returns the client address of req followed by its request id,
+// it is the first field of access log lines.
+// GetFlushInterval returns the flush interval a round trip filter has asked
+// for the response body, which overrides the FlushPolicies of the handler.
+func GetFlushInterval(ctx context.Context) (time.Duration, bool) {
+	if r, ok := ctx.Value(contextKey).(*racer); ok {
+		interval, ok := r.fi.Load().(time.Duration)
+		return interval, ok
+	}
+	return 0, false
+}
+
+// SetFlushInterval asks the handler to flush the response body at interval,
+// -1 after every write, e.g. for the chunked bodies a filter knows to be
+// streams. It is a no-op without a NewContext context.
+func SetFlushInterval(ctx context.Context, interval time.Duration) {
+	if r, ok := ctx.Value(contextKey).(*racer); ok {
+		r.fi.Store(interval)
+	}
+}
+
+func RemoteAddr(req *http.Request) string {
+	if id := GetRequestID(req.Context()); id != "" {
+		return req.RemoteAddr + " #" + id
+	}
+	return req.RemoteAddr
+}
+
 func SetRoundTripFilter(ctx context.Context, filter RoundTripFilter) {
 	ctx.Value(contextKey).(*racer).rtf = filter
 }
@@ -2,16 +2,20 @@ package gae
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/cloudflare/golibs/lrucache"
 	"github.com/phuslu/glog"
 	"github.com/phuslu/net/http2"
+	"github.com/quic-go/quic-go/http3"
 
 	"../../dialer"
 	"../../filters"
@@ -30,32 +34,151 @@ const (
 )
 
 type Config struct {
-	AppIDs          []string
-	Scheme          string
-	Domain          string
-	Path            string
-	Password        string
-	SSLVerify       bool
-	IPv6Only        bool
-	DisableHTTP2    bool
-	ForceHTTP2      bool
-	Sites           []string
-	Site2Alias      map[string]string
-	HostMap         map[string][]string
-	FakeServerNames []string
-	ForceHTTPS      []string
-	ForceGAE        []string
-	FakeOptions     map[string][]string
-	DNSServers      []string
-	IPBlackList     []string
-	Transport       struct {
+	AppIDs             []string
+	FetchServers       []string
+	ServerPolicy       string
+	PaddingPercent     int
+	PaddingMax         int
+	PaddingBody        bool
+	UserAgents         []string
+	Headers            helpers.HeaderNormalization
+	Encoding           string
+	EncodeBody         bool
+	Obfuscate          string
+	ObfuscateKey       string
+	Scheme             string
+	Domain             string
+	Path               string
+	Password           string
+	SignRequest        bool
+	KeyID              string
+	SSLVerify          bool
+	ClientCertFile     string
+	ClientKeyFile      string
+	IPPreference       string
+	IPv6Only           bool // deprecated, same as IPPreference "only_ipv6"
+	DNS64Prefixes      []string
+	DisableHTTP2       bool
+	ForceHTTP2         bool
+	EnableQuic         bool
+	FetchServerHTTP2   bool
+	EnableMetrics      bool
+	Sites              []string
+	Site2Alias         map[string]string
+	HostMap            map[string][]string
+	FetchServerHosts   map[string][]string
+	FakeServerNames    []string
+	ForceHTTPS         []string
+	ForceGAE           []string
+	HedgeSites         []string
+	WarmUp             bool
+	FakeOptions        map[string][]string
+	FetchOptions       map[string]FetchOption
+	DeadlinePolicies   map[string]helpers.DeadlinePolicy
+	Upstream           string
+	DNSServers         []string
+	AliasDNSServers    map[string][]string
+	DNSServerOrdering  bool
+	StaticHosts        map[string][]string
+	StaticHostsFile    string
+	DNSQueryOptions    map[string]dialer.DNSQueryOptions
+	IPBlackList        []string
+	IPWhiteList        map[string][]string
+	AddrPolicy         map[string]string
+	IPBlackListSources []struct {
+		Type        string
+		Path        string
+		URL         string
+		ChecksumURL string
+		RangeDelta  bool
+		Entries     []string
+	}
+	IPBlackListRefresh int
+	VerifyAliases      map[string][]string
+	TLSFingerprints    map[string]string
+	SNIPolicies        map[string]dialer.SNIPolicy
+	ServerNames        map[string]string
+	ECHDNSServer       string
+	SocketOptions      map[string]dialer.SocketOptions
+	DialStrategies     map[string]string
+	AliasTiers         map[string][]string
+	AliasPorts         map[string]map[string]string
+	Telemetry          struct {
+		Enabled  bool
+		Endpoint string
+		Region   string
+		ISP      string
+		Interval int
+		Epsilon  float64
+		MinCount int
+	}
+	CertLearning struct {
+		Enabled bool
+		TTL     int
+	}
+	ConnCache struct {
+		Filename      string
+		FlushInterval int
+		MaxAge        int
+	}
+	DNSCache struct {
+		Filename      string
+		FlushInterval int
+		MaxAge        int
+		Prefetch      []string
+	}
+	AutoRange struct {
+		Enabled   bool
+		ChunkSize int
+		Threads   int
+	}
+	Quota struct {
+		Enabled    bool
+		DailyBytes int64
+		Timezone   string
+	}
+	HealthCheck struct {
+		Enabled     bool
+		ServerName  string
+		Interval    int
+		MaxFailures int
+		Timeout     int
+	}
+	ClockCheck struct {
+		Enabled    bool
+		URLs       []string
+		Interval   int
+		MaxSkew    int
+		Compensate bool
+	}
+	IPScanner struct {
+		Enabled     bool
+		Alias       string
+		ServerName  string
+		CIDRs       []string
+		Concurrency int
+		BatchSize   int
+		MaxGood     int
+		Interval    int
+		Timeout     int
+	}
+	Transport struct {
 		Dialer struct {
-			DNSCacheExpiry int
-			DNSCacheSize   uint
-			DualStack      bool
-			KeepAlive      int
-			Level          int
-			Timeout        int
+			AutoLevel          bool
+			DNSCacheExpiry     int
+			DNSNegativeExpiry  int
+			DNSCacheSize       uint
+			DualStack          bool
+			HappyEyeballsDelay int
+			IPv6Fallback       int
+			IPv6Cooldown       int
+			IdleConnPool       int
+			IdleConnTimeout    int
+			KeepAlive          int
+			Level              int
+			SessionCacheSize   int
+			ThrottleWindow     int
+			Timeout            int
 		}
 		DisableCompression    bool
 		DisableKeepAlives     bool
@@ -64,6 +187,12 @@ type Config struct {
 		ResponseHeaderTimeout int
 		RetryDelay            float32
 		RetryTimes            int
+		RetryPolicy           string
+		SpoolMemory           int64
+		MaxSpoolSize          int64
+		MaxErrorBody          int64
+		FlushInterval         int
+		Gunzip                bool
 	}
 }
 
@@ -76,6 +205,11 @@ type Filter struct {
 	FakeOptionsMatcher *helpers.HostMatcher
 	SiteMatcher        *helpers.HostMatcher
 	DirectSiteMatcher  *helpers.HostMatcher
+	HedgeSiteMatcher   *helpers.HostMatcher
+	AutoRangeChunkSize int
+	AutoRangeThreads   int
+	FlushInterval      time.Duration
+	muConfig           sync.RWMutex
 }
 
 func init() {
@@ -110,72 +244,370 @@ func init() {
 }
 
 func NewFilter(config *Config) (filters.Filter, error) {
-	dnsServers := make([]net.IP, 0)
-	for _, s := range config.DNSServers {
-		if ip := net.ParseIP(s); ip != nil {
-			dnsServers = append(dnsServers, ip)
+	dnsServers := parseDNSServers(config.DNSServers)
+
+	ipWhiteList := make(map[string][]*net.IPNet)
+	for alias, cidrs := range config.IPWhiteList {
+		ipnets, err := helpers.ParseIPNets(cidrs)
+		if err != nil {
+			return nil, fmt.Errorf("GAE: IPWhiteList[%#v] error: %v", alias, err)
+		}
+		ipWhiteList[alias] = ipnets
+	}
+
+	aliasDNSServers, err := parseAliasDNSServers(config.AliasDNSServers)
+	if err != nil {
+		return nil, err
+	}
+
+	addrPolicy, err := dialer.ParseAddrPolicy(config.AddrPolicy)
+	if err != nil {
+		return nil, fmt.Errorf("GAE: AddrPolicy error: %v", err)
+	}
+
+	dns64Prefixes, err := dialer.ParseDNS64Prefixes(config.DNS64Prefixes)
+	if err != nil {
+		return nil, fmt.Errorf("GAE: DNS64Prefixes error: %v", err)
+	}
+	ipPreference, err := dialer.ParseIPPreference(config.IPPreference)
+	if err != nil {
+		return nil, fmt.Errorf("GAE: %v", err)
+	}
+	if config.IPv6Only {
+		ipPreference = dialer.IPOnlyIPv6
+	}
+
+	if ipPreference == dialer.IPOnlyIPv6 && len(dns64Prefixes) == 0 {
+		if dns64Prefixes, err = dialer.DetectDNS64(); err != nil {
+			glog.V(2).Infof("GAE: DetectDNS64() error: %v", err)
+		} else {
+			glog.Infof("GAE: detected DNS64 prefixes %v", dns64Prefixes)
+		}
+	}
+
+	for alias, name := range config.TLSFingerprints {
+		if _, _, err := dialer.ParseFingerprint(name); err != nil {
+			return nil, fmt.Errorf("GAE: TLSFingerprints[%#v] error: %v", alias, err)
 		}
 	}
 
+	// Offer h2 via ALPN to fetchservers which are not covered by google aliases,
+	// so that encoded requests are multiplexed over one TLS connection.
+	var tlsConfig *tls.Config
+	if config.Scheme == "https" && config.FetchServerHTTP2 && !config.DisableHTTP2 {
+		tlsConfig = &tls.Config{
+			ClientSessionCache: tls.NewLRUClientSessionCache(1000),
+			NextProtos:         []string{"h2", "http/1.1"},
+			Time:               helpers.Now,
+			KeyLogWriter:       helpers.KeyLog,
+		}
+	}
+
+	site2alias, hostMap := mergeFetchServerHosts(config.Site2Alias, config.HostMap, config.FetchServerHosts)
+	hostMap, err = dialer.ResolveHostMap(hostMap)
+	if err != nil {
+		return nil, fmt.Errorf("GAE: %v", err)
+	}
+
 	d := &dialer.MultiDialer{
 		Dialer: net.Dialer{
 			KeepAlive: time.Duration(config.Transport.Dialer.KeepAlive) * time.Second,
 			Timeout:   time.Duration(config.Transport.Dialer.Timeout) * time.Second,
 			DualStack: config.Transport.Dialer.DualStack,
 		},
-		IPv6Only:        config.IPv6Only,
-		TLSConfig:       nil,
-		Site2Alias:      helpers.NewHostMatcherWithString(config.Site2Alias),
-		IPBlackList:     lrucache.NewLRUCache(8192),
-		HostMap:         config.HostMap,
-		FakeServerNames: config.FakeServerNames,
-		DNSServers:      dnsServers,
-		DNSCache:        lrucache.NewLRUCache(config.Transport.Dialer.DNSCacheSize),
-		DNSCacheExpiry:  time.Duration(config.Transport.Dialer.DNSCacheExpiry) * time.Second,
-		TCPConnDuration: lrucache.NewLRUCache(8192),
-		TCPConnError:    lrucache.NewLRUCache(8192),
-		TLSConnDuration: lrucache.NewLRUCache(8192),
-		TLSConnError:    lrucache.NewLRUCache(8192),
-		ConnExpiry:      5 * time.Minute,
-		Level:           config.Transport.Dialer.Level,
+		IPPreference:       ipPreference,
+		DNS64Prefixes:      dns64Prefixes,
+		TLSConfig:          tlsConfig,
+		Site2Alias:         helpers.NewHostMatcherWithString(site2alias),
+		IPBlackList:        helpers.NewKeyedCache(lrucache.NewLRUCache(8192)),
+		IPWhiteList:        ipWhiteList,
+		AddrPolicy:         addrPolicy,
+		IPVerdicts:         lrucache.NewLRUCache(8192),
+		VerifyAliases:      config.VerifyAliases,
+		TLSFingerprints:    config.TLSFingerprints,
+		HostMap:            hostMap,
+		FakeServerNames:    config.FakeServerNames,
+		DNSServers:         dnsServers,
+		AliasDNSServers:    aliasDNSServers,
+		DNSOrdering:        config.DNSServerOrdering,
+		DNSCache:           helpers.NewKeyedCache(lrucache.NewLRUCache(config.Transport.Dialer.DNSCacheSize)),
+		DNSCacheExpiry:     time.Duration(config.Transport.Dialer.DNSCacheExpiry) * time.Second,
+		DNSNegativeExpiry:  time.Duration(config.Transport.Dialer.DNSNegativeExpiry) * time.Second,
+		TCPConnDuration:    helpers.NewKeyedCache(lrucache.NewLRUCache(8192)),
+		TCPConnError:       helpers.NewKeyedCache(lrucache.NewLRUCache(8192)),
+		TLSConnDuration:    helpers.NewKeyedCache(lrucache.NewLRUCache(8192)),
+		TLSConnError:       helpers.NewKeyedCache(lrucache.NewLRUCache(8192)),
+		QUICConnDuration:   helpers.NewKeyedCache(lrucache.NewLRUCache(8192)),
+		QUICConnError:      helpers.NewKeyedCache(lrucache.NewLRUCache(8192)),
+		ConnExpiry:         5 * time.Minute,
+		IdleConnPool:       config.Transport.Dialer.IdleConnPool,
+		IdleConnTimeout:    time.Duration(config.Transport.Dialer.IdleConnTimeout) * time.Second,
+		Level:              config.Transport.Dialer.Level,
+		AutoLevel:          config.Transport.Dialer.AutoLevel,
+		HappyEyeballsDelay: time.Duration(config.Transport.Dialer.HappyEyeballsDelay) * time.Millisecond,
+	}
+
+	d.IPv6FallbackFailures = config.Transport.Dialer.IPv6Fallback
+	d.IPv6FallbackCooldown = time.Duration(config.Transport.Dialer.IPv6Cooldown) * time.Second
+
+	if n := config.Transport.Dialer.SessionCacheSize; n > 0 {
+		d.SessionCache = tls.NewLRUClientSessionCache(n)
+	}
+
+	if config.Transport.Dialer.ThrottleWindow > 0 {
+		d.ThrottledIPs = helpers.NewKeyedCache(lrucache.NewLRUCache(1024))
+		d.ThrottleWindow = time.Duration(config.Transport.Dialer.ThrottleWindow) * time.Second
+	}
+
+	// IPBlackList is left out, shrinking it would dial the bad ips again
+	for name, c := range map[string]lrucache.Cache{
+		"DNSCache":         d.DNSCache,
+		"TCPConnDuration":  d.TCPConnDuration,
+		"TCPConnError":     d.TCPConnError,
+		"TLSConnDuration":  d.TLSConnDuration,
+		"TLSConnError":     d.TLSConnError,
+		"QUICConnDuration": d.QUICConnDuration,
+		"QUICConnError":    d.QUICConnError,
+	} {
+		if kc, ok := c.(*helpers.KeyedCache); ok {
+			helpers.RegisterMemoryUser("gae."+name, kc)
+		}
 	}
 
+	// the budget of -cachemem is shared in proportion to the sizes above
+	d.RegisterCaches(filterName)
+
 	for _, ip := range config.IPBlackList {
-		d.IPBlackList.Set(ip, struct{}{}, time.Time{})
+		d.BlackListIP(ip, 0)
+	}
+
+	if config.CertLearning.Enabled {
+		d.CertLearner = dialer.NewCertLearner(time.Duration(config.CertLearning.TTL) * time.Second)
 	}
 
-	var tr http.RoundTripper
+	if config.Upstream != "" {
+		upstream, err := dialer.ParseUpstream(config.Upstream)
+		if err != nil {
+			return nil, fmt.Errorf("GAE: Upstream %#v error: %v", config.Upstream, err)
+		}
+		d.Upstream = upstream
+	}
 
-	t1 := &http.Transport{
-		Dial:                  d.Dial,
-		DialTLS:               d.DialTLS,
-		DisableKeepAlives:     config.Transport.DisableKeepAlives,
-		DisableCompression:    config.Transport.DisableCompression,
-		ResponseHeaderTimeout: time.Duration(config.Transport.ResponseHeaderTimeout) * time.Second,
-		IdleConnTimeout:       time.Duration(config.Transport.IdleConnTimeout) * time.Second,
-		MaxIdleConnsPerHost:   config.Transport.MaxIdleConnsPerHost,
+	var metrics helpers.MetricsRecorder
+	if config.EnableMetrics {
+		helpers.DefaultMetrics.SetBuckets("goproxy_gae_request_bytes", helpers.SizeBuckets)
+		helpers.DefaultMetrics.SetBuckets("goproxy_gae_response_bytes", helpers.SizeBuckets)
+		metrics = helpers.DefaultMetrics
+		d.Metrics = metrics
 	}
 
-	switch {
-	case config.DisableHTTP2 && config.ForceHTTP2:
-		glog.Fatalf("GAE: DisableHTTP2=%v and ForceHTTPS=%v is conflict!", config.DisableHTTP2, config.ForceHTTP2)
-	case config.ForceHTTP2:
-		_ = dialer.GetDefaultTLSConfigForGoogle(config.FakeServerNames)
-		tr = &http2.Transport{
-			DialTLS:            d.DialTLS2,
-			TLSClientConfig:    dialer.GetDefaultTLSConfigForGoogle(config.FakeServerNames),
-			DisableCompression: config.Transport.DisableCompression,
+	if len(config.IPBlackListSources) > 0 {
+		sources := make([]dialer.BlackListSource, 0)
+		for i, s := range config.IPBlackListSources {
+			switch s.Type {
+			case "file":
+				sources = append(sources, &dialer.FileBlackListSource{Filename: s.Path})
+			case "url":
+				sources = append(sources, &dialer.URLBlackListSource{
+					URL:         s.URL,
+					Transport:   &http.Transport{Proxy: http.ProxyFromEnvironment},
+					ChecksumURL: s.ChecksumURL,
+					RangeDelta:  s.RangeDelta,
+				})
+			case "cidr":
+				sources = append(sources, &dialer.StaticBlackListSource{
+					Label:   fmt.Sprintf("IPBlackListSources[%d]", i),
+					Entries: s.Entries,
+				})
+			default:
+				return nil, fmt.Errorf("GAE: unknown IPBlackListSources type %#v", s.Type)
+			}
 		}
-	case config.DisableHTTP2:
-		tr = t1
-	default:
-		err := http2.ConfigureTransport(t1)
+
+		d.BlackList = dialer.NewBlackList(sources, time.Duration(config.IPBlackListRefresh)*time.Second)
+		helpers.DefaultScheduler.Every("gae.blacklist", d.BlackList.Interval, false, func() error {
+			d.BlackList.Reload()
+			return nil
+		})
+	}
+
+	if filename := config.ConnCache.Filename; filename != "" {
+		if err := d.LoadConnCache(filename, time.Duration(config.ConnCache.MaxAge)*time.Second); err != nil && !os.IsNotExist(err) {
+			glog.Warningf("GAE: LoadConnCache(%#v) error: %v", filename, err)
+		}
+		helpers.DefaultScheduler.Every("gae.conncache", time.Duration(config.ConnCache.FlushInterval)*time.Second, false, func() error {
+			return d.SaveConnCache(filename)
+		})
+	}
+
+	if filename := config.DNSCache.Filename; filename != "" {
+		if err := d.LoadDNSCache(filename, time.Duration(config.DNSCache.MaxAge)*time.Second); err != nil && !os.IsNotExist(err) {
+			glog.Warningf("GAE: LoadDNSCache(%#v) error: %v", filename, err)
+		}
+		helpers.DefaultScheduler.Every("gae.dnscache", time.Duration(config.DNSCache.FlushInterval)*time.Second, false, func() error {
+			return d.SaveDNSCache(filename)
+		})
+	}
+
+	if len(config.DNSCache.Prefetch) > 0 {
+		go d.PrefetchDNS(config.DNSCache.Prefetch)
+	}
+
+	if config.IPScanner.Enabled {
+		s, err := dialer.NewIPScanner(d, config.IPScanner.Alias, config.IPScanner.CIDRs, config.IPScanner.ServerName)
 		if err != nil {
-			glog.Warningf("GAE: Error enabling Transport HTTP/2 support: %v", err)
+			return nil, err
+		}
+		if config.IPScanner.Concurrency > 0 {
+			s.Concurrency = config.IPScanner.Concurrency
+		}
+		if config.IPScanner.BatchSize > 0 {
+			s.BatchSize = config.IPScanner.BatchSize
+		}
+		if config.IPScanner.MaxGood > 0 {
+			s.MaxGood = config.IPScanner.MaxGood
 		}
-		tr = t1
+		if config.IPScanner.Interval > 0 {
+			s.Interval = time.Duration(config.IPScanner.Interval) * time.Second
+		}
+		if config.IPScanner.Timeout > 0 {
+			s.Timeout = time.Duration(config.IPScanner.Timeout) * time.Second
+		}
+		helpers.DefaultScheduler.Every("gae.ipscanner", s.Interval, true, func() error {
+			if s.Scan() == 0 {
+				return fmt.Errorf("no working ip found for alias %#v", s.Alias)
+			}
+			return nil
+		})
 	}
 
+	if err := d.SetSNIPolicies(config.SNIPolicies); err != nil {
+		return nil, err
+	}
+	d.SetServerNames(config.ServerNames)
+	if err := d.SetECHDNSServer(config.ECHDNSServer); err != nil {
+		return nil, err
+	}
+	if err := d.SetDNSQueryOptions(config.DNSQueryOptions); err != nil {
+		return nil, err
+	}
+	if err := setupTelemetry(d, config); err != nil {
+		return nil, err
+	}
+	if err := setStaticHosts(d, config); err != nil {
+		return nil, err
+	}
+	if err := d.SetSocketOptions(config.SocketOptions); err != nil {
+		return nil, err
+	}
+	if err := d.SetDialStrategies(config.DialStrategies); err != nil {
+		return nil, err
+	}
+	if err := d.SetAliasTiers(config.AliasTiers); err != nil {
+		return nil, err
+	}
+	if err := d.SetAliasPorts(config.AliasPorts); err != nil {
+		return nil, err
+	}
+	go checkSNIPolicies(d, config.SNIPolicies)
+
+	if config.WarmUp {
+		go d.WarmUp()
+	}
+
+	if config.HealthCheck.Enabled {
+		h := dialer.NewHealthChecker(d, config.HealthCheck.ServerName)
+		if config.HealthCheck.MaxFailures > 0 {
+			h.MaxFailures = config.HealthCheck.MaxFailures
+		}
+		if config.HealthCheck.Timeout > 0 {
+			h.Timeout = time.Duration(config.HealthCheck.Timeout) * time.Second
+		}
+		helpers.DefaultScheduler.Every("gae.healthcheck", time.Duration(config.HealthCheck.Interval)*time.Second, false, h.Check)
+	}
+
+	if config.ClockCheck.Enabled {
+		c := &helpers.ClockChecker{
+			URLs:       config.ClockCheck.URLs,
+			MaxSkew:    time.Duration(config.ClockCheck.MaxSkew) * time.Second,
+			Compensate: config.ClockCheck.Compensate,
+			Transport:  &http.Transport{},
+		}
+		interval := time.Duration(config.ClockCheck.Interval) * time.Second
+		if interval <= 0 {
+			interval = time.Hour
+		}
+		helpers.DefaultScheduler.Every("gae.clockcheck", interval, true, c.Update)
+	}
+
+	deadlines, err := newDeadlinePolicies(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// the dials take the ConnectTimeout and TLSHandshakeTimeout of the
+	// deadline policy of the request from its context
+	newTransport := func(dialTLS func(context.Context, string, string) (net.Conn, error), dialTLS2 func(string, string, *tls.Config) (net.Conn, error)) http.RoundTripper {
+		t1 := &http.Transport{
+			DialContext:           d.DialContext,
+			DialTLSContext:        dialTLS,
+			DisableKeepAlives:     config.Transport.DisableKeepAlives,
+			DisableCompression:    config.Transport.DisableCompression,
+			ResponseHeaderTimeout: time.Duration(config.Transport.ResponseHeaderTimeout) * time.Second,
+			IdleConnTimeout:       time.Duration(config.Transport.IdleConnTimeout) * time.Second,
+			MaxIdleConnsPerHost:   config.Transport.MaxIdleConnsPerHost,
+		}
+		if deadlines != nil {
+			// the deadline policies take over, a host may get a longer one
+			t1.ResponseHeaderTimeout = 0
+		}
+
+		switch {
+		case config.DisableHTTP2 && config.ForceHTTP2:
+			glog.Fatalf("GAE: DisableHTTP2=%v and ForceHTTPS=%v is conflict!", config.DisableHTTP2, config.ForceHTTP2)
+		case config.ForceHTTP2:
+			_ = dialer.GetDefaultTLSConfigForGoogle(config.FakeServerNames)
+			return &http2.Transport{
+				DialTLS:            dialTLS2,
+				TLSClientConfig:    dialer.GetDefaultTLSConfigForGoogle(config.FakeServerNames),
+				DisableCompression: config.Transport.DisableCompression,
+			}
+		case config.DisableHTTP2:
+			break
+		default:
+			err := http2.ConfigureTransport(t1)
+			if err != nil {
+				glog.Warningf("GAE: Error enabling Transport HTTP/2 support: %v", err)
+			}
+		}
+		return t1
+	}
+
+	tr := newTransport(d.DialTLSContext, d.DialTLS2)
+
+	// the google frontends are reached over UDP/443 as well, which is
+	// throttled less than TCP/443 in some networks
+	if config.EnableQuic {
+		tr = &QuicTransport{
+			Transport: &http3.Transport{
+				Dial:               d.DialQUIC,
+				TLSClientConfig:    dialer.GetDefaultTLSConfigForGoogle(config.FakeServerNames),
+				DisableCompression: config.Transport.DisableCompression,
+			},
+			Fallback: tr,
+			Cooldown: DefaultQuicCooldown,
+		}
+	}
+
+	// small requests go through their own connections, which may land on
+	// the ips throttled for bulk transfers.
+	var smallTransport http.RoundTripper
+	if d.ThrottledIPs != nil {
+		smallTransport = newTransport(d.DialTLSSmallContext, d.DialTLS2Small)
+	}
+
+	headers := helpers.NewHeaderNormalizer(config.Headers)
+
 	servers := make([]Server, 0)
 	for _, appid := range config.AppIDs {
 		var rawurl string
@@ -191,30 +623,141 @@ func NewFilter(config *Config) (filters.Filter, error) {
 		}
 
 		server := Server{
-			URL:       u,
-			Password:  config.Password,
-			SSLVerify: config.SSLVerify,
-			Deadline:  time.Duration(config.Transport.ResponseHeaderTimeout-4) * time.Second,
+			URL:            u,
+			Password:       config.Password,
+			SSLVerify:      config.SSLVerify,
+			Deadline:       time.Duration(config.Transport.ResponseHeaderTimeout-4) * time.Second,
+			PaddingPercent: config.PaddingPercent,
+			PaddingMax:     config.PaddingMax,
+			UserAgents:     config.UserAgents,
+			Headers:        headers,
+			Encoding:       config.Encoding,
+			EncodeBody:     config.EncodeBody,
+			Obfuscate:      config.Obfuscate,
+			ObfuscateKey:   config.ObfuscateKey,
+			MaxErrorBody:   config.Transport.MaxErrorBody,
 		}
 
 		servers = append(servers, server)
 	}
 
+	for _, rawurl := range config.FetchServers {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return nil, err
+		}
+
+		servers = append(servers, Server{
+			URL:            u,
+			Password:       config.Password,
+			SignRequest:    config.SignRequest,
+			KeyID:          config.KeyID,
+			SSLVerify:      config.SSLVerify,
+			Deadline:       time.Duration(config.Transport.ResponseHeaderTimeout-4) * time.Second,
+			PaddingPercent: config.PaddingPercent,
+			PaddingMax:     config.PaddingMax,
+			PaddingBody:    config.PaddingBody,
+			UserAgents:     config.UserAgents,
+			Headers:        headers,
+			Encoding:       config.Encoding,
+			EncodeBody:     config.EncodeBody,
+			Obfuscate:      config.Obfuscate,
+			ObfuscateKey:   config.ObfuscateKey,
+			MaxErrorBody:   config.Transport.MaxErrorBody,
+		})
+	}
+
+	if config.ClientCertFile != "" {
+		cert, err := helpers.LoadClientCertificate(config.ClientCertFile, config.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("GAE: %v", err)
+		}
+		d.ClientCertificates = make(map[string]tls.Certificate, len(servers))
+		for _, server := range servers {
+			if server.URL.Scheme == "https" {
+				d.ClientCertificates[server.URL.Hostname()] = cert
+			}
+		}
+	}
+
+	switch config.Encoding {
+	case "", EncodingFlate, EncodingBrotli, EncodingZstd:
+		break
+	default:
+		return nil, fmt.Errorf("GAE: unknown Encoding %#v", config.Encoding)
+	}
+
+	switch config.Obfuscate {
+	case "":
+		break
+	case helpers.ObfuscateAES:
+		if config.ObfuscateKey == "" && config.Password == "" {
+			return nil, fmt.Errorf("GAE: Obfuscate %#v needs ObfuscateKey or Password", config.Obfuscate)
+		}
+	default:
+		return nil, fmt.Errorf("GAE: unknown Obfuscate %#v", config.Obfuscate)
+	}
+
+	switch config.ServerPolicy {
+	case "", ServerPolicyRoundRobin, ServerPolicyLeastErrors:
+		break
+	default:
+		return nil, fmt.Errorf("GAE: unknown ServerPolicy %#v", config.ServerPolicy)
+	}
+
+	retry, err := helpers.NewRetryPolicy(config.Transport.RetryPolicy, config.Transport.RetryTimes, time.Duration(config.Transport.RetryDelay*1000)*time.Millisecond)
+	if err != nil {
+		return nil, fmt.Errorf("GAE: %v", err)
+	}
+
+	t := &Transport{
+		RoundTripper:      tr,
+		SmallRoundTripper: smallTransport,
+		MultiDialer:       d,
+		Servers:           servers,
+		ServerPolicy:      config.ServerPolicy,
+		Retry:             retry,
+		SpoolMemory:       config.Transport.SpoolMemory,
+		MaxSpoolSize:      config.Transport.MaxSpoolSize,
+		Metrics:           metrics,
+		Gunzip:            config.Transport.Gunzip,
+	}
+	if t.SpoolMemory <= 0 {
+		t.SpoolMemory = helpers.DefaultReplayMemory
+	}
+	if t.MaxSpoolSize <= 0 {
+		t.MaxSpoolSize = helpers.DefaultMaxReplaySize
+	}
+	t.SetFetchOptions(config.FetchOptions)
+	t.SetDeadlinePolicies(deadlines)
+	if config.Quota.Enabled {
+		t.Quota = NewQuotaManager(config.Quota.DailyBytes, config.Quota.Timezone)
+	}
+
+	autoRangeChunkSize, autoRangeThreads := 0, 0
+	if config.AutoRange.Enabled {
+		autoRangeChunkSize, autoRangeThreads = config.AutoRange.ChunkSize, config.AutoRange.Threads
+		if autoRangeChunkSize <= 0 {
+			autoRangeChunkSize = DefaultAutoRangeChunkSize
+		}
+		if autoRangeThreads <= 0 {
+			autoRangeThreads = DefaultAutoRangeThreads
+		}
+	}
+
 	return &Filter{
-		Config: *config,
-		GAETransport: &Transport{
-			RoundTripper: tr,
-			MultiDialer:  d,
-			Servers:      servers,
-			RetryDelay:   time.Duration(config.Transport.RetryDelay*1000) * time.Second,
-			RetryTimes:   config.Transport.RetryTimes,
-		},
+		Config:             *config,
+		GAETransport:       t,
 		DirectTransport:    tr,
 		ForceHTTPSMatcher:  helpers.NewHostMatcher(config.ForceHTTPS),
 		ForceGAEStrings:    config.ForceGAE,
 		FakeOptionsMatcher: helpers.NewHostMatcherWithStrings(config.FakeOptions),
 		SiteMatcher:        helpers.NewHostMatcher(config.Sites),
 		DirectSiteMatcher:  helpers.NewHostMatcherWithString(config.Site2Alias),
+		HedgeSiteMatcher:   helpers.NewHostMatcher(config.HedgeSites),
+		AutoRangeChunkSize: autoRangeChunkSize,
+		AutoRangeThreads:   autoRangeThreads,
+		FlushInterval:      time.Duration(config.Transport.FlushInterval) * time.Millisecond,
 	}, nil
 }
 
@@ -222,13 +765,136 @@ func (f *Filter) FilterName() string {
 	return filterName
 }
 
+func (f *Filter) MultiDialer() *dialer.MultiDialer {
+	return f.GAETransport.MultiDialer
+}
+
+// QuotaUsage returns the usage of the fetch servers in the current quota day.
+func (f *Filter) QuotaUsage() (interface{}, bool) {
+	if f.GAETransport.Quota == nil {
+		return nil, false
+	}
+	return f.GAETransport.Quota.Usage(), true
+}
+
+// ResetQuota clears the usage of the fetch server of host, all of them if
+// host is empty.
+func (f *Filter) ResetQuota(host string) bool {
+	if f.GAETransport.Quota == nil {
+		return false
+	}
+	f.GAETransport.Quota.Reset(host)
+	return true
+}
+
+// Reload re-reads gae.json and swaps the site matchers and the alias/dns
+// settings of MultiDialer, transports and established connections are kept.
+func (f *Filter) Reload() error {
+	filename := filterName + ".json"
+	config := new(Config)
+	err := storage.ReadJsonConfig(storage.LookupConfigStoreURI(filterName), filename, config)
+	if err != nil {
+		return err
+	}
+
+	aliasDNSServers, err := parseAliasDNSServers(config.AliasDNSServers)
+	if err != nil {
+		return err
+	}
+
+	site2alias, hostMap := mergeFetchServerHosts(config.Site2Alias, config.HostMap, config.FetchServerHosts)
+	if hostMap, err = dialer.ResolveHostMap(hostMap); err != nil {
+		return fmt.Errorf("GAE: %v", err)
+	}
+	f.MultiDialer().Reload(helpers.NewHostMatcherWithString(site2alias), hostMap, parseDNSServers(config.DNSServers))
+	f.MultiDialer().SetAliasDNSServers(aliasDNSServers)
+	if err := f.MultiDialer().SetSNIPolicies(config.SNIPolicies); err != nil {
+		return err
+	}
+	f.MultiDialer().SetServerNames(config.ServerNames)
+	f.MultiDialer().SetFakeServerNames(config.FakeServerNames)
+	if err := f.MultiDialer().SetECHDNSServer(config.ECHDNSServer); err != nil {
+		return err
+	}
+	if err := f.MultiDialer().SetDNSQueryOptions(config.DNSQueryOptions); err != nil {
+		return err
+	}
+	if err := setupTelemetry(f.MultiDialer(), config); err != nil {
+		return err
+	}
+	if err := setStaticHosts(f.MultiDialer(), config); err != nil {
+		return err
+	}
+	if err := f.MultiDialer().SetSocketOptions(config.SocketOptions); err != nil {
+		return err
+	}
+	if err := f.MultiDialer().SetDialStrategies(config.DialStrategies); err != nil {
+		return err
+	}
+	if err := f.MultiDialer().SetAliasTiers(config.AliasTiers); err != nil {
+		return err
+	}
+	if err := f.MultiDialer().SetAliasPorts(config.AliasPorts); err != nil {
+		return err
+	}
+	go checkSNIPolicies(f.MultiDialer(), config.SNIPolicies)
+
+	f.muConfig.Lock()
+	f.ForceHTTPSMatcher = helpers.NewHostMatcher(config.ForceHTTPS)
+	f.ForceGAEStrings = config.ForceGAE
+	f.FakeOptionsMatcher = helpers.NewHostMatcherWithStrings(config.FakeOptions)
+	f.SiteMatcher = helpers.NewHostMatcher(config.Sites)
+	f.DirectSiteMatcher = helpers.NewHostMatcherWithString(config.Site2Alias)
+	f.HedgeSiteMatcher = helpers.NewHostMatcher(config.HedgeSites)
+	f.muConfig.Unlock()
+
+	f.GAETransport.SetFetchOptions(config.FetchOptions)
+	if f.GAETransport.deadlinePolicies() != nil {
+		// without policies at start the RoundTripper keeps its own
+		// ResponseHeaderTimeout, so they cannot be added on reload
+		deadlines, err := helpers.NewDeadlinePolicies(deadlineDefault(config), config.DeadlinePolicies)
+		if err != nil {
+			return fmt.Errorf("GAE: %v", err)
+		}
+		f.GAETransport.SetDeadlinePolicies(deadlines)
+	}
+
+	glog.Infof("GAE: %#v reloaded", filename)
+	return nil
+}
+
+// Route tells apart the requests of DirectSites, which gae sends directly
+// through its MultiDialer, as "gae/direct".
+func (f *Filter) Route(req *http.Request) (string, bool) {
+	f.muConfig.RLock()
+	siteMatcher := f.SiteMatcher
+	directSiteMatcher := f.DirectSiteMatcher
+	f.muConfig.RUnlock()
+
+	if !siteMatcher.Match(req.Host) {
+		return "", false
+	}
+	if directSiteMatcher.Match(req.Host) && req.URL.Scheme != "http" && !f.shouldForceGAE(req) {
+		return filterName + "/direct", true
+	}
+	return filterName, true
+}
+
 func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
-	if !f.SiteMatcher.Match(req.Host) {
+	f.muConfig.RLock()
+	siteMatcher := f.SiteMatcher
+	fakeOptionsMatcher := f.FakeOptionsMatcher
+	forceHTTPSMatcher := f.ForceHTTPSMatcher
+	directSiteMatcher := f.DirectSiteMatcher
+	hedgeSiteMatcher := f.HedgeSiteMatcher
+	f.muConfig.RUnlock()
+
+	if !siteMatcher.Match(req.Host) {
 		return ctx, nil, nil
 	}
 
 	if req.Method == http.MethodOptions {
-		if v, ok := f.FakeOptionsMatcher.Lookup(req.Host); ok {
+		if v, ok := fakeOptionsMatcher.Lookup(req.Host); ok {
 			resp := &http.Response{
 				Status:        "200 OK",
 				StatusCode:    http.StatusOK,
@@ -249,14 +915,14 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 			if origin := req.Header.Get("Origin"); origin != "" {
 				resp.Header.Set("Access-Control-Allow-Origin", origin)
 			}
-			glog.V(2).Infof("%s \"GAE FAKEOPTIONS %s %s %s\" %d %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
+			glog.V(2).Infof("%s \"GAE FAKEOPTIONS %s %s %s\" %d %s", filters.RemoteAddr(req), req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
 			return ctx, resp, nil
 		}
 	}
 
 	var tr http.RoundTripper = f.GAETransport
 
-	if req.URL.Scheme == "http" && f.ForceHTTPSMatcher.Match(req.Host) {
+	if req.URL.Scheme == "http" && forceHTTPSMatcher.Match(req.Host) {
 		if !strings.HasPrefix(req.Header.Get("Referer"), "https://") {
 			u := strings.Replace(req.URL.String(), "http://", "https://", 1)
 			glog.V(2).Infof("GAE FORCEHTTPS get raw url=%v, redirect to %v", req.URL.String(), u)
@@ -273,12 +939,12 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 				Close:         true,
 				ContentLength: -1,
 			}
-			glog.V(2).Infof("%s \"GAE FORCEHTTPS %s %s %s\" %d %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
+			glog.V(2).Infof("%s \"GAE FORCEHTTPS %s %s %s\" %d %s", filters.RemoteAddr(req), req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
 			return ctx, resp, nil
 		}
 	}
 
-	if f.DirectSiteMatcher.Match(req.Host) {
+	if directSiteMatcher.Match(req.Host) {
 		if req.URL.Path == "/url" {
 			if u := req.URL.Query().Get("url"); u != "" {
 				glog.V(2).Infof("GAE REDIRECT get raw url=%v, redirect to %v", req.URL.String(), u)
@@ -300,6 +966,7 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 
 		if req.URL.Scheme != "http" && !f.shouldForceGAE(req) {
 			tr = f.DirectTransport
+			req.Host = f.MultiDialer().HostHeader(req.Host)
 			if s := req.Header.Get("Connection"); s != "" {
 				if s1 := strings.ToLower(s); s != s1 {
 					req.Header.Set("Connection", s1)
@@ -313,9 +980,25 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 		prefix = "DIRECT"
 	}
 
-	resp, err := tr.RoundTrip(req)
+	var resp *http.Response
+	var err error
+	if tr == f.GAETransport && len(f.GAETransport.Servers) > 1 && isIdempotent(req) && hedgeSiteMatcher.Match(req.Host) {
+		prefix = "HEDGE"
+		resp, err = f.GAETransport.Hedge(req)
+	} else if deadlines := f.GAETransport.deadlinePolicies(); deadlines != nil && tr == f.DirectTransport {
+		p, _ := deadlines.Lookup(req.Host)
+		resp, err = helpers.RoundTripWithDeadline(tr, req, p)
+	} else {
+		resp, err = tr.RoundTrip(req)
+	}
+	if err == nil && tr == f.GAETransport {
+		resp, err = f.GAETransport.followRedirects(req, resp)
+	}
+	if err == nil && isRedirect(resp) {
+		rewriteLocation(resp, forceHTTPSMatcher)
+	}
 	if err != nil {
-		glog.Warningf("%s \"GAE %s %s %s %s\" error: %T(%v)", req.RemoteAddr, prefix, req.Method, req.URL.String(), req.Proto, err, err)
+		glog.Warningf("%s \"GAE %s %s %s %s\" error: %T(%v)", filters.RemoteAddr(req), prefix, req.Method, req.URL.String(), req.Proto, err, err)
 		if tr == f.DirectTransport {
 			if ne, ok := err.(interface {
 				Timeout() bool
@@ -324,19 +1007,35 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 					t1.CloseIdleConnections()
 				} else if t2, ok := tr.(*http2.Transport); ok {
 					t2.CloseConnections()
+				} else if t3, ok := tr.(*QuicTransport); ok {
+					t3.CloseIdleConnections()
 				}
 			}
 		}
 	} else {
-		glog.V(2).Infof("%s \"GAE %s %s %s %s\" %d %s", req.RemoteAddr, prefix, req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
+		glog.V(2).Infof("%s \"GAE %s %s %s %s\" %d %s", filters.RemoteAddr(req), prefix, req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
+		// the client asks for the whole body, but it is too large for urlfetch
+		if tr == f.GAETransport && f.AutoRangeChunkSize > 0 && resp.StatusCode == http.StatusPartialContent &&
+			req.Method == http.MethodGet && req.Header.Get("Range") == "" {
+			resp = f.stitchRanges(req, resp)
+		}
+		// a body of unknown length may be a stream, e.g. server-sent events
+		// relayed by a fetch server which supports them
+		if f.FlushInterval != 0 && resp.ContentLength < 0 {
+			filters.SetFlushInterval(ctx, f.FlushInterval)
+		}
 	}
 
 	return ctx, resp, nil
 }
 
 func (f *Filter) shouldForceGAE(req *http.Request) bool {
-	if len(f.ForceGAEStrings) > 0 {
-		for _, s := range f.ForceGAEStrings {
+	f.muConfig.RLock()
+	forceGAEStrings := f.ForceGAEStrings
+	f.muConfig.RUnlock()
+
+	if len(forceGAEStrings) > 0 {
+		for _, s := range forceGAEStrings {
 			if strings.Contains(req.URL.String(), s) {
 				return true
 			}
@@ -344,3 +1043,174 @@ func (f *Filter) shouldForceGAE(req *http.Request) bool {
 	}
 	return false
 }
+
+// isIdempotent reports whether req may be sent twice, see Transport.Hedge.
+// newDeadlinePolicies returns the DeadlinePolicies of config, or nil if
+// there are none.
+func newDeadlinePolicies(config *Config) (*helpers.DeadlinePolicies, error) {
+	if len(config.DeadlinePolicies) == 0 {
+		return nil, nil
+	}
+	deadlines, err := helpers.NewDeadlinePolicies(deadlineDefault(config), config.DeadlinePolicies)
+	if err != nil {
+		return nil, fmt.Errorf("GAE: %v", err)
+	}
+	return deadlines, nil
+}
+
+// deadlineDefault is the policy of the hosts without one, the timeouts of
+// Transport.
+func deadlineDefault(config *Config) helpers.DeadlinePolicy {
+	return helpers.DeadlinePolicy{
+		ConnectTimeout:        config.Transport.Dialer.Timeout,
+		ResponseHeaderTimeout: config.Transport.ResponseHeaderTimeout,
+	}
+}
+
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return req.ContentLength == 0
+	}
+	return false
+}
+
+func parseDNSServers(ss []string) []net.IP {
+	dnsServers := make([]net.IP, 0)
+	for _, s := range ss {
+		if ip := net.ParseIP(s); ip != nil {
+			dnsServers = append(dnsServers, ip)
+		}
+	}
+	return dnsServers
+}
+
+func parseAliasDNSServers(m map[string][]string) (map[string][]string, error) {
+	servers := make(map[string][]string, len(m))
+	for alias, ss := range m {
+		for _, s := range ss {
+			server, err := dialer.ParseDNSServer(s)
+			if err != nil {
+				return nil, fmt.Errorf("GAE: AliasDNSServers[%#v] error: %v", alias, err)
+			}
+			servers[alias] = append(servers[alias], server)
+		}
+	}
+	return servers, nil
+}
+
+// checkSNIPolicies warns about the policies whose origin rejects the SNI and
+// Host header combination, the ones without CheckHost are skipped.
+func checkSNIPolicies(d *dialer.MultiDialer, policies map[string]dialer.SNIPolicy) {
+	for alias, p := range policies {
+		if p.CheckHost == "" {
+			continue
+		}
+		if err := d.CheckSNIPolicy(alias); err != nil {
+			glog.Warningf("GAE: SNIPolicies[%#v] is not accepted by %#v: %v", alias, p.CheckHost, err)
+		}
+	}
+}
+
+// setStaticHosts merges StaticHostsFile and StaticHosts into d, the latter
+// wins for the names in both.
+func setStaticHosts(d *dialer.MultiDialer, config *Config) error {
+	hosts := make(map[string][]string)
+	if config.StaticHostsFile != "" {
+		hosts1, err := dialer.ReadHostsFile(config.StaticHostsFile)
+		if err != nil {
+			return fmt.Errorf("GAE: StaticHostsFile error: %v", err)
+		}
+		hosts = hosts1
+	}
+	for host, names := range config.StaticHosts {
+		hosts[host] = names
+	}
+
+	if err := d.SetStaticHosts(hosts); err != nil {
+		return fmt.Errorf("GAE: %v", err)
+	}
+	return nil
+}
+
+// setupTelemetry starts or stops the opt-in report of the dial success of
+// the strategies of d, see helpers.Telemetry for what is sent.
+func setupTelemetry(d *dialer.MultiDialer, config *Config) error {
+	if !config.Telemetry.Enabled {
+		helpers.StopTelemetry(filterName)
+		return nil
+	}
+
+	if !config.EnableMetrics {
+		return fmt.Errorf("GAE: Telemetry needs EnableMetrics")
+	}
+
+	t := &helpers.Telemetry{
+		Endpoint: config.Telemetry.Endpoint,
+		Region:   config.Telemetry.Region,
+		ISP:      config.Telemetry.ISP,
+		Interval: time.Duration(config.Telemetry.Interval) * time.Second,
+		Epsilon:  config.Telemetry.Epsilon,
+		MinCount: config.Telemetry.MinCount,
+		Source: func() map[string]helpers.TelemetryCount {
+			counts := make(map[string]helpers.TelemetryCount)
+			helpers.DefaultMetrics.Counters("goproxy_dial_attempts_total", func(labels map[string]string, value float64) {
+				if !d.HasAlias(labels["alias"]) {
+					return
+				}
+				key := "type=" + labels["type"] + "," + d.Strategy(labels["alias"])
+				c := counts[key]
+				if labels["result"] == "ok" {
+					c.OK += value
+				} else {
+					c.Error += value
+				}
+				counts[key] = c
+			})
+			return counts
+		},
+	}
+
+	if err := helpers.StartTelemetry(filterName, t); err != nil {
+		return fmt.Errorf("GAE: %v", err)
+	}
+	return nil
+}
+
+// mergeFetchServerHosts routes the fetch server hostnames through MultiDialer
+// without touching the site aliases of config. A host mapped to one existing
+// alias uses it, otherwise its own alias is made of the given ips or names,
+// an empty list resolves the host itself through DNSServers.
+func mergeFetchServerHosts(site2alias map[string]string, hostMap map[string][]string, hosts map[string][]string) (map[string]string, map[string][]string) {
+	if len(hosts) == 0 {
+		return site2alias, hostMap
+	}
+
+	site2alias1 := make(map[string]string, len(site2alias)+len(hosts))
+	for host, alias := range site2alias {
+		site2alias1[host] = alias
+	}
+
+	hostMap1 := make(map[string][]string, len(hostMap)+len(hosts))
+	for alias, names := range hostMap {
+		hostMap1[alias] = names
+	}
+
+	for host, names := range hosts {
+		if len(names) == 1 {
+			if _, ok := hostMap[names[0]]; ok {
+				site2alias1[host] = names[0]
+				continue
+			}
+		}
+
+		alias := "fetchserver_" + host
+		if len(names) == 0 {
+			names = []string{host}
+		}
+		site2alias1[host] = alias
+		hostMap1[alias] = names
+	}
+
+	return site2alias1, hostMap1
+}
@@ -0,0 +1,62 @@
+package gae
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/phuslu/glog"
+	"github.com/quic-go/quic-go/http3"
+
+	"../../helpers"
+)
+
+const (
+	DefaultQuicCooldown time.Duration = 5 * time.Minute
+)
+
+// QuicTransport sends the https requests to the google frontends over
+// HTTP/3, dialed by MultiDialer.DialQUIC. After HTTP/3 failed, e.g. UDP/443
+// is blocked, the requests go through Fallback for Cooldown.
+type QuicTransport struct {
+	*http3.Transport
+	Fallback http.RoundTripper
+	Cooldown time.Duration
+
+	brokenUntil int64
+}
+
+func (t *QuicTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" || time.Now().UnixNano() < atomic.LoadInt64(&t.brokenUntil) {
+		return t.Fallback.RoundTrip(req)
+	}
+
+	resp, err := t.Transport.RoundTrip(req)
+	if err == nil || req.Context().Err() != nil {
+		return resp, err
+	}
+
+	glog.Warningf("GAE: HTTP/3 %s %s error: %v, fall back to TCP for %s", req.Method, req.URL.Host, err, t.Cooldown)
+	atomic.StoreInt64(&t.brokenUntil, time.Now().Add(t.Cooldown).UnixNano())
+
+	// the body may be gone with the failed attempt
+	if !helpers.IsReplayable(req) {
+		return nil, err
+	}
+	if req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = body
+	}
+	return t.Fallback.RoundTrip(req)
+}
+
+func (t *QuicTransport) CloseIdleConnections() {
+	t.Transport.CloseIdleConnections()
+	if c, ok := t.Fallback.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
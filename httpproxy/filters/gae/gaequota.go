@@ -0,0 +1,229 @@
+package gae
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../../helpers"
+)
+
+const (
+	// the daily quotas of GAE reset at midnight Pacific Time
+	DefaultQuotaTimezone string = "America/Los_Angeles"
+)
+
+// AppIDQuota is the usage of one fetch server in the current quota day.
+type AppIDQuota struct {
+	Requests  int64
+	Bytes     int64
+	OverQuota bool
+	// when OverQuota is cleared, the next quota day or Retry-After
+	ResetAt time.Time
+}
+
+// QuotaManager tracks the requests and bytes sent through each fetch server
+// and the ones which are over quota, so that requests are scheduled to the
+// appids with quota left until they reset.
+type QuotaManager struct {
+	// bytes of a fetch server per quota day, 0 is unlimited
+	DailyBytes int64
+	Location   *time.Location
+
+	mu     sync.Mutex
+	appids map[string]*AppIDQuota
+}
+
+func NewQuotaManager(dailyBytes int64, timezone string) *QuotaManager {
+	if timezone == "" {
+		timezone = DefaultQuotaTimezone
+	}
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		glog.Warningf("GAE: load quota timezone %#v error: %v, fallback to UTC-8", timezone, err)
+		loc = time.FixedZone("PST", -8*60*60)
+	}
+
+	return &QuotaManager{
+		DailyBytes: dailyBytes,
+		Location:   loc,
+		appids:     make(map[string]*AppIDQuota),
+	}
+}
+
+// nextReset returns the start of the quota day after now.
+func (m *QuotaManager) nextReset(now time.Time) time.Time {
+	t := now.In(m.Location)
+	return time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, m.Location)
+}
+
+// appid returns the usage of server, which is reset if its quota day is over.
+// m.mu must be held.
+func (m *QuotaManager) appid(server Server) *AppIDQuota {
+	now := time.Now()
+
+	q, ok := m.appids[server.URL.Host]
+	if !ok || now.After(q.ResetAt) {
+		q = &AppIDQuota{ResetAt: m.nextReset(now)}
+		m.appids[server.URL.Host] = q
+	}
+	return q
+}
+
+// Add counts a request of server with n bytes sent or received.
+func (m *QuotaManager) Add(server Server, requests, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q := m.appid(server)
+	q.Requests += requests
+	q.Bytes += n
+	if m.DailyBytes > 0 && q.Bytes >= m.DailyBytes && !q.OverQuota {
+		glog.Warningf("GAE: %s has used %d bytes, over DailyBytes until %s", server.URL.Host, q.Bytes, q.ResetAt.Format(time.RFC3339))
+		q.OverQuota = true
+	}
+}
+
+// SetOverQuota marks server over quota until retryAfter, or the next quota
+// day if it is 0.
+func (m *QuotaManager) SetOverQuota(server Server, retryAfter time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	q := m.appid(server)
+	q.OverQuota = true
+	if retryAfter > 0 {
+		q.ResetAt = time.Now().Add(retryAfter)
+	}
+}
+
+// Reset clears the usage of the fetch server of host, or of all of them if
+// host is empty.
+func (m *QuotaManager) Reset(host string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if host == "" {
+		m.appids = make(map[string]*AppIDQuota)
+	} else {
+		delete(m.appids, host)
+	}
+}
+
+func (m *QuotaManager) hasQuota(server Server) bool {
+	return !m.appid(server).OverQuota
+}
+
+// Schedule returns server if it has quota left, or else the server of
+// servers with quota left which has used the fewest bytes. If all of them
+// are over quota, server is returned as is.
+func (m *QuotaManager) Schedule(server Server, servers []Server) Server {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.hasQuota(server) {
+		return server
+	}
+
+	n, min := -1, int64(0)
+	for i, s := range servers {
+		if !m.hasQuota(s) {
+			continue
+		}
+		if used := m.appid(s).Bytes; n < 0 || used < min {
+			n, min = i, used
+		}
+	}
+	if n < 0 {
+		return server
+	}
+
+	glog.V(2).Infof("GAE: %s is over quota, schedule to %s", server.URL.Host, servers[n].URL.Host)
+	return servers[n]
+}
+
+// Usage returns the usage of the fetch servers by host.
+func (m *QuotaManager) Usage() map[string]AppIDQuota {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	usage := make(map[string]AppIDQuota, len(m.appids))
+	for host, q := range m.appids {
+		if now.After(q.ResetAt) {
+			continue
+		}
+		usage[host] = *q
+	}
+	return usage
+}
+
+// CountBody counts the bytes read from body to server.
+func (m *QuotaManager) CountBody(server Server, body io.ReadCloser) io.ReadCloser {
+	return &quotaBody{ReadCloser: body, m: m, server: server}
+}
+
+type quotaBody struct {
+	io.ReadCloser
+	m      *QuotaManager
+	server Server
+	n      int64
+	once   sync.Once
+}
+
+func (b *quotaBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(&b.n, int64(n))
+	return n, err
+}
+
+func (b *quotaBody) Close() error {
+	b.once.Do(func() {
+		b.m.Add(b.server, 0, atomic.LoadInt64(&b.n))
+	})
+	return b.ReadCloser.Close()
+}
+
+// overQuotaResponse reports whether resp of a fetch server says it is over
+// quota, i.e. 503, or 403/429/500 with an "Over Quota" page or an
+// OverQuotaError of urlfetch, and the Retry-After of it. The sniffed head
+// of the body is put back.
+func overQuotaResponse(resp *http.Response) (bool, time.Duration) {
+	var retryAfter time.Duration
+	if s := resp.Header.Get("Retry-After"); s != "" {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			retryAfter = time.Duration(n) * time.Second
+		} else if t, err := http.ParseTime(s); err == nil {
+			retryAfter = time.Until(t)
+		}
+	}
+
+	switch resp.StatusCode {
+	case http.StatusServiceUnavailable:
+		return true, retryAfter
+	case http.StatusForbidden, http.StatusTooManyRequests, http.StatusInternalServerError:
+		break
+	default:
+		return false, 0
+	}
+
+	if resp.Body == nil {
+		return false, 0
+	}
+
+	head, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	resp.Body = helpers.NewMultiReadCloser(bytes.NewReader(head), resp.Body)
+
+	head = bytes.ToLower(head)
+	if bytes.Contains(head, []byte("over quota")) || bytes.Contains(head, []byte("overquotaerror")) {
+		return true, retryAfter
+	}
+	return false, 0
+}
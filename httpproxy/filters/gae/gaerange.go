@@ -0,0 +1,358 @@
+package gae
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/phuslu/glog"
+
+	"../../filters"
+)
+
+const (
+	DefaultAutoRangeChunkSize int = 4 * 1024 * 1024
+	DefaultAutoRangeThreads   int = 4
+)
+
+// errRangeChanged is the error of a chunk of another version of the body, it
+// is not retried.
+var errRangeChanged = errors.New("the body has changed since the first range")
+
+// parseContentRange parses "bytes start-end/total".
+func parseContentRange(s string) (start, end, total int64, err error) {
+	if !strings.HasPrefix(s, "bytes ") {
+		return 0, 0, 0, fmt.Errorf("unsupported Content-Range %#v", s)
+	}
+	if _, err = fmt.Sscanf(s[len("bytes "):], "%d-%d/%d", &start, &end, &total); err != nil {
+		return 0, 0, 0, fmt.Errorf("malformed Content-Range %#v", s)
+	}
+	if start > end || end >= total {
+		return 0, 0, 0, fmt.Errorf("invalid Content-Range %#v", s)
+	}
+	return
+}
+
+// stitchRanges handles the 206 which the server side returns instead of a
+// response too large for urlfetch. The rest of body is fetched in ChunkSize
+// Range requests by Threads workers, each one picks its own appid, and the
+// chunks are streamed to client in order as a plain 200 response.
+func (f *Filter) stitchRanges(req *http.Request, resp *http.Response) *http.Response {
+	start, end, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+	if err != nil || start != 0 {
+		return resp
+	}
+
+	resp.Status = "200 OK"
+	resp.StatusCode = http.StatusOK
+	resp.ContentLength = total
+	resp.Header.Set("Content-Length", strconv.FormatInt(total, 10))
+	resp.Header.Del("Content-Range")
+
+	// the first range must be whole, or the chunks after it are misplaced
+	first := &exactBody{ReadCloser: resp.Body, n: end + 1}
+	if end+1 == total {
+		resp.Body = first
+		return resp
+	}
+
+	chunkSize := int64(f.AutoRangeChunkSize)
+	glog.V(2).Infof("%s \"GAE AUTORANGE %s %s %s\" %d %d chunks", filters.RemoteAddr(req), req.Method, req.URL.String(), req.Proto, total, (total-end-1+chunkSize-1)/chunkSize)
+
+	body := &rangeBody{
+		first: first,
+		order: make(chan chan rangeChunk, f.AutoRangeThreads),
+		done:  make(chan struct{}),
+		version: rangeVersion{
+			total:        total,
+			etag:         resp.Header.Get("ETag"),
+			lastModified: resp.Header.Get("Last-Modified"),
+		},
+	}
+	go body.fetch(f, req, end+1, chunkSize)
+
+	resp.Body = body
+	return resp
+}
+
+// rangeChunk is the data of a chunk, or the rest of the body from its start
+// on in stream if the server ignores Range.
+type rangeChunk struct {
+	data   []byte
+	stream io.ReadCloser
+	err    error
+}
+
+// rangeVersion tells the body of the first response, the chunks must be of
+// the same one.
+type rangeVersion struct {
+	total        int64
+	etag         string
+	lastModified string
+}
+
+func (v rangeVersion) check(resp *http.Response) error {
+	if etag := resp.Header.Get("ETag"); v.etag != "" && etag != "" && etag != v.etag {
+		return fmt.Errorf("%w: ETag %#v, it was %#v", errRangeChanged, etag, v.etag)
+	}
+	if lastModified := resp.Header.Get("Last-Modified"); v.lastModified != "" && lastModified != "" && lastModified != v.lastModified {
+		return fmt.Errorf("%w: Last-Modified %#v, it was %#v", errRangeChanged, lastModified, v.lastModified)
+	}
+	return nil
+}
+
+// rangeBody reads the first response then the chunks in order, at most
+// cap(order) chunks are fetched ahead of the reader.
+type rangeBody struct {
+	first   io.ReadCloser
+	order   chan chan rangeChunk
+	done    chan struct{}
+	version rangeVersion
+	cur     io.Reader
+	stream  io.Closer
+	once    sync.Once
+}
+
+func (b *rangeBody) fetch(f *Filter, req *http.Request, start, chunkSize int64) {
+	defer close(b.order)
+
+	total := b.version.total
+
+	threads := cap(b.order)
+	if chunks := int((total - start + chunkSize - 1) / chunkSize); chunks < threads {
+		threads = chunks
+	}
+	f.Prewarm(req, threads)
+
+	for ; start < total; start += chunkSize {
+		end := start + chunkSize - 1
+		if end > total-1 {
+			end = total - 1
+		}
+
+		c := make(chan rangeChunk, 1)
+		select {
+		case b.order <- c:
+		case <-b.done:
+			return
+		}
+
+		go func(start, end int64) {
+			var chunk rangeChunk
+			retry := f.GAETransport.Retry
+			for i := 0; i < retry.Attempts(); i++ {
+				if i > 0 && retry.Sleep(req.Context(), i) != nil {
+					break
+				}
+				chunk.data, chunk.stream, chunk.err = f.fetchRange(req, start, end, b.version)
+				if chunk.err == nil || errors.Is(chunk.err, errRangeChanged) || !retry.RetryError(chunk.err) {
+					break
+				}
+				glog.Warningf("%s \"GAE AUTORANGE %s bytes=%d-%d\" error: %v", filters.RemoteAddr(req), req.URL.String(), start, end, chunk.err)
+			}
+			c <- chunk
+		}(start, end)
+	}
+}
+
+// Prewarm opens n connections to where the requests like req go, an appid or
+// the site itself for DirectSites, and keeps them in the idle pool of
+// MultiDialer for the chunks to come.
+func (f *Filter) Prewarm(req *http.Request, n int) int {
+	d := f.MultiDialer()
+	if d == nil {
+		return 0
+	}
+
+	var scheme, host string
+	switch egress, ok := f.Route(req); {
+	case !ok:
+		return 0
+	case egress == filterName+"/direct":
+		scheme, host = req.URL.Scheme, req.URL.Host
+	default:
+		f.GAETransport.muServers.Lock()
+		u := f.GAETransport.Servers[0].URL
+		f.GAETransport.muServers.Unlock()
+		scheme, host = u.Scheme, u.Host
+	}
+	if scheme != "https" {
+		return 0
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, "443")
+	}
+
+	return d.Prewarm(req.Context(), "tcp", host, n)
+}
+
+// fetchRange returns bytes start-end of the body of version. If the server
+// ignores Range and answers the whole body, its stream from start on is
+// returned instead.
+func (f *Filter) fetchRange(req *http.Request, start, end int64, version rangeVersion) ([]byte, io.ReadCloser, error) {
+	req1 := filters.ReplayRequest(req)
+	req1.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+
+	resp, err := f.GAETransport.RoundTrip(req1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := version.check(resp); err != nil {
+		resp.Body.Close()
+		return nil, nil, err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		break
+	case http.StatusOK:
+		if resp.ContentLength >= 0 && resp.ContentLength != version.total {
+			resp.Body.Close()
+			return nil, nil, fmt.Errorf("%w: length %d, it was %d", errRangeChanged, resp.ContentLength, version.total)
+		}
+		glog.Warningf("%s \"GAE AUTORANGE %s\" ignores Range, switch to a single stream from %d", filters.RemoteAddr(req), req.URL.String(), start)
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, start); err != nil {
+			resp.Body.Close()
+			return nil, nil, err
+		}
+		return nil, &exactBody{ReadCloser: resp.Body, n: version.total - start}, nil
+	default:
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	defer resp.Body.Close()
+
+	start1, end1, total1, err := parseContentRange(resp.Header.Get("Content-Range"))
+	switch {
+	case err != nil:
+		return nil, nil, err
+	case total1 != version.total:
+		return nil, nil, fmt.Errorf("%w: Content-Range %#v, the length was %d", errRangeChanged, resp.Header.Get("Content-Range"), version.total)
+	case start1 != start || end1 != end:
+		return nil, nil, fmt.Errorf("Content-Range %#v mismatch bytes=%d-%d", resp.Header.Get("Content-Range"), start, end)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, end-start+2))
+	if err != nil {
+		return nil, nil, err
+	}
+	if int64(len(data)) != end-start+1 {
+		return nil, nil, fmt.Errorf("short chunk bytes=%d-%d, got %d bytes", start, end, len(data))
+	}
+
+	return data, nil, nil
+}
+
+// exactBody fails a body which is not n bytes long.
+type exactBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *exactBody) Read(p []byte) (int, error) {
+	if b.n <= 0 {
+		var one [1]byte
+		if m, _ := b.ReadCloser.Read(one[:]); m > 0 {
+			return 0, fmt.Errorf("long range, more bytes than expected")
+		}
+		return 0, io.EOF
+	}
+
+	if int64(len(p)) > b.n {
+		p = p[:b.n]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.n -= int64(n)
+	if err == io.EOF && b.n > 0 {
+		err = fmt.Errorf("short range, %d bytes missing: %w", b.n, io.ErrUnexpectedEOF)
+	}
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+func (b *rangeBody) Read(p []byte) (int, error) {
+	if b.first != nil {
+		n, err := b.first.Read(p)
+		if err != io.EOF {
+			return n, err
+		}
+		b.first.Close()
+		b.first = nil
+		if n > 0 {
+			return n, nil
+		}
+	}
+
+	for {
+		if b.cur != nil {
+			n, err := b.cur.Read(p)
+			if err != io.EOF {
+				return n, err
+			}
+			b.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+		}
+		if b.stream != nil {
+			return 0, io.EOF
+		}
+
+		c, ok := <-b.order
+		if !ok {
+			return 0, io.EOF
+		}
+
+		chunk := <-c
+		if chunk.err != nil {
+			return 0, chunk.err
+		}
+		if chunk.stream != nil {
+			// the stream holds the rest, the chunks after it are dropped
+			b.stop()
+			b.cur, b.stream = chunk.stream, chunk.stream
+			b.order = nil
+			continue
+		}
+		b.cur = bytes.NewReader(chunk.data)
+	}
+}
+
+// stop ends fetch and closes the streams of the chunks fetched ahead.
+func (b *rangeBody) stop() {
+	b.once.Do(func() {
+		close(b.done)
+		if order := b.order; order != nil {
+			go func() {
+				for c := range order {
+					if chunk := <-c; chunk.stream != nil {
+						chunk.stream.Close()
+					}
+				}
+			}()
+		}
+	})
+}
+
+func (b *rangeBody) Close() error {
+	b.stop()
+	if b.first != nil {
+		b.first.Close()
+		b.first = nil
+	}
+	if b.stream != nil {
+		b.stream.Close()
+		b.stream = nil
+	}
+	return nil
+}
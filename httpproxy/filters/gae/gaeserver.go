@@ -4,45 +4,119 @@ import (
 	"bufio"
 	"bytes"
 	"compress/flate"
+	"compress/gzip"
 	"encoding/binary"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httputil"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/phuslu/glog"
+
 	"../../helpers"
 )
 
+const (
+	EncodingFlate  string = "deflate"
+	EncodingBrotli string = "br"
+	EncodingZstd   string = "zstd"
+)
+
+const (
+	// bodies larger than this are sent as is even if EncodeBody is set
+	maxEncodeBodySize int64 = 8 * 1024 * 1024
+	// the error bodies within the compressed header block are kept in
+	// memory up to this, the 64K block inflates to a lot more
+	defaultMaxErrorBody int64 = 1024 * 1024
+)
+
+// FetchOption overrides the urlfetch behavior for the sites it is set for,
+// e.g. login flows which break if the server follows redirects itself.
+type FetchOption struct {
+	FollowRedirects bool
+	// 0 keeps the default of server side
+	MaxSize int64
+	// follow up to MaxRedirects redirects on our side instead of urlfetch,
+	// so that each hop is logged and goes through the proxy rules
+	MaxRedirects int
+}
+
 type Server struct {
-	URL       *url.URL
-	Password  string
-	SSLVerify bool
-	Deadline  time.Duration
+	URL            *url.URL
+	Password       string
+	SignRequest    bool
+	KeyID          string
+	SSLVerify      bool
+	Deadline       time.Duration
+	PaddingPercent int
+	PaddingMax     int
+	PaddingBody    bool
+	UserAgents     []string
+	Headers        *helpers.HeaderNormalizer
+	Encoding       string
+	EncodeBody     bool
+	Obfuscate      string
+	ObfuscateKey   string
+	MaxErrorBody   int64
+	FetchOption    *FetchOption
 }
 
 func (f *Server) encodeRequest(req *http.Request) (*http.Request, error) {
 	var err error
 	var b bytes.Buffer
 
-	w, err := flate.NewWriter(&b, flate.BestCompression)
+	w, err := newEncoder(&b, f.Encoding)
 	if err != nil {
 		return nil, err
 	}
 
 	fmt.Fprintf(w, "%s %s HTTP/1.1\r\n", req.Method, req.URL.String())
-	req.Header.WriteSubset(w, helpers.ReqWriteExcludeHeader)
+	if f.Headers != nil {
+		helpers.WriteHeaderOrdered(w, f.Headers.Header(req.Host, req.Header), helpers.ReqWriteExcludeHeader)
+	} else {
+		req.Header.WriteSubset(w, helpers.ReqWriteExcludeHeader)
+	}
 	fmt.Fprintf(w, "X-Urlfetch-Password: %s\r\n", f.Password)
 	if f.Deadline > 0 {
 		fmt.Fprintf(w, "X-Urlfetch-Deadline: %d\r\n", f.Deadline/time.Second)
 	}
+	if o := f.FetchOption; o != nil {
+		if o.FollowRedirects && o.MaxRedirects <= 0 {
+			io.WriteString(w, "X-Urlfetch-Redirect: 1\r\n")
+		} else {
+			io.WriteString(w, "X-Urlfetch-Redirect: 0\r\n")
+		}
+		if o.MaxSize > 0 {
+			fmt.Fprintf(w, "X-Urlfetch-MaxSize: %d\r\n", o.MaxSize)
+		}
+	}
+	padding, bodyPadding := helpers.RandomPadding(req.ContentLength+1024, f.PaddingPercent, f.PaddingMax), ""
+	if f.PaddingBody {
+		padding, bodyPadding = helpers.RandomPaddings(req.ContentLength+1024, f.PaddingPercent, f.PaddingMax)
+	}
+	if padding != "" {
+		fmt.Fprintf(w, "%s: %s\r\n", helpers.PaddingHeader, padding)
+	}
+	if bodyPadding != "" {
+		fmt.Fprintf(w, "%s: %d\r\n", helpers.PaddingBodyHeader, len(bodyPadding))
+	}
+	helpers.WritePaddingOptions(w, f.PaddingPercent, f.PaddingMax)
 	w.Close()
 
 	b0 := make([]byte, 2)
 	binary.BigEndian.PutUint16(b0, uint16(b.Len()))
 
+	// the padding chunk goes before the body, so the body may be streamed
+	b.WriteString(bodyPadding)
+
 	req1 := &http.Request{
 		Proto:      "HTTP/1.1",
 		ProtoMajor: 1,
@@ -54,25 +128,102 @@ func (f *Server) encodeRequest(req *http.Request) (*http.Request, error) {
 	}
 
 	if req1.URL.Scheme == "https" {
-		req1.Header.Set("User-Agent", "a")
+		req1.Header.Set("User-Agent", helpers.RandomUserAgent(f.UserAgents))
+	}
+
+	// old server-side scripts ignore it and only speak flate
+	if f.Encoding != "" && f.Encoding != EncodingFlate {
+		req1.Header.Set("X-Urlfetch-Encoding", f.Encoding)
+	}
+
+	body, contentLength := req.Body, req.ContentLength
+	if f.EncodeBody && req1.Header.Get("X-Urlfetch-Encoding") != "" && contentLength > 0 && contentLength <= maxEncodeBodySize {
+		var b1 bytes.Buffer
+		w1, err := newEncoder(&b1, f.Encoding)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = io.Copy(w1, req.Body); err != nil {
+			return nil, err
+		}
+		if err = w1.Close(); err != nil {
+			return nil, err
+		}
+		body, contentLength = ioutil.NopCloser(&b1), int64(b1.Len())
+		req1.Header.Set("X-Urlfetch-Body-Encoding", f.Encoding)
 	}
 
-	if req.ContentLength > 0 {
-		req1.ContentLength = int64(len(b0)+b.Len()) + req.ContentLength
-		req1.Body = helpers.NewMultiReadCloser(bytes.NewReader(b0), &b, req.Body)
+	if contentLength > 0 {
+		req1.ContentLength = int64(len(b0)+b.Len()) + contentLength
+		req1.Body = helpers.NewMultiReadCloser(bytes.NewReader(b0), &b, body)
 	} else {
 		req1.ContentLength = int64(len(b0) + b.Len())
 		req1.Body = helpers.NewMultiReadCloser(bytes.NewReader(b0), &b)
 	}
 
+	if f.Obfuscate != "" {
+		nonce, err := helpers.NewObfuscateNonce()
+		if err != nil {
+			return nil, err
+		}
+		stream, err := helpers.NewObfuscator(f.Obfuscate, f.obfuscateKey(), nonce, "request")
+		if err != nil {
+			return nil, err
+		}
+		// a stream cipher keeps the length, so ContentLength holds
+		req1.Body = helpers.NewObfuscatedBody(req1.Body, stream)
+		req1.Header.Set("X-Urlfetch-Options", helpers.FormatUrlfetchOptions(f.Obfuscate, nonce))
+	}
+
+	if f.SignRequest && f.Password != "" {
+		helpers.SignRequest(req1, f.Password, f.KeyID, "")
+	}
+
 	return req1, nil
 }
 
+func (f *Server) obfuscateKey() string {
+	if f.ObfuscateKey != "" {
+		return f.ObfuscateKey
+	}
+	return f.Password
+}
+
+// deobfuscateResponse unscrambles the body of a fetch which the server has
+// obfuscated with the nonce of the request, other bodies are left alone.
+func (f *Server) deobfuscateResponse(resp *http.Response) error {
+	options := helpers.ParseUrlfetchOptions(resp.Header.Get("X-Urlfetch-Options"))
+	method := options["obfs"]
+	if method == "" {
+		return nil
+	}
+
+	if resp.Request == nil {
+		return fmt.Errorf("urlfetch obfuscated response without request")
+	}
+	nonce, err := hex.DecodeString(helpers.ParseUrlfetchOptions(resp.Request.Header.Get("X-Urlfetch-Options"))["nonce"])
+	if err != nil || len(nonce) == 0 {
+		return fmt.Errorf("urlfetch obfuscated response of a request without nonce")
+	}
+
+	stream, err := helpers.NewObfuscator(method, f.obfuscateKey(), nonce, "response")
+	if err != nil {
+		return err
+	}
+	resp.Body = helpers.NewObfuscatedBody(resp.Body, stream)
+
+	return nil
+}
+
 func (f *Server) decodeResponse(resp *http.Response) (resp1 *http.Response, err error) {
 	if resp.StatusCode != http.StatusOK {
 		return resp, nil
 	}
 
+	if err = f.deobfuscateResponse(resp); err != nil {
+		return
+	}
+
 	var hdrLen uint16
 	if err = binary.Read(resp.Body, binary.BigEndian, &hdrLen); err != nil {
 		return
@@ -83,10 +234,46 @@ func (f *Server) decodeResponse(resp *http.Response) (resp1 *http.Response, err
 		return
 	}
 
-	resp1, err = http.ReadResponse(bufio.NewReader(flate.NewReader(bytes.NewReader(hdrBuf))), resp.Request)
+	hdr, err := newDecoder(bytes.NewReader(hdrBuf), resp.Header.Get("X-Urlfetch-Encoding"))
 	if err != nil {
 		return
 	}
+	defer hdr.Close()
+
+	resp1, err = http.ReadResponse(bufio.NewReader(hdr), resp.Request)
+	if err != nil {
+		return
+	}
+
+	// the length of the body which follows the header block, the obfuscation
+	// keeps it, the body encoding does not
+	bodyLen := int64(-1)
+	if resp.ContentLength >= 0 {
+		bodyLen = resp.ContentLength - 2 - int64(hdrLen)
+	}
+
+	// only a padding asked for is trusted, the server may be an old one which
+	// relays the headers of the origin as is
+	if f.PaddingPercent > 0 {
+		var n int64
+		if n, err = helpers.DiscardPadding(resp.Body, resp1.Header); err != nil {
+			return
+		}
+		if bodyLen >= 0 {
+			bodyLen -= n
+		}
+	}
+
+	if encoding := resp.Header.Get("X-Urlfetch-Body-Encoding"); encoding != "" {
+		bodyLen = -1
+		var body io.ReadCloser
+		if body, err = newDecoder(resp.Body, encoding); err != nil {
+			return
+		}
+		resp.Body = &decodedBody{body, resp.Body}
+		resp1.ContentLength = -1
+		resp1.Header.Del("Content-Length")
+	}
 
 	const cookieKey string = "Set-Cookie"
 	if cookies, ok := resp1.Header[cookieKey]; ok && len(cookies) == 1 {
@@ -117,16 +304,187 @@ func (f *Server) decodeResponse(resp *http.Response) (resp1 *http.Response, err
 		case resp1.Body == nil:
 			resp1.Body = resp.Body
 		default:
-			b, _ := ioutil.ReadAll(resp1.Body)
-			if b != nil && len(b) > 0 {
+			// the header block is closed on return, so the error body
+			// within it has to be read now
+			max := f.MaxErrorBody
+			if max <= 0 {
+				max = defaultMaxErrorBody
+			}
+			b, _ := ioutil.ReadAll(io.LimitReader(resp1.Body, max+1))
+			if int64(len(b)) > max {
+				glog.Warningf("GAE: %s error body of %s is larger than %d bytes, truncated", f.URL.Host, resp1.Status, max)
+				b = b[:max]
+				resp1.ContentLength = -1
+				resp1.Header.Del("Content-Length")
+			}
+			if len(b) > 0 {
 				resp1.Body = helpers.NewMultiReadCloser(bytes.NewReader(b), resp.Body)
 			} else {
 				resp1.Body = resp.Body
 			}
 		}
 	} else {
-		resp1.Body = resp.Body
+		resp1.Body = reframeBody(resp1, resp.Body, bodyLen)
 	}
 
 	return
 }
+
+// reframeBody fixes the framing of resp which the fetchserver copied from the
+// origin as is. urlfetch has already dechunked the body, and usually gunzipped
+// it too, so the inner Transfer-Encoding and Content-Encoding may no longer
+// hold, nor the Content-Length. bodyLen is the length of body, -1 if unknown.
+func reframeBody(resp *http.Response, body io.ReadCloser, bodyLen int64) io.ReadCloser {
+	br := bufio.NewReader(body)
+	var r io.Reader = br
+
+	if len(resp.TransferEncoding) > 0 {
+		chunked := resp.TransferEncoding[len(resp.TransferEncoding)-1] == "chunked"
+		resp.TransferEncoding = nil
+		resp.ContentLength = -1
+		resp.Header.Del("Content-Length")
+		resp.Header.Del("Transfer-Encoding")
+		if chunked && isChunkHeader(peekLine(br, 32)) {
+			glog.V(2).Infof("GAE: dechunk the body of %s", resp.Request.URL)
+			r = httputil.NewChunkedReader(br)
+			bodyLen = -1
+		}
+	}
+
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "gzip", "x-gzip":
+		if r == io.Reader(br) && bodyLen != 0 {
+			if head, _ := br.Peek(2); len(head) > 0 && !isGzip(head) {
+				resp.Header.Del("Content-Encoding")
+			}
+		}
+	}
+
+	if bodyLen > 0 && resp.ContentLength != bodyLen {
+		if resp.ContentLength >= 0 {
+			glog.V(2).Infof("GAE: Content-Length of %s is %d, but its body is %d bytes", resp.Request.URL, resp.ContentLength, bodyLen)
+		}
+		resp.ContentLength = bodyLen
+		resp.Header.Set("Content-Length", strconv.FormatInt(bodyLen, 10))
+	}
+
+	return &decodedBody{ioutil.NopCloser(r), body}
+}
+
+// isChunkHeader reports whether b starts with a chunk size line, e.g. "1f4\r\n"
+// or "1f4;ext=1\r\n".
+func isChunkHeader(b []byte) bool {
+	i := 0
+	for i < len(b) && strings.IndexByte("0123456789abcdefABCDEF", b[i]) >= 0 {
+		i++
+	}
+	if i == 0 || i > 16 {
+		return false
+	}
+	if j := bytes.IndexByte(b[i:], '\n'); j > 0 && b[i+j-1] == '\r' {
+		return b[i] == '\r' || b[i] == ';' || b[i] == ' ' || b[i] == '\t'
+	}
+	return false
+}
+
+// peekLine peeks at the first line of br, up to max bytes, without waiting
+// for more than it needs, the body may be a slow stream.
+func peekLine(br *bufio.Reader, max int) []byte {
+	for n := 1; ; {
+		b, err := br.Peek(n)
+		if err != nil {
+			return b
+		}
+		b, _ = br.Peek(br.Buffered())
+		if bytes.IndexByte(b, '\n') >= 0 || len(b) >= max {
+			return b
+		}
+		n = len(b) + 1
+	}
+}
+
+func isGzip(b []byte) bool {
+	return len(b) >= 2 && b[0] == 0x1f && b[1] == 0x8b
+}
+
+// gunzipResponse decodes the gzip body of resp for a client which did not ask
+// for it, e.g. a script which does not send Accept-Encoding.
+func gunzipResponse(req *http.Request, resp *http.Response) {
+	if resp.Body == nil || strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+		return
+	}
+	switch strings.ToLower(resp.Header.Get("Content-Encoding")) {
+	case "gzip", "x-gzip":
+	default:
+		return
+	}
+
+	br := bufio.NewReader(resp.Body)
+	if head, _ := br.Peek(2); !isGzip(head) {
+		resp.Header.Del("Content-Encoding")
+		resp.Body = &decodedBody{ioutil.NopCloser(br), resp.Body}
+		return
+	}
+
+	r, err := gzip.NewReader(br)
+	if err != nil {
+		glog.Warningf("GAE: gunzip %s error: %v", req.URL, err)
+		resp.Body = &decodedBody{ioutil.NopCloser(br), resp.Body}
+		return
+	}
+
+	resp.Body = &decodedBody{r, resp.Body}
+	resp.ContentLength = -1
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+}
+
+func newEncoder(w io.Writer, encoding string) (io.WriteCloser, error) {
+	switch encoding {
+	case "", EncodingFlate:
+		return flate.NewWriter(w, flate.BestCompression)
+	case EncodingBrotli:
+		return brotli.NewWriterLevel(w, brotli.BestCompression), nil
+	case EncodingZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	default:
+		return nil, fmt.Errorf("unsupported urlfetch encoding %#v", encoding)
+	}
+}
+
+func newDecoder(r io.Reader, encoding string) (io.ReadCloser, error) {
+	switch encoding {
+	case "", EncodingFlate:
+		return flate.NewReader(r), nil
+	case EncodingBrotli:
+		return ioutil.NopCloser(brotli.NewReader(r)), nil
+	case EncodingZstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zstdReadCloser{d}, nil
+	default:
+		return nil, fmt.Errorf("unsupported urlfetch encoding %#v", encoding)
+	}
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (r zstdReadCloser) Close() error {
+	r.Decoder.Close()
+	return nil
+}
+
+// decodedBody reads through the decoder and closes both of it and the raw body
+type decodedBody struct {
+	io.ReadCloser
+	raw io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	b.ReadCloser.Close()
+	return b.raw.Close()
+}
@@ -3,42 +3,209 @@ package gae
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net"
 	"net/http"
 	"path"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"../../dialer"
+	"../../filters"
 	"../../helpers"
 
 	"github.com/phuslu/glog"
 )
 
+const (
+	ServerPolicyRoundRobin  string = "round-robin"
+	ServerPolicyLeastErrors string = "least-errors"
+)
+
+// smallRangeSize is the largest Range request which counts as small.
+const smallRangeSize int64 = 64 * 1024
+
 type Transport struct {
 	http.RoundTripper
-	MultiDialer *dialer.MultiDialer
-	Servers     []Server
-	muServers   sync.Mutex
-	RetryDelay  time.Duration
-	RetryTimes  int
+	SmallRoundTripper http.RoundTripper
+	MultiDialer       *dialer.MultiDialer
+	Servers           []Server
+	ServerPolicy      string
+	muServers         sync.Mutex
+	serverErrors      map[string]int
+	flateOnly         map[string]bool
+	serverIndex       uint32
+	Retry             *helpers.RetryPolicy
+	SpoolMemory       int64
+	MaxSpoolSize      int64
+	Metrics           helpers.MetricsRecorder
+	Quota             *QuotaManager
+	Gunzip            bool
+	fetchOptions      *helpers.HostMatcher
+	deadlines         *helpers.DeadlinePolicies
 }
 
+// RoundTrip spools the body of req when urlfetch needs it up front, i.e. its
+// length is unknown, or when a retry may need to send it again, i.e. req is
+// idempotent or its body is small. Other bodies are sent once and never
+// retried.
 func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
-	for i := 0; i < t.RetryTimes; i++ {
-		server := t.pickServer(req, i)
+	if helpers.IsReplayable(req) || (req.ContentLength >= 0 && !t.spoolForRetry(req)) {
+		return t.roundTrip(req, 0)
+	}
+
+	req1, rb, err := helpers.ReplayableRequest(req, t.SpoolMemory, t.MaxSpoolSize)
+	if err != nil {
+		return nil, fmt.Errorf("GAE spool request body: %v", err)
+	}
+	defer rb.Close()
+
+	resp, err := t.roundTrip(req1, 0)
+	if resp != nil {
+		resp.Request = req
+	}
+	return resp, err
+}
+
+// Hedge sends req through two appids at once and returns the first valid
+// response, the other one is discarded. req must be idempotent and have no
+// body.
+func (t *Transport) Hedge(req *http.Request) (*http.Response, error) {
+	type racer struct {
+		resp *http.Response
+		err  error
+	}
+
+	lane := make(chan racer, 2)
+	for _, offset := range []int{0, 1} {
+		go func(req *http.Request, offset int) {
+			resp, err := t.roundTrip(req, offset)
+			lane <- racer{resp, err}
+		}(filters.ReplayRequest(req), offset)
+	}
+
+	var r racer
+	for i := 0; i < 2; i++ {
+		r = <-lane
+		if r.err == nil && r.resp.StatusCode < http.StatusInternalServerError {
+			if i == 0 {
+				go func() {
+					if r1 := <-lane; r1.resp != nil {
+						r1.resp.Body.Close()
+					}
+				}()
+			}
+			r.resp.Request = req
+			return r.resp, nil
+		}
+		if i == 0 && r.resp != nil {
+			r.resp.Body.Close()
+		}
+	}
+
+	if r.resp != nil {
+		r.resp.Request = req
+	}
+	return r.resp, r.err
+}
+
+func (t *Transport) spoolForRetry(req *http.Request) bool {
+	if t.Retry.Attempts() <= 1 || req.ContentLength > t.MaxSpoolSize {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.ContentLength <= t.SpoolMemory
+}
+
+// roundTrip starts with the server picked for try offset, so that hedged
+// requests go through different appids. A body which cannot be replayed
+// gets one try.
+func (t *Transport) roundTrip(req *http.Request, offset int) (*http.Response, error) {
+	tries := t.Retry.Attempts()
+	if !helpers.IsReplayable(req) {
+		tries = 1
+	}
+
+	for i := 0; i < tries; i++ {
+		if i > 0 {
+			if err := t.Retry.Sleep(req.Context(), i); err != nil {
+				return nil, err
+			}
+		}
+
+		server := t.pickServer(req, i+offset)
+		if t.Quota != nil {
+			server = t.Quota.Schedule(server, t.Servers)
+		}
+		if t.isFlateOnly(server) {
+			server.Encoding, server.EncodeBody = "", false
+		}
+		server.FetchOption = t.lookupFetchOption(req.Host)
+
+		deadlines := t.deadlinePolicies()
+		var deadline helpers.DeadlinePolicy
+		if deadlines != nil {
+			var ok bool
+			deadline, ok = deadlines.Lookup(req.Host)
+			// urlfetch is asked to give up before us, as with the default one
+			if ok && deadline.ResponseHeaderTimeout > 4 {
+				server.Deadline = time.Duration(deadline.ResponseHeaderTimeout-4) * time.Second
+			}
+		}
+
+		// the previous try has drained the body
+		if i > 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
 
 		req1, err := server.encodeRequest(req)
 		if err != nil {
 			return nil, fmt.Errorf("GAE encodeRequest: %s", err.Error())
 		}
+		if t.MultiDialer != nil {
+			req1.Host = t.MultiDialer.HostHeader(req1.Host)
+		}
+		req1 = helpers.WithClientTrace(req.Context(), req1, "gae")
 
-		resp, err := t.RoundTripper.RoundTrip(req1)
+		rt := t.RoundTripper
+		if t.SmallRoundTripper != nil && isSmallRequest(req) {
+			rt = t.SmallRoundTripper
+		}
+
+		var resp *http.Response
+		if deadlines != nil {
+			resp, err = helpers.RoundTripWithDeadline(rt, req1, deadline)
+		} else {
+			resp, err = rt.RoundTrip(req1)
+		}
+		t.recordMetrics(server, req1, resp, err)
+		if err == nil && t.Quota != nil {
+			n := req1.ContentLength
+			if resp.StatusCode != http.StatusOK && resp.ContentLength > 0 {
+				n += resp.ContentLength
+			}
+			t.Quota.Add(server, 1, n)
+		}
+		if err == nil {
+			if addr, err := helpers.ReflectRemoteAddrFromResponse(resp); err == nil {
+				filters.SetUpstream(req.Context(), addr)
+			}
+		}
 
 		if err != nil {
+			t.markServer(server, false)
 
 			isTimeoutError := false
 			if ne, ok := err.(interface {
@@ -64,8 +231,11 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 				}
 			}
 
-			if i == t.RetryTimes-1 {
-				return nil, err
+			if i == tries-1 || !t.Retry.RetryError(err) {
+				if isTimeoutError {
+					return nil, helpers.NewError(helpers.ErrFetchTimeout, "GAE "+server.URL.Host, err)
+				}
+				return nil, helpers.NewError(helpers.ErrFetchServer, "GAE "+server.URL.Host, err)
 			} else {
 				glog.Warningf("GAE: request \"%s\" error: %T(%v), retry...", req.URL.String(), err, err)
 				continue
@@ -73,60 +243,107 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 		}
 
 		if resp.StatusCode != http.StatusOK {
-			if i == t.RetryTimes-1 {
+			t.markServer(server, false)
+
+			overQuota, retryAfter := overQuotaResponse(resp)
+			if overQuota && t.Quota != nil {
+				t.Quota.SetOverQuota(server, retryAfter)
+			}
+
+			if server.Obfuscate != "" && resp.Header.Get("X-Urlfetch-Options") == "" &&
+				(resp.StatusCode == http.StatusBadRequest || resp.StatusCode == http.StatusInternalServerError) {
+				// never fall back to plain, that is what the middlebox is looking for
+				glog.Warningf("GAE: %s returns %s, its server-side script may not support %#v obfuscation", server.URL.Host, resp.Status, server.Obfuscate)
+			}
+
+			if server.Encoding != "" && server.Encoding != EncodingFlate && unsupportedEncoding(resp, server.Encoding) {
+				glog.Warningf("GAE: %s does not support %#v encoding, fallback to flate", server.URL.Host, server.Encoding)
+				t.setFlateOnly(server)
+				// the next try sends the body again by GetBody, a body which
+				// cannot be replayed has only this try
+				if i < tries-1 && helpers.IsReplayable(req) {
+					resp.Body.Close()
+					continue
+				}
+			}
+
+			if i == tries-1 {
+				if overQuota {
+					resp.Body.Close()
+					return nil, helpers.NewError(helpers.ErrFetchQuota, "GAE "+server.URL.Host, nil)
+				}
 				return resp, nil
 			}
 
-			switch resp.StatusCode {
-			case http.StatusServiceUnavailable:
+			if overQuota {
+				resp.Body.Close()
 				if len(t.Servers) == 1 {
 					glog.Warningf("GAE: %s over qouta, please add more appids to gae.user.json", server.URL.Host)
 				} else {
 					glog.Warningf("GAE: %s over qouta, switch to next appid...", server.URL.Host)
 					t.roundServers()
 				}
-				time.Sleep(t.RetryDelay)
 				continue
+			}
+
+			switch resp.StatusCode {
 			case http.StatusBadGateway, http.StatusNotFound:
 				if t.MultiDialer != nil {
 					if addr, err := helpers.ReflectRemoteAddrFromResponse(resp); err == nil {
 						if ip, _, err := net.SplitHostPort(addr); err == nil {
 							glog.Warningf("GAE: %s StatusCode is %d, does not looks like a gws/gvs ip, add to blacklist for 2 hours", ip, resp.StatusCode)
-							t.MultiDialer.IPBlackList.Set(ip, struct{}{}, time.Now().Add(2*time.Hour))
+							t.MultiDialer.BlackListIP(ip, 2*time.Hour)
 						}
 					}
 				}
 				continue
 			default:
+				if len(t.Servers) > 1 && t.Retry.RetryStatus(resp.StatusCode) {
+					glog.Warningf("GAE: %s StatusCode is %d, retry with next appid...", server.URL.Host, resp.StatusCode)
+					resp.Body.Close()
+					continue
+				}
 				return resp, nil
 			}
 		}
 
+		t.markServer(server, true)
+		if t.Quota != nil {
+			resp.Body = t.Quota.CountBody(server, resp.Body)
+		}
+
+		start := time.Now()
 		resp1, err := server.decodeResponse(resp)
 		if err != nil {
+			helpers.TraceFrom(req.Context()).Addf("decode", "gae", "error: %v", err)
 			return nil, err
 		}
 		if resp1 != nil {
 			resp1.Request = req
+			if t.Gunzip {
+				gunzipResponse(req, resp1)
+			}
+			helpers.TraceFrom(req.Context()).Addf("decode", "gae", "%s from %s in %s", resp1.Status, server.URL.Host, time.Since(start))
 		}
-		if i == t.RetryTimes-1 {
-			return resp, err
+		if i == tries-1 {
+			return resp1, err
 		}
 
 		switch resp1.StatusCode {
 		case http.StatusBadGateway:
-			body, err := ioutil.ReadAll(resp1.Body)
+			// only sniff the head of body, the rest is streamed to client
+			head, err := ioutil.ReadAll(io.LimitReader(resp1.Body, 4096))
 			if err != nil {
 				resp1.Body.Close()
 				return nil, err
 			}
-			resp1.Body.Close()
 			switch {
-			case bytes.Contains(body, []byte("DEADLINE_EXCEEDED")):
+			case bytes.Contains(head, []byte("DEADLINE_EXCEEDED")):
+				resp1.Body.Close()
 				glog.V(2).Infof("GAE: %s urlfetch %#v get DEADLINE_EXCEEDED, retry...", req1.URL.Host, req.URL.String())
 				continue
 			default:
-				resp1.Body = ioutil.NopCloser(bytes.NewReader(body))
+				resp1.Body = helpers.NewMultiReadCloser(bytes.NewReader(head), resp1.Body)
 				return resp1, nil
 			}
 		default:
@@ -137,11 +354,75 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	return nil, fmt.Errorf("GAE: cannot reach here with %#v", req)
 }
 
+func (t *Transport) recordMetrics(server Server, req *http.Request, resp *http.Response, err error) {
+	if t.Metrics == nil {
+		return
+	}
+
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	t.Metrics.IncCounter("goproxy_gae_requests_total", "server", server.URL.Host, "code", code)
+
+	if req.ContentLength >= 0 {
+		t.Metrics.Observe("goproxy_gae_request_bytes", float64(req.ContentLength), "server", server.URL.Host)
+	}
+	if err == nil && resp.ContentLength >= 0 {
+		t.Metrics.Observe("goproxy_gae_response_bytes", float64(resp.ContentLength), "server", server.URL.Host)
+	}
+}
+
+// SetFetchOptions swaps the host patterns to *FetchOption rules.
+func (t *Transport) SetFetchOptions(options map[string]FetchOption) {
+	values := make(map[string]interface{}, len(options))
+	for host, o := range options {
+		o := o
+		values[host] = &o
+	}
+	m := helpers.NewHostMatcherWithValue(values)
+
+	t.muServers.Lock()
+	t.fetchOptions = m
+	t.muServers.Unlock()
+}
+
+// SetDeadlinePolicies swaps the timeouts by host pattern, nil keeps the ones
+// of the RoundTripper.
+func (t *Transport) SetDeadlinePolicies(policies *helpers.DeadlinePolicies) {
+	t.muServers.Lock()
+	t.deadlines = policies
+	t.muServers.Unlock()
+}
+
+func (t *Transport) deadlinePolicies() *helpers.DeadlinePolicies {
+	t.muServers.Lock()
+	defer t.muServers.Unlock()
+	return t.deadlines
+}
+
+func (t *Transport) lookupFetchOption(host string) *FetchOption {
+	t.muServers.Lock()
+	m := t.fetchOptions
+	t.muServers.Unlock()
+
+	if m == nil {
+		return nil
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if v, ok := m.Lookup(host); ok {
+		return v.(*FetchOption)
+	}
+	return nil
+}
+
 func (t *Transport) roundServers() {
 	server := t.Servers[0]
 	t.muServers.Lock()
 	defer t.muServers.Unlock()
-	if server == t.Servers[0] {
+	if server.URL == t.Servers[0].URL {
 		for i := 0; i < len(t.Servers)-1; i++ {
 			t.Servers[i] = t.Servers[i+1]
 		}
@@ -149,7 +430,112 @@ func (t *Transport) roundServers() {
 	}
 }
 
+// unsupportedEncoding reports whether resp is the 415 of a fetch server which
+// does not speak encoding, its Accept-Encoding lists the ones it does (RFC
+// 7694). Other errors may have any cause and keep the encoding.
+func unsupportedEncoding(resp *http.Response, encoding string) bool {
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		return false
+	}
+	for _, s := range strings.Split(resp.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(s) == encoding {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *Transport) isFlateOnly(server Server) bool {
+	if server.Encoding == "" || server.Encoding == EncodingFlate {
+		return false
+	}
+
+	t.muServers.Lock()
+	defer t.muServers.Unlock()
+	return t.flateOnly[server.URL.String()]
+}
+
+func (t *Transport) setFlateOnly(server Server) {
+	t.muServers.Lock()
+	defer t.muServers.Unlock()
+
+	if t.flateOnly == nil {
+		t.flateOnly = make(map[string]bool)
+	}
+	t.flateOnly[server.URL.String()] = true
+}
+
+// markServer counts the failures of server for ServerPolicyLeastErrors, a
+// success halves the count so that a recovered appid is picked again.
+func (t *Transport) markServer(server Server, ok bool) {
+	if t.ServerPolicy != ServerPolicyLeastErrors {
+		return
+	}
+
+	t.muServers.Lock()
+	defer t.muServers.Unlock()
+
+	if t.serverErrors == nil {
+		t.serverErrors = make(map[string]int)
+	}
+
+	key := server.URL.String()
+	if ok {
+		t.serverErrors[key] /= 2
+	} else {
+		t.serverErrors[key]++
+	}
+}
+
+func (t *Transport) leastErrorsServer() Server {
+	t.muServers.Lock()
+	defer t.muServers.Unlock()
+
+	n, min := 0, -1
+	for _, j := range rand.Perm(len(t.Servers)) {
+		if errors := t.serverErrors[t.Servers[j].URL.String()]; min < 0 || errors < min {
+			n, min = j, errors
+		}
+	}
+
+	return t.Servers[n]
+}
+
+// isSmallRequest guesses whether the response of req is small, so that it
+// may go through the ips which are throttled for bulk transfers.
+func isSmallRequest(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodHead, http.MethodOptions:
+		return true
+	}
+
+	if req.ContentLength > 0 {
+		return false
+	}
+
+	if s := req.Header.Get("Range"); strings.HasPrefix(s, "bytes=") && !strings.Contains(s, ",") {
+		parts := strings.SplitN(s[len("bytes="):], "-", 2)
+		if len(parts) == 2 && parts[0] != "" && parts[1] != "" {
+			start, err1 := strconv.ParseInt(parts[0], 10, 64)
+			end, err2 := strconv.ParseInt(parts[1], 10, 64)
+			if err1 == nil && err2 == nil && end >= start && end-start < smallRangeSize {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
 func (t *Transport) pickServer(req *http.Request, i int) Server {
+	switch t.ServerPolicy {
+	case ServerPolicyRoundRobin:
+		n := atomic.AddUint32(&t.serverIndex, 1)
+		return t.Servers[int(n%uint32(len(t.Servers)))]
+	case ServerPolicyLeastErrors:
+		return t.leastErrorsServer()
+	}
+
 	n := 0
 
 	if i > 0 && len(t.Servers) > 1 {
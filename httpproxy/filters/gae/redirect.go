@@ -0,0 +1,92 @@
+package gae
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/phuslu/glog"
+
+	"../../filters"
+	"../../helpers"
+)
+
+func isRedirect(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return resp.Header.Get("Location") != ""
+	}
+	return false
+}
+
+// followRedirects follows the redirects of resp on our side for the sites
+// whose FetchOption sets MaxRedirects, urlfetch follows them blindly and
+// hides the hops otherwise. The last redirect is handed to the client once
+// MaxRedirects hops are made.
+func (t *Transport) followRedirects(req *http.Request, resp *http.Response) (*http.Response, error) {
+	o := t.lookupFetchOption(req.Host)
+	if o == nil || !o.FollowRedirects || o.MaxRedirects <= 0 {
+		return resp, nil
+	}
+
+	chain := []string{req.URL.String()}
+	defer func() {
+		if len(chain) > 1 {
+			glog.V(2).Infof("%s \"GAE REDIRECT %s %s %s\" chain: %s", filters.RemoteAddr(req), req.Method, req.URL.String(), req.Proto, strings.Join(chain, " -> "))
+		}
+	}()
+
+	req1 := req
+	for i := 0; i < o.MaxRedirects && isRedirect(resp); i++ {
+		method := req1.Method
+		switch {
+		case resp.StatusCode == http.StatusSeeOther && method != http.MethodHead:
+			method = http.MethodGet
+		case req1.ContentLength != 0:
+			// the body is gone, let the client follow it
+			return resp, nil
+		}
+
+		u, err := req1.URL.Parse(resp.Header.Get("Location"))
+		if err != nil {
+			return resp, nil
+		}
+
+		req2 := filters.ReplayRequest(req1)
+		req2.Method = method
+		req2.URL = u
+		req2.Host = u.Host
+		if u.Host != req1.URL.Host {
+			req2.Header.Del("Authorization")
+			req2.Header.Del("Cookie")
+		}
+
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+		resp.Body.Close()
+
+		chain = append(chain, u.String())
+		if resp, err = t.roundTrip(req2, 0); err != nil {
+			return nil, err
+		}
+		req1 = req2
+	}
+
+	resp.Request = req
+	return resp, nil
+}
+
+// rewriteLocation upgrades a redirect to a ForceHTTPS site to https, so that
+// the next request of the client is not bounced once more by FORCEHTTPS.
+func rewriteLocation(resp *http.Response, forceHTTPSMatcher *helpers.HostMatcher) {
+	u, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil || u.Scheme != "http" || !forceHTTPSMatcher.Match(u.Host) {
+		return
+	}
+
+	u.Scheme = "https"
+	glog.V(2).Infof("GAE REDIRECT rewrite Location=%v to %v", resp.Header.Get("Location"), u.String())
+	resp.Header.Set("Location", u.String())
+}
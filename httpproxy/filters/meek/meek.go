@@ -0,0 +1,181 @@
+package meek
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../../dialer"
+	"../../filters"
+	"../../helpers"
+	"../../storage"
+)
+
+const (
+	filterName string = "meek"
+)
+
+type Config struct {
+	URL          string
+	Front        string
+	Password     string
+	SignRequest  bool
+	KeyID        string
+	PollInterval int
+	MaxBody      int
+	Transport    struct {
+		Dialer struct {
+			Timeout   int
+			KeepAlive int
+		}
+		TLSClientConfig struct {
+			InsecureSkipVerify bool
+		}
+		ResponseHeaderTimeout int
+		MaxIdleConnsPerHost   int
+	}
+}
+
+type Filter struct {
+	Config
+	MeekDialer *dialer.MeekDialer
+	transport  *http.Transport
+}
+
+func init() {
+	filename := filterName + ".json"
+	config := new(Config)
+	err := storage.ReadJsonConfig(storage.LookupConfigStoreURI(filterName), filename, config)
+	if err != nil {
+		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	err = filters.Register(filterName, &filters.RegisteredFilter{
+		New: func() (filters.Filter, error) {
+			return NewFilter(config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("MEEK: invalid relay url %#v", config.URL)
+	}
+
+	d := &net.Dialer{
+		Timeout:   time.Duration(config.Transport.Dialer.Timeout) * time.Second,
+		KeepAlive: time.Duration(config.Transport.Dialer.KeepAlive) * time.Second,
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.Transport.TLSClientConfig.InsecureSkipVerify,
+		ClientSessionCache: tls.NewLRUClientSessionCache(1000),
+		KeyLogWriter:       helpers.KeyLog,
+	}
+	if config.Front != "" {
+		// the front domain is what the censor sees, verify against it.
+		tlsConfig.ServerName = config.Front
+	}
+
+	md := &dialer.MeekDialer{
+		URL:   u,
+		Front: config.Front,
+		Transport: &http.Transport{
+			Dial:                  d.Dial,
+			TLSClientConfig:       tlsConfig,
+			ResponseHeaderTimeout: time.Duration(config.Transport.ResponseHeaderTimeout) * time.Second,
+			MaxIdleConnsPerHost:   config.Transport.MaxIdleConnsPerHost,
+		},
+		PollInterval: time.Duration(config.PollInterval) * time.Millisecond,
+		MaxBody:      config.MaxBody,
+	}
+	if config.SignRequest {
+		md.Password, md.KeyID = config.Password, config.KeyID
+	} else if config.Password != "" {
+		md.Header = http.Header{"X-Urlfetch-Password": []string{config.Password}}
+	}
+
+	return &Filter{
+		Config:     *config,
+		MeekDialer: md,
+		transport: &http.Transport{
+			Dial:                md.Dial,
+			MaxIdleConnsPerHost: config.Transport.MaxIdleConnsPerHost,
+		},
+	}, nil
+}
+
+func (f *Filter) FilterName() string {
+	return filterName
+}
+
+// Route takes every request.
+func (f *Filter) Route(req *http.Request) (string, bool) {
+	return filterName, true
+}
+
+func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	if req.Method != "CONNECT" {
+		resp, err := f.transport.RoundTrip(req)
+		if err != nil {
+			return ctx, nil, err
+		}
+		glog.V(2).Infof("%s \"MEEK %s %s %s\" %d %s", filters.RemoteAddr(req), req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
+		return ctx, resp, nil
+	}
+
+	glog.V(2).Infof("%s \"MEEK %s %s %s\" - -", filters.RemoteAddr(req), req.Method, req.Host, req.Proto)
+
+	address := req.Host
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "443")
+	}
+
+	rconn, err := f.MeekDialer.Dial("tcp", address)
+	if err != nil {
+		return ctx, nil, err
+	}
+	defer rconn.Close()
+
+	rw := filters.GetResponseWriter(ctx)
+
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		return ctx, nil, fmt.Errorf("http.ResponseWriter(%#v) does not implments http.Hijacker", rw)
+	}
+
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		return ctx, nil, fmt.Errorf("http.ResponseWriter(%#v) does not implments http.Flusher", rw)
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	lconn, _, err := hijacker.Hijack()
+	if err != nil {
+		return ctx, nil, fmt.Errorf("%#v.Hijack() error: %v", hijacker, err)
+	}
+	defer lconn.Close()
+
+	go helpers.IoCopy(rconn, lconn)
+	helpers.IoCopy(lconn, rconn)
+
+	filters.SetHijacked(ctx, true)
+	return ctx, nil, nil
+}
@@ -0,0 +1,175 @@
+package metrics
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../../filters"
+	"../../helpers"
+	"../../storage"
+)
+
+const (
+	filterName string = "metrics"
+)
+
+type Config struct {
+	Path      string
+	StatsPath string
+	WhiteList []string
+}
+
+type Filter struct {
+	Config
+	Metrics   *helpers.Metrics
+	WhiteList map[string]struct{}
+}
+
+func init() {
+	filename := filterName + ".json"
+	config := new(Config)
+	err := storage.ReadJsonConfig(storage.LookupConfigStoreURI(filterName), filename, config)
+	if err != nil {
+		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	err = filters.Register(filterName, &filters.RegisteredFilter{
+		New: func() (filters.Filter, error) {
+			return NewFilter(config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	f := &Filter{
+		Config:    *config,
+		Metrics:   helpers.DefaultMetrics,
+		WhiteList: make(map[string]struct{}),
+	}
+
+	for _, ip := range config.WhiteList {
+		f.WhiteList[ip] = struct{}{}
+	}
+
+	return f, nil
+}
+
+func (f *Filter) FilterName() string {
+	return filterName
+}
+
+func matchPath(req *http.Request, path string) bool {
+	return path != "" && (req.RequestURI == path || strings.HasPrefix(req.RequestURI, path+"?"))
+}
+
+func (f *Filter) Route(req *http.Request) (string, bool) {
+	return filterName, matchPath(req, f.StatsPath) || matchPath(req, f.Path)
+}
+
+func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	isStats := matchPath(req, f.StatsPath)
+	if !isStats && !matchPath(req, f.Path) {
+		return ctx, nil, nil
+	}
+
+	code := http.StatusOK
+	contentType := "text/plain; version=0.0.4"
+	buf := new(bytes.Buffer)
+
+	if ip, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if _, ok := f.WhiteList[ip]; !ok {
+			code = http.StatusForbidden
+		}
+	}
+
+	switch {
+	case code != http.StatusOK:
+		buf.WriteString(http.StatusText(code) + "\n")
+	case isStats:
+		code = f.writeStats(buf, req)
+		contentType = "application/json"
+	default:
+		f.Metrics.WriteTo(buf)
+	}
+
+	resp := &http.Response{
+		Status:     fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode: code,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type": []string{contentType},
+		},
+		Request:       req,
+		Close:         false,
+		ContentLength: int64(buf.Len()),
+		Body:          ioutil.NopCloser(buf),
+	}
+
+	glog.V(2).Infof("%s \"METRICS %s %s %s\" %d %d", filters.RemoteAddr(req), req.Method, req.RequestURI, req.Proto, resp.StatusCode, resp.ContentLength)
+
+	return ctx, resp, nil
+}
+
+// writeStats writes the usage report of the StatsDB, e.g.
+// "?from=2017-01-01&to=2017-07-01&group=month,filter". from defaults to one
+// year before to, and to defaults to now.
+func (f *Filter) writeStats(w io.Writer, req *http.Request) int {
+	writeError := func(code int, err error) int {
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return code
+	}
+
+	db := helpers.DefaultStatsDB()
+	if db == nil {
+		return writeError(http.StatusNotFound, fmt.Errorf("stats is not enabled"))
+	}
+
+	q := req.URL.Query()
+
+	to := time.Now()
+	if s := q.Get("to"); s != "" {
+		t, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			return writeError(http.StatusBadRequest, err)
+		}
+		to = t
+	}
+
+	from := to.AddDate(-1, 0, 0)
+	if s := q.Get("from"); s != "" {
+		t, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			return writeError(http.StatusBadRequest, err)
+		}
+		from = t
+	}
+
+	groups := []string{"month"}
+	if s := q.Get("group"); s != "" {
+		groups = strings.Split(s, ",")
+	}
+
+	rows, err := db.Query(from, to, groups)
+	if err != nil {
+		return writeError(http.StatusBadRequest, err)
+	}
+
+	json.NewEncoder(w).Encode(rows)
+	return http.StatusOK
+}
@@ -0,0 +1,238 @@
+package mirror
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../../filters"
+	"../../helpers"
+	"../../storage"
+)
+
+const (
+	filterName string = "mirror"
+)
+
+type Config struct {
+	Sites []string
+	// a RoundTripFilter the copies are sent through, e.g. "php"
+	Filter string
+	// or an http proxy, e.g. a second goproxy with the new appids, or a recorder
+	ProxyURL string
+	// the requests with larger or unknown length bodies are not mirrored
+	MaxBodySize int64
+	// copies in flight, the ones over it are dropped
+	Concurrency int
+	// seconds a copy may take
+	Timeout int
+}
+
+type Filter struct {
+	Config
+	SiteMatcher *helpers.HostMatcher
+	Metrics     helpers.MetricsRecorder
+	transport   http.RoundTripper
+	timeout     time.Duration
+	sem         chan struct{}
+
+	muTarget sync.Mutex
+	target   filters.RoundTripFilter
+}
+
+func init() {
+	filename := filterName + ".json"
+	config := new(Config)
+	err := storage.ReadJsonConfig(storage.LookupConfigStoreURI(filterName), filename, config)
+	if err != nil {
+		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	err = filters.Register(filterName, &filters.RegisteredFilter{
+		New: func() (filters.Filter, error) {
+			return NewFilter(config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	if config.Timeout <= 0 {
+		config.Timeout = 30
+	}
+	if config.Concurrency <= 0 {
+		config.Concurrency = 16
+	}
+
+	f := &Filter{
+		Config:      *config,
+		SiteMatcher: helpers.NewHostMatcher(config.Sites),
+		Metrics:     helpers.DefaultMetrics,
+		timeout:     time.Duration(config.Timeout) * time.Second,
+		sem:         make(chan struct{}, config.Concurrency),
+	}
+
+	switch {
+	case config.Filter != "" && config.ProxyURL != "":
+		return nil, fmt.Errorf("MIRROR: both of Filter and ProxyURL are set")
+	case config.Filter == filterName:
+		return nil, fmt.Errorf("MIRROR: mirrors to itself")
+	case config.Filter != "":
+		break
+	case config.ProxyURL != "":
+		u, err := url.Parse(config.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("MIRROR: %v", err)
+		}
+		f.transport = &http.Transport{
+			Proxy: http.ProxyURL(u),
+			// the copies of https requests are tunneled through the proxy,
+			// which may well intercept them with its own root CA
+			TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+			MaxIdleConnsPerHost: 8,
+			IdleConnTimeout:     time.Minute,
+		}
+	default:
+		return nil, fmt.Errorf("MIRROR: neither Filter nor ProxyURL is set")
+	}
+
+	return f, nil
+}
+
+func (f *Filter) FilterName() string {
+	return filterName
+}
+
+// Request sends a copy of req to the mirror in the background, req itself is
+// passed on. A body within MaxBodySize is read up front for the copy.
+func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
+	if !f.mirrored(req) {
+		return ctx, req, nil
+	}
+
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody && req.ContentLength != 0 {
+		if req.ContentLength < 0 || req.ContentLength > f.MaxBodySize {
+			f.Metrics.IncCounter("goproxy_mirror_requests_total", "result", "skipped")
+			return ctx, req, nil
+		}
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(req.Body, req.ContentLength))
+		if err != nil {
+			return ctx, nil, err
+		}
+		req.Body = helpers.NewMultiReadCloser(bytes.NewReader(body), req.Body)
+	}
+
+	select {
+	case f.sem <- struct{}{}:
+	default:
+		glog.V(2).Infof("%s \"MIRROR %s %s %s\" dropped, %d copies in flight", filters.RemoteAddr(req), req.Method, req.URL.String(), req.Proto, cap(f.sem))
+		f.Metrics.IncCounter("goproxy_mirror_requests_total", "result", "dropped")
+		return ctx, req, nil
+	}
+
+	req1 := req.Clone(context.Background())
+	req1.RequestURI = ""
+	req1.Body = ioutil.NopCloser(bytes.NewReader(body))
+	req1.ContentLength = int64(len(body))
+	if len(body) == 0 {
+		req1.Body = http.NoBody
+	}
+	req1.Header.Set("X-Goproxy-Mirror", "1")
+
+	remoteAddr := filters.RemoteAddr(req)
+	go func() {
+		defer func() { <-f.sem }()
+		f.mirror(remoteAddr, req1)
+	}()
+
+	return ctx, req, nil
+}
+
+// mirrored reports whether req is copied, the tunnels and the upgrades are
+// not, put mirror after stripssl to see the requests within them.
+func (f *Filter) mirrored(req *http.Request) bool {
+	if req.Method == http.MethodConnect || req.Header.Get("Upgrade") != "" {
+		return false
+	}
+	return f.SiteMatcher.Match(req.Host)
+}
+
+func (f *Filter) mirror(remoteAddr string, req *http.Request) {
+	ctx, cancel := context.WithTimeout(filters.NewContext(context.Background(), nil, nil), f.timeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	start := time.Now()
+	resp, err := f.roundTrip(ctx, req)
+	if err == nil {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	duration := time.Since(start)
+
+	if err != nil {
+		glog.Warningf("%s \"MIRROR %s %s %s\" error: %v", remoteAddr, req.Method, req.URL.String(), req.Proto, err)
+		f.Metrics.IncCounter("goproxy_mirror_requests_total", "result", "error")
+		return
+	}
+
+	glog.V(2).Infof("%s \"MIRROR %s %s %s\" %d in %s", remoteAddr, req.Method, req.URL.String(), req.Proto, resp.StatusCode, duration)
+	f.Metrics.IncCounter("goproxy_mirror_requests_total", "result", fmt.Sprintf("%dxx", resp.StatusCode/100))
+	f.Metrics.Observe("goproxy_mirror_duration_seconds", duration.Seconds())
+}
+
+func (f *Filter) roundTrip(ctx context.Context, req *http.Request) (*http.Response, error) {
+	if f.transport != nil {
+		return f.transport.RoundTrip(req)
+	}
+
+	t, err := f.targetFilter()
+	if err != nil {
+		return nil, err
+	}
+
+	_, resp, err := t.RoundTrip(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil {
+		return nil, fmt.Errorf("%s passed the request on", f.Filter)
+	}
+	return resp, nil
+}
+
+// targetFilter returns the filter of Filter, which is looked up at the first
+// copy, it may not exist yet when the mirror filter is made.
+func (f *Filter) targetFilter() (filters.RoundTripFilter, error) {
+	f.muTarget.Lock()
+	defer f.muTarget.Unlock()
+
+	if f.target != nil {
+		return f.target, nil
+	}
+
+	f1, err := filters.GetFilter(f.Filter)
+	if err != nil {
+		return nil, err
+	}
+	t, ok := f1.(filters.RoundTripFilter)
+	if !ok {
+		return nil, fmt.Errorf("%#v is not a RoundTripFilter", f.Filter)
+	}
+	f.target = t
+	return t, nil
+}
@@ -3,9 +3,12 @@ package php
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
+	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
+	"sync"
 	"time"
 
 	"github.com/cloudflare/golibs/lrucache"
@@ -24,12 +27,25 @@ const (
 
 type Config struct {
 	Servers []struct {
-		URL       string
-		Password  string
-		SSLVerify bool
-		Host      string
+		URL            string
+		Password       string
+		SSLVerify      bool
+		ClientCertFile string
+		ClientKeyFile  string
+		SignRequest    bool
+		KeyID          string
+		Host           string
+		PaddingPercent int
+		PaddingMax     int
+		PaddingBody    bool
+		UserAgents     []string
+		// the CONNECT tunnel url of the fetch server, e.g. the
+		// "/_gh/tunnel" of goproxy-server -tunnel
+		TunnelURL string
 	}
-	Sites     []string
+	Sites []string
+	// pinned ips of fetch server hostnames, raced against each other
+	Hosts     map[string][]string
 	Transport struct {
 		Dialer struct {
 			Timeout        int
@@ -37,20 +53,29 @@ type Config struct {
 			DualStack      bool
 			RetryTimes     int
 			RetryDelay     float32
+			RetryPolicy    string
 			DNSCacheExpiry int
 			DNSCacheSize   uint
 		}
-		DisableKeepAlives   bool
-		DisableCompression  bool
-		TLSHandshakeTimeout int
-		MaxIdleConnsPerHost int
+		DisableKeepAlives     bool
+		DisableCompression    bool
+		TLSHandshakeTimeout   int
+		ResponseHeaderTimeout int
+		MaxIdleConnsPerHost   int
+		RetryTimes            int
+		RetryPolicy           string
+		// milliseconds, see httpproxy.json FlushPolicies
+		FlushInterval int
 	}
 }
 
 type Filter struct {
 	Config
 	Transport *Transport
+	Tunnels   []*dialer.MeekDialer
 	Sites     *helpers.HostMatcher
+	dialer    *dialer.Dialer
+	muConfig  sync.RWMutex
 }
 
 func init() {
@@ -74,17 +99,33 @@ func init() {
 
 func NewFilter(config *Config) (filters.Filter, error) {
 	servers := make([]Server, 0)
+	certs := make(map[string]tls.Certificate)
 	for _, s := range config.Servers {
 		u, err := url.Parse(s.URL)
 		if err != nil {
 			return nil, err
 		}
 
+		if s.ClientCertFile != "" && u.Scheme == "https" {
+			cert, err := helpers.LoadClientCertificate(s.ClientCertFile, s.ClientKeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("PHP: %v", err)
+			}
+			certs[u.Hostname()] = cert
+		}
+
 		server := Server{
-			URL:       u,
-			Password:  s.Password,
-			SSLVerify: s.SSLVerify,
-			Host:      s.Host,
+			URL:            u,
+			Password:       s.Password,
+			SSLVerify:      s.SSLVerify,
+			SignRequest:    s.SignRequest,
+			KeyID:          s.KeyID,
+			Host:           s.Host,
+			Deadline:       time.Duration(config.Transport.ResponseHeaderTimeout-4) * time.Second,
+			PaddingPercent: s.PaddingPercent,
+			PaddingMax:     s.PaddingMax,
+			PaddingBody:    s.PaddingBody,
+			UserAgents:     s.UserAgents,
 		}
 
 		servers = append(servers, server)
@@ -97,11 +138,23 @@ func NewFilter(config *Config) (filters.Filter, error) {
 			DualStack: config.Transport.Dialer.DualStack,
 		},
 		RetryTimes:     config.Transport.Dialer.RetryTimes,
-		RetryDelay:     time.Duration(config.Transport.Dialer.RetryDelay*1000) * time.Second,
-		DNSCache:       lrucache.NewLRUCache(config.Transport.Dialer.DNSCacheSize),
+		RetryDelay:     time.Duration(config.Transport.Dialer.RetryDelay*1000) * time.Millisecond,
+		DNSCache:       helpers.NewKeyedCache(lrucache.NewLRUCache(config.Transport.Dialer.DNSCacheSize)),
 		DNSCacheExpiry: time.Duration(config.Transport.Dialer.DNSCacheExpiry) * time.Second,
 		LoopbackAddrs:  nil,
 		Level:          2,
+		Hosts:          config.Hosts,
+	}
+
+	retry, err := helpers.NewRetryPolicy(config.Transport.RetryPolicy, config.Transport.RetryTimes, 0)
+	if err != nil {
+		return nil, fmt.Errorf("PHP: %v", err)
+	}
+
+	if name := config.Transport.Dialer.RetryPolicy; name != "" {
+		if d.Retry, err = helpers.LookupRetryPolicy(name); err != nil {
+			return nil, fmt.Errorf("PHP: %v", err)
+		}
 	}
 
 	for _, server := range servers {
@@ -133,9 +186,15 @@ func NewFilter(config *Config) (filters.Filter, error) {
 		TLSClientConfig: &tls.Config{
 			InsecureSkipVerify: false,
 			ClientSessionCache: tls.NewLRUClientSessionCache(1000),
+			KeyLogWriter:       helpers.KeyLog,
 		},
-		TLSHandshakeTimeout: time.Duration(config.Transport.TLSHandshakeTimeout) * time.Second,
-		MaxIdleConnsPerHost: config.Transport.MaxIdleConnsPerHost,
+		TLSHandshakeTimeout:   time.Duration(config.Transport.TLSHandshakeTimeout) * time.Second,
+		ResponseHeaderTimeout: time.Duration(config.Transport.ResponseHeaderTimeout) * time.Second,
+		MaxIdleConnsPerHost:   config.Transport.MaxIdleConnsPerHost,
+	}
+
+	if len(certs) > 0 {
+		tr.DialTLS = dialClientTLS(d, tr, certs)
 	}
 
 	if tr.TLSClientConfig != nil {
@@ -145,30 +204,186 @@ func NewFilter(config *Config) (filters.Filter, error) {
 		}
 	}
 
+	tunnels := make([]*dialer.MeekDialer, 0)
+	for _, s := range config.Servers {
+		if s.TunnelURL == "" {
+			continue
+		}
+		u, err := url.Parse(s.TunnelURL)
+		if err != nil {
+			return nil, err
+		}
+		md := &dialer.MeekDialer{
+			URL:       u,
+			Transport: tr,
+		}
+		if s.SignRequest {
+			md.Password, md.KeyID = s.Password, s.KeyID
+		} else {
+			md.Header = http.Header{"X-Urlfetch-Password": []string{s.Password}}
+		}
+		tunnels = append(tunnels, md)
+	}
+
+	d.RegisterCaches(filterName)
+
 	return &Filter{
 		Config: *config,
 		Transport: &Transport{
 			RoundTripper: tr,
 			Servers:      servers,
+			Retry:        retry,
 		},
-		Sites: helpers.NewHostMatcher(config.Sites),
+		Tunnels: tunnels,
+		Sites:   helpers.NewHostMatcher(config.Sites),
+		dialer:  d,
 	}, nil
 }
 
+// Reload re-reads php.json and swaps in its Sites and Hosts, the established
+// connections are kept. The Servers and the Transport settings are applied on
+// restart.
+func (f *Filter) Reload() error {
+	filename := filterName + ".json"
+	config := new(Config)
+	if err := storage.ReadJsonConfig(storage.LookupConfigStoreURI(filterName), filename, config); err != nil {
+		return err
+	}
+
+	f.dialer.SetHosts(config.Hosts)
+
+	f.muConfig.Lock()
+	f.Sites = helpers.NewHostMatcher(config.Sites)
+	f.muConfig.Unlock()
+
+	// the idle connections may go to ips which are not pinned anymore
+	if c, ok := f.Transport.RoundTripper.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+
+	glog.Infof("PHP: %#v reloaded", filename)
+	return nil
+}
+
+func (f *Filter) match(host string) bool {
+	f.muConfig.RLock()
+	defer f.muConfig.RUnlock()
+	return f.Sites.Match(host)
+}
+
+// dialClientTLS does the handshakes of tr itself, so that the client
+// certificate of a fetch server is presented to it alone.
+func dialClientTLS(d *dialer.Dialer, tr *http.Transport, certs map[string]tls.Certificate) func(network, addr string) (net.Conn, error) {
+	return func(network, addr string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := d.Dial(network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		config := tr.TLSClientConfig.Clone()
+		if config.ServerName == "" {
+			config.ServerName = host
+		}
+		if cert, ok := certs[host]; ok {
+			config.Certificates = []tls.Certificate{cert}
+		}
+
+		tlsConn := tls.Client(conn, config)
+		if tr.TLSHandshakeTimeout > 0 {
+			tlsConn.SetDeadline(time.Now().Add(tr.TLSHandshakeTimeout))
+		}
+		if err := tlsConn.Handshake(); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn.SetDeadline(time.Time{})
+
+		return tlsConn, nil
+	}
+}
+
 func (p *Filter) FilterName() string {
 	return filterName
 }
 
+func (f *Filter) Route(req *http.Request) (string, bool) {
+	return filterName, f.match(req.Host)
+}
+
 func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
-	if !f.Sites.Match(req.Host) {
+	if !f.match(req.Host) {
 		return ctx, nil, nil
 	}
 
+	if req.Method == http.MethodConnect && len(f.Tunnels) > 0 {
+		return f.connect(ctx, req)
+	}
+
 	resp, err := f.Transport.RoundTrip(req)
 	if err != nil {
 		return ctx, nil, err
 	} else {
-		glog.V(2).Infof("%s \"PHP %s %s %s\" %d %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
+		glog.V(2).Infof("%s \"PHP %s %s %s\" %d %s", filters.RemoteAddr(req), req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
+	}
+	// a body of unknown length may be a stream, e.g. server-sent events
+	if f.Config.Transport.FlushInterval != 0 && resp.ContentLength < 0 {
+		filters.SetFlushInterval(ctx, time.Duration(f.Config.Transport.FlushInterval)*time.Millisecond)
 	}
 	return ctx, resp, nil
 }
+
+// connect tunnels a CONNECT through the fetch server, which keeps the tcp
+// connection to the target, so https sites pass through without MITM.
+func (f *Filter) connect(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	address := req.Host
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, "443")
+	}
+
+	var rconn net.Conn
+	var err error
+	for _, i := range rand.Perm(len(f.Tunnels)) {
+		if rconn, err = f.Tunnels[i].Dial("tcp", address); err == nil {
+			break
+		}
+		glog.Warningf("PHP: tunnel %s via %#v error: %v", address, f.Tunnels[i].URL.Host, err)
+	}
+	if err != nil {
+		return ctx, nil, err
+	}
+	defer rconn.Close()
+
+	glog.V(2).Infof("%s \"PHP %s %s %s\" - -", filters.RemoteAddr(req), req.Method, req.Host, req.Proto)
+
+	rw := filters.GetResponseWriter(ctx)
+
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		return ctx, nil, fmt.Errorf("http.ResponseWriter(%#v) does not implments http.Hijacker", rw)
+	}
+
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		return ctx, nil, fmt.Errorf("http.ResponseWriter(%#v) does not implments http.Flusher", rw)
+	}
+
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	lconn, _, err := hijacker.Hijack()
+	if err != nil {
+		return ctx, nil, fmt.Errorf("%#v.Hijack() error: %v", hijacker, err)
+	}
+	defer lconn.Close()
+
+	go helpers.IoCopy(rconn, lconn)
+	helpers.IoCopy(lconn, rconn)
+
+	filters.SetHijacked(ctx, true)
+	return ctx, nil, nil
+}
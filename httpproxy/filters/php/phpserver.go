@@ -9,15 +9,23 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"time"
 
 	"../../helpers"
 )
 
 type Server struct {
-	URL       *url.URL
-	Password  string
-	SSLVerify bool
-	Host      string
+	URL            *url.URL
+	Password       string
+	SSLVerify      bool
+	SignRequest    bool
+	KeyID          string
+	Host           string
+	Deadline       time.Duration
+	PaddingPercent int
+	PaddingMax     int
+	PaddingBody    bool
+	UserAgents     []string
 }
 
 func (s *Server) encodeRequest(req *http.Request) (*http.Request, error) {
@@ -31,13 +39,31 @@ func (s *Server) encodeRequest(req *http.Request) (*http.Request, error) {
 
 	fmt.Fprintf(w, "%s %s HTTP/1.1\r\n", req.Method, req.URL.String())
 	req.Header.WriteSubset(w, helpers.ReqWriteExcludeHeader)
-	fmt.Fprintf(w, "X-Urlfetch-Password: %s\r\n", s.Password)
+	if s.SignRequest {
+		fmt.Fprintf(w, "X-Urlfetch-Signature: %s\r\n", helpers.NewSignature(s.Password, s.KeyID, "", req.Method, req.URL.String()))
+	} else {
+		fmt.Fprintf(w, "X-Urlfetch-Password: %s\r\n", s.Password)
+	}
 	if s.URL.Scheme == "https" {
 		io.WriteString(w, "X-Urlfetch-Https: 1\r\n")
 	}
 	if s.SSLVerify {
 		io.WriteString(w, "X-Urlfetch-SSLVerify: 1\r\n")
 	}
+	if deadline := s.deadline(req); deadline > 0 {
+		fmt.Fprintf(w, "X-Urlfetch-Deadline: %d\r\n", deadline/time.Second)
+	}
+	padding, bodyPadding := helpers.RandomPadding(req.ContentLength+1024, s.PaddingPercent, s.PaddingMax), ""
+	if s.PaddingBody {
+		padding, bodyPadding = helpers.RandomPaddings(req.ContentLength+1024, s.PaddingPercent, s.PaddingMax)
+	}
+	if padding != "" {
+		fmt.Fprintf(w, "%s: %s\r\n", helpers.PaddingHeader, padding)
+	}
+	if bodyPadding != "" {
+		fmt.Fprintf(w, "%s: %d\r\n", helpers.PaddingBodyHeader, len(bodyPadding))
+	}
+	helpers.WritePaddingOptions(w, s.PaddingPercent, s.PaddingMax)
 	io.WriteString(w, "\r\n")
 	if err != nil {
 		return nil, err
@@ -47,6 +73,9 @@ func (s *Server) encodeRequest(req *http.Request) (*http.Request, error) {
 	b0 := make([]byte, 2)
 	binary.BigEndian.PutUint16(b0, uint16(b.Len()))
 
+	// the padding chunk goes before the body, so the body may be streamed
+	b.WriteString(bodyPadding)
+
 	req1 := &http.Request{
 		Proto:      "HTTP/1.1",
 		ProtoMajor: 1,
@@ -58,7 +87,7 @@ func (s *Server) encodeRequest(req *http.Request) (*http.Request, error) {
 	}
 
 	if req1.URL.Scheme == "https" {
-		req1.Header.Set("User-Agent", "a")
+		req1.Header.Set("User-Agent", helpers.RandomUserAgent(s.UserAgents))
 	}
 
 	if s.URL.Scheme == "http" {
@@ -69,6 +98,11 @@ func (s *Server) encodeRequest(req *http.Request) (*http.Request, error) {
 		}
 	}
 
+	// goproxy-server checks the "HMAC" Proxy-Authorization before the body
+	if s.SignRequest {
+		helpers.SignRequest(req1, s.Password, s.KeyID, "")
+	}
+
 	if req.ContentLength > 0 {
 		req1.ContentLength = int64(len(b0)+b.Len()) + req.ContentLength
 		req1.Body = helpers.NewMultiReadCloser(bytes.NewReader(b0), &b, req.Body)
@@ -80,6 +114,24 @@ func (s *Server) encodeRequest(req *http.Request) (*http.Request, error) {
 	return req1, nil
 }
 
+// deadline is the smaller one of Deadline and the time left to the deadline
+// of req, a second is kept for the way back.
+func (s *Server) deadline(req *http.Request) time.Duration {
+	deadline := s.Deadline
+	if t, ok := req.Context().Deadline(); ok {
+		if left := time.Until(t) - time.Second; left > 0 && (deadline <= 0 || left < deadline) {
+			deadline = left
+		}
+	}
+	if deadline < time.Second {
+		return 0
+	}
+	return deadline
+}
+
+// decodeResponse reads the response of fetch server in the framing of gae, a
+// 2-byte length and the flate-compressed response header followed by the
+// body. The plain response of older scripts is still accepted.
 func (s *Server) decodeResponse(resp *http.Response) (resp1 *http.Response, err error) {
 	if resp.StatusCode != http.StatusOK {
 		return resp, nil
@@ -89,6 +141,36 @@ func (s *Server) decodeResponse(resp *http.Response) (resp1 *http.Response, err
 		resp.Body = helpers.NewXorReadCloser(resp.Body, []byte(s.Password))
 	}
 
-	resp, err = http.ReadResponse(bufio.NewReader(resp.Body), resp.Request)
-	return resp, err
+	br := bufio.NewReader(resp.Body)
+	if b, err := br.Peek(5); err == nil && string(b) == "HTTP/" {
+		return http.ReadResponse(br, resp.Request)
+	}
+
+	var hdrLen uint16
+	if err = binary.Read(br, binary.BigEndian, &hdrLen); err != nil {
+		return
+	}
+
+	hdrBuf := make([]byte, hdrLen)
+	if _, err = io.ReadFull(br, hdrBuf); err != nil {
+		return
+	}
+
+	hdr := flate.NewReader(bytes.NewReader(hdrBuf))
+	defer hdr.Close()
+
+	resp1, err = http.ReadResponse(bufio.NewReader(hdr), resp.Request)
+	if err != nil {
+		return
+	}
+
+	// only a padding asked for is trusted, as in the gae filter
+	if s.PaddingPercent > 0 {
+		if _, err = helpers.DiscardPadding(br, resp1.Header); err != nil {
+			return
+		}
+	}
+
+	resp1.Body = helpers.NewMultiReadCloser(br, resp.Body)
+	return
 }
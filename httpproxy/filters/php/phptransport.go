@@ -6,11 +6,17 @@ import (
 	"net/http"
 	"path"
 	"strings"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../../helpers"
 )
 
 type Transport struct {
 	http.RoundTripper
 	Servers []Server
+	Retry   *helpers.RetryPolicy
 }
 
 func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
@@ -41,18 +47,64 @@ func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 		}
 	}
 
-	server := t.Servers[i]
-
-	req1, err := server.encodeRequest(req)
-	if err != nil {
-		return nil, fmt.Errorf("PHP encodeRequest: %s", err.Error())
+	tries := t.Retry.Attempts()
+	// the body of a retry is replayed, unless it is too large to keep
+	if tries > 1 && !helpers.IsReplayable(req) {
+		if req.ContentLength >= 0 && req.ContentLength <= helpers.DefaultMaxReplaySize {
+			req1, rb, err := helpers.ReplayableRequest(req, helpers.DefaultReplayMemory, helpers.DefaultMaxReplaySize)
+			if err != nil {
+				return nil, fmt.Errorf("PHP spool request body: %v", err)
+			}
+			defer rb.Close()
+			req = req1
+		} else {
+			tries = 1
+		}
 	}
 
-	res, err := t.RoundTripper.RoundTrip(req1)
-	if err != nil {
-		return nil, err
+	var err error
+	for j := 0; j < tries; j++ {
+		server := t.Servers[(i+j)%len(t.Servers)]
+
+		if j > 0 {
+			if err := t.Retry.Sleep(req.Context(), j); err != nil {
+				return nil, err
+			}
+		}
+
+		if j > 0 && req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+
+		var req1 *http.Request
+		if req1, err = server.encodeRequest(req); err != nil {
+			return nil, fmt.Errorf("PHP encodeRequest: %s", err.Error())
+		}
+		req1 = helpers.WithClientTrace(req.Context(), req1, "php")
+
+		var res *http.Response
+		res, err = t.RoundTripper.RoundTrip(req1)
+		if err != nil {
+			if !t.Retry.RetryError(err) {
+				break
+			}
+			if j < tries-1 {
+				glog.Warningf("PHP: request \"%s\" error: %T(%v), retry...", req.URL.String(), err, err)
+			}
+			continue
+		}
+
+		start := time.Now()
+		resp, err := server.decodeResponse(res)
+		if err != nil {
+			helpers.TraceFrom(req.Context()).Addf("decode", "php", "error: %v", err)
+		} else {
+			helpers.TraceFrom(req.Context()).Addf("decode", "php", "%s from %s in %s", resp.Status, server.URL.Host, time.Since(start))
+		}
+		return resp, err
 	}
 
-	resp, err := server.decodeResponse(res)
-	return resp, err
+	return nil, err
 }
@@ -0,0 +1,173 @@
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../../filters"
+	"../../storage"
+)
+
+const (
+	filterName string = "plugin"
+)
+
+type Config struct {
+	Plugins []PluginConfig
+}
+
+// PluginConfig is a third-party filter, either a Go plugin or a program
+// speaking the stdio protocol of process.go.
+type PluginConfig struct {
+	// the filter name used in httpproxy.json
+	Name string
+	// a .so built with "go build -buildmode=plugin", which exports NewFilter
+	Path string
+	// a program and its arguments, started when the filter is made
+	Command []string
+	// milliseconds a call of the program may take
+	Timeout int
+	// handed to NewFilter of a Go plugin, and in $GOPROXY_PLUGIN_CONFIG as
+	// json to a program
+	Config map[string]interface{}
+}
+
+// backend is a loaded plugin, the phases it does not implement pass.
+type backend interface {
+	Request(context.Context, *http.Request) (context.Context, *http.Request, error)
+	RoundTrip(context.Context, *http.Request) (context.Context, *http.Response, error)
+	Response(context.Context, *http.Response) (context.Context, *http.Response, error)
+	Close() error
+}
+
+// Filter is a plugin under its own name, it is a filter of every chain and
+// may be put into any of them in httpproxy.json.
+type Filter struct {
+	name string
+
+	mu      sync.RWMutex
+	backend backend
+}
+
+func init() {
+	filename := filterName + ".json"
+	config := new(Config)
+	err := storage.ReadJsonConfig(storage.LookupConfigStoreURI(filterName), filename, config)
+	if err != nil {
+		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	for _, pc := range config.Plugins {
+		pc := pc
+		err = filters.Register(pc.Name, &filters.RegisteredFilter{
+			New: func() (filters.Filter, error) {
+				return NewFilter(pc)
+			},
+		})
+
+		if err != nil {
+			glog.Fatalf("Register(%#v) error: %s", pc.Name, err)
+		}
+	}
+}
+
+func NewFilter(config PluginConfig) (filters.Filter, error) {
+	b, err := newBackend(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Filter{
+		name:    config.Name,
+		backend: b,
+	}, nil
+}
+
+func newBackend(config PluginConfig) (backend, error) {
+	switch {
+	case config.Name == "":
+		return nil, fmt.Errorf("PLUGIN: plugin without Name")
+	case config.Path != "" && len(config.Command) > 0:
+		return nil, fmt.Errorf("PLUGIN: %s has both of Path and Command", config.Name)
+	case config.Path != "":
+		b, err := openPlugin(config.Path, config.Config)
+		if err != nil {
+			return nil, fmt.Errorf("PLUGIN: %s: %v", config.Name, err)
+		}
+		return b, nil
+	case len(config.Command) > 0:
+		timeout := time.Duration(config.Timeout) * time.Millisecond
+		if timeout <= 0 {
+			timeout = 100 * time.Millisecond
+		}
+		b, err := startProcess(config.Name, config.Command, config.Config, timeout)
+		if err != nil {
+			return nil, fmt.Errorf("PLUGIN: %s: %v", config.Name, err)
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("PLUGIN: %s has neither Path nor Command", config.Name)
+	}
+}
+
+func (f *Filter) FilterName() string {
+	return f.name
+}
+
+func (f *Filter) current() backend {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.backend
+}
+
+func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
+	return f.current().Request(ctx, req)
+}
+
+func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	return f.current().RoundTrip(ctx, req)
+}
+
+func (f *Filter) Response(ctx context.Context, resp *http.Response) (context.Context, *http.Response, error) {
+	return f.current().Response(ctx, resp)
+}
+
+// Reload re-reads plugin.json and swaps in the plugin anew, a program is
+// restarted and a Go plugin gets NewFilter called again. Go plugins can not
+// be unloaded, new code has to be built to a new Path.
+func (f *Filter) Reload() error {
+	config := new(Config)
+	filename := filterName + ".json"
+	if err := storage.ReadJsonConfig(storage.LookupConfigStoreURI(filterName), filename, config); err != nil {
+		return err
+	}
+
+	var pc *PluginConfig
+	for i := range config.Plugins {
+		if config.Plugins[i].Name == f.name {
+			pc = &config.Plugins[i]
+			break
+		}
+	}
+	if pc == nil {
+		return fmt.Errorf("PLUGIN: %s is gone from %s, restart to remove it", f.name, filename)
+	}
+
+	b, err := newBackend(*pc)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	old := f.backend
+	f.backend = b
+	f.mu.Unlock()
+
+	glog.Infof("PLUGIN: %s reloaded", f.name)
+	return old.Close()
+}
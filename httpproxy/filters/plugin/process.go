@@ -0,0 +1,378 @@
+package plugin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../../filters"
+)
+
+// message is a line of json on the stdin or stdout of a plugin program. The
+// proxy writes one per call, e.g.
+//
+//	{"id":1,"phase":"roundtrip","method":"GET","url":"http://example.com/","host":"example.com","header":{...}}
+//
+// and the program answers each on stdout with the same id, in any order,
+// and leaves the fields it does not change out, e.g.
+//
+//	{"id":1,"action":"respond","status":403,"body":"YmxvY2tlZA=="}
+//
+// The actions are "" to pass, "modify" the url and header of a request or
+// the status and header of a response, and "respond" with status, header and
+// body, which are base64, in the roundtrip and response phases. The bodies of
+// the proxied requests and responses are not sent to the program. What it
+// writes to stderr goes to the log.
+type message struct {
+	ID         uint64      `json:"id"`
+	Phase      string      `json:"phase,omitempty"`
+	Method     string      `json:"method,omitempty"`
+	URL        string      `json:"url,omitempty"`
+	Host       string      `json:"host,omitempty"`
+	RemoteAddr string      `json:"remote_addr,omitempty"`
+	Status     int         `json:"status,omitempty"`
+	Header     http.Header `json:"header,omitempty"`
+	Action     string      `json:"action,omitempty"`
+	Body       []byte      `json:"body,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+const (
+	ActionPass    string = ""
+	ActionModify  string = "modify"
+	ActionRespond string = "respond"
+)
+
+// maxMessageSize caps a line of the program, i.e. the body it responds with.
+const maxMessageSize = 16 * 1024 * 1024
+
+// process is a plugin program, which is restarted at the next call after it
+// exits, at most once a second. A call failing or timing out passes.
+type process struct {
+	name    string
+	command []string
+	env     []string
+	timeout time.Duration
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	started time.Time
+	closed  bool
+	nextID  uint64
+	pending map[uint64]chan *message
+}
+
+func startProcess(name string, command []string, config map[string]interface{}, timeout time.Duration) (backend, error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &process{
+		name:    name,
+		command: command,
+		env:     append(os.Environ(), "GOPROXY_PLUGIN_NAME="+name, "GOPROXY_PLUGIN_CONFIG="+string(data)),
+		timeout: timeout,
+		pending: make(map[uint64]chan *message),
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.start(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// start runs the program, p.mu is held.
+func (p *process) start() error {
+	p.started = time.Now()
+
+	cmd := exec.Command(p.command[0], p.command[1:]...)
+	cmd.Env = p.env
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	glog.Infof("PLUGIN: %s started %#v, pid %d", p.name, p.command, cmd.Process.Pid)
+
+	p.cmd = cmd
+	p.stdin = stdin
+	go p.read(cmd, stdout)
+	go p.log(stderr)
+
+	return nil
+}
+
+func (p *process) read(cmd *exec.Cmd, stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), maxMessageSize)
+	for scanner.Scan() {
+		m := new(message)
+		if err := json.Unmarshal(scanner.Bytes(), m); err != nil {
+			glog.Warningf("PLUGIN: %s wrote a bad message %#v: %v", p.name, scanner.Text(), err)
+			continue
+		}
+
+		p.mu.Lock()
+		ch, ok := p.pending[m.ID]
+		delete(p.pending, m.ID)
+		p.mu.Unlock()
+
+		if ok {
+			ch <- m
+		}
+	}
+
+	err := scanner.Err()
+	if err1 := cmd.Wait(); err == nil {
+		err = err1
+	}
+
+	p.mu.Lock()
+	if p.cmd == cmd {
+		p.cmd = nil
+		p.stdin = nil
+	}
+	for id, ch := range p.pending {
+		close(ch)
+		delete(p.pending, id)
+	}
+	closed := p.closed
+	p.mu.Unlock()
+
+	if !closed {
+		glog.Warningf("PLUGIN: %s exited: %v", p.name, err)
+	}
+}
+
+func (p *process) log(stderr io.Reader) {
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		glog.Infof("PLUGIN: %s: %s", p.name, scanner.Text())
+	}
+}
+
+func (p *process) call(ctx context.Context, m *message) (*message, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, fmt.Errorf("closed")
+	}
+	if p.cmd == nil {
+		if time.Since(p.started) < time.Second {
+			p.mu.Unlock()
+			return nil, fmt.Errorf("exited, restart is delayed")
+		}
+		if err := p.start(); err != nil {
+			p.mu.Unlock()
+			return nil, err
+		}
+	}
+
+	p.nextID++
+	m.ID = p.nextID
+	ch := make(chan *message, 1)
+	p.pending[m.ID] = ch
+
+	data, err := json.Marshal(m)
+	if err == nil {
+		_, err = p.stdin.Write(append(data, '\n'))
+	}
+	if err != nil {
+		delete(p.pending, m.ID)
+	}
+	p.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+
+	select {
+	case r, ok := <-ch:
+		if !ok {
+			return nil, fmt.Errorf("exited")
+		}
+		if r.Error != "" {
+			return nil, fmt.Errorf("%s", r.Error)
+		}
+		return r, nil
+	case <-timer.C:
+		err = fmt.Errorf("timed out after %s", p.timeout)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	p.mu.Lock()
+	delete(p.pending, m.ID)
+	p.mu.Unlock()
+
+	return nil, err
+}
+
+func requestMessage(phase string, req *http.Request) *message {
+	return &message{
+		Phase:      phase,
+		Method:     req.Method,
+		URL:        req.URL.String(),
+		Host:       req.Host,
+		RemoteAddr: req.RemoteAddr,
+		Header:     req.Header,
+	}
+}
+
+func (p *process) Request(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
+	r, err := p.call(ctx, requestMessage("request", req))
+	if err != nil {
+		glog.Warningf("%s \"PLUGIN %s %s %s\" error: %v", filters.RemoteAddr(req), p.name, req.Method, req.URL.String(), err)
+		return ctx, req, nil
+	}
+
+	if r.Action != ActionModify {
+		return ctx, req, nil
+	}
+
+	req1 := req.WithContext(req.Context())
+	if r.URL != "" {
+		u, err := url.Parse(r.URL)
+		if err != nil {
+			glog.Warningf("%s \"PLUGIN %s %s %s\" bad url %#v: %v", filters.RemoteAddr(req), p.name, req.Method, req.URL.String(), r.URL, err)
+			return ctx, req, nil
+		}
+		req1.URL = u
+		req1.Host = u.Host
+	}
+	if r.Header != nil {
+		req1.Header = r.Header
+	}
+
+	return ctx, req1, nil
+}
+
+func (p *process) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	r, err := p.call(ctx, requestMessage("roundtrip", req))
+	if err != nil {
+		glog.Warningf("%s \"PLUGIN %s %s %s\" error: %v", filters.RemoteAddr(req), p.name, req.Method, req.URL.String(), err)
+		return ctx, nil, nil
+	}
+
+	if r.Action != ActionRespond {
+		return ctx, nil, nil
+	}
+
+	glog.V(2).Infof("%s \"PLUGIN %s %s %s\" %d", filters.RemoteAddr(req), p.name, req.Method, req.URL.String(), r.Status)
+	return ctx, newResponse(req, r), nil
+}
+
+func (p *process) Response(ctx context.Context, resp *http.Response) (context.Context, *http.Response, error) {
+	req := resp.Request
+	if req == nil {
+		return ctx, resp, nil
+	}
+
+	m := requestMessage("response", req)
+	m.Status = resp.StatusCode
+	m.Header = resp.Header
+
+	r, err := p.call(ctx, m)
+	if err != nil {
+		glog.Warningf("%s \"PLUGIN %s %s %s\" error: %v", filters.RemoteAddr(req), p.name, req.Method, req.URL.String(), err)
+		return ctx, resp, nil
+	}
+
+	switch r.Action {
+	case ActionModify:
+		if r.Status != 0 {
+			resp.StatusCode = r.Status
+			resp.Status = fmt.Sprintf("%d %s", r.Status, http.StatusText(r.Status))
+		}
+		if r.Header != nil {
+			resp.Header = r.Header
+		}
+	case ActionRespond:
+		if resp.Body != nil {
+			resp.Body.Close()
+		}
+		resp = newResponse(req, r)
+	}
+
+	return ctx, resp, nil
+}
+
+func newResponse(req *http.Request, r *message) *http.Response {
+	code := r.Status
+	if code == 0 {
+		code = http.StatusOK
+	}
+	header := r.Header
+	if header == nil {
+		header = http.Header{}
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Request:       req,
+		Close:         true,
+		ContentLength: int64(len(r.Body)),
+		Body:          ioutil.NopCloser(bytes.NewReader(r.Body)),
+	}
+}
+
+// Close closes the stdin of the program, which should exit after answering
+// the calls in flight, it is killed after 5 seconds.
+func (p *process) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil
+	}
+	p.closed = true
+
+	if p.cmd == nil {
+		return nil
+	}
+
+	cmd := p.cmd
+	time.AfterFunc(5*time.Second, func() {
+		cmd.Process.Kill()
+	})
+
+	return p.stdin.Close()
+}
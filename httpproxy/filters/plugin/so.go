@@ -0,0 +1,90 @@
+// +build linux,cgo darwin,cgo freebsd,cgo
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	goplugin "plugin"
+
+	"../../filters"
+)
+
+// goPlugin is a .so which exports
+//
+//	func NewFilter(config map[string]interface{}) (interface{}, error)
+//
+// returning a value with any of the methods of filters.RequestFilter,
+// filters.RoundTripFilter and filters.ResponseFilter. They only use types of
+// the standard library, so the plugin needs no import of this tree. An
+// io.Closer is closed when the plugin is reloaded.
+type goPlugin struct {
+	request   filters.RequestFilter
+	roundTrip filters.RoundTripFilter
+	response  filters.ResponseFilter
+	closer    io.Closer
+}
+
+func openPlugin(path string, config map[string]interface{}) (backend, error) {
+	p, err := goplugin.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	sym, err := p.Lookup("NewFilter")
+	if err != nil {
+		return nil, err
+	}
+
+	newFilter, ok := sym.(func(map[string]interface{}) (interface{}, error))
+	if !ok {
+		return nil, fmt.Errorf("%s: NewFilter is %T, not func(map[string]interface{}) (interface{}, error)", path, sym)
+	}
+
+	v, err := newFilter(config)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &goPlugin{}
+	b.request, _ = v.(filters.RequestFilter)
+	b.roundTrip, _ = v.(filters.RoundTripFilter)
+	b.response, _ = v.(filters.ResponseFilter)
+	b.closer, _ = v.(io.Closer)
+
+	if b.request == nil && b.roundTrip == nil && b.response == nil {
+		return nil, fmt.Errorf("%s: %T is not a filter of any chain", path, v)
+	}
+
+	return b, nil
+}
+
+func (b *goPlugin) Request(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
+	if b.request == nil {
+		return ctx, req, nil
+	}
+	return b.request.Request(ctx, req)
+}
+
+func (b *goPlugin) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	if b.roundTrip == nil {
+		return ctx, nil, nil
+	}
+	return b.roundTrip.RoundTrip(ctx, req)
+}
+
+func (b *goPlugin) Response(ctx context.Context, resp *http.Response) (context.Context, *http.Response, error) {
+	if b.response == nil {
+		return ctx, resp, nil
+	}
+	return b.response.Response(ctx, resp)
+}
+
+func (b *goPlugin) Close() error {
+	if b.closer == nil {
+		return nil
+	}
+	return b.closer.Close()
+}
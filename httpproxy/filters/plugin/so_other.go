@@ -0,0 +1,11 @@
+// +build !linux,!darwin,!freebsd !cgo
+
+package plugin
+
+import (
+	"fmt"
+)
+
+func openPlugin(path string, config map[string]interface{}) (backend, error) {
+	return nil, fmt.Errorf("%s: Go plugins need cgo on linux, darwin or freebsd, use Command instead", path)
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/phuslu/glog"
 
 	"../../filters"
+	"../../helpers"
 	"../../storage"
 )
 
@@ -20,13 +21,25 @@ type Config struct {
 	Threshold int
 	Rate      int
 	Capacity  int
+	// host pattern to bytes per second, shared by all requests to the site
+	Sites map[string]struct {
+		Upload   int
+		Download int
+	}
 }
 
 type Filter struct {
 	Config
-	Threshold int64
-	Rate      float64
-	Capacity  int64
+	Threshold   int64
+	Rate        float64
+	Capacity    int64
+	SiteMatcher *helpers.HostMatcher
+}
+
+// siteBuckets caps the total throughput of a site, either bucket may be nil.
+type siteBuckets struct {
+	upload   *ratelimit.Bucket
+	download *ratelimit.Bucket
 }
 
 func init() {
@@ -60,6 +73,19 @@ func NewFilter(config *Config) (filters.Filter, error) {
 		f.Capacity = int64(config.Rate) * 1024
 	}
 
+	sites := make(map[string]interface{})
+	for host, site := range config.Sites {
+		b := &siteBuckets{}
+		if site.Upload > 0 {
+			b.upload = ratelimit.NewBucketWithRate(float64(site.Upload), int64(site.Upload))
+		}
+		if site.Download > 0 {
+			b.download = ratelimit.NewBucketWithRate(float64(site.Download), int64(site.Download))
+		}
+		sites[host] = b
+	}
+	f.SiteMatcher = helpers.NewHostMatcherWithValue(sites)
+
 	return f, nil
 }
 
@@ -67,7 +93,30 @@ func (f *Filter) FilterName() string {
 	return filterName
 }
 
+func (f *Filter) lookupSite(host string) *siteBuckets {
+	if v, ok := f.SiteMatcher.Lookup(host); ok {
+		return v.(*siteBuckets)
+	}
+	return nil
+}
+
+func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
+	if b := f.lookupSite(req.Host); b != nil && b.upload != nil && req.Body != nil && req.ContentLength != 0 {
+		glog.V(2).Infof("%s \"RateLimit %s upload to %#v\"", filters.RemoteAddr(req), req.URL.String(), b.upload.Rate())
+		req.Body = newBucketReader(req.Body, b.upload)
+	}
+
+	return ctx, req, nil
+}
+
 func (f *Filter) Response(ctx context.Context, resp *http.Response) (context.Context, *http.Response, error) {
+	if resp.Request != nil {
+		if b := f.lookupSite(resp.Request.Host); b != nil && b.download != nil {
+			glog.V(2).Infof("RateLimit %#v download to %#v", resp.Request.URL.String(), b.download.Rate())
+			resp.Body = newBucketReader(resp.Body, b.download)
+			return ctx, resp, nil
+		}
+	}
 
 	if f.Rate > 0 && resp.ContentLength > f.Threshold {
 		glog.V(2).Infof("RateLimit %#v rate to %#v", resp.Request.URL.String(), f.Rate)
@@ -83,10 +132,15 @@ type rateLimitReader struct {
 }
 
 func NewRateLimitReader(rc io.ReadCloser, rate float64, capacity int64) io.ReadCloser {
+	return newBucketReader(rc, ratelimit.NewBucketWithRate(rate, capacity))
+}
+
+// newBucketReader takes from bucket, which may be shared with other readers.
+func newBucketReader(rc io.ReadCloser, bucket *ratelimit.Bucket) io.ReadCloser {
 	var rlr rateLimitReader
 
 	rlr.rc = rc
-	rlr.rlr = ratelimit.Reader(rc, ratelimit.NewBucketWithRate(rate, capacity))
+	rlr.rlr = ratelimit.Reader(rc, bucket)
 
 	return &rlr
 }
@@ -0,0 +1,21 @@
+package filters
+
+import (
+	"sync/atomic"
+)
+
+// readOnly is set at startup on kiosk or classroom machines, the proxy keeps
+// serving traffic but refuses admin api mutations, config reloads and MITM.
+var readOnly int32
+
+func SetReadOnly(b bool) {
+	var v int32
+	if b {
+		v = 1
+	}
+	atomic.StoreInt32(&readOnly, v)
+}
+
+func ReadOnly() bool {
+	return atomic.LoadInt32(&readOnly) != 0
+}
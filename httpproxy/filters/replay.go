@@ -0,0 +1,25 @@
+package filters
+
+import (
+	"net/http"
+)
+
+// ReplayRequest returns a copy of req for a retry or a hedged fetch without
+// body. Header is copied deeply so that concurrent replays never share a
+// Cookie header with each other or with requests of other clients, and the
+// copy keeps the context and RemoteAddr of req so that it stays bound to the
+// client which sent req.
+func ReplayRequest(req *http.Request) *http.Request {
+	req1 := req.WithContext(req.Context())
+
+	req1.Header = make(http.Header, len(req.Header))
+	for key, values := range req.Header {
+		req1.Header[key] = append([]string(nil), values...)
+	}
+
+	req1.Body = nil
+	req1.ContentLength = 0
+	req1.GetBody = nil
+
+	return req1
+}
@@ -2,11 +2,17 @@ package rewrite
 
 import (
 	"context"
+	"fmt"
+	"net"
 	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
 
 	"github.com/phuslu/glog"
 
 	"../../filters"
+	"../../helpers"
 	"../../storage"
 )
 
@@ -14,17 +20,37 @@ const (
 	filterName string = "rewrite"
 )
 
+// Rule rewrites the requests to Hosts whose path starts with PathPrefix, and
+// their responses. A header set to "" is removed.
+type Rule struct {
+	Hosts           []string
+	PathPrefix      string
+	UpgradeHTTPS    bool
+	URLPattern      string
+	URLReplace      string
+	RequestHeaders  map[string]string
+	ResponseHeaders map[string]string
+}
+
 type Config struct {
 	UserAgent struct {
 		Enabled bool
 		Value   string
 	}
+	Rules []Rule
+}
+
+type rule struct {
+	Rule
+	hosts      *helpers.HostMatcher
+	urlPattern *regexp.Regexp
 }
 
 type Filter struct {
 	Config
 	UserAgentEnabled bool
 	UserAgentValue   string
+	rules            []rule
 }
 
 func init() {
@@ -47,10 +73,27 @@ func init() {
 }
 
 func NewFilter(config *Config) (filters.Filter, error) {
+	rules := make([]rule, 0, len(config.Rules))
+	for i, r := range config.Rules {
+		r1 := rule{
+			Rule:  r,
+			hosts: helpers.NewHostMatcher(r.Hosts),
+		}
+		if r.URLPattern != "" {
+			re, err := regexp.Compile(r.URLPattern)
+			if err != nil {
+				return nil, fmt.Errorf("REWRITE: Rules[%d].URLPattern error: %v", i, err)
+			}
+			r1.urlPattern = re
+		}
+		rules = append(rules, r1)
+	}
+
 	f := &Filter{
 		Config:           *config,
 		UserAgentEnabled: config.UserAgent.Enabled,
 		UserAgentValue:   config.UserAgent.Value,
+		rules:            rules,
 	}
 
 	return f, nil
@@ -66,9 +109,77 @@ func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Contex
 		req.Header.Set("User-Agent", f.UserAgentValue)
 	}
 
+	if req.Method == http.MethodConnect {
+		return ctx, req, nil
+	}
+
+	for _, r := range f.matchRules(req) {
+		setHeaders(req.Header, r.RequestHeaders)
+
+		if r.UpgradeHTTPS && req.URL.Scheme == "http" {
+			glog.V(2).Infof("%s \"REWRITE %s %s %s\" upgrade to https", filters.RemoteAddr(req), req.Method, req.URL.String(), req.Proto)
+			req.URL.Scheme = "https"
+			if host, port, err := net.SplitHostPort(req.URL.Host); err == nil && port == "80" {
+				req.URL.Host = host
+			}
+		}
+
+		if r.urlPattern != nil {
+			s := req.URL.String()
+			if s1 := r.urlPattern.ReplaceAllString(s, r.URLReplace); s1 != s {
+				u, err := url.Parse(s1)
+				if err != nil {
+					glog.Warningf("REWRITE: url.Parse(%#v) error: %v", s1, err)
+					continue
+				}
+				glog.V(2).Infof("%s \"REWRITE %s %s %s\" to %#v", filters.RemoteAddr(req), req.Method, s, req.Proto, s1)
+				req.URL = u
+				req.Host = u.Host
+			}
+		}
+	}
+
 	return ctx, req, nil
 }
 
 func (f *Filter) Response(ctx context.Context, resp *http.Response) (context.Context, *http.Response, error) {
+	if resp.Request == nil {
+		return ctx, resp, nil
+	}
+
+	for _, r := range f.matchRules(resp.Request) {
+		setHeaders(resp.Header, r.ResponseHeaders)
+	}
+
 	return ctx, resp, nil
 }
+
+// matchRules returns the rules for req in the order of config.
+func (f *Filter) matchRules(req *http.Request) []rule {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	var rules []rule
+	for _, r := range f.rules {
+		if !r.hosts.Match(host) {
+			continue
+		}
+		if r.PathPrefix != "" && !strings.HasPrefix(req.URL.Path, r.PathPrefix) {
+			continue
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+func setHeaders(header http.Header, values map[string]string) {
+	for key, value := range values {
+		if value == "" {
+			header.Del(key)
+		} else {
+			header.Set(key, value)
+		}
+	}
+}
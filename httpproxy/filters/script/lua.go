@@ -0,0 +1,155 @@
+package script
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// statePool keeps the lua states with the script loaded, a state runs one
+// call at a time.
+type statePool struct {
+	name   string
+	source string
+	states chan *lua.LState
+}
+
+func newStatePool(name, source string, size int) (*statePool, error) {
+	p := &statePool{
+		name:   name,
+		source: source,
+		states: make(chan *lua.LState, size),
+	}
+
+	// fail early on a broken script
+	L, err := p.newState()
+	if err != nil {
+		return nil, err
+	}
+	p.put(L)
+
+	return p, nil
+}
+
+// newState returns a state with the script loaded and no access to the os,
+// the io and the files.
+func (p *statePool) newState() (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring", "require"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	if err := L.DoString(p.source); err != nil {
+		L.Close()
+		return nil, fmt.Errorf("%s: %v", p.name, err)
+	}
+	if L.GetGlobal("route").Type() != lua.LTFunction {
+		L.Close()
+		return nil, fmt.Errorf("%s: no function route(req) defined", p.name)
+	}
+
+	return L, nil
+}
+
+func (p *statePool) get() (*lua.LState, error) {
+	select {
+	case L := <-p.states:
+		return L, nil
+	default:
+		return p.newState()
+	}
+}
+
+func (p *statePool) put(L *lua.LState) {
+	select {
+	case p.states <- L:
+	default:
+		L.Close()
+	}
+}
+
+// route calls route(req) of the script, which returns the name of an action
+// and its argument, see Action.
+func (p *statePool) route(ctx context.Context, req *http.Request) (Action, error) {
+	L, err := p.get()
+	if err != nil {
+		return Action{}, err
+	}
+
+	L.SetContext(ctx)
+	err = L.CallByParam(lua.P{
+		Fn:      L.GetGlobal("route"),
+		NRet:    2,
+		Protect: true,
+	}, requestTable(L, req))
+	L.RemoveContext()
+	if err != nil {
+		// a state stopped halfway is not reused
+		L.Close()
+		return Action{}, err
+	}
+
+	name, arg := L.Get(-2), L.Get(-1)
+	L.Pop(2)
+	p.put(L)
+
+	var action Action
+	switch name.Type() {
+	case lua.LTNil:
+		return action, nil
+	case lua.LTString:
+		action.Name = name.String()
+	default:
+		return action, fmt.Errorf("route(req) returns a %s, not a string", name.Type())
+	}
+	switch arg.Type() {
+	case lua.LTString, lua.LTNumber:
+		action.Arg = arg.String()
+	}
+	if action.Name == "rewrite" && action.Arg == "" {
+		return Action{}, fmt.Errorf("route(req) returns \"rewrite\" without a url")
+	}
+
+	return action, nil
+}
+
+// requestTable is the req argument of route, the keys of headers are in the
+// canonical form, e.g. req.headers["User-Agent"].
+func requestTable(L *lua.LState, req *http.Request) *lua.LTable {
+	headers := L.NewTable()
+	for key, values := range req.Header {
+		headers.RawSetString(key, lua.LString(strings.Join(values, ", ")))
+	}
+
+	clientIP := req.RemoteAddr
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		clientIP = host
+	}
+
+	t := L.NewTable()
+	t.RawSetString("method", lua.LString(req.Method))
+	t.RawSetString("url", lua.LString(req.URL.String()))
+	t.RawSetString("scheme", lua.LString(req.URL.Scheme))
+	t.RawSetString("host", lua.LString(req.Host))
+	t.RawSetString("path", lua.LString(req.URL.Path))
+	t.RawSetString("client_ip", lua.LString(clientIP))
+	t.RawSetString("headers", headers)
+	return t
+}
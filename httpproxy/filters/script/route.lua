@@ -0,0 +1,34 @@
+-- route is called with each request which reaches the script filter, req has
+--   method, url, scheme, host, path, client_ip, and headers whose keys are in
+--   the canonical form, e.g. req.headers["User-Agent"]
+-- it returns one of
+--   "direct", "gae" or the name of another RoundTripFilter, which sends req
+--   "block", status   to answer status, 403 if it is left out
+--   "rewrite", url    to go on with req sent to url instead
+--   nil               to go on with req as is
+-- the os, io and the files are out of reach, and a call which fails or takes
+-- longer than Timeout of script.json passes the request on.
+
+local blocked = {
+	["ads.example.com"] = true,
+}
+
+local function has_suffix(s, suffix)
+	return suffix == "" or string.sub(s, -string.len(suffix)) == suffix
+end
+
+function route(req)
+	if blocked[req.host] then
+		return "block", 403
+	end
+
+	if req.host == "google.com" or has_suffix(req.host, ".google.com") then
+		return "gae"
+	end
+
+	if req.host == "example.com" and req.scheme == "http" then
+		return "rewrite", "https://example.com" .. req.path
+	end
+
+	return nil
+end
@@ -0,0 +1,235 @@
+package script
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../../filters"
+	"../../helpers"
+	"../../storage"
+)
+
+const (
+	filterName string = "script"
+)
+
+type Config struct {
+	// the lua file in the config store which defines route(req)
+	Script string
+	// milliseconds a call of route may take
+	Timeout int
+	// lua states kept for the calls in parallel
+	States int
+}
+
+// Action is what the route function of a script returns for a request.
+type Action struct {
+	// "block", "rewrite", the name of a RoundTripFilter, or "" to pass the
+	// request on
+	Name string
+	// the status of "block" and the url of "rewrite"
+	Arg string
+}
+
+type Filter struct {
+	Config
+	states  *statePool
+	timeout time.Duration
+
+	muTargets sync.Mutex
+	targets   map[string]filters.RoundTripFilter
+}
+
+func init() {
+	filename := filterName + ".json"
+	config := new(Config)
+	err := storage.ReadJsonConfig(storage.LookupConfigStoreURI(filterName), filename, config)
+	if err != nil {
+		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	err = filters.Register(filterName, &filters.RegisteredFilter{
+		New: func() (filters.Filter, error) {
+			return NewFilter(config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	store, err := storage.OpenURI(storage.LookupConfigStoreURI(filterName))
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := store.GetObject(config.Script, -1, -1)
+	if err != nil {
+		return nil, fmt.Errorf("SCRIPT: %v", err)
+	}
+	rc := object.Body()
+	source, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, fmt.Errorf("SCRIPT: %v", err)
+	}
+
+	if config.Timeout <= 0 {
+		config.Timeout = 50
+	}
+	if config.States <= 0 {
+		config.States = 8
+	}
+
+	states, err := newStatePool(config.Script, string(source), config.States)
+	if err != nil {
+		return nil, fmt.Errorf("SCRIPT: %v", err)
+	}
+
+	return &Filter{
+		Config:  *config,
+		states:  states,
+		timeout: time.Duration(config.Timeout) * time.Millisecond,
+		targets: make(map[string]filters.RoundTripFilter),
+	}, nil
+}
+
+func (f *Filter) FilterName() string {
+	return filterName
+}
+
+// route runs the script for req, a failed or timed out script passes the
+// request on.
+func (f *Filter) route(req *http.Request) Action {
+	ctx, cancel := context.WithTimeout(req.Context(), f.timeout)
+	defer cancel()
+
+	action, err := f.states.route(ctx, req)
+	if err != nil {
+		glog.Warningf("%s \"SCRIPT %s %s\" %s error: %v", filters.RemoteAddr(req), req.Method, req.URL.String(), f.Script, err)
+		return Action{}
+	}
+	return action
+}
+
+// target returns the RoundTripFilter named name. The filters are looked up at
+// the first request, they may not exist yet when the script filter is made.
+func (f *Filter) target(name string) (filters.RoundTripFilter, error) {
+	if name == filterName {
+		return nil, fmt.Errorf("script routes to itself")
+	}
+
+	f.muTargets.Lock()
+	defer f.muTargets.Unlock()
+
+	if t, ok := f.targets[name]; ok {
+		return t, nil
+	}
+
+	f1, err := filters.GetFilter(name)
+	if err != nil {
+		return nil, err
+	}
+	t, ok := f1.(filters.RoundTripFilter)
+	if !ok {
+		return nil, fmt.Errorf("%#v is not a RoundTripFilter", name)
+	}
+	f.targets[name] = t
+	return t, nil
+}
+
+// rewrite points req to rawurl, which keeps the scheme of req if it has none.
+func rewrite(req *http.Request, rawurl string) error {
+	if req.Method == http.MethodConnect {
+		return fmt.Errorf("cannot rewrite a CONNECT")
+	}
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+	if u.Host == "" {
+		return fmt.Errorf("rewrite url %#v has no host", rawurl)
+	}
+	if u.Scheme == "" {
+		u.Scheme = req.URL.Scheme
+	}
+	req.URL = u
+	req.Host = u.Host
+	if host, _, err := net.SplitHostPort(u.Host); err == nil {
+		req.Host = host
+	}
+	return nil
+}
+
+func blockResponse(req *http.Request, arg string) *http.Response {
+	code, err := strconv.Atoi(arg)
+	if err != nil || code < 100 || code > 999 {
+		code = http.StatusForbidden
+	}
+	return helpers.BlockResponse(req, code, filterName, http.StatusText(code)+" by script")
+}
+
+func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	action := f.route(req)
+
+	switch action.Name {
+	case "":
+		return ctx, nil, nil
+	case "block":
+		resp := blockResponse(req, action.Arg)
+		glog.V(2).Infof("%s \"SCRIPT %s %s %s\" %d %d", filters.RemoteAddr(req), req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.ContentLength)
+		return ctx, resp, nil
+	case "rewrite":
+		u := req.URL.String()
+		if err := rewrite(req, action.Arg); err != nil {
+			glog.Warningf("%s \"SCRIPT %s %s\" rewrite error: %v", filters.RemoteAddr(req), req.Method, u, err)
+			return ctx, nil, nil
+		}
+		glog.V(2).Infof("%s \"SCRIPT %s %s\" rewrite to %s", filters.RemoteAddr(req), req.Method, u, req.URL.String())
+		return ctx, nil, nil
+	}
+
+	t, err := f.target(action.Name)
+	if err != nil {
+		glog.Warningf("%s \"SCRIPT %s %s\" route to %#v error: %v", filters.RemoteAddr(req), req.Method, req.URL.String(), action.Name, err)
+		return ctx, nil, nil
+	}
+	glog.V(2).Infof("%s \"SCRIPT %s %s\" route to %s", filters.RemoteAddr(req), req.Method, req.URL.String(), action.Name)
+	return t.RoundTrip(ctx, req)
+}
+
+// Route runs the script as RoundTrip does, the route of a filter is the one
+// it gives itself.
+func (f *Filter) Route(req *http.Request) (string, bool) {
+	action := f.route(req)
+
+	switch action.Name {
+	case "":
+		return "", false
+	case "block":
+		return filterName + "/block", true
+	case "rewrite":
+		rewrite(req, action.Arg)
+		return "", false
+	}
+
+	t, err := f.target(action.Name)
+	if err != nil {
+		return "", false
+	}
+	if r, ok := t.(filters.Router); ok {
+		return r.Route(req)
+	}
+	return t.FilterName(), true
+}
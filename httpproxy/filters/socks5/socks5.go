@@ -0,0 +1,251 @@
+package socks5
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+	"github.com/phuslu/glog"
+
+	"../../dialer"
+	"../../filters"
+	"../../helpers"
+	"../../storage"
+)
+
+const (
+	filterName string = "socks5"
+)
+
+type Config struct {
+	Server struct {
+		Address  string
+		Username string
+		Password string
+	}
+	Sites      []string
+	Site2Alias map[string]string
+	HostMap    map[string][]string
+	Transport  struct {
+		Dialer struct {
+			DNSCacheExpiry int
+			DNSCacheSize   uint
+			DualStack      bool
+			KeepAlive      int
+			Level          int
+			Timeout        int
+		}
+		TLSClientConfig struct {
+			InsecureSkipVerify     bool
+			ClientSessionCacheSize int
+		}
+		DisableCompression  bool
+		DisableKeepAlives   bool
+		IdleConnTimeout     int
+		MaxIdleConnsPerHost int
+		TLSHandshakeTimeout int
+	}
+}
+
+type Filter struct {
+	Config
+	Dialer      *dialer.Socks5Dialer
+	Transport   *http.Transport
+	SiteMatcher *helpers.HostMatcher
+
+	muConfig sync.RWMutex
+}
+
+func init() {
+	filename := filterName + ".json"
+	config := new(Config)
+	err := storage.ReadJsonConfig(storage.LookupConfigStoreURI(filterName), filename, config)
+	if err != nil {
+		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	err = filters.Register(filterName, &filters.RegisteredFilter{
+		New: func() (filters.Filter, error) {
+			return NewFilter(config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	if _, _, err := net.SplitHostPort(config.Server.Address); err != nil {
+		return nil, fmt.Errorf("SOCKS5: invalid server address %#v: %v", config.Server.Address, err)
+	}
+
+	hostMap, err := dialer.ResolveHostMap(config.HostMap)
+	if err != nil {
+		return nil, fmt.Errorf("SOCKS5: %v", err)
+	}
+
+	md := &dialer.MultiDialer{
+		Dialer: net.Dialer{
+			KeepAlive: time.Duration(config.Transport.Dialer.KeepAlive) * time.Second,
+			Timeout:   time.Duration(config.Transport.Dialer.Timeout) * time.Second,
+			DualStack: config.Transport.Dialer.DualStack,
+		},
+		Site2Alias:      helpers.NewHostMatcherWithString(config.Site2Alias),
+		IPBlackList:     helpers.NewKeyedCache(lrucache.NewLRUCache(1024)),
+		HostMap:         hostMap,
+		DNSCache:        helpers.NewKeyedCache(lrucache.NewLRUCache(config.Transport.Dialer.DNSCacheSize)),
+		DNSCacheExpiry:  time.Duration(config.Transport.Dialer.DNSCacheExpiry) * time.Second,
+		TCPConnDuration: helpers.NewKeyedCache(lrucache.NewLRUCache(1024)),
+		TCPConnError:    helpers.NewKeyedCache(lrucache.NewLRUCache(1024)),
+		TLSConnDuration: helpers.NewKeyedCache(lrucache.NewLRUCache(1024)),
+		TLSConnError:    helpers.NewKeyedCache(lrucache.NewLRUCache(1024)),
+		ConnExpiry:      5 * time.Minute,
+		Level:           config.Transport.Dialer.Level,
+	}
+	md.RegisterCaches(filterName)
+
+	d := &dialer.Socks5Dialer{
+		Dialer:   md,
+		Address:  config.Server.Address,
+		Username: config.Server.Username,
+		Password: config.Server.Password,
+	}
+
+	f := &Filter{
+		Config:      *config,
+		Dialer:      d,
+		SiteMatcher: helpers.NewHostMatcher(config.Sites),
+	}
+
+	f.Transport = &http.Transport{
+		Dial: f.dial,
+		TLSClientConfig: &tls.Config{
+			InsecureSkipVerify: config.Transport.TLSClientConfig.InsecureSkipVerify,
+			ClientSessionCache: tls.NewLRUClientSessionCache(config.Transport.TLSClientConfig.ClientSessionCacheSize),
+			KeyLogWriter:       helpers.KeyLog,
+		},
+		DisableKeepAlives:   config.Transport.DisableKeepAlives,
+		DisableCompression:  config.Transport.DisableCompression,
+		IdleConnTimeout:     time.Duration(config.Transport.IdleConnTimeout) * time.Second,
+		TLSHandshakeTimeout: time.Duration(config.Transport.TLSHandshakeTimeout) * time.Second,
+		MaxIdleConnsPerHost: config.Transport.MaxIdleConnsPerHost,
+	}
+
+	return f, nil
+}
+
+func (f *Filter) FilterName() string {
+	return filterName
+}
+
+// Reload re-reads socks5.json and swaps in its Server, Sites, Site2Alias and
+// HostMap, the established connections are kept. The Transport settings are
+// applied on restart.
+func (f *Filter) Reload() error {
+	filename := filterName + ".json"
+	config := new(Config)
+	if err := storage.ReadJsonConfig(storage.LookupConfigStoreURI(filterName), filename, config); err != nil {
+		return err
+	}
+
+	if _, _, err := net.SplitHostPort(config.Server.Address); err != nil {
+		return fmt.Errorf("SOCKS5: invalid server address %#v: %v", config.Server.Address, err)
+	}
+
+	hostMap, err := dialer.ResolveHostMap(config.HostMap)
+	if err != nil {
+		return fmt.Errorf("SOCKS5: %v", err)
+	}
+
+	f.muConfig.Lock()
+	md := f.Dialer.Dialer.(*dialer.MultiDialer)
+	md.Reload(helpers.NewHostMatcherWithString(config.Site2Alias), hostMap, nil)
+	f.Dialer = &dialer.Socks5Dialer{
+		Dialer:   md,
+		Address:  config.Server.Address,
+		Username: config.Server.Username,
+		Password: config.Server.Password,
+	}
+	f.SiteMatcher = helpers.NewHostMatcher(config.Sites)
+	f.muConfig.Unlock()
+
+	// the idle connections go through the old server
+	f.Transport.CloseIdleConnections()
+
+	glog.Infof("SOCKS5: %#v reloaded", filename)
+	return nil
+}
+
+func (f *Filter) dial(network, address string) (net.Conn, error) {
+	f.muConfig.RLock()
+	d := f.Dialer
+	f.muConfig.RUnlock()
+	return d.Dial(network, address)
+}
+
+func (f *Filter) match(host string) bool {
+	f.muConfig.RLock()
+	defer f.muConfig.RUnlock()
+	return f.SiteMatcher.Match(host)
+}
+
+func (f *Filter) Route(req *http.Request) (string, bool) {
+	return filterName, f.match(req.Host)
+}
+
+func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	if !f.match(req.Host) {
+		return ctx, nil, nil
+	}
+
+	switch req.Method {
+	case http.MethodConnect:
+		glog.V(2).Infof("%s \"SOCKS5 %s %s %s\" - -", filters.RemoteAddr(req), req.Method, req.Host, req.Proto)
+		rconn, err := f.dial("tcp", req.Host)
+		if err != nil {
+			return ctx, nil, err
+		}
+		defer rconn.Close()
+
+		rw := filters.GetResponseWriter(ctx)
+
+		hijacker, ok := rw.(http.Hijacker)
+		if !ok {
+			return ctx, nil, fmt.Errorf("http.ResponseWriter(%#v) does not implments http.Hijacker", rw)
+		}
+
+		flusher, ok := rw.(http.Flusher)
+		if !ok {
+			return ctx, nil, fmt.Errorf("http.ResponseWriter(%#v) does not implments http.Flusher", rw)
+		}
+
+		rw.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		lconn, _, err := hijacker.Hijack()
+		if err != nil {
+			return ctx, nil, fmt.Errorf("%#v.Hijack() error: %v", hijacker, err)
+		}
+		defer lconn.Close()
+
+		go helpers.IoCopy(rconn, lconn)
+		helpers.IoCopy(lconn, rconn)
+
+		filters.SetHijacked(ctx, true)
+		return ctx, nil, nil
+	default:
+		resp, err := f.Transport.RoundTrip(req)
+		if err != nil {
+			glog.Warningf("%s \"SOCKS5 %s %s %s\" error: %v", filters.RemoteAddr(req), req.Method, req.URL.String(), req.Proto, err)
+			return ctx, nil, err
+		}
+		glog.V(2).Infof("%s \"SOCKS5 %s %s %s\" %d %s", filters.RemoteAddr(req), req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
+		return ctx, resp, nil
+	}
+}
@@ -0,0 +1,104 @@
+package stripssl
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../../storage"
+)
+
+// recentHosts counts the certificates served per common name, the top ones
+// are saved to a file and issued ahead on next start.
+type recentHosts struct {
+	filename string
+	mu       sync.Mutex
+	counts   map[string]int
+}
+
+func newRecentHosts(filename string) *recentHosts {
+	r := &recentHosts{
+		filename: filename,
+		counts:   make(map[string]int),
+	}
+
+	data, recovered, err := storage.ReadFileVerified(filename, nil)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			glog.Warningf("STRIPSSL: open %#v error: %v", filename, err)
+		}
+		return r
+	}
+	if recovered {
+		glog.Warningf("STRIPSSL: %#v is corrupted, load the last good one", filename)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		parts := strings.Fields(scanner.Text())
+		if len(parts) != 2 {
+			continue
+		}
+		if n, err := strconv.Atoi(parts[1]); err == nil {
+			r.counts[parts[0]] = n
+		}
+	}
+
+	return r
+}
+
+func (r *recentHosts) add(name string) {
+	r.mu.Lock()
+	r.counts[name]++
+	r.mu.Unlock()
+}
+
+// top returns at most n names ordered by count.
+func (r *recentHosts) top(n int) []string {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.counts))
+	for name := range r.counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return r.counts[names[i]] > r.counts[names[j]] })
+	r.mu.Unlock()
+
+	if len(names) > n {
+		names = names[:n]
+	}
+	return names
+}
+
+// save writes the top n names with their counts.
+func (r *recentHosts) save(n int) error {
+	names := r.top(n)
+
+	r.mu.Lock()
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("%s %d", name, r.counts[name]))
+	}
+	r.mu.Unlock()
+
+	return storage.WriteFileAtomic(r.filename, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
+
+// warmUp issues the certificates of the recently used hosts into the cache.
+func (f *Filter) warmUp(names []string) {
+	start := time.Now()
+	for _, name := range names {
+		if _, err := f.certificate(name); err != nil {
+			glog.Warningf("STRIPSSL: warm up certificate of %#v error: %v", name, err)
+			return
+		}
+	}
+	glog.V(2).Infof("STRIPSSL: warmed up %d certificates in %s", len(names), time.Since(start))
+}
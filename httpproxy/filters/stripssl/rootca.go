@@ -1,14 +1,20 @@
 package stripssl
 
 import (
+	"crypto"
+	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"encoding/hex"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"math/big"
+	"net"
 	"os"
 	"os/exec"
 	"runtime"
@@ -17,6 +23,8 @@ import (
 	"time"
 
 	"github.com/phuslu/glog"
+
+	"../../storage"
 )
 
 type RootCA struct {
@@ -28,7 +36,7 @@ type RootCA struct {
 	mu       *sync.Mutex
 
 	ca       *x509.Certificate
-	priv     *rsa.PrivateKey
+	priv     crypto.Signer
 	derBytes []byte
 }
 
@@ -80,19 +88,13 @@ func NewRootCA(name string, vaildFor time.Duration, rsaBits int, certDir string)
 		rootCA.priv = priv
 		rootCA.derBytes = derBytes
 
-		outFile1, err := os.Create(keyFile)
-		if err != nil {
+		// the key goes first, a cert without it would be taken as an existing CA
+		if err = storage.WriteFileAtomic(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}), 0600); err != nil {
 			return nil, err
 		}
-		pem.Encode(outFile1, &pem.Block{Type: "PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rootCA.priv)})
-		outFile1.Close()
-
-		outFile2, err := os.Create(certFile)
-		if err != nil {
+		if err = storage.WriteFileAtomic(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rootCA.derBytes}), 0644); err != nil {
 			return nil, err
 		}
-		pem.Encode(outFile2, &pem.Block{Type: "CERTIFICATE", Bytes: rootCA.derBytes})
-		outFile2.Close()
 
 		cmds := make([]*exec.Cmd, 0)
 		switch runtime.GOOS {
@@ -121,7 +123,7 @@ func NewRootCA(name string, vaildFor time.Duration, rsaBits int, certDir string)
 			}
 		}
 	} else {
-		data, err := ioutil.ReadFile(keyFile)
+		data, err := readRootCAFile(keyFile)
 		if err != nil {
 			return nil, err
 		}
@@ -148,7 +150,7 @@ func NewRootCA(name string, vaildFor time.Duration, rsaBits int, certDir string)
 			}
 		}
 
-		data, err = ioutil.ReadFile(certFile)
+		data, err = readRootCAFile(certFile)
 		if err != nil {
 			return nil, err
 		}
@@ -178,6 +180,104 @@ func NewRootCA(name string, vaildFor time.Duration, rsaBits int, certDir string)
 	return rootCA, nil
 }
 
+// LoadRootCA uses a CA provided by the user, it is never regenerated nor
+// imported into the system store. The issued certificates are kept in a sub
+// directory of certDir per CA, so that swapping the CA never serves a stale
+// certificate.
+func LoadRootCA(name, certFile, keyFile, certDir string) (*RootCA, error) {
+	rootCA := &RootCA{
+		name:     name,
+		keyFile:  keyFile,
+		certFile: certFile,
+		mu:       new(sync.Mutex),
+	}
+
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if b, _ := pem.Decode(data); b != nil && b.Type == "CERTIFICATE" {
+		rootCA.derBytes = b.Bytes
+	} else {
+		return nil, fmt.Errorf("no CERTIFICATE found in %#v", certFile)
+	}
+
+	if rootCA.ca, err = x509.ParseCertificate(rootCA.derBytes); err != nil {
+		return nil, err
+	}
+
+	if !rootCA.ca.IsCA {
+		return nil, fmt.Errorf("%#v is not a CA certificate", certFile)
+	}
+
+	data, err = ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		var b *pem.Block
+		if b, data = pem.Decode(data); b == nil {
+			break
+		}
+		if priv, err := parsePrivateKey(b); err == nil {
+			rootCA.priv = priv
+			break
+		}
+	}
+
+	if rootCA.priv == nil {
+		return nil, fmt.Errorf("no usable PRIVATE KEY found in %#v", keyFile)
+	}
+
+	switch pub := rootCA.ca.PublicKey.(type) {
+	case *rsa.PublicKey:
+		rootCA.rsaBits = pub.N.BitLen()
+	default:
+		rootCA.rsaBits = 2048
+	}
+
+	id := hex.EncodeToString(rootCA.ca.SubjectKeyId)
+	if id == "" {
+		id = hex.EncodeToString(rootCA.ca.SerialNumber.Bytes())
+	}
+	if len(id) > 16 {
+		id = id[:16]
+	}
+	rootCA.certDir = certDir + "/" + id
+
+	if err := os.MkdirAll(rootCA.certDir, 0755); err != nil {
+		return nil, err
+	}
+
+	return rootCA, nil
+}
+
+func parsePrivateKey(b *pem.Block) (crypto.Signer, error) {
+	switch b.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(b.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(b.Bytes)
+	case "PRIVATE KEY":
+		if priv, err := x509.ParsePKCS1PrivateKey(b.Bytes); err == nil {
+			return priv, nil
+		}
+		key, err := x509.ParsePKCS8PrivateKey(b.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch priv := key.(type) {
+		case *rsa.PrivateKey:
+			return priv, nil
+		case *ecdsa.PrivateKey:
+			return priv, nil
+		}
+	}
+	return nil, errors.New("unsupported private key type " + b.Type)
+}
+
 func (c *RootCA) issue(commonName string, vaildFor time.Duration, rsaBits int) error {
 	certFile := c.toFilename(commonName, ".crt")
 
@@ -212,7 +312,6 @@ func (c *RootCA) issue(commonName string, vaildFor time.Duration, rsaBits int) e
 		PublicKeyAlgorithm: csr.PublicKeyAlgorithm,
 		PublicKey:          csr.PublicKey,
 		SerialNumber:       big.NewInt(time.Now().UnixNano()),
-		SignatureAlgorithm: x509.SHA256WithRSA,
 		NotBefore:          time.Now().Add(-time.Duration(10 * time.Minute)).UTC(),
 		NotAfter:           time.Now().Add(vaildFor),
 		KeyUsage:           x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
@@ -222,20 +321,40 @@ func (c *RootCA) issue(commonName string, vaildFor time.Duration, rsaBits int) e
 		},
 	}
 
+	// browsers only look at subjectAltName
+	if ip := net.ParseIP(commonName); ip != nil {
+		certTemplate.IPAddresses = []net.IP{ip}
+	} else {
+		certTemplate.DNSNames = []string{commonName}
+	}
+
 	certBytes, err := x509.CreateCertificate(rand.Reader, certTemplate, c.ca, csr.PublicKey, c.priv)
 	if err != nil {
 		return err
 	}
 
-	outFile, err := os.Create(certFile)
-	defer outFile.Close()
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
+	data = append(data, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})...)
+
+	return storage.ReplaceFile(certFile, data, 0644)
+}
+
+// readRootCAFile reads the key or cert of the root CA, or the last good one
+// if it is corrupted, since a new root CA would have to be imported again.
+func readRootCAFile(filename string) ([]byte, error) {
+	data, recovered, err := storage.ReadFileVerified(filename, func(data []byte) error {
+		if b, _ := pem.Decode(data); b == nil {
+			return fmt.Errorf("no PEM block found in %#v", filename)
+		}
+		return nil
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	pem.Encode(outFile, &pem.Block{Type: "CERTIFICATE", Bytes: certBytes})
-	pem.Encode(outFile, &pem.Block{Type: "PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
-
-	return nil
+	if recovered {
+		glog.Warningf("STRIPSSL: %#v is corrupted, recovered the last good one", filename)
+	}
+	return data, nil
 }
 
 func GetCommonName(domain string) string {
@@ -270,15 +389,24 @@ func (c *RootCA) toFilename(commonName, suffix string) string {
 func (c *RootCA) Issue(commonName string, vaildFor time.Duration, rsaBits int) (*tls.Certificate, error) {
 	certFile := c.toFilename(commonName, ".crt")
 
-	if _, err := os.Stat(certFile); os.IsNotExist(err) {
-		glog.V(2).Infof("Issue %s certificate for %#v...", c.name, commonName)
-		c.mu.Lock()
-		defer c.mu.Unlock()
-		if _, err := os.Stat(certFile); os.IsNotExist(err) {
-			if err = c.issue(commonName, vaildFor, rsaBits); err != nil {
-				return nil, err
-			}
-		}
+	if tlsCert, err := tls.LoadX509KeyPair(certFile, certFile); err == nil {
+		return &tlsCert, nil
+	} else if !os.IsNotExist(err) {
+		// a cert torn by a power loss before certs were written atomically
+		glog.Warningf("Load %s certificate %#v error: %v, issue it again", c.name, certFile, err)
+	}
+
+	glog.V(2).Infof("Issue %s certificate for %#v...", c.name, commonName)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// another goroutine may have issued it while waiting for the lock
+	if tlsCert, err := tls.LoadX509KeyPair(certFile, certFile); err == nil {
+		return &tlsCert, nil
+	}
+
+	if err := c.issue(commonName, vaildFor, rsaBits); err != nil {
+		return nil, err
 	}
 
 	tlsCert, err := tls.LoadX509KeyPair(certFile, certFile)
@@ -8,6 +8,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"time"
 
@@ -30,9 +31,14 @@ type Config struct {
 		Name     string
 		Duration int
 		RsaBits  int
-	}
-	Ports []int
-	Sites []string
+		// a CA provided by user, the generated one is used if they are empty
+		CertFile string
+		KeyFile  string
+	}
+	CacheSize   int
+	WarmUpHosts int
+	Ports       []int
+	Sites       []string
 }
 
 type Filter struct {
@@ -42,6 +48,7 @@ type Filter struct {
 	TLSConfigCache lrucache.Cache
 	Ports          map[string]struct{}
 	Sites          *helpers.HostMatcher
+	recent         *recentHosts
 }
 
 func init() {
@@ -66,11 +73,19 @@ func init() {
 func NewFilter(config *Config) (_ filters.Filter, err error) {
 	var ca *RootCA
 
-	ca, err = NewRootCA(config.RootCA.Name, time.Duration(config.RootCA.Duration)*time.Second, config.RootCA.RsaBits, config.RootCA.Dirname)
+	if config.RootCA.CertFile != "" {
+		ca, err = LoadRootCA(config.RootCA.Name, config.RootCA.CertFile, config.RootCA.KeyFile, config.RootCA.Dirname)
+	} else {
+		ca, err = NewRootCA(config.RootCA.Name, time.Duration(config.RootCA.Duration)*time.Second, config.RootCA.RsaBits, config.RootCA.Dirname)
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	if config.CacheSize <= 0 {
+		config.CacheSize = 4096
+	}
+
 	if _, err := os.Stat(config.RootCA.Dirname); os.IsNotExist(err) {
 		if err = os.Mkdir(config.RootCA.Dirname, 0755); err != nil {
 			return nil, err
@@ -81,7 +96,7 @@ func NewFilter(config *Config) (_ filters.Filter, err error) {
 		Config:         *config,
 		CA:             ca,
 		CAExpiry:       time.Duration(config.RootCA.Duration) * time.Second,
-		TLSConfigCache: lrucache.NewMultiLRUCache(4, 4096),
+		TLSConfigCache: lrucache.NewMultiLRUCache(4, uint(config.CacheSize)),
 		Ports:          make(map[string]struct{}),
 		Sites:          helpers.NewHostMatcher(config.Sites),
 	}
@@ -90,6 +105,14 @@ func NewFilter(config *Config) (_ filters.Filter, err error) {
 		f.Ports[strconv.Itoa(port)] = struct{}{}
 	}
 
+	if config.WarmUpHosts > 0 {
+		f.recent = newRecentHosts(filepath.Join(config.RootCA.Dirname, "recent_hosts.txt"))
+		go f.warmUp(f.recent.top(config.WarmUpHosts))
+		helpers.DefaultScheduler.Every("stripssl.recenthosts", 10*time.Minute, false, func() error {
+			return f.recent.save(config.WarmUpHosts)
+		})
+	}
+
 	return f, nil
 }
 
@@ -98,7 +121,7 @@ func (f *Filter) FilterName() string {
 }
 
 func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Context, *http.Request, error) {
-	if req.Method != http.MethodConnect {
+	if req.Method != http.MethodConnect || filters.ReadOnly() {
 		return ctx, req, nil
 	}
 
@@ -133,7 +156,7 @@ func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Contex
 		return ctx, nil, err
 	}
 
-	glog.V(2).Infof("%s \"STRIP %s %s %s\" - -", req.RemoteAddr, req.Method, req.Host, req.Proto)
+	glog.V(2).Infof("%s \"STRIP %s %s %s\" - -", filters.RemoteAddr(req), req.Method, req.Host, req.Proto)
 
 	var c net.Conn = conn
 	if needStripSSL {
@@ -146,7 +169,7 @@ func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Contex
 		tlsConn := tls.Server(conn, config)
 
 		if err := tlsConn.Handshake(); err != nil {
-			glog.V(2).Infof("%s %T.Handshake() error: %#v", req.RemoteAddr, tlsConn, err)
+			glog.V(2).Infof("%s %T.Handshake() error: %#v", filters.RemoteAddr(req), tlsConn, err)
 			conn.Close()
 			return ctx, nil, err
 		}
@@ -172,24 +195,45 @@ func (f *Filter) Request(ctx context.Context, req *http.Request) (context.Contex
 	return ctx, nil, nil
 }
 
-func (f *Filter) issue(host string) (_ *tls.Config, err error) {
+// issue returns a tls.Config which picks the certificate by the SNI of the
+// client, host of the CONNECT request is used if the client sends no SNI.
+func (f *Filter) issue(host string) (*tls.Config, error) {
 	if h, _, err := net.SplitHostPort(host); err == nil {
 		host = h
 	}
 
+	// issue the certificate of host ahead, so that a bad CA fails early
+	if _, err := f.certificate(host); err != nil {
+		return nil, err
+	}
+
+	if f.recent != nil {
+		f.recent.add(GetCommonName(host))
+	}
+
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" {
+				return f.certificate(hello.ServerName)
+			}
+			return f.certificate(host)
+		},
+		KeyLogWriter: helpers.KeyLog,
+	}, nil
+}
+
+func (f *Filter) certificate(host string) (*tls.Certificate, error) {
 	name := GetCommonName(host)
 
-	var config interface{}
-	var ok bool
-	if config, ok = f.TLSConfigCache.Get(name); !ok {
-		cert, err := f.CA.Issue(name, f.CAExpiry, f.CA.RsaBits())
-		if err != nil {
-			return nil, err
-		}
-		config = &tls.Config{
-			Certificates: []tls.Certificate{*cert},
-		}
-		f.TLSConfigCache.Set(name, config, time.Now().Add(f.CAExpiry))
+	if cert, ok := f.TLSConfigCache.Get(name); ok {
+		return cert.(*tls.Certificate), nil
 	}
-	return config.(*tls.Config), nil
+
+	cert, err := f.CA.Issue(name, f.CAExpiry, f.CA.RsaBits())
+	if err != nil {
+		return nil, err
+	}
+	f.TLSConfigCache.Set(name, cert, time.Now().Add(f.CAExpiry))
+
+	return cert, nil
 }
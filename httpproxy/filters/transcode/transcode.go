@@ -0,0 +1,238 @@
+package transcode
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/phuslu/glog"
+
+	"../../filters"
+	"../../helpers"
+	"../../storage"
+)
+
+const (
+	filterName string = "transcode"
+)
+
+type Config struct {
+	Decompress struct {
+		Enabled bool
+	}
+	Images struct {
+		Enabled      bool
+		Quality      int
+		MaxSize      int64
+		SaveDataOnly bool
+		Sites        []string
+	}
+}
+
+// Filter transforms the response bodies for the clients, it decodes the
+// content encodings they did not ask for and recompresses images for the
+// ones on a slow link.
+type Filter struct {
+	Config
+	ImageSites *helpers.HostMatcher
+}
+
+func init() {
+	filename := filterName + ".json"
+	config := new(Config)
+	err := storage.ReadJsonConfig(storage.LookupConfigStoreURI(filterName), filename, config)
+	if err != nil {
+		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	err = filters.Register(filterName, &filters.RegisteredFilter{
+		New: func() (filters.Filter, error) {
+			return NewFilter(config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	if config.Images.Enabled && (config.Images.Quality < 1 || config.Images.Quality > 100) {
+		return nil, fmt.Errorf("TRANSCODE: invalid Images.Quality %d", config.Images.Quality)
+	}
+
+	f := &Filter{
+		Config: *config,
+	}
+
+	if len(config.Images.Sites) > 0 {
+		f.ImageSites = helpers.NewHostMatcher(config.Images.Sites)
+	}
+
+	return f, nil
+}
+
+func (f *Filter) FilterName() string {
+	return filterName
+}
+
+func (f *Filter) Response(ctx context.Context, resp *http.Response) (context.Context, *http.Response, error) {
+	req := resp.Request
+	if req == nil || req.Method == http.MethodHead || resp.Body == nil || resp.Body == http.NoBody {
+		return ctx, resp, nil
+	}
+
+	// a range of an encoded body cannot be decoded on its own
+	if f.Decompress.Enabled && resp.StatusCode != http.StatusPartialContent {
+		if encoding := strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))); encoding != "" && encoding != "identity" && !acceptsEncoding(req.Header.Get("Accept-Encoding"), encoding) {
+			br := bufio.NewReader(resp.Body)
+			resp.Body = readCloser{br, resp.Body}
+			body, err := decodeBody(encoding, br, resp.Body)
+			if err != nil {
+				glog.Warningf("%s \"TRANSCODE %s %s %s\" decode %#v error: %v", filters.RemoteAddr(req), req.Method, req.URL.String(), req.Proto, encoding, err)
+			} else {
+				glog.V(2).Infof("%s \"TRANSCODE %s %s %s\" decode %#v", filters.RemoteAddr(req), req.Method, req.URL.String(), req.Proto, encoding)
+				resp.Body = body
+				resp.Header.Del("Content-Encoding")
+				resp.Header.Del("Content-Length")
+				resp.ContentLength = -1
+			}
+		}
+	}
+
+	if f.Images.Enabled && f.wantsSmallImages(req) && resp.StatusCode == http.StatusOK && resp.Header.Get("Content-Encoding") == "" {
+		switch strings.SplitN(resp.Header.Get("Content-Type"), ";", 2)[0] {
+		case "image/jpeg", "image/png":
+			f.recompressImage(req, resp)
+		}
+	}
+
+	return ctx, resp, nil
+}
+
+func (f *Filter) wantsSmallImages(req *http.Request) bool {
+	if f.Images.SaveDataOnly && !strings.EqualFold(req.Header.Get("Save-Data"), "on") {
+		return false
+	}
+
+	if f.ImageSites != nil {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return f.ImageSites.Match(host)
+	}
+
+	return true
+}
+
+// recompressImage replaces the body with a jpeg of Quality if it is smaller,
+// the image is buffered as it has to be decoded as a whole.
+func (f *Filter) recompressImage(req *http.Request, resp *http.Response) {
+	if resp.ContentLength > f.Images.MaxSize {
+		return
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, f.Images.MaxSize+1))
+	if err != nil || int64(len(data)) > f.Images.MaxSize {
+		// pass what is read and the rest as is
+		resp.Body = readCloser{io.MultiReader(bytes.NewReader(data), resp.Body), resp.Body}
+		return
+	}
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		glog.V(2).Infof("%s \"TRANSCODE %s %s %s\" decode image error: %v", filters.RemoteAddr(req), req.Method, req.URL.String(), req.Proto, err)
+		return
+	}
+
+	// jpeg has no alpha channel
+	if o, ok := img.(interface{ Opaque() bool }); ok && !o.Opaque() {
+		return
+	}
+
+	var b bytes.Buffer
+	if err = jpeg.Encode(&b, img, &jpeg.Options{Quality: f.Images.Quality}); err != nil || b.Len() >= len(data) {
+		return
+	}
+
+	glog.V(2).Infof("%s \"TRANSCODE %s %s %s\" recompress image %d to %d bytes", filters.RemoteAddr(req), req.Method, req.URL.String(), req.Proto, len(data), b.Len())
+
+	resp.Body = ioutil.NopCloser(&b)
+	resp.ContentLength = int64(b.Len())
+	resp.Header.Set("Content-Length", strconv.Itoa(b.Len()))
+	resp.Header.Set("Content-Type", "image/jpeg")
+	resp.Header.Del("ETag")
+}
+
+// acceptsEncoding reports whether the Accept-Encoding value s allows
+// encoding, a missing header allows none.
+func acceptsEncoding(s, encoding string) bool {
+	for _, part := range strings.Split(s, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		if name != encoding && name != "*" && !(name == "x-gzip" && encoding == "gzip") {
+			continue
+		}
+		for _, param := range fields[1:] {
+			if kv := strings.SplitN(strings.TrimSpace(param), "=", 2); len(kv) == 2 && kv[0] == "q" {
+				if q, err := strconv.ParseFloat(kv[1], 64); err == nil && q == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// decodeBody returns a streaming decoder of encoding over br, which buffers
+// body. The magic bytes are peeked, so br is left intact if it fails.
+func decodeBody(encoding string, br *bufio.Reader, body io.Closer) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		if b, err := br.Peek(2); err != nil || b[0] != 0x1f || b[1] != 0x8b {
+			return nil, fmt.Errorf("not a gzip stream")
+		}
+		r, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return readCloser{r, body}, nil
+	case "deflate":
+		// it should be zlib, but some servers send raw deflate
+		if b, err := br.Peek(2); err == nil && (uint16(b[0])<<8|uint16(b[1]))%31 == 0 && b[0]&0x0f == 8 {
+			r, err := zlib.NewReader(br)
+			if err != nil {
+				return nil, err
+			}
+			return readCloser{r, body}, nil
+		}
+		return readCloser{flate.NewReader(br), body}, nil
+	case "br":
+		return readCloser{brotli.NewReader(br), body}, nil
+	default:
+		return nil, fmt.Errorf("unsupported encoding %#v", encoding)
+	}
+}
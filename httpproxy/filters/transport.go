@@ -0,0 +1,36 @@
+package filters
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Transport is a http.RoundTripper which sends requests through the
+// RoundTripFilter Name, e.g. so that the rules of a filter are downloaded
+// through gae while the direct path is blocked.
+type Transport struct {
+	Name string
+}
+
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f, err := GetFilter(t.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	f1, ok := f.(RoundTripFilter)
+	if !ok {
+		return nil, fmt.Errorf("%#v is not a RoundTripFilter", t.Name)
+	}
+
+	_, resp, err := f1.RoundTrip(req.Context(), req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp == nil {
+		return nil, fmt.Errorf("filter %#v does not handle %s", t.Name, req.URL.String())
+	}
+
+	return resp, nil
+}
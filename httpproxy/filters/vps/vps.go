@@ -2,8 +2,10 @@ package vps
 
 import (
 	"context"
-	// "fmt"
+	"crypto/tls"
+	"fmt"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"path"
@@ -12,6 +14,7 @@ import (
 	"github.com/phuslu/glog"
 	"github.com/phuslu/net/http2"
 
+	"../../dialer"
 	"../../filters"
 	"../../helpers"
 	"../../storage"
@@ -23,17 +26,25 @@ const (
 
 type Config struct {
 	FetchServers []struct {
-		URL       string
-		Username  string
-		Password  string
-		SSLVerify bool
+		URL         string
+		Username    string
+		Password    string
+		SSLVerify   bool
+		SignRequest bool
+		KeyID       string
 	}
 	Sites []string
+	// pinned ips of fetch server hostnames, raced against each other
+	Hosts map[string][]string
+	// the retry policy of retry.json, a failed request goes to the next
+	// fetch server, none if empty
+	RetryPolicy string
 }
 
 type Filter struct {
 	FetchServers []*FetchServer
 	Sites        *helpers.HostMatcher
+	Retry        *helpers.RetryPolicy
 }
 
 func init() {
@@ -64,21 +75,49 @@ func NewFilter(config *Config) (filters.Filter, error) {
 		}
 
 		transport := &http2.Transport{}
+		if len(config.Hosts) > 0 {
+			d := &dialer.Dialer{
+				Hosts: config.Hosts,
+			}
+			transport.DialTLS = func(network, addr string, cfg *tls.Config) (net.Conn, error) {
+				conn, err := d.Dial(network, addr)
+				if err != nil {
+					return nil, err
+				}
+				tlsConn := tls.Client(conn, cfg)
+				if err := tlsConn.Handshake(); err != nil {
+					conn.Close()
+					return nil, err
+				}
+				return tlsConn, nil
+			}
+		}
 
 		fs := &FetchServer{
-			URL:       u,
-			Username:  fs.Username,
-			Password:  fs.Password,
-			SSLVerify: fs.SSLVerify,
-			Transport: transport,
+			URL:         u,
+			Username:    fs.Username,
+			Password:    fs.Password,
+			SSLVerify:   fs.SSLVerify,
+			SignRequest: fs.SignRequest,
+			KeyID:       fs.KeyID,
+			Transport:   transport,
 		}
 
 		fetchServers = append(fetchServers, fs)
 	}
 
+	var retry *helpers.RetryPolicy
+	if config.RetryPolicy != "" {
+		var err error
+		if retry, err = helpers.LookupRetryPolicy(config.RetryPolicy); err != nil {
+			return nil, fmt.Errorf("VPS: %v", err)
+		}
+	}
+
 	return &Filter{
 		FetchServers: fetchServers,
 		Sites:        helpers.NewHostMatcher(config.Sites),
+		Retry:        retry,
 	}, nil
 }
 
@@ -86,6 +125,10 @@ func (p *Filter) FilterName() string {
 	return filterName
 }
 
+func (f *Filter) Route(req *http.Request) (string, bool) {
+	return filterName, f.Sites.Match(req.Host)
+}
+
 func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
 	if !f.Sites.Match(req.Host) {
 		return ctx, nil, nil
@@ -117,8 +160,6 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 		}
 	}
 
-	fetchServer := f.FetchServers[i]
-
 	// if req.Method == "CONNECT" {
 	// 	rconn, err := fetchServer.Transport.Connect(req)
 	// 	if err != nil {
@@ -153,11 +194,36 @@ func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Cont
 	// 	ctx.Hijack(true)
 	// 	return ctx, nil, nil
 	// }
-	resp, err := fetchServer.RoundTrip(req)
+	tries := f.Retry.Attempts()
+	if !helpers.IsReplayable(req) {
+		tries = 1
+	}
+
+	var resp *http.Response
+	var err error
+	for j := 0; j < tries; j++ {
+		if j > 0 {
+			glog.Warningf("VPS: request \"%s\" error: %T(%v), retry...", req.URL.String(), err, err)
+			if err := f.Retry.Sleep(req.Context(), j); err != nil {
+				return ctx, nil, err
+			}
+			if req.GetBody != nil {
+				if req.Body, err = req.GetBody(); err != nil {
+					return ctx, nil, err
+				}
+			}
+		}
+
+		fetchServer := f.FetchServers[(i+j)%len(f.FetchServers)]
+		resp, err = fetchServer.RoundTrip(req)
+		if err == nil || !f.Retry.RetryError(err) {
+			break
+		}
+	}
 	if err != nil {
 		return ctx, nil, err
 	} else {
-		glog.V(2).Infof("%s \"VPS %s %s %s\" %d %s", req.RemoteAddr, req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
+		glog.V(2).Infof("%s \"VPS %s %s %s\" %d %s", filters.RemoteAddr(req), req.Method, req.URL.String(), req.Proto, resp.StatusCode, resp.Header.Get("Content-Length"))
 	}
 	return ctx, resp, err
 }
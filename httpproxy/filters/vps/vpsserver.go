@@ -7,6 +7,8 @@ import (
 	"net/url"
 
 	"github.com/phuslu/net/http2"
+
+	"../../helpers"
 )
 
 var (
@@ -24,11 +26,13 @@ var (
 )
 
 type FetchServer struct {
-	URL       *url.URL
-	Username  string
-	Password  string
-	SSLVerify bool
-	Transport *http2.Transport
+	URL         *url.URL
+	Username    string
+	Password    string
+	SSLVerify   bool
+	SignRequest bool
+	KeyID       string
+	Transport   *http2.Transport
 }
 
 func (f *FetchServer) RoundTrip(req *http.Request) (resp *http.Response, err error) {
@@ -38,7 +42,11 @@ func (f *FetchServer) RoundTrip(req *http.Request) (resp *http.Response, err err
 		}
 	}
 
-	req.Header.Set("Proxy-Authorization", base64.StdEncoding.EncodeToString([]byte(f.Username+":"+f.Password)))
+	if f.SignRequest {
+		helpers.SignRequest(req, f.Password, f.KeyID, f.Username)
+	} else {
+		req.Header.Set("Proxy-Authorization", base64.StdEncoding.EncodeToString([]byte(f.Username+":"+f.Password)))
+	}
 
 	resp, err = f.Transport.RoundTrip(req)
 	if err != nil {
@@ -0,0 +1,170 @@
+package websocket
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../../filters"
+	"../../helpers"
+	"../../storage"
+)
+
+const (
+	filterName string = "websocket"
+)
+
+type Config struct {
+	Sites  []string
+	Dialer struct {
+		Timeout   int
+		KeepAlive int
+		DualStack bool
+	}
+	TLSClientConfig struct {
+		InsecureSkipVerify     bool
+		ClientSessionCacheSize int
+	}
+}
+
+type Filter struct {
+	Config
+	Dialer      *net.Dialer
+	TLSConfig   *tls.Config
+	SiteMatcher *helpers.HostMatcher
+}
+
+func init() {
+	filename := filterName + ".json"
+	config := new(Config)
+	err := storage.ReadJsonConfig(storage.LookupConfigStoreURI(filterName), filename, config)
+	if err != nil {
+		glog.Fatalf("storage.ReadJsonConfig(%#v) failed: %s", filename, err)
+	}
+
+	err = filters.Register(filterName, &filters.RegisteredFilter{
+		New: func() (filters.Filter, error) {
+			return NewFilter(config)
+		},
+	})
+
+	if err != nil {
+		glog.Fatalf("Register(%#v) error: %s", filterName, err)
+	}
+}
+
+func NewFilter(config *Config) (filters.Filter, error) {
+	return &Filter{
+		Config: *config,
+		Dialer: &net.Dialer{
+			Timeout:   time.Duration(config.Dialer.Timeout) * time.Second,
+			KeepAlive: time.Duration(config.Dialer.KeepAlive) * time.Second,
+			DualStack: config.Dialer.DualStack,
+		},
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: config.TLSClientConfig.InsecureSkipVerify,
+			ClientSessionCache: tls.NewLRUClientSessionCache(config.TLSClientConfig.ClientSessionCacheSize),
+			KeyLogWriter:       helpers.KeyLog,
+		},
+		SiteMatcher: helpers.NewHostMatcher(config.Sites),
+	}, nil
+}
+
+func (f *Filter) FilterName() string {
+	return filterName
+}
+
+// IsWebSocket reports whether req asks for a websocket upgrade.
+func IsWebSocket(req *http.Request) bool {
+	if !strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+
+	for _, s := range strings.Split(req.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(s), "upgrade") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *Filter) Route(req *http.Request) (string, bool) {
+	return filterName, req.Method == http.MethodGet && IsWebSocket(req) && f.SiteMatcher.Match(req.Host)
+}
+
+func (f *Filter) RoundTrip(ctx context.Context, req *http.Request) (context.Context, *http.Response, error) {
+	if req.Method != http.MethodGet || !IsWebSocket(req) || !f.SiteMatcher.Match(req.Host) {
+		return ctx, nil, nil
+	}
+
+	addr := req.URL.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		switch req.URL.Scheme {
+		case "https", "wss":
+			addr = net.JoinHostPort(addr, "443")
+		default:
+			addr = net.JoinHostPort(addr, "80")
+		}
+	}
+
+	glog.V(2).Infof("%s \"WEBSOCKET %s %s %s\" - -", filters.RemoteAddr(req), req.Method, req.URL.String(), req.Proto)
+
+	rconn, err := f.Dialer.Dial("tcp", addr)
+	if err != nil {
+		return ctx, nil, err
+	}
+	defer rconn.Close()
+
+	if req.URL.Scheme == "https" || req.URL.Scheme == "wss" {
+		config := f.TLSConfig.Clone()
+		config.ServerName = req.URL.Hostname()
+		tlsConn := tls.Client(rconn, config)
+		if err = tlsConn.Handshake(); err != nil {
+			return ctx, nil, err
+		}
+		rconn = tlsConn
+	}
+
+	for _, key := range []string{"Proxy-Connection", "Proxy-Authorization"} {
+		req.Header.Del(key)
+	}
+
+	if err = req.Write(rconn); err != nil {
+		return ctx, nil, err
+	}
+
+	rw := filters.GetResponseWriter(ctx)
+
+	hijacker, ok := rw.(http.Hijacker)
+	if !ok {
+		return ctx, nil, fmt.Errorf("http.ResponseWriter(%#v) does not implments http.Hijacker", rw)
+	}
+
+	lconn, brw, err := hijacker.Hijack()
+	if err != nil {
+		return ctx, nil, fmt.Errorf("%#v.Hijack() error: %v", hijacker, err)
+	}
+	defer lconn.Close()
+
+	// the client may already send frames which are buffered by net/http
+	if n := brw.Reader.Buffered(); n > 0 {
+		b, _ := brw.Reader.Peek(n)
+		if _, err = rconn.Write(b); err != nil {
+			filters.SetHijacked(ctx, true)
+			return ctx, nil, nil
+		}
+	}
+
+	go helpers.IoCopy(rconn, lconn)
+	helpers.IoCopy(lconn, rconn)
+
+	filters.SetHijacked(ctx, true)
+	return ctx, nil, nil
+}
@@ -1,14 +1,18 @@
 package httpproxy
 
 import (
+	"context"
 	"fmt"
 	"io"
+	"math/rand"
+	"mime"
 	"net"
 	"net/http"
 	"os"
 	"runtime"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/phuslu/glog"
 
@@ -22,17 +26,67 @@ type Handler struct {
 	RequestFilters   []filters.RequestFilter
 	RoundTripFilters []filters.RoundTripFilter
 	ResponseFilters  []filters.ResponseFilter
+	FallbackFilter   filters.RoundTripFilter
+	FallbackChains   map[string]*FallbackChain
+	FlushInterval    time.Duration
+	FlushThreshold   int
+	FlushPolicies    map[string]time.Duration
+	Metrics          helpers.MetricsRecorder
+	RequestIDHeader  bool
+	AccessLog        *helpers.AccessLog
+	Stats            *helpers.StatsDB
+	Traffic          *helpers.TrafficStats
+	ForwardedFor     string
+	Panics           *helpers.PanicGuard
+	ErrorPages       *helpers.ErrorPages
 }
 
 func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	var err error
 
+	start := time.Now()
+
 	remoteAddr := req.RemoteAddr
 
 	// Prepare filter.Context
 	ctx := filters.NewContext(req.Context(), h.Listener, rw)
+
+	// Tag the request with an id for log correlation
+	requestID := fmt.Sprintf("%016x", rand.Int63())
+	filters.SetRequestID(ctx, requestID)
+	remoteAddr += " #" + requestID
+	if h.RequestIDHeader {
+		rw.Header().Set("X-GoProxy-Request-Id", requestID)
+	}
+
+	// Record the way of the request through the filters if asked to
+	var trace *helpers.Trace
+	if helpers.Traces.ShouldTrace(req) {
+		req.Header.Del(helpers.TraceHeader)
+		trace = helpers.NewTrace(requestID, req)
+		ctx = helpers.WithTrace(ctx, trace)
+		rw.Header().Set("X-GoProxy-Trace-Id", requestID)
+		defer helpers.Traces.Put(trace)
+	}
 	req = req.WithContext(ctx)
 
+	// Fields of the access log line, which is written at any exit below
+	var (
+		status  int
+		egress  string
+		written int64
+	)
+	if h.AccessLog != nil || h.Stats != nil || h.Traffic != nil {
+		defer func() {
+			h.logAccess(req, egress, status, written, err, start)
+		}()
+	}
+	if trace != nil {
+		defer func() {
+			trace.Addf("done", egress, "%d, %d bytes in %s", status, written, time.Since(start))
+		}()
+	}
+
 	// Enable transport http proxy
 	if req.Method != "CONNECT" && !req.URL.IsAbs() {
 		if req.URL.Scheme == "" {
@@ -59,12 +113,22 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 
 	// Filter Request
 	for _, f := range h.RequestFilters {
-		ctx, req, err = f.Request(ctx, req)
+		if h.Panics.Bypassed(f.FilterName(), req) {
+			trace.Addf("request", f.FilterName(), "bypassed for its panics")
+			continue
+		}
+		start := time.Now()
+		ctx, req, err = h.request(f, ctx, req)
+		h.observe("request", f.FilterName(), start)
+		trace.Addf("request", f.FilterName(), "%s %s in %s", req.Method, req.URL, time.Since(start))
 		// A roundtrip filter hijacked
 		if filters.GetHijacked(ctx) {
+			egress = f.FilterName()
+			trace.Addf("request", f.FilterName(), "hijacked")
 			return
 		}
 		if err != nil {
+			trace.Addf("request", f.FilterName(), "error: %v", err)
 			if err != io.EOF {
 				glog.Errorf("%s Filter Request %T error: %#v", remoteAddr, f, err)
 			}
@@ -78,18 +142,75 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		defer req.Body.Close()
 	}
 
+	if h.ForwardedFor != "" && req.Method != "CONNECT" {
+		forwardedFor(req, h.ForwardedFor)
+	}
+
 	// Filter Request -> Response
 	var resp *http.Response
 	for _, f := range h.RoundTripFilters {
-		ctx, resp, err = f.RoundTrip(ctx, req)
+		chain := h.FallbackChains[f.FilterName()]
+		if chain != nil {
+			f = chain.Pick(f, req.Host)
+		}
+		if h.Panics.Bypassed(f.FilterName(), req) {
+			trace.Addf("roundtrip", f.FilterName(), "bypassed for its panics")
+			continue
+		}
+		start := time.Now()
+		ctx, resp, err = h.roundTrip(f, ctx, req)
+		h.observe("roundtrip", f.FilterName(), start)
+		traceRoundTrip(ctx, trace, f, resp, err, start)
+		egress = f.FilterName()
 		// A roundtrip filter hijacked
 		if filters.GetHijacked(ctx) {
 			return
 		}
+		// Move on along the chain once the host keeps failing on this filter
+		if chain != nil && chain.Failed(f, req.Host, resp, err) && req.ContentLength == 0 {
+			if f1 := chain.Next(f, req.Host); f1 != nil {
+				glog.Warningf("%s Filter RoundTrip %T keeps failing %#v, fallback to %T", remoteAddr, f, req.Host, f1)
+				if resp != nil && resp.Body != nil {
+					resp.Body.Close()
+				}
+				if h.Metrics != nil {
+					h.Metrics.IncCounter("goproxy_fallback_total", "from", f.FilterName(), "to", f1.FilterName())
+				}
+				f = f1
+				trace.Addf("fallback", f.FilterName(), "%#v keeps failing on the previous filter", req.Host)
+				start = time.Now()
+				ctx, resp, err = h.roundTrip(f, ctx, filters.ReplayRequest(req))
+				h.observe("roundtrip", f.FilterName(), start)
+				traceRoundTrip(ctx, trace, f, resp, err, start)
+				egress = f.FilterName()
+				if filters.GetHijacked(ctx) {
+					return
+				}
+			}
+		}
+		// Retry a failed request without body via the fallback egress
+		if err != nil && h.FallbackFilter != nil && f != h.FallbackFilter && req.ContentLength == 0 {
+			glog.Warningf("%s Filter RoundTrip %T error: %v, fallback to %T", remoteAddr, f, err, h.FallbackFilter)
+			f = h.FallbackFilter
+			trace.Addf("fallback", f.FilterName(), "the previous filter failed")
+			start = time.Now()
+			ctx, resp, err = h.roundTrip(f, ctx, filters.ReplayRequest(req))
+			h.observe("roundtrip", f.FilterName(), start)
+			traceRoundTrip(ctx, trace, f, resp, err, start)
+			egress = f.FilterName()
+			if filters.GetHijacked(ctx) {
+				return
+			}
+		}
 		// Unexcepted errors
 		if err != nil {
 			glog.Errorf("%s Filter RoundTrip %T error: %v", remoteAddr, f, err)
-			http.Error(rw, err.Error(), http.StatusBadGateway)
+			status = errorStatusCode(err)
+			page := helpers.NewErrorPage(status, err)
+			page.Filter = f.FilterName()
+			page.URL = req.URL.String()
+			page.RequestID = requestID
+			h.ErrorPages.Write(rw, req, page)
 			return
 		}
 		// Update context for request
@@ -107,11 +228,20 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		if resp == nil {
 			return
 		}
-		ctx, resp, err = f.Response(ctx, resp)
+		if h.Panics.Bypassed(f.FilterName(), req) {
+			trace.Addf("response", f.FilterName(), "bypassed for its panics")
+			continue
+		}
+		start := time.Now()
+		ctx, resp, err = h.response(f, ctx, req, resp)
+		h.observe("response", f.FilterName(), start)
+		trace.Addf("response", f.FilterName(), "in %s", time.Since(start))
 		if err != nil {
+			trace.Addf("response", f.FilterName(), "error: %v", err)
 			msg := fmt.Sprintf("%s Filter %T Response error: %v", remoteAddr, f, err)
 			glog.Errorln(msg)
-			http.Error(rw, msg, http.StatusBadGateway)
+			status = http.StatusBadGateway
+			h.writeError(rw, req, status, f.FilterName(), requestID, fmt.Errorf("Filter %T Response error: %v", f, err), msg)
 			return
 		}
 		// Update context for request
@@ -121,7 +251,20 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	if resp == nil {
 		msg := fmt.Sprintf("%s Handler %#v Response empty response", remoteAddr, h)
 		glog.Errorln(msg)
-		http.Error(rw, msg, http.StatusBadGateway)
+		status = http.StatusBadGateway
+		h.writeError(rw, req, status, "", requestID, fmt.Errorf("empty response"), msg)
+		return
+	}
+
+	// A filter blocked the request, tell why in an error page
+	if page := helpers.BlockedPage(resp); page != nil && h.ErrorPages != nil {
+		if resp.Body != nil {
+			resp.Body.Close()
+		}
+		page.URL = req.URL.String()
+		page.RequestID = requestID
+		status = page.Status
+		h.ErrorPages.Write(rw, req, page)
 		return
 	}
 
@@ -131,9 +274,21 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		}
 	}
 	rw.WriteHeader(resp.StatusCode)
+	status = resp.StatusCode
 	if resp.Body != nil {
 		defer resp.Body.Close()
-		n, err := helpers.IoCopy(rw, resp.Body)
+		interval := h.flushInterval(ctx, resp)
+		// Send the response headers before the first body chunk arrives
+		if flusher, ok := rw.(http.Flusher); ok && interval != 0 {
+			flusher.Flush()
+		}
+		threshold := h.FlushThreshold
+		if interval == 0 {
+			threshold = 0
+		}
+		w := helpers.NewFlushWriter(rw, interval, threshold)
+		defer w.Close()
+		n, err := helpers.IoCopy(w, resp.Body)
 		if err != nil {
 			if isClosedConnError(err) {
 				glog.Infof("IoCopy %#v return %#v %T(%v)", resp.Body, n, err, err)
@@ -141,6 +296,234 @@ func (h Handler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 				glog.Warningf("IoCopy %#v return %#v %T(%v)", resp.Body, n, err, err)
 			}
 		}
+		written = n
+	}
+
+	h.observeExchange(ctx, req, resp, written, start)
+}
+
+// request calls f.Request, a panic of f fails the request instead of the
+// connection and is counted against f by Panics.
+func (h Handler) request(f filters.RequestFilter, ctx context.Context, req *http.Request) (ctx1 context.Context, req1 *http.Request, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			ctx1, req1, err = ctx, req, h.Panics.Recovered(f.FilterName(), req, v)
+		}
+	}()
+	return f.Request(ctx, req)
+}
+
+func (h Handler) roundTrip(f filters.RoundTripFilter, ctx context.Context, req *http.Request) (ctx1 context.Context, resp *http.Response, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			ctx1, resp, err = ctx, nil, h.Panics.Recovered(f.FilterName(), req, v)
+		}
+	}()
+	return f.RoundTrip(ctx, req)
+}
+
+func (h Handler) response(f filters.ResponseFilter, ctx context.Context, req *http.Request, resp *http.Response) (ctx1 context.Context, resp1 *http.Response, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			if resp.Body != nil {
+				resp.Body.Close()
+			}
+			ctx1, resp1, err = ctx, nil, h.Panics.Recovered(f.FilterName(), req, v)
+		}
+	}()
+	return f.Response(ctx, resp)
+}
+
+// traceRoundTrip records whether f took the request, and the upstream of the
+// response if it reports one.
+func traceRoundTrip(ctx context.Context, trace *helpers.Trace, f filters.RoundTripFilter, resp *http.Response, err error, start time.Time) {
+	switch {
+	case trace == nil:
+		return
+	case err != nil:
+		trace.Addf("roundtrip", f.FilterName(), "error in %s: %v", time.Since(start), err)
+	case filters.GetHijacked(ctx):
+		trace.Addf("roundtrip", f.FilterName(), "hijacked in %s", time.Since(start))
+	case resp != nil:
+		if upstream := filters.GetUpstream(ctx); upstream != "" {
+			trace.Addf("roundtrip", f.FilterName(), "%s in %s from %s", resp.Status, time.Since(start), upstream)
+		} else {
+			trace.Addf("roundtrip", f.FilterName(), "%s in %s", resp.Status, time.Since(start))
+		}
+	default:
+		trace.Addf("roundtrip", f.FilterName(), "passed in %s", time.Since(start))
+	}
+}
+
+// flushInterval returns the flush interval of resp, the one set by the round
+// trip filter, or by its Content-Type, e.g. "text/event-stream" then
+// "text/*", otherwise the default one.
+func (h Handler) flushInterval(ctx context.Context, resp *http.Response) time.Duration {
+	if interval, ok := filters.GetFlushInterval(ctx); ok {
+		return interval
+	}
+
+	if len(h.FlushPolicies) == 0 {
+		return h.FlushInterval
+	}
+
+	ct := resp.Header.Get("Content-Type")
+	if mt, _, err := mime.ParseMediaType(ct); err == nil {
+		ct = mt
+	}
+
+	if interval, ok := h.FlushPolicies[ct]; ok {
+		return interval
+	}
+
+	if i := strings.Index(ct, "/"); i > 0 {
+		if interval, ok := h.FlushPolicies[ct[:i]+"/*"]; ok {
+			return interval
+		}
+	}
+
+	return h.FlushInterval
+}
+
+func (h Handler) observe(stage, name string, start time.Time) {
+	if h.Metrics != nil {
+		h.Metrics.Observe("goproxy_filter_duration_seconds", time.Since(start).Seconds(), "filter", name, "stage", stage)
+	}
+}
+
+// observeExchange records sizes and duration of a request by its egress, i.e.
+// the RoundTripFilter which gave the response, and the response Content-Type.
+func (h Handler) observeExchange(ctx context.Context, req *http.Request, resp *http.Response, written int64, start time.Time) {
+	if h.Metrics == nil {
+		return
+	}
+
+	egress := "none"
+	if f := filters.GetRoundTripFilter(ctx); f != nil {
+		egress = f.FilterName()
+	}
+
+	ct := "none"
+	if mt, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil {
+		ct = mt
+	}
+
+	if req.ContentLength >= 0 {
+		h.Metrics.Observe("goproxy_request_bytes", float64(req.ContentLength), "egress", egress)
+	}
+	h.Metrics.Observe("goproxy_response_bytes", float64(written), "egress", egress, "content_type", ct)
+	h.Metrics.Observe("goproxy_request_duration_seconds", time.Since(start).Seconds(), "egress", egress, "content_type", ct)
+}
+
+// logAccess writes the access log line of req to AccessLog, Stats and Traffic,
+// the upstream is the address reported by the egress filter via
+// filters.SetUpstream.
+func (h Handler) logAccess(req *http.Request, egress string, status int, written int64, err error, start time.Time) {
+	requestBytes := req.ContentLength
+	if requestBytes < 0 {
+		requestBytes = 0
+	}
+	// the bytes relayed by a hijacking filter, e.g. a CONNECT tunnel
+	up, down := filters.GetTraffic(req.Context())
+	requestBytes += up
+	written += down
+
+	e := &helpers.AccessLogEntry{
+		Time:          start,
+		RequestID:     filters.GetRequestID(req.Context()),
+		Client:        req.RemoteAddr,
+		Method:        req.Method,
+		Host:          req.Host,
+		URL:           req.URL.String(),
+		Filter:        egress,
+		Upstream:      filters.GetUpstream(req.Context()),
+		Status:        status,
+		RequestBytes:  requestBytes,
+		ResponseBytes: written,
+		Latency:       float64(time.Since(start)) / float64(time.Millisecond),
+	}
+
+	if err != nil && err != io.EOF {
+		e.Error = err.Error()
+	}
+
+	if h.AccessLog != nil {
+		if err := h.AccessLog.Log(e); err != nil {
+			glog.Warningf("AccessLog.Log(%#v) error: %v", e.URL, err)
+		}
+	}
+
+	if h.Stats != nil {
+		if err := h.Stats.Log(e); err != nil {
+			glog.Warningf("Stats.Log(%#v) error: %v", e.URL, err)
+		}
+	}
+
+	if h.Traffic != nil {
+		client := req.RemoteAddr
+		if host, _, err := net.SplitHostPort(client); err == nil {
+			client = host
+		}
+		h.Traffic.Add(client, req.Host, requestBytes, written)
+	}
+}
+
+// forwardedFor appends the client ip to X-Forwarded-For and Forwarded of req
+// in "append" mode, and removes the headers which reveal the client or the
+// proxy chain in "strip" mode.
+func forwardedFor(req *http.Request, mode string) {
+	switch mode {
+	case "append":
+		ip, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			return
+		}
+		if prior := req.Header.Get("X-Forwarded-For"); prior != "" {
+			req.Header.Set("X-Forwarded-For", prior+", "+ip)
+		} else {
+			req.Header.Set("X-Forwarded-For", ip)
+		}
+		node := ip
+		if strings.Contains(ip, ":") {
+			node = "\"[" + ip + "]\""
+		}
+		if prior := req.Header.Get("Forwarded"); prior != "" {
+			req.Header.Set("Forwarded", prior+", for="+node)
+		} else {
+			req.Header.Set("Forwarded", "for="+node)
+		}
+	case "strip":
+		for _, key := range []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Real-Ip", "Forwarded", "Via", "Client-Ip"} {
+			req.Header.Del(key)
+		}
+	}
+}
+
+// writeError writes an error page of err, or text as http.Error did if the
+// error pages are disabled.
+func (h Handler) writeError(rw http.ResponseWriter, req *http.Request, status int, filter, requestID string, err error, text string) {
+	if h.ErrorPages == nil {
+		http.Error(rw, text, status)
+		return
+	}
+
+	page := helpers.NewErrorPage(status, err)
+	page.Filter = filter
+	page.URL = req.URL.String()
+	page.RequestID = requestID
+	h.ErrorPages.Write(rw, req, page)
+}
+
+// errorStatusCode maps the kind of a RoundTrip error to the status code
+// returned to client.
+func errorStatusCode(err error) int {
+	switch {
+	case helpers.IsError(err, helpers.ErrFetchTimeout):
+		return http.StatusGatewayTimeout
+	case helpers.IsError(err, helpers.ErrFetchQuota):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusBadGateway
 	}
 }
 
@@ -0,0 +1,159 @@
+package helpers
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// the rejected peers counted one by one, the ones after are only counted
+	// in the total, so that a scan of the internet does not grow it unbounded
+	maxRejectedPeers int = 1024
+)
+
+// AcceptFilter decides from the peer address whether a connection is served,
+// before anything is read from it. A peer in Deny is rejected, and so is a
+// peer not in Allow if Allow is not empty.
+type AcceptFilter struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+
+	mu       sync.Mutex
+	rejected int64
+	peers    map[string]*RejectedPeer
+}
+
+// RejectedPeer is the count of connections rejected from one ip.
+type RejectedPeer struct {
+	Count    int64
+	LastSeen time.Time
+}
+
+// AcceptStats is the connections rejected by an AcceptFilter.
+type AcceptStats struct {
+	Rejected int64
+	Peers    map[string]RejectedPeer
+}
+
+// NewAcceptFilter parses the CIDRs of allow and deny, a single ip is taken as
+// a /32 or /128. It returns nil if both are empty.
+func NewAcceptFilter(allow, deny []string) (*AcceptFilter, error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+
+	f := &AcceptFilter{
+		peers: make(map[string]*RejectedPeer),
+	}
+
+	var err error
+	if f.Allow, err = ParseIPNets(allow); err != nil {
+		return nil, err
+	}
+	if f.Deny, err = ParseIPNets(deny); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// ParseIPNets parses cidrs, a single ip is taken as a /32 or /128.
+func ParseIPNets(cidrs []string) ([]*net.IPNet, error) {
+	ipnets := make([]*net.IPNet, 0, len(cidrs))
+	for _, s := range cidrs {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %#v", s)
+			}
+			if ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %#v: %v", s, err)
+		}
+		ipnets = append(ipnets, ipnet)
+	}
+	return ipnets, nil
+}
+
+// ContainsIP reports whether ip is inside one of ipnets, a nil ip is not.
+func ContainsIP(ipnets []*net.IPNet, ip net.IP) bool {
+	for _, ipnet := range ipnets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Accept reports whether a connection from addr is served, and counts it if
+// not. A nil AcceptFilter accepts all.
+func (f *AcceptFilter) Accept(addr net.Addr) bool {
+	if f == nil {
+		return true
+	}
+
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		if addr != nil {
+			host, _, err := net.SplitHostPort(addr.String())
+			if err == nil {
+				ip = net.ParseIP(host)
+			}
+		}
+	}
+	if ip == nil {
+		// not an ip peer, such as a unix socket, is up to the handler
+		return true
+	}
+
+	if !ContainsIP(f.Deny, ip) && (len(f.Allow) == 0 || ContainsIP(f.Allow, ip)) {
+		return true
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.rejected++
+	key := ip.String()
+	p, ok := f.peers[key]
+	if !ok {
+		if len(f.peers) >= maxRejectedPeers {
+			return false
+		}
+		p = &RejectedPeer{}
+		f.peers[key] = p
+	}
+	p.Count++
+	p.LastSeen = time.Now()
+
+	return false
+}
+
+// Stats returns the connections rejected so far.
+func (f *AcceptFilter) Stats() AcceptStats {
+	stats := AcceptStats{Peers: make(map[string]RejectedPeer)}
+	if f == nil {
+		return stats
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	stats.Rejected = f.rejected
+	for ip, p := range f.peers {
+		stats.Peers[ip] = *p
+	}
+	return stats
+}
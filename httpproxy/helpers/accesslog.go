@@ -0,0 +1,134 @@
+package helpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultAccessLogMaxSize    int64 = 64 * 1024 * 1024
+	DefaultAccessLogMaxBackups int   = 3
+)
+
+// AccessLogEntry is one line of the access log.
+type AccessLogEntry struct {
+	Time          time.Time `json:"time"`
+	RequestID     string    `json:"request_id"`
+	Client        string    `json:"client"`
+	Method        string    `json:"method"`
+	Host          string    `json:"host"`
+	URL           string    `json:"url"`
+	Filter        string    `json:"filter,omitempty"`
+	Upstream      string    `json:"upstream,omitempty"`
+	Status        int       `json:"status"`
+	RequestBytes  int64     `json:"request_bytes"`
+	ResponseBytes int64     `json:"response_bytes"`
+	Latency       float64   `json:"latency_ms"`
+	Error         string    `json:"error,omitempty"`
+}
+
+// AccessLog writes entries as JSON lines to Filename, the file is rotated to
+// Filename.1 ... Filename.MaxBackups once it grows over MaxSize.
+type AccessLog struct {
+	Filename   string
+	MaxSize    int64
+	MaxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func NewAccessLog(filename string, maxSize int64, maxBackups int) (*AccessLog, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultAccessLogMaxSize
+	}
+	if maxBackups <= 0 {
+		maxBackups = DefaultAccessLogMaxBackups
+	}
+
+	l := &AccessLog{
+		Filename:   filename,
+		MaxSize:    maxSize,
+		MaxBackups: maxBackups,
+	}
+
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *AccessLog) open() error {
+	file, err := os.OpenFile(l.Filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	l.file = file
+	l.size = fi.Size()
+	return nil
+}
+
+func (l *AccessLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+
+	for i := l.MaxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.Filename, i), fmt.Sprintf("%s.%d", l.Filename, i+1))
+	}
+	err := os.Rename(l.Filename, l.Filename+".1")
+
+	// keep logging to the old file if it cannot be renamed, e.g. on windows
+	if err1 := l.open(); err1 != nil {
+		return err1
+	}
+	return err
+}
+
+func (l *AccessLog) Log(e *AccessLogEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return fmt.Errorf("AccessLog %#v is closed", l.Filename)
+	}
+
+	if l.size+int64(len(data)) > l.MaxSize && l.size > 0 {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	return err
+}
+
+func (l *AccessLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
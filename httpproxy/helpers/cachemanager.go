@@ -0,0 +1,200 @@
+package helpers
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+)
+
+const (
+	cacheExportInterval time.Duration = 10 * time.Second
+
+	// a cache is never resized below this many entries by the budget
+	minManagedCacheSize = 64
+)
+
+// CacheStats is a cache of CacheManager as listed by admin system/caches.
+type CacheStats struct {
+	Name string
+	KeyedCacheStats
+	// the capacity the cache is made with, its share of the budget
+	Weight int
+	// the capacity set by Resize, 0 if the budget decides
+	Pinned      int
+	MemoryBytes int64
+}
+
+type managedCache struct {
+	cache  *KeyedCache
+	weight int
+	pinned int
+}
+
+// CacheManager sizes the KeyedCaches of the dialers from a single memory
+// budget, each gets a share in proportion to the capacity it is made with.
+// Without a budget the caches have the capacities they are made with.
+type CacheManager struct {
+	Metrics *Metrics
+
+	mu     sync.Mutex
+	budget int64
+	caches map[string]*managedCache
+}
+
+var DefaultCacheManager = NewCacheManager()
+
+func NewCacheManager() *CacheManager {
+	return &CacheManager{
+		Metrics: DefaultMetrics,
+		caches:  make(map[string]*managedCache),
+	}
+}
+
+// ManageCaches sizes the caches of DefaultCacheManager to budget bytes, 0
+// only reports, and exports their counters to Metrics every 10 seconds.
+func ManageCaches(budget int64) error {
+	if err := DefaultCacheManager.SetBudget(budget); err != nil {
+		return err
+	}
+	DefaultScheduler.Every("caches", cacheExportInterval, false, DefaultCacheManager.Export)
+	return nil
+}
+
+// Register adds c under name, a cache of the same name is replaced, e.g.
+// when a filter reloads, and its pinned capacity is kept.
+func (m *CacheManager) Register(name string, c *KeyedCache) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mc := &managedCache{
+		cache:  c,
+		weight: c.Capacity(),
+	}
+	if old, ok := m.caches[name]; ok {
+		mc.pinned = old.pinned
+	}
+	m.caches[name] = mc
+
+	m.allocate()
+}
+
+// Budget returns the bytes the caches are sized to, 0 if there is none.
+func (m *CacheManager) Budget() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.budget
+}
+
+// SetBudget sizes the caches to bytes, 0 gives them back their own sizes.
+func (m *CacheManager) SetBudget(bytes int64) error {
+	if bytes < 0 {
+		return fmt.Errorf("cache budget %d is negative", bytes)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.budget = bytes
+	m.allocate()
+
+	return nil
+}
+
+// Resize pins the capacity of cache name, the budget left is shared by the
+// others. capacity 0 hands the cache back to the budget.
+func (m *CacheManager) Resize(name string, capacity int) error {
+	if capacity < 0 {
+		return fmt.Errorf("capacity %d is negative", capacity)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mc, ok := m.caches[name]
+	if !ok {
+		return fmt.Errorf("cache %#v not exists", name)
+	}
+
+	mc.pinned = capacity
+	m.allocate()
+
+	return nil
+}
+
+// allocate resizes the caches to their shares of the budget, m.mu is held.
+func (m *CacheManager) allocate() {
+	budget := m.budget
+	weights := 0
+	for _, mc := range m.caches {
+		if mc.pinned > 0 {
+			mc.cache.Resize(mc.pinned)
+			budget -= int64(mc.pinned) * keyedCacheEntrySize
+		} else {
+			weights += mc.weight
+		}
+	}
+
+	if weights == 0 {
+		return
+	}
+
+	for name, mc := range m.caches {
+		if mc.pinned > 0 {
+			continue
+		}
+		capacity := mc.weight
+		if m.budget > 0 {
+			capacity = int(budget / keyedCacheEntrySize * int64(mc.weight) / int64(weights))
+		}
+		if capacity < minManagedCacheSize && m.budget > 0 {
+			capacity = minManagedCacheSize
+		}
+		if capacity != mc.cache.Capacity() {
+			glog.V(2).Infof("CACHES: resize %#v to %d entries", name, capacity)
+			mc.cache.Resize(capacity)
+		}
+	}
+}
+
+// Stats returns the caches sorted by name.
+func (m *CacheManager) Stats() []CacheStats {
+	m.mu.Lock()
+	stats := make([]CacheStats, 0, len(m.caches))
+	for name, mc := range m.caches {
+		stats = append(stats, CacheStats{
+			Name:            name,
+			KeyedCacheStats: mc.cache.Stats(),
+			Weight:          mc.weight,
+			Pinned:          mc.pinned,
+		})
+	}
+	m.mu.Unlock()
+
+	for i := range stats {
+		stats[i].MemoryBytes = int64(stats[i].Len) * keyedCacheEntrySize
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+
+	return stats
+}
+
+// Export sets the counters and the sizes of the caches in Metrics.
+func (m *CacheManager) Export() error {
+	if m.Metrics == nil {
+		return nil
+	}
+
+	for _, s := range m.Stats() {
+		m.Metrics.SetCounter("goproxy_cache_hits_total", float64(s.Hits), "cache", s.Name)
+		m.Metrics.SetCounter("goproxy_cache_misses_total", float64(s.Misses), "cache", s.Name)
+		m.Metrics.SetCounter("goproxy_cache_evictions_total", float64(s.Evictions), "cache", s.Name)
+		m.Metrics.SetGauge("goproxy_cache_entries", float64(s.Len), "cache", s.Name)
+		m.Metrics.SetGauge("goproxy_cache_capacity", float64(s.Capacity), "cache", s.Name)
+	}
+	m.Metrics.SetGauge("goproxy_cache_budget_bytes", float64(m.Budget()))
+
+	return nil
+}
@@ -0,0 +1,33 @@
+package helpers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"time"
+)
+
+// LoadClientCertificate loads the client certificate of mutual TLS, keyFile
+// may be empty if certFile holds the private key too. An expired certificate
+// is an error, the server would refuse it anyway.
+func LoadClientCertificate(certFile, keyFile string) (tls.Certificate, error) {
+	if keyFile == "" {
+		keyFile = certFile
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("load client certificate %#v: %v", certFile, err)
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("parse client certificate %#v: %v", certFile, err)
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return tls.Certificate{}, fmt.Errorf("client certificate %#v expired at %s", certFile, leaf.NotAfter)
+	}
+	cert.Leaf = leaf
+
+	return cert, nil
+}
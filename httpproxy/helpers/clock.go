@@ -0,0 +1,99 @@
+package helpers
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/phuslu/glog"
+)
+
+// clockSkew is the offset in nanoseconds added to the local clock by Now, it
+// stays zero unless a ClockChecker compensates.
+var clockSkew int64
+
+// Now returns the local time corrected by the measured skew, pass it as
+// tls.Config.Time or x509.VerifyOptions.CurrentTime.
+func Now() time.Time {
+	return time.Now().Add(time.Duration(atomic.LoadInt64(&clockSkew)))
+}
+
+// ClockChecker compares the local clock with the Date header of URLs, which
+// should be plain http servers reachable without the proxy.
+type ClockChecker struct {
+	URLs       []string
+	MaxSkew    time.Duration
+	Compensate bool
+	Transport  http.RoundTripper
+}
+
+// Check returns the median of remote time minus local time. The Date header
+// only has a resolution of seconds.
+func (c *ClockChecker) Check() (time.Duration, error) {
+	client := &http.Client{
+		Transport: c.Transport,
+		Timeout:   10 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	skews := make([]time.Duration, 0, len(c.URLs))
+	for _, url := range c.URLs {
+		start := time.Now()
+		resp, err := client.Head(url)
+		if err != nil {
+			glog.V(2).Infof("CLOCK: HEAD %#v error: %v", url, err)
+			continue
+		}
+		resp.Body.Close()
+		end := time.Now()
+
+		date, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			glog.V(2).Infof("CLOCK: %#v returns bad Date %#v", url, resp.Header.Get("Date"))
+			continue
+		}
+
+		skews = append(skews, date.Sub(start.Add(end.Sub(start)/2)))
+	}
+
+	if len(skews) == 0 {
+		return 0, fmt.Errorf("no Date header from %v", c.URLs)
+	}
+
+	sort.Slice(skews, func(i, j int) bool { return skews[i] < skews[j] })
+	return skews[len(skews)/2], nil
+}
+
+// Update checks the clock, warns if it is off by more than MaxSkew and sets
+// the skew used by Now if Compensate is true.
+func (c *ClockChecker) Update() error {
+	skew, err := c.Check()
+	if err != nil {
+		return err
+	}
+
+	if -c.MaxSkew <= skew && skew <= c.MaxSkew {
+		skew = 0
+	}
+
+	if c.Compensate {
+		atomic.StoreInt64(&clockSkew, int64(skew))
+	}
+
+	if skew != 0 {
+		behind := "behind"
+		if skew < 0 {
+			behind, skew = "ahead", -skew
+		}
+		glog.Errorf("CLOCK: ************************************************************")
+		glog.Errorf("CLOCK: system clock is %s %s, TLS handshakes may fail,", skew.Truncate(time.Second), behind)
+		glog.Errorf("CLOCK: please synchronize the time of this computer.")
+		glog.Errorf("CLOCK: ************************************************************")
+	}
+
+	return nil
+}
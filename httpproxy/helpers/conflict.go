@@ -0,0 +1,91 @@
+package helpers
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+const (
+	ConflictPort    string = "port"
+	ConflictAdapter string = "adapter"
+	ConflictProcess string = "process"
+	ConflictProxy   string = "proxy"
+)
+
+// Conflict is a piece of local software or configuration which commonly
+// breaks goproxy, e.g. another proxy holding the listen port or a VPN adapter
+// hijacking the default route.
+type Conflict struct {
+	Kind       string
+	Name       string
+	Detail     string
+	Suggestion string
+}
+
+func (c Conflict) String() string {
+	s := fmt.Sprintf("%s %s: %s", c.Kind, c.Name, c.Detail)
+	if c.Suggestion != "" {
+		s += " (" + c.Suggestion + ")"
+	}
+	return s
+}
+
+// DetectConflicts checks that addrs are still free to listen on and probes
+// the platform for conflicting adapters, processes and proxy settings.
+func DetectConflicts(addrs []string) []Conflict {
+	conflicts := make([]Conflict, 0)
+
+	for _, addr := range addrs {
+		if addr == "" || !IsTCPAddress(addr) {
+			continue
+		}
+		if c, ok := CheckPortConflict(addr); ok {
+			conflicts = append(conflicts, c)
+		}
+	}
+
+	return append(conflicts, DetectPlatformConflicts(addrs)...)
+}
+
+func CheckPortConflict(addr string) (Conflict, bool) {
+	ln, err := net.Listen("tcp", addr)
+	if err == nil {
+		ln.Close()
+		return Conflict{}, false
+	}
+
+	c := Conflict{
+		Kind:   ConflictPort,
+		Name:   addr,
+		Detail: err.Error(),
+	}
+	if addr1, ok := SuggestPort(addr); ok {
+		c.Suggestion = "try " + addr1
+	}
+
+	return c, true
+}
+
+// SuggestPort returns the first free port after the one in addr.
+func SuggestPort(addr string) (string, bool) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", false
+	}
+
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return "", false
+	}
+
+	for i := n + 1; i < n+100 && i < 65536; i++ {
+		addr1 := net.JoinHostPort(host, strconv.Itoa(i))
+		if ln, err := net.Listen("tcp", addr1); err == nil {
+			ln.Close()
+			return addr1, true
+		}
+	}
+
+	return "", false
+}
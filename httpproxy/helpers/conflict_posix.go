@@ -0,0 +1,7 @@
+// +build !windows
+
+package helpers
+
+func DetectPlatformConflicts(addrs []string) []Conflict {
+	return nil
+}
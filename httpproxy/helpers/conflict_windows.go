@@ -0,0 +1,158 @@
+// +build windows
+
+package helpers
+
+import (
+	"net"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var conflictAdapterNames = []string{"tap", "tun", "wintun", "wireguard", "openvpn", "vpn", "clash", "v2ray"}
+
+// conflictProcesses lists software which installs WFP callouts, LSPs or a
+// system wide proxy and is known to fight with goproxy.
+var conflictProcesses = map[string]string{
+	"proxifier.exe":     "Proxifier redirects connections through WFP",
+	"nlsvc.exe":         "NetLimiter filters connections through WFP",
+	"glasswire.exe":     "GlassWire firewall may block outgoing connections",
+	"adguardsvc.exe":    "AdGuard intercepts https through a WFP driver",
+	"fiddler.exe":       "Fiddler overrides the system proxy",
+	"charles.exe":       "Charles overrides the system proxy",
+	"clash-win64.exe":   "Clash may hold the proxy port or a tun adapter",
+	"clash.exe":         "Clash may hold the proxy port or a tun adapter",
+	"v2rayn.exe":        "v2rayN overrides the system proxy",
+	"shadowsocks.exe":   "Shadowsocks overrides the system proxy",
+	"psiphon3.exe":      "Psiphon overrides the system proxy",
+	"lantern.exe":       "Lantern overrides the system proxy",
+	"astrill.exe":       "Astrill installs a tap adapter and WFP filters",
+	"openvpn-gui.exe":   "OpenVPN may route traffic around goproxy",
+	"wireguard.exe":     "WireGuard may route traffic around goproxy",
+	"xx-net.exe":        "XX-Net may hold the proxy port",
+	"goagent.exe":       "GoAgent may hold the proxy port",
+	"freegate.exe":      "Freegate overrides the system proxy",
+	"ultrasurf.exe":     "Ultrasurf overrides the system proxy",
+	"u1802.exe":         "Ultrasurf overrides the system proxy",
+	"netch.exe":         "Netch redirects processes through a WFP driver",
+	"sstap.exe":         "SSTap installs a tap adapter",
+	"privoxy.exe":       "Privoxy may hold the proxy port",
+	"ccproxy.exe":       "CCProxy may hold the proxy port",
+	"hotspotshield.exe": "Hotspot Shield installs a tap adapter",
+}
+
+// DetectPlatformConflicts looks for VPN adapters, known conflicting processes
+// and a WinINet proxy which does not point to any of addrs.
+func DetectPlatformConflicts(addrs []string) []Conflict {
+	conflicts := detectAdapters()
+	conflicts = append(conflicts, detectProcesses()...)
+	if c, ok := detectSystemProxy(addrs); ok {
+		conflicts = append(conflicts, c)
+	}
+	return conflicts
+}
+
+// detectAdapters reports up interfaces which look like VPN virtual adapters,
+// TAP-Windows assigns MACs starting with 00:ff.
+func detectAdapters() []Conflict {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+
+	conflicts := make([]Conflict, 0)
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		name := strings.ToLower(iface.Name)
+		matched := strings.HasPrefix(iface.HardwareAddr.String(), "00:ff:")
+		for _, s := range conflictAdapterNames {
+			if strings.Contains(name, s) {
+				matched = true
+				break
+			}
+		}
+		if matched {
+			conflicts = append(conflicts, Conflict{
+				Kind:       ConflictAdapter,
+				Name:       iface.Name,
+				Detail:     "virtual network adapter is up, it may route traffic around goproxy",
+				Suggestion: "disconnect the VPN or exclude goproxy from it",
+			})
+		}
+	}
+
+	return conflicts
+}
+
+func detectProcesses() []Conflict {
+	snapshot, err := syscall.CreateToolhelp32Snapshot(syscall.TH32CS_SNAPPROCESS, 0)
+	if err != nil {
+		return nil
+	}
+	defer syscall.CloseHandle(snapshot)
+
+	conflicts := make([]Conflict, 0)
+	seen := make(map[string]struct{})
+
+	var entry syscall.ProcessEntry32
+	entry.Size = uint32(unsafe.Sizeof(entry))
+	for err = syscall.Process32First(snapshot, &entry); err == nil; err = syscall.Process32Next(snapshot, &entry) {
+		name := strings.ToLower(syscall.UTF16ToString(entry.ExeFile[:]))
+		detail, ok := conflictProcesses[name]
+		if !ok {
+			continue
+		}
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		conflicts = append(conflicts, Conflict{
+			Kind:       ConflictProcess,
+			Name:       name,
+			Detail:     detail,
+			Suggestion: "quit it or move goproxy to another port",
+		})
+	}
+
+	return conflicts
+}
+
+// detectSystemProxy reports an enabled WinINet proxy which does not point at
+// any of addrs.
+func detectSystemProxy(addrs []string) (Conflict, bool) {
+	var h syscall.Handle
+	path := `Software\Microsoft\Windows\CurrentVersion\Internet Settings`
+	if err := syscall.RegOpenKeyEx(syscall.HKEY_CURRENT_USER, syscall.StringToUTF16Ptr(path), 0, syscall.KEY_READ, &h); err != nil {
+		return Conflict{}, false
+	}
+	defer syscall.RegCloseKey(h)
+
+	var enabled uint32
+	var typ uint32
+	n := uint32(unsafe.Sizeof(enabled))
+	if err := syscall.RegQueryValueEx(h, syscall.StringToUTF16Ptr("ProxyEnable"), nil, &typ, (*byte)(unsafe.Pointer(&enabled)), &n); err != nil || enabled == 0 {
+		return Conflict{}, false
+	}
+
+	buf := make([]uint16, 1024)
+	n = uint32(len(buf) * 2)
+	if err := syscall.RegQueryValueEx(h, syscall.StringToUTF16Ptr("ProxyServer"), nil, &typ, (*byte)(unsafe.Pointer(&buf[0])), &n); err != nil {
+		return Conflict{}, false
+	}
+	server := syscall.UTF16ToString(buf)
+
+	for _, addr := range addrs {
+		if _, port, err := net.SplitHostPort(addr); err == nil && strings.HasSuffix(server, ":"+port) {
+			return Conflict{}, false
+		}
+	}
+
+	return Conflict{
+		Kind:       ConflictProxy,
+		Name:       "WinINet",
+		Detail:     "system proxy is set to " + server,
+		Suggestion: "point it to goproxy or disable it",
+	}, true
+}
@@ -0,0 +1,206 @@
+package helpers
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// DeadlinePolicy is the timeouts of the requests to a host pattern, in
+// seconds, 0 keeps the one of the filter.
+type DeadlinePolicy struct {
+	// dial of a tcp connection
+	ConnectTimeout int
+	// TLS handshake of the dials which do it themselves
+	TLSHandshakeTimeout int
+	// from the request sent to the response header received
+	ResponseHeaderTimeout int
+	// between two reads of the response body
+	IdleTimeout int
+}
+
+// merge returns p with the zero timeouts taken from q.
+func (p DeadlinePolicy) merge(q DeadlinePolicy) DeadlinePolicy {
+	if p.ConnectTimeout == 0 {
+		p.ConnectTimeout = q.ConnectTimeout
+	}
+	if p.TLSHandshakeTimeout == 0 {
+		p.TLSHandshakeTimeout = q.TLSHandshakeTimeout
+	}
+	if p.ResponseHeaderTimeout == 0 {
+		p.ResponseHeaderTimeout = q.ResponseHeaderTimeout
+	}
+	if p.IdleTimeout == 0 {
+		p.IdleTimeout = q.IdleTimeout
+	}
+	return p
+}
+
+// DeadlinePolicies maps host patterns to DeadlinePolicy, on top of Default,
+// so that e.g. video hosts get long deadlines while APIs fail fast.
+type DeadlinePolicies struct {
+	Default DeadlinePolicy
+	hosts   *HostMatcher
+}
+
+// NewDeadlinePolicies returns the policies of host patterns over def.
+func NewDeadlinePolicies(def DeadlinePolicy, policies map[string]DeadlinePolicy) (*DeadlinePolicies, error) {
+	values := make(map[string]interface{}, len(policies))
+	for host, p := range policies {
+		if p.ConnectTimeout < 0 || p.TLSHandshakeTimeout < 0 || p.ResponseHeaderTimeout < 0 || p.IdleTimeout < 0 {
+			return nil, fmt.Errorf("invalid deadline policy %#v of %#v", p, host)
+		}
+		p := p.merge(def)
+		values[host] = &p
+	}
+
+	return &DeadlinePolicies{
+		Default: def,
+		hosts:   NewHostMatcherWithValue(values),
+	}, nil
+}
+
+// Lookup returns the policy of host, which is Default if no pattern matches.
+func (ps *DeadlinePolicies) Lookup(host string) (DeadlinePolicy, bool) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if v, ok := ps.hosts.Lookup(host); ok {
+		return *v.(*DeadlinePolicy), true
+	}
+	return ps.Default, false
+}
+
+type deadlinePolicyKey struct{}
+
+// WithDeadlinePolicy returns ctx carrying p to the dialers, which take the
+// ConnectTimeout and TLSHandshakeTimeout of it over their own.
+func WithDeadlinePolicy(ctx context.Context, p DeadlinePolicy) context.Context {
+	return context.WithValue(ctx, deadlinePolicyKey{}, p)
+}
+
+func DeadlinePolicyFromContext(ctx context.Context) (DeadlinePolicy, bool) {
+	p, ok := ctx.Value(deadlinePolicyKey{}).(DeadlinePolicy)
+	return p, ok
+}
+
+// deadlineError is the error of a request whose deadline is exceeded, it is
+// a timeout for the retry logic of the filters.
+type deadlineError struct {
+	what    string
+	timeout time.Duration
+}
+
+func (e *deadlineError) Error() string {
+	return fmt.Sprintf("%s timeout after %s", e.what, e.timeout)
+}
+
+func (e *deadlineError) Timeout() bool   { return true }
+func (e *deadlineError) Temporary() bool { return true }
+
+// RoundTripWithDeadline sends req through rt under the ResponseHeaderTimeout
+// and IdleTimeout of p, a request which exceeds them is cancelled. p is put
+// into the context of req for the dialers.
+func RoundTripWithDeadline(rt http.RoundTripper, req *http.Request, p DeadlinePolicy) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(WithDeadlinePolicy(req.Context(), p))
+	req = req.WithContext(ctx)
+
+	var timer *time.Timer
+	if p.ResponseHeaderTimeout > 0 {
+		timer = time.AfterFunc(time.Duration(p.ResponseHeaderTimeout)*time.Second, cancel)
+	}
+
+	resp, err := rt.RoundTrip(req)
+
+	// the timer has fired if it cannot be stopped, then the request is
+	// cancelled even if the response has just made it
+	if timer != nil && !timer.Stop() {
+		cancel()
+		if err == nil {
+			resp.Body.Close()
+		}
+		return nil, &deadlineError{"response header", time.Duration(p.ResponseHeaderTimeout) * time.Second}
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	if p.IdleTimeout > 0 && resp.Body != nil && resp.Body != http.NoBody {
+		idle := time.Duration(p.IdleTimeout) * time.Second
+		resp.Body = &idleTimeoutBody{
+			ReadCloser: resp.Body,
+			timeout:    idle,
+			timer:      time.AfterFunc(idle, cancel),
+			cancel:     cancel,
+		}
+	} else if resp.Body != nil {
+		resp.Body = &cancelBody{resp.Body, cancel}
+	} else {
+		cancel()
+	}
+
+	return resp, nil
+}
+
+// DeadlineTransport is a http.RoundTripper which sends each request under
+// the policy of its host.
+type DeadlineTransport struct {
+	http.RoundTripper
+	Policies *DeadlinePolicies
+}
+
+func (t *DeadlineTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.Policies == nil {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	p, _ := t.Policies.Lookup(req.Host)
+	return RoundTripWithDeadline(t.RoundTripper, req, p)
+}
+
+// idleTimeoutBody cancels the request when no read completes for timeout.
+type idleTimeoutBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   *time.Timer
+	cancel  context.CancelFunc
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.timer.Reset(b.timeout)
+	}
+	if err != nil && err != io.EOF && !b.timer.Stop() {
+		return n, &deadlineError{"response body idle", b.timeout}
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) unwrap() io.ReadCloser {
+	return b.ReadCloser
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	return b.ReadCloser.Close()
+}
+
+// cancelBody releases the context of the request once its body is closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) unwrap() io.ReadCloser {
+	return b.ReadCloser
+}
+
+func (b *cancelBody) Close() error {
+	b.cancel()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,172 @@
+package helpers
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"time"
+)
+
+const (
+	DefaultDecoyServer string = "nginx"
+	DefaultDecoyIndex  string = `<!DOCTYPE html>
+<html>
+<head>
+<title>Welcome to nginx!</title>
+<style>
+    body {
+        width: 35em;
+        margin: 0 auto;
+        font-family: Tahoma, Verdana, Arial, sans-serif;
+    }
+</style>
+</head>
+<body>
+<h1>Welcome to nginx!</h1>
+<p>If you see this page, the nginx web server is successfully installed and
+working. Further configuration is required.</p>
+
+<p>For online documentation and support please refer to
+<a href="http://nginx.org/">nginx.org</a>.<br/>
+Commercial support is available at
+<a href="http://nginx.com/">nginx.com</a>.</p>
+
+<p><em>Thank you for using nginx.</em></p>
+</body>
+</html>
+`
+)
+
+// DecoyHandler answers like a stock nginx site, so that active probes of a
+// fetchserver only ever see an ordinary web server. Files are served from
+// Root if set, otherwise Index is the only page.
+type DecoyHandler struct {
+	Server   string
+	Root     string
+	Index    []byte
+	Modified time.Time
+}
+
+func NewDecoyHandler(root string) *DecoyHandler {
+	return &DecoyHandler{
+		Server:   DefaultDecoyServer,
+		Root:     root,
+		Index:    []byte(DefaultDecoyIndex),
+		Modified: time.Now().Add(-30 * 24 * time.Hour).Truncate(time.Second),
+	}
+}
+
+func (h *DecoyHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	header := rw.Header()
+	for key := range header {
+		delete(header, key)
+	}
+	header.Set("Server", h.Server)
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		break
+	case http.MethodPost, http.MethodPut, http.MethodDelete, http.MethodOptions, http.MethodPatch:
+		h.Error(rw, http.StatusMethodNotAllowed)
+		return
+	default:
+		h.Error(rw, http.StatusBadRequest)
+		return
+	}
+
+	name := path.Clean("/" + req.URL.Path)
+	if name == "/" || name == "/index.html" {
+		if h.Root == "" {
+			header.Set("Content-Type", "text/html")
+			header.Set("ETag", fmt.Sprintf("\"%x-%x\"", h.Modified.Unix(), len(h.Index)))
+			http.ServeContent(rw, req, "index.html", h.Modified, bytes.NewReader(h.Index))
+			return
+		}
+		name = "/index.html"
+	}
+
+	if h.Root == "" {
+		h.Error(rw, http.StatusNotFound)
+		return
+	}
+
+	f, err := http.Dir(h.Root).Open(name)
+	if err != nil {
+		if os.IsPermission(err) {
+			h.Error(rw, http.StatusForbidden)
+		} else {
+			h.Error(rw, http.StatusNotFound)
+		}
+		return
+	}
+	defer f.Close()
+
+	fi, err := f.Stat()
+	if err != nil || fi.IsDir() {
+		h.Error(rw, http.StatusForbidden)
+		return
+	}
+
+	header.Set("ETag", fmt.Sprintf("\"%x-%x\"", fi.ModTime().Unix(), fi.Size()))
+	http.ServeContent(rw, req, fi.Name(), fi.ModTime(), f)
+}
+
+// Error writes the error page of nginx for code.
+func (h *DecoyHandler) Error(rw http.ResponseWriter, code int) {
+	status := strconv.Itoa(code) + " " + http.StatusText(code)
+	if code == http.StatusMethodNotAllowed {
+		status = "405 Not Allowed"
+	}
+
+	body := h.errorPage(status, status, "")
+
+	header := rw.Header()
+	header.Set("Server", h.Server)
+	header.Set("Content-Type", "text/html")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	if code == http.StatusBadRequest {
+		header.Set("Connection", "close")
+	}
+	rw.WriteHeader(code)
+	rw.Write([]byte(body))
+}
+
+// ErrorResponse is the whole response of nginx for code, after which it
+// closes the connection, for the malformed requests which are answered on the
+// connection itself. Some 400 pages of nginx are titled by their reason, e.g.
+// "Request Header Or Cookie Too Large".
+func (h *DecoyHandler) ErrorResponse(code int, reason string) []byte {
+	status := strconv.Itoa(code) + " " + http.StatusText(code)
+	title := status
+	if reason != "" {
+		title = strconv.Itoa(code) + " " + reason
+	}
+
+	body := h.errorPage(title, status, reason)
+
+	return []byte(fmt.Sprintf("HTTP/1.1 %s\r\nServer: %s\r\nDate: %s\r\nContent-Type: text/html\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s",
+		status, h.Server, time.Now().UTC().Format(http.TimeFormat), len(body), body))
+}
+
+func (h *DecoyHandler) errorPage(title, status, reason string) string {
+	if reason != "" {
+		reason = "<center>" + reason + "</center>\r\n"
+	}
+	return fmt.Sprintf("<html>\r\n<head><title>%s</title></head>\r\n<body>\r\n<center><h1>%s</h1></center>\r\n%s<hr><center>%s</center>\r\n</body>\r\n</html>\r\n", title, status, reason, h.Server)
+}
+
+// NewCamouflageHandler passes requests accepted by authorized to h and hands
+// everything else to decoy, so unauthenticated or malformed requests never
+// reveal proxy behavior.
+func NewCamouflageHandler(authorized func(*http.Request) bool, h http.Handler, decoy http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if authorized(req) {
+			h.ServeHTTP(rw, req)
+		} else {
+			decoy.ServeHTTP(rw, req)
+		}
+	})
+}
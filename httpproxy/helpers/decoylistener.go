@@ -0,0 +1,183 @@
+package helpers
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultDecoyHandshakeTimeout time.Duration = 10 * time.Second
+)
+
+// the headers of the responses which net/http writes on the connection itself
+// for the requests it cannot parse, e.g. "HTTP/1.1 400 Bad Request" and
+// "HTTP/1.1 431 Request Header Fields Too Large"
+var goErrorHeaders = []byte("\r\nContent-Type: text/plain; charset=utf-8\r\nConnection: close\r\n\r\n")
+
+// DecoyListener accepts the connections of Listener for a http.Server, so
+// that the malformed requests are answered by the error pages of nginx of
+// Decoy instead of the plain text ones of net/http. With Config the TLS
+// handshakes are done here too, plain http sent to it gets the page of nginx
+// for it. The server needs the ConnContext and the Handler of the listener.
+type DecoyListener struct {
+	net.Listener
+	Config           *tls.Config
+	Decoy            *DecoyHandler
+	HandshakeTimeout time.Duration
+
+	lane      chan decoyAccept
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type decoyAccept struct {
+	c net.Conn
+	e error
+}
+
+func NewDecoyListener(ln net.Listener, config *tls.Config, decoy *DecoyHandler) *DecoyListener {
+	l := &DecoyListener{
+		Listener:         ln,
+		Config:           config,
+		Decoy:            decoy,
+		HandshakeTimeout: DefaultDecoyHandshakeTimeout,
+		lane:             make(chan decoyAccept),
+		done:             make(chan struct{}),
+	}
+	if config != nil {
+		go l.serve()
+	}
+	return l
+}
+
+func (l *DecoyListener) Accept() (net.Conn, error) {
+	if l.Config == nil {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		return &decoyConn{Conn: conn, decoy: l.Decoy}, nil
+	}
+
+	select {
+	case r := <-l.lane:
+		return r.c, r.e
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *DecoyListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return l.Listener.Close()
+}
+
+// serve accepts the connections and hands them to Accept once they have done
+// the handshake, so a slow client does not hold the others up.
+func (l *DecoyListener) serve() {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.lane <- decoyAccept{nil, err}:
+			case <-l.done:
+				return
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			return
+		}
+		go l.handshake(conn)
+	}
+}
+
+func (l *DecoyListener) handshake(conn net.Conn) {
+	tlsConn := tls.Server(conn, l.Config)
+	conn.SetDeadline(time.Now().Add(l.HandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		var re tls.RecordHeaderError
+		if errors.As(err, &re) && re.Conn != nil && looksLikeHTTP(re.RecordHeader[:]) {
+			re.Conn.Write(l.Decoy.ErrorResponse(http.StatusBadRequest, "The plain HTTP request was sent to HTTPS port"))
+		}
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	// http2 frames its own errors, only http/1.1 is written in plain text
+	var c net.Conn = tlsConn
+	if state := tlsConn.ConnectionState(); state.NegotiatedProtocol != "h2" {
+		c = &decoyConn{Conn: tlsConn, decoy: l.Decoy, state: &state}
+	}
+
+	select {
+	case l.lane <- decoyAccept{c, nil}:
+	case <-l.done:
+		c.Close()
+	}
+}
+
+func looksLikeHTTP(header []byte) bool {
+	switch string(header) {
+	case "GET /", "HEAD ", "POST ", "PUT /", "OPTIO":
+		return true
+	}
+	return false
+}
+
+type decoyStateKey struct{}
+
+// ConnContext is the ConnContext of the http.Server, it keeps the TLS state
+// of the connections which net/http serves as plain ones.
+func (l *DecoyListener) ConnContext(ctx context.Context, c net.Conn) context.Context {
+	if dc, ok := c.(*decoyConn); ok && dc.state != nil {
+		return context.WithValue(ctx, decoyStateKey{}, dc.state)
+	}
+	return ctx
+}
+
+// Handler fills in the req.TLS of the requests over the TLS connections of l
+// and hands them to h.
+func (l *DecoyListener) Handler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.TLS == nil {
+			if state, ok := req.Context().Value(decoyStateKey{}).(*tls.ConnectionState); ok {
+				req.TLS = state
+			}
+		}
+		h.ServeHTTP(rw, req)
+	})
+}
+
+// decoyConn turns the responses of net/http to malformed requests into the
+// ones of nginx, which always answers them 400.
+type decoyConn struct {
+	net.Conn
+	decoy *DecoyHandler
+	state *tls.ConnectionState
+}
+
+func (c *decoyConn) Write(b []byte) (int, error) {
+	i := bytes.Index(b, goErrorHeaders)
+	if i < 0 || !bytes.HasPrefix(b, []byte("HTTP/1.1 ")) || bytes.IndexByte(b[:i], '\n') >= 0 {
+		return c.Conn.Write(b)
+	}
+
+	reason := ""
+	if bytes.HasPrefix(b[9:], []byte("431 ")) {
+		reason = "Request Header Or Cookie Too Large"
+	}
+	if _, err := c.Conn.Write(c.decoy.ErrorResponse(http.StatusBadRequest, reason)); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,258 @@
+package helpers
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/phuslu/glog"
+)
+
+const (
+	// lists larger than this are refused, they are kept in memory
+	maxDownloadSize int64 = 64 * 1024 * 1024
+)
+
+// Downloader fetches a rule or ip list on schedule with as little traffic as
+// it can, for metered connections. The ETag and Last-Modified of the last
+// download are sent so an unchanged list is not transferred.
+//
+// With RangeDelta, only the bytes after the last download are requested, which
+// suits lists that are appended to. Since a range cannot tell whether the
+// head of the list is changed, RangeDelta needs ChecksumURL or SignatureURL and
+// the assembled list falls back to a full download if it does not match.
+//
+// With SignatureURL and PublicKey, the list must carry a valid ed25519
+// signature, so that it can be fetched from untrusted mirrors.
+type Downloader struct {
+	URL       string
+	Transport http.RoundTripper
+	// serves the hex SHA-256 of the list, e.g. in the format of sha256sum
+	ChecksumURL string
+	// serves the base64 or hex ed25519 signature of the list
+	SignatureURL string
+	PublicKey    ed25519.PublicKey
+	RangeDelta   bool
+	// seeds If-Modified-Since before the first download, e.g. with the
+	// modification time of a stored copy
+	LastModified string
+
+	etag string
+	data []byte
+}
+
+// Download returns the list and whether it is changed since the last call.
+// An unchanged list is returned with modified false and no error.
+func (d *Downloader) Download() (data []byte, modified bool, err error) {
+	if d.RangeDelta && (d.ChecksumURL != "" || d.SignatureURL != "") && len(d.data) > 0 && d.etag != "" {
+		data, modified, err = d.download(true)
+		if err == nil {
+			return data, modified, nil
+		}
+		glog.Warningf("DOWNLOAD %#v delta error: %v, fallback to full download", d.URL, err)
+	}
+	return d.download(false)
+}
+
+func (d *Downloader) download(delta bool) ([]byte, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, d.URL, nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if d.etag != "" {
+		req.Header.Set("If-None-Match", d.etag)
+	} else if d.LastModified != "" {
+		req.Header.Set("If-Modified-Since", d.LastModified)
+	}
+	if delta {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", len(d.data)))
+		// a partial body must not be transparently decompressed
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+
+	resp, err := d.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, false, err
+	}
+	defer resp.Body.Close()
+
+	var data []byte
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		glog.V(2).Infof("DOWNLOAD %#v not modified", d.URL)
+		return d.data, false, nil
+	case http.StatusOK:
+		if data, err = readAllLimited(resp.Body); err != nil {
+			return nil, false, err
+		}
+	case http.StatusPartialContent:
+		if !delta {
+			return nil, false, fmt.Errorf("DOWNLOAD: GET %#v return unrequested %s", d.URL, resp.Status)
+		}
+		start, size, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return nil, false, err
+		}
+		if start != int64(len(d.data)) {
+			return nil, false, fmt.Errorf("DOWNLOAD: GET %#v return range from %d, want %d", d.URL, start, len(d.data))
+		}
+		part, err := readAllLimited(resp.Body)
+		if err != nil {
+			return nil, false, err
+		}
+		data = append(append(make([]byte, 0, len(d.data)+len(part)), d.data...), part...)
+		if size >= 0 && int64(len(data)) != size {
+			return nil, false, fmt.Errorf("DOWNLOAD: GET %#v assembled %d bytes, want %d", d.URL, len(data), size)
+		}
+		glog.V(2).Infof("DOWNLOAD %#v appended %d bytes to %d bytes", d.URL, len(part), len(d.data))
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the list is shrunk, or not changed at all if it has no ETag
+		return nil, false, fmt.Errorf("DOWNLOAD: GET %#v return %s", d.URL, resp.Status)
+	default:
+		return nil, false, fmt.Errorf("DOWNLOAD: GET %#v return %s", d.URL, resp.Status)
+	}
+
+	if d.ChecksumURL != "" {
+		if err = d.verify(data); err != nil {
+			return nil, false, err
+		}
+	}
+
+	if d.SignatureURL != "" {
+		if err = d.verifySignature(data); err != nil {
+			return nil, false, err
+		}
+	}
+
+	d.etag = resp.Header.Get("ETag")
+	if lm := resp.Header.Get("Last-Modified"); lm != "" {
+		d.LastModified = lm
+	}
+	d.data = data
+
+	return data, true, nil
+}
+
+// verify compares the SHA-256 of data with the one served by ChecksumURL.
+func (d *Downloader) verify(data []byte) error {
+	b, err := d.get(d.ChecksumURL)
+	if err != nil {
+		return err
+	}
+
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return fmt.Errorf("DOWNLOAD: %#v has no checksum", d.ChecksumURL)
+	}
+
+	sum := sha256.Sum256(data)
+	if want := strings.ToLower(fields[0]); hex.EncodeToString(sum[:]) != want {
+		return fmt.Errorf("DOWNLOAD: %#v checksum mismatch, got %x, want %s", d.URL, sum, want)
+	}
+
+	return nil
+}
+
+// verifySignature checks the signature served by SignatureURL against data.
+func (d *Downloader) verifySignature(data []byte) error {
+	if len(d.PublicKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("DOWNLOAD: invalid public key of %#v", d.SignatureURL)
+	}
+
+	b, err := d.get(d.SignatureURL)
+	if err != nil {
+		return err
+	}
+
+	s := strings.TrimSpace(string(b))
+	sig, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		if sig, err = hex.DecodeString(s); err != nil || len(sig) != ed25519.SignatureSize {
+			return fmt.Errorf("DOWNLOAD: %#v has no valid signature", d.SignatureURL)
+		}
+	}
+
+	if !ed25519.Verify(d.PublicKey, data, sig) {
+		return fmt.Errorf("DOWNLOAD: %#v signature mismatch", d.URL)
+	}
+
+	return nil
+}
+
+// get reads the small file at rawurl, e.g. a checksum or a signature.
+func (d *Downloader) get(rawurl string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := d.Transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DOWNLOAD: GET %#v return %s", rawurl, resp.Status)
+	}
+
+	return ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+}
+
+// ParsePublicKey parses a base64 or hex ed25519 public key.
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		if key, err = hex.DecodeString(s); err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid ed25519 public key %#v", s)
+		}
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+func readAllLimited(r io.Reader) ([]byte, error) {
+	var b bytes.Buffer
+	n, err := b.ReadFrom(io.LimitReader(r, maxDownloadSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > maxDownloadSize {
+		return nil, fmt.Errorf("DOWNLOAD: larger than %d bytes", maxDownloadSize)
+	}
+	return b.Bytes(), nil
+}
+
+// parseContentRange parses "bytes start-end/size", size is -1 if it is "*".
+func parseContentRange(s string) (start, size int64, err error) {
+	if !strings.HasPrefix(s, "bytes ") {
+		return 0, 0, fmt.Errorf("invalid Content-Range %#v", s)
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(s, "bytes "), "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid Content-Range %#v", s)
+	}
+
+	if start, err = strconv.ParseInt(strings.SplitN(parts[0], "-", 2)[0], 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range %#v", s)
+	}
+
+	if parts[1] == "*" {
+		return start, -1, nil
+	}
+
+	if size, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return 0, 0, fmt.Errorf("invalid Content-Range %#v", s)
+	}
+
+	return start, size, nil
+}
@@ -0,0 +1,269 @@
+package helpers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The headers of a response of BlockResponse, the handler renders it as an
+// error page and strips them before the response goes to the client.
+const (
+	BlockedByHeader   = "X-Goproxy-Blocked-By"
+	BlockReasonHeader = "X-Goproxy-Block-Reason"
+)
+
+// ErrorPage is what the client is told about a request which failed or was
+// blocked, it is the data of the html template and the json of API clients.
+type ErrorPage struct {
+	Status int    `json:"status"`
+	Kind   string `json:"kind"`
+	Reason string `json:"reason"`
+	// the filter which failed or blocked the request
+	Filter string `json:"filter,omitempty"`
+	// the alias of the dial and the addrs which were raced
+	Alias     string    `json:"alias,omitempty"`
+	Addrs     []string  `json:"addrs,omitempty"`
+	URL       string    `json:"url,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+	Time      time.Time `json:"time"`
+	Brand     string    `json:"-"`
+}
+
+// NewErrorPage describes err, the alias and addrs are those of the innermost
+// Error which has them.
+func NewErrorPage(status int, err error) *ErrorPage {
+	page := &ErrorPage{
+		Status: status,
+		Kind:   errorKindName(err),
+		Reason: err.Error(),
+		Time:   time.Now(),
+	}
+
+	for err != nil {
+		e, ok := err.(*Error)
+		if !ok {
+			break
+		}
+		if e.Alias != "" {
+			page.Alias = e.Alias
+		}
+		if len(e.Addrs) > 0 {
+			page.Addrs = e.Addrs
+		}
+		err = e.Err
+	}
+
+	return page
+}
+
+func errorKindName(err error) string {
+	switch {
+	case IsError(err, ErrDNSFailure):
+		return "dns_failure"
+	case IsError(err, ErrAllAddrsBad):
+		return "all_addrs_bad"
+	case IsError(err, ErrDialFailure):
+		return "dial_failure"
+	case IsError(err, ErrFetchQuota):
+		return "fetch_quota"
+	case IsError(err, ErrFetchTimeout):
+		return "fetch_timeout"
+	case IsError(err, ErrFetchServer):
+		return "fetch_server"
+	case IsError(err, ErrBlockPage):
+		return "block_page"
+	default:
+		return "error"
+	}
+}
+
+// Text is the plain text page, as http.Error wrote it before error pages.
+func (page *ErrorPage) Text() string {
+	if page.RequestID == "" {
+		return page.Reason
+	}
+	return fmt.Sprintf("%s (request id %s)", page.Reason, page.RequestID)
+}
+
+// BlockResponse is the response of a filter which blocks req, reason is told
+// to the client in an error page, or as text if error pages are disabled.
+func BlockResponse(req *http.Request, status int, filter, reason string) *http.Response {
+	data := []byte(reason + "\n")
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header: http.Header{
+			"Content-Type":    []string{"text/plain; charset=utf-8"},
+			BlockedByHeader:   []string{filter},
+			BlockReasonHeader: []string{reason},
+		},
+		Request:       req,
+		Close:         true,
+		ContentLength: int64(len(data)),
+		Body:          ioutil.NopCloser(bytes.NewReader(data)),
+	}
+}
+
+// BlockedPage returns the page of a response of BlockResponse and strips its
+// headers, or nil for the other responses.
+func BlockedPage(resp *http.Response) *ErrorPage {
+	filter := resp.Header.Get(BlockedByHeader)
+	if filter == "" {
+		return nil
+	}
+
+	page := &ErrorPage{
+		Status: resp.StatusCode,
+		Kind:   "blocked",
+		Reason: resp.Header.Get(BlockReasonHeader),
+		Filter: filter,
+		Time:   time.Now(),
+	}
+	if page.Reason == "" {
+		page.Reason = http.StatusText(resp.StatusCode) + " by " + filter
+	}
+
+	resp.Header.Del(BlockedByHeader)
+	resp.Header.Del(BlockReasonHeader)
+
+	return page
+}
+
+const defaultErrorPageTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Status}} {{statusText .Status}} - {{.Brand}}</title>
+<style>
+body { font-family: sans-serif; margin: 3em auto; max-width: 48em; color: #333; }
+h1 { font-size: 1.5em; }
+pre { background: #f4f4f4; padding: 1em; white-space: pre-wrap; word-break: break-all; }
+.meta { color: #888; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>{{.Status}} {{statusText .Status}}</h1>
+{{if eq .Kind "blocked"}}<p>The request to <code>{{.URL}}</code> is blocked by {{.Filter}}.</p>
+{{else if eq .Kind "dns_failure"}}<p>The address of {{if .Alias}}<code>{{.Alias}}</code>{{else}}the server{{end}} could not be resolved.</p>
+{{else if eq .Kind "all_addrs_bad"}}<p>All the addresses of {{if .Alias}}<code>{{.Alias}}</code>{{else}}the server{{end}} are known to be bad.</p>
+{{else if eq .Kind "dial_failure"}}<p>None of the addresses of {{if .Alias}}<code>{{.Alias}}</code>{{else}}the server{{end}} could be connected.</p>
+{{else}}<p>The request to <code>{{.URL}}</code> failed.</p>
+{{end}}<pre>{{.Reason}}</pre>
+{{if .Addrs}}<p>Addresses tried:</p>
+<ul>{{range .Addrs}}<li><code>{{.}}</code></li>{{end}}</ul>
+{{end}}<p class="meta">{{.Brand}}{{if .Filter}} &middot; {{.Filter}}{{end}}{{if .RequestID}} &middot; request id {{.RequestID}}{{end}} &middot; {{.Time.Format "2006-01-02 15:04:05 MST"}}</p>
+</body>
+</html>
+`
+
+// ErrorPages writes the error pages of a handler, as html to browsers and
+// json to the clients which prefer it. A nil ErrorPages writes plain text.
+type ErrorPages struct {
+	Brand    string
+	Template *template.Template
+}
+
+// NewErrorPages parses text as the html template of the pages, the built-in
+// one is used if it is empty.
+func NewErrorPages(brand, text string) (*ErrorPages, error) {
+	if brand == "" {
+		brand = "GoProxy"
+	}
+	if text == "" {
+		text = defaultErrorPageTemplate
+	}
+
+	tmpl, err := template.New("errorpage").Funcs(template.FuncMap{
+		"statusText": http.StatusText,
+	}).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ErrorPages{
+		Brand:    brand,
+		Template: tmpl,
+	}, nil
+}
+
+func (p *ErrorPages) Write(rw http.ResponseWriter, req *http.Request, page *ErrorPage) {
+	if p == nil {
+		http.Error(rw, page.Text(), page.Status)
+		return
+	}
+
+	page.Brand = p.Brand
+
+	var buf bytes.Buffer
+	var contentType string
+	switch errorPageFormat(req.Header.Get("Accept")) {
+	case "json":
+		contentType = "application/json; charset=utf-8"
+		json.NewEncoder(&buf).Encode(page)
+	case "html":
+		contentType = "text/html; charset=utf-8"
+		if err := p.Template.Execute(&buf, page); err != nil {
+			buf.Reset()
+			fmt.Fprintf(&buf, "%s\nerror page template: %v\n", page.Text(), err)
+			contentType = "text/plain; charset=utf-8"
+		}
+	default:
+		contentType = "text/plain; charset=utf-8"
+		buf.WriteString(page.Text() + "\n")
+	}
+
+	rw.Header().Set("Content-Type", contentType)
+	rw.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+	rw.WriteHeader(page.Status)
+	rw.Write(buf.Bytes())
+}
+
+// errorPageFormat picks json, html or text by the q values of accept, the
+// wildcards and a missing header mean text, as curl and most tools send them.
+func errorPageFormat(accept string) string {
+	var jsonQ, htmlQ float64
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(s, 64); err != nil {
+				continue
+			}
+		}
+		switch {
+		case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+			if q > jsonQ {
+				jsonQ = q
+			}
+		case mediaType == "text/html" || mediaType == "application/xhtml+xml":
+			if q > htmlQ {
+				htmlQ = q
+			}
+		}
+	}
+
+	switch {
+	case jsonQ > 0 && jsonQ >= htmlQ:
+		return "json"
+	case htmlQ > 0:
+		return "html"
+	default:
+		return "text"
+	}
+}
@@ -0,0 +1,89 @@
+package helpers
+
+import (
+	"errors"
+	"net"
+)
+
+// Kinds of Error, compare them with IsError instead of matching strings.
+var (
+	ErrDNSFailure   = errors.New("dns failure")
+	ErrAllAddrsBad  = errors.New("all addresses are bad")
+	ErrDialFailure  = errors.New("dial failure")
+	ErrFetchQuota   = errors.New("fetchserver over quota")
+	ErrFetchTimeout = errors.New("fetchserver timeout")
+	ErrFetchServer  = errors.New("fetchserver failure")
+	ErrBlockPage    = errors.New("block page detected")
+)
+
+// Error wraps the error of Op with its Kind, so callers can branch on the
+// cause while the message keeps the original details. Alias and Addrs are
+// the alias and the addrs of a dial, for the error pages.
+type Error struct {
+	Kind  error
+	Op    string
+	Err   error
+	Alias string
+	Addrs []string
+}
+
+func NewError(kind error, op string, err error) *Error {
+	return &Error{
+		Kind: kind,
+		Op:   op,
+		Err:  err,
+	}
+}
+
+// WithAddrs sets the alias and the addrs of e and returns it.
+func (e *Error) WithAddrs(alias string, addrs []string) *Error {
+	e.Alias = alias
+	e.Addrs = addrs
+	return e
+}
+
+func (e *Error) Error() string {
+	s := e.Kind.Error()
+	if e.Op != "" {
+		s = e.Op + ": " + s
+	}
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is(err, kind) match the Kind of e.
+func (e *Error) Is(target error) bool {
+	return e.Kind == target
+}
+
+func (e *Error) Timeout() bool {
+	if e.Kind == ErrFetchTimeout {
+		return true
+	}
+	ne, ok := e.Err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func (e *Error) Temporary() bool {
+	ne, ok := e.Err.(net.Error)
+	return ok && ne.Temporary()
+}
+
+// ErrorKind returns the outermost Kind of err, or nil if err is not an Error.
+func ErrorKind(err error) error {
+	if e, ok := err.(*Error); ok {
+		return e.Kind
+	}
+	return nil
+}
+
+// IsError reports whether err or one of the errors it wraps is of kind.
+func IsError(err error, kind error) bool {
+	return errors.Is(err, kind)
+}
@@ -0,0 +1,100 @@
+package helpers
+
+import (
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+type flushWriter struct {
+	dst       io.Writer
+	flusher   http.Flusher
+	interval  time.Duration
+	threshold int
+	pending   int
+	timer     *time.Timer
+	mu        sync.Mutex
+}
+
+// NewFlushWriter wraps dst so that written data is pushed to the client
+// without waiting for the whole body. A negative interval flushes after every
+// write, a positive one flushes at most interval after data became pending,
+// and threshold forces a flush once that many bytes are pending. Close must
+// be called before dst becomes invalid.
+func NewFlushWriter(dst io.Writer, interval time.Duration, threshold int) io.WriteCloser {
+	flusher, ok := dst.(http.Flusher)
+	if !ok || (interval == 0 && threshold <= 0) {
+		return nopWriteCloser{dst}
+	}
+
+	return &flushWriter{
+		dst:       dst,
+		flusher:   flusher,
+		interval:  interval,
+		threshold: threshold,
+	}
+}
+
+func (w *flushWriter) Write(p []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	n, err = w.dst.Write(p)
+	if err != nil {
+		return
+	}
+
+	w.pending += n
+
+	switch {
+	case w.interval < 0, w.threshold > 0 && w.pending >= w.threshold:
+		w.flush()
+	case w.interval > 0 && w.timer == nil:
+		w.timer = time.AfterFunc(w.interval, w.delayedFlush)
+	}
+
+	return
+}
+
+func (w *flushWriter) flush() {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	w.pending = 0
+	w.flusher.Flush()
+}
+
+func (w *flushWriter) delayedFlush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.timer == nil {
+		return
+	}
+	w.timer = nil
+	if w.pending > 0 {
+		w.pending = 0
+		w.flusher.Flush()
+	}
+}
+
+func (w *flushWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package helpers
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+// DefaultStripHeaders reveal that a request went through a proxy.
+var DefaultStripHeaders = []string{
+	"Via",
+	"Forwarded",
+	"X-Forwarded-For",
+	"X-Forwarded-Host",
+	"X-Forwarded-Proto",
+	"X-Forwarded-Port",
+	"X-Forwarded-Server",
+	"X-Real-Ip",
+	"X-Proxy-Id",
+	"Client-Ip",
+	"Proxy-Connection",
+	"Proxy-Authorization",
+}
+
+// browserHeaderOrder is the order which browsers send the common headers
+// in, the other headers follow it sorted.
+var browserHeaderOrder = []string{
+	"Host",
+	"Connection",
+	"Content-Length",
+	"Cache-Control",
+	"Sec-Ch-Ua",
+	"Sec-Ch-Ua-Mobile",
+	"Sec-Ch-Ua-Platform",
+	"Upgrade-Insecure-Requests",
+	"Origin",
+	"Content-Type",
+	"User-Agent",
+	"Accept",
+	"Sec-Fetch-Site",
+	"Sec-Fetch-Mode",
+	"Sec-Fetch-User",
+	"Sec-Fetch-Dest",
+	"Referer",
+	"Accept-Encoding",
+	"Accept-Language",
+	"Cookie",
+	"If-None-Match",
+	"If-Modified-Since",
+	"Range",
+}
+
+var headerNewlineToSpace = strings.NewReplacer("\n", " ", "\r", " ")
+
+// HeaderNormalization makes the requests sent upstream look like the ones of
+// a browser. The headers of DefaultStripHeaders and StripHeaders are removed,
+// and the User-Agent of the hosts matching UserAgents is replaced.
+type HeaderNormalization struct {
+	Enabled      bool
+	StripHeaders []string
+	// e.g. "*.example.com": "Mozilla/5.0 ...", an empty one removes it
+	UserAgents map[string]string
+}
+
+type HeaderNormalizer struct {
+	strip      map[string]bool
+	userAgents *HostMatcher
+}
+
+// NewHeaderNormalizer returns nil unless c is enabled.
+func NewHeaderNormalizer(c HeaderNormalization) *HeaderNormalizer {
+	if !c.Enabled {
+		return nil
+	}
+
+	strip := make(map[string]bool)
+	for _, key := range append(DefaultStripHeaders, c.StripHeaders...) {
+		strip[textproto.CanonicalMIMEHeaderKey(key)] = true
+	}
+
+	return &HeaderNormalizer{
+		strip:      strip,
+		userAgents: NewHostMatcherWithString(c.UserAgents),
+	}
+}
+
+// Header returns a copy of header normalized for host, header is left alone.
+func (n *HeaderNormalizer) Header(host string, header http.Header) http.Header {
+	header1 := make(http.Header, len(header))
+	for key, values := range header {
+		if !n.strip[key] {
+			header1[key] = values
+		}
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if ua, ok := n.userAgents.Lookup(host); ok {
+		if ua.(string) == "" {
+			header1.Del("User-Agent")
+		} else {
+			header1.Set("User-Agent", ua.(string))
+		}
+	}
+
+	return header1
+}
+
+// Normalize returns req with the header normalized, req itself is left alone.
+// It returns req as is on a nil HeaderNormalizer.
+func (n *HeaderNormalizer) Normalize(req *http.Request) *http.Request {
+	if n == nil {
+		return req
+	}
+
+	req1 := req.WithContext(req.Context())
+	req1.Header = n.Header(req.Host, req.Header)
+	return req1
+}
+
+// WriteHeaderOrdered is http.Header.WriteSubset which writes the headers in
+// the order of browsers instead of sorted.
+func WriteHeaderOrdered(w io.Writer, header http.Header, exclude map[string]bool) error {
+	keys := make([]string, 0, len(header))
+	seen := make(map[string]bool, len(browserHeaderOrder))
+	for _, key := range browserHeaderOrder {
+		seen[key] = true
+		if _, ok := header[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+
+	rest := make([]string, 0, len(header))
+	for key := range header {
+		if !seen[key] {
+			rest = append(rest, key)
+		}
+	}
+	sort.Strings(rest)
+
+	for _, key := range append(keys, rest...) {
+		if exclude[key] {
+			continue
+		}
+		for _, value := range header[key] {
+			if _, err := fmt.Fprintf(w, "%s: %s\r\n", key, textproto.TrimString(headerNewlineToSpace.Replace(value))); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
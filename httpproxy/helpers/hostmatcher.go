@@ -1,6 +1,7 @@
 package helpers
 
 import (
+	"net"
 	"path"
 	"strings"
 )
@@ -88,6 +89,22 @@ func (hm *HostMatcher) Lookup(host string) (interface{}, bool) {
 		return hm.starValue, true
 	}
 
+	return hm.lookup(host)
+}
+
+// LookupWithPort is Lookup which prefers the patterns of host:port, e.g.
+// "*.example.com:8443", to the ones of host. "*" only matches host.
+func (hm *HostMatcher) LookupWithPort(host, port string) (interface{}, bool) {
+	if port != "" {
+		if value, ok := hm.lookup(net.JoinHostPort(host, port)); ok {
+			return value, true
+		}
+	}
+
+	return hm.Lookup(host)
+}
+
+func (hm *HostMatcher) lookup(host string) (interface{}, bool) {
 	if value, ok := hm.strictMap[host]; ok {
 		return value, true
 	}
@@ -0,0 +1,254 @@
+package helpers
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+// KeyedCache is a lrucache.Cache which remembers its keys, so that the
+// entries can be listed, e.g. by admin api, and moved to a cache of another
+// capacity by Resize. It counts its hits, misses and evictions.
+type KeyedCache struct {
+	hits      uint64
+	misses    uint64
+	evictions uint64
+
+	mu    sync.RWMutex
+	cache lrucache.Cache
+	// the keys and their expiry
+	keys map[string]time.Time
+}
+
+func NewKeyedCache(cache lrucache.Cache) *KeyedCache {
+	return &KeyedCache{
+		cache: cache,
+		keys:  make(map[string]time.Time),
+	}
+}
+
+func (c *KeyedCache) count(ok bool) {
+	if ok {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+}
+
+func (c *KeyedCache) Get(key string) (interface{}, bool) {
+	c.mu.RLock()
+	v, ok := c.cache.Get(key)
+	c.mu.RUnlock()
+	c.count(ok)
+	return v, ok
+}
+
+func (c *KeyedCache) GetQuiet(key string) (interface{}, bool) {
+	c.mu.RLock()
+	v, ok := c.cache.GetQuiet(key)
+	c.mu.RUnlock()
+	c.count(ok)
+	return v, ok
+}
+
+func (c *KeyedCache) GetNotStale(key string) (interface{}, bool) {
+	c.mu.RLock()
+	v, ok := c.cache.GetNotStale(key)
+	c.mu.RUnlock()
+	c.count(ok)
+	return v, ok
+}
+
+func (c *KeyedCache) GetNotStaleNow(key string, now time.Time) (interface{}, bool) {
+	c.mu.RLock()
+	v, ok := c.cache.GetNotStaleNow(key, now)
+	c.mu.RUnlock()
+	c.count(ok)
+	return v, ok
+}
+
+func (c *KeyedCache) Set(key string, value interface{}, expire time.Time) {
+	c.SetNow(key, value, expire, time.Now())
+}
+
+func (c *KeyedCache) SetNow(key string, value interface{}, expire time.Time, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// a new key which does not grow a full cache pushed another one out
+	_, exists := c.cache.GetQuiet(key)
+	n := c.cache.Len()
+	c.cache.SetNow(key, value, expire, now)
+	if !exists && n > 0 && c.cache.Len() <= n {
+		atomic.AddUint64(&c.evictions, 1)
+	}
+
+	c.keys[key] = expire
+	if len(c.keys) > 2*c.cache.Capacity() {
+		c.prune()
+	}
+}
+
+func (c *KeyedCache) Del(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.keys, key)
+	return c.cache.Del(key)
+}
+
+func (c *KeyedCache) Clear() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.keys = make(map[string]time.Time)
+	return c.cache.Clear()
+}
+
+func (c *KeyedCache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cache.Len()
+}
+
+func (c *KeyedCache) Capacity() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cache.Capacity()
+}
+
+func (c *KeyedCache) Expire() int {
+	return c.ExpireNow(time.Now())
+}
+
+func (c *KeyedCache) ExpireNow(now time.Time) int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cache.ExpireNow(now)
+}
+
+// Keys returns the sorted keys which still exist in the underlying cache.
+func (c *KeyedCache) Keys() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.prune()
+
+	keys := make([]string, 0, len(c.keys))
+	for key := range c.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// prune forgets the keys evicted by the underlying cache, c.mu must be held.
+func (c *KeyedCache) prune() {
+	for key := range c.keys {
+		if _, ok := c.cache.GetQuiet(key); !ok {
+			delete(c.keys, key)
+		}
+	}
+}
+
+// Resize moves the entries to a new lrucache of capacity, the ones which
+// expire first are dropped if they do not fit, and counted as evictions. A
+// zero expiry never expires, e.g. of a blacklisted ip.
+func (c *KeyedCache) Resize(capacity int) {
+	if capacity <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if capacity == c.cache.Capacity() {
+		return
+	}
+
+	type entry struct {
+		key    string
+		value  interface{}
+		expire time.Time
+	}
+	entries := make([]entry, 0, len(c.keys))
+	for key, expire := range c.keys {
+		if value, ok := c.cache.GetQuiet(key); ok {
+			entries = append(entries, entry{key, value, expire})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].expire.IsZero() || entries[j].expire.IsZero() {
+			return !entries[i].expire.IsZero() && entries[j].expire.IsZero()
+		}
+		return entries[i].expire.Before(entries[j].expire)
+	})
+
+	if n := len(entries) - capacity; n > 0 {
+		atomic.AddUint64(&c.evictions, uint64(n))
+		entries = entries[n:]
+	}
+
+	cache := lrucache.NewLRUCache(uint(capacity))
+	keys := make(map[string]time.Time, len(entries))
+	for _, e := range entries {
+		cache.Set(e.key, e.value, e.expire)
+		keys[e.key] = e.expire
+	}
+
+	c.cache = cache
+	c.keys = keys
+}
+
+// KeyedCacheStats are the counters of a KeyedCache since it was made.
+type KeyedCacheStats struct {
+	Capacity  int
+	Len       int
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+}
+
+func (c *KeyedCache) Stats() KeyedCacheStats {
+	c.mu.RLock()
+	capacity, n := c.cache.Capacity(), c.cache.Len()
+	c.mu.RUnlock()
+
+	return KeyedCacheStats{
+		Capacity:  capacity,
+		Len:       n,
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Evictions: atomic.LoadUint64(&c.evictions),
+	}
+}
+
+// MemoryUsage estimates the memory held by the entries.
+func (c *KeyedCache) MemoryUsage() int64 {
+	return int64(c.Len()) * keyedCacheEntrySize
+}
+
+// Shrink expires the stale entries, and drops more of them if fraction of
+// the entries is not freed by that.
+func (c *KeyedCache) Shrink(fraction float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := c.cache.Len()
+	want := n - int(float64(n)*fraction)
+
+	c.cache.Expire()
+
+	c.prune()
+	for key := range c.keys {
+		if c.cache.Len() <= want {
+			break
+		}
+		c.cache.Del(key)
+		delete(c.keys, key)
+	}
+}
@@ -0,0 +1,104 @@
+package helpers
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/phuslu/glog"
+)
+
+// KeyLog is the KeyLogWriter of the tls.Configs of both legs, the MITM one
+// towards the client and the ones towards the servers. It writes the TLS
+// secrets in the NSS key log format of SSLKEYLOGFILE, so that captures can be
+// decrypted by Wireshark, and drops them unless it is enabled.
+var KeyLog = &KeyLogWriter{}
+
+type KeyLogWriter struct {
+	mu       sync.Mutex
+	filename string
+	file     *os.File
+}
+
+func (w *KeyLogWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return len(b), nil
+	}
+	return w.file.Write(b)
+}
+
+// SetFilename sets the file written to by Enable, which is taken from the
+// SSLKEYLOGFILE environment variable or the config only, never from a request.
+// A filename which is set already is kept, so the environment wins.
+func (w *KeyLogWriter) SetFilename(filename string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.filename == "" {
+		w.filename = filename
+	}
+}
+
+// ConfiguredFilename returns the file which Enable writes to.
+func (w *KeyLogWriter) ConfiguredFilename() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.filename
+}
+
+// Enable appends the secrets of the handshakes from now on to the file set
+// by SetFilename.
+func (w *KeyLogWriter) Enable() error {
+	w.mu.Lock()
+	filename := w.filename
+	w.mu.Unlock()
+
+	if filename == "" {
+		return fmt.Errorf("KeyLog: no filename, set SSLKEYLOGFILE or KeyLogFile of admin.json")
+	}
+
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	old := w.file
+	w.file = file
+	w.mu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	glog.Warningf("KeyLog: TLS secrets are written to %#v, anyone who reads it can decrypt the captures", filename)
+	return nil
+}
+
+func (w *KeyLogWriter) Disable() error {
+	w.mu.Lock()
+	file := w.file
+	w.file = nil
+	w.mu.Unlock()
+
+	if file == nil {
+		return nil
+	}
+
+	glog.Infof("KeyLog: stop writing TLS secrets to %#v", file.Name())
+	return file.Close()
+}
+
+// Filename returns the file written to, or "" if it is disabled.
+func (w *KeyLogWriter) Filename() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.file == nil {
+		return ""
+	}
+	return w.file.Name()
+}
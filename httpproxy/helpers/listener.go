@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"strings"
 	"sync"
 	"time"
 
@@ -24,6 +25,11 @@ type Listener interface {
 	filer
 
 	Add(net.Conn) error
+	Rebind(network, addr string) error
+	// Allow reports whether a connection from addr passes the AcceptFilter,
+	// for the connections accepted elsewhere and handed over by Add.
+	Allow(addr net.Addr) bool
+	AcceptStats() AcceptStats
 }
 
 type racer struct {
@@ -34,7 +40,15 @@ type racer struct {
 type listener struct {
 	ln              net.Listener
 	lane            chan racer
+	closed          chan struct{}
+	muLane          sync.RWMutex
+	tlsConfig       *tls.Config
 	keepAlivePeriod time.Duration
+	proxyProtocol   bool
+	proxyTimeout    time.Duration
+	proxyTrusted    []*net.IPNet
+	acceptFilter    *AcceptFilter
+	started         bool
 	stopped         bool
 	once            sync.Once
 	mu              sync.Mutex
@@ -43,24 +57,84 @@ type listener struct {
 type ListenOptions struct {
 	TLSConfig       *tls.Config
 	KeepAlivePeriod time.Duration
+	// ProxyProtocol requires a PROXY protocol v1/v2 header on every accepted
+	// connection, which must arrive within ProxyProtocolTimeout. Only the
+	// peers in ProxyProtocolTrusted, e.g. the load balancer, may send it, the
+	// connections of the others are closed before anything is read.
+	ProxyProtocol        bool
+	ProxyProtocolTimeout time.Duration
+	ProxyProtocolTrusted []*net.IPNet
+	// AcceptFilter rejects connections by the peer ip right after accept,
+	// behind a PROXY protocol header it is the client ip of the header.
+	AcceptFilter *AcceptFilter
 }
 
 func ListenTCP(network, addr string, opts *ListenOptions) (Listener, error) {
-	laddr, err := net.ResolveTCPAddr(network, addr)
+	var tlsConfig *tls.Config
+	if opts != nil && opts.TLSConfig != nil {
+		tlsConfig = opts.TLSConfig
+	}
+
+	ln, err := listenTCP(network, addr, tlsConfig)
 	if err != nil {
 		return nil, err
 	}
 
-	ln0, err := net.ListenTCP(network, laddr)
+	return NewListener(ln, opts), nil
+}
+
+// Listen listens at addr, which is host:port, "unix:/path/to/socket", or
+// "systemd:name" for a socket passed by systemd socket activation, see
+// SystemdListener.
+func Listen(addr string, opts *ListenOptions) (Listener, error) {
+	var ln net.Listener
+	var err error
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		ln, err = listenUnix(strings.TrimPrefix(addr, "unix:"))
+	case strings.HasPrefix(addr, "systemd:"):
+		ln, err = SystemdListener(strings.TrimPrefix(addr, "systemd:"))
+	default:
+		return ListenTCP("tcp", addr, opts)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	var ln net.Listener
 	if opts != nil && opts.TLSConfig != nil {
-		ln = tls.NewListener(ln0, opts.TLSConfig)
-	} else {
-		ln = ln0
+		ln = tls.NewListener(ln, opts.TLSConfig)
+	}
+
+	return NewListener(ln, opts), nil
+}
+
+// IsTCPAddress reports whether addr is host:port rather than a unix or
+// systemd socket of Listen.
+func IsTCPAddress(addr string) bool {
+	return !strings.HasPrefix(addr, "unix:") && !strings.HasPrefix(addr, "systemd:")
+}
+
+// listenUnix removes a stale socket file at path, which a crashed process
+// left behind, before it listens. The socket is created by the umask.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("listen unix %s: address already in use", path)
+		}
+		os.Remove(path)
+	}
+
+	return net.Listen("unix", path)
+}
+
+// NewListener wraps ln, which is already listening, e.g. a unix socket or one
+// handed over by a program embedding the proxy. opts.TLSConfig is only used by
+// Rebind, ln is not wrapped with it.
+func NewListener(ln net.Listener, opts *ListenOptions) Listener {
+	var tlsConfig *tls.Config
+	if opts != nil && opts.TLSConfig != nil {
+		tlsConfig = opts.TLSConfig
 	}
 
 	var keepAlivePeriod time.Duration
@@ -71,48 +145,116 @@ func ListenTCP(network, addr string, opts *ListenOptions) (Listener, error) {
 	l := &listener{
 		ln:              ln,
 		lane:            make(chan racer, backlog),
+		closed:          make(chan struct{}),
+		tlsConfig:       tlsConfig,
 		stopped:         false,
 		keepAlivePeriod: keepAlivePeriod,
 	}
 
-	return l, nil
+	if opts != nil {
+		l.acceptFilter = opts.AcceptFilter
+	}
 
+	if opts != nil && opts.ProxyProtocol {
+		l.proxyProtocol = true
+		l.proxyTrusted = opts.ProxyProtocolTrusted
+		l.proxyTimeout = opts.ProxyProtocolTimeout
+		if l.proxyTimeout <= 0 {
+			l.proxyTimeout = 5 * time.Second
+		}
+	}
+
+	return l
 }
 
-func (l *listener) Accept() (c net.Conn, err error) {
-	l.once.Do(func() {
-		go func() {
-			var tempDelay time.Duration
-			for {
-				conn, err := l.ln.Accept()
-				l.lane <- racer{conn, err}
-				if err != nil {
-					if ne, ok := err.(net.Error); ok && ne.Temporary() {
-						if tempDelay == 0 {
-							tempDelay = 5 * time.Millisecond
-						} else {
-							tempDelay *= 2
-						}
-						if max := 1 * time.Second; tempDelay > max {
-							tempDelay = max
-						}
-						glog.Warningf("httpproxy.Listener: Accept error: %v; retrying in %v", err, tempDelay)
-						time.Sleep(tempDelay)
-						continue
-					}
-					return
+func listenTCP(network, addr string, tlsConfig *tls.Config) (net.Listener, error) {
+	laddr, err := net.ResolveTCPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := net.ListenTCP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	if tlsConfig != nil {
+		return tls.NewListener(ln, tlsConfig), nil
+	}
+
+	return ln, nil
+}
+
+func (l *listener) serve(ln net.Listener) {
+	var tempDelay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			l.mu.Lock()
+			replaced, stopped := l.ln != ln, l.stopped
+			l.mu.Unlock()
+			if replaced || stopped {
+				// the socket was swapped out by Rebind, let the new one serve.
+				return
+			}
+		}
+		if err == nil && l.proxyProtocol {
+			// the header is read aside, so a slow client does not block Accept
+			go l.addProxyConn(conn)
+			tempDelay = 0
+			continue
+		}
+		if err == nil && !l.Allow(conn.RemoteAddr()) {
+			conn.Close()
+			tempDelay = 0
+			continue
+		}
+		l.push(racer{conn, err})
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+				if max := 1 * time.Second; tempDelay > max {
+					tempDelay = max
 				}
+				glog.Warningf("httpproxy.Listener: Accept error: %v; retrying in %v", err, tempDelay)
+				time.Sleep(tempDelay)
+				continue
 			}
-		}()
+			return
+		}
+		tempDelay = 0
+	}
+}
+
+func (l *listener) Accept() (c net.Conn, err error) {
+	l.once.Do(func() {
+		l.mu.Lock()
+		l.started = true
+		ln := l.ln
+		l.mu.Unlock()
+		go l.serve(ln)
 	})
 
-	r := <-l.lane
+	var r racer
+	select {
+	case r = <-l.lane:
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
 	if r.err != nil {
 		return r.conn, r.err
 	}
 
 	if l.keepAlivePeriod > 0 {
-		if tc, ok := r.conn.(*net.TCPConn); ok {
+		conn := r.conn
+		if pc, ok := conn.(*proxyConn); ok {
+			conn = pc.Conn
+		}
+		if tc, ok := conn.(*net.TCPConn); ok {
 			tc.SetKeepAlive(true)
 			tc.SetKeepAlivePeriod(l.keepAlivePeriod)
 		}
@@ -123,35 +265,214 @@ func (l *listener) Accept() (c net.Conn, err error) {
 
 func (l *listener) Close() error {
 	l.mu.Lock()
-	defer l.mu.Unlock()
 	if l.stopped {
+		l.mu.Unlock()
 		return nil
 	}
 	l.stopped = true
-	close(l.lane)
-	return l.ln.Close()
+	ln := l.ln
+	l.mu.Unlock()
+
+	// wake up the senders blocked on a full lane, then close the conns
+	// which nobody accepts any more
+	close(l.closed)
+	l.muLane.Lock()
+	for drained := false; !drained; {
+		select {
+		case r := <-l.lane:
+			if r.conn != nil {
+				r.conn.Close()
+			}
+		default:
+			drained = true
+		}
+	}
+	l.muLane.Unlock()
+
+	return ln.Close()
 }
 
 func (l *listener) Addr() net.Addr {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 	return l.ln.Addr()
 }
 
 func (l *listener) File() (*os.File, error) {
-	if f, ok := l.ln.(filer); ok {
+	l.mu.Lock()
+	ln := l.ln
+	l.mu.Unlock()
+	if f, ok := ln.(filer); ok {
 		return f.File()
 	}
-	return nil, fmt.Errorf("%T does not has func File()", l.ln)
+	return nil, fmt.Errorf("%T does not has func File()", ln)
 }
 
-func (l *listener) Add(conn net.Conn) error {
-	l.mu.Lock()
-	defer l.mu.Unlock()
+// Rebind binds addr and moves the accept loop over to it, network "" is the
+// network of the current socket, e.g. "unix" for a unix or systemd socket.
+// The old socket keeps accepting for RebindDrainTimeout after the new one is
+// listening, so the connections in its backlog are not dropped, and the
+// connections already accepted from it keep being served.
+func (l *listener) Rebind(network, addr string) error {
+	if network == "" {
+		network = l.Addr().Network()
+	}
 
+	var ln net.Listener
+	var err error
+	switch network {
+	case "unix":
+		if ln, err = listenUnix(addr); err == nil && l.tlsConfig != nil {
+			ln = tls.NewListener(ln, l.tlsConfig)
+		}
+	default:
+		ln, err = listenTCP(network, addr, l.tlsConfig)
+	}
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
 	if l.stopped {
+		l.mu.Unlock()
+		ln.Close()
 		return fmt.Errorf("%#v already closed", l)
 	}
+	old := l.ln
+	l.ln = ln
+	started := l.started
+	l.mu.Unlock()
+
+	if started {
+		go l.serve(ln)
+	}
+
+	glog.Infof("httpproxy.Listener: rebind from %s to %s", old.Addr(), ln.Addr())
+
+	if !started {
+		return old.Close()
+	}
+
+	// the accept loop of old goes on until it is closed
+	time.AfterFunc(RebindDrainTimeout, func() {
+		old.Close()
+	})
+	return nil
+}
+
+// RebindDrainTimeout is how long the old socket of Rebind keeps accepting.
+var RebindDrainTimeout = 1 * time.Second
+
+func (l *listener) addProxyConn(conn net.Conn) {
+	// anyone else could claim any client address, e.g. a loopback one
+	if !l.proxyTrustedPeer(conn.RemoteAddr()) {
+		glog.V(2).Infof("httpproxy.Listener: reject PROXY header from untrusted %s", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+
+	pc, err := ReadProxyHeader(conn, l.proxyTimeout)
+	if err != nil {
+		glog.Warningf("httpproxy.Listener: ReadProxyHeader(%s) error: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	if !l.Allow(pc.RemoteAddr()) {
+		pc.Close()
+		return
+	}
+
+	if err := l.Add(pc); err != nil {
+		pc.Close()
+	}
+}
 
-	l.lane <- racer{conn, nil}
+// proxyTrustedPeer reports whether addr is in ProxyProtocolTrusted, none of
+// the peers is trusted if it is empty.
+func (l *listener) proxyTrustedPeer(addr net.Addr) bool {
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	default:
+		if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+			ip = net.ParseIP(host)
+		}
+	}
+	return ip != nil && ContainsIP(l.proxyTrusted, ip)
+}
 
+func (l *listener) Add(conn net.Conn) error {
+	if !l.send(racer{conn, nil}) {
+		return fmt.Errorf("%#v already closed", l)
+	}
 	return nil
 }
+
+// push hands r over to Accept, or closes its conn if l is closed meanwhile.
+func (l *listener) push(r racer) {
+	if !l.send(r) && r.conn != nil {
+		r.conn.Close()
+	}
+}
+
+// send waits for room in the lane without holding mu, so that a full lane
+// does not block Close, Addr or Rebind. It is false if l is closed.
+func (l *listener) send(r racer) bool {
+	l.muLane.RLock()
+	defer l.muLane.RUnlock()
+
+	select {
+	case <-l.closed:
+		return false
+	default:
+	}
+
+	select {
+	case l.lane <- r:
+		return true
+	case <-l.closed:
+		return false
+	}
+}
+
+func (l *listener) Allow(addr net.Addr) bool {
+	if l.acceptFilter.Accept(addr) {
+		return true
+	}
+	glog.V(3).Infof("httpproxy.Listener: reject connection from %s", addr)
+	return false
+}
+
+func (l *listener) AcceptStats() AcceptStats {
+	return l.acceptFilter.Stats()
+}
+
+var listeners = struct {
+	sync.Mutex
+	m map[string]Listener
+}{m: make(map[string]Listener)}
+
+func RegisterListener(name string, ln Listener) {
+	listeners.Lock()
+	defer listeners.Unlock()
+	listeners.m[name] = ln
+}
+
+func Listeners() map[string]Listener {
+	listeners.Lock()
+	defer listeners.Unlock()
+	m := make(map[string]Listener, len(listeners.m))
+	for name, ln := range listeners.m {
+		m[name] = ln
+	}
+	return m
+}
+
+func LookupListener(name string) (Listener, bool) {
+	listeners.Lock()
+	defer listeners.Unlock()
+	ln, ok := listeners.m[name]
+	return ln, ok
+}
@@ -0,0 +1,197 @@
+package helpers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+)
+
+// Field is a key value pair of a structured log line.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func F(key string, value interface{}) Field {
+	return Field{key, value}
+}
+
+// Logger writes structured log lines, Debug is the level of glog.V(2).
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warning(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+}
+
+// DefaultLogger is glog until SetLogger is called, e.g. by the -logger flag.
+var DefaultLogger Logger = GlogLogger{}
+
+var (
+	loggerFactories   = map[string]func() (Logger, error){"glog": func() (Logger, error) { return GlogLogger{}, nil }}
+	muLoggerFactories sync.Mutex
+)
+
+// RegisterLogger makes a Logger available to NewLogger, the adapters of zap
+// and zerolog register themselves when they are built in with their tags.
+func RegisterLogger(name string, factory func() (Logger, error)) {
+	muLoggerFactories.Lock()
+	defer muLoggerFactories.Unlock()
+	loggerFactories[name] = factory
+}
+
+func NewLogger(name string) (Logger, error) {
+	muLoggerFactories.Lock()
+	factory, ok := loggerFactories[name]
+	muLoggerFactories.Unlock()
+
+	if !ok {
+		names := make([]string, 0, len(loggerFactories))
+		for name := range loggerFactories {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown logger %#v, built in: %s", name, strings.Join(names, ", "))
+	}
+
+	return factory()
+}
+
+func SetLogger(l Logger) {
+	DefaultLogger = l
+}
+
+// GlogLogger appends the fields to the message as "key=value".
+type GlogLogger struct{}
+
+func (GlogLogger) Debug(msg string, fields ...Field) {
+	if glog.V(2) {
+		glog.V(2).Info(formatFields(msg, fields))
+	}
+}
+
+func (GlogLogger) Info(msg string, fields ...Field) {
+	glog.Info(formatFields(msg, fields))
+}
+
+func (GlogLogger) Warning(msg string, fields ...Field) {
+	glog.Warning(formatFields(msg, fields))
+}
+
+func (GlogLogger) Error(msg string, fields ...Field) {
+	glog.Error(formatFields(msg, fields))
+}
+
+func formatFields(msg string, fields []Field) string {
+	if len(fields) == 0 {
+		return msg
+	}
+
+	parts := make([]string, 0, len(fields)+1)
+	parts = append(parts, msg)
+	for _, f := range fields {
+		switch v := f.Value.(type) {
+		case string:
+			parts = append(parts, f.Key+"="+fmt.Sprintf("%#v", v))
+		case error:
+			parts = append(parts, f.Key+"="+fmt.Sprintf("%#v", v.Error()))
+		default:
+			parts = append(parts, fmt.Sprintf("%s=%v", f.Key, v))
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// SampledLogger passes at most Burst lines of the same message each Window
+// to Logger, so a flapping dialer does not flood the log. The number of the
+// dropped lines is added to the next line which passes.
+type SampledLogger struct {
+	Logger Logger
+	Burst  int
+	Window time.Duration
+
+	mu      sync.Mutex
+	samples map[string]*logSample
+}
+
+type logSample struct {
+	start   time.Time
+	count   int
+	dropped int
+}
+
+func NewSampledLogger(l Logger, burst int, window time.Duration) *SampledLogger {
+	return &SampledLogger{
+		Logger:  l,
+		Burst:   burst,
+		Window:  window,
+		samples: make(map[string]*logSample),
+	}
+}
+
+func (l *SampledLogger) Debug(msg string, fields ...Field) {
+	if fields, ok := l.sample(msg, fields); ok {
+		l.Logger.Debug(msg, fields...)
+	}
+}
+
+func (l *SampledLogger) Info(msg string, fields ...Field) {
+	if fields, ok := l.sample(msg, fields); ok {
+		l.Logger.Info(msg, fields...)
+	}
+}
+
+func (l *SampledLogger) Warning(msg string, fields ...Field) {
+	if fields, ok := l.sample(msg, fields); ok {
+		l.Logger.Warning(msg, fields...)
+	}
+}
+
+// Error is never sampled.
+func (l *SampledLogger) Error(msg string, fields ...Field) {
+	l.Logger.Error(msg, fields...)
+}
+
+func (l *SampledLogger) sample(msg string, fields []Field) ([]Field, bool) {
+	if l.Burst <= 0 {
+		return fields, true
+	}
+
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	s, ok := l.samples[msg]
+	if !ok {
+		// messages are constants, but do not let a formatted one grow it forever
+		if len(l.samples) >= 4096 {
+			l.samples = make(map[string]*logSample)
+		}
+		s = &logSample{start: now}
+		l.samples[msg] = s
+	}
+
+	if now.Sub(s.start) >= l.Window {
+		s.start = now
+		s.count = 0
+	}
+
+	if s.count >= l.Burst {
+		s.dropped++
+		return nil, false
+	}
+	s.count++
+
+	if s.dropped > 0 {
+		fields = append(fields, F("sampled_out", s.dropped))
+		s.dropped = 0
+	}
+
+	return fields, true
+}
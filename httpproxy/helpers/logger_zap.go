@@ -0,0 +1,46 @@
+// +build zap
+
+package helpers
+
+import (
+	"go.uber.org/zap"
+)
+
+func init() {
+	RegisterLogger("zap", func() (Logger, error) {
+		l, err := zap.NewProduction()
+		if err != nil {
+			return nil, err
+		}
+		return &ZapLogger{l}, nil
+	})
+}
+
+// ZapLogger writes the log lines as json with zap, build with "-tags zap".
+type ZapLogger struct {
+	Logger *zap.Logger
+}
+
+func (l *ZapLogger) Debug(msg string, fields ...Field) {
+	l.Logger.Debug(msg, zapFields(fields)...)
+}
+
+func (l *ZapLogger) Info(msg string, fields ...Field) {
+	l.Logger.Info(msg, zapFields(fields)...)
+}
+
+func (l *ZapLogger) Warning(msg string, fields ...Field) {
+	l.Logger.Warn(msg, zapFields(fields)...)
+}
+
+func (l *ZapLogger) Error(msg string, fields ...Field) {
+	l.Logger.Error(msg, zapFields(fields)...)
+}
+
+func zapFields(fields []Field) []zap.Field {
+	zfs := make([]zap.Field, 0, len(fields))
+	for _, f := range fields {
+		zfs = append(zfs, zap.Any(f.Key, f.Value))
+	}
+	return zfs
+}
@@ -0,0 +1,48 @@
+// +build zerolog
+
+package helpers
+
+import (
+	"os"
+
+	"github.com/rs/zerolog"
+)
+
+func init() {
+	RegisterLogger("zerolog", func() (Logger, error) {
+		return &ZerologLogger{zerolog.New(os.Stderr).With().Timestamp().Logger()}, nil
+	})
+}
+
+// ZerologLogger writes the log lines as json with zerolog, build with
+// "-tags zerolog".
+type ZerologLogger struct {
+	Logger zerolog.Logger
+}
+
+func (l *ZerologLogger) Debug(msg string, fields ...Field) {
+	l.write(l.Logger.Debug(), msg, fields)
+}
+
+func (l *ZerologLogger) Info(msg string, fields ...Field) {
+	l.write(l.Logger.Info(), msg, fields)
+}
+
+func (l *ZerologLogger) Warning(msg string, fields ...Field) {
+	l.write(l.Logger.Warn(), msg, fields)
+}
+
+func (l *ZerologLogger) Error(msg string, fields ...Field) {
+	l.write(l.Logger.Error(), msg, fields)
+}
+
+func (l *ZerologLogger) write(e *zerolog.Event, msg string, fields []Field) {
+	for _, f := range fields {
+		if err, ok := f.Value.(error); ok {
+			e = e.Str(f.Key, err.Error())
+		} else {
+			e = e.Interface(f.Key, f.Value)
+		}
+	}
+	e.Msg(msg)
+}
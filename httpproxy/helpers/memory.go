@@ -0,0 +1,184 @@
+package helpers
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+)
+
+const (
+	memoryCheckInterval time.Duration = 10 * time.Second
+
+	// the GOGC while the process is above its soft limit
+	tightGCPercent = 25
+
+	// a rough size of a KeyedCache entry, keys are hosts or addrs and
+	// values are short lists or durations
+	keyedCacheEntrySize int64 = 256
+)
+
+// MemoryUser is a cache which reports how much memory it holds and gives
+// some back when the process is above its soft limit.
+type MemoryUser interface {
+	MemoryUsage() int64
+	// Shrink drops about fraction of the entries, the least useful first
+	Shrink(fraction float64)
+}
+
+var (
+	memoryUsers   = make(map[string]MemoryUser)
+	muMemoryUsers sync.Mutex
+)
+
+// RegisterMemoryUser adds u to the memory report and the soft limit, a user
+// of the same name is replaced, e.g. when a filter reloads.
+func RegisterMemoryUser(name string, u MemoryUser) {
+	muMemoryUsers.Lock()
+	defer muMemoryUsers.Unlock()
+	memoryUsers[name] = u
+}
+
+// MemoryUsages returns the estimated bytes held by each MemoryUser.
+func MemoryUsages() map[string]int64 {
+	muMemoryUsers.Lock()
+	users := make(map[string]MemoryUser, len(memoryUsers))
+	for name, u := range memoryUsers {
+		users[name] = u
+	}
+	muMemoryUsers.Unlock()
+
+	usages := make(map[string]int64, len(users))
+	for name, u := range users {
+		usages[name] = u.MemoryUsage()
+	}
+	return usages
+}
+
+// MemoryWatcher exports the memory of the process and its caches to Metrics,
+// and shrinks the caches and tightens GC while the RSS is above SoftLimit,
+// before the OOM killer steps in.
+type MemoryWatcher struct {
+	SoftLimit int64
+	Metrics   *Metrics
+
+	gcPercent int
+	tight     bool
+}
+
+// WatchMemory checks the memory every 10 seconds, softLimit 0 only reports.
+func WatchMemory(softLimit int64) *MemoryWatcher {
+	w := &MemoryWatcher{
+		SoftLimit: softLimit,
+		Metrics:   DefaultMetrics,
+	}
+	DefaultScheduler.Every("memory", memoryCheckInterval, true, w.Check)
+	return w
+}
+
+func (w *MemoryWatcher) Check() error {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	rss, err := readRSS()
+	if err != nil {
+		rss = int64(ms.Sys)
+	}
+
+	usages := MemoryUsages()
+
+	if w.Metrics != nil {
+		w.Metrics.SetGauge("goproxy_memory_rss_bytes", float64(rss))
+		w.Metrics.SetGauge("goproxy_memory_heap_bytes", float64(ms.HeapAlloc))
+		w.Metrics.SetGauge("goproxy_memory_soft_limit_bytes", float64(w.SoftLimit))
+		for name, n := range usages {
+			w.Metrics.SetGauge("goproxy_cache_memory_bytes", float64(n), "cache", name)
+		}
+	}
+
+	if w.SoftLimit <= 0 {
+		return nil
+	}
+
+	switch {
+	case rss > w.SoftLimit:
+		w.shrink(rss, usages)
+	case w.tight && rss < w.SoftLimit*8/10:
+		debug.SetGCPercent(w.gcPercent)
+		w.tight = false
+		glog.Infof("MEMORY: rss %d is below the soft limit %d, restore GOGC=%d", rss, w.SoftLimit, w.gcPercent)
+	}
+
+	return nil
+}
+
+// shrink gives back the overshoot of rss from the largest caches first and
+// lowers GOGC until the process is below the soft limit again.
+func (w *MemoryWatcher) shrink(rss int64, usages map[string]int64) {
+	if !w.tight {
+		w.gcPercent = debug.SetGCPercent(tightGCPercent)
+		w.tight = true
+	}
+
+	glog.Warningf("MEMORY: rss %d is above the soft limit %d, shrink caches and set GOGC=%d", rss, w.SoftLimit, tightGCPercent)
+
+	names := make([]string, 0, len(usages))
+	for name := range usages {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return usages[names[i]] > usages[names[j]] })
+
+	muMemoryUsers.Lock()
+	users := make(map[string]MemoryUser, len(memoryUsers))
+	for name, u := range memoryUsers {
+		users[name] = u
+	}
+	muMemoryUsers.Unlock()
+
+	over := rss - w.SoftLimit
+	for _, name := range names {
+		n := usages[name]
+		if over <= 0 || n <= 0 {
+			break
+		}
+		fraction := float64(over) / float64(n)
+		if fraction > 0.5 {
+			fraction = 0.5
+		}
+		if u, ok := users[name]; ok {
+			u.Shrink(fraction)
+			glog.V(2).Infof("MEMORY: shrink %#v of %d bytes by %.0f%%", name, n, fraction*100)
+		}
+		over -= int64(float64(n) * fraction)
+	}
+
+	debug.FreeOSMemory()
+}
+
+// readRSS reads the resident set size from /proc, it fails on the platforms
+// without procfs.
+func readRSS() (int64, error) {
+	data, err := ioutil.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, err
+	}
+
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0, os.ErrInvalid
+	}
+
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return pages * int64(os.Getpagesize()), nil
+}
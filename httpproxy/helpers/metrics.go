@@ -0,0 +1,300 @@
+package helpers
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MetricsRecorder is implemented by anything that wants to collect counters
+// and histograms from the dialer and fetch transports. Labels are passed as
+// key, value pairs.
+type MetricsRecorder interface {
+	IncCounter(name string, labels ...string)
+	Observe(name string, value float64, labels ...string)
+}
+
+var (
+	DurationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+	SizeBuckets     = []float64{256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304, 16777216}
+)
+
+var DefaultMetrics = NewMetrics()
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+type Metrics struct {
+	mu         sync.Mutex
+	counters   map[string]map[string]float64
+	gauges     map[string]map[string]float64
+	histograms map[string]map[string]*histogram
+	buckets    map[string][]float64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		counters:   make(map[string]map[string]float64),
+		gauges:     make(map[string]map[string]float64),
+		histograms: make(map[string]map[string]*histogram),
+		buckets:    make(map[string][]float64),
+	}
+}
+
+// SetBuckets sets the upper bounds used by histogram name, DurationBuckets is
+// used if it is never called.
+func (m *Metrics) SetBuckets(name string, buckets []float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.buckets[name] = buckets
+}
+
+func (m *Metrics) IncCounter(name string, labels ...string) {
+	key := formatLabels(labels)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.counters[name]
+	if !ok {
+		c = make(map[string]float64)
+		m.counters[name] = c
+	}
+	c[key]++
+}
+
+// SetCounter sets counter name to value, for the counters which are kept
+// elsewhere and exported now and then, e.g. the hits of a cache.
+func (m *Metrics) SetCounter(name string, value float64, labels ...string) {
+	key := formatLabels(labels)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.counters[name]
+	if !ok {
+		c = make(map[string]float64)
+		m.counters[name] = c
+	}
+	c[key] = value
+}
+
+// SetGauge sets the current value of gauge name, e.g. the memory in use.
+func (m *Metrics) SetGauge(name string, value float64, labels ...string) {
+	key := formatLabels(labels)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	g, ok := m.gauges[name]
+	if !ok {
+		g = make(map[string]float64)
+		m.gauges[name] = g
+	}
+	g[key] = value
+}
+
+func (m *Metrics) Observe(name string, value float64, labels ...string) {
+	key := formatLabels(labels)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	hs, ok := m.histograms[name]
+	if !ok {
+		hs = make(map[string]*histogram)
+		m.histograms[name] = hs
+	}
+
+	h, ok := hs[key]
+	if !ok {
+		buckets, ok := m.buckets[name]
+		if !ok {
+			buckets = DurationBuckets
+		}
+		h = &histogram{
+			buckets: buckets,
+			counts:  make([]uint64, len(buckets)),
+		}
+		hs[key] = h
+	}
+
+	for i, le := range h.buckets {
+		if value <= le {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// Counters calls fn with the labels and the value of each series of counter
+// name, e.g. to sum the dial attempts of an alias.
+func (m *Metrics) Counters(name string, fn func(labels map[string]string, value float64)) {
+	m.mu.Lock()
+	c := make(map[string]float64, len(m.counters[name]))
+	for key, value := range m.counters[name] {
+		c[key] = value
+	}
+	m.mu.Unlock()
+
+	for key, value := range c {
+		fn(parseLabels(key), value)
+	}
+}
+
+// WriteTo dumps all metrics in prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+
+	for _, name := range sortedKeys(m.counters) {
+		fmt.Fprintf(bw, "# TYPE %s counter\n", name)
+		c := m.counters[name]
+		for _, key := range sortedKeys(c) {
+			fmt.Fprintf(bw, "%s%s %s\n", name, wrapLabels(key), formatFloat(c[key]))
+		}
+	}
+
+	for _, name := range sortedKeys(m.gauges) {
+		fmt.Fprintf(bw, "# TYPE %s gauge\n", name)
+		g := m.gauges[name]
+		for _, key := range sortedKeys(g) {
+			fmt.Fprintf(bw, "%s%s %s\n", name, wrapLabels(key), formatFloat(g[key]))
+		}
+	}
+
+	for _, name := range sortedKeys(m.histograms) {
+		fmt.Fprintf(bw, "# TYPE %s histogram\n", name)
+		hs := m.histograms[name]
+		for _, key := range sortedKeys(hs) {
+			h := hs[key]
+			for i, le := range h.buckets {
+				fmt.Fprintf(bw, "%s_bucket%s %d\n", name, wrapLabels(joinLabels(key, "le", formatFloat(le))), h.counts[i])
+			}
+			fmt.Fprintf(bw, "%s_bucket%s %d\n", name, wrapLabels(joinLabels(key, "le", "+Inf")), h.count)
+			fmt.Fprintf(bw, "%s_sum%s %s\n", name, wrapLabels(key), formatFloat(h.sum))
+			fmt.Fprintf(bw, "%s_count%s %d\n", name, wrapLabels(key), h.count)
+		}
+	}
+
+	err := bw.Flush()
+	return cw.n, err
+}
+
+func (m *Metrics) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(rw)
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+
+	parts := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		parts = append(parts, labels[i]+"="+strconv.Quote(labels[i+1]))
+	}
+
+	return strings.Join(parts, ",")
+}
+
+// parseLabels reverses formatLabels.
+func parseLabels(key string) map[string]string {
+	labels := make(map[string]string)
+	for key != "" {
+		i := strings.IndexByte(key, '=')
+		if i < 0 || i+1 >= len(key) || key[i+1] != '"' {
+			break
+		}
+		name := key[:i]
+		j := i + 2
+		for j < len(key) && key[j] != '"' {
+			if key[j] == '\\' {
+				j++
+			}
+			j++
+		}
+		if j >= len(key) {
+			break
+		}
+		value, err := strconv.Unquote(key[i+1 : j+1])
+		if err != nil {
+			break
+		}
+		labels[name] = value
+		key = strings.TrimPrefix(key[j+1:], ",")
+	}
+	return labels
+}
+
+func joinLabels(key string, name, value string) string {
+	label := formatLabels([]string{name, value})
+	if key == "" {
+		return label
+	}
+	return key + "," + label
+}
+
+func wrapLabels(key string) string {
+	if key == "" {
+		return ""
+	}
+	return "{" + key + "}"
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch m := m.(type) {
+	case map[string]map[string]float64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]map[string]*histogram:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]float64:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	case map[string]*histogram:
+		for k := range m {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
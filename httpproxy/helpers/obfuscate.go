@@ -0,0 +1,83 @@
+package helpers
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// AES-256-CTR, the obfuscation of the fetches of the gae filter and
+	// goproxy-server
+	ObfuscateAES string = "aes"
+)
+
+// NewObfuscator returns the keystream of one direction, "request" or
+// "response", of a fetch. The key is HMAC-SHA256(secret, direction+nonce) of
+// the nonce sent in X-Urlfetch-Options, so no two fetches share a keystream
+// and the counter may start at zero.
+//
+// It only hides the flate framing from middleboxes which pattern-match it,
+// the payload is still protected by TLS, or not at all over plain http.
+func NewObfuscator(method, secret string, nonce []byte, direction string) (cipher.Stream, error) {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(direction))
+	mac.Write(nonce)
+	key := mac.Sum(nil)
+
+	switch method {
+	case ObfuscateAES:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewCTR(block, make([]byte, aes.BlockSize)), nil
+	default:
+		return nil, fmt.Errorf("unsupported urlfetch obfuscation %#v", method)
+	}
+}
+
+// NewObfuscateNonce returns a random nonce of a fetch.
+func NewObfuscateNonce() ([]byte, error) {
+	nonce := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return nonce, nil
+}
+
+// FormatUrlfetchOptions returns the X-Urlfetch-Options of an obfuscated
+// fetch, e.g. "obfs=aes; nonce=00112233445566778899aabbccddeeff".
+func FormatUrlfetchOptions(method string, nonce []byte) string {
+	return fmt.Sprintf("obfs=%s; nonce=%s", method, hex.EncodeToString(nonce))
+}
+
+func ParseUrlfetchOptions(s string) map[string]string {
+	options := make(map[string]string)
+	for _, part := range strings.Split(s, ";") {
+		if kv := strings.SplitN(strings.TrimSpace(part), "=", 2); len(kv) == 2 {
+			options[strings.ToLower(kv[0])] = kv[1]
+		}
+	}
+	return options
+}
+
+// obfuscatedBody reads r through a keystream and closes the raw body.
+type obfuscatedBody struct {
+	io.Reader
+	raw io.Closer
+}
+
+func (b *obfuscatedBody) Close() error {
+	return b.raw.Close()
+}
+
+func NewObfuscatedBody(body io.ReadCloser, stream cipher.Stream) io.ReadCloser {
+	return &obfuscatedBody{cipher.StreamReader{S: stream, R: body}, body}
+}
@@ -0,0 +1,72 @@
+package helpers
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"testing"
+)
+
+func TestObfuscatorRoundTrip(t *testing.T) {
+	nonce, err := NewObfuscateNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	options := ParseUrlfetchOptions(FormatUrlfetchOptions(ObfuscateAES, nonce))
+	if options["obfs"] != ObfuscateAES || options["nonce"] != hex.EncodeToString(nonce) {
+		t.Fatalf("ParseUrlfetchOptions returns %v", options)
+	}
+
+	// the length and the flate header of a fetch, which are always known
+	plain := append([]byte{0x01, 0x2c, 0x78, 0x9c}, bytes.Repeat([]byte("GET http://www.example.org/ HTTP/1.1\r\n"), 8)...)
+
+	enc, err := NewObfuscator(ObfuscateAES, "123456", nonce, "request")
+	if err != nil {
+		t.Fatal(err)
+	}
+	scrambled := make([]byte, len(plain))
+	enc.XORKeyStream(scrambled, plain)
+
+	// a 32 bytes key repeated over the payload would show up here
+	if bytes.Equal(scrambled[32:64], scrambled[32+38:64+38]) || bytes.Contains(scrambled, plain[4:20]) {
+		t.Fatalf("the scrambled fetch repeats the plain one: %x", scrambled)
+	}
+
+	dec, err := NewObfuscator(ObfuscateAES, "123456", nonce, "request")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(NewObfuscatedBody(ioutil.NopCloser(bytes.NewReader(scrambled)), dec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plain) {
+		t.Fatalf("round trip returns %q, want %q", got, plain)
+	}
+
+	// the other direction, or another nonce, is another keystream
+	for _, c := range []struct {
+		nonce     []byte
+		direction string
+	}{
+		{nonce, "response"},
+		{append([]byte{0}, nonce[1:]...), "request"},
+	} {
+		s, err := NewObfuscator(ObfuscateAES, "123456", c.nonce, c.direction)
+		if err != nil {
+			t.Fatal(err)
+		}
+		other := make([]byte, len(plain))
+		s.XORKeyStream(other, plain)
+		if bytes.Equal(other, scrambled) {
+			t.Errorf("%s keystream of nonce %x equals the request one", c.direction, c.nonce)
+		}
+	}
+
+	for _, method := range []string{"xor", "rc4", ""} {
+		if _, err := NewObfuscator(method, "123456", nonce, "request"); err == nil {
+			t.Errorf("NewObfuscator(%#v) is accepted", method)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package helpers
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	paddingChars    string = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+	minPaddingBound int    = 32
+	maxPaddingChunk int64  = 1024 * 1024
+)
+
+// The padding headers of the fetch framing. PaddingHeader is junk in a header
+// block, PaddingBodyHeader the length of the junk chunk between the header
+// block and the body. A fetch asks for padded responses by PaddingPercentHeader
+// and PaddingMaxHeader, the RandomPadding bounds of the server.
+const (
+	PaddingHeader        string = "X-Urlfetch-Padding"
+	PaddingBodyHeader    string = "X-Urlfetch-Padding-Body"
+	PaddingPercentHeader string = "X-Urlfetch-Padding-Percent"
+	PaddingMaxHeader     string = "X-Urlfetch-Padding-Max"
+)
+
+// RandomPadding returns printable junk whose length is uniformly chosen up to
+// percent% of size (at least minPaddingBound) and never more than max, so
+// the overhead stays bounded while the sizes of similar requests differ.
+func RandomPadding(size int64, percent, max int) string {
+	if percent <= 0 || max <= 0 {
+		return ""
+	}
+
+	bound := int(size * int64(percent) / 100)
+	if bound < minPaddingBound {
+		bound = minPaddingBound
+	}
+	if bound > max {
+		bound = max
+	}
+
+	b := make([]byte, rand.Intn(bound+1))
+	for i := range b {
+		b[i] = paddingChars[rand.Intn(len(paddingChars))]
+	}
+
+	return string(b)
+}
+
+// RandomPaddings splits a RandomPadding at random into the one of a header
+// block and the one of the body chunk, so both vary within the same bound.
+func RandomPaddings(size int64, percent, max int) (string, string) {
+	padding := RandomPadding(size, percent, max)
+	i := rand.Intn(len(padding) + 1)
+	return padding[:i], padding[i:]
+}
+
+// WritePaddingOptions writes the padding headers which ask the fetch server
+// to pad its response the same way.
+func WritePaddingOptions(w io.Writer, percent, max int) {
+	if percent > 0 && max > 0 {
+		fmt.Fprintf(w, "%s: %d\r\n%s: %d\r\n", PaddingPercentHeader, percent, PaddingMaxHeader, max)
+	}
+}
+
+// ParsePaddingOptions returns the padding asked for by the headers of
+// WritePaddingOptions, 0 if none.
+func ParsePaddingOptions(header http.Header) (int, int) {
+	percent, err1 := strconv.Atoi(header.Get(PaddingPercentHeader))
+	max, err2 := strconv.Atoi(header.Get(PaddingMaxHeader))
+	if err1 != nil || err2 != nil || percent <= 0 || max <= 0 {
+		return 0, 0
+	}
+	return percent, max
+}
+
+// DiscardPadding skips the padding chunk in r whose length is in header, and
+// removes the padding headers from it. It returns the bytes skipped.
+func DiscardPadding(r io.Reader, header http.Header) (int64, error) {
+	s := header.Get(PaddingBodyHeader)
+	for key := range header {
+		if strings.HasPrefix(key, PaddingHeader) {
+			delete(header, key)
+		}
+	}
+	if s == "" {
+		return 0, nil
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > maxPaddingChunk {
+		return 0, fmt.Errorf("invalid %s %#v", PaddingBodyHeader, s)
+	}
+	return io.CopyN(ioutil.Discard, r, n)
+}
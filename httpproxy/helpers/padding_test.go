@@ -0,0 +1,61 @@
+package helpers
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"testing"
+)
+
+func TestRandomPaddingOverhead(t *testing.T) {
+	cases := []struct {
+		size    int64
+		percent int
+		max     int
+		bound   int
+	}{
+		{0, 10, 1024, minPaddingBound},
+		{100, 10, 1024, minPaddingBound},
+		{10000, 10, 1024, 1000},
+		{1000000, 10, 1024, 1024},
+		{1000000, 0, 1024, 0},
+		{1000000, 10, 0, 0},
+	}
+
+	for _, c := range cases {
+		for i := 0; i < 1000; i++ {
+			if n := len(RandomPadding(c.size, c.percent, c.max)); n > c.bound {
+				t.Fatalf("RandomPadding(%d, %d, %d) is %d bytes, want at most %d", c.size, c.percent, c.max, n, c.bound)
+			}
+			// the header and the body chunk share the bound
+			h, b := RandomPaddings(c.size, c.percent, c.max)
+			if n := len(h) + len(b); n > c.bound {
+				t.Fatalf("RandomPaddings(%d, %d, %d) is %d bytes, want at most %d", c.size, c.percent, c.max, n, c.bound)
+			}
+		}
+	}
+}
+
+func TestDiscardPadding(t *testing.T) {
+	header := http.Header{}
+	header.Set(PaddingHeader, "junk")
+	header.Set(PaddingBodyHeader, "4")
+	header.Set("Content-Type", "text/plain")
+
+	r := bytes.NewReader([]byte("abcdbody"))
+	n, err := DiscardPadding(r, header)
+	if err != nil || n != 4 {
+		t.Fatalf("DiscardPadding() = %d, %v, want 4", n, err)
+	}
+	if body, _ := ioutil.ReadAll(r); string(body) != "body" {
+		t.Errorf("body after the padding is %#v, want \"body\"", string(body))
+	}
+	if len(header) != 1 {
+		t.Errorf("padding headers are left in %v", header)
+	}
+
+	header.Set(PaddingBodyHeader, "-1")
+	if _, err := DiscardPadding(r, header); err == nil {
+		t.Errorf("DiscardPadding() of a negative length should fail")
+	}
+}
@@ -0,0 +1,228 @@
+package helpers
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+)
+
+const (
+	DefaultPanicMaxPanics int           = 3
+	DefaultPanicCooldown  time.Duration = 10 * time.Minute
+
+	maxPanicRecords int = 1024
+)
+
+// PanicRecord is a filter which panicked on the requests of Pattern, Site is
+// the function and line which panicked the last time. The filter is bypassed
+// for them until Until.
+type PanicRecord struct {
+	Filter   string
+	Pattern  string
+	Value    string
+	Site     string
+	Count    int
+	Last     time.Time
+	Until    time.Time
+	Bypassed bool
+}
+
+// PanicGuard recovers the panics of filters, so that a buggy filter fails
+// only the request it panics on. After MaxPanics of a filter on the requests
+// of a pattern within Cooldown, the filter is bypassed for them until Cooldown
+// passes.
+type PanicGuard struct {
+	MaxPanics int
+	Cooldown  time.Duration
+
+	mu      sync.Mutex
+	records map[string]*PanicRecord
+}
+
+func NewPanicGuard(maxPanics int, cooldown time.Duration) *PanicGuard {
+	if maxPanics <= 0 {
+		maxPanics = DefaultPanicMaxPanics
+	}
+	if cooldown <= 0 {
+		cooldown = DefaultPanicCooldown
+	}
+
+	return &PanicGuard{
+		MaxPanics: maxPanics,
+		Cooldown:  cooldown,
+		records:   make(map[string]*PanicRecord),
+	}
+}
+
+// PanicPattern returns the pattern which the panics of a request count
+// against, its host and the first segment of its path, e.g.
+// "www.example.com/search".
+func PanicPattern(req *http.Request) string {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	if req.Method == http.MethodConnect {
+		return host
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	if i := strings.IndexByte(path, '/'); i >= 0 {
+		path = path[:i]
+	}
+	return host + "/" + path
+}
+
+// Bypassed reports whether filter is skipped for req.
+func (g *PanicGuard) Bypassed(filter string, req *http.Request) bool {
+	if g == nil {
+		return false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	r, ok := g.records[filter+" "+PanicPattern(req)]
+	return ok && time.Now().Before(r.Until)
+}
+
+// Recovered records v which filter panicked with on req and returns it as
+// an error. It must be called by the deferred function which recovered v.
+func (g *PanicGuard) Recovered(filter string, req *http.Request, v interface{}) error {
+	site := panicSite()
+	pattern := PanicPattern(req)
+	glog.Errorf("PANICGUARD: %s panic on %#v at %s: %v", filter, req.URL.String(), site, v)
+
+	if g != nil {
+		g.record(filter, pattern, fmt.Sprint(v), site)
+	}
+
+	return fmt.Errorf("filter %s panic: %v", filter, v)
+}
+
+func (g *PanicGuard) record(filter, pattern, value, site string) {
+	key := filter + " " + pattern
+	now := time.Now()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	r, ok := g.records[key]
+	if !ok || now.Sub(r.Last) > g.Cooldown {
+		if !ok && len(g.records) >= maxPanicRecords {
+			g.prune(now)
+		}
+		r = &PanicRecord{Filter: filter, Pattern: pattern}
+		g.records[key] = r
+	}
+
+	r.Value, r.Site, r.Last = value, site, now
+	r.Count++
+	if r.Count >= g.MaxPanics && now.After(r.Until) {
+		r.Until = now.Add(g.Cooldown)
+		glog.Warningf("PANICGUARD: %s panicked on %#v %d times, bypass it for %s", filter, pattern, r.Count, g.Cooldown)
+	}
+}
+
+// prune drops the records which are neither recent nor bypassing, and the
+// oldest ones if there are still too many.
+func (g *PanicGuard) prune(now time.Time) {
+	for key, r := range g.records {
+		if now.Sub(r.Last) > g.Cooldown && now.After(r.Until) {
+			delete(g.records, key)
+		}
+	}
+	for len(g.records) >= maxPanicRecords {
+		var oldest string
+		for key, r := range g.records {
+			if oldest == "" || r.Last.Before(g.records[oldest].Last) {
+				oldest = key
+			}
+		}
+		delete(g.records, oldest)
+	}
+}
+
+// Records returns the panics recorded within Cooldown and the bypasses, the
+// latest first.
+func (g *PanicGuard) Records() []PanicRecord {
+	now := time.Now()
+
+	g.mu.Lock()
+	records := make([]PanicRecord, 0, len(g.records))
+	for _, r := range g.records {
+		if now.Sub(r.Last) <= g.Cooldown || now.Before(r.Until) {
+			r1 := *r
+			r1.Bypassed = now.Before(r.Until)
+			records = append(records, r1)
+		}
+	}
+	g.mu.Unlock()
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Last.After(records[j].Last)
+	})
+	return records
+}
+
+// Reset forgets the panics of filter, all filters if it is empty, and stops
+// bypassing them.
+func (g *PanicGuard) Reset(filter string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for key, r := range g.records {
+		if filter == "" || r.Filter == filter {
+			delete(g.records, key)
+		}
+	}
+}
+
+// panicSite returns the function and line which panicked, it walks the stack
+// of the deferred function past runtime.gopanic.
+func panicSite() string {
+	pcs := make([]uintptr, 32)
+	n := runtime.Callers(3, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	panicking := false
+	for {
+		frame, more := frames.Next()
+		switch {
+		case frame.Function == "runtime.gopanic":
+			panicking = true
+		case panicking && !strings.HasPrefix(frame.Function, "runtime."):
+			return fmt.Sprintf("%s:%d", frame.Function, frame.Line)
+		}
+		if !more {
+			return "unknown"
+		}
+	}
+}
+
+var panicGuards = struct {
+	sync.Mutex
+	m map[string]*PanicGuard
+}{m: make(map[string]*PanicGuard)}
+
+func RegisterPanicGuard(name string, g *PanicGuard) {
+	panicGuards.Lock()
+	defer panicGuards.Unlock()
+	panicGuards.m[name] = g
+}
+
+func PanicGuards() map[string]*PanicGuard {
+	panicGuards.Lock()
+	defer panicGuards.Unlock()
+	m := make(map[string]*PanicGuard, len(panicGuards.m))
+	for name, g := range panicGuards.m {
+		m[name] = g
+	}
+	return m
+}
@@ -0,0 +1,153 @@
+package helpers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// the longest v1 header, "PROXY TCP6 <39> <39> 65535 65535\r\n"
+	proxyProtoV1MaxLen = 107
+)
+
+var proxyProtoV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn is a connection accepted behind a load balancer, its addresses
+// are the ones of the client connection announced in the PROXY header.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// ReadProxyHeader reads the HAProxy PROXY protocol v1 or v2 header of conn
+// within timeout and returns a conn which reports the announced addresses.
+// A LOCAL or UNKNOWN header keeps the addresses of conn.
+func ReadProxyHeader(conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	if timeout > 0 {
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	c := &proxyConn{
+		Conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+
+	sig, err := c.r.Peek(len(proxyProtoV2Sig))
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.Equal(sig, proxyProtoV2Sig):
+		err = c.readV2()
+	case bytes.HasPrefix(sig, []byte("PROXY ")):
+		err = c.readV1()
+	default:
+		err = fmt.Errorf("missing PROXY header from %s", conn.RemoteAddr())
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *proxyConn) readV1() error {
+	line := make([]byte, 0, proxyProtoV1MaxLen)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyProtoV1MaxLen {
+			return fmt.Errorf("PROXY v1 header too long from %s", c.Conn.RemoteAddr())
+		}
+		b, err := c.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+	}
+
+	parts := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(parts) >= 2 && parts[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(parts) != 6 || (parts[1] != "TCP4" && parts[1] != "TCP6") {
+		return fmt.Errorf("malformed PROXY v1 header %#v", string(line))
+	}
+
+	srcIP, dstIP := net.ParseIP(parts[2]), net.ParseIP(parts[3])
+	srcPort, err1 := strconv.ParseUint(parts[4], 10, 16)
+	dstPort, err2 := strconv.ParseUint(parts[5], 10, 16)
+	if srcIP == nil || dstIP == nil || err1 != nil || err2 != nil {
+		return fmt.Errorf("malformed PROXY v1 header %#v", string(line))
+	}
+
+	c.remote = &net.TCPAddr{IP: srcIP, Port: int(srcPort)}
+	c.local = &net.TCPAddr{IP: dstIP, Port: int(dstPort)}
+	return nil
+}
+
+func (c *proxyConn) readV2() error {
+	hdr := make([]byte, 16)
+	if _, err := io.ReadFull(c.r, hdr); err != nil {
+		return err
+	}
+
+	if hdr[12]>>4 != 2 {
+		return fmt.Errorf("unsupported PROXY v2 version %d", hdr[12]>>4)
+	}
+
+	data := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return err
+	}
+
+	// LOCAL command, e.g. health checks of the load balancer
+	if hdr[12]&0xf == 0 {
+		return nil
+	}
+
+	switch hdr[13] >> 4 {
+	case 1:
+		if len(data) < 12 {
+			return fmt.Errorf("short PROXY v2 AF_INET addresses")
+		}
+		c.remote = &net.TCPAddr{IP: net.IP(data[0:4]), Port: int(binary.BigEndian.Uint16(data[8:10]))}
+		c.local = &net.TCPAddr{IP: net.IP(data[4:8]), Port: int(binary.BigEndian.Uint16(data[10:12]))}
+	case 2:
+		if len(data) < 36 {
+			return fmt.Errorf("short PROXY v2 AF_INET6 addresses")
+		}
+		c.remote = &net.TCPAddr{IP: net.IP(data[0:16]), Port: int(binary.BigEndian.Uint16(data[32:34]))}
+		c.local = &net.TCPAddr{IP: net.IP(data[16:32]), Port: int(binary.BigEndian.Uint16(data[34:36]))}
+	}
+
+	return nil
+}
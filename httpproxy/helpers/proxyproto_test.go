@@ -0,0 +1,135 @@
+package helpers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func proxyProtoV2(command, family byte, addrs []byte) []byte {
+	hdr := append([]byte{}, proxyProtoV2Sig...)
+	hdr = append(hdr, 0x20|command, family<<4|1, 0, 0)
+	binary.BigEndian.PutUint16(hdr[14:16], uint16(len(addrs)))
+	return append(hdr, addrs...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	v4 := []byte{1, 2, 3, 4, 5, 6, 7, 8, 0x1f, 0x90, 0x01, 0xbb}
+	v6 := make([]byte, 36)
+	copy(v6[0:16], net.ParseIP("2001:db8::1"))
+	copy(v6[16:32], net.ParseIP("2001:db8::2"))
+	binary.BigEndian.PutUint16(v6[32:34], 8080)
+	binary.BigEndian.PutUint16(v6[34:36], 443)
+
+	cases := []struct {
+		name   string
+		header []byte
+		remote string
+		local  string
+		err    string
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 8080 443\r\n"), "1.2.3.4:8080", "5.6.7.8:443", ""},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 8080 443\r\n"), "[2001:db8::1]:8080", "[2001:db8::2]:443", ""},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", "", ""},
+		{"v1 bad port", []byte("PROXY TCP4 1.2.3.4 5.6.7.8 80800 443\r\n"), "", "", "malformed"},
+		{"v1 bad ip", []byte("PROXY TCP4 1.2.3 5.6.7.8 8080 443\r\n"), "", "", "malformed"},
+		{"v1 truncated", []byte("PROXY TCP4 1.2.3.4 5.6"), "", "", "EOF"},
+		{"v1 oversized", []byte("PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n"), "", "", "too long"},
+		{"v2 tcp4", proxyProtoV2(1, 1, v4), "1.2.3.4:8080", "5.6.7.8:443", ""},
+		{"v2 tcp6", proxyProtoV2(1, 2, v6), "[2001:db8::1]:8080", "[2001:db8::2]:443", ""},
+		{"v2 local", proxyProtoV2(0, 0, nil), "", "", ""},
+		{"v2 short addrs", proxyProtoV2(1, 1, v4[:8]), "", "", "short"},
+		{"v2 truncated", proxyProtoV2(1, 1, v4)[:20], "", "", "EOF"},
+		{"v2 bad version", append(append([]byte{}, proxyProtoV2Sig...), 0x11, 0x11, 0, 0), "", "", "unsupported"},
+		{"missing", []byte("GET / HTTP/1.1\r\n\r\n"), "", "", "missing"},
+	}
+
+	for _, c := range cases {
+		client, server := net.Pipe()
+		go func() {
+			client.Write(append(c.header, "payload"...))
+			client.Close()
+		}()
+
+		conn, err := ReadProxyHeader(server, time.Second)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: ReadProxyHeader() error %v, want %#v", c.name, err, c.err)
+			}
+			server.Close()
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: ReadProxyHeader() error: %v", c.name, err)
+			server.Close()
+			continue
+		}
+
+		remote, local := server.RemoteAddr().String(), server.LocalAddr().String()
+		if c.remote != "" {
+			remote, local = c.remote, c.local
+		}
+		if s := conn.RemoteAddr().String(); s != remote {
+			t.Errorf("%s: RemoteAddr() = %s, want %s", c.name, s, remote)
+		}
+		if s := conn.LocalAddr().String(); s != local {
+			t.Errorf("%s: LocalAddr() = %s, want %s", c.name, s, local)
+		}
+		if data, _ := ioutil.ReadAll(conn); !bytes.Equal(data, []byte("payload")) {
+			t.Errorf("%s: read %#v after the header, want \"payload\"", c.name, string(data))
+		}
+		conn.Close()
+	}
+}
+
+func TestListenerProxyProtocolTrusted(t *testing.T) {
+	for _, trusted := range []string{"127.0.0.1", "10.0.0.0/8"} {
+		ipnets, err := ParseIPNets([]string{trusted})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ln, err := ListenTCP("tcp", "127.0.0.1:0", &ListenOptions{
+			ProxyProtocol:        true,
+			ProxyProtocolTrusted: ipnets,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Write([]byte("PROXY TCP4 1.2.3.4 5.6.7.8 8080 443\r\n"))
+
+		accepted := make(chan net.Conn, 1)
+		go func() {
+			c, err := ln.Accept()
+			if err == nil {
+				accepted <- c
+			}
+		}()
+
+		select {
+		case c := <-accepted:
+			if trusted != "127.0.0.1" {
+				t.Errorf("trusted %s: accepted a PROXY header from 127.0.0.1", trusted)
+			} else if s := c.RemoteAddr().String(); s != "1.2.3.4:8080" {
+				t.Errorf("trusted %s: RemoteAddr() = %s, want 1.2.3.4:8080", trusted, s)
+			}
+			c.Close()
+		case <-time.After(500 * time.Millisecond):
+			if trusted == "127.0.0.1" {
+				t.Errorf("trusted %s: the PROXY header of 127.0.0.1 is not accepted", trusted)
+			}
+		}
+
+		conn.Close()
+		ln.Close()
+	}
+}
@@ -2,6 +2,7 @@ package helpers
 
 import (
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"reflect"
@@ -21,7 +22,17 @@ func reflectRemoteAddrFromResponse(resp *http.Response) (string, error) {
 		return "", fmt.Errorf("ReflectRemoteAddrFromResponse: cannot reflect %#v for %v", resp, resp.Request.URL.String())
 	}
 
-	v := reflect.ValueOf(resp.Body)
+	// look through the bodies wrapped by helpers, e.g. RoundTripWithDeadline
+	body := resp.Body
+	for {
+		u, ok := body.(interface{ unwrap() io.ReadCloser })
+		if !ok {
+			break
+		}
+		body = u.unwrap()
+	}
+
+	v := reflect.ValueOf(body)
 
 	switch v.Type().String() {
 	case "*http.gzipReader":
@@ -0,0 +1,99 @@
+package helpers
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+)
+
+const (
+	DefaultReplayMemory  int64 = 1024 * 1024
+	DefaultMaxReplaySize int64 = 32 * 1024 * 1024
+)
+
+// ReplayBody holds a request body so that it can be sent again by a retry,
+// once a try has drained the original one. It is read into memory, or a temp
+// file beyond memLimit.
+type ReplayBody struct {
+	buf  []byte
+	file *os.File
+	size int64
+}
+
+func NewReplayBody(r io.Reader, memLimit, maxSize int64) (*ReplayBody, error) {
+	var b bytes.Buffer
+	n, err := io.Copy(&b, io.LimitReader(r, memLimit+1))
+	if err != nil {
+		return nil, err
+	}
+	if n <= memLimit {
+		return &ReplayBody{buf: b.Bytes(), size: n}, nil
+	}
+
+	file, err := ioutil.TempFile("", "goproxy-spool-")
+	if err != nil {
+		return nil, err
+	}
+	rb := &ReplayBody{file: file}
+
+	n, err = io.Copy(file, io.MultiReader(&b, io.LimitReader(r, maxSize-n+1)))
+	if err == nil && n > maxSize {
+		err = fmt.Errorf("request body exceeds %d bytes", maxSize)
+	}
+	if err != nil {
+		rb.Close()
+		return nil, err
+	}
+	rb.size = n
+
+	return rb, nil
+}
+
+func (rb *ReplayBody) Size() int64 {
+	return rb.size
+}
+
+// Body returns a new reader from the start of the body.
+func (rb *ReplayBody) Body() io.ReadCloser {
+	if rb.file != nil {
+		return ioutil.NopCloser(io.NewSectionReader(rb.file, 0, rb.size))
+	}
+	return ioutil.NopCloser(bytes.NewReader(rb.buf))
+}
+
+func (rb *ReplayBody) Close() error {
+	if rb.file == nil {
+		return nil
+	}
+	rb.file.Close()
+	return os.Remove(rb.file.Name())
+}
+
+// ReplayableRequest reads the body of req into a ReplayBody and returns a
+// copy of req which sends it, with a known ContentLength and a GetBody for
+// the retries. The ReplayBody must be closed after the last try.
+func ReplayableRequest(req *http.Request, memLimit, maxSize int64) (*http.Request, *ReplayBody, error) {
+	rb, err := NewReplayBody(req.Body, memLimit, maxSize)
+	req.Body.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req1 := req.WithContext(req.Context())
+	req1.ContentLength = rb.Size()
+	req1.TransferEncoding = nil
+	req1.Body = rb.Body()
+	req1.GetBody = func() (io.ReadCloser, error) {
+		return rb.Body(), nil
+	}
+
+	return req1, rb, nil
+}
+
+// IsReplayable reports whether a retry of req can send its body again.
+func IsReplayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
@@ -0,0 +1,196 @@
+package helpers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Error classes of ErrorClass, the values of RetryPolicy.RetryOn.
+const (
+	RetryOnTimeout string = "timeout"
+	RetryOnConnect string = "connect"
+	RetryOnReset   string = "reset"
+	// the other network errors
+	RetryOnNetwork string = "network"
+	// a 5xx status of the fetch server
+	RetryOnStatus string = "status"
+	// the errors which are none of the above
+	RetryOnOther string = "other"
+)
+
+// RetryPolicy is how a filter retries a failed request: up to MaxAttempts
+// tries, waiting Backoff seconds before the first retry and twice as long
+// before each next one up to MaxBackoff, a random Jitter fraction of which
+// is taken off. Only the errors of RetryOn classes are retried, all if it is
+// empty. The methods of a nil RetryPolicy never retry.
+type RetryPolicy struct {
+	MaxAttempts int
+	Backoff     float64
+	MaxBackoff  float64
+	Jitter      float64
+	RetryOn     []string
+}
+
+var (
+	muRetryPolicies sync.RWMutex
+	retryPolicies   = make(map[string]*RetryPolicy)
+)
+
+// RegisterRetryPolicy names p, so that the filters can refer to it.
+func RegisterRetryPolicy(name string, p RetryPolicy) error {
+	if err := p.Validate(); err != nil {
+		return fmt.Errorf("retry policy %#v: %v", name, err)
+	}
+
+	muRetryPolicies.Lock()
+	defer muRetryPolicies.Unlock()
+
+	retryPolicies[name] = &p
+	return nil
+}
+
+func LookupRetryPolicy(name string) (*RetryPolicy, error) {
+	muRetryPolicies.RLock()
+	defer muRetryPolicies.RUnlock()
+
+	p, ok := retryPolicies[name]
+	if !ok {
+		return nil, fmt.Errorf("retry policy %#v not exists", name)
+	}
+	return p, nil
+}
+
+// NewRetryPolicy returns the policy named name, or the one of the legacy
+// RetryTimes and RetryDelay settings of a filter if name is empty.
+func NewRetryPolicy(name string, times int, delay time.Duration) (*RetryPolicy, error) {
+	if name != "" {
+		return LookupRetryPolicy(name)
+	}
+	return &RetryPolicy{
+		MaxAttempts: times,
+		Backoff:     delay.Seconds(),
+		MaxBackoff:  delay.Seconds(),
+	}, nil
+}
+
+func (p *RetryPolicy) Validate() error {
+	if p.MaxAttempts < 0 || p.Backoff < 0 || p.MaxBackoff < 0 {
+		return errors.New("MaxAttempts, Backoff and MaxBackoff must not be negative")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("Jitter %v is not in [0, 1]", p.Jitter)
+	}
+	for _, class := range p.RetryOn {
+		switch class {
+		case RetryOnTimeout, RetryOnConnect, RetryOnReset, RetryOnNetwork, RetryOnStatus, RetryOnOther:
+		default:
+			return fmt.Errorf("unknown RetryOn class %#v", class)
+		}
+	}
+	return nil
+}
+
+// Attempts returns the number of tries, at least 1.
+func (p *RetryPolicy) Attempts() int {
+	if p == nil || p.MaxAttempts <= 0 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) retryOn(class string) bool {
+	if p == nil {
+		return false
+	}
+	if len(p.RetryOn) == 0 {
+		return true
+	}
+	for _, c := range p.RetryOn {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// RetryError reports whether the class of err is retried.
+func (p *RetryPolicy) RetryError(err error) bool {
+	return err != nil && p.retryOn(ErrorClass(err))
+}
+
+// RetryStatus reports whether a fetch server response of code is retried.
+func (p *RetryPolicy) RetryStatus(code int) bool {
+	return code >= 500 && p.retryOn(RetryOnStatus)
+}
+
+// Delay returns the wait before retry n, which counts from 1.
+func (p *RetryPolicy) Delay(n int) time.Duration {
+	if p == nil || p.Backoff <= 0 || n <= 0 {
+		return 0
+	}
+
+	d := p.Backoff
+	for i := 1; i < n && (p.MaxBackoff <= 0 || d < p.MaxBackoff); i++ {
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		d -= d * p.Jitter * rand.Float64()
+	}
+
+	return time.Duration(d * float64(time.Second))
+}
+
+// Sleep waits the Delay of retry n, it returns early with the error of ctx
+// if ctx is done.
+func (p *RetryPolicy) Sleep(ctx context.Context, n int) error {
+	d := p.Delay(n)
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ErrorClass returns the RetryOn class of err.
+func ErrorClass(err error) string {
+	// the fetch server timeouts are wrapped with their kind
+	if ne, ok := err.(interface{ Timeout() bool }); ok && ne.Timeout() {
+		return RetryOnTimeout
+	}
+
+	var oe *net.OpError
+	if errors.As(err, &oe) && oe.Op == "dial" {
+		return RetryOnConnect
+	}
+
+	for _, e := range []error{io.EOF, io.ErrUnexpectedEOF, syscall.ECONNRESET, syscall.EPIPE} {
+		if errors.Is(err, e) {
+			return RetryOnReset
+		}
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return RetryOnNetwork
+	}
+
+	return RetryOnOther
+}
@@ -0,0 +1,179 @@
+package helpers
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+)
+
+// DefaultScheduler runs the periodic jobs of filters, its status is served by
+// the admin filter.
+var DefaultScheduler = NewScheduler()
+
+// JobStatus is the state of a job as shown in the dashboard.
+type JobStatus struct {
+	Name         string
+	Interval     string
+	Running      bool
+	Runs         int
+	Failures     int
+	LastRun      time.Time
+	LastDuration string
+	LastError    string
+	NextRun      time.Time
+}
+
+type job struct {
+	name     string
+	interval time.Duration
+	run      func() error
+	trigger  chan struct{}
+	stop     chan struct{}
+
+	mu     sync.Mutex
+	status JobStatus
+}
+
+// Scheduler runs each job in its own goroutine every interval, a run which
+// is still in progress is never overlapped.
+type Scheduler struct {
+	mu   sync.Mutex
+	jobs map[string]*job
+}
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{
+		jobs: make(map[string]*job),
+	}
+}
+
+// Every schedules run every interval, the first run is at once if immediate
+// is true. A job of the same name is replaced, e.g. when a filter reloads.
+func (s *Scheduler) Every(name string, interval time.Duration, immediate bool, run func() error) {
+	if interval <= 0 {
+		return
+	}
+
+	j := &job{
+		name:     name,
+		interval: interval,
+		run:      run,
+		trigger:  make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+	}
+	j.status.Name = name
+	j.status.Interval = interval.String()
+
+	s.mu.Lock()
+	if old, ok := s.jobs[name]; ok {
+		close(old.stop)
+	}
+	s.jobs[name] = j
+	s.mu.Unlock()
+
+	if immediate {
+		j.trigger <- struct{}{}
+	}
+
+	go j.loop()
+}
+
+// Cancel stops the job name, a run in progress is not interrupted.
+func (s *Scheduler) Cancel(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if j, ok := s.jobs[name]; ok {
+		close(j.stop)
+		delete(s.jobs, name)
+	}
+}
+
+// RunNow triggers the job name out of its schedule.
+func (s *Scheduler) RunNow(name string) error {
+	s.mu.Lock()
+	j, ok := s.jobs[name]
+	s.mu.Unlock()
+
+	if !ok {
+		return fmt.Errorf("job %#v not exists", name)
+	}
+
+	select {
+	case j.trigger <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Jobs returns the status of all jobs ordered by name.
+func (s *Scheduler) Jobs() []JobStatus {
+	s.mu.Lock()
+	jobs := make([]*job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, j)
+	}
+	s.mu.Unlock()
+
+	statuses := make([]JobStatus, 0, len(jobs))
+	for _, j := range jobs {
+		j.mu.Lock()
+		statuses = append(statuses, j.status)
+		j.mu.Unlock()
+	}
+
+	sort.Slice(statuses, func(i, k int) bool { return statuses[i].Name < statuses[k].Name })
+	return statuses
+}
+
+func (j *job) loop() {
+	timer := time.NewTimer(j.interval)
+	defer timer.Stop()
+
+	j.mu.Lock()
+	j.status.NextRun = time.Now().Add(j.interval)
+	j.mu.Unlock()
+
+	for {
+		select {
+		case <-j.stop:
+			return
+		case <-j.trigger:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-timer.C:
+		}
+
+		j.execute()
+		timer.Reset(j.interval)
+	}
+}
+
+func (j *job) execute() {
+	start := time.Now()
+
+	j.mu.Lock()
+	j.status.Running = true
+	j.mu.Unlock()
+
+	err := j.run()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.status.Running = false
+	j.status.Runs++
+	j.status.LastRun = start
+	j.status.LastDuration = time.Since(start).String()
+	j.status.LastError = ""
+	j.status.NextRun = time.Now().Add(j.interval)
+	if err != nil {
+		j.status.Failures++
+		j.status.LastError = err.Error()
+		glog.Warningf("SCHEDULER: job %#v error: %v", j.name, err)
+	}
+}
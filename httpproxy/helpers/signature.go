@@ -0,0 +1,281 @@
+package helpers
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+)
+
+const (
+	DefaultSignatureWindow time.Duration = 5 * time.Minute
+)
+
+var (
+	ErrSignatureInvalid  = errors.New("signature: invalid")
+	ErrSignatureMismatch = errors.New("signature: mismatch")
+	ErrSignatureExpired  = errors.New("signature: timestamp out of window")
+	ErrSignatureReplayed = errors.New("signature: nonce replayed")
+	ErrSignatureNoSecret = errors.New("signature: unknown user")
+	ErrSignatureNoKey    = errors.New("signature: unknown key id")
+	ErrSignatureRetired  = errors.New("signature: key retired")
+)
+
+// Signature authenticates a request to a fetchserver with a HMAC-SHA256 over
+// method, url, timestamp and nonce, so the secret is never sent in plaintext.
+// KeyID tells the fetchserver which of the user's secrets signed the request.
+type Signature struct {
+	User      string
+	KeyID     string
+	Timestamp int64
+	Nonce     string
+	Sign      string
+}
+
+func NewSignature(secret, keyID, user, method, rawurl string) *Signature {
+	b := make([]byte, 12)
+	rand.Read(b)
+
+	s := &Signature{
+		User:      user,
+		KeyID:     keyID,
+		Timestamp: time.Now().Unix(),
+		Nonce:     hex.EncodeToString(b),
+	}
+	s.Sign = s.compute(secret, method, rawurl)
+
+	return s
+}
+
+func (s *Signature) compute(secret, method, rawurl string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	if s.KeyID == "" {
+		fmt.Fprintf(mac, "%s\n%s\n%s\n%d\n%s", s.User, method, rawurl, s.Timestamp, s.Nonce)
+	} else {
+		fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%d\n%s", s.User, s.KeyID, method, rawurl, s.Timestamp, s.Nonce)
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Signature) String() string {
+	if s.KeyID != "" {
+		return fmt.Sprintf("user=%s, kid=%s, ts=%d, nonce=%s, sig=%s", s.User, s.KeyID, s.Timestamp, s.Nonce, s.Sign)
+	}
+	return fmt.Sprintf("user=%s, ts=%d, nonce=%s, sig=%s", s.User, s.Timestamp, s.Nonce, s.Sign)
+}
+
+func ParseSignature(value string) (*Signature, error) {
+	s := new(Signature)
+
+	for _, part := range strings.Split(value, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) != 2 {
+			return nil, ErrSignatureInvalid
+		}
+		switch kv[0] {
+		case "user":
+			s.User = kv[1]
+		case "kid":
+			s.KeyID = kv[1]
+		case "ts":
+			ts, err := strconv.ParseInt(kv[1], 10, 64)
+			if err != nil {
+				return nil, ErrSignatureInvalid
+			}
+			s.Timestamp = ts
+		case "nonce":
+			s.Nonce = kv[1]
+		case "sig":
+			s.Sign = kv[1]
+		}
+	}
+
+	if s.Timestamp == 0 || s.Nonce == "" || s.Sign == "" {
+		return nil, ErrSignatureInvalid
+	}
+
+	return s, nil
+}
+
+// SignatureKey is one accepted secret of a user. A zero NotAfter never
+// retires, so old and new keys can overlap while clients are rotated.
+type SignatureKey struct {
+	ID       string
+	Secret   string
+	NotAfter time.Time
+}
+
+// SignatureVerifier checks signatures on the fetchserver side. Nonces seen
+// within Window are remembered to reject replayed requests.
+type SignatureVerifier struct {
+	Keys   map[string][]SignatureKey
+	Window time.Duration
+	Nonces lrucache.Cache
+	mu     sync.RWMutex
+}
+
+func NewSignatureVerifier(secrets map[string]string, window time.Duration) *SignatureVerifier {
+	if window <= 0 {
+		window = DefaultSignatureWindow
+	}
+
+	v := &SignatureVerifier{
+		Keys:   make(map[string][]SignatureKey),
+		Window: window,
+		Nonces: lrucache.NewLRUCache(64 * 1024),
+	}
+
+	for user, secret := range secrets {
+		v.AddKey(user, SignatureKey{Secret: secret})
+	}
+
+	return v
+}
+
+// AddKey accepts key for user, replacing the key with the same ID.
+func (v *SignatureVerifier) AddKey(user string, key SignatureKey) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	keys := v.Keys[user]
+	for i, k := range keys {
+		if k.ID == key.ID {
+			keys[i] = key
+			return
+		}
+	}
+	v.Keys[user] = append(keys, key)
+}
+
+// RemoveKey stops accepting the key of user with id.
+func (v *SignatureVerifier) RemoveKey(user, id string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	keys := v.Keys[user]
+	for i, k := range keys {
+		if k.ID == id {
+			v.Keys[user] = append(keys[:i:i], keys[i+1:]...)
+			break
+		}
+	}
+	if len(v.Keys[user]) == 0 {
+		delete(v.Keys, user)
+	}
+}
+
+// match finds the key which produced s. Untagged signatures are tried
+// against every untagged key of the user.
+func (v *SignatureVerifier) match(s *Signature, method, rawurl string, now time.Time) (*SignatureKey, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	keys, ok := v.Keys[s.User]
+	if !ok {
+		return nil, ErrSignatureNoSecret
+	}
+
+	err := ErrSignatureNoKey
+	for i := range keys {
+		key := &keys[i]
+		if key.ID != s.KeyID {
+			continue
+		}
+		if !key.NotAfter.IsZero() && now.After(key.NotAfter) {
+			err = ErrSignatureRetired
+			continue
+		}
+		if hmac.Equal([]byte(s.Sign), []byte(s.compute(key.Secret, method, rawurl))) {
+			return key, nil
+		}
+		err = ErrSignatureMismatch
+	}
+
+	return nil, err
+}
+
+// HasSecret tells whether secret is an accepted key of user, for the clients
+// which send the secret itself in an encrypted channel.
+func (v *SignatureVerifier) HasSecret(user, secret string) bool {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	now := time.Now()
+	for _, key := range v.Keys[user] {
+		if !key.NotAfter.IsZero() && now.After(key.NotAfter) {
+			continue
+		}
+		if hmac.Equal([]byte(secret), []byte(key.Secret)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (v *SignatureVerifier) Verify(value, method, rawurl string) (*Signature, error) {
+	s, err := ParseSignature(value)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if d := now.Sub(time.Unix(s.Timestamp, 0)); d > v.Window || d < -v.Window {
+		return nil, ErrSignatureExpired
+	}
+
+	if _, err := v.match(s, method, rawurl, now); err != nil {
+		return nil, err
+	}
+
+	if _, ok := v.Nonces.GetNotStale(s.Nonce); ok {
+		return nil, ErrSignatureReplayed
+	}
+	v.Nonces.Set(s.Nonce, struct{}{}, now.Add(2*v.Window))
+
+	return s, nil
+}
+
+// signatureURL is the url a request is signed over. The server side of a
+// fetch sees only the path, so the scheme and the host are filled in from the
+// connection and the Host header, which the client keeps when fronting.
+func signatureURL(req *http.Request) string {
+	u := *req.URL
+	if u.Scheme == "" {
+		if req.TLS != nil {
+			u.Scheme = "https"
+		} else {
+			u.Scheme = "http"
+		}
+	}
+	if req.Host != "" {
+		u.Host = req.Host
+	}
+	return u.String()
+}
+
+// SignRequest sets the "HMAC" Proxy-Authorization of req, signed by secret.
+func SignRequest(req *http.Request, secret, keyID, user string) {
+	req.Header.Set("Proxy-Authorization", "HMAC "+NewSignature(secret, keyID, user, req.Method, signatureURL(req)).String())
+}
+
+// VerifyRequest checks the "HMAC" Proxy-Authorization sent by vps clients and
+// by the fetches of SignRequest, it fits as the authorized func of
+// NewCamouflageHandler.
+func (v *SignatureVerifier) VerifyRequest(req *http.Request) bool {
+	auth := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(auth, "HMAC ") {
+		return false
+	}
+
+	_, err := v.Verify(auth[5:], req.Method, signatureURL(req))
+	return err == nil
+}
@@ -0,0 +1,61 @@
+package helpers
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignatureVerify(t *testing.T) {
+	v := NewSignatureVerifier(map[string]string{"test": "123456"}, 0)
+
+	value := NewSignature("123456", "", "test", "GET", "http://www.example.com/").String()
+
+	if _, err := v.Verify(value, "GET", "http://www.example.com/"); err != nil {
+		t.Errorf("Verify(%#v) error: %v", value, err)
+	}
+
+	if _, err := v.Verify(value, "GET", "http://www.example.com/"); err != ErrSignatureReplayed {
+		t.Errorf("Verify(%#v) replayed should return %v, got %v", value, ErrSignatureReplayed, err)
+	}
+
+	value = NewSignature("123456", "", "test", "GET", "http://www.example.com/").String()
+	if _, err := v.Verify(value, "POST", "http://www.example.com/"); err != ErrSignatureMismatch {
+		t.Errorf("Verify(%#v) tampered should return %v, got %v", value, ErrSignatureMismatch, err)
+	}
+
+	value = NewSignature("654321", "", "nobody", "GET", "http://www.example.com/").String()
+	if _, err := v.Verify(value, "GET", "http://www.example.com/"); err != ErrSignatureNoSecret {
+		t.Errorf("Verify(%#v) unknown user should return %v, got %v", value, ErrSignatureNoSecret, err)
+	}
+}
+
+func TestSignatureKeyRotation(t *testing.T) {
+	v := NewSignatureVerifier(nil, 0)
+	v.AddKey("test", SignatureKey{ID: "old", Secret: "123456"})
+	v.AddKey("test", SignatureKey{ID: "new", Secret: "654321"})
+
+	for _, kid := range []string{"old", "new"} {
+		secret := map[string]string{"old": "123456", "new": "654321"}[kid]
+		value := NewSignature(secret, kid, "test", "GET", "http://www.example.com/").String()
+		if _, err := v.Verify(value, "GET", "http://www.example.com/"); err != nil {
+			t.Errorf("Verify(%#v) error: %v", value, err)
+		}
+	}
+
+	value := NewSignature("123456", "new", "test", "GET", "http://www.example.com/").String()
+	if _, err := v.Verify(value, "GET", "http://www.example.com/"); err != ErrSignatureMismatch {
+		t.Errorf("Verify(%#v) wrong secret should return %v, got %v", value, ErrSignatureMismatch, err)
+	}
+
+	v.RemoveKey("test", "old")
+	value = NewSignature("123456", "old", "test", "GET", "http://www.example.com/").String()
+	if _, err := v.Verify(value, "GET", "http://www.example.com/"); err != ErrSignatureNoKey {
+		t.Errorf("Verify(%#v) removed key should return %v, got %v", value, ErrSignatureNoKey, err)
+	}
+
+	v.AddKey("test", SignatureKey{ID: "new", Secret: "654321", NotAfter: time.Now().Add(-time.Second)})
+	value = NewSignature("654321", "new", "test", "GET", "http://www.example.com/").String()
+	if _, err := v.Verify(value, "GET", "http://www.example.com/"); err != ErrSignatureRetired {
+		t.Errorf("Verify(%#v) retired key should return %v, got %v", value, ErrSignatureRetired, err)
+	}
+}
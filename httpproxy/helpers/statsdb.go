@@ -0,0 +1,10 @@
+package helpers
+
+// StatsRow is one group of a StatsDB.Query result.
+type StatsRow struct {
+	Group         map[string]string `json:"group"`
+	Requests      int64             `json:"requests"`
+	RequestBytes  int64             `json:"request_bytes"`
+	ResponseBytes int64             `json:"response_bytes"`
+	Latency       float64           `json:"avg_latency_ms"`
+}
@@ -0,0 +1,45 @@
+// +build !sqlite
+
+package helpers
+
+import (
+	"errors"
+	"time"
+)
+
+var errNoSQLite = errors.New("StatsDB: not built with sqlite, build with \"-tags sqlite\"")
+
+// StatsDB is the stub of a build without "-tags sqlite", it cannot be opened.
+type StatsDB struct {
+	Filename  string
+	Retention time.Duration
+}
+
+func OpenStatsDB(filename string, retention time.Duration) (*StatsDB, error) {
+	return nil, errNoSQLite
+}
+
+// DefaultStatsDB returns nil, no StatsDB is ever opened.
+func DefaultStatsDB() *StatsDB {
+	return nil
+}
+
+func (s *StatsDB) Log(e *AccessLogEntry) error {
+	return errNoSQLite
+}
+
+func (s *StatsDB) Prune(t time.Time) (int64, error) {
+	return 0, errNoSQLite
+}
+
+func (s *StatsDB) Query(from, to time.Time, groups []string) ([]StatsRow, error) {
+	return nil, errNoSQLite
+}
+
+func (s *StatsDB) Backup() error {
+	return errNoSQLite
+}
+
+func (s *StatsDB) Close() error {
+	return nil
+}
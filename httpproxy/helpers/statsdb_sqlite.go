@@ -0,0 +1,338 @@
+// +build sqlite
+
+package helpers
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/phuslu/glog"
+
+	"../storage"
+)
+
+const (
+	statsFlushInterval time.Duration = time.Second
+	statsQueueSize     int           = 4096
+	statsBackupSuffix  string        = ".bak"
+)
+
+const statsSchema = `
+CREATE TABLE IF NOT EXISTS requests (
+	time           INTEGER NOT NULL,
+	request_id     TEXT,
+	client         TEXT,
+	method         TEXT,
+	host           TEXT,
+	filter         TEXT,
+	upstream       TEXT,
+	status         INTEGER,
+	request_bytes  INTEGER,
+	response_bytes INTEGER,
+	latency_ms     REAL
+);
+CREATE INDEX IF NOT EXISTS requests_time ON requests (time);
+`
+
+// statsGroups are the columns StatsDB.Query can group by, "day" and "month"
+// are derived from the request time in UTC.
+var statsGroups = map[string]string{
+	"day":    "strftime('%Y-%m-%d', time, 'unixepoch')",
+	"month":  "strftime('%Y-%m', time, 'unixepoch')",
+	"host":   "host",
+	"filter": "filter",
+	"status": "status",
+}
+
+// StatsDB keeps the access log entries in a SQLite file for usage reports,
+// entries older than Retention are deleted hourly by DefaultScheduler. Entries are queued and
+// inserted in batches, so Log does not block the request. go-sqlite3 needs
+// cgo, so it is only built in with "-tags sqlite".
+type StatsDB struct {
+	Filename  string
+	Retention time.Duration
+
+	db      *sql.DB
+	queue   chan *AccessLogEntry
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+}
+
+var (
+	statsDBs       = make(map[string]*StatsDB)
+	defaultStatsDB *StatsDB
+	muStatsDBs     sync.Mutex
+)
+
+// OpenStatsDB opens or creates filename, profiles which share a filename share
+// the StatsDB. The first one opened is also returned by DefaultStatsDB.
+func OpenStatsDB(filename string, retention time.Duration) (*StatsDB, error) {
+	muStatsDBs.Lock()
+	defer muStatsDBs.Unlock()
+
+	if s, ok := statsDBs[filename]; ok {
+		return s, nil
+	}
+
+	db, err := openStatsDB(filename)
+	if err != nil {
+		glog.Warningf("StatsDB %#v error: %v, restore the last backup", filename, err)
+		if db, err = restoreStatsDB(filename); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &StatsDB{
+		Filename:  filename,
+		Retention: retention,
+		db:        db,
+		queue:     make(chan *AccessLogEntry, statsQueueSize),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+
+	go s.loop()
+
+	DefaultScheduler.Every("stats.backup "+filename, 24*time.Hour, false, s.Backup)
+
+	if retention > 0 {
+		DefaultScheduler.Every("stats.prune "+filename, time.Hour, true, func() error {
+			n, err := s.Prune(time.Now().Add(-retention))
+			if n > 0 {
+				glog.V(2).Infof("StatsDB %#v pruned %d entries", filename, n)
+			}
+			return err
+		})
+	}
+
+	statsDBs[filename] = s
+	if defaultStatsDB == nil {
+		defaultStatsDB = s
+	}
+	return s, nil
+}
+
+// openStatsDB opens filename in WAL mode, which survives a power loss, and
+// checks it is not corrupted.
+func openStatsDB(filename string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return nil, err
+	}
+	// sqlite allows a single writer
+	db.SetMaxOpenConns(1)
+
+	var result string
+	if err = db.QueryRow("PRAGMA quick_check").Scan(&result); err == nil && result != "ok" {
+		err = fmt.Errorf("quick_check: %s", result)
+	}
+	if err == nil {
+		_, err = db.Exec("PRAGMA journal_mode=WAL; PRAGMA synchronous=NORMAL;" + statsSchema)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// restoreStatsDB moves the corrupted filename aside and opens a copy of its
+// last backup, or a new file if there is none.
+func restoreStatsDB(filename string) (*sql.DB, error) {
+	corrupted := fmt.Sprintf("%s.corrupted-%d", filename, time.Now().Unix())
+	if err := os.Rename(filename, corrupted); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	os.Remove(filename + "-wal")
+	os.Remove(filename + "-shm")
+
+	if data, err := ioutil.ReadFile(filename + statsBackupSuffix); err == nil {
+		if err = storage.ReplaceFile(filename, data, 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	db, err := openStatsDB(filename)
+	if err != nil {
+		return nil, fmt.Errorf("StatsDB %#v restore error: %v", filename, err)
+	}
+
+	glog.Warningf("StatsDB %#v is restored, the corrupted one is kept as %#v", filename, corrupted)
+	return db, nil
+}
+
+// Backup writes a consistent copy of the file to Filename.bak, which is
+// restored if the file is found corrupted on open.
+func (s *StatsDB) Backup() error {
+	tmpname := s.Filename + statsBackupSuffix + ".tmp"
+	os.Remove(tmpname)
+
+	if _, err := s.db.Exec("VACUUM INTO ?", tmpname); err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+
+	return os.Rename(tmpname, s.Filename+statsBackupSuffix)
+}
+
+// DefaultStatsDB returns the first opened StatsDB, or nil.
+func DefaultStatsDB() *StatsDB {
+	muStatsDBs.Lock()
+	defer muStatsDBs.Unlock()
+	return defaultStatsDB
+}
+
+// Log queues e, it is dropped if the queue is full.
+func (s *StatsDB) Log(e *AccessLogEntry) error {
+	select {
+	case s.queue <- e:
+		return nil
+	default:
+		return fmt.Errorf("StatsDB %#v queue is full", s.Filename)
+	}
+}
+
+func (s *StatsDB) loop() {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(statsFlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*AccessLogEntry, 0, 256)
+	for {
+		select {
+		case e := <-s.queue:
+			batch = append(batch, e)
+			if len(batch) < cap(batch) {
+				continue
+			}
+		case <-ticker.C:
+		case <-s.done:
+			for len(s.queue) > 0 {
+				batch = append(batch, <-s.queue)
+			}
+			if err := s.insert(batch); err != nil {
+				glog.Warningf("StatsDB %#v insert %d entries error: %v", s.Filename, len(batch), err)
+			}
+			return
+		}
+
+		if err := s.insert(batch); err != nil {
+			glog.Warningf("StatsDB %#v insert %d entries error: %v", s.Filename, len(batch), err)
+		}
+		batch = batch[:0]
+	}
+}
+
+func (s *StatsDB) insert(batch []*AccessLogEntry) error {
+	if len(batch) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare("INSERT INTO requests VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, e := range batch {
+		if _, err := stmt.Exec(e.Time.Unix(), e.RequestID, e.Client, e.Method, e.Host, e.Filter, e.Upstream, e.Status, e.RequestBytes, e.ResponseBytes, e.Latency); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Prune deletes the entries before t and returns how many were deleted.
+func (s *StatsDB) Prune(t time.Time) (int64, error) {
+	r, err := s.db.Exec("DELETE FROM requests WHERE time < ?", t.Unix())
+	if err != nil {
+		return 0, err
+	}
+	return r.RowsAffected()
+}
+
+// Query sums the entries in [from, to) by groups, e.g. "month" and "filter"
+// for a month over month usage report of each egress.
+func (s *StatsDB) Query(from, to time.Time, groups []string) ([]StatsRow, error) {
+	columns := ""
+	for i, g := range groups {
+		expr, ok := statsGroups[g]
+		if !ok {
+			return nil, fmt.Errorf("StatsDB: unknown group %#v", g)
+		}
+		if i > 0 {
+			columns += ", "
+		}
+		columns += expr
+	}
+
+	query := "SELECT COUNT(*), SUM(request_bytes), SUM(response_bytes), AVG(latency_ms)"
+	if columns != "" {
+		query += ", " + columns
+	}
+	query += " FROM requests WHERE time >= ? AND time < ?"
+	if columns != "" {
+		query += " GROUP BY " + columns + " ORDER BY " + columns
+	}
+
+	rows, err := s.db.Query(query, from.Unix(), to.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]StatsRow, 0)
+	for rows.Next() {
+		var requestBytes, responseBytes sql.NullInt64
+		var latency sql.NullFloat64
+		values := make([]sql.NullString, len(groups))
+
+		dest := []interface{}{new(int64), &requestBytes, &responseBytes, &latency}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+
+		row := StatsRow{
+			Group:         make(map[string]string, len(groups)),
+			Requests:      *dest[0].(*int64),
+			RequestBytes:  requestBytes.Int64,
+			ResponseBytes: responseBytes.Int64,
+			Latency:       latency.Float64,
+		}
+		for i, g := range groups {
+			row.Group[g] = values[i].String
+		}
+		result = append(result, row)
+	}
+
+	return result, rows.Err()
+}
+
+// Close flushes the queued entries and closes the file.
+func (s *StatsDB) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+	})
+	<-s.stopped
+	return s.db.Close()
+}
@@ -0,0 +1,93 @@
+package helpers
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// the first fd passed by systemd socket activation
+const listenFdsStart = 3
+
+var systemdSockets struct {
+	once  sync.Once
+	mu    sync.Mutex
+	lns   []net.Listener
+	names []string
+	taken []bool
+	err   error
+}
+
+// loadSystemdSockets takes over the sockets of LISTEN_FDS, which systemd
+// passes when it starts us for a .socket unit, and clears the variables so
+// that our children do not take them too.
+func loadSystemdSockets() {
+	s := &systemdSockets
+
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if pid != strconv.Itoa(os.Getpid()) {
+		s.err = fmt.Errorf("no sockets passed by systemd, LISTEN_PID is %#v", pid)
+		return
+	}
+
+	n, err := strconv.Atoi(fds)
+	if err != nil || n <= 0 {
+		s.err = fmt.Errorf("no sockets passed by systemd, LISTEN_FDS is %#v", fds)
+		return
+	}
+
+	for i := 0; i < n; i++ {
+		name := strconv.Itoa(i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		// FileListener dups the fd with close-on-exec, the original is closed
+		f := os.NewFile(uintptr(listenFdsStart+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			s.err = fmt.Errorf("systemd socket %#v: %v", name, err)
+			return
+		}
+
+		s.lns = append(s.lns, ln)
+		s.names = append(s.names, name)
+		s.taken = append(s.taken, false)
+	}
+}
+
+// SystemdListener returns a socket passed by systemd, by its FileDescriptorName
+// or its index, or the first one not taken yet if name is empty. Each socket is
+// taken once.
+func SystemdListener(name string) (net.Listener, error) {
+	s := &systemdSockets
+	s.once.Do(loadSystemdSockets)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	for i, ln := range s.lns {
+		if s.taken[i] {
+			continue
+		}
+		if name == "" || name == s.names[i] || name == strconv.Itoa(i) {
+			s.taken[i] = true
+			return ln, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no systemd socket %#v left in %v", name, s.names)
+}
@@ -0,0 +1,218 @@
+package helpers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+)
+
+const (
+	DefaultTelemetryInterval time.Duration = 24 * time.Hour
+	DefaultTelemetryEpsilon  float64       = 1
+	DefaultTelemetryMinCount int           = 20
+
+	telemetryTimeout time.Duration = 30 * time.Second
+)
+
+// TelemetryCount is the dial attempts of a strategy.
+type TelemetryCount struct {
+	OK    float64
+	Error float64
+}
+
+type TelemetryRow struct {
+	Strategy string `json:"strategy"`
+	OK       int64  `json:"ok"`
+	Error    int64  `json:"error"`
+}
+
+// TelemetryReport is all that a Telemetry sends, nothing else leaves the
+// process.
+type TelemetryReport struct {
+	Region string         `json:"region"`
+	ISP    string         `json:"isp"`
+	Period int64          `json:"period"`
+	Rows   []TelemetryRow `json:"rows"`
+}
+
+// Telemetry is the opt-in report of which fronting strategies still work
+// where. Every Interval it posts a TelemetryReport to Endpoint:
+//
+//   - Region and ISP are the labels configured by the user, they are never
+//     looked up from the ip
+//   - a strategy is e.g. "type=tls,sni=cross,fingerprint=chrome,ech=false",
+//     ips, hosts, aliases and requests are never sent
+//   - the counts are the dial attempts in the period plus Laplace noise of
+//     scale 1/Epsilon, rounded, and the strategies with less than MinCount
+//     attempts are left out
+//
+// Endpoint still sees the ip which the report comes from, like any site.
+type Telemetry struct {
+	Endpoint string
+	Region   string
+	ISP      string
+	Interval time.Duration
+	Epsilon  float64
+	MinCount int
+	// returns the cumulative counts by strategy, the report sends the
+	// difference since the previous one
+	Source func() map[string]TelemetryCount
+	Client *http.Client
+
+	mu         sync.Mutex
+	last       map[string]TelemetryCount
+	lastTime   time.Time
+	lastReport *TelemetryReport
+}
+
+var (
+	telemetries   = make(map[string]*Telemetry)
+	muTelemetries sync.Mutex
+)
+
+// StartTelemetry schedules t as the job "telemetry <name>", a Telemetry of
+// the same name is replaced, e.g. when a filter reloads.
+func StartTelemetry(name string, t *Telemetry) error {
+	u, err := url.Parse(t.Endpoint)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("Telemetry: invalid Endpoint %#v", t.Endpoint)
+	}
+	if t.Source == nil {
+		return fmt.Errorf("Telemetry: no Source")
+	}
+	if t.Interval <= 0 {
+		t.Interval = DefaultTelemetryInterval
+	}
+	if t.Epsilon <= 0 {
+		t.Epsilon = DefaultTelemetryEpsilon
+	}
+	if t.MinCount <= 0 {
+		t.MinCount = DefaultTelemetryMinCount
+	}
+	if t.Client == nil {
+		t.Client = &http.Client{Timeout: telemetryTimeout}
+	}
+
+	// the attempts before opting in are not reported
+	t.last = t.Source()
+	t.lastTime = time.Now()
+
+	muTelemetries.Lock()
+	telemetries[name] = t
+	muTelemetries.Unlock()
+
+	glog.Infof("Telemetry %#v: report coarse dial success counts of region %#v isp %#v to %#v every %s", name, t.Region, t.ISP, t.Endpoint, t.Interval)
+	DefaultScheduler.Every("telemetry "+name, t.Interval, false, t.Send)
+
+	return nil
+}
+
+// StopTelemetry cancels the Telemetry of name if there is one.
+func StopTelemetry(name string) {
+	muTelemetries.Lock()
+	_, ok := telemetries[name]
+	delete(telemetries, name)
+	muTelemetries.Unlock()
+
+	if ok {
+		DefaultScheduler.Cancel("telemetry " + name)
+	}
+}
+
+// LastTelemetryReports returns the last report sent by each Telemetry, so
+// that users can see exactly what was sent.
+func LastTelemetryReports() map[string]*TelemetryReport {
+	muTelemetries.Lock()
+	defer muTelemetries.Unlock()
+
+	reports := make(map[string]*TelemetryReport, len(telemetries))
+	for name, t := range telemetries {
+		t.mu.Lock()
+		reports[name] = t.lastReport
+		t.mu.Unlock()
+	}
+	return reports
+}
+
+// Report builds the report of the period since the previous one.
+func (t *Telemetry) Report() *TelemetryReport {
+	counts := t.Source()
+	now := time.Now()
+
+	t.mu.Lock()
+	last, lastTime := t.last, t.lastTime
+	t.last, t.lastTime = counts, now
+	t.mu.Unlock()
+
+	scale := 1 / t.Epsilon
+	rows := make([]TelemetryRow, 0)
+	for strategy, c := range counts {
+		c0 := last[strategy]
+		ok := noisyCount(c.OK-c0.OK, scale)
+		fail := noisyCount(c.Error-c0.Error, scale)
+		if ok+fail < int64(t.MinCount) {
+			continue
+		}
+		rows = append(rows, TelemetryRow{strategy, ok, fail})
+	}
+	sort.Slice(rows, func(i, j int) bool { return rows[i].Strategy < rows[j].Strategy })
+
+	return &TelemetryReport{
+		Region: t.Region,
+		ISP:    t.ISP,
+		Period: int64(now.Sub(lastTime).Seconds()),
+		Rows:   rows,
+	}
+}
+
+// Send posts the report to Endpoint, an empty one is not sent.
+func (t *Telemetry) Send() error {
+	r := t.Report()
+	if len(r.Rows) == 0 {
+		glog.V(2).Infof("Telemetry: nothing to report to %#v", t.Endpoint)
+		return nil
+	}
+
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.Client.Post(t.Endpoint, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("Telemetry: %#v returns %s", t.Endpoint, resp.Status)
+	}
+
+	t.mu.Lock()
+	t.lastReport = r
+	t.mu.Unlock()
+
+	glog.V(2).Infof("Telemetry: sent %s to %#v", data, t.Endpoint)
+	return nil
+}
+
+// noisyCount adds Laplace noise of scale to n and rounds it, a count never
+// goes below zero.
+func noisyCount(n float64, scale float64) int64 {
+	u := rand.Float64() - 0.5
+	noise := -scale * math.Copysign(1, u) * math.Log(1-2*math.Abs(u))
+
+	if n = math.Round(n + noise); n < 0 {
+		return 0
+	}
+	return int64(n)
+}
@@ -0,0 +1,258 @@
+package helpers
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+)
+
+const (
+	// TraceHeader asks to trace a request, it is not sent upstream
+	TraceHeader string = "X-GoProxy-Trace"
+
+	DefaultTraceStoreSize int = 128
+)
+
+// TraceEvent is a step of a traced request, Elapsed is since the request came
+// in.
+type TraceEvent struct {
+	Elapsed time.Duration
+	Stage   string
+	Name    string
+	Detail  string `json:",omitempty"`
+}
+
+// Trace records how a request went through the proxy: the decision of each
+// filter, the dns answers and the addrs raced by the dialers, and the timing
+// of the response. All of its methods are no-ops on a nil Trace, so the code
+// on the way of a request calls them whether it is traced or not.
+type Trace struct {
+	ID     string
+	Method string
+	URL    string
+	Start  time.Time
+
+	mu     sync.Mutex
+	events []TraceEvent
+}
+
+func NewTrace(id string, req *http.Request) *Trace {
+	return &Trace{
+		ID:     id,
+		Method: req.Method,
+		URL:    req.URL.String(),
+		Start:  time.Now(),
+	}
+}
+
+func (t *Trace) Addf(stage, name, format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+
+	e := TraceEvent{
+		Elapsed: time.Since(t.Start),
+		Stage:   stage,
+		Name:    name,
+		Detail:  fmt.Sprintf(format, args...),
+	}
+
+	t.mu.Lock()
+	t.events = append(t.events, e)
+	t.mu.Unlock()
+}
+
+func (t *Trace) Events() []TraceEvent {
+	if t == nil {
+		return nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]TraceEvent(nil), t.events...)
+}
+
+func (t *Trace) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		ID     string
+		Method string
+		URL    string
+		Start  time.Time
+		Events []TraceEvent
+	}{t.ID, t.Method, t.URL, t.Start, t.Events()})
+}
+
+// ClientTrace records the connection and the first response byte of the
+// requests which name sends upstream for the traced request.
+func (t *Trace) ClientTrace(name string) *httptrace.ClientTrace {
+	if t == nil {
+		return nil
+	}
+
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				t.Addf("conn", name, "reuse conn to %s, idle %s", info.Conn.RemoteAddr(), info.IdleTime)
+			} else {
+				t.Addf("conn", name, "new conn to %s", info.Conn.RemoteAddr())
+			}
+		},
+		TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+			if err != nil {
+				t.Addf("conn", name, "tls handshake error: %v", err)
+			}
+		},
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err != nil {
+				t.Addf("conn", name, "write request error: %v", info.Err)
+			}
+		},
+		GotFirstResponseByte: func() {
+			t.Addf("conn", name, "first response byte")
+		},
+	}
+}
+
+type traceKey struct{}
+
+func WithTrace(ctx context.Context, t *Trace) context.Context {
+	return context.WithValue(ctx, traceKey{}, t)
+}
+
+// TraceFrom returns the trace of ctx, nil if the request is not traced.
+func TraceFrom(ctx context.Context) *Trace {
+	if ctx == nil {
+		return nil
+	}
+	t, _ := ctx.Value(traceKey{}).(*Trace)
+	return t
+}
+
+// WithClientTrace carries the trace of ctx over to req, a request which a
+// filter sends upstream for the traced one, e.g. a fetch request.
+func WithClientTrace(ctx context.Context, req *http.Request, name string) *http.Request {
+	t := TraceFrom(ctx)
+	if t == nil {
+		return req
+	}
+
+	ctx1 := WithTrace(req.Context(), t)
+	ctx1 = httptrace.WithClientTrace(ctx1, t.ClientTrace(name))
+	return req.WithContext(ctx1)
+}
+
+// TraceSummary is a Trace without its events.
+type TraceSummary struct {
+	ID     string
+	Method string
+	URL    string
+	Start  time.Time
+	Events int
+}
+
+// TraceStore keeps the last traces, and the hosts whose requests are traced
+// without TraceHeader until a deadline.
+type TraceStore struct {
+	mu     sync.Mutex
+	traces []*Trace
+	next   int
+	hosts  *HostMatcher
+	until  time.Time
+}
+
+var Traces = NewTraceStore(DefaultTraceStoreSize)
+
+func NewTraceStore(size int) *TraceStore {
+	return &TraceStore{
+		traces: make([]*Trace, 0, size),
+	}
+}
+
+// Enable traces the requests to hosts, all of them if hosts is empty, until
+// d has passed. A zero d disables it.
+func (s *TraceStore) Enable(hosts []string, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if d <= 0 {
+		s.hosts, s.until = nil, time.Time{}
+		return
+	}
+	if len(hosts) == 0 {
+		hosts = []string{"*"}
+	}
+	s.hosts, s.until = NewHostMatcher(hosts), time.Now().Add(d)
+}
+
+// Enabled returns the hosts traced without TraceHeader and until when.
+func (s *TraceStore) Enabled() (*HostMatcher, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.hosts == nil || time.Now().After(s.until) {
+		return nil, time.Time{}
+	}
+	return s.hosts, s.until
+}
+
+// ShouldTrace reports whether req asks to be traced or matches Enable.
+func (s *TraceStore) ShouldTrace(req *http.Request) bool {
+	if req.Header.Get(TraceHeader) != "" {
+		return true
+	}
+
+	hosts, _ := s.Enabled()
+	return hosts != nil && hosts.Match(req.Host)
+}
+
+func (s *TraceStore) Put(t *Trace) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.traces) < cap(s.traces) {
+		s.traces = append(s.traces, t)
+		return
+	}
+	s.traces[s.next] = t
+	s.next = (s.next + 1) % len(s.traces)
+}
+
+func (s *TraceStore) Get(id string) (*Trace, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, t := range s.traces {
+		if t.ID == id {
+			return t, true
+		}
+	}
+	return nil, false
+}
+
+// List returns the summaries of the traces kept, the newest first.
+func (s *TraceStore) List() []TraceSummary {
+	s.mu.Lock()
+	traces := make([]*Trace, 0, len(s.traces))
+	for i := range s.traces {
+		// the oldest one is at next once the ring is full
+		traces = append(traces, s.traces[(s.next+len(s.traces)-1-i)%len(s.traces)])
+	}
+	s.mu.Unlock()
+
+	summaries := make([]TraceSummary, len(traces))
+	for i, t := range traces {
+		summaries[i] = TraceSummary{
+			ID:     t.ID,
+			Method: t.Method,
+			URL:    t.URL,
+			Start:  t.Start,
+			Events: len(t.Events()),
+		}
+	}
+	return summaries
+}
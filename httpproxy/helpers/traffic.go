@@ -0,0 +1,210 @@
+package helpers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"../storage"
+)
+
+const (
+	// the resolution of the rolling windows, a day is 288 buckets
+	trafficBucketSize time.Duration = 5 * time.Minute
+	trafficRetention  time.Duration = 24 * time.Hour
+
+	DefaultTrafficSaveInterval time.Duration = time.Minute
+)
+
+// TrafficCounter is the traffic of a client or a host, Up is what the client
+// sent and Down is what it received.
+type TrafficCounter struct {
+	Requests int64 `json:"requests"`
+	Up       int64 `json:"up"`
+	Down     int64 `json:"down"`
+}
+
+func (c *TrafficCounter) add(c1 *TrafficCounter) {
+	c.Requests += c1.Requests
+	c.Up += c1.Up
+	c.Down += c1.Down
+}
+
+type trafficBucket struct {
+	Clients map[string]*TrafficCounter `json:"clients"`
+	Hosts   map[string]*TrafficCounter `json:"hosts"`
+}
+
+// TrafficRow is one client or host of a TrafficStats.Query result.
+type TrafficRow struct {
+	Key string `json:"key"`
+	TrafficCounter
+}
+
+// TrafficStats counts the bytes up and down of each client ip and each
+// destination host in buckets of 5 minutes over the last day, so that a
+// shared deployment can tell who consumes the quota. It is saved to Filename
+// periodically and loaded back at start.
+type TrafficStats struct {
+	Filename string
+
+	mu      sync.Mutex
+	buckets map[int64]*trafficBucket
+}
+
+var (
+	trafficStats        = make(map[string]*TrafficStats)
+	defaultTrafficStats *TrafficStats
+	muTrafficStats      sync.Mutex
+)
+
+// OpenTrafficStats loads filename if it exists, profiles which share a
+// filename share the TrafficStats. The first one opened is also returned by
+// DefaultTrafficStats.
+func OpenTrafficStats(filename string, saveInterval time.Duration) (*TrafficStats, error) {
+	muTrafficStats.Lock()
+	defer muTrafficStats.Unlock()
+
+	if t, ok := trafficStats[filename]; ok {
+		return t, nil
+	}
+
+	t := &TrafficStats{
+		Filename: filename,
+		buckets:  make(map[int64]*trafficBucket),
+	}
+
+	data, recovered, err := storage.ReadFileVerified(filename, nil)
+	switch {
+	case err == nil:
+		if err = json.Unmarshal(data, &t.buckets); err != nil {
+			return nil, fmt.Errorf("TrafficStats %#v error: %v", filename, err)
+		}
+		if recovered {
+			glog.Warningf("TrafficStats %#v is corrupted, recovered the last good one", filename)
+		}
+	case !os.IsNotExist(err):
+		return nil, err
+	}
+
+	if saveInterval <= 0 {
+		saveInterval = DefaultTrafficSaveInterval
+	}
+	DefaultScheduler.Every("traffic.save "+filename, saveInterval, false, t.Save)
+
+	trafficStats[filename] = t
+	if defaultTrafficStats == nil {
+		defaultTrafficStats = t
+	}
+	return t, nil
+}
+
+// DefaultTrafficStats returns the first opened TrafficStats, or nil.
+func DefaultTrafficStats() *TrafficStats {
+	muTrafficStats.Lock()
+	defer muTrafficStats.Unlock()
+	return defaultTrafficStats
+}
+
+func (t *TrafficStats) Add(client, host string, up, down int64) {
+	key := time.Now().Truncate(trafficBucketSize).Unix()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	b, ok := t.buckets[key]
+	if !ok {
+		b = &trafficBucket{
+			Clients: make(map[string]*TrafficCounter),
+			Hosts:   make(map[string]*TrafficCounter),
+		}
+		t.buckets[key] = b
+		t.prune()
+	}
+
+	c := &TrafficCounter{1, up, down}
+	addTraffic(b.Clients, client, c)
+	addTraffic(b.Hosts, host, c)
+}
+
+func addTraffic(m map[string]*TrafficCounter, key string, c *TrafficCounter) {
+	sum, ok := m[key]
+	if !ok {
+		sum = new(TrafficCounter)
+		m[key] = sum
+	}
+	sum.add(c)
+}
+
+// Query sums the traffic of the last window by "client" or "host", the
+// heaviest first. limit <= 0 returns all of them.
+func (t *TrafficStats) Query(window time.Duration, by string, limit int) ([]TrafficRow, error) {
+	if by != "client" && by != "host" {
+		return nil, fmt.Errorf("TrafficStats: unknown group %#v", by)
+	}
+
+	since := time.Now().Add(-window).Truncate(trafficBucketSize).Unix()
+	sums := make(map[string]*TrafficCounter)
+
+	t.mu.Lock()
+	for key, b := range t.buckets {
+		if key < since {
+			continue
+		}
+		m := b.Clients
+		if by == "host" {
+			m = b.Hosts
+		}
+		for k, c := range m {
+			addTraffic(sums, k, c)
+		}
+	}
+	t.mu.Unlock()
+
+	rows := make([]TrafficRow, 0, len(sums))
+	for k, c := range sums {
+		rows = append(rows, TrafficRow{k, *c})
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i].Up+rows[i].Down > rows[j].Up+rows[j].Down
+	})
+	if limit > 0 && len(rows) > limit {
+		rows = rows[:limit]
+	}
+
+	return rows, nil
+}
+
+// Save writes the buckets to Filename atomically, so a crash never leaves a
+// truncated one.
+func (t *TrafficStats) Save() error {
+	t.mu.Lock()
+	t.prune()
+	data, err := json.Marshal(t.buckets)
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err = storage.WriteFileAtomic(t.Filename, data, 0644); err != nil {
+		return err
+	}
+
+	glog.V(3).Infof("TrafficStats saved to %#v", t.Filename)
+	return nil
+}
+
+// prune drops the buckets older than a day, t.mu must be held.
+func (t *TrafficStats) prune() {
+	since := time.Now().Add(-trafficRetention).Unix()
+	for key := range t.buckets {
+		if key < since {
+			delete(t.buckets, key)
+		}
+	}
+}
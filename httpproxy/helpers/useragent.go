@@ -0,0 +1,23 @@
+package helpers
+
+import (
+	"math/rand"
+)
+
+const (
+	// DefaultUserAgent is what the https fetch requests carried historically.
+	DefaultUserAgent string = "a"
+)
+
+// RandomUserAgent picks one of userAgents for a fetch request, so that the
+// requests to a fetch server do not share one odd looking User-Agent.
+func RandomUserAgent(userAgents []string) string {
+	switch len(userAgents) {
+	case 0:
+		return DefaultUserAgent
+	case 1:
+		return userAgents[0]
+	default:
+		return userAgents[rand.Intn(len(userAgents))]
+	}
+}
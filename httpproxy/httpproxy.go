@@ -2,7 +2,9 @@ package httpproxy
 
 import (
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
 	"time"
 
@@ -12,29 +14,90 @@ import (
 	"./helpers"
 	"./storage"
 
+	_ "./filters/admin"
 	_ "./filters/auth"
 	_ "./filters/autoproxy"
 	_ "./filters/autorange"
+	_ "./filters/cache"
+	_ "./filters/clamav"
 	_ "./filters/direct"
 	_ "./filters/gae"
+	_ "./filters/meek"
+	_ "./filters/metrics"
+	_ "./filters/mirror"
 	_ "./filters/php"
+	_ "./filters/plugin"
 	_ "./filters/ratelimit"
 	_ "./filters/rewrite"
+	_ "./filters/script"
+	_ "./filters/socks5"
 	_ "./filters/stripssl"
+	_ "./filters/transcode"
 	_ "./filters/vps"
+	_ "./filters/websocket"
 )
 
-type configType map[string]struct {
+// ProfileConfig is a profile of httpproxy.json, a listener and its filters.
+type ProfileConfig struct {
 	Enabled          bool
 	Address          string
+	Addresses        []string
+	Socks5Address    string
 	KeepAlivePeriod  int
 	ReadTimeout      int
 	WriteTimeout     int
+	FlushInterval    int
+	FlushThreshold   int
+	FlushPolicies    map[string]int
+	RequestIDHeader  bool
 	RequestFilters   []string
 	RoundTripFilters []string
 	ResponseFilters  []string
+	FallbackFilter   string
+	ProxyProtocol    bool
+	ForwardedFor     string
+	AllowCIDRs       []string
+	DenyCIDRs        []string
+	AccessLog        struct {
+		Enabled    bool
+		Filename   string
+		MaxSize    int
+		MaxBackups int
+	}
+	Stats struct {
+		Enabled   bool
+		Filename  string
+		Retention int
+	}
+	Traffic struct {
+		Enabled      bool
+		Filename     string
+		SaveInterval int
+	}
+	Transparent struct {
+		Address string
+		Mode    string
+	}
+	FallbackChains map[string]struct {
+		Filters     []string
+		Statuses    []int
+		MaxFailures int
+		Cooldown    int
+	}
+	PanicBypass struct {
+		MaxPanics int
+		Cooldown  int
+	}
+	ErrorPages struct {
+		Enabled  bool
+		Brand    string
+		Template string
+	}
+	ProxyProtocolTrusted []string
 }
 
+type configType map[string]ProfileConfig
+
 var (
 	Config configType
 )
@@ -48,6 +111,19 @@ func init() {
 		fmt.Printf("storage.ReadJsonConfig(%#v) failed: %s\n", filename, err)
 		return
 	}
+
+	// the filters are created later, so they find the policies they refer to
+	filename = "retry.json"
+	policies := make(map[string]helpers.RetryPolicy)
+	if err = storage.ReadJsonConfig(storage.LookupConfigStoreURI("retry"), filename, &policies); err != nil {
+		fmt.Printf("storage.ReadJsonConfig(%#v) failed: %s\n", filename, err)
+		return
+	}
+	for name, p := range policies {
+		if err = helpers.RegisterRetryPolicy(name, p); err != nil {
+			fmt.Printf("%s: %s\n", filename, err)
+		}
+	}
 }
 
 func ServeProfile(profile string) error {
@@ -56,22 +132,39 @@ func ServeProfile(profile string) error {
 		return fmt.Errorf("profile(%#v) not exists", profile)
 	}
 
-	listenOpts := &helpers.ListenOptions{TLSConfig: nil}
+	acceptFilter, err := helpers.NewAcceptFilter(config.AllowCIDRs, config.DenyCIDRs)
+	if err != nil {
+		glog.Fatalf("profile(%#v) AllowCIDRs/DenyCIDRs error: %s", profile, err)
+	}
 
-	ln, err := helpers.ListenTCP("tcp", config.Address, listenOpts)
+	proxyTrusted, err := proxyProtocolTrusted(config)
 	if err != nil {
-		glog.Fatalf("ListenTCP(%s, %#v) error: %s", config.Address, listenOpts, err)
+		glog.Fatalf("profile(%#v) %s", profile, err)
 	}
 
-	requestFilters, roundtripFilters, responseFilters := getFilters(profile)
+	listenOpts := &helpers.ListenOptions{
+		TLSConfig:            nil,
+		ProxyProtocol:        config.ProxyProtocol,
+		ProxyProtocolTrusted: proxyTrusted,
+		AcceptFilter:         acceptFilter,
+	}
 
-	h := Handler{
-		Listener:         ln,
-		RequestFilters:   requestFilters,
-		RoundTripFilters: roundtripFilters,
-		ResponseFilters:  responseFilters,
+	ln, err := helpers.Listen(config.Address, listenOpts)
+	if err != nil {
+		if addr, ok := helpers.SuggestPort(config.Address); ok {
+			glog.Fatalf("Listen(%s, %#v) error: %s, try Address %#v instead", config.Address, listenOpts, err, addr)
+		}
+		glog.Fatalf("Listen(%s, %#v) error: %s", config.Address, listenOpts, err)
 	}
 
+	helpers.RegisterListener(profile, ln)
+
+	h, err := newHandler(profile, config)
+	if err != nil {
+		glog.Fatalf("profile(%#v) error: %v", profile, err)
+	}
+	h.Listener = ln
+
 	s := &http.Server{
 		Handler:        h,
 		ReadTimeout:    time.Duration(config.ReadTimeout) * time.Second,
@@ -79,16 +172,195 @@ func ServeProfile(profile string) error {
 		MaxHeaderBytes: 1 << 20,
 	}
 
+	if config.Socks5Address != "" {
+		go func() {
+			if err := ServeSocks5(config.Socks5Address, ln); err != nil {
+				glog.Errorf("ServeSocks5(%#v) error: %v", config.Socks5Address, err)
+			}
+		}()
+	}
+
+	if config.Transparent.Address != "" {
+		go func() {
+			if err := ServeTransparent(config.Transparent.Address, config.Transparent.Mode, ln); err != nil {
+				glog.Errorf("ServeTransparent(%#v) error: %v", config.Transparent.Address, err)
+			}
+		}()
+	}
+
+	// more addresses share the filter chain of profile, and so its dialers and caches
+	for _, addr := range config.Addresses {
+		ln1, err := helpers.Listen(addr, listenOpts)
+		if err != nil {
+			glog.Fatalf("Listen(%s, %#v) error: %s", addr, listenOpts, err)
+		}
+
+		helpers.RegisterListener(profile+"@"+addr, ln1)
+
+		h1 := h
+		h1.Listener = ln1
+		s1 := &http.Server{
+			Handler:        h1,
+			ReadTimeout:    s.ReadTimeout,
+			WriteTimeout:   s.WriteTimeout,
+			MaxHeaderBytes: s.MaxHeaderBytes,
+		}
+
+		go func() {
+			glog.Infof("ListenAndServe(%#v) on %s\n", profile, ln1.Addr().String())
+			if err := s1.Serve(ln1); err != nil {
+				glog.Errorf("Serve(%#v) on %s error: %v", profile, ln1.Addr().String(), err)
+			}
+		}()
+	}
+
 	glog.Infof("ListenAndServe(%#v) on %s\n", profile, h.Listener.Addr().String())
 	return s.Serve(h.Listener)
 }
 
-func getFilters(profile string) ([]filters.RequestFilter, []filters.RoundTripFilter, []filters.ResponseFilter) {
-	config, ok := Config[profile]
-	if !ok {
-		panic(fmt.Errorf("profile(%#v) not exists", profile))
+// proxyProtocolTrusted parses the ProxyProtocolTrusted of config, which must
+// not be empty with ProxyProtocol, any peer could claim any address otherwise.
+func proxyProtocolTrusted(config ProfileConfig) ([]*net.IPNet, error) {
+	ipnets, err := helpers.ParseIPNets(config.ProxyProtocolTrusted)
+	if err != nil {
+		return nil, fmt.Errorf("ProxyProtocolTrusted error: %v", err)
+	}
+	if config.ProxyProtocol && len(ipnets) == 0 {
+		return nil, fmt.Errorf("ProxyProtocol requires ProxyProtocolTrusted, the load balancers which may send the PROXY header")
+	}
+	return ipnets, nil
+}
+
+// newHandler builds the filter chains and the stats of profile, the
+// Listener of the handler is left to the caller.
+func newHandler(profile string, config ProfileConfig) (Handler, error) {
+	requestFilters, roundtripFilters, responseFilters, err := getFilters(config)
+	if err != nil {
+		return Handler{}, err
+	}
+
+	var fallbackFilter filters.RoundTripFilter
+	if config.FallbackFilter != "" {
+		f, err := filters.GetFilter(config.FallbackFilter)
+		if err != nil {
+			return Handler{}, fmt.Errorf("filters.GetFilter(%#v) failed: %v", config.FallbackFilter, err)
+		}
+		f1, ok := f.(filters.RoundTripFilter)
+		if !ok {
+			return Handler{}, fmt.Errorf("%#v is not a RoundTripFilter", config.FallbackFilter)
+		}
+		fallbackFilter = f1
+	}
+
+	fallbackChains := make(map[string]*FallbackChain)
+	for name, c := range config.FallbackChains {
+		fs := make([]filters.RoundTripFilter, 0, len(c.Filters))
+		for _, name1 := range c.Filters {
+			f, err := filters.GetFilter(name1)
+			if err != nil {
+				return Handler{}, fmt.Errorf("filters.GetFilter(%#v) failed: %v", name1, err)
+			}
+			f1, ok := f.(filters.RoundTripFilter)
+			if !ok {
+				return Handler{}, fmt.Errorf("%#v is not a RoundTripFilter", name1)
+			}
+			fs = append(fs, f1)
+		}
+		fallbackChains[name] = NewFallbackChain(fs, c.Statuses, c.MaxFailures, time.Duration(c.Cooldown)*time.Second)
 	}
 
+	panics := helpers.NewPanicGuard(config.PanicBypass.MaxPanics, time.Duration(config.PanicBypass.Cooldown)*time.Second)
+	helpers.RegisterPanicGuard(profile, panics)
+
+	helpers.DefaultMetrics.SetBuckets("goproxy_request_bytes", helpers.SizeBuckets)
+	helpers.DefaultMetrics.SetBuckets("goproxy_response_bytes", helpers.SizeBuckets)
+
+	flushPolicies := make(map[string]time.Duration)
+	for contentType, interval := range config.FlushPolicies {
+		flushPolicies[contentType] = time.Duration(interval) * time.Millisecond
+	}
+
+	var accessLog *helpers.AccessLog
+	if config.AccessLog.Enabled {
+		accessLog, err = helpers.NewAccessLog(config.AccessLog.Filename, int64(config.AccessLog.MaxSize)*1024*1024, config.AccessLog.MaxBackups)
+		if err != nil {
+			return Handler{}, fmt.Errorf("helpers.NewAccessLog(%#v) error: %v", config.AccessLog.Filename, err)
+		}
+	}
+
+	var stats *helpers.StatsDB
+	if config.Stats.Enabled {
+		stats, err = helpers.OpenStatsDB(config.Stats.Filename, time.Duration(config.Stats.Retention)*24*time.Hour)
+		if err != nil {
+			return Handler{}, fmt.Errorf("helpers.OpenStatsDB(%#v) error: %v", config.Stats.Filename, err)
+		}
+	}
+
+	var errorPages *helpers.ErrorPages
+	if config.ErrorPages.Enabled {
+		errorPages, err = newErrorPages(config.ErrorPages.Brand, config.ErrorPages.Template)
+		if err != nil {
+			return Handler{}, fmt.Errorf("newErrorPages(%#v) error: %v", config.ErrorPages.Template, err)
+		}
+	}
+
+	var traffic *helpers.TrafficStats
+	if config.Traffic.Enabled {
+		traffic, err = helpers.OpenTrafficStats(config.Traffic.Filename, time.Duration(config.Traffic.SaveInterval)*time.Second)
+		if err != nil {
+			return Handler{}, fmt.Errorf("helpers.OpenTrafficStats(%#v) error: %v", config.Traffic.Filename, err)
+		}
+	}
+
+	return Handler{
+		RequestFilters:   requestFilters,
+		RoundTripFilters: roundtripFilters,
+		ResponseFilters:  responseFilters,
+		FallbackFilter:   fallbackFilter,
+		FallbackChains:   fallbackChains,
+		FlushInterval:    time.Duration(config.FlushInterval) * time.Millisecond,
+		FlushThreshold:   config.FlushThreshold,
+		FlushPolicies:    flushPolicies,
+		Metrics:          helpers.DefaultMetrics,
+		RequestIDHeader:  config.RequestIDHeader,
+		AccessLog:        accessLog,
+		Stats:            stats,
+		Traffic:          traffic,
+		ForwardedFor:     config.ForwardedFor,
+		Panics:           panics,
+		ErrorPages:       errorPages,
+	}, nil
+}
+
+// newErrorPages reads the html template of the error pages from the config
+// store of httpproxy.json, the built-in one is used if filename is empty.
+func newErrorPages(brand, filename string) (*helpers.ErrorPages, error) {
+	if filename == "" {
+		return helpers.NewErrorPages(brand, "")
+	}
+
+	store, err := storage.OpenURI(storage.LookupConfigStoreURI("httpproxy"))
+	if err != nil {
+		return nil, err
+	}
+
+	object, err := store.GetObject(filename, -1, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := object.Body()
+	data, err := ioutil.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return helpers.NewErrorPages(brand, string(data))
+}
+
+func getFilters(config ProfileConfig) ([]filters.RequestFilter, []filters.RoundTripFilter, []filters.ResponseFilter, error) {
+
 	fs := make(map[string]filters.Filter)
 	for _, names := range [][]string{config.RequestFilters,
 		config.RoundTripFilters,
@@ -97,7 +369,7 @@ func getFilters(profile string) ([]filters.RequestFilter, []filters.RoundTripFil
 			if _, ok := fs[name]; !ok {
 				f, err := filters.GetFilter(name)
 				if err != nil {
-					glog.Fatalf("filters.GetFilter(%#v) failed: %#v", name, err)
+					return nil, nil, nil, fmt.Errorf("filters.GetFilter(%#v) failed: %v", name, err)
 				}
 				fs[name] = f
 			}
@@ -109,7 +381,7 @@ func getFilters(profile string) ([]filters.RequestFilter, []filters.RoundTripFil
 		f := fs[name]
 		f1, ok := f.(filters.RequestFilter)
 		if !ok {
-			glog.Fatalf("%#v is not a RequestFilter", f)
+			return nil, nil, nil, fmt.Errorf("%#v is not a RequestFilter", name)
 		}
 		requestFilters = append(requestFilters, f1)
 	}
@@ -119,7 +391,7 @@ func getFilters(profile string) ([]filters.RequestFilter, []filters.RoundTripFil
 		f := fs[name]
 		f1, ok := f.(filters.RoundTripFilter)
 		if !ok {
-			glog.Fatalf("%#v is not a RoundTripFilter", f)
+			return nil, nil, nil, fmt.Errorf("%#v is not a RoundTripFilter", name)
 		}
 		roundtripFilters = append(roundtripFilters, f1)
 	}
@@ -129,10 +401,10 @@ func getFilters(profile string) ([]filters.RequestFilter, []filters.RoundTripFil
 		f := fs[name]
 		f1, ok := f.(filters.ResponseFilter)
 		if !ok {
-			glog.Fatalf("%#v is not a ResponseFilter", f)
+			return nil, nil, nil, fmt.Errorf("%#v is not a ResponseFilter", name)
 		}
 		responseFilters = append(responseFilters, f1)
 	}
 
-	return requestFilters, roundtripFilters, responseFilters
+	return requestFilters, roundtripFilters, responseFilters, nil
 }
@@ -0,0 +1,188 @@
+// +build integration
+
+// Package integration runs the dialer against the simulated hostile network
+// of assets/integration, use assets/integration/run.sh to start it.
+package integration
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cloudflare/golibs/lrucache"
+
+	"../dialer"
+	"../helpers"
+)
+
+var (
+	dnsServer  = getenv("DNS_SERVER", "172.28.0.53:53")
+	goodIP     = getenv("GOOD_IP", "172.28.0.10")
+	resetIP    = getenv("RESET_IP", "172.28.0.11")
+	throttleIP = getenv("THROTTLE_IP", "172.28.0.12")
+	poisonIP   = getenv("POISON_IP", "10.10.10.10")
+)
+
+func getenv(key, value string) string {
+	if s := os.Getenv(key); s != "" {
+		return s
+	}
+	return value
+}
+
+// newDialer maps "<alias>.site" to each alias of hostMap and resolves all of
+// them through the poisoning dns server.
+func newDialer(hostMap map[string][]string) *dialer.MultiDialer {
+	site2alias := make(map[string]string, len(hostMap))
+	aliasDNSServers := make(map[string][]string, len(hostMap))
+	for alias := range hostMap {
+		site2alias[alias+".site"] = alias
+		aliasDNSServers[alias] = []string{dnsServer}
+	}
+
+	return &dialer.MultiDialer{
+		Dialer: net.Dialer{
+			Timeout: 3 * time.Second,
+		},
+		IPPreference:    dialer.IPOnlyIPv4,
+		Site2Alias:      helpers.NewHostMatcherWithString(site2alias),
+		IPBlackList:     helpers.NewKeyedCache(lrucache.NewLRUCache(64)),
+		HostMap:         hostMap,
+		AliasDNSServers: aliasDNSServers,
+		DNSCache:        helpers.NewKeyedCache(lrucache.NewLRUCache(64)),
+		DNSCacheExpiry:  time.Hour,
+		TCPConnDuration: helpers.NewKeyedCache(lrucache.NewLRUCache(64)),
+		TCPConnError:    helpers.NewKeyedCache(lrucache.NewLRUCache(64)),
+		TLSConnDuration: helpers.NewKeyedCache(lrucache.NewLRUCache(64)),
+		TLSConnError:    helpers.NewKeyedCache(lrucache.NewLRUCache(64)),
+		ConnExpiry:      5 * time.Minute,
+		Level:           4,
+		ThrottledIPs:    lrucache.NewLRUCache(64),
+		ThrottleWindow:  time.Second,
+	}
+}
+
+func contains(ss []string, s string) bool {
+	for _, s1 := range ss {
+		if s1 == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestPoisonedDNS(t *testing.T) {
+	d := newDialer(map[string][]string{
+		"poisoned": {"blocked.test", "good.test"},
+	})
+	d.BlackListIP(poisonIP, 0)
+
+	hosts, err := d.LookupAlias("poisoned")
+	if err != nil {
+		t.Fatalf("LookupAlias error: %v", err)
+	}
+	if contains(hosts, poisonIP) {
+		t.Errorf("LookupAlias returns the poisoned ip %s: %v", poisonIP, hosts)
+	}
+	if !contains(hosts, goodIP) {
+		t.Errorf("LookupAlias misses %s: %v", goodIP, hosts)
+	}
+}
+
+func TestResetFailover(t *testing.T) {
+	d := newDialer(map[string][]string{
+		"reset": {resetIP, goodIP},
+	})
+
+	conn, err := d.DialTLS("tcp", "reset.site:443")
+	if err != nil {
+		t.Fatalf("DialTLS error: %v", err)
+	}
+	defer conn.Close()
+
+	if host, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); host != goodIP {
+		t.Errorf("DialTLS picks %s, want %s", host, goodIP)
+	}
+	if _, ok := d.TLSConnError.Get(net.JoinHostPort(resetIP, "443")); !ok {
+		t.Errorf("the reset of %s is not recorded in TLSConnError", resetIP)
+	}
+}
+
+func TestHealthCheckBlacklist(t *testing.T) {
+	d := newDialer(map[string][]string{
+		"reset": {resetIP, goodIP},
+	})
+
+	if conn, err := d.DialTLS("tcp", "reset.site:443"); err == nil {
+		conn.Close()
+	}
+
+	h := dialer.NewHealthChecker(d, "good.test")
+	h.MaxFailures = 2
+	for i := 0; i < h.MaxFailures; i++ {
+		if err := h.Check(); err != nil {
+			t.Fatalf("HealthChecker.Check error: %v", err)
+		}
+	}
+
+	if !d.IsBlackListed(resetIP) {
+		t.Errorf("%s is not blacklisted after %d failed probes", resetIP, h.MaxFailures)
+	}
+	if d.IsBlackListed(goodIP) {
+		t.Errorf("%s is blacklisted", goodIP)
+	}
+}
+
+func TestThrottleDetection(t *testing.T) {
+	d := newDialer(map[string][]string{
+		"throttle": {throttleIP},
+	})
+
+	conn, err := d.DialTLS("tcp", "throttle.site:443")
+	if err != nil {
+		t.Fatalf("DialTLS error: %v", err)
+	}
+	defer conn.Close()
+
+	io.WriteString(conn, "GET /big HTTP/1.1\r\nHost: throttle.test\r\nConnection: close\r\n\r\n")
+
+	// read through the first and the second window of the throttle check
+	conn.SetReadDeadline(time.Now().Add(3 * d.ThrottleWindow))
+	io.Copy(ioutil.Discard, conn)
+
+	if !d.IsThrottled(throttleIP) {
+		t.Errorf("%s is not detected as throttled", throttleIP)
+	}
+}
+
+func TestScannerSkipsReset(t *testing.T) {
+	d := newDialer(map[string][]string{
+		"scan": {},
+	})
+
+	// covers goodIP and resetIP
+	s, err := dialer.NewIPScanner(d, "scan", []string{goodIP + "/30"}, "good.test")
+	if err != nil {
+		t.Fatalf("NewIPScanner error: %v", err)
+	}
+	s.BatchSize = 16
+	s.Timeout = time.Second
+
+	if n := s.Scan(); n == 0 {
+		t.Fatalf("IPScanner found no good ips")
+	}
+
+	hosts, err := d.LookupAlias("scan")
+	if err != nil {
+		t.Fatalf("LookupAlias error: %v", err)
+	}
+	if !contains(hosts, goodIP) {
+		t.Errorf("IPScanner misses %s: %v", goodIP, hosts)
+	}
+	if contains(hosts, resetIP) {
+		t.Errorf("IPScanner keeps %s: %v", resetIP, hosts)
+	}
+}
@@ -0,0 +1,203 @@
+package httpproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"./filters"
+	"./helpers"
+)
+
+// Proxy is the whole proxy of a profile, its filters with their dialers and
+// the admin api if it is one of them, for the programs which embed goproxy
+// instead of running the binary, e.g.
+//
+//	p, err := httpproxy.New(httpproxy.Config["Default"], httpproxy.WithName("embedded"))
+//	if err != nil {
+//		return err
+//	}
+//	ln, _ := net.Listen("tcp", "127.0.0.1:8087")
+//	return p.Serve(ln)
+//
+// The filters read their config files when the package is initialized, from
+// the config store of CONFIG_STORE_URI, so it must be set before the program
+// starts, e.g. to "file:///etc/goproxy".
+type Proxy struct {
+	name    string
+	config  ProfileConfig
+	handler Handler
+	filters []filters.Filter
+
+	mu      sync.Mutex
+	servers []*http.Server
+}
+
+// Option configures a Proxy created by New.
+type Option func(*Proxy) error
+
+// WithName names the proxy in the admin api, e.g. the listeners and the panics
+// of system/panics. It is "embedded" by default.
+func WithName(name string) Option {
+	return func(p *Proxy) error {
+		if name == "" {
+			return fmt.Errorf("empty name")
+		}
+		p.name = name
+		return nil
+	}
+}
+
+// WithFilter puts f in front of the filter chains of the config which it
+// implements, so that it sees every request first. A RoundTripFilter returning
+// no response passes the request on to the configured ones.
+func WithFilter(f filters.Filter) Option {
+	return func(p *Proxy) error {
+		switch f.(type) {
+		case filters.RequestFilter, filters.RoundTripFilter, filters.ResponseFilter:
+		default:
+			return fmt.Errorf("%T is not a filter of any chain", f)
+		}
+		p.filters = append(p.filters, f)
+		return nil
+	}
+}
+
+// WithLogger replaces the structured logger, it is process wide.
+func WithLogger(l helpers.Logger) Option {
+	return func(p *Proxy) error {
+		helpers.SetLogger(l)
+		return nil
+	}
+}
+
+// WithMetrics records the requests to m instead of helpers.DefaultMetrics.
+func WithMetrics(m helpers.MetricsRecorder) Option {
+	return func(p *Proxy) error {
+		p.handler.Metrics = m
+		return nil
+	}
+}
+
+// WithReadOnly refuses admin changes, config reloads and MITM, it is process
+// wide.
+func WithReadOnly(readOnly bool) Option {
+	return func(p *Proxy) error {
+		filters.SetReadOnly(readOnly)
+		return nil
+	}
+}
+
+// New builds the proxy of config, which is usually a profile of Config. The
+// Address, Addresses, Socks5Address and Transparent of config are ignored,
+// the proxy only serves the listeners given to Serve.
+func New(config ProfileConfig, opts ...Option) (*Proxy, error) {
+	p := &Proxy{
+		name:   "embedded",
+		config: config,
+	}
+
+	for _, opt := range opts {
+		if err := opt(p); err != nil {
+			return nil, fmt.Errorf("httpproxy.New: %v", err)
+		}
+	}
+
+	h, err := newHandler(p.name, config)
+	if err != nil {
+		return nil, fmt.Errorf("httpproxy.New: %v", err)
+	}
+	if p.handler.Metrics != nil {
+		h.Metrics = p.handler.Metrics
+	}
+
+	for i := len(p.filters) - 1; i >= 0; i-- {
+		if f, ok := p.filters[i].(filters.RequestFilter); ok {
+			h.RequestFilters = append([]filters.RequestFilter{f}, h.RequestFilters...)
+		}
+		if f, ok := p.filters[i].(filters.RoundTripFilter); ok {
+			h.RoundTripFilters = append([]filters.RoundTripFilter{f}, h.RoundTripFilters...)
+		}
+		if f, ok := p.filters[i].(filters.ResponseFilter); ok {
+			h.ResponseFilters = append([]filters.ResponseFilter{f}, h.ResponseFilters...)
+		}
+	}
+
+	p.handler = h
+	return p, nil
+}
+
+// Serve accepts the connections of ln until it is closed or Shutdown is
+// called, it may be called with several listeners at once. ln is subject to
+// the AllowCIDRs, DenyCIDRs, ProxyProtocol and ProxyProtocolTrusted of the
+// config.
+func (p *Proxy) Serve(ln net.Listener) error {
+	acceptFilter, err := helpers.NewAcceptFilter(p.config.AllowCIDRs, p.config.DenyCIDRs)
+	if err != nil {
+		return err
+	}
+
+	proxyTrusted, err := proxyProtocolTrusted(p.config)
+	if err != nil {
+		return err
+	}
+
+	ln1 := helpers.NewListener(ln, &helpers.ListenOptions{
+		ProxyProtocol:        p.config.ProxyProtocol,
+		ProxyProtocolTrusted: proxyTrusted,
+		AcceptFilter:         acceptFilter,
+		KeepAlivePeriod:      time.Duration(p.config.KeepAlivePeriod) * time.Second,
+	})
+	helpers.RegisterListener(p.name+"@"+ln.Addr().String(), ln1)
+
+	h := p.handler
+	h.Listener = ln1
+	s := &http.Server{
+		Handler:        h,
+		ReadTimeout:    time.Duration(p.config.ReadTimeout) * time.Second,
+		WriteTimeout:   time.Duration(p.config.WriteTimeout) * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+
+	p.mu.Lock()
+	p.servers = append(p.servers, s)
+	p.mu.Unlock()
+
+	glog.Infof("httpproxy.Proxy(%#v) serve on %s", p.name, ln.Addr().String())
+	err = s.Serve(ln1)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+// ServeHTTP serves a request accepted by another server. The filters which
+// take over the connection need a ResponseWriter which is an http.Hijacker,
+// and stripssl only works under Serve, which hands the decrypted connections
+// back to its listener.
+func (p *Proxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	p.handler.ServeHTTP(rw, req)
+}
+
+// Shutdown stops the listeners of Serve and waits for the requests in flight
+// until ctx is done. The hijacked connections, e.g. CONNECT tunnels, are not
+// waited for.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	servers := p.servers
+	p.servers = nil
+	p.mu.Unlock()
+
+	var err error
+	for _, s := range servers {
+		if err1 := s.Shutdown(ctx); err1 != nil && err == nil {
+			err = err1
+		}
+	}
+	return err
+}
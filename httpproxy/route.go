@@ -0,0 +1,74 @@
+package httpproxy
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"./filters"
+)
+
+// Route is how a request goes through the RoundTripFilters of a profile.
+type Route struct {
+	// the egress of the filter which takes the request, empty if none does
+	Egress string
+	// the filters the request is offered to in turn, up to Egress
+	Filters []string
+	// the filters which are not filters.Router and are taken as passing the
+	// request on
+	Unknown []string
+}
+
+// RouteRequest returns the Route of req in profile, without sending it. req
+// is taken as it leaves the RequestFilters, e.g. a https request in place of
+// the CONNECT stripped by stripssl. The FallbackChains are not followed, they
+// only apply to the hosts which keep failing.
+func RouteRequest(profile string, req *http.Request) (*Route, error) {
+	config, ok := Config[profile]
+	if !ok {
+		return nil, fmt.Errorf("profile(%#v) not exists", profile)
+	}
+
+	if host, _, err := net.SplitHostPort(req.Host); err == nil {
+		req.Host = host
+	}
+
+	route := &Route{
+		Filters: make([]string, 0),
+		Unknown: make([]string, 0),
+	}
+	for _, name := range config.RoundTripFilters {
+		f, err := filters.GetFilter(name)
+		if err != nil {
+			return nil, fmt.Errorf("filters.GetFilter(%#v) failed: %v", name, err)
+		}
+		route.Filters = append(route.Filters, name)
+
+		r, ok := f.(filters.Router)
+		if !ok {
+			route.Unknown = append(route.Unknown, name)
+			continue
+		}
+		if egress, ok := r.Route(req); ok {
+			route.Egress = egress
+			return route, nil
+		}
+	}
+
+	return route, nil
+}
+
+// IsProfileAddr reports whether host:port is an address profile listens at,
+// that is a request to it is for goproxy itself, e.g. its pac or admin.
+func IsProfileAddr(profile, hostport string) bool {
+	config, ok := Config[profile]
+	if !ok {
+		return false
+	}
+	for _, addr := range append([]string{config.Address}, config.Addresses...) {
+		if addr == hostport {
+			return true
+		}
+	}
+	return false
+}
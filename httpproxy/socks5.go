@@ -0,0 +1,253 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"./helpers"
+)
+
+const (
+	socks5Version        byte = 0x05
+	socks5AuthNone       byte = 0x00
+	socks5AuthNoAccept   byte = 0xff
+	socks5CmdConnect     byte = 0x01
+	socks5CmdUDP         byte = 0x03
+	socks5AtypIPv4       byte = 0x01
+	socks5AtypDomain     byte = 0x03
+	socks5AtypIPv6       byte = 0x04
+	socks5RepSucceeded   byte = 0x00
+	socks5RepFailure     byte = 0x01
+	socks5RepCmdNotSupp  byte = 0x07
+	socks5RepAtypNotSupp byte = 0x08
+
+	socks5HandshakeTimeout time.Duration = 30 * time.Second
+)
+
+var errSocks5Atyp = errors.New("unknown address type")
+
+// ServeSocks5 accepts SOCKS5 clients on addr, the ones rejected by the
+// AcceptFilter of ln are closed. A CONNECT is turned into a http CONNECT
+// request and handed to ln, so the target goes through the same filter chain
+// as http proxy clients. UDP ASSOCIATE is refused, the datagrams could pass
+// neither the filters, the auth nor the MultiDialer, so relaying them would
+// make an open relay to any host, the private ones included.
+func ServeSocks5(addr string, ln helpers.Listener) error {
+	sln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("ServeSocks5 on %s\n", sln.Addr().String())
+
+	for {
+		conn, err := sln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(50 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		if !ln.Allow(conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+		go serveSocks5Conn(conn, ln)
+	}
+}
+
+func serveSocks5Conn(conn net.Conn, ln helpers.Listener) {
+	conn.SetDeadline(time.Now().Add(socks5HandshakeTimeout))
+
+	cmd, address, err := socks5Handshake(conn)
+	if err != nil {
+		glog.V(2).Infof("%s \"SOCKS5 handshake\" error: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	switch cmd {
+	case socks5CmdConnect:
+		glog.V(2).Infof("%s \"SOCKS5 CONNECT %s\" - -", conn.RemoteAddr(), address)
+		preface := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", address, address)
+		c := &socks5Conn{
+			Conn: conn,
+			r:    io.MultiReader(bytes.NewReader([]byte(preface)), conn),
+		}
+		if err := ln.Add(c); err != nil {
+			socks5Reply(conn, socks5RepFailure, nil)
+			conn.Close()
+		}
+	case socks5CmdUDP:
+		glog.V(2).Infof("%s \"SOCKS5 UDP ASSOCIATE %s\" refused", conn.RemoteAddr(), address)
+		socks5Reply(conn, socks5RepCmdNotSupp, nil)
+		conn.Close()
+	default:
+		glog.V(2).Infof("%s \"SOCKS5 %d %s\" command not supported", conn.RemoteAddr(), cmd, address)
+		socks5Reply(conn, socks5RepCmdNotSupp, nil)
+		conn.Close()
+	}
+}
+
+func socks5Handshake(conn net.Conn) (byte, string, error) {
+	b := make([]byte, 262)
+
+	if _, err := io.ReadFull(conn, b[:2]); err != nil {
+		return 0, "", err
+	}
+	if b[0] != socks5Version {
+		return 0, "", fmt.Errorf("unexpected protocol version %d", b[0])
+	}
+
+	methods := b[2 : 2+int(b[1])]
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return 0, "", err
+	}
+	if bytes.IndexByte(methods, socks5AuthNone) < 0 {
+		conn.Write([]byte{socks5Version, socks5AuthNoAccept})
+		return 0, "", errors.New("no acceptable authentication methods")
+	}
+	if _, err := conn.Write([]byte{socks5Version, socks5AuthNone}); err != nil {
+		return 0, "", err
+	}
+
+	if _, err := io.ReadFull(conn, b[:4]); err != nil {
+		return 0, "", err
+	}
+	cmd := b[1]
+
+	host, err := socks5ReadAddr(conn, b[3])
+	if err != nil {
+		if err == errSocks5Atyp {
+			socks5Reply(conn, socks5RepAtypNotSupp, nil)
+		} else {
+			socks5Reply(conn, socks5RepFailure, nil)
+		}
+		return 0, "", err
+	}
+
+	if _, err := io.ReadFull(conn, b[:2]); err != nil {
+		return 0, "", err
+	}
+
+	return cmd, net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(b[:2])))), nil
+}
+
+func socks5ReadAddr(r io.Reader, atyp byte) (string, error) {
+	var n int
+	switch atyp {
+	case socks5AtypIPv4:
+		n = net.IPv4len
+	case socks5AtypIPv6:
+		n = net.IPv6len
+	case socks5AtypDomain:
+		b := make([]byte, 1)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		n = int(b[0])
+	default:
+		return "", errSocks5Atyp
+	}
+
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+
+	if atyp == socks5AtypDomain {
+		// the domain goes into the request line of a http CONNECT
+		if len(b) == 0 || bytes.IndexFunc(b, func(r rune) bool { return r <= ' ' || r == 0x7f }) >= 0 {
+			return "", fmt.Errorf("invalid domain %q", b)
+		}
+		return string(b), nil
+	}
+	return net.IP(b).String(), nil
+}
+
+func socks5AppendAddr(b []byte, addr *net.UDPAddr) []byte {
+	if addr == nil {
+		return append(b, socks5AtypIPv4, 0, 0, 0, 0, 0, 0)
+	}
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		b = append(b, socks5AtypIPv4)
+		b = append(b, ip4...)
+	} else {
+		b = append(b, socks5AtypIPv6)
+		b = append(b, addr.IP.To16()...)
+	}
+	return append(b, byte(addr.Port>>8), byte(addr.Port))
+}
+
+func socks5Reply(w io.Writer, rep byte, bind *net.UDPAddr) error {
+	_, err := w.Write(socks5AppendAddr([]byte{socks5Version, rep, 0}, bind))
+	return err
+}
+
+// socks5Conn feeds a http CONNECT preface to the http server, and turns its
+// response into the SOCKS5 reply.
+type socks5Conn struct {
+	net.Conn
+	r       io.Reader
+	mu      sync.Mutex
+	replied bool
+	buf     []byte
+}
+
+func (c *socks5Conn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *socks5Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.replied {
+		return c.Conn.Write(b)
+	}
+
+	c.buf = append(c.buf, b...)
+	i := bytes.Index(c.buf, []byte("\r\n\r\n"))
+	if i < 0 {
+		if len(c.buf) > 64*1024 {
+			return 0, errors.New("socks5Conn: CONNECT response too large")
+		}
+		return len(b), nil
+	}
+
+	c.replied = true
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(c.buf[:i+4])), nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		socks5Reply(c.Conn, socks5RepFailure, nil)
+		c.Conn.Close()
+		return 0, fmt.Errorf("socks5Conn: CONNECT failed: %v", err)
+	}
+
+	if err := socks5Reply(c.Conn, socks5RepSucceeded, nil); err != nil {
+		return 0, err
+	}
+
+	if rest := c.buf[i+4:]; len(rest) > 0 {
+		if _, err := c.Conn.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+	c.buf = nil
+
+	return len(b), nil
+}
@@ -0,0 +1,110 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+
+	"./helpers"
+)
+
+// socks5Listener hands the connections added by serveSocks5Conn to the test.
+type socks5Listener struct {
+	helpers.Listener
+	conns chan net.Conn
+}
+
+func (ln *socks5Listener) Add(c net.Conn) error {
+	ln.conns <- c
+	return nil
+}
+
+func socks5Request(cmd, atyp byte, addr []byte) []byte {
+	b := []byte{socks5Version, 1, socks5AuthNone, socks5Version, cmd, 0, atyp}
+	b = append(b, addr...)
+	return append(b, 0x01, 0xbb)
+}
+
+func TestSocks5Handshake(t *testing.T) {
+	cases := []struct {
+		name    string
+		request []byte
+		cmd     byte
+		address string
+		ok      bool
+	}{
+		{"ipv4", socks5Request(socks5CmdConnect, socks5AtypIPv4, []byte{127, 0, 0, 1}), socks5CmdConnect, "127.0.0.1:443", true},
+		{"domain", socks5Request(socks5CmdConnect, socks5AtypDomain, append([]byte{11}, "example.org"...)), socks5CmdConnect, "example.org:443", true},
+		{"control char", socks5Request(socks5CmdConnect, socks5AtypDomain, append([]byte{13}, "example.org\r\n"...)), 0, "", false},
+		{"no auth method", []byte{socks5Version, 1, 0x02}, 0, "", false},
+	}
+
+	for _, c := range cases {
+		client, server := net.Pipe()
+		go client.Write(c.request)
+		go io.Copy(ioutil.Discard, client)
+		cmd, address, err := socks5Handshake(server)
+		if (err == nil) != c.ok || cmd != c.cmd || address != c.address {
+			t.Errorf("%s: socks5Handshake returns (%d, %#v, %v)", c.name, cmd, address, err)
+		}
+		server.Close()
+		client.Close()
+	}
+}
+
+func TestServeSocks5Conn(t *testing.T) {
+	ln := &socks5Listener{conns: make(chan net.Conn, 1)}
+
+	// UDP ASSOCIATE is refused
+	client, server := net.Pipe()
+	go serveSocks5Conn(server, ln)
+	go client.Write(socks5Request(socks5CmdUDP, socks5AtypIPv4, []byte{0, 0, 0, 0}))
+	b, _ := ioutil.ReadAll(client)
+	if !bytes.HasPrefix(b, []byte{socks5Version, socks5AuthNone, socks5Version, socks5RepCmdNotSupp}) {
+		t.Errorf("UDP ASSOCIATE replies %x", b)
+	}
+	client.Close()
+
+	// CONNECT goes to ln as a http CONNECT, and its response becomes the reply
+	client, server = net.Pipe()
+	defer client.Close()
+	go serveSocks5Conn(server, ln)
+	go client.Write(socks5Request(socks5CmdConnect, socks5AtypDomain, append([]byte{11}, "example.org"...)))
+
+	if _, err := io.ReadFull(client, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+
+	c := <-ln.conns
+	defer c.Close()
+	br := bufio.NewReader(c)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Method != http.MethodConnect || req.Host != "example.org:443" {
+		t.Fatalf("socks5 CONNECT is turned into %s %s", req.Method, req.Host)
+	}
+
+	go c.Write([]byte("HTTP/1.1 200 OK\r\n\r\nhello"))
+	b = make([]byte, 10+5)
+	if _, err := io.ReadFull(client, b); err != nil {
+		t.Fatal(err)
+	}
+	if b[1] != socks5RepSucceeded || string(b[10:]) != "hello" {
+		t.Errorf("CONNECT replies %q", b)
+	}
+
+	go client.Write([]byte("world"))
+	b = make([]byte, 5)
+	if _, err := io.ReadFull(br, b); err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "world" {
+		t.Errorf("the relay reads %q", b)
+	}
+}
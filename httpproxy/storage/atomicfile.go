@@ -0,0 +1,134 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	checksumSuffix = ".sha256"
+	backupSuffix   = ".bak"
+)
+
+// WriteFileAtomic replaces filename with data so that a power loss leaves
+// either the old or the new content, never a torn file. data is synced to a
+// temporary file which is renamed over filename, and its SHA-256 is kept in
+// filename.sha256. The previous content, if it is intact, is kept in
+// filename.bak for ReadFileVerified to fall back to.
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	if old, err := ioutil.ReadFile(filename); err == nil && verifyChecksum(filename, old) == nil {
+		if err = ReplaceFile(filename+backupSuffix, old, perm); err != nil {
+			return err
+		}
+		if err = ReplaceFile(filename+backupSuffix+checksumSuffix, checksum(old), perm); err != nil {
+			return err
+		}
+	}
+
+	// a crash between the two leaves a checksum mismatch, which falls back
+	// to the backup written above
+	if err := ReplaceFile(filename, data, perm); err != nil {
+		return err
+	}
+	return ReplaceFile(filename+checksumSuffix, checksum(data), perm)
+}
+
+// ReadFileVerified reads filename written by WriteFileAtomic. If its content
+// does not match the checksum, e.g. after a power loss, the backup is read
+// instead and recovered is true. A file without checksum is trusted.
+//
+// check, if not nil, validates the content as well, e.g. parses it. A file
+// which passes check is also trusted on a checksum mismatch, so that hand
+// edits of config files are not reverted.
+func ReadFileVerified(filename string, check func([]byte) error) (data []byte, recovered bool, err error) {
+	data, err = ioutil.ReadFile(filename)
+	if err == nil {
+		if err = verifyFile(filename, data, check); err == nil {
+			return data, false, nil
+		}
+	}
+
+	data1, err1 := ioutil.ReadFile(filename + backupSuffix)
+	if err1 != nil {
+		return nil, false, err
+	}
+	if err1 = verifyFile(filename+backupSuffix, data1, check); err1 != nil {
+		return nil, false, fmt.Errorf("%v, and its backup: %v", err, err1)
+	}
+
+	return data1, true, nil
+}
+
+func verifyFile(filename string, data []byte, check func([]byte) error) error {
+	err := verifyChecksum(filename, data)
+	if check == nil {
+		return err
+	}
+	if err1 := check(data); err1 != nil {
+		return fmt.Errorf("%#v is corrupted: %v", filename, err1)
+	}
+	return nil
+}
+
+// verifyChecksum compares data with filename.sha256, a missing one passes.
+func verifyChecksum(filename string, data []byte) error {
+	sum, err := ioutil.ReadFile(filename + checksumSuffix)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if !bytes.Equal(bytes.TrimSpace(sum), checksum(data)) {
+		return fmt.Errorf("%#v is corrupted: checksum mismatch", filename)
+	}
+
+	return nil
+}
+
+func checksum(data []byte) []byte {
+	sum := sha256.Sum256(data)
+	return []byte(hex.EncodeToString(sum[:]))
+}
+
+// ReplaceFile writes data to a synced temporary file and renames it to
+// filename, for the files which are cheap to rebuild and need no backup.
+func ReplaceFile(filename string, data []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".")
+	if err != nil {
+		return err
+	}
+
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Chmod(f.Name(), perm)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	if err = os.Rename(f.Name(), filename); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+
+	// make the rename itself durable, it is not supported on windows
+	if dir, err := os.Open(filepath.Dir(filename)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	return nil
+}
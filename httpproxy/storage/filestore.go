@@ -2,6 +2,7 @@ package storage
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -99,10 +100,15 @@ func (s *fileStore) GetObject(object string, start, end int64) (Object, error) {
 		return nil, err
 	}
 
-	data, err := ioutil.ReadFile(filename)
+	data, recovered, err := ReadFileVerified(filename, checkObject(object))
 	if err != nil {
 		return nil, err
 	}
+	if recovered {
+		if fi, err = os.Stat(filename + backupSuffix); err != nil {
+			return nil, err
+		}
+	}
 
 	header := http.Header{}
 	header.Set("Last-Modified", fi.ModTime().Format(DateFormat))
@@ -149,22 +155,12 @@ func (s *fileStore) HeadObject(object string) (http.Header, error) {
 func (s *fileStore) PutObject(object string, header http.Header, data io.ReadCloser) error {
 	defer data.Close()
 
-	filename := filepath.Join(s.Dirname, object)
-	tmpname := filename + ".tmp"
 	b, err := ioutil.ReadAll(data)
 	if err != nil {
 		return err
 	}
 
-	if err = ioutil.WriteFile(tmpname, b, defaultFilePerm); err != nil {
-		return err
-	}
-
-	if err = os.Rename(tmpname, filename); err != nil {
-		return err
-	}
-
-	return nil
+	return WriteFileAtomic(filepath.Join(s.Dirname, object), b, defaultFilePerm)
 }
 
 func (s *fileStore) CopyObject(destObject string, srcObject string) error {
@@ -173,7 +169,7 @@ func (s *fileStore) CopyObject(destObject string, srcObject string) error {
 		return err
 	}
 
-	return ioutil.WriteFile(filepath.Join(s.Dirname, destObject), data, defaultFilePerm)
+	return WriteFileAtomic(filepath.Join(s.Dirname, destObject), data, defaultFilePerm)
 }
 
 func (s *fileStore) DeleteObject(object string) error {
@@ -183,5 +179,30 @@ func (s *fileStore) DeleteObject(object string) error {
 		return err
 	}
 
+	for _, suffix := range []string{checksumSuffix, backupSuffix, backupSuffix + checksumSuffix} {
+		os.Remove(filename + suffix)
+	}
+
 	return nil
 }
+
+// checkObject rejects the damage a power loss leaves, an empty or zeroed file
+// or a json config which does not parse. Anything else is trusted even if it
+// does not match its checksum, since the config files are edited by hand.
+func checkObject(object string) func([]byte) error {
+	return func(data []byte) error {
+		if len(bytes.Trim(data, "\x00")) == 0 {
+			return fmt.Errorf("%#v is empty", object)
+		}
+		if path.Ext(object) == ".json" {
+			b, err := ReadJson(bytes.NewReader(data))
+			if err != nil {
+				return err
+			}
+			if !json.Valid(b) {
+				return fmt.Errorf("%#v is not valid json", object)
+			}
+		}
+		return nil
+	}
+}
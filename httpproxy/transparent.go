@@ -0,0 +1,223 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/phuslu/glog"
+
+	"./helpers"
+)
+
+const (
+	// the original destination is the one iptables REDIRECT has rewritten,
+	// read with SO_ORIGINAL_DST
+	TransparentRedirect string = "redirect"
+	// the original destination is the local address of the conn, which the
+	// TPROXY target keeps intact for a socket with IP_TRANSPARENT
+	TransparentTProxy string = "tproxy"
+
+	transparentPeekTimeout time.Duration = 30 * time.Second
+)
+
+var errPeekDone = errors.New("peek done")
+
+// ServeTransparent accepts the connections intercepted by iptables on addr
+// and hands them to ln. A TLS connection becomes a http CONNECT request to
+// the SNI, or the original destination if there is none, so that it goes
+// through the same filter chain as http proxy clients; a plain http one is
+// served as is, the handler takes its Host header as the target.
+func ServeTransparent(addr, mode string, ln helpers.Listener) error {
+	switch mode {
+	case "", TransparentRedirect, TransparentTProxy:
+		break
+	default:
+		return fmt.Errorf("unknown transparent mode %#v, want %#v or %#v", mode, TransparentRedirect, TransparentTProxy)
+	}
+
+	tln, err := listenTransparent(addr, mode == TransparentTProxy)
+	if err != nil {
+		return err
+	}
+
+	glog.Infof("ServeTransparent(%#v) on %s\n", mode, tln.Addr().String())
+
+	for {
+		conn, err := tln.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				time.Sleep(50 * time.Millisecond)
+				continue
+			}
+			return err
+		}
+		if !ln.Allow(conn.RemoteAddr()) {
+			conn.Close()
+			continue
+		}
+		go serveTransparentConn(conn, mode, ln)
+	}
+}
+
+func serveTransparentConn(conn net.Conn, mode string, ln helpers.Listener) {
+	var dst string
+	var err error
+	if mode == TransparentTProxy {
+		dst = conn.LocalAddr().String()
+	} else {
+		dst, err = originalDst(conn)
+	}
+	if err != nil {
+		glog.V(2).Infof("%s \"TRANSPARENT\" original destination error: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	conn.SetReadDeadline(time.Now().Add(transparentPeekTimeout))
+	first := make([]byte, 1)
+	if _, err = io.ReadFull(conn, first); err != nil {
+		conn.Close()
+		return
+	}
+
+	// 0x16 is the record type of a TLS handshake
+	if first[0] != 0x16 {
+		conn.SetReadDeadline(time.Time{})
+		glog.V(2).Infof("%s \"TRANSPARENT HTTP %s\" - -", conn.RemoteAddr(), dst)
+		c := &transparentConn{
+			Conn: conn,
+			r:    io.MultiReader(bytes.NewReader(first), conn),
+		}
+		if err := ln.Add(c); err != nil {
+			conn.Close()
+		}
+		return
+	}
+
+	var hello bytes.Buffer
+	hello.Write(first)
+	name, err := peekServerName(io.TeeReader(conn, &hello), first)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		glog.V(2).Infof("%s \"TRANSPARENT TLS %s\" peek ClientHello error: %v", conn.RemoteAddr(), dst, err)
+		conn.Close()
+		return
+	}
+
+	target := dst
+	if name != "" {
+		_, port, _ := net.SplitHostPort(dst)
+		target = net.JoinHostPort(name, port)
+	}
+
+	glog.V(2).Infof("%s \"TRANSPARENT CONNECT %s\" %s -", conn.RemoteAddr(), target, dst)
+	preface := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", target, target)
+	c := &transparentConn{
+		Conn:    conn,
+		r:       io.MultiReader(bytes.NewReader([]byte(preface)), &hello, conn),
+		connect: true,
+	}
+	if err := ln.Add(c); err != nil {
+		conn.Close()
+	}
+}
+
+// peekServerName reads the ClientHello from r and returns its SNI, first is
+// the byte already read from it.
+func peekServerName(r io.Reader, first []byte) (string, error) {
+	var name string
+	var peeked bool
+	err := tls.Server(&readOnlyConn{r: io.MultiReader(bytes.NewReader(first), r)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name, peeked = hello.ServerName, true
+			return nil, errPeekDone
+		},
+	}).Handshake()
+	if !peeked {
+		return "", err
+	}
+	return name, nil
+}
+
+// readOnlyConn is the conn of peekServerName, whatever the handshake writes
+// back is dropped.
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readOnlyConn) Read(b []byte) (int, error)         { return c.r.Read(b) }
+func (c *readOnlyConn) Write(b []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c *readOnlyConn) Close() error                       { return nil }
+func (c *readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c *readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c *readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c *readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// transparentConn feeds the peeked bytes, after a http CONNECT preface for
+// TLS, to the http server and drops its response to the CONNECT, which the
+// client never asked for.
+type transparentConn struct {
+	net.Conn
+	r       io.Reader
+	connect bool
+
+	mu      sync.Mutex
+	replied bool
+	buf     []byte
+}
+
+func (c *transparentConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *transparentConn) Write(b []byte) (int, error) {
+	if !c.connect {
+		return c.Conn.Write(b)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.replied {
+		return c.Conn.Write(b)
+	}
+
+	c.buf = append(c.buf, b...)
+	i := bytes.Index(c.buf, []byte("\r\n\r\n"))
+	if i < 0 {
+		if len(c.buf) > 64*1024 {
+			return 0, errors.New("transparentConn: CONNECT response too large")
+		}
+		return len(b), nil
+	}
+
+	c.replied = true
+
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(c.buf[:i+4])), nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		c.Conn.Close()
+		if err == nil {
+			err = errors.New(resp.Status)
+		}
+		return 0, fmt.Errorf("transparentConn: CONNECT failed: %v", err)
+	}
+
+	if rest := c.buf[i+4:]; len(rest) > 0 {
+		if _, err := c.Conn.Write(rest); err != nil {
+			return 0, err
+		}
+	}
+	c.buf = nil
+
+	return len(b), nil
+}
@@ -0,0 +1,87 @@
+// +build linux
+
+package httpproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	// SO_ORIGINAL_DST of netfilter, and IP6T_SO_ORIGINAL_DST of ip6tables
+	soOriginalDst = 80
+	// not in package syscall
+	ipv6Transparent = 75
+)
+
+func listenTransparent(addr string, tproxy bool) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if tproxy {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var err error
+			c.Control(func(fd uintptr) {
+				err = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+				if err == nil && network == "tcp6" {
+					err = syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1)
+				}
+			})
+			if err != nil {
+				return os.NewSyscallError("setsockopt IP_TRANSPARENT", err)
+			}
+			return nil
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
+
+func formatSockaddr(ip net.IP, port int) string {
+	return net.JoinHostPort(ip.String(), strconv.Itoa(port))
+}
+
+// originalDst returns the destination of conn before iptables REDIRECT.
+func originalDst(conn net.Conn) (string, error) {
+	tc, ok := conn.(*net.TCPConn)
+	if !ok {
+		return "", fmt.Errorf("%T is not a *net.TCPConn", conn)
+	}
+	rc, err := tc.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+
+	ipv6 := false
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		ipv6 = true
+	}
+
+	// large enough for a sockaddr_in6
+	var b [28]byte
+	var errno syscall.Errno
+	err = rc.Control(func(fd uintptr) {
+		level := syscall.SOL_IP
+		if ipv6 {
+			level = syscall.SOL_IPV6
+		}
+		size := uint32(len(b))
+		_, _, errno = syscall.Syscall6(syscall.SYS_GETSOCKOPT, fd, uintptr(level), soOriginalDst,
+			uintptr(unsafe.Pointer(&b[0])), uintptr(unsafe.Pointer(&size)), 0)
+	})
+	if err != nil {
+		return "", err
+	}
+	if errno != 0 {
+		return "", os.NewSyscallError("getsockopt SO_ORIGINAL_DST", errno)
+	}
+
+	// the port is big endian in both of sockaddr_in and sockaddr_in6
+	port := int(b[2])<<8 | int(b[3])
+	if ipv6 {
+		return formatSockaddr(net.IP(b[8:24]), port), nil
+	}
+	return formatSockaddr(net.IPv4(b[4], b[5], b[6], b[7]), port), nil
+}
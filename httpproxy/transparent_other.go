@@ -0,0 +1,17 @@
+// +build !linux
+
+package httpproxy
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+func listenTransparent(addr string, tproxy bool) (net.Listener, error) {
+	return nil, fmt.Errorf("transparent proxy is not supported on %s", runtime.GOOS)
+}
+
+func originalDst(conn net.Conn) (string, error) {
+	return "", fmt.Errorf("SO_ORIGINAL_DST is not supported on %s", runtime.GOOS)
+}
@@ -4,10 +4,14 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
+	"time"
 
 	"./httpproxy"
+	"./httpproxy/filters"
 	"./httpproxy/helpers"
 )
 
@@ -25,13 +29,90 @@ func main() {
 	if logToStderr {
 		flag.Set("logtostderr", "true")
 	}
+
+	if len(os.Args) > 1 && os.Args[1] == "rankip" {
+		os.Exit(rankIP(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "cert" {
+		os.Exit(certCommand(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "benchmark" {
+		os.Exit(benchmarkCommand(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "report" {
+		os.Exit(reportCommand(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "rules" {
+		os.Exit(rulesCommand(os.Args[2:]))
+	}
+
+	readOnly := flag.Bool("readonly", false, "serve traffic only, refuse admin changes, config reloads and MITM")
+	memLimit := flag.Int("memlimit", 0, "soft memory limit in MB, caches are shrunk and GC is tightened above it")
+	cacheMem := flag.Int("cachemem", 0, "memory budget in MB shared by the dialer caches, 0 keeps their configured sizes")
+	logger := flag.String("logger", "glog", "logger of structured log lines, glog, or zap/zerolog if built with its tag")
+	logSample := flag.Int("logsample", 10, "log at most this many lines of the same message per second, 0 logs all")
 	flag.Parse()
 
+	l, err := helpers.NewLogger(*logger)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+	if *logSample > 0 {
+		l = helpers.NewSampledLogger(l, *logSample, time.Second)
+	}
+	helpers.SetLogger(l)
+
+	filters.SetReadOnly(*readOnly)
+	if filename := os.Getenv("SSLKEYLOGFILE"); filename != "" {
+		helpers.KeyLog.SetFilename(filename)
+		if err := helpers.KeyLog.Enable(); err != nil {
+			fmt.Fprintf(os.Stderr, "SSLKEYLOGFILE %#v error: %s\n", filename, err)
+			os.Exit(1)
+		}
+	}
+	helpers.WatchMemory(int64(*memLimit) << 20)
+	if err := helpers.ManageCaches(int64(*cacheMem) << 20); err != nil {
+		fmt.Fprintf(os.Stderr, "-cachemem error: %s\n", err)
+		os.Exit(1)
+	}
+
 	gover := strings.Split(strings.Replace(runtime.Version(), "devel +", "devel+", 1), " ")[0]
 
 	fmt.Fprintf(os.Stderr, `------------------------------------------------------
 GoProxy Version    : %s (go/%s %s/%s)`,
 		version, gover, runtime.GOOS, runtime.GOARCH)
+	if *readOnly {
+		fmt.Fprintf(os.Stderr, `
+Read Only Mode     : true`)
+	}
+	if *memLimit > 0 {
+		fmt.Fprintf(os.Stderr, `
+Memory Soft Limit  : %d MB`, *memLimit)
+	}
+	if *cacheMem > 0 {
+		fmt.Fprintf(os.Stderr, `
+Cache Memory Budget: %d MB`, *cacheMem)
+	}
+	if filename := helpers.KeyLog.Filename(); filename != "" {
+		fmt.Fprintf(os.Stderr, `
+TLS Key Log File   : %s`, filename)
+	}
+	addrs := make([]string, 0)
+	for _, config := range httpproxy.Config {
+		if config.Enabled {
+			addrs = append(addrs, config.Address, config.Socks5Address)
+			addrs = append(addrs, config.Addresses...)
+		}
+	}
+	for _, c := range helpers.DetectConflicts(addrs) {
+		fmt.Fprintf(os.Stderr, `
+Conflict Detected  : %s`, c)
+	}
 	for profile, config := range httpproxy.Config {
 		if !config.Enabled {
 			continue
@@ -40,10 +121,15 @@ GoProxy Version    : %s (go/%s %s/%s)`,
 GoProxy Profile    : %s
 Listen Address     : %s
 Enabled Filters    : %v`, profile,
-			config.Address,
+			strings.Join(append([]string{config.Address}, config.Addresses...), ", "),
 			fmt.Sprintf("%s|%s|%s", strings.Join(config.RequestFilters, ","), strings.Join(config.RoundTripFilters, ","), strings.Join(config.ResponseFilters, ",")))
+		if config.Socks5Address != "" {
+			fmt.Fprintf(os.Stderr, `
+Socks5 Address     : %s`,
+				config.Socks5Address)
+		}
 		for _, fn := range config.RoundTripFilters {
-			if fn == "autoproxy" {
+			if fn == "autoproxy" && helpers.IsTCPAddress(config.Address) {
 				fmt.Fprintf(os.Stderr, `
 Pac Server         : http://%s/proxy.pac`,
 					config.Address)
@@ -57,5 +143,12 @@ Pac Server         : http://%s/proxy.pac`,
 		helpers.SetConsoleTitle(fmt.Sprintf("GoProxy %s (go/%s)", version, gover))
 	}
 
-	select {}
+	// SIGHUP re-reads the config files of reloadable filters in place
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	for range c {
+		if err := filters.ReloadFilters(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+		}
+	}
 }
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"./httpproxy/dialer"
+	"./httpproxy/filters"
+	"./httpproxy/storage"
+)
+
+type rankIPEntry struct {
+	IP             string  `json:"ip"`
+	LatencyMs      int64   `json:"latency_ms"`
+	CommonName     string  `json:"common_name"`
+	ThroughputKbps float64 `json:"throughput_kbps"`
+	Error          string  `json:"error,omitempty"`
+}
+
+// rankIPResult is the -json output of rankip.
+type rankIPResult struct {
+	Command string        `json:"command"`
+	Filter  string        `json:"filter"`
+	Alias   string        `json:"alias"`
+	Total   int           `json:"total"`
+	Good    int           `json:"good"`
+	Merged  int           `json:"merged"`
+	IPs     []rankIPEntry `json:"ips"`
+}
+
+// rankIP is "goproxy rankip", it handshakes the candidate ips of -in the way
+// the filter dials -alias, writes them ranked as csv, or json with -json, and
+// optionally merges the best ones into the HostMap of the filter.
+func rankIP(args []string) int {
+	fs := flag.NewFlagSet("rankip", flag.ExitOnError)
+	in := fs.String("in", "", "file of candidate ips, separated by newlines, spaces, commas or |")
+	out := fs.String("out", "", "write the ranked csv to this file instead of stdout")
+	filterName := fs.String("filter", "gae", "the filter whose dialer, SNI policies and socket options are used")
+	alias := fs.String("alias", "google_hk", "the alias the ips are ranked for")
+	host := fs.String("host", "www.google.com", "the requested host, which is the SNI of \"match\" policies")
+	port := fs.Int("port", 443, "the port to handshake")
+	sample := fs.String("sample", "", "request this path of -host to sample the throughput, e.g. /")
+	concurrency := fs.Int("c", 32, "the number of concurrent handshakes")
+	timeout := fs.Duration("timeout", 5*time.Second, "the timeout of each ip")
+	top := fs.Int("top", 0, "merge the top N ips into HostMap[alias] of <filter>.user.json")
+	asJSON := fs.Bool("json", false, "write the ranks as json instead of csv")
+	fs.Parse(args)
+
+	if *in == "" {
+		fmt.Fprintf(os.Stderr, "usage: goproxy rankip -in ips.txt [options]\n")
+		fs.PrintDefaults()
+		return 2
+	}
+
+	ips, err := readIPs(*in)
+	if err != nil {
+		return failCommand("rankip", *asJSON, err)
+	}
+
+	f, err := filters.GetFilter(*filterName)
+	if err != nil {
+		return failCommand("rankip", *asJSON, err)
+	}
+	f1, ok := f.(interface {
+		MultiDialer() *dialer.MultiDialer
+	})
+	if !ok || f1.MultiDialer() == nil {
+		return failCommand("rankip", *asJSON, fmt.Errorf("filter %#v has no MultiDialer", *filterName))
+	}
+
+	r := &dialer.IPRanker{
+		MultiDialer: f1.MultiDialer(),
+		Alias:       *alias,
+		Host:        *host,
+		Port:        *port,
+		SamplePath:  *sample,
+		Concurrency: *concurrency,
+		Timeout:     *timeout,
+	}
+	ranks := r.Rank(ips)
+
+	result := rankIPResult{
+		Command: "rankip",
+		Filter:  *filterName,
+		Alias:   *alias,
+		Total:   len(ips),
+		IPs:     make([]rankIPEntry, 0, len(ranks)),
+	}
+	good := make([]string, 0)
+	for _, rank := range ranks {
+		entry := rankIPEntry{
+			IP:             rank.IP,
+			LatencyMs:      int64(rank.Latency / time.Millisecond),
+			CommonName:     rank.CommonName,
+			ThroughputKbps: math.Round(rank.Throughput / 1024),
+		}
+		if rank.Err != nil {
+			entry.Error = rank.Err.Error()
+		} else {
+			good = append(good, rank.IP)
+		}
+		result.IPs = append(result.IPs, entry)
+	}
+	result.Good = len(good)
+
+	if *top > 0 && len(good) > 0 {
+		if len(good) > *top {
+			good = good[:*top]
+		}
+		if err = mergeHostMap(*filterName, *alias, good); err != nil {
+			return failCommand("rankip", *asJSON, err)
+		}
+		result.Merged = len(good)
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		file, err := os.Create(*out)
+		if err != nil {
+			return failCommand("rankip", *asJSON, err)
+		}
+		defer file.Close()
+		w = file
+	}
+
+	if *asJSON {
+		e := json.NewEncoder(w)
+		e.SetIndent("", "  ")
+		if err = e.Encode(result); err != nil {
+			return failCommand("rankip", *asJSON, err)
+		}
+		return 0
+	}
+
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"ip", "latency_ms", "common_name", "throughput_kbps", "error"})
+	for _, entry := range result.IPs {
+		cw.Write([]string{
+			entry.IP,
+			fmt.Sprintf("%d", entry.LatencyMs),
+			entry.CommonName,
+			fmt.Sprintf("%.0f", entry.ThroughputKbps),
+			entry.Error,
+		})
+	}
+	cw.Flush()
+	if err = cw.Error(); err != nil {
+		return failCommand("rankip", false, err)
+	}
+
+	fmt.Fprintf(os.Stderr, "rankip: %d of %d ips handshaked with alias %#v\n", result.Good, result.Total, *alias)
+	if result.Merged > 0 {
+		fmt.Fprintf(os.Stderr, "rankip: merged %d ips into HostMap[%#v] of %s.user.json\n", result.Merged, *alias, *filterName)
+	}
+
+	return 0
+}
+
+func readIPs(filename string) ([]string, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		for _, s := range strings.FieldsFunc(line, func(c rune) bool {
+			return c == ' ' || c == '\t' || c == '\r' || c == ',' || c == '|'
+		}) {
+			if net.ParseIP(s) == nil {
+				return nil, fmt.Errorf("%s: invalid ip %#v", filename, s)
+			}
+			if !seen[s] {
+				seen[s] = true
+				ips = append(ips, s)
+			}
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, fmt.Errorf("%s: no ips", filename)
+	}
+
+	return ips, nil
+}
+
+// mergeHostMap replaces HostMap[alias] of the user config of filterName with
+// ips, the other settings of it are kept but its comments are not.
+func mergeHostMap(filterName, alias string, ips []string) error {
+	store, err := storage.OpenURI(storage.LookupConfigStoreURI(filterName))
+	if err != nil {
+		return err
+	}
+
+	filename := filterName + ".user.json"
+	config := make(map[string]interface{})
+	if object, err := store.GetObject(filename, -1, -1); err == nil {
+		rc := object.Body()
+		data, err := storage.ReadJson(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		d := json.NewDecoder(bytes.NewReader(data))
+		d.UseNumber()
+		if err = d.Decode(&config); err != nil {
+			return fmt.Errorf("%s: %v", filename, err)
+		}
+	}
+
+	hostMap, _ := config["HostMap"].(map[string]interface{})
+	if hostMap == nil {
+		hostMap = make(map[string]interface{})
+	}
+	hostMap[alias] = ips
+	config["HostMap"] = hostMap
+
+	data, err := json.MarshalIndent(config, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return store.PutObject(filename, http.Header{}, ioutil.NopCloser(bytes.NewReader(data)))
+}
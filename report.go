@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"./httpproxy/dialer"
+	"./httpproxy/filters"
+)
+
+// reportIPsResult is the -json output of report ips.
+type reportIPsResult struct {
+	Command string             `json:"command"`
+	Filter  string             `json:"filter"`
+	Source  string             `json:"source"`
+	IPs     []dialer.AddrScore `json:"ips"`
+}
+
+// reportCommand is "goproxy report ips", it prints the scores of the addrs
+// the dialer of a filter has dialed, see MultiDialer.ScoreReport, to guide
+// the curation of HostMap. They are fetched from the admin api of a running
+// goproxy with -admin, or else taken from the ConnCache file of the filter.
+func reportCommand(args []string) int {
+	if len(args) == 0 || args[0] != "ips" {
+		fmt.Fprintf(os.Stderr, "usage: goproxy report ips [options]\n")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("report ips", flag.ExitOnError)
+	filterName := fs.String("filter", "gae", "the filter whose dialer is reported")
+	admin := fs.String("admin", "", "the admin api of a running goproxy, e.g. http://127.0.0.1:8087/admin/api/")
+	sortKey := fs.String("sort", "latency", "sort by latency, errors, lastseen, addr or alias")
+	alias := fs.String("alias", "", "only report the addrs of this alias")
+	asJSON := fs.Bool("json", false, "write the report as json instead of a table")
+	fs.Parse(args[1:])
+
+	result := reportIPsResult{
+		Command: "report",
+		Filter:  *filterName,
+	}
+
+	if *admin != "" {
+		u := strings.TrimSuffix(*admin, "/") + "/" + *filterName + "/scores?" + url.Values{"alias": {*alias}}.Encode()
+		scores, err := fetchScores(u)
+		if err != nil {
+			return failCommand("report", *asJSON, err)
+		}
+		result.Source = u
+		result.IPs = scores
+	} else {
+		f, err := filters.GetFilter(*filterName)
+		if err != nil {
+			return failCommand("report", *asJSON, err)
+		}
+		f1, ok := f.(interface {
+			MultiDialer() *dialer.MultiDialer
+		})
+		if !ok || f1.MultiDialer() == nil {
+			return failCommand("report", *asJSON, fmt.Errorf("filter %#v has no MultiDialer", *filterName))
+		}
+		result.Source = "conncache"
+		result.IPs = make([]dialer.AddrScore, 0)
+		for _, s := range f1.MultiDialer().ScoreReport() {
+			if *alias == "" || s.Alias == *alias {
+				result.IPs = append(result.IPs, s)
+			}
+		}
+	}
+
+	if err := dialer.SortAddrScores(result.IPs, *sortKey); err != nil {
+		return failCommand("report", *asJSON, err)
+	}
+
+	if *asJSON {
+		writeJSON(result)
+		return 0
+	}
+
+	if err := dialer.WriteAddrScores(os.Stdout, result.IPs); err != nil {
+		return failCommand("report", false, err)
+	}
+	if len(result.IPs) == 0 && *admin == "" {
+		fmt.Fprintf(os.Stderr, "report: no addrs in the ConnCache of %s, try -admin against a running goproxy\n", *filterName)
+	}
+
+	return 0
+}
+
+func fetchScores(u string) ([]dialer.AddrScore, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		json.NewDecoder(resp.Body).Decode(&e)
+		return nil, fmt.Errorf("GET %s: %s %s", u, resp.Status, e.Error)
+	}
+
+	scores := make([]dialer.AddrScore, 0)
+	if err := json.NewDecoder(resp.Body).Decode(&scores); err != nil {
+		return nil, fmt.Errorf("GET %s: %v", u, err)
+	}
+	return scores, nil
+}
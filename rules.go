@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"./httpproxy"
+	"./httpproxy/storage"
+)
+
+// ruleFixture is a case of a rules test file, which is a json list of them,
+// comments allowed, e.g.
+//
+//	[
+//		{"URL": "https://www.google.com/", "Egress": "gae"},
+//		{"URL": "https://www.baidu.com/", "Egress": "direct"},
+//		// a request for goproxy itself
+//		{"URL": "http://127.0.0.1:8087/proxy.pac", "Egress": "autoproxy"},
+//		{"URL": "https://echo.websocket.org/", "Header": {"Upgrade": "websocket", "Connection": "Upgrade"}, "Egress": "websocket"}
+//	]
+//
+// Egress is the expected egress, "" if no filter takes the request. Filters,
+// if not empty, is the expected list of the filters the request is offered
+// to, up to the egress one.
+type ruleFixture struct {
+	Name    string `json:",omitempty"`
+	Method  string `json:",omitempty"`
+	URL     string
+	Header  map[string]string `json:",omitempty"`
+	Egress  string
+	Filters []string `json:",omitempty"`
+}
+
+type ruleResult struct {
+	ruleFixture
+	OK           bool
+	ActualEgress string
+	ActualRoute  []string
+	Unknown      []string `json:",omitempty"`
+	Error        string   `json:",omitempty"`
+}
+
+// rulesTestResult is the -json output of rules test.
+type rulesTestResult struct {
+	Command string       `json:"command"`
+	Profile string       `json:"profile"`
+	File    string       `json:"file"`
+	Passed  int          `json:"passed"`
+	Failed  int          `json:"failed"`
+	Results []ruleResult `json:"results"`
+}
+
+// rulesCommand is "goproxy rules test", it routes the requests of a fixture
+// file through the loaded config, see httpproxy.RouteRequest, and reports the
+// ones whose egress is not the expected one. It exits 1 on any mismatch, so
+// that a refactoring of the Sites and the filter lists of a profile can be
+// checked before it is deployed.
+func rulesCommand(args []string) int {
+	if len(args) == 0 || args[0] != "test" {
+		fmt.Fprintf(os.Stderr, "usage: goproxy rules test [options] FIXTURES.json\n")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("rules test", flag.ExitOnError)
+	profile := fs.String("profile", "Default", "the profile of httpproxy.json whose RoundTripFilters route the requests")
+	verbose := fs.Bool("v", false, "list the passed cases too")
+	asJSON := fs.Bool("json", false, "write the results as json instead of a table")
+	fs.Parse(args[1:])
+
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "usage: goproxy rules test [options] FIXTURES.json\n")
+		return 2
+	}
+
+	fixtures, err := readRuleFixtures(fs.Arg(0))
+	if err != nil {
+		return failCommand("rules", *asJSON, err)
+	}
+
+	result := rulesTestResult{
+		Command: "rules",
+		Profile: *profile,
+		File:    fs.Arg(0),
+		Results: make([]ruleResult, 0, len(fixtures)),
+	}
+	for _, fixture := range fixtures {
+		r, err := runRuleFixture(*profile, fixture)
+		if err != nil {
+			return failCommand("rules", *asJSON, err)
+		}
+		if r.OK {
+			result.Passed++
+		} else {
+			result.Failed++
+		}
+		result.Results = append(result.Results, r)
+	}
+
+	if *asJSON {
+		writeJSON(result)
+	} else {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "RESULT\tCASE\tEXPECTED\tACTUAL\tROUTE")
+		for _, r := range result.Results {
+			if r.OK && !*verbose {
+				continue
+			}
+			status := "ok"
+			switch {
+			case r.Error != "":
+				status = "ERROR"
+			case !r.OK:
+				status = "FAIL"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", status, r.caseName(), orNone(r.Egress), orNone(r.ActualEgress), strings.Join(r.ActualRoute, ","))
+		}
+		tw.Flush()
+		fmt.Fprintf(os.Stdout, "%d passed, %d failed\n", result.Passed, result.Failed)
+		if unknown := unknownFilters(result.Results); len(unknown) > 0 {
+			fmt.Fprintf(os.Stderr, "rules: %s cannot tell a route, they are taken as passing every request on\n", strings.Join(unknown, ", "))
+		}
+	}
+
+	if result.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func readRuleFixtures(filename string) ([]ruleFixture, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := storage.ReadJson(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	fixtures := make([]ruleFixture, 0)
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	for i, fixture := range fixtures {
+		if fixture.URL == "" {
+			return nil, fmt.Errorf("%s: case #%d has no URL", filename, i+1)
+		}
+	}
+	return fixtures, nil
+}
+
+// runRuleFixture makes the request of fixture as a client of profile would,
+// a request for an address of profile is one for goproxy itself and has a
+// relative RequestURI, and routes it. A request which cannot be made is a
+// failed case, an error is of the config.
+func runRuleFixture(profile string, fixture ruleFixture) (ruleResult, error) {
+	r := ruleResult{ruleFixture: fixture}
+
+	method := fixture.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	req, err := http.NewRequest(method, fixture.URL, nil)
+	if err != nil {
+		r.Error = err.Error()
+		return r, nil
+	}
+	for key, value := range fixture.Header {
+		req.Header.Set(key, value)
+	}
+	req.RemoteAddr = "127.0.0.1:0"
+	if httpproxy.IsProfileAddr(profile, req.URL.Host) {
+		req.RequestURI = req.URL.RequestURI()
+	} else {
+		req.RequestURI = req.URL.String()
+	}
+
+	route, err := httpproxy.RouteRequest(profile, req)
+	if err != nil {
+		return r, err
+	}
+
+	r.ActualEgress = route.Egress
+	r.ActualRoute = route.Filters
+	r.Unknown = route.Unknown
+	r.OK = r.ActualEgress == fixture.Egress
+	if len(fixture.Filters) > 0 && strings.Join(fixture.Filters, ",") != strings.Join(route.Filters, ",") {
+		r.OK = false
+	}
+	return r, nil
+}
+
+func (r ruleResult) caseName() string {
+	if r.Name != "" {
+		return r.Name
+	}
+	if r.Method != "" && r.Method != http.MethodGet {
+		return r.Method + " " + r.URL
+	}
+	return r.URL
+}
+
+func unknownFilters(results []ruleResult) []string {
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+	for _, r := range results {
+		for _, name := range r.Unknown {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}